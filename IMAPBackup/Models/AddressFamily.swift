@@ -0,0 +1,27 @@
+import Foundation
+import Network
+
+/// IP version used to reach an account's server
+enum AddressFamily: String, Codable, CaseIterable {
+    /// Whatever the resolver offers, IPv6 and IPv4 raced by the system
+    case automatic = "auto"
+    /// IPv4 only, for dual-stack networks whose IPv6 path is broken and hangs until the timeout
+    case ipv4
+    case ipv6
+
+    var displayName: String {
+        switch self {
+        case .automatic: return "Automatic"
+        case .ipv4: return "IPv4 Only"
+        case .ipv6: return "IPv6 Only"
+        }
+    }
+
+    var ipVersion: NWProtocolIP.Options.Version {
+        switch self {
+        case .automatic: return .any
+        case .ipv4: return .v4
+        case .ipv6: return .v6
+        }
+    }
+}
@@ -0,0 +1,110 @@
+import Foundation
+
+/// How risky an archived attachment is to open, judged from its extension and content type.
+/// Only a hint for the browser and manifests; nothing is blocked or removed because of it.
+enum AttachmentRisk: String, Codable, CaseIterable {
+    /// Documents, images and text that open in a viewer (pdf, png, txt, docx, ...)
+    case safe
+    /// Unknown types and containers such as archives, whose contents cannot be judged
+    case caution
+    /// Executables, scripts and macro-enabled Office documents
+    case dangerous
+
+    var displayName: String {
+        switch self {
+        case .safe: return "Safe to open"
+        case .caution: return "Unknown type"
+        case .dangerous: return "Potentially dangerous"
+        }
+    }
+
+    /// Classify by the last extension of the filename and the MIME type.
+    /// Either one marking the attachment dangerous wins, so "invoice.pdf.exe" or a .pdf sent as
+    /// application/x-msdownload is dangerous. Safe needs a safe extension whose content type does not
+    /// contradict it.
+    static func classify(filename: String, contentType: String?) -> AttachmentRisk {
+        let ext = (filename as NSString).pathExtension.lowercased()
+        let type = contentType.map(baseType) ?? ""
+
+        if dangerousExtensions.contains(ext) || isDangerous(contentType: type) {
+            return .dangerous
+        }
+        if safeExtensions.contains(ext) && (type.isEmpty || isGeneric(contentType: type) || isSafe(contentType: type)) {
+            return .safe
+        }
+        if ext.isEmpty && isSafe(contentType: type) {
+            return .safe
+        }
+        return .caution
+    }
+
+    // MARK: - Extensions
+
+    private static let dangerousExtensions: Set<String> = [
+        // Windows executables and installers
+        "exe", "scr", "com", "pif", "msi", "msp", "dll", "cpl", "sys", "lnk", "reg", "inf", "gadget",
+        // Scripts
+        "bat", "cmd", "js", "jse", "vbs", "vbe", "wsf", "wsh", "ps1", "psm1", "hta", "sh", "command",
+        // Other runnable packages
+        "jar", "app", "pkg", "dmg", "apk", "iso", "img", "vhd",
+        // Macro-enabled Office documents and add-ins
+        "docm", "dotm", "xlsm", "xltm", "xlam", "pptm", "potm", "ppam", "ppsm", "sldm",
+    ]
+
+    private static let safeExtensions: Set<String> = [
+        "pdf",
+        "jpg", "jpeg", "png", "gif", "heic", "heif", "webp", "bmp", "tif", "tiff",
+        "txt", "csv", "md", "rtf", "ics", "vcf",
+        "doc", "docx", "xls", "xlsx", "ppt", "pptx", "odt", "ods", "odp", "pages", "numbers", "key",
+        "mp3", "m4a", "wav", "aac", "mp4", "mov",
+    ]
+
+    // MARK: - Content Types
+
+    private static func baseType(_ contentType: String) -> String {
+        let base = contentType.split(separator: ";", maxSplits: 1).first.map(String.init) ?? contentType
+        return base.trimmingCharacters(in: .whitespaces).lowercased()
+    }
+
+    private static func isDangerous(contentType: String) -> Bool {
+        if contentType.contains("macroenabled") {
+            return true
+        }
+        return [
+            "application/x-msdownload", "application/x-msdos-program", "application/x-dosexec",
+            "application/x-executable", "application/x-ms-installer", "application/x-msi",
+            "application/vnd.microsoft.portable-executable", "application/hta",
+            "application/javascript", "application/x-javascript", "text/javascript",
+            "application/x-sh", "application/x-csh", "text/x-sh",
+            "application/x-bat", "application/x-vbscript", "text/vbscript",
+            "application/java-archive", "application/x-java-archive",
+            "application/vnd.android.package-archive", "application/x-apple-diskimage",
+        ].contains(contentType)
+    }
+
+    private static func isSafe(contentType: String) -> Bool {
+        if contentType == "image/svg+xml" {
+            // SVG can carry scripts
+            return false
+        }
+        if contentType.hasPrefix("image/") || contentType.hasPrefix("audio/") || contentType.hasPrefix("video/") {
+            return true
+        }
+        return [
+            "application/pdf", "text/plain", "text/csv", "text/calendar", "text/vcard", "text/x-vcard",
+            "text/markdown", "application/rtf", "text/rtf",
+            "application/msword", "application/vnd.ms-excel", "application/vnd.ms-powerpoint",
+            "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+            "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+            "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+            "application/vnd.oasis.opendocument.text", "application/vnd.oasis.opendocument.spreadsheet",
+            "application/vnd.oasis.opendocument.presentation",
+        ].contains(contentType)
+    }
+
+    /// Types mail clients use when they do not know better, which say nothing against the extension
+    private static func isGeneric(contentType: String) -> Bool {
+        contentType == "application/octet-stream" || contentType == "application/x-unknown"
+            || contentType == "application/unknown" || contentType == "binary/octet-stream"
+    }
+}
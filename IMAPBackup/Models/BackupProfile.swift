@@ -0,0 +1,85 @@
+import Foundation
+
+/// Named subsets of accounts, e.g. "work" and "personal", that can be backed up on their own
+struct BackupProfiles: Codable, Equatable {
+    /// Profile name -> account email addresses
+    var profiles: [String: [String]] = [:]
+
+    var names: [String] {
+        profiles.keys.sorted { $0.localizedCaseInsensitiveCompare($1) == .orderedAscending }
+    }
+
+    /// Accounts of a profile, in the order they are configured.
+    /// Throws if the profile does not exist or names an account that is not configured.
+    func accounts(for profile: String, in accounts: [EmailAccount]) throws -> [EmailAccount] {
+        guard let emails = profiles[profile] else {
+            throw BackupProfileError.unknownProfile(profile)
+        }
+
+        let missing = Self.unknownEmails(emails, in: accounts)
+        guard missing.isEmpty else {
+            throw BackupProfileError.unknownAccounts(profile: profile, emails: missing)
+        }
+
+        let wanted = Set(emails.map { $0.lowercased() })
+        return accounts.filter { wanted.contains($0.email.lowercased()) }
+    }
+
+    /// Accounts picked by email address for a one-off backup, in the order they are configured.
+    /// No names selects every account; throws if a name is not configured.
+    static func accounts(named emails: [String], in accounts: [EmailAccount]) throws -> [EmailAccount] {
+        guard !emails.isEmpty else { return accounts }
+
+        let missing = unknownEmails(emails, in: accounts)
+        guard missing.isEmpty else {
+            throw BackupProfileError.unknownSelectedAccounts(missing)
+        }
+
+        let wanted = Set(emails.map { $0.lowercased() })
+        return accounts.filter { wanted.contains($0.email.lowercased()) }
+    }
+
+    /// One problem per profile that references accounts which are not configured
+    func validate(against accounts: [EmailAccount]) -> [BackupProfileError] {
+        names.compactMap { name in
+            let missing = Self.unknownEmails(profiles[name] ?? [], in: accounts)
+            return missing.isEmpty ? nil : .unknownAccounts(profile: name, emails: missing)
+        }
+    }
+
+    private static func unknownEmails(_ emails: [String], in accounts: [EmailAccount]) -> [String] {
+        let configured = Set(accounts.map { $0.email.lowercased() })
+        return emails.filter { !configured.contains($0.lowercased()) }
+    }
+
+    // MARK: - Files
+
+    /// Load profiles from a JSON file: {"profiles": {"work": ["me@work.example"]}}
+    static func load(from url: URL) throws -> BackupProfiles {
+        let data = try Data(contentsOf: url)
+        return try JSONDecoder().decode(BackupProfiles.self, from: data)
+    }
+
+    func write(to url: URL) throws {
+        let encoder = JSONEncoder()
+        encoder.outputFormatting = [.prettyPrinted, .sortedKeys]
+        try encoder.encode(self).write(to: url, options: .atomic)
+    }
+}
+
+enum BackupProfileError: LocalizedError, Equatable {
+    case unknownProfile(String)
+    case unknownAccounts(profile: String, emails: [String])
+    case unknownSelectedAccounts([String])
+
+    var errorDescription: String? {
+        switch self {
+        case .unknownProfile(let name):
+            return "There is no backup profile named \"\(name)\""
+        case .unknownAccounts(let profile, let emails):
+            return "Profile \"\(profile)\" refers to accounts that are not configured: \(emails.joined(separator: ", "))"
+        case .unknownSelectedAccounts(let emails):
+            return "No account is configured for \(emails.joined(separator: ", "))"
+        }
+    }
+}
@@ -0,0 +1,50 @@
+import Foundation
+
+/// Which server messages a backup looks at
+enum BackupSince: Equatable {
+    /// Every message in each folder
+    case all
+    /// Messages since the account's last successful backup, or all of them when there was none
+    case lastRun
+    /// Messages since a fixed day
+    case date(Date)
+
+    /// Parse "all", "last-run" or a yyyy-MM-dd day, as given with `-BackupSince`
+    init?(argument: String) {
+        switch argument.trimmingCharacters(in: .whitespaces).lowercased() {
+        case "all":
+            self = .all
+        case "last-run":
+            self = .lastRun
+        default:
+            guard let date = Self.dayFormatter.date(from: argument.trimmingCharacters(in: .whitespaces)) else {
+                return nil
+            }
+            self = .date(date)
+        }
+    }
+
+    var argument: String {
+        switch self {
+        case .all: return "all"
+        case .lastRun: return "last-run"
+        case .date(let date): return Self.dayFormatter.string(from: date)
+        }
+    }
+
+    /// SEARCH SINCE date for an account, nil to search everything
+    func resolve(for account: EmailAccount) -> Date? {
+        switch self {
+        case .all: return nil
+        case .lastRun: return account.lastSuccessfulBackupDate
+        case .date(let date): return date
+        }
+    }
+
+    private static let dayFormatter: DateFormatter = {
+        let formatter = DateFormatter()
+        formatter.locale = Locale(identifier: "en_US_POSIX")
+        formatter.dateFormat = "yyyy-MM-dd"
+        return formatter
+    }()
+}
@@ -1,4 +1,5 @@
 import Foundation
+import Combine
 
 /// Represents the current state of a backup operation
 struct BackupProgress: Identifiable {
@@ -79,12 +80,199 @@ struct BackupError: Identifiable {
     let message: String
     let folder: String?
     let email: String?
+    let kind: FailureKind
 
-    init(message: String, folder: String? = nil, email: String? = nil) {
+    init(message: String, folder: String? = nil, email: String? = nil, kind: FailureKind = .other) {
         self.id = UUID()
         self.timestamp = Date()
         self.message = message
         self.folder = folder
         self.email = email
+        self.kind = kind
+    }
+}
+
+/// Work left over when a backup had to stop early, so the next run continues there first
+struct BackupCheckpoint: Codable, Equatable {
+    struct PendingFolder: Codable, Equatable {
+        let path: String
+        let uids: [UInt32]
+    }
+
+    let createdAt: Date
+    let reason: String
+    let folders: [PendingFolder]
+
+    var remainingCount: Int {
+        folders.reduce(0) { $0 + $1.uids.count }
+    }
+}
+
+/// Every folder's saved UIDs of one account in a single file, so a run reads one file instead of
+/// a UID cache per folder. Folders are keyed by their path inside the account directory.
+struct BackupStateIndex: Codable, Equatable {
+    struct Folder: Codable, Equatable {
+        let uidValidity: UInt32
+        var uids: Set<UInt32>
+        /// Every UID was saved under `uidValidity`. False when they were found by scanning the
+        /// files on disk, which may hold UIDs of an earlier UIDVALIDITY.
+        let isVerified: Bool
+
+        init(uidValidity: UInt32, uids: Set<UInt32>, isVerified: Bool) {
+            self.uidValidity = uidValidity
+            self.uids = uids
+            self.isVerified = isVerified
+        }
+
+        enum CodingKeys: String, CodingKey {
+            case uidValidity, uids, isVerified
+        }
+
+        init(from decoder: Decoder) throws {
+            let container = try decoder.container(keyedBy: CodingKeys.self)
+            uidValidity = try container.decode(UInt32.self, forKey: .uidValidity)
+            uids = Set(try container.decode([UInt32].self, forKey: .uids))
+            // Indexes written before this field were all filled by scanning
+            isVerified = try container.decodeIfPresent(Bool.self, forKey: .isVerified) ?? false
+        }
+
+        func encode(to encoder: Encoder) throws {
+            var container = encoder.container(keyedBy: CodingKeys.self)
+            try container.encode(uidValidity, forKey: .uidValidity)
+            // Sorted, so the file only changes where the backup did
+            try container.encode(uids.sorted(), forKey: .uids)
+            try container.encode(isVerified, forKey: .isVerified)
+        }
+    }
+
+    var savedAt: Date?
+    var folders: [String: Folder] = [:]
+}
+
+/// Overview of a backed-up folder, kept in its `_folder.json` so it can be shown without
+/// scanning every email. Rewritten at the end of each folder's backup (opt-in).
+struct FolderSummary: Codable, Equatable {
+    let folder: String
+    var messageCount: Int
+    /// Size of the .eml files
+    var totalBytes: Int64
+    /// Dates of the oldest and newest email, as in their filenames; nil for an empty folder
+    var oldestMessage: Date?
+    var newestMessage: Date?
+    /// UIDVALIDITY the folder's UIDs belong to, when known
+    var uidValidity: UInt32?
+    var lastSync: Date
+}
+
+/// One line of the JSON Lines backup report: a folder as it completes, or the run summary.
+/// Appended as the backup goes, so a killed run still leaves every finished folder on record.
+struct BackupReportRecord: Codable, Equatable {
+    enum Kind: String, Codable {
+        case folder
+        case summary
+    }
+
+    let kind: Kind
+    /// Same for all records of one backup run
+    let runId: UUID
+    let accountEmail: String
+    /// Folder path; nil for the summary
+    var folder: String?
+    let startedAt: Date
+    let finishedAt: Date
+    var downloaded: Int
+    var failed: Int
+    var bytes: Int64
+    var errors: [String]
+    /// Outcome of the run; summary only
+    var status: BackupHistoryStatus?
+    /// Kind of error that ended a failed run; summary only
+    var failureKind: FailureKind?
+    /// UIDs whose download did not match the server-reported size; folder only
+    var quarantined: [UInt32]?
+    /// UIDs that failed after all retries and were skipped; folder only
+    var failedUIDs: [UInt32]?
+    /// Set when the folder was abandoned for exceeding the error threshold; folder only
+    var gaveUp: Bool?
+    /// UIDs saved without a body (header-only or empty on the server), which are not failures; folder only
+    var emptyBodyUIDs: [UInt32]?
+    /// UIDs whose Date header lies far in the future; folder only
+    var futureDatedUIDs: [UInt32]?
+    /// Wall-clock time of the folder's fetch and save; folder only
+    var durationMs: Int?
+    /// Downloaded bytes over `durationMs`; folder only
+    var bytesPerSecond: Int?
+
+    /// Fill in duration and throughput from the start and finish times
+    func withTiming() -> BackupReportRecord {
+        var record = self
+        let duration = finishedAt.timeIntervalSince(startedAt)
+        record.durationMs = Int((duration * 1000).rounded())
+        record.bytesPerSecond = duration > 0 ? Int(Double(bytes) / duration) : nil
+        return record
+    }
+}
+
+/// Result of backing up a single email, for live logs
+struct MessageEvent: Identifiable {
+    let id: UUID
+    let timestamp: Date
+    let accountId: UUID
+    let folder: String
+    let uid: UInt32
+    let subject: String?
+    let savedURL: URL?
+    let bytes: Int64
+    /// Set when the email failed after all retries
+    let error: String?
+
+    init(accountId: UUID, folder: String, uid: UInt32, subject: String? = nil,
+         savedURL: URL? = nil, bytes: Int64 = 0, error: String? = nil) {
+        self.id = UUID()
+        self.timestamp = Date()
+        self.accountId = accountId
+        self.folder = folder
+        self.uid = uid
+        self.subject = subject
+        self.savedURL = savedURL
+        self.bytes = bytes
+        self.error = error
+    }
+
+    var isSuccess: Bool { error == nil }
+}
+
+/// Stream of per-message results, complementing the aggregate BackupProgress.
+/// Events are sent on the main actor, so subscribers see them one at a time and in order
+/// even when several accounts are backed up concurrently.
+@MainActor
+final class MessageEventStream: ObservableObject {
+    /// Maximum number of events kept for display
+    let capacity: Int
+
+    /// Most recent events, oldest first
+    @Published private(set) var recentEvents: [MessageEvent] = []
+
+    private let subject = PassthroughSubject<MessageEvent, Never>()
+
+    /// Every event as it happens
+    var events: AnyPublisher<MessageEvent, Never> {
+        subject.eraseToAnyPublisher()
+    }
+
+    init(capacity: Int = 500) {
+        self.capacity = capacity
+    }
+
+    func send(_ event: MessageEvent) {
+        recentEvents.append(event)
+        if recentEvents.count > capacity {
+            recentEvents.removeFirst(recentEvents.count - capacity)
+        }
+        subject.send(event)
+    }
+
+    func clear() {
+        recentEvents.removeAll()
     }
 }
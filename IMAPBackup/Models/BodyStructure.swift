@@ -0,0 +1,154 @@
+import Foundation
+
+/// A message's MIME tree as the server reports it in BODYSTRUCTURE (RFC 3501 section 7.4.2),
+/// enough to fetch the parts one by one and leave large attachments on the server
+struct BodyStructure: Equatable {
+    /// Section for BODY[<section>], e.g. "2" or "1.3"; empty for the message itself
+    let section: String
+    /// Lowercased type and subtype, e.g. "multipart/mixed" or "application/pdf"
+    let contentType: String
+    /// Size in bytes as transferred, before any content transfer decoding; 0 for multiparts
+    let size: Int
+    /// Lowercased, e.g. "base64"; nil for multiparts
+    let encoding: String?
+    let filename: String?
+    /// Marked as an attachment or given a filename
+    let isAttachment: Bool
+    /// Separator of the parts of a multipart
+    let boundary: String?
+    /// Parts of a multipart; a message/rfc822 part is kept whole and has none
+    let parts: [BodyStructure]
+
+    var isMultipart: Bool {
+        contentType.hasPrefix("multipart/")
+    }
+
+    /// Size once decoded, which is what attachment size limits compare against
+    var decodedSize: Int {
+        encoding == "base64" ? size * 3 / 4 : size
+    }
+
+    /// The structure from the BODYSTRUCTURE item of a FETCH response; nil when it is malformed
+    init?(response: String) {
+        guard let value = EnvelopeParser.parseFetchAttributes(response)["BODYSTRUCTURE"] else { return nil }
+        self.init(value)
+    }
+
+    init?(_ value: IMAPValue, section: String = "") {
+        guard case .list(let items) = value, !items.isEmpty else { return nil }
+        self.section = section
+
+        // Multipart: (part)(part)... "subtype" [(params) [disposition ...]]
+        if case .list = items[0] {
+            var parts: [BodyStructure] = []
+            var index = 0
+            while index < items.count, case .list = items[index] {
+                let partSection = section.isEmpty ? "\(index + 1)" : "\(section).\(index + 1)"
+                guard let part = BodyStructure(items[index], section: partSection) else { return nil }
+                parts.append(part)
+                index += 1
+            }
+            let subtype = index < items.count ? Self.string(items[index])?.lowercased() ?? "mixed" : "mixed"
+            let params = index + 1 < items.count ? Self.parameters(items[index + 1]) : [:]
+            contentType = "multipart/\(subtype)"
+            size = 0
+            encoding = nil
+            filename = nil
+            isAttachment = false
+            boundary = params["boundary"]
+            self.parts = parts
+            return
+        }
+
+        // Single part: "type" "subtype" (params) id description "encoding" size ...
+        guard items.count >= 7, let type = Self.string(items[0]), let subtype = Self.string(items[1]),
+              let size = Self.string(items[6]).flatMap({ Int($0) }) else { return nil }
+        contentType = "\(type)/\(subtype)".lowercased()
+        self.size = size
+        encoding = Self.string(items[5])?.lowercased()
+        boundary = nil
+        parts = []
+
+        // Text parts add a line count, message/rfc822 an envelope, a body and a line count,
+        // before the optional MD5 and disposition
+        let dispositionIndex: Int
+        switch contentType {
+        case _ where contentType.hasPrefix("text/"): dispositionIndex = 9
+        case "message/rfc822": dispositionIndex = 11
+        default: dispositionIndex = 8
+        }
+        var disposition: String?
+        var dispositionParams: [String: String] = [:]
+        if dispositionIndex < items.count, case .list(let fields) = items[dispositionIndex], let kind = fields.first {
+            disposition = Self.string(kind)?.lowercased()
+            dispositionParams = fields.count > 1 ? Self.parameters(fields[1]) : [:]
+        }
+        filename = dispositionParams["filename"] ?? Self.parameters(items[2])["name"]
+        isAttachment = disposition == "attachment" || filename != nil
+    }
+
+    /// Attachments anywhere in the message larger than `limit` decoded bytes
+    func attachments(over limit: Int) -> [BodyStructure] {
+        guard isMultipart else {
+            return isAttachment && !section.isEmpty && decodedSize > limit ? [self] : []
+        }
+        return parts.flatMap { $0.attachments(over: limit) }
+    }
+
+    /// The message rebuilt from its header and parts, each part in `skipped` replaced by a short text
+    /// part from `placeholder`. `fetch` returns BODY[<section>] for "HEADER", "<n>.MIME" and "<n>".
+    /// Text outside the parts, such as a multipart preamble, is not kept.
+    func assemble(
+        skipping skipped: Set<String>,
+        placeholder: (BodyStructure) -> String,
+        fetch: (String) async throws -> Data
+    ) async throws -> Data {
+        var message = try await fetch("HEADER")
+        message += try await body(skipping: skipped, placeholder: placeholder, fetch: fetch)
+        return message
+    }
+
+    private func body(
+        skipping skipped: Set<String>,
+        placeholder: (BodyStructure) -> String,
+        fetch: (String) async throws -> Data
+    ) async throws -> Data {
+        guard isMultipart, let boundary = boundary else {
+            return try await fetch(section.isEmpty ? "TEXT" : section)
+        }
+
+        var data = Data()
+        for part in parts {
+            data += Data("--\(boundary)\r\n".utf8)
+            if skipped.contains(part.section) {
+                data += Data("Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n".utf8)
+                data += Data(placeholder(part).utf8)
+            } else {
+                data += try await fetch("\(part.section).MIME")
+                data += try await part.body(skipping: skipped, placeholder: placeholder, fetch: fetch)
+            }
+            data += Data("\r\n".utf8)
+        }
+        data += Data("--\(boundary)--\r\n".utf8)
+        return data
+    }
+
+    private static func string(_ value: IMAPValue) -> String? {
+        if case .string(let string) = value { return string }
+        return nil
+    }
+
+    /// ("NAME" "value" ...) as lowercased names to values
+    private static func parameters(_ value: IMAPValue) -> [String: String] {
+        guard case .list(let items) = value else { return [:] }
+        var parameters: [String: String] = [:]
+        var index = 0
+        while index + 1 < items.count {
+            if let name = string(items[index]), let value = string(items[index + 1]) {
+                parameters[name.lowercased()] = value
+            }
+            index += 2
+        }
+        return parameters
+    }
+}
@@ -39,6 +39,14 @@ struct Email: Identifiable, Hashable {
         self.size = size
     }
 
+    /// How far ahead of now a Date header may be before it is taken for bogus rather than clock skew
+    static let futureDateTolerance: TimeInterval = 2 * 24 * 60 * 60
+
+    /// Whether `date` lies further in the future than clock skew explains, as spam dates often do
+    static func isFarFuture(_ date: Date, now: Date = Date()) -> Bool {
+        date.timeIntervalSince(now) > futureDateTolerance
+    }
+
     /// Generate filename for this email
     /// Format: <UID>_<timestamp>_<sender>.eml
     func filename() -> String {
@@ -115,3 +123,23 @@ extension String {
         return result
     }
 }
+
+// MARK: - String Extension for Text Sanitization
+
+extension String {
+    /// Decode bytes as UTF-8, replacing invalid sequences with U+FFFD and dropping control characters
+    init(sanitizingUTF8 data: Data) {
+        self = String(decoding: data, as: UTF8.self).strippingControlCharacters()
+    }
+
+    /// Remove control characters except tab and line breaks; they garble display and break some JSON consumers
+    func strippingControlCharacters() -> String {
+        let allowed: Set<Unicode.Scalar> = ["\t", "\n", "\r"]
+        guard unicodeScalars.contains(where: { $0.properties.generalCategory == .control && !allowed.contains($0) }) else {
+            return self
+        }
+        var scalars = String.UnicodeScalarView()
+        scalars.append(contentsOf: unicodeScalars.filter { $0.properties.generalCategory != .control || allowed.contains($0) })
+        return String(scalars)
+    }
+}
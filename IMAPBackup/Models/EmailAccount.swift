@@ -40,6 +40,25 @@ final class TemporaryPassword {
     }
 }
 
+// MARK: - Shared Folder Filter
+
+/// Include/exclude glob patterns (`*`, `?`) for the folders of one shared namespace.
+/// Patterns match the folder name below the namespace prefix, e.g. `bob.Sent` under `user.`.
+struct SharedFolderFilter: Codable, Hashable {
+    /// Empty means every folder is included
+    var include: [String] = []
+    var exclude: [String] = []
+
+    func allows(_ relativeName: String) -> Bool {
+        let included = include.isEmpty || include.contains { Self.matches(relativeName, pattern: $0) }
+        return included && !exclude.contains { Self.matches(relativeName, pattern: $0) }
+    }
+
+    static func matches(_ name: String, pattern: String) -> Bool {
+        fnmatch(pattern, name, 0) == 0
+    }
+}
+
 // MARK: - Authentication Type
 
 /// Authentication type for email accounts
@@ -57,7 +76,33 @@ struct EmailAccount: Identifiable, Codable, Hashable {
     var useSSL: Bool
     var isEnabled: Bool
     var lastBackupDate: Date?
+    /// Start of the last backup that finished without a fatal error or cancellation
+    var lastSuccessfulBackupDate: Date?
     var authType: AuthenticationType
+    /// Server folder path -> local path, consulted before sanitization
+    var folderRemap: [String: String]
+    /// Identify as MailKeep with the ID command when the server supports it
+    var sendClientID: Bool
+    /// Reconnect to the server named in a login REFERRAL (same domain only)
+    var followReferrals: Bool
+    /// Also back up other users' and public folders from the NAMESPACE response
+    var backupSharedFolders: Bool
+    /// Namespace prefix -> filter for its folders
+    var sharedFolderFilters: [String: SharedFolderFilter]
+    /// Keychain service the password was stored under by another tool; tried before MailKeep's own entry
+    var keychainService: String?
+    /// Command printing the password, e.g. `pass show email/work`; used instead of the Keychain when set
+    var passwordCommand: String?
+    /// How emails are fetched; two-phase works around servers that mishandle combined FETCH items
+    var fetchStrategy: FetchStrategy
+    /// IP version the connection is limited to; automatic lets the resolver choose
+    var addressFamily: AddressFamily
+    /// Name sent as SNI and checked against the certificate instead of the IMAP server,
+    /// for servers reached by IP or alias that present a certificate for another name
+    var tlsServerName: String?
+    /// Store each folder in one directory named by its whole path joined with this separator,
+    /// e.g. `Work_Projects`, instead of nesting; nil nests folders as on the server
+    var flatFolderSeparator: String?
 
     // Password is stored in Keychain, not in this struct
     // This property is only used during account creation/update
@@ -84,6 +129,9 @@ struct EmailAccount: Identifiable, Codable, Hashable {
 
     enum CodingKeys: String, CodingKey {
         case id, email, imapServer, port, username, useSSL, isEnabled, lastBackupDate, authType
+        case folderRemap, sendClientID, followReferrals, backupSharedFolders, sharedFolderFilters
+        case lastSuccessfulBackupDate, keychainService, passwordCommand, fetchStrategy, addressFamily
+        case tlsServerName, flatFolderSeparator
         // Note: password is excluded from Codable
     }
 
@@ -98,8 +146,22 @@ struct EmailAccount: Identifiable, Codable, Hashable {
         useSSL = try container.decode(Bool.self, forKey: .useSSL)
         isEnabled = try container.decode(Bool.self, forKey: .isEnabled)
         lastBackupDate = try container.decodeIfPresent(Date.self, forKey: .lastBackupDate)
+        lastSuccessfulBackupDate = try container.decodeIfPresent(Date.self, forKey: .lastSuccessfulBackupDate)
         // Default to password auth for older accounts
         authType = try container.decodeIfPresent(AuthenticationType.self, forKey: .authType) ?? .password
+        folderRemap = try container.decodeIfPresent([String: String].self, forKey: .folderRemap) ?? [:]
+        sendClientID = try container.decodeIfPresent(Bool.self, forKey: .sendClientID) ?? true
+        followReferrals = try container.decodeIfPresent(Bool.self, forKey: .followReferrals) ?? false
+        backupSharedFolders = try container.decodeIfPresent(Bool.self, forKey: .backupSharedFolders) ?? false
+        sharedFolderFilters = try container.decodeIfPresent(
+            [String: SharedFolderFilter].self, forKey: .sharedFolderFilters
+        ) ?? [:]
+        keychainService = try container.decodeIfPresent(String.self, forKey: .keychainService)
+        passwordCommand = try container.decodeIfPresent(String.self, forKey: .passwordCommand)
+        fetchStrategy = try container.decodeIfPresent(FetchStrategy.self, forKey: .fetchStrategy) ?? .combined
+        addressFamily = try container.decodeIfPresent(AddressFamily.self, forKey: .addressFamily) ?? .automatic
+        tlsServerName = try container.decodeIfPresent(String.self, forKey: .tlsServerName)
+        flatFolderSeparator = try container.decodeIfPresent(String.self, forKey: .flatFolderSeparator)
     }
 
     init(
@@ -112,7 +174,19 @@ struct EmailAccount: Identifiable, Codable, Hashable {
         useSSL: Bool = true,
         isEnabled: Bool = true,
         lastBackupDate: Date? = nil,
-        authType: AuthenticationType = .password
+        lastSuccessfulBackupDate: Date? = nil,
+        authType: AuthenticationType = .password,
+        folderRemap: [String: String] = [:],
+        sendClientID: Bool = true,
+        followReferrals: Bool = false,
+        backupSharedFolders: Bool = false,
+        sharedFolderFilters: [String: SharedFolderFilter] = [:],
+        keychainService: String? = nil,
+        passwordCommand: String? = nil,
+        fetchStrategy: FetchStrategy = .combined,
+        addressFamily: AddressFamily = .automatic,
+        tlsServerName: String? = nil,
+        flatFolderSeparator: String? = nil
     ) {
         self.id = id
         self.email = email
@@ -123,17 +197,188 @@ struct EmailAccount: Identifiable, Codable, Hashable {
         self.useSSL = useSSL
         self.isEnabled = isEnabled
         self.lastBackupDate = lastBackupDate
+        self.lastSuccessfulBackupDate = lastSuccessfulBackupDate
         self.authType = authType
+        self.folderRemap = folderRemap
+        self.sendClientID = sendClientID
+        self.followReferrals = followReferrals
+        self.backupSharedFolders = backupSharedFolders
+        self.sharedFolderFilters = sharedFolderFilters
+        self.keychainService = keychainService
+        self.passwordCommand = passwordCommand
+        self.fetchStrategy = fetchStrategy
+        self.addressFamily = addressFamily
+        self.tlsServerName = tlsServerName
+        self.flatFolderSeparator = flatFolderSeparator
     }
 
-    /// Get password from Keychain
+    // MARK: - Run State
+
+    /// Record a finished backup. Only a clean run moves the last successful date, and it is
+    /// set to the run's start so messages arriving during the run are searched again next time.
+    mutating func recordBackup(startedAt: Date, finishedAt: Date = Date(), succeeded: Bool) {
+        lastBackupDate = finishedAt
+        if succeeded {
+            lastSuccessfulBackupDate = startedAt
+        }
+    }
+
+    // MARK: - Folder Remapping
+
+    /// Parse remap lines of the form "Server/Folder = Local/Path"
+    static func parseFolderRemap(_ text: String) -> [String: String] {
+        var remap: [String: String] = [:]
+        for line in text.components(separatedBy: .newlines) {
+            let parts = line.components(separatedBy: "=")
+            guard parts.count == 2 else { continue }
+            let server = parts[0].trimmingCharacters(in: .whitespaces)
+            let local = parts[1].trimmingCharacters(in: .whitespaces)
+            if !server.isEmpty && !local.isEmpty {
+                remap[server] = local
+            }
+        }
+        return remap
+    }
+
+    /// Format a remap table as editable lines, sorted by server folder
+    static func formatFolderRemap(_ remap: [String: String]) -> String {
+        remap.keys.sorted().map { "\($0) = \(remap[$0]!)" }.joined(separator: "\n")
+    }
+
+    /// Separator for flattened folders as entered, without characters that would nest or
+    /// break a file name. Nothing usable left falls back to an underscore.
+    static func normalizedFlatFolderSeparator(_ text: String) -> String {
+        let unsafe = CharacterSet(charactersIn: "/\\:").union(.whitespacesAndNewlines).union(.controlCharacters)
+        let separator = String(text.unicodeScalars.filter { !unsafe.contains($0) })
+        return separator.isEmpty ? "_" : separator
+    }
+
+    // MARK: - Shared Folders
+
+    /// Whether a folder from a shared namespace passes that namespace's filter
+    func includesSharedFolder(_ folder: IMAPFolder) -> Bool {
+        guard let prefix = folder.namespacePrefix else { return true }
+        guard let filter = sharedFolderFilters[prefix] else { return true }
+        return filter.allows(String(folder.name.dropFirst(prefix.count)))
+    }
+
+    /// Parse filter lines of the form "<prefix> include|exclude <pattern>"; `""` is the empty prefix
+    static func parseSharedFolderFilters(_ text: String) -> [String: SharedFolderFilter] {
+        var filters: [String: SharedFolderFilter] = [:]
+        for line in text.components(separatedBy: .newlines) {
+            let parts = line.split(separator: " ", maxSplits: 2).map(String.init)
+            guard parts.count == 3 else { continue }
+            let prefix = parts[0] == "\"\"" ? "" : parts[0]
+            let pattern = parts[2].trimmingCharacters(in: .whitespaces)
+            switch parts[1].lowercased() {
+            case "include":
+                filters[prefix, default: SharedFolderFilter()].include.append(pattern)
+            case "exclude":
+                filters[prefix, default: SharedFolderFilter()].exclude.append(pattern)
+            default:
+                continue
+            }
+        }
+        return filters
+    }
+
+    /// Format filters as editable lines, sorted by prefix
+    static func formatSharedFolderFilters(_ filters: [String: SharedFolderFilter]) -> String {
+        filters.keys.sorted().flatMap { prefix -> [String] in
+            let name = prefix.isEmpty ? "\"\"" : prefix
+            let filter = filters[prefix]!
+            return filter.include.map { "\(name) include \($0)" } + filter.exclude.map { "\(name) exclude \($0)" }
+        }.joined(separator: "\n")
+    }
+
+    // MARK: - Keychain Service
+
+    /// Why a custom keychain service name cannot be used, nil if it is fine or empty
+    static func keychainServiceProblem(_ name: String) -> String? {
+        let trimmed = name.trimmingCharacters(in: .whitespaces)
+        if trimmed.isEmpty {
+            return nil
+        }
+        if trimmed.count > 255 {
+            return "Keychain service name is longer than 255 characters"
+        }
+        if trimmed.unicodeScalars.contains(where: { CharacterSet.controlCharacters.contains($0) }) {
+            return "Keychain service name contains control characters"
+        }
+        return nil
+    }
+
+    /// Trimmed keychain service name, nil when empty
+    static func normalizedKeychainService(_ name: String) -> String? {
+        let trimmed = name.trimmingCharacters(in: .whitespaces)
+        return trimmed.isEmpty ? nil : trimmed
+    }
+
+    /// Why a TLS server name is not a plausible hostname, nil if it is fine or empty.
+    /// IP addresses are refused: SNI carries host names only.
+    static func tlsServerNameProblem(_ name: String) -> String? {
+        var trimmed = name.trimmingCharacters(in: .whitespaces)
+        if trimmed.hasSuffix(".") {
+            trimmed.removeLast()
+        }
+        if trimmed.isEmpty {
+            return name.trimmingCharacters(in: .whitespaces).isEmpty ? nil : "TLS server name is not a host name"
+        }
+        if trimmed.count > 253 {
+            return "TLS server name is longer than 253 characters"
+        }
+
+        let hostCharacters = CharacterSet(charactersIn: "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-")
+        let labels = trimmed.components(separatedBy: ".")
+        for label in labels {
+            guard !label.isEmpty, label.count <= 63,
+                  label.unicodeScalars.allSatisfy({ hostCharacters.contains($0) }),
+                  !label.hasPrefix("-"), !label.hasSuffix("-") else {
+                return "TLS server name is not a host name"
+            }
+        }
+        if labels.allSatisfy({ $0.allSatisfy(\.isNumber) }) {
+            return "TLS server name must be a host name, not an IP address"
+        }
+        return nil
+    }
+
+    /// Trimmed, lowercased TLS server name without a trailing dot, nil when empty
+    static func normalizedTLSServerName(_ name: String) -> String? {
+        var trimmed = name.trimmingCharacters(in: .whitespaces).lowercased()
+        if trimmed.hasSuffix(".") {
+            trimmed.removeLast()
+        }
+        return trimmed.isEmpty ? nil : trimmed
+    }
+
+    /// Why a password command cannot be run, nil if it is fine or empty
+    static func passwordCommandProblem(_ command: String) -> String? {
+        do {
+            _ = try PasswordCommandService.splitArguments(command)
+            return nil
+        } catch {
+            return error.localizedDescription
+        }
+    }
+
+    /// Get password from the password command or Keychain
     func getPassword() async -> String? {
         // First check if we have a temporary password (during account creation)
         if let tempPassword = _password, !tempPassword.isEmpty {
             return tempPassword
         }
-        // Otherwise fetch from Keychain
-        return try? await KeychainService.shared.getPassword(for: id)
+        if let command = passwordCommand, !command.isEmpty {
+            do {
+                return try await PasswordCommandService.run(command)
+            } catch {
+                logError("Password command for \(email) failed: \(error.localizedDescription)")
+                return nil
+            }
+        }
+        // Otherwise fetch from Keychain, trying a custom service first
+        let lookups = KeychainService.passwordLookups(accountId: id, username: username, customService: keychainService)
+        return try? await KeychainService.shared.getPassword(trying: lookups)
     }
 
     /// Save password to Keychain
@@ -146,10 +391,13 @@ struct EmailAccount: Identifiable, Codable, Hashable {
         try await KeychainService.shared.deletePassword(for: id)
     }
 
-    /// Check if password exists
+    /// Check if password exists. A password command counts without being run: it may prompt
+    /// or unlock a password manager, which a check should not set off.
     func hasPassword() async -> Bool {
         if _password != nil { return true }
-        return await KeychainService.shared.hasPassword(for: id)
+        if let command = passwordCommand, !command.isEmpty { return true }
+        let lookups = KeychainService.passwordLookups(accountId: id, username: username, customService: keychainService)
+        return (try? await KeychainService.shared.getPassword(trying: lookups)) != nil
     }
 
     // MARK: - OAuth Token Management
@@ -166,12 +414,12 @@ struct EmailAccount: Identifiable, Codable, Hashable {
         guard let tokenString = String(data: data, encoding: .utf8) else {
             throw NSError(domain: "EmailAccount", code: 1, userInfo: [NSLocalizedDescriptionKey: "Failed to encode OAuth tokens"])
         }
-        try await KeychainService.shared.savePassword(tokenString, for: id, service: "com.kzahedi.MailKeep.oauth")
+        try await KeychainService.shared.savePassword(tokenString, for: id, service: KeychainService.oauthService)
     }
 
     /// Get OAuth tokens from Keychain
     func getOAuthTokens() async -> GoogleOAuthTokens? {
-        guard let tokenString = try? await KeychainService.shared.getPassword(for: id, service: "com.kzahedi.MailKeep.oauth"),
+        guard let tokenString = try? await KeychainService.shared.getPassword(for: id, service: KeychainService.oauthService),
               let data = tokenString.data(using: .utf8) else {
             return nil
         }
@@ -180,7 +428,7 @@ struct EmailAccount: Identifiable, Codable, Hashable {
 
     /// Delete OAuth tokens from Keychain
     func deleteOAuthTokens() async throws {
-        try await KeychainService.shared.deletePassword(for: id, service: "com.kzahedi.MailKeep.oauth")
+        try await KeychainService.shared.deletePassword(for: id, service: KeychainService.oauthService)
     }
 
     /// Get a valid access token, refreshing if necessary
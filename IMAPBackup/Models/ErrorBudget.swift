@@ -0,0 +1,41 @@
+import Foundation
+
+/// Decides when a folder has failed too many of its emails to keep going.
+/// Single failures (a permission blip, one unreadable message) are recorded and skipped;
+/// a folder is only given up when the share of failures crosses the threshold.
+struct ErrorBudget: Equatable {
+    /// Largest tolerated share of failed emails, 0...1; nil never gives up
+    let maxErrorRate: Double?
+    /// Emails attempted before the rate is judged, so one early failure does not stop a folder
+    let minimumAttempts: Int
+
+    private(set) var attempted = 0
+    private(set) var failed = 0
+
+    init(maxErrorRate: Double?, minimumAttempts: Int = 10) {
+        self.maxErrorRate = maxErrorRate
+        self.minimumAttempts = minimumAttempts
+    }
+
+    /// Budget from a percentage setting where 0 means no limit
+    init(maxErrorPercent: Int, minimumAttempts: Int = 10) {
+        self.init(maxErrorRate: maxErrorPercent > 0 ? Double(min(maxErrorPercent, 100)) / 100 : nil,
+                  minimumAttempts: minimumAttempts)
+    }
+
+    mutating func record(succeeded: Bool) {
+        attempted += 1
+        if !succeeded {
+            failed += 1
+        }
+    }
+
+    var errorRate: Double {
+        attempted > 0 ? Double(failed) / Double(attempted) : 0
+    }
+
+    var isExceeded: Bool {
+        guard let maxErrorRate = maxErrorRate, attempted >= minimumAttempts else { return false }
+        return errorRate > maxErrorRate
+    }
+}
@@ -0,0 +1,148 @@
+import Foundation
+import Network
+
+/// What kind of problem an error is, so reports and notifications can say what to do about it
+/// instead of only repeating the message. Errors wrapping another one through
+/// `NSUnderlyingErrorKey` are classified by what they wrap when they say nothing themselves.
+enum FailureKind: String, Codable, CaseIterable {
+    /// Wrong or missing credentials, or a sign-in the server refused
+    case auth
+    /// The server could not be reached or the connection broke
+    case network
+    /// A server download limit or a full disk
+    case quota
+    /// A message larger than the server accepts, e.g. when restoring
+    case tooLarge
+    /// The backup volume cannot hold more files, though it may have space left
+    case tooManyFiles
+    /// The secure connection could not be set up, usually a certificate problem
+    case tls
+    /// Data that could not be read, from the server or on disk
+    case parse
+    case other
+
+    var displayName: String {
+        switch self {
+        case .auth: return "Sign-in Problem"
+        case .network: return "Connection Problem"
+        case .quota: return "Limit Reached"
+        case .tooLarge: return "Message Too Large"
+        case .tooManyFiles: return "Too Many Files"
+        case .tls: return "Secure Connection Problem"
+        case .parse: return "Unreadable Data"
+        case .other: return "Error"
+        }
+    }
+
+    /// What the user can do about it; nil when there is nothing general to say
+    var advice: String? {
+        switch self {
+        case .auth: return "Check the account's password or sign in again."
+        case .network: return "Check the network and the server name; the next backup retries."
+        case .quota: return "Wait for the server's limit to reset or free up disk space."
+        case .tooLarge: return "Raise the server's message size limit, or restore the email to an account that accepts larger messages."
+        case .tooManyFiles: return "Free up files on the backup volume, move backups to a volume with more inodes, or keep old emails as an mbox export."
+        case .tls: return "Check the server's certificate and the account's TLS settings."
+        case .parse, .other: return nil
+        }
+    }
+
+    /// Kind of `error`, looking through wrapped errors
+    static func classify(_ error: Error) -> FailureKind {
+        var current: Error? = error
+        // A bounded walk; an error wrapping itself would otherwise never end
+        for _ in 0..<8 {
+            guard let candidate = current else { break }
+            if let kind = kind(of: candidate) {
+                return kind
+            }
+            current = (candidate as NSError).userInfo[NSUnderlyingErrorKey] as? Error
+        }
+        return .other
+    }
+
+    /// Kind of one error without looking at what it wraps, nil if it does not tell
+    private static func kind(of error: Error) -> FailureKind? {
+        switch error {
+        case let imapError as IMAPError:
+            switch imapError {
+            case .authenticationFailed, .loginDisabled:
+                return .auth
+            case .notConnected, .connectionFailed, .connectionCancelled, .connectionClosed, .sendFailed, .receiveFailed:
+                return .network
+            case .bandwidthLimitExceeded:
+                return .quota
+            case .messageTooLarge:
+                return .tooLarge
+            case .tlsFailed:
+                return .tls
+            case .folderNotFound, .fetchFailed, .commandFailed, .referral:
+                return .other
+            }
+        case is GoogleOAuthError, is PasswordCommandError:
+            return .auth
+        case is InodeCheckError:
+            return .tooManyFiles
+        case let keychainError as KeychainError:
+            if case .notFound = keychainError {
+                return .auth
+            }
+            return nil
+        case let nwError as NWError:
+            switch nwError {
+            case .tls:
+                return .tls
+            case .posix(let code):
+                return kind(ofPOSIX: code) ?? .network
+            default:
+                return .network
+            }
+        case let urlError as URLError:
+            switch urlError.code {
+            case .secureConnectionFailed, .serverCertificateHasBadDate, .serverCertificateUntrusted,
+                 .serverCertificateHasUnknownRoot, .serverCertificateNotYetValid,
+                 .clientCertificateRejected, .clientCertificateRequired:
+                return .tls
+            case .cannotDecodeRawData, .cannotDecodeContentData, .cannotParseResponse:
+                return .parse
+            default:
+                return .network
+            }
+        case is DecodingError:
+            return .parse
+        case let cocoaError as CocoaError:
+            switch cocoaError.code {
+            case .fileWriteOutOfSpace:
+                return .quota
+            case .fileReadCorruptFile, .propertyListReadCorrupt, .coderReadCorrupt:
+                return .parse
+            default:
+                return nil
+            }
+        case let posixError as POSIXError:
+            return kind(ofPOSIX: posixError.code)
+        default:
+            break
+        }
+
+        let nsError = error as NSError
+        // Secure Transport status codes, errSSLUnknownRootCert and friends
+        if nsError.domain == NSOSStatusErrorDomain, (-9899 ... -9800).contains(nsError.code) {
+            return .tls
+        }
+        return nil
+    }
+
+    /// A full disk or a broken connection; other codes, such as a missing file, say nothing
+    private static func kind(ofPOSIX code: POSIXErrorCode) -> FailureKind? {
+        switch code {
+        case .ENOSPC, .EDQUOT:
+            return .quota
+        case .ECONNREFUSED, .ECONNRESET, .ECONNABORTED, .ETIMEDOUT, .EHOSTUNREACH, .EHOSTDOWN,
+             .ENETUNREACH, .ENETDOWN, .ENETRESET, .EPIPE, .ENOTCONN:
+            return .network
+        default:
+            return nil
+        }
+    }
+}
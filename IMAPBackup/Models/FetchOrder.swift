@@ -0,0 +1,23 @@
+import Foundation
+
+/// Order new emails of a folder are saved in
+enum FetchOrder: String, Codable, CaseIterable {
+    /// Lowest UID first, the order the server lists them in
+    case oldestFirst = "oldest-first"
+    /// Highest UID first, so recent mail is safe even when a backup is interrupted
+    case newestFirst = "newest-first"
+
+    var displayName: String {
+        switch self {
+        case .oldestFirst: return "Oldest First"
+        case .newestFirst: return "Newest First"
+        }
+    }
+
+    func arrange(_ uids: [UInt32]) -> [UInt32] {
+        switch self {
+        case .oldestFirst: return uids
+        case .newestFirst: return uids.sorted(by: >)
+        }
+    }
+}
@@ -0,0 +1,47 @@
+import Foundation
+
+/// How the FETCH commands for a folder's new emails are split up, for servers that misbehave
+/// with some item combinations
+enum FetchStrategy: String, Codable, CaseIterable {
+    /// Each email's size, body, and envelope with flags and body structure are fetched one after another
+    case combined
+    /// UID, flags, size and envelope of a whole batch first in one plain FETCH, then each body by UID
+    /// alone with nothing else fetched per email. Leaves out BODYSTRUCTURE, which is what quirky
+    /// servers most often get wrong.
+    case twoPhase = "two-phase"
+
+    var displayName: String {
+        switch self {
+        case .combined: return "Combined"
+        case .twoPhase: return "Two-Phase"
+        }
+    }
+
+    /// Envelopes are fetched for this many UIDs per command
+    static let envelopeBatchSize = 200
+
+    /// Raw FETCH response per UID for the first phase; empty for `.combined`, which fetches
+    /// sizes and envelopes one email at a time. UIDs the server did not answer for are left out.
+    func prefetchEnvelopes(
+        for uids: [UInt32],
+        using service: IMAPServiceProtocol
+    ) async throws -> [UInt32: String] {
+        guard self == .twoPhase, !uids.isEmpty else { return [:] }
+
+        let sorted = uids.sorted()
+        var envelopes: [UInt32: String] = [:]
+        for start in stride(from: 0, to: sorted.count, by: Self.envelopeBatchSize) {
+            try Task.checkCancellation()
+            let batch = Array(sorted[start..<min(start + Self.envelopeBatchSize, sorted.count)])
+            let fetched = try await service.fetchEnvelopes(uids: batch)
+            envelopes.merge(fetched) { current, _ in current }
+        }
+        return envelopes
+    }
+
+    /// RFC822.SIZE from a first-phase response, so the body phase needs no size fetch of its own
+    static func reportedSize(in response: String) -> Int? {
+        guard case .string(let size)? = EnvelopeParser.parseFetchAttributes(response)["RFC822.SIZE"] else { return nil }
+        return Int(size)
+    }
+}
@@ -0,0 +1,85 @@
+import Foundation
+
+/// How a backup tells which server messages it already has
+enum IncrementalStrategy: String, Codable, CaseIterable {
+    /// Server UIDs against the UIDs saved on disk. Fast, but a UIDVALIDITY reset or a
+    /// server migration renumbers every message and everything is downloaded again.
+    case uid
+    /// Message-ID headers against those saved on disk. Survives UID changes at the cost
+    /// of fetching the Message-ID of every message in the folder.
+    case messageId = "message-id"
+
+    var displayName: String {
+        switch self {
+        case .uid: return "UID"
+        case .messageId: return "Message-ID"
+        }
+    }
+
+    /// Message-IDs are fetched for this many UIDs per command
+    static let messageIdBatchSize = 500
+
+    /// UIDs among `uids` that still need downloading.
+    /// With `.messageId`, messages without a Message-ID header fall back to the UID check.
+    /// `uidsAreCurrent` says `backedUpUIDs` were recorded under the folder's current UIDVALIDITY,
+    /// so those messages are skipped on their UID alone and no header of theirs is fetched.
+    func newUIDs(
+        _ uids: [UInt32],
+        backedUpUIDs: Set<UInt32>,
+        knownMessageIDs: Set<String>,
+        uidsAreCurrent: Bool = false,
+        using service: IMAPServiceProtocol
+    ) async throws -> [UInt32] {
+        let unknown = uidsAreCurrent ? uids.filter { !backedUpUIDs.contains($0) } : uids
+
+        // Nothing on disk to match against, so there is no point fetching headers
+        guard self == .messageId, !knownMessageIDs.isEmpty, !unknown.isEmpty else {
+            return uids.filter { !backedUpUIDs.contains($0) }
+        }
+
+        // Every message is looked at, so a range may span gaps; otherwise only runs of unknown UIDs
+        let sorted = unknown.sorted()
+        let ranges = uidsAreCurrent
+            ? Self.contiguousRanges(sorted, maxCount: Self.messageIdBatchSize)
+            : stride(from: 0, to: sorted.count, by: Self.messageIdBatchSize).map {
+                sorted[$0]...sorted[min($0 + Self.messageIdBatchSize, sorted.count) - 1]
+            }
+
+        var serverMessageIDs: [UInt32: String] = [:]
+        for range in ranges {
+            let fetched = try await service.fetchMessageIDs(uids: range)
+            serverMessageIDs.merge(fetched) { current, _ in current }
+        }
+
+        return unknown.filter { uid in
+            if let messageId = serverMessageIDs[uid] {
+                return !knownMessageIDs.contains(messageId)
+            }
+            return !backedUpUIDs.contains(uid)
+        }
+    }
+
+    /// UID ranges covering `uids` and nothing else, each at most `maxCount` long, so no message
+    /// outside `uids` is fetched. New messages are usually one run at the end of a folder.
+    static func contiguousRanges(_ uids: [UInt32], maxCount: Int) -> [ClosedRange<UInt32>] {
+        var ranges: [ClosedRange<UInt32>] = []
+        var start: UInt32?
+        var end: UInt32 = 0
+
+        for uid in Set(uids).sorted() {
+            if let first = start, uid == end + 1, Int(uid - first) < maxCount {
+                end = uid
+                continue
+            }
+            if let first = start {
+                ranges.append(first...end)
+            }
+            start = uid
+            end = uid
+        }
+        if let first = start {
+            ranges.append(first...end)
+        }
+        return ranges
+    }
+}
@@ -0,0 +1,35 @@
+import Foundation
+
+/// IMAP settings of a well-known mail provider, to complete accounts whose settings are
+/// missing, e.g. from macOS Internet Accounts where a bundled mail, calendar and contacts
+/// account does not always store its IMAP server.
+struct MailProvider: Equatable {
+    let name: String
+    /// Domains of the provider's email addresses
+    let domains: [String]
+    let host: String
+    /// SSL/TLS from the start
+    let port: Int
+
+    static let known: [MailProvider] = [
+        MailProvider(name: "Gmail", domains: ["gmail.com", "googlemail.com"], host: "imap.gmail.com", port: 993),
+        MailProvider(name: "iCloud", domains: ["icloud.com", "me.com", "mac.com"], host: "imap.mail.me.com", port: 993),
+        MailProvider(name: "Outlook", domains: ["outlook.com", "hotmail.com", "live.com", "msn.com"], host: "outlook.office365.com", port: 993),
+        MailProvider(name: "Yahoo", domains: ["yahoo.com", "ymail.com"], host: "imap.mail.yahoo.com", port: 993),
+        MailProvider(name: "AOL", domains: ["aol.com"], host: "imap.aol.com", port: 993),
+        MailProvider(name: "Fastmail", domains: ["fastmail.com", "fastmail.fm"], host: "imap.fastmail.com", port: 993),
+        MailProvider(name: "Zoho", domains: ["zoho.com", "zohomail.com"], host: "imap.zoho.com", port: 993),
+        MailProvider(name: "GMX", domains: ["gmx.de", "gmx.net", "gmx.com", "gmx.at", "gmx.ch"], host: "imap.gmx.net", port: 993),
+        MailProvider(name: "WEB.DE", domains: ["web.de"], host: "imap.web.de", port: 993),
+        MailProvider(name: "IONOS", domains: ["ionos.de"], host: "imap.ionos.de", port: 993),
+        MailProvider(name: "Telekom", domains: ["t-online.de"], host: "secureimap.t-online.de", port: 993),
+        MailProvider(name: "Yandex", domains: ["yandex.com", "yandex.ru"], host: "imap.yandex.com", port: 993)
+    ]
+
+    /// The provider of an email address by its domain, nil for other domains
+    static func forEmail(_ email: String) -> MailProvider? {
+        guard let at = email.lastIndex(of: "@") else { return nil }
+        let domain = email[email.index(after: at)...].trimmingCharacters(in: .whitespaces).lowercased()
+        return known.first { $0.domains.contains(domain) }
+    }
+}
@@ -0,0 +1,94 @@
+import Foundation
+
+/// Output format for account listings
+enum AccountListFormat: String, CaseIterable {
+    case text = "Text"
+    case json = "JSON"
+
+    var fileExtension: String {
+        switch self {
+        case .text: return "txt"
+        case .json: return "json"
+        }
+    }
+}
+
+/// Account fields included in listings; credentials are never part of it
+struct AccountSummary: Codable, Equatable {
+    let id: UUID
+    let email: String
+    let username: String
+    let imapServer: String
+    let port: Int
+    let useSSL: Bool
+    let authType: AuthenticationType
+    let isEnabled: Bool
+    let lastBackupDate: Date?
+
+    init(_ account: EmailAccount) {
+        self.id = account.id
+        self.email = account.email
+        self.username = account.username
+        self.imapServer = account.imapServer
+        self.port = account.port
+        self.useSSL = account.useSSL
+        self.authType = account.authType
+        self.isEnabled = account.isEnabled
+        self.lastBackupDate = account.lastBackupDate
+    }
+}
+
+/// Renders the configured accounts as readable text or JSON for scripting.
+/// Output goes to any TextOutputStream (a String, a file handle wrapper, ...);
+/// `render` collects it into a String.
+enum AccountExportService {
+
+    /// Render accounts in the given format
+    static func render(_ accounts: [EmailAccount], format: AccountListFormat) throws -> String {
+        var output = ""
+        try write(accounts, format: format, to: &output)
+        return output
+    }
+
+    /// Write accounts in the given format
+    static func write<Target: TextOutputStream>(
+        _ accounts: [EmailAccount],
+        format: AccountListFormat,
+        to output: inout Target
+    ) throws {
+        switch format {
+        case .text:
+            for (index, account) in accounts.enumerated() {
+                if index > 0 {
+                    output.write("\n")
+                }
+                writeAccountInfo(account, to: &output)
+            }
+        case .json:
+            let encoder = JSONEncoder()
+            encoder.outputFormatting = [.prettyPrinted, .sortedKeys]
+            encoder.dateEncodingStrategy = .iso8601
+            let data = try encoder.encode(accounts.map(AccountSummary.init))
+            output.write(String(decoding: data, as: UTF8.self))
+            output.write("\n")
+        }
+    }
+
+    /// Write a readable description of one account
+    static func writeAccountInfo<Target: TextOutputStream>(_ account: EmailAccount, to output: inout Target) {
+        let summary = AccountSummary(account)
+        let lastBackup = summary.lastBackupDate.map {
+            DateFormatter.localizedString(from: $0, dateStyle: .medium, timeStyle: .short)
+        } ?? "Never"
+
+        output.write("""
+        \(summary.email)
+          Server:      \(summary.imapServer):\(summary.port)\(summary.useSSL ? " (SSL/TLS)" : "")
+          Username:    \(summary.username)
+          Auth:        \(summary.authType == .oauth2 ? "OAuth2" : "Password")
+          Enabled:     \(summary.isEnabled ? "Yes" : "No")
+          Last backup: \(lastBackup)
+
+        """)
+    }
+}
@@ -0,0 +1,95 @@
+import Foundation
+
+/// Where an account's credentials live, so purging can be tested without the Keychain
+protocol AccountSecretStore {
+    func removePassword(for accountId: UUID) async throws
+    func removeOAuthTokens(for accountId: UUID) async throws
+}
+
+extension KeychainService: AccountSecretStore {
+    func removePassword(for accountId: UUID) async throws {
+        try deletePassword(for: accountId)
+    }
+
+    func removeOAuthTokens(for accountId: UUID) async throws {
+        try deletePassword(for: accountId, service: Self.oauthService)
+    }
+}
+
+/// What purging an account removed
+struct AccountPurgeResult {
+    var removedPassword = false
+    var removedOAuthTokens = false
+    /// Backup directory that was deleted, if requested and present
+    var removedBackupDirectory: URL?
+    var errors: [String] = []
+}
+
+/// Removes everything an account leaves behind: Keychain secrets and, on request, its backups.
+/// Removing the account from the account list is up to the caller.
+enum AccountPurgeService {
+
+    /// Delete the password and OAuth tokens; a missing item is not an error
+    static func purgeSecrets(of account: EmailAccount, store: AccountSecretStore) async -> AccountPurgeResult {
+        var result = AccountPurgeResult()
+
+        do {
+            try await store.removePassword(for: account.id)
+            result.removedPassword = true
+        } catch {
+            result.errors.append("Password: \(error.localizedDescription)")
+        }
+
+        do {
+            try await store.removeOAuthTokens(for: account.id)
+            result.removedOAuthTokens = true
+        } catch {
+            result.errors.append("OAuth tokens: \(error.localizedDescription)")
+        }
+
+        return result
+    }
+
+    /// The account's backup directory, guaranteed to be strictly inside the backup location
+    /// after resolving symlinks, so a purge can never delete anything else.
+    static func backupDirectory(for account: EmailAccount, in backupLocation: URL) throws -> URL {
+        let base = backupLocation.standardizedFileURL.resolvingSymlinksInPath()
+        let directory = try DeletionGuard.securePath(
+            base.appendingPathComponent(account.email.sanitizedForFilename()),
+            within: base
+        )
+
+        guard directory.deletingLastPathComponent().path == base.path else {
+            throw DeletionError.outsideBackupLocation(directory.path)
+        }
+        return directory
+    }
+
+    /// What removing the account's backup directory deletes; empty when there is none
+    static func backupDeletionPlan(for account: EmailAccount, in backupLocation: URL) throws -> DeletionPlan {
+        let directory = try backupDirectory(for: account, in: backupLocation)
+        var plan = DeletionPlan(operation: "Purging \(account.email)", mode: .dryRun)
+        if FileManager.default.fileExists(atPath: directory.path) {
+            plan.add("file", count: DeletionGuard.fileCount(in: directory), bytes: DeletionGuard.allocatedSize(of: directory))
+        }
+        return plan
+    }
+
+    /// Delete the account's backup directory when confirmed, otherwise only log what would go;
+    /// returns nil when there was none
+    @discardableResult
+    static func removeBackupDirectory(
+        for account: EmailAccount,
+        in backupLocation: URL,
+        mode: DeletionMode = .dryRun,
+        fileManager: FileManager = .default
+    ) throws -> URL? {
+        let directory = try backupDirectory(for: account, in: backupLocation)
+        guard fileManager.fileExists(atPath: directory.path) else { return nil }
+
+        let plan = try backupDeletionPlan(for: account, in: backupLocation)
+        try DeletionGuard.remove(directory, within: backupLocation, mode: mode, fileManager: fileManager)
+        logInfo(mode == .dryRun ? plan.summary : "Removed backup directory for \(account.email): \(directory.path)")
+        return directory
+    }
+}
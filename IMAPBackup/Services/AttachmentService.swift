@@ -1,4 +1,5 @@
 import Foundation
+import CryptoKit
 
 /// Service for extracting attachments from email files
 actor AttachmentService {
@@ -13,6 +14,12 @@ actor AttachmentService {
 
     /// Extract attachments from raw email data
     func extractAttachments(from emailData: Data) -> [Attachment] {
+        Self.attachments(in: emailData)
+    }
+
+    /// Attachments of raw email data. Keeps no state, so emails can be parsed concurrently
+    /// without going through an AttachmentService actor.
+    nonisolated static func attachments(in emailData: Data) -> [Attachment] {
         guard let content = String(data: emailData, encoding: .utf8) ?? String(data: emailData, encoding: .isoLatin1) else {
             return []
         }
@@ -49,41 +56,304 @@ actor AttachmentService {
     }
 
     /// Save extracted attachments to a folder
-    func saveAttachments(_ attachments: [Attachment], to folderURL: URL) throws -> [URL] {
+    /// Returns one URL per attachment; with the skip strategies it may point at a file saved earlier.
+    /// Names and duplicates are settled for all attachments first, so up to `maxConcurrentWrites` files
+    /// can then be written at once without two writers ever targeting the same file.
+    func saveAttachments(
+        _ attachments: [Attachment],
+        to folderURL: URL,
+        strategy: AttachmentDedupStrategy = .rename,
+        maxConcurrentWrites: Int = 1
+    ) async throws -> [URL] {
         if !fileManager.fileExists(atPath: folderURL.path) {
             try fileManager.createDirectory(at: folderURL, withIntermediateDirectories: true)
         }
 
         var savedURLs: [URL] = []
+        var writes: [PlannedWrite] = []
+        // Files this call is about to write, by name and by content, so later attachments see them too
+        var plannedByName: [String: Int] = [:]
+        var plannedByChecksum: [String: URL] = [:]
 
         for attachment in attachments {
             let sanitizedFilename = attachment.filename.sanitizedForFilename()
             var fileURL = folderURL.appendingPathComponent(sanitizedFilename)
+            var checksum: String?
+
+            switch strategy {
+            case .overwrite:
+                // The last attachment with a name wins, as if they were written one after another
+                let write = PlannedWrite(data: attachment.data, url: fileURL, replacing: true)
+                if let index = plannedByName[fileURL.lastPathComponent] {
+                    writes[index] = write
+                } else {
+                    plannedByName[fileURL.lastPathComponent] = writes.count
+                    writes.append(write)
+                }
+                savedURLs.append(fileURL)
+                continue
+            case .skipIdentical:
+                if let index = plannedByName[fileURL.lastPathComponent] {
+                    if writes[index].data == attachment.data {
+                        savedURLs.append(fileURL)
+                        continue
+                    }
+                } else if fileManager.fileExists(atPath: fileURL.path),
+                          (try? Data(contentsOf: fileURL)) == attachment.data {
+                    savedURLs.append(fileURL)
+                    continue
+                }
+            case .contentHash:
+                let hash = AttachmentMetadata.checksum(of: attachment.data)
+                if let existing = plannedByChecksum[hash] ?? existingFile(with: attachment.data, checksum: hash, in: folderURL) {
+                    savedURLs.append(existing)
+                    continue
+                }
+                checksum = hash
+            case .rename:
+                break
+            }
 
-            // Handle duplicate filenames
+            // Handle duplicate filenames, on disk and earlier in this email
             var counter = 1
-            while fileManager.fileExists(atPath: fileURL.path) {
+            while fileManager.fileExists(atPath: fileURL.path) || plannedByName[fileURL.lastPathComponent] != nil {
                 let name = (sanitizedFilename as NSString).deletingPathExtension
                 let ext = (sanitizedFilename as NSString).pathExtension
                 fileURL = folderURL.appendingPathComponent("\(name)_\(counter).\(ext)")
                 counter += 1
             }
 
-            // Write to temp file first, then atomically move to final location
-            let tempURL = fileURL.appendingPathExtension("tmp")
-            try attachment.data.write(to: tempURL)
-            try fileManager.moveItem(at: tempURL, to: fileURL)
-
+            plannedByName[fileURL.lastPathComponent] = writes.count
+            writes.append(PlannedWrite(data: attachment.data, url: fileURL, replacing: false))
+            if let checksum = checksum {
+                plannedByChecksum[checksum] = fileURL
+            }
             savedURLs.append(fileURL)
         }
 
+        try await Self.perform(writes, maxConcurrent: maxConcurrentWrites)
         return savedURLs
     }
 
+    private struct PlannedWrite {
+        let data: Data
+        let url: URL
+        let replacing: Bool
+    }
+
+    /// Run the writes with at most `maxConcurrent` in flight. Targets are distinct, so each
+    /// writer has its own temp file and rename.
+    private nonisolated static func perform(_ writes: [PlannedWrite], maxConcurrent: Int) async throws {
+        let limit = max(1, maxConcurrent)
+        guard limit > 1, writes.count > 1 else {
+            for planned in writes {
+                try write(planned.data, to: planned.url, replacing: planned.replacing)
+            }
+            return
+        }
+
+        try await withThrowingTaskGroup(of: Void.self) { group in
+            for (index, planned) in writes.enumerated() {
+                if index >= limit {
+                    _ = try await group.next()
+                }
+                group.addTask {
+                    try write(planned.data, to: planned.url, replacing: planned.replacing)
+                }
+            }
+            try await group.waitForAll()
+        }
+    }
+
+    /// Write to temp file first, then atomically move to final location
+    private nonisolated static func write(_ data: Data, to fileURL: URL, replacing: Bool) throws {
+        let fileManager = FileManager.default
+        let tempURL = fileURL.appendingPathExtension("tmp")
+        try data.write(to: tempURL)
+        if replacing && fileManager.fileExists(atPath: fileURL.path) {
+            _ = try fileManager.replaceItemAt(fileURL, withItemAt: tempURL)
+        } else {
+            try fileManager.moveItem(at: tempURL, to: fileURL)
+        }
+    }
+
+    /// A file in the folder with exactly this content, whatever its name
+    private func existingFile(with data: Data, checksum: String, in folderURL: URL) -> URL? {
+        let contents = (try? fileManager.contentsOfDirectory(
+            at: folderURL,
+            includingPropertiesForKeys: [.fileSizeKey],
+            options: [.skipsHiddenFiles]
+        )) ?? []
+        return contents.sorted { $0.lastPathComponent < $1.lastPathComponent }.first { url in
+            guard url.pathExtension != "tmp",
+                  (try? url.resourceValues(forKeys: [.fileSizeKey]).fileSize) == data.count,
+                  let existing = try? Data(contentsOf: url) else {
+                return false
+            }
+            return AttachmentMetadata.checksum(of: existing) == checksum
+        }
+    }
+
+    /// Save an email's attachments to <name>_attachments next to it and record
+    /// their sizes and checksums in <name>.attachments.json
+    /// Attachments matching a skip rule are not written but still get a metadata entry saying why.
+    @discardableResult
+    func saveAttachments(
+        _ attachments: [Attachment],
+        for emailURL: URL,
+        strategy: AttachmentDedupStrategy = .rename,
+        skipRules: AttachmentSkipRules = AttachmentSkipRules(),
+        maxConcurrentWrites: Int = 1,
+        notDownloaded: [AttachmentMetadata] = []
+    ) async throws -> [AttachmentMetadata] {
+        let kept = attachments.filter { skipRules.skipReason(for: $0) == nil }
+        // No empty attachments folder for an email whose only attachments were left on the server
+        var savedURLs: ArraySlice<URL> = []
+        if !kept.isEmpty || notDownloaded.isEmpty {
+            savedURLs = try await saveAttachments(
+                kept,
+                to: AttachmentMetadata.folderURL(for: emailURL),
+                strategy: strategy,
+                maxConcurrentWrites: maxConcurrentWrites
+            )[...]
+        }
+
+        // Attachments that ended up in one file, overwritten or identical to one already kept, are
+        // recorded once, with the size and checksum of what the file holds
+        var metadata: [AttachmentMetadata] = []
+        var recorded = Set<String>()
+        for attachment in attachments {
+            if let reason = skipRules.skipReason(for: attachment) {
+                metadata.append(AttachmentMetadata(filename: attachment.filename.sanitizedForFilename(), data: attachment.data,
+                                                   contentType: attachment.contentType, skipReason: reason))
+                continue
+            }
+
+            let fileURL = savedURLs.removeFirst()
+            let filename = fileURL.lastPathComponent
+            guard recorded.insert(filename).inserted else { continue }
+            metadata.append(AttachmentMetadata(filename: filename, data: try Data(contentsOf: fileURL),
+                                               contentType: attachment.contentType))
+        }
+        // Attachments left on the server are only known from BODYSTRUCTURE, so they have no checksum
+        metadata += notDownloaded
+
+        let encoder = JSONEncoder()
+        encoder.outputFormatting = [.prettyPrinted, .sortedKeys]
+        try encoder.encode(metadata).write(to: AttachmentMetadata.sidecarURL(for: emailURL), options: .atomic)
+
+        return metadata
+    }
+
+    /// Recompute the size and checksum of each recorded attachment of an email.
+    /// Emails without an .attachments.json sidecar have nothing to check.
+    nonisolated static func verifyAttachments(for emailURL: URL) -> [AttachmentIntegrityIssue] {
+        guard let data = try? Data(contentsOf: AttachmentMetadata.sidecarURL(for: emailURL)),
+              let recorded = try? JSONDecoder().decode([AttachmentMetadata].self, from: data) else {
+            return []
+        }
+
+        let folderURL = AttachmentMetadata.folderURL(for: emailURL)
+        return recorded.filter { $0.skipReason == nil }.compactMap { metadata in
+            let fileURL = folderURL.appendingPathComponent(metadata.filename)
+            guard let contents = try? Data(contentsOf: fileURL) else {
+                return AttachmentIntegrityIssue(fileURL: fileURL, kind: .missing)
+            }
+            guard metadata.hasChecksum else { return nil }
+            if contents.count != metadata.size {
+                return AttachmentIntegrityIssue(fileURL: fileURL, kind: .sizeMismatch)
+            }
+            if AttachmentMetadata.checksum(of: contents) != metadata.sha256 {
+                return AttachmentIntegrityIssue(fileURL: fileURL, kind: .checksumMismatch)
+            }
+            return nil
+        }
+    }
+
+    // MARK: - Backup Extraction
+
+    /// Extract attachments from every .eml in an existing backup into a separate tree
+    /// Output mirrors the backup layout: <output>/<account>/<folder>/<email>_attachments/<file>.
+    /// Existing per-email folders are replaced, so re-running is idempotent. Writes manifest.json.
+    func extractAttachments(inBackup backupURL: URL, to outputURL: URL) async throws -> AttachmentManifest {
+        try fileManager.createDirectory(at: outputURL, withIntermediateDirectories: true)
+
+        // Resolve symlinks so relative paths work for e.g. /var vs /private/var
+        let basePath = backupURL.resolvingSymlinksInPath().path
+        let outputPath = outputURL.resolvingSymlinksInPath().path
+        var manifest = AttachmentManifest(sourcePath: basePath)
+
+        guard let enumerator = fileManager.enumerator(
+            at: backupURL,
+            includingPropertiesForKeys: [.isRegularFileKey],
+            options: [.skipsHiddenFiles]
+        ) else {
+            return manifest
+        }
+
+        var emailURLs: [URL] = []
+        for case let fileURL as URL in enumerator {
+            // Don't descend into the output tree when it lives inside the backup
+            let filePath = fileURL.resolvingSymlinksInPath().path
+            if filePath == outputPath || filePath.hasPrefix(outputPath + "/") {
+                enumerator.skipDescendants()
+                continue
+            }
+            if fileURL.pathExtension == "eml" {
+                emailURLs.append(fileURL)
+            }
+        }
+
+        // Sorted for a deterministic manifest
+        for emailURL in emailURLs.sorted(by: { $0.path < $1.path }) {
+            manifest.emailsScanned += 1
+
+            let attachments = extractAttachments(from: emailURL)
+            guard !attachments.isEmpty else { continue }
+
+            let emailPath = relativePath(of: emailURL, to: basePath)
+            let relativeFolder = (emailPath as NSString).deletingLastPathComponent
+            let emailFilename = emailURL.deletingPathExtension().lastPathComponent
+            let folderURL = outputURL
+                .appendingPathComponent(relativeFolder)
+                .appendingPathComponent("\(emailFilename)_attachments")
+
+            if fileManager.fileExists(atPath: folderURL.path) {
+                try fileManager.removeItem(at: folderURL)
+            }
+
+            let savedURLs = try await saveAttachments(attachments, to: folderURL)
+            for (attachment, savedURL) in zip(attachments, savedURLs) {
+                manifest.attachments.append(AttachmentManifest.Entry(
+                    emailPath: emailPath,
+                    attachmentPath: relativePath(of: savedURL, to: outputPath),
+                    filename: attachment.filename,
+                    contentType: attachment.contentType,
+                    size: attachment.data.count,
+                    risk: AttachmentRisk.classify(filename: attachment.filename, contentType: attachment.contentType)
+                ))
+            }
+        }
+
+        let encoder = JSONEncoder()
+        encoder.outputFormatting = [.prettyPrinted, .sortedKeys]
+        encoder.dateEncodingStrategy = .iso8601
+        try encoder.encode(manifest).write(to: outputURL.appendingPathComponent("manifest.json"), options: .atomic)
+
+        logInfo("Extracted \(manifest.attachments.count) attachments from \(manifest.emailsScanned) emails")
+        return manifest
+    }
+
+    private func relativePath(of url: URL, to basePath: String) -> String {
+        let path = url.resolvingSymlinksInPath().path
+        guard path.hasPrefix(basePath + "/") else { return path }
+        return String(path.dropFirst(basePath.count + 1))
+    }
+
     // MARK: - Private Methods
 
     /// Find the MIME boundary from Content-Type header
-    private func findBoundary(in content: String) -> String? {
+    private static func findBoundary(in content: String) -> String? {
         // Look for Content-Type: multipart/... boundary="..."
         let pattern = #"Content-Type:\s*multipart/[^;]+;\s*boundary="?([^"\r\n;]+)"?"#
 
@@ -97,7 +367,7 @@ actor AttachmentService {
     }
 
     /// Parse a MIME part and extract attachment if it is one
-    private func parseAttachmentPart(_ part: String) -> Attachment? {
+    private static func parseAttachmentPart(_ part: String) -> Attachment? {
         // Split headers from body
         let headerBodySplit: String.Index
         if let range = part.range(of: "\r\n\r\n") {
@@ -141,8 +411,8 @@ actor AttachmentService {
     }
 
     /// Parse a header value from headers string
-    private func parseHeader(_ name: String, in headers: String) -> String? {
-        let pattern = "(?m)^\(name):\\s*(.+?)(?=\\r?\\n[^\\s\\t]|\\r?\\n\\r?\\n|$)"
+    private static func parseHeader(_ name: String, in headers: String) -> String? {
+        let pattern = "(?m)^\(name):\\s*(.+?)(?=\\r?\\n[^\\s\\t]|\\r?\\n\\r?\\n|\\z)"
 
         guard let regex = try? NSRegularExpression(pattern: pattern, options: [.caseInsensitive, .dotMatchesLineSeparators]),
               let match = regex.firstMatch(in: headers, range: NSRange(headers.startIndex..., in: headers)),
@@ -160,181 +430,251 @@ actor AttachmentService {
         return value.trimmingCharacters(in: .whitespacesAndNewlines)
     }
 
-    /// Extract filename from Content-Disposition or Content-Type header
-    private func extractFilename(from header: String) -> String? {
-        // Try filename*= (RFC 5987 encoded)
-        if let range = header.range(of: #"filename\*\s*=\s*[^;]+"#, options: .regularExpression) {
-            let value = String(header[range])
-            if let encoded = value.components(separatedBy: "=").last {
-                return decodeRFC5987(encoded.trimmingCharacters(in: .whitespaces))
+    /// Filename from the filename parameter of Content-Disposition or the name parameter of Content-Type,
+    /// decoded from RFC 2231 or RFC 2047 so non-ASCII names are kept
+    private static func extractFilename(from header: String) -> String? {
+        for parameter in ["filename", "name"] {
+            if let value = MIMEDecoding.headerParameter(parameter, in: header)?.trimmingCharacters(in: .whitespacesAndNewlines),
+               !value.isEmpty {
+                return value
             }
         }
+        return nil
+    }
 
-        // Try filename= (regular)
-        let patterns = [
-            #"filename\s*=\s*"([^"]+)""#,  // filename="value"
-            #"filename\s*=\s*'([^']+)'"#,  // filename='value'
-            #"filename\s*=\s*([^\s;]+)"#   // filename=value
-        ]
+    /// Decode body based on Content-Transfer-Encoding
+    private static func decodeBody(_ body: String, encoding: String) -> Data? {
+        switch encoding {
+        case "base64":
+            // Remove whitespace and decode
+            let cleaned = body.replacingOccurrences(of: "\r", with: "")
+                              .replacingOccurrences(of: "\n", with: "")
+                              .replacingOccurrences(of: " ", with: "")
+            return Data(base64Encoded: cleaned)
 
-        for pattern in patterns {
-            if let regex = try? NSRegularExpression(pattern: pattern, options: .caseInsensitive),
-               let match = regex.firstMatch(in: header, range: NSRange(header.startIndex..., in: header)),
-               let valueRange = Range(match.range(at: 1), in: header) {
-                var filename = String(header[valueRange])
-                // Decode RFC 2047 if present
-                filename = decodeRFC2047(filename)
-                return filename
-            }
-        }
+        case "quoted-printable":
+            return MIMEDecoding.decodeQuotedPrintable(body)
 
-        // Try name= in Content-Type
-        let namePatterns = [
-            #"name\s*=\s*"([^"]+)""#,
-            #"name\s*=\s*'([^']+)'"#,
-            #"name\s*=\s*([^\s;]+)"#
-        ]
+        case "7bit", "8bit", "binary":
+            return body.data(using: .utf8) ?? body.data(using: .isoLatin1)
 
-        for pattern in namePatterns {
-            if let regex = try? NSRegularExpression(pattern: pattern, options: .caseInsensitive),
-               let match = regex.firstMatch(in: header, range: NSRange(header.startIndex..., in: header)),
-               let valueRange = Range(match.range(at: 1), in: header) {
-                var filename = String(header[valueRange])
-                filename = decodeRFC2047(filename)
-                return filename
-            }
+        default:
+            return body.data(using: .utf8) ?? body.data(using: .isoLatin1)
         }
-
-        return nil
     }
+}
 
-    /// Decode RFC 5987 encoded filename (charset'language'encoded_value)
-    private func decodeRFC5987(_ encoded: String) -> String {
-        let parts = encoded.components(separatedBy: "'")
-        guard parts.count >= 3 else { return encoded }
+/// Manifest of a standalone attachment extraction run
+struct AttachmentManifest: Codable {
+    struct Entry: Codable, Equatable {
+        /// Email path relative to the backup directory
+        let emailPath: String
+        /// Attachment path relative to the output directory
+        let attachmentPath: String
+        /// Filename as given in the email, before sanitization
+        let filename: String
+        let contentType: String
+        let size: Int
+        let risk: AttachmentRisk
+    }
 
-        let charset = parts[0].lowercased()
-        let encodedValue = parts[2...].joined(separator: "'")
+    var createdAt = Date()
+    var sourcePath: String
+    var emailsScanned = 0
+    var attachments: [Entry] = []
+}
 
-        // URL decode the value
-        var decoded = encodedValue.removingPercentEncoding ?? encodedValue
+/// A saved attachment file with its size and SHA-256, for detecting bit-rot later
+struct AttachmentMetadata: Codable, Equatable {
+    /// File name inside the attachments folder, after sanitization and duplicate renaming
+    let filename: String
+    /// MIME type without parameters, e.g. "application/pdf"; nil in metadata written before it was recorded
+    let contentType: String?
+    let size: Int
+    /// Lowercase hex SHA-256 of the file contents
+    let sha256: String
+    /// Why the attachment was not written to disk; nil when it was saved
+    let skipReason: String?
+    /// Whether the attachment looks safe to open, from its filename and content type
+    let risk: AttachmentRisk
+
+    /// Recorded but not written to disk, e.g. over the size limit; written as `"skipped": true`
+    var skipped: Bool {
+        skipReason != nil
+    }
 
-        // Handle charset if not UTF-8
-        if charset != "utf-8" && charset != "utf8" {
-            let cfEncoding = CFStringConvertIANACharSetNameToEncoding(charset as CFString)
-            if cfEncoding != kCFStringEncodingInvalidId {
-                let nsEncoding = CFStringConvertEncodingToNSStringEncoding(cfEncoding)
-                if let data = encodedValue.removingPercentEncoding?.data(using: .isoLatin1),
-                   let converted = String(data: data, encoding: String.Encoding(rawValue: nsEncoding)) {
-                    decoded = converted
-                }
-            }
-        }
+    init(filename: String, size: Int, sha256: String, contentType: String? = nil, skipReason: String? = nil,
+         risk: AttachmentRisk? = nil) {
+        self.filename = filename
+        self.contentType = contentType
+        self.size = size
+        self.sha256 = sha256
+        self.skipReason = skipReason
+        self.risk = risk ?? AttachmentRisk.classify(filename: filename, contentType: contentType)
+    }
 
-        return decoded
+    init(filename: String, data: Data, contentType: String? = nil, skipReason: String? = nil) {
+        self.init(filename: filename, size: data.count, sha256: Self.checksum(of: data),
+                  contentType: contentType, skipReason: skipReason)
     }
 
-    /// Decode RFC 2047 encoded strings
-    private func decodeRFC2047(_ input: String) -> String {
-        let pattern = #"=\?([^?]+)\?([QqBb])\?([^?]*)\?="#
+    private enum CodingKeys: String, CodingKey {
+        case filename, contentType, size, sha256, skipReason, risk, skipped
+    }
 
-        guard let regex = try? NSRegularExpression(pattern: pattern, options: []) else {
-            return input
+    /// Also reads the older sidecars that listed bare filenames; those entries have no size or checksum
+    init(from decoder: Decoder) throws {
+        if let filename = try? decoder.singleValueContainer().decode(String.self) {
+            self.init(filename: filename, size: 0, sha256: "")
+            return
         }
 
-        var result = input
-        let matches = regex.matches(in: input, range: NSRange(input.startIndex..., in: input))
-
-        for match in matches.reversed() {
-            guard let fullRange = Range(match.range, in: result),
-                  let charsetRange = Range(match.range(at: 1), in: result),
-                  let encodingRange = Range(match.range(at: 2), in: result),
-                  let textRange = Range(match.range(at: 3), in: result) else {
-                continue
-            }
-
-            let charset = String(result[charsetRange]).lowercased()
-            let encoding = String(result[encodingRange]).lowercased()
-            let encodedText = String(result[textRange])
-
-            var decodedData: Data?
+        let container = try decoder.container(keyedBy: CodingKeys.self)
+        self.init(
+            filename: try container.decode(String.self, forKey: .filename),
+            size: try container.decode(Int.self, forKey: .size),
+            sha256: try container.decode(String.self, forKey: .sha256),
+            contentType: try container.decodeIfPresent(String.self, forKey: .contentType),
+            skipReason: try container.decodeIfPresent(String.self, forKey: .skipReason),
+            // Metadata written before risks were recorded is classified on load
+            risk: try? container.decodeIfPresent(AttachmentRisk.self, forKey: .risk)
+        )
+    }
 
-            if encoding == "q" {
-                decodedData = decodeQuotedPrintable(encodedText, isHeader: true)
-            } else if encoding == "b" {
-                decodedData = Data(base64Encoded: encodedText)
-            }
+    func encode(to encoder: Encoder) throws {
+        var container = encoder.container(keyedBy: CodingKeys.self)
+        try container.encode(filename, forKey: .filename)
+        try container.encodeIfPresent(contentType, forKey: .contentType)
+        try container.encode(size, forKey: .size)
+        try container.encode(sha256, forKey: .sha256)
+        try container.encodeIfPresent(skipReason, forKey: .skipReason)
+        try container.encode(risk, forKey: .risk)
+        // Easier to filter on than the reason; derived from it, so not read back
+        if skipped {
+            try container.encode(true, forKey: .skipped)
+        }
+    }
 
-            if let data = decodedData {
-                let cfEncoding = CFStringConvertIANACharSetNameToEncoding(charset as CFString)
-                let nsEncoding = CFStringConvertEncodingToNSStringEncoding(cfEncoding)
+    /// Entry from a filenames-only sidecar, which can only be checked for existence
+    var hasChecksum: Bool {
+        !sha256.isEmpty
+    }
 
-                if let decoded = String(data: data, encoding: String.Encoding(rawValue: nsEncoding)) {
-                    result.replaceSubrange(fullRange, with: decoded)
-                } else if let decoded = String(data: data, encoding: .utf8) {
-                    result.replaceSubrange(fullRange, with: decoded)
-                }
-            }
-        }
+    static func checksum(of data: Data) -> String {
+        SHA256.hash(data: data).map { String(format: "%02x", $0) }.joined()
+    }
 
-        return result
+    /// <name>.attachments.json next to the email
+    static func sidecarURL(for emailURL: URL) -> URL {
+        emailURL.deletingPathExtension().appendingPathExtension("attachments.json")
     }
 
-    /// Decode quoted-printable encoding
-    private func decodeQuotedPrintable(_ input: String, isHeader: Bool = false) -> Data? {
-        var result = Data()
-        var index = input.startIndex
+    /// <name>_attachments next to the email
+    static func folderURL(for emailURL: URL) -> URL {
+        let name = emailURL.deletingPathExtension().lastPathComponent
+        return emailURL.deletingLastPathComponent().appendingPathComponent("\(name)_attachments")
+    }
+}
 
-        while index < input.endIndex {
-            let char = input[index]
+/// An attachment file that no longer matches its recorded metadata
+struct AttachmentIntegrityIssue: Equatable {
+    enum Kind: String {
+        case missing
+        case sizeMismatch = "size mismatch"
+        case checksumMismatch = "checksum mismatch"
+    }
 
-            if char == "=" {
-                let next1 = input.index(after: index)
-                if next1 < input.endIndex {
-                    let next2 = input.index(after: next1)
-                    if next2 <= input.endIndex {
-                        let hex = String(input[next1..<next2])
-                        if let byte = UInt8(hex, radix: 16) {
-                            result.append(byte)
-                            index = next2
-                            continue
-                        }
-                    }
-                }
-            } else if isHeader && char == "_" {
-                result.append(0x20)  // Space
-                index = input.index(after: index)
-                continue
-            }
+    let fileURL: URL
+    let kind: Kind
+}
 
-            if let byte = String(char).data(using: .utf8) {
-                result.append(byte)
-            }
-            index = input.index(after: index)
+/// What saving does when an attachment's filename is already taken in its folder
+enum AttachmentDedupStrategy: String, Codable, CaseIterable {
+    /// Keep both, adding _1, _2, ... to the new file's name
+    case rename
+    /// Keep the existing file if its content is identical, otherwise rename
+    case skipIdentical
+    /// Replace the existing file
+    case overwrite
+    /// Reuse any file in the folder with the same content, whatever its name, otherwise rename
+    case contentHash
+
+    var displayName: String {
+        switch self {
+        case .rename: return "Rename duplicates"
+        case .skipIdentical: return "Skip identical files"
+        case .overwrite: return "Overwrite"
+        case .contentHash: return "Deduplicate by content"
         }
+    }
+}
 
-        return result
+/// Glob patterns for attachments that should not be saved, e.g. tracking images or S/MIME signatures
+struct AttachmentSkipRules: Codable, Equatable {
+    /// MIME type globs such as "image/*", matched case-insensitively
+    var contentTypes: [String] = []
+    /// Filename globs such as "*.p7s", matched case-insensitively
+    var filenames: [String] = []
+    /// Attachments larger than this many decoded bytes are not saved; 0 for no limit. Backups leave
+    /// them on the server when BODYSTRUCTURE shows them. Can be given at launch as `-NoAttachmentsOver 10MB`.
+    var maxSizeBytes = 0
+
+    var isEmpty: Bool {
+        contentTypes.isEmpty && filenames.isEmpty && maxSizeBytes <= 0
     }
 
-    /// Decode body based on Content-Transfer-Encoding
-    private func decodeBody(_ body: String, encoding: String) -> Data? {
-        switch encoding {
-        case "base64":
-            // Remove whitespace and decode
-            let cleaned = body.replacingOccurrences(of: "\r", with: "")
-                              .replacingOccurrences(of: "\n", with: "")
-                              .replacingOccurrences(of: " ", with: "")
-            return Data(base64Encoded: cleaned)
+    /// The first rule the attachment matches, nil if it should be saved
+    func skipReason(for attachment: AttachmentService.Attachment) -> String? {
+        if maxSizeBytes > 0 && attachment.data.count > maxSizeBytes {
+            return "larger than \(ByteCountFormatter.string(fromByteCount: Int64(maxSizeBytes), countStyle: .file))"
+        }
+        let contentType = attachment.contentType.lowercased()
+        if let pattern = contentTypes.first(where: { fnmatch($0.lowercased(), contentType, 0) == 0 }) {
+            return "content type matches \(pattern)"
+        }
+        let filename = attachment.filename.lowercased()
+        if let pattern = filenames.first(where: { fnmatch($0.lowercased(), filename, 0) == 0 }) {
+            return "filename matches \(pattern)"
+        }
+        return nil
+    }
 
-        case "quoted-printable":
-            return decodeQuotedPrintable(body)
+    /// Comma or newline separated patterns from a settings field
+    static func parsePatterns(_ text: String) -> [String] {
+        text.components(separatedBy: CharacterSet(charactersIn: ",\n"))
+            .map { $0.trimmingCharacters(in: .whitespaces) }
+            .filter { !$0.isEmpty }
+    }
 
-        case "7bit", "8bit", "binary":
-            return body.data(using: .utf8) ?? body.data(using: .isoLatin1)
+    /// Bytes in a size such as "10MB", "500 KB", "1.5G" or "2048". Units are binary (1 KB = 1024 bytes)
+    /// and case-insensitive; nil for anything else.
+    static func parseSize(_ text: String) -> Int? {
+        let trimmed = text.trimmingCharacters(in: .whitespaces).uppercased()
+        guard let unitStart = trimmed.firstIndex(where: { !$0.isNumber && $0 != "." }) else {
+            return Int(trimmed)
+        }
 
-        default:
-            return body.data(using: .utf8) ?? body.data(using: .isoLatin1)
+        guard let number = Double(trimmed[..<unitStart].trimmingCharacters(in: .whitespaces)), number >= 0 else {
+            return nil
+        }
+        let multipliers: [String: Double] = [
+            "B": 1, "K": 1024, "KB": 1024, "M": 1024 * 1024, "MB": 1024 * 1024,
+            "G": 1024 * 1024 * 1024, "GB": 1024 * 1024 * 1024,
+        ]
+        guard let multiplier = multipliers[trimmed[unitStart...].trimmingCharacters(in: .whitespaces)] else {
+            return nil
         }
+        return Int(number * multiplier)
+    }
+}
+
+extension AttachmentSkipRules {
+    // Rules saved before the size limit existed keep their patterns
+    init(from decoder: Decoder) throws {
+        let container = try decoder.container(keyedBy: CodingKeys.self)
+        contentTypes = try container.decodeIfPresent([String].self, forKey: .contentTypes) ?? []
+        filenames = try container.decodeIfPresent([String].self, forKey: .filenames) ?? []
+        maxSizeBytes = try container.decodeIfPresent(Int.self, forKey: .maxSizeBytes) ?? 0
     }
 }
 
@@ -342,8 +682,24 @@ actor AttachmentService {
 struct AttachmentExtractionSettings: Codable {
     var isEnabled: Bool = false
     var createSubfolderPerEmail: Bool = true
+    var dedupStrategy: AttachmentDedupStrategy = .rename
+    var skipRules = AttachmentSkipRules()
+    /// Attachment files of one email written at the same time
+    var maxConcurrentWrites = 4
 
     static let `default` = AttachmentExtractionSettings()
+
+    init() {}
+
+    // Settings saved before dedupStrategy existed keep their other values
+    init(from decoder: Decoder) throws {
+        let container = try decoder.container(keyedBy: CodingKeys.self)
+        isEnabled = try container.decodeIfPresent(Bool.self, forKey: .isEnabled) ?? false
+        createSubfolderPerEmail = try container.decodeIfPresent(Bool.self, forKey: .createSubfolderPerEmail) ?? true
+        dedupStrategy = try container.decodeIfPresent(AttachmentDedupStrategy.self, forKey: .dedupStrategy) ?? .rename
+        skipRules = try container.decodeIfPresent(AttachmentSkipRules.self, forKey: .skipRules) ?? AttachmentSkipRules()
+        maxConcurrentWrites = try container.decodeIfPresent(Int.self, forKey: .maxConcurrentWrites) ?? 4
+    }
 }
 
 /// Global attachment extraction settings manager
@@ -351,11 +707,21 @@ struct AttachmentExtractionSettings: Codable {
 class AttachmentExtractionManager: ObservableObject {
     static let shared = AttachmentExtractionManager()
 
+    /// What is saved and shown in Settings, without the launch size limit
     @Published var settings: AttachmentExtractionSettings {
         didSet { saveSettings() }
     }
 
+    /// Size limit given at launch, e.g. `-NoAttachmentsOver 10MB`; applies to this run without being saved
+    let launchSizeLimit: Int?
+
+    /// `settings` with the launch size limit in place, which is what backups use
+    var effectiveSettings: AttachmentExtractionSettings {
+        Self.applying(launchSizeLimit: launchSizeLimit, to: settings)
+    }
+
     private let settingsKey = "AttachmentExtractionSettings"
+    private static let noAttachmentsOverKey = "NoAttachmentsOver"
 
     private init() {
         if let data = UserDefaults.standard.data(forKey: settingsKey),
@@ -364,6 +730,25 @@ class AttachmentExtractionManager: ObservableObject {
         } else {
             self.settings = AttachmentExtractionSettings.default
         }
+
+        launchSizeLimit = Self.launchSizeLimit(in: UserDefaults.standard)
+    }
+
+    /// The `-NoAttachmentsOver` size from the launch arguments, nil when not given or not a size
+    nonisolated static func launchSizeLimit(in defaults: UserDefaults) -> Int? {
+        guard let rawSize = defaults.string(forKey: noAttachmentsOverKey) else { return nil }
+        guard let size = AttachmentSkipRules.parseSize(rawSize) else {
+            logWarning("Ignoring NoAttachmentsOver \"\(rawSize)\": expected a size such as 10MB")
+            return nil
+        }
+        return size
+    }
+
+    nonisolated static func applying(launchSizeLimit: Int?, to settings: AttachmentExtractionSettings) -> AttachmentExtractionSettings {
+        guard let limit = launchSizeLimit else { return settings }
+        var settings = settings
+        settings.skipRules.maxSizeBytes = limit
+        return settings
     }
 
     private func saveSettings() {
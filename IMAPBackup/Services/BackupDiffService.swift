@@ -0,0 +1,118 @@
+import Foundation
+
+/// How one folder on the server differs from its backup
+struct FolderDiff: Codable, Equatable {
+    let folder: String
+    /// On the server but not backed up; the next backup downloads these
+    var newOnServer = 0
+    /// Backed up but no longer on the server, deleted or moved there
+    var missingOnServer = 0
+    /// Backed-up emails whose flags changed since the last flag refresh. Nil when the server has
+    /// no CONDSTORE or the folder's flags were never refreshed, so changes cannot be told apart.
+    var flagChanges: Int?
+
+    var isUnchanged: Bool {
+        newOnServer == 0 && missingOnServer == 0 && (flagChanges ?? 0) == 0
+    }
+}
+
+/// What a backup of one account would change, found without writing anything
+struct BackupDiff: Codable {
+    let accountEmail: String
+    let comparedAt: Date
+    var folders: [FolderDiff] = []
+    var errors: [String] = []
+
+    var newOnServer: Int {
+        folders.reduce(0) { $0 + $1.newOnServer }
+    }
+
+    var missingOnServer: Int {
+        folders.reduce(0) { $0 + $1.missingOnServer }
+    }
+
+    /// Sum over the folders where flag changes are known, nil if they are known nowhere
+    var flagChanges: Int? {
+        let known = folders.compactMap { $0.flagChanges }
+        return known.isEmpty ? nil : known.reduce(0, +)
+    }
+
+    var summary: String {
+        var parts = ["\(newOnServer) new on server", "\(missingOnServer) missing on server"]
+        if let flagChanges = flagChanges {
+            parts.append("\(flagChanges) flag change(s)")
+        }
+        let changed = folders.filter { !$0.isUnchanged }.count
+        var text = parts.joined(separator: ", ") + " in \(changed) of \(folders.count) folder(s)"
+        if !errors.isEmpty {
+            text += ", \(errors.count) error(s)"
+        }
+        return text
+    }
+
+    /// Pretty-printed JSON with ISO 8601 dates, for scripts deciding whether to back up, repair or prune
+    static func jsonData(_ diffs: [BackupDiff]) throws -> Data {
+        let encoder = JSONEncoder()
+        encoder.outputFormatting = [.prettyPrinted, .sortedKeys]
+        encoder.dateEncodingStrategy = .iso8601
+        return try encoder.encode(diffs)
+    }
+}
+
+/// Dry run of a backup: compares each server folder with what is on disk and reports what the
+/// next backup would download, what the server no longer has and whose flags changed. Folders
+/// are only EXAMINEd and nothing on disk is written, not even the UID caches.
+enum BackupDiffService {
+
+    /// Compare every selectable folder of one account over a logged-in connection
+    static func diffAccount(
+        accountEmail: String,
+        service: IMAPServiceProtocol,
+        storageService: StorageService
+    ) async throws -> BackupDiff {
+        var diff = BackupDiff(accountEmail: accountEmail, comparedAt: Date())
+        let folders = try await service.listFolders().filter { $0.isSelectable }
+
+        for folder in folders {
+            try Task.checkCancellation()
+
+            do {
+                let status = try await service.examineFolder(folder.name)
+                var serverUIDs = Set<UInt32>()
+                if status.exists > 0 {
+                    serverUIDs = Set(try await service.searchAll())
+                }
+                let localUIDs = try await storageService.peekExistingUIDs(accountEmail: accountEmail, folderPath: folder.path)
+
+                var folderDiff = FolderDiff(
+                    folder: folder.path,
+                    newOnServer: serverUIDs.subtracting(localUIDs).count,
+                    missingOnServer: localUIDs.subtracting(serverUIDs).count
+                )
+
+                // Only a CHANGEDSINCE answer tells changed flags from unchanged ones
+                if status.exists > 0, !localUIDs.isEmpty,
+                   let modSeq = await storageService.flagsModSeq(
+                       accountEmail: accountEmail,
+                       folderPath: folder.path,
+                       uidValidity: status.uidValidity
+                   ) {
+                    let fetched = try await service.fetchFlags(changedSince: modSeq)
+                    if fetched.isIncremental {
+                        folderDiff.flagChanges = fetched.flags.keys.filter { localUIDs.contains($0) }.count
+                    }
+                }
+
+                diff.folders.append(folderDiff)
+            } catch is CancellationError {
+                throw CancellationError()
+            } catch {
+                diff.errors.append("\(folder.name): \(error.localizedDescription)")
+                logWarning("Comparing \(folder.name) failed: \(error.localizedDescription)")
+            }
+        }
+
+        logInfo("Compared \(accountEmail) with its backup: \(diff.summary)")
+        return diff
+    }
+}
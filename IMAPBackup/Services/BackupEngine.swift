@@ -0,0 +1,1103 @@
+import Foundation
+
+/// Outcome of downloading one folder
+struct FolderDownloadResult {
+    /// UIDs that were written and verified on disk
+    var verifiedUIDs: [UInt32] = []
+    var downloaded = 0
+    var bytes: Int64 = 0
+    /// One message per email that failed after all retries
+    var errors: [String] = []
+    /// UIDs that came down with a different size than the server reported, twice
+    var quarantined: [UInt32] = []
+    /// UIDs that could not be downloaded or saved, including quarantined ones
+    var failedUIDs: [UInt32] = []
+    /// The folder was abandoned because too many of its emails failed
+    var gaveUp = false
+    /// UIDs saved without a body, either header-only or empty on the server; not failures
+    var emptyBodyUIDs: [UInt32] = []
+    /// UIDs whose Date header lies far in the future
+    var futureDatedUIDs: [UInt32] = []
+
+    /// Add the outcome of another batch of the same folder
+    mutating func merge(_ other: FolderDownloadResult) {
+        verifiedUIDs += other.verifiedUIDs
+        downloaded += other.downloaded
+        bytes += other.bytes
+        errors += other.errors
+        quarantined += other.quarantined
+        failedUIDs += other.failedUIDs
+        gaveUp = gaveUp || other.gaveUp
+        emptyBodyUIDs += other.emptyBodyUIDs
+        futureDatedUIDs += other.futureDatedUIDs
+    }
+}
+
+enum BackupEngineError: LocalizedError {
+    case invalidEmailData
+
+    var errorDescription: String? {
+        switch self {
+        case .invalidEmailData:
+            return "Downloaded data does not appear to be a valid email"
+        }
+    }
+}
+
+/// Finds and downloads the new emails of an account into a storage backend, using only what it
+/// is handed: the backend, a logger, and an optional notifier and progress handler. It reads no
+/// settings, keeps no shared state and prints nothing, so other tools can embed MailKeep's backup
+/// with `backUp`. The app's BackupManager runs every backup through `newUIDs` and
+/// `downloadFolder` as well, and adds scheduling, history, checkpoints, reports and cleanup around them.
+final class BackupEngine {
+    typealias ProgressHandler = (BackupProgress) -> Void
+    typealias ServiceFactory = (EmailAccount) -> IMAPServiceProtocol
+    /// Opens and logs in one more connection to the account's server
+    typealias ConnectionOpener = () async throws -> IMAPServiceProtocol
+    typealias EventHandler = (Event) async -> Void
+    /// Whether storage can take more emails, e.g. enough free inodes; throws to stop the run
+    typealias StorageCheck = () throws -> Void
+
+    struct Options {
+        var fetchOrder: FetchOrder = .oldestFirst
+        /// Newest emails saved per folder and run; 0 saves all
+        var maxMessagesPerFolder = 0
+        /// Pause after each email; 0 does not pause
+        var messageDelayMs = 0
+        /// Name emails dated far in the future by their INTERNALDATE
+        var clampFutureDates = false
+        /// Give up on a folder once more than this percentage of its emails failed; 0 never gives up
+        var maxErrorPercent = 0
+        /// Emails larger than this are streamed to disk instead of held in memory
+        var streamingThresholdBytes = Constants.defaultStreamingThresholdBytes
+        /// Save only ENVELOPE, FLAGS and BODYSTRUCTURE per message, no .eml
+        var headersOnly = false
+        /// Store the server-reported envelope next to each email
+        var saveEnvelopeSidecars = false
+        /// Read state written to envelope sidecars
+        var localFlagPolicy: LocalFlagPolicy = .preserve
+        var incrementalStrategy: IncrementalStrategy = .uid
+        var backupSince: BackupSince = .all
+        /// Connections one folder is downloaded over at once; 1 downloads emails one by one
+        var maxConcurrentMessagesPerFolder = 1
+        /// Pause before the first retry of a failed email, doubled for each further attempt
+        var retryDelayMs = 1000
+        /// Attachments are extracted next to each saved email with these settings; nil leaves them in the email
+        var attachments: AttachmentExtractionSettings? = nil
+        /// Attachments larger than this many decoded bytes are left on the server and listed as skipped
+        /// in the email's attachment metadata; 0 downloads every attachment
+        var skipAttachmentsOverBytes = 0
+        /// Saved emails of a batch between two runs of `storageCheck`
+        var storageCheckInterval = 500
+    }
+
+    /// What happened to one email, as it happens
+    enum Event {
+        case saved(folder: IMAPFolder, uid: UInt32, subject: String?, url: URL, bytes: Int64)
+        /// Skipped after all retries; `reason` is the short form for per-message logs
+        case failed(folder: IMAPFolder, uid: UInt32, reason: String, error: BackupError)
+        /// The server refused further downloads while fetching this email
+        case interrupted(folder: IMAPFolder, uid: UInt32, reason: String)
+        case gaveUp(folder: IMAPFolder, error: BackupError)
+    }
+
+    let storage: StorageBackend
+    let logger: BackupLogger
+    let notifier: BackupNotifier?
+    let options: Options
+    /// The primary location when it keeps one file per email. Streaming, quarantine, sidecars,
+    /// headers-only saves and verification need it; other backends get plain saves.
+    let files: StorageService?
+    /// Every location an email is written to, when `storage` has mirrors
+    let destinations: MultiStorage?
+    /// Index saved emails are recorded in, a transaction per batch of emails. Batches downloaded
+    /// over parallel connections, and other accounts sharing the index, queue on its actor.
+    let index: DatabaseService?
+    /// Run every `Options.storageCheckInterval` saved emails of a batch
+    let storageCheck: StorageCheck?
+
+    private let progressHandler: ProgressHandler?
+    private let makeService: ServiceFactory
+
+    init(
+        storage: StorageBackend,
+        logger: BackupLogger = AppLogger(),
+        notifier: BackupNotifier? = nil,
+        options: Options = Options(),
+        index: DatabaseService? = nil,
+        storageCheck: StorageCheck? = nil,
+        progress: ProgressHandler? = nil,
+        makeService: @escaping ServiceFactory = { IMAPService(account: $0) }
+    ) {
+        self.storage = storage
+        self.index = index
+        self.storageCheck = storageCheck
+        self.logger = logger
+        self.notifier = notifier
+        var options = options
+        options.maxMessagesPerFolder = max(0, options.maxMessagesPerFolder)
+        options.messageDelayMs = max(0, options.messageDelayMs)
+        options.maxConcurrentMessagesPerFolder = max(1, options.maxConcurrentMessagesPerFolder)
+        options.storageCheckInterval = max(1, options.storageCheckInterval)
+        self.options = options
+        self.destinations = storage as? MultiStorage
+        self.files = storage as? StorageService ?? destinations?.backends.first as? StorageService
+        self.progressHandler = progress
+        self.makeService = makeService
+    }
+
+    // MARK: - Embedding
+
+    /// Save every email of `account` that storage does not have yet. A failed email is
+    /// recorded in the returned progress and skipped; failing to connect, log in or list
+    /// folders throws. `password` nil uses the one in the Keychain.
+    @discardableResult
+    func backUp(_ account: EmailAccount, password: String? = nil) async throws -> BackupProgress {
+        let tracker = ProgressTracker(BackupProgress(accountId: account.id), handler: progressHandler)
+        let service = makeService(account)
+
+        do {
+            await tracker.update { $0.status = .connecting }
+            try await service.connect()
+            try await service.login(password: password)
+
+            await tracker.update { $0.status = .fetchingFolders }
+            let folders = try await service.listFolders().filter { $0.isSelectable }
+            if let files = files {
+                try await files.resolveFolderCollisions(accountEmail: account.email, folderPaths: folders.map(\.path))
+            }
+            await tracker.update { $0.totalFolders = folders.count }
+
+            for folder in folders {
+                try Task.checkCancellation()
+                await tracker.update {
+                    $0.status = .downloading
+                    $0.currentFolder = folder.name
+                }
+                let uids = try await newUIDs(in: folder, account: account, service: service).uids
+                if !uids.isEmpty {
+                    let cap = options.maxMessagesPerFolder > 0 ? options.maxMessagesPerFolder : uids.count
+                    await tracker.update { $0.totalEmails += min(uids.count, cap) }
+                    logger.log("\(folder.path): \(min(uids.count, cap)) new emails", level: .debug)
+
+                    try await downloadFolder(uids, from: folder, account: account, service: service, openConnection: {
+                        let extra = self.makeService(account)
+                        do {
+                            try await extra.connect()
+                            try await extra.login(password: password)
+                        } catch {
+                            await extra.disconnect()
+                            throw error
+                        }
+                        return extra
+                    }) { event in
+                        await tracker.record(event)
+                    }
+                }
+                try Task.checkCancellation()
+                await tracker.update { $0.processedFolders += 1 }
+            }
+
+            try? await service.logout()
+        } catch {
+            // Nothing is left half-read on a connection that is given up on
+            await service.disconnect()
+            let kind = FailureKind.classify(error)
+            await tracker.update {
+                $0.status = error is CancellationError ? .cancelled : .failed
+                $0.errors.append(BackupError(message: error.localizedDescription, kind: kind))
+            }
+            logger.log("Backup failed for \(account.email) (\(kind.rawValue)): \(error.localizedDescription)", level: .error)
+            notifier?.notifyBackupFailed(account: account.email, error: error.localizedDescription, kind: kind)
+            throw error
+        }
+
+        await tracker.update { $0.status = .completed }
+        let progress = await tracker.progress
+        logger.log("Backup completed for \(account.email): \(progress.downloadedEmails) emails downloaded, \(progress.errors.count) errors", level: .info)
+        notifier?.notifyBackupCompleted(
+            account: account.email,
+            emailsDownloaded: progress.downloadedEmails,
+            totalEmails: progress.totalEmails,
+            errors: progress.errors.count
+        )
+        return progress
+    }
+
+    // MARK: - Finding New Emails
+
+    /// UIDs of `folder` that still need downloading, and the folder's UIDVALIDITY
+    func newUIDs(
+        in folder: IMAPFolder,
+        account: EmailAccount,
+        service: IMAPServiceProtocol
+    ) async throws -> (uids: [UInt32], uidValidity: UInt32) {
+        let status = try await service.examineFolder(folder.name)
+
+        guard status.exists > 0 else { return ([], status.uidValidity) }
+
+        // Search for all emails, or those since the configured day
+        let allUIDs: [UInt32]
+        if let since = options.backupSince.resolve(for: account) {
+            allUIDs = try await service.searchSince(since)
+        } else {
+            allUIDs = try await service.searchAll()
+        }
+
+        // A backend without files of its own only knows the UIDs it holds
+        guard let files = files else {
+            let existing = try await storage.getExistingUIDs(accountEmail: account.email, folderPath: folder.path)
+            return (allUIDs.filter { !existing.contains($0) }, status.uidValidity)
+        }
+
+        // Get already backed up UIDs from the state index, or by scanning existing files.
+        // UIDs are current only when the index saw each of them saved under this UIDVALIDITY;
+        // an entry filled by scanning files may hold UIDs of an earlier one.
+        var backedUpUIDs: Set<UInt32>
+        var uidsAreCurrent = false
+        if let indexed = await files.indexedUIDs(
+            accountEmail: account.email,
+            folderPath: folder.path,
+            uidValidity: status.uidValidity
+        ) {
+            backedUpUIDs = indexed
+            uidsAreCurrent = await files.indexedUIDsAreVerified(accountEmail: account.email, folderPath: folder.path)
+        } else {
+            backedUpUIDs = (try? await files.getExistingUIDs(
+                accountEmail: account.email,
+                folderPath: folder.path
+            )) ?? []
+            await files.updateStateIndex(
+                backedUpUIDs,
+                accountEmail: account.email,
+                folderPath: folder.path,
+                uidValidity: status.uidValidity
+            )
+        }
+
+        // With mirrors, only emails every destination has count as backed up.
+        // The primary's cache is repaired first so the primary is not written twice.
+        if let destinations = destinations {
+            _ = try? await files.recoverUncachedUIDs(
+                allUIDs.filter { !backedUpUIDs.contains($0) },
+                accountEmail: account.email,
+                folderPath: folder.path
+            )
+            backedUpUIDs = (try? await destinations.getExistingUIDs(
+                accountEmail: account.email,
+                folderPath: folder.path
+            )) ?? []
+            uidsAreCurrent = false
+        }
+
+        // An index run only needs messages that have no envelope yet
+        if options.headersOnly {
+            backedUpUIDs.formUnion((try? await files.getEnvelopeUIDs(
+                accountEmail: account.email,
+                folderPath: folder.path
+            )) ?? [])
+            uidsAreCurrent = false
+        }
+
+        // Message-IDs on disk also cover messages the server has renumbered
+        let knownMessageIDs: Set<String> = options.incrementalStrategy == .messageId
+            ? (try? await files.getExistingMessageIDs(accountEmail: account.email, folderPath: folder.path)) ?? []
+            : []
+
+        let candidates = try await options.incrementalStrategy.newUIDs(
+            allUIDs,
+            backedUpUIDs: backedUpUIDs,
+            knownMessageIDs: knownMessageIDs,
+            uidsAreCurrent: uidsAreCurrent,
+            using: service
+        )
+        // The index recorded every save under this UIDVALIDITY, so no email on disk is missing
+        // from it and the folder need not be listed
+        guard options.incrementalStrategy == .uid && destinations == nil && !uidsAreCurrent else {
+            return (candidates, status.uidValidity)
+        }
+
+        // Emails on disk that the cache lost track of are not new
+        let recovered = (try? await files.recoverUncachedUIDs(
+            candidates,
+            accountEmail: account.email,
+            folderPath: folder.path
+        )) ?? []
+
+        return (candidates.filter { !recovered.contains($0) }, status.uidValidity)
+    }
+
+    // MARK: - Downloading
+
+    /// Download `uids` of `folder`. With `maxConcurrentMessagesPerFolder` above 1 and a way to
+    /// open more connections, the folder is split into batches downloaded at once: the first over
+    /// `service`, each other one over a connection from `openConnection`. A batch whose connection
+    /// cannot be opened is downloaded over `service` afterwards.
+    @discardableResult
+    func downloadFolder(
+        _ uids: [UInt32],
+        from folder: IMAPFolder,
+        account: EmailAccount,
+        service: IMAPServiceProtocol,
+        openConnection: ConnectionOpener? = nil,
+        events: EventHandler? = nil
+    ) async throws -> FolderDownloadResult {
+        // A per-folder cap counts saved emails across the whole folder, which batches cannot share
+        let batches = options.maxMessagesPerFolder > 0
+            ? [uids]
+            : Self.fetchBatches(uids, connections: options.maxConcurrentMessagesPerFolder)
+        // One budget for the whole folder, however many batches its emails are split into
+        let budget = FolderErrorBudget(maxErrorPercent: options.maxErrorPercent)
+        guard batches.count > 1, let openConnection = openConnection else {
+            return try await downloadEmails(uids, from: folder, account: account, service: service, budget: budget, events: events)
+        }
+
+        logger.log("Downloading \(uids.count) emails in \(folder.path) over \(batches.count) connections", level: .info)
+        var result = FolderDownloadResult()
+
+        let (batchResults, fallbackUIDs) = try await Self.runBatches(batches, main: service) {
+            do {
+                return try await openConnection()
+            } catch {
+                self.logger.log("Could not open an extra connection for \(folder.path), using the main one: \(error.localizedDescription)", level: .warning)
+                throw error
+            }
+        } run: { batch, connection in
+            try await self.downloadEmails(batch, from: folder, account: account, service: connection, budget: budget, events: events)
+        }
+        for batchResult in batchResults {
+            result.merge(batchResult)
+        }
+
+        if !fallbackUIDs.isEmpty && !result.gaveUp {
+            result.merge(try await downloadEmails(fallbackUIDs, from: folder, account: account, service: service, budget: budget, events: events))
+        }
+        return result
+    }
+
+    /// Download emails one by one over `service`, retrying each failed one before skipping it.
+    /// Stops once `budget`, which other batches of the folder may share, is exceeded.
+    private func downloadEmails(
+        _ uids: [UInt32],
+        from folder: IMAPFolder,
+        account: EmailAccount,
+        service: IMAPServiceProtocol,
+        budget: FolderErrorBudget,
+        events: EventHandler?
+    ) async throws -> FolderDownloadResult {
+        var result = FolderDownloadResult()
+        guard !uids.isEmpty else { return result }
+
+        // Re-select folder (may have been deselected during counting phase)
+        _ = try await service.examineFolder(folder.name)
+
+        let cap = options.maxMessagesPerFolder > 0 ? options.maxMessagesPerFolder : nil
+        if let cap = cap, uids.count > cap {
+            logger.log("Saving only the newest \(cap) of \(uids.count) new emails in \(folder.name)", level: .info)
+        }
+
+        let headersOnly = options.headersOnly && files != nil
+        let saveSidecars = options.saveEnvelopeSidecars && !headersOnly && files != nil
+        let ordered = Self.downloadOrder(uids, order: options.fetchOrder, maxMessages: cap)
+        // Saved emails waiting to be recorded in the index
+        var indexed: [IndexedEmail] = []
+
+        // Two-phase: sizes and envelopes of the batch up front, so below only the bodies are fetched,
+        // each on its own. An email missing here has its size and envelope fetched one by one.
+        var prefetchedEnvelopes: [UInt32: String] = [:]
+        if account.fetchStrategy == .twoPhase {
+            do {
+                prefetchedEnvelopes = try await account.fetchStrategy.prefetchEnvelopes(
+                    for: Array(ordered.prefix(cap ?? ordered.count)),
+                    using: service
+                )
+            } catch is CancellationError {
+                return result
+            } catch {
+                logger.log("\(folder.path): batched envelope fetch failed, fetching envelopes per email: \(error.localizedDescription)", level: .warning)
+            }
+        }
+
+        for uid in ordered {
+            guard !Task.isCancelled else { break }
+            if let cap = cap, result.downloaded >= cap { break }
+            // Another batch of this folder already gave up on it
+            if await budget.isExceeded {
+                result.gaveUp = true
+                break
+            }
+            let failuresBefore = result.errors.count
+            let savedBefore = result.downloaded
+
+            var lastError: Error?
+            for attempt in 1...Constants.maxRetryAttempts {
+                do {
+                    // Check email size first to decide whether to stream
+                    let emailSize: Int
+                    if headersOnly {
+                        emailSize = 0
+                    } else if let size = prefetchedEnvelopes[uid].flatMap(FetchStrategy.reportedSize(in:)) {
+                        emailSize = size
+                    } else {
+                        emailSize = try await service.fetchEmailSize(uid: uid)
+                    }
+
+                    // Only an email larger than the limit can hold an attachment over it
+                    var oversized: (structure: BodyStructure, parts: [BodyStructure])?
+                    let sizeLimit = options.skipAttachmentsOverBytes
+                    if !headersOnly && sizeLimit > 0 && emailSize > sizeLimit,
+                       let structure = try await service.fetchBodyStructure(uid: uid) {
+                        let parts = structure.attachments(over: sizeLimit)
+                        if !parts.isEmpty {
+                            oversized = (structure, parts)
+                        }
+                    }
+                    let useStreaming = !headersOnly && oversized == nil && files != nil && emailSize > options.streamingThresholdBytes
+
+                    var bytesDownloaded: Int64 = 0
+                    var email: Email
+                    var parsed: ParsedEmail?
+                    var emptyBody = false
+                    var futureDated = false
+                    let savedURL: URL
+
+                    if headersOnly, let files = files {
+                        // Envelope only; nothing is verified, so server cleanup never touches these
+                        let response: String
+                        if let prefetched = prefetchedEnvelopes[uid] {
+                            response = prefetched
+                        } else {
+                            response = try await service.fetchEnvelope(uid: uid)
+                        }
+                        var sidecar = EnvelopeSidecar(uid: uid, folder: folder.path, response: response)
+                            .applying(options.localFlagPolicy)
+                        bytesDownloaded = Int64(response.utf8.count)
+
+                        parsed = EmailParser.parseMetadata(from: Data(sidecar.headerBlock.utf8))
+                        let (date, dateInFuture) = await Self.filenameDate(headerDate: parsed?.date, clamp: options.clampFutureDates) {
+                            try await service.fetchInternalDate(uid: uid)
+                        }
+                        futureDated = dateInFuture
+                        if futureDated {
+                            sidecar.futureDated = true
+                        }
+                        email = Email(
+                            messageId: parsed?.messageId ?? UUID().uuidString,
+                            uid: uid,
+                            folder: folder.path,
+                            subject: parsed?.subject ?? "(No Subject)",
+                            sender: parsed?.senderName ?? "Unknown",
+                            senderEmail: parsed?.senderEmail ?? "",
+                            date: date
+                        )
+
+                        savedURL = try await files.saveHeadersOnly(
+                            sidecar,
+                            email: email,
+                            accountEmail: account.email,
+                            folderPath: folder.path
+                        )
+                    } else if let oversized = oversized {
+                        let skippedParts = oversized.parts
+                        // Part by part, without the large attachments. The copy is incomplete, so it is
+                        // never verified and server cleanup never removes the original.
+                        let limit = ByteCountFormatter.string(fromByteCount: Int64(sizeLimit), countStyle: .file)
+                        let emailData = try await oversized.structure.assemble(
+                            skipping: Set(skippedParts.map(\.section)),
+                            placeholder: { part in
+                                let size = ByteCountFormatter.string(fromByteCount: Int64(part.decodedSize), countStyle: .file)
+                                return "Attachment \"\(part.filename ?? "unnamed")\" (\(size)) is larger than \(limit) and was left on the server.\r\n"
+                            }
+                        ) { section in
+                            try await service.fetchBodySection(uid: uid, section: section)
+                        }
+                        bytesDownloaded = Int64(emailData.count)
+
+                        parsed = EmailParser.parseMetadata(from: emailData)
+                        let (date, dateInFuture) = await Self.filenameDate(headerDate: parsed?.date, clamp: options.clampFutureDates) {
+                            try await service.fetchInternalDate(uid: uid)
+                        }
+                        futureDated = dateInFuture
+
+                        email = Email(
+                            messageId: parsed?.messageId ?? UUID().uuidString,
+                            uid: uid,
+                            folder: folder.path,
+                            subject: parsed?.subject ?? "(No Subject)",
+                            sender: parsed?.senderName ?? "Unknown",
+                            senderEmail: parsed?.senderEmail ?? "",
+                            date: date
+                        )
+
+                        savedURL = try await storage.saveEmail(
+                            emailData,
+                            email: email,
+                            accountEmail: account.email,
+                            folderPath: folder.path
+                        )
+                        logger.log("UID \(uid): left \(skippedParts.count) attachment(s) over \(limit) on the server", level: .info)
+
+                        if files != nil {
+                            let notDownloaded = skippedParts.map { part in
+                                AttachmentMetadata(
+                                    filename: (part.filename ?? "attachment").sanitizedForFilename(),
+                                    size: part.decodedSize,
+                                    sha256: "",
+                                    contentType: part.contentType,
+                                    skipReason: "larger than \(limit), not downloaded"
+                                )
+                            }
+                            await extractAttachments(from: emailData, emailURL: savedURL, settings: options.attachments, notDownloaded: notDownloaded)
+                        }
+                    } else if useStreaming, let files = files {
+                        // Stream large email directly to disk
+                        logger.log("Streaming large email (UID: \(uid), size: \(ByteCountFormatter.string(fromByteCount: Int64(emailSize), countStyle: .file)))", level: .info)
+
+                        // Create placeholder email for filename
+                        email = Email(
+                            messageId: UUID().uuidString,
+                            uid: uid,
+                            folder: folder.path,
+                            subject: "(Streaming)",
+                            sender: "Unknown",
+                            senderEmail: "",
+                            date: Date()
+                        )
+
+                        let (tempURL, finalURL) = try await files.prepareStreamingDestination(
+                            email: email,
+                            accountEmail: account.email,
+                            folderPath: folder.path
+                        )
+
+                        // Stream directly to disk, once more when the size is off like an in-memory download
+                        bytesDownloaded = try await service.streamEmailToFile(uid: uid, destinationURL: tempURL)
+                        if !IMAPService.sizeMatches(reported: emailSize, actual: Int(bytesDownloaded)) {
+                            logger.log("UID \(uid): streamed \(bytesDownloaded) bytes but the server reported \(emailSize), fetching again", level: .warning)
+                            bytesDownloaded = try await service.streamEmailToFile(uid: uid, destinationURL: tempURL)
+                        }
+                        guard IMAPService.sizeMatches(reported: emailSize, actual: Int(bytesDownloaded)) else {
+                            let quarantineURL = try await files.quarantineStreamedFile(
+                                tempURL,
+                                email: email,
+                                accountEmail: account.email,
+                                folderPath: folder.path
+                            )
+                            let message = "UID \(uid): downloaded \(bytesDownloaded) bytes but the server reported \(emailSize), quarantined as \(quarantineURL.lastPathComponent)"
+                            await recordQuarantine(uid: uid, message: message, folder: folder, result: &result, events: events)
+                            lastError = nil
+                            break // Not retried again in this run
+                        }
+
+                        // Move to final location and update UID cache
+                        try await files.finalizeStreamedFile(tempURL: tempURL, finalURL: finalURL, uid: uid)
+                        savedURL = finalURL
+
+                        if let destinations = destinations {
+                            try await destinations.mirrorEmail(
+                                Data(contentsOf: finalURL, options: .mappedIfSafe),
+                                email: email,
+                                accountEmail: account.email,
+                                folderPath: folder.path
+                            )
+                        }
+
+                        // The file must hold every byte streamed; the server's size was checked above,
+                        // allowing for how it counts line endings, and may be unknown
+                        if await files.verifySavedEmail(at: finalURL, expectedSize: Int(bytesDownloaded)) {
+                            result.verifiedUIDs.append(uid)
+                        } else {
+                            logger.log("Size mismatch for streamed email UID \(uid), it will not be removed from the server", level: .warning)
+                        }
+
+                        // Check for moved emails (deduplication)
+                        let dupResult = await files.checkAndHandleDuplicate(
+                            newFileURL: finalURL,
+                            accountEmail: account.email
+                        )
+                        if dupResult.isDuplicate, let movedFrom = dupResult.movedFrom {
+                            logger.log("Detected moved email: \(movedFrom.lastPathComponent) -> \(finalURL.lastPathComponent)", level: .debug)
+                        }
+
+                        // Read headers from saved file for metadata
+                        if let headerContent = await files.readEmailHeaders(at: finalURL) {
+                            if let headerData = headerContent.data(using: .utf8) {
+                                parsed = EmailParser.parseMetadata(from: headerData)
+                            }
+                        }
+
+                        // Update email with parsed metadata (file is already saved with placeholder name)
+                        // In streaming mode, we keep the placeholder filename but log the actual subject
+                        if let p = parsed {
+                            logger.log("Streamed email: \(p.subject ?? "(No Subject)") from \(p.senderEmail ?? "unknown")", level: .debug)
+                        }
+
+                    } else {
+                        // Normal in-memory download for smaller emails, checked against RFC822.SIZE
+                        let (emailData, sizeMatches) = try await IMAPService.fetchVerifyingSize(uid: uid, reportedSize: emailSize) {
+                            try await service.fetchEmail(uid: uid)
+                        }
+                        bytesDownloaded = Int64(emailData.count)
+
+                        // Verify download - check for valid email structure
+                        // Try progressively smaller chunks until string conversion succeeds
+                        // (some emails have invalid bytes in the middle that break full conversion)
+                        var content: String? = nil
+                        for chunkSize in [8192, 4096, 2048, 1024, 512] {
+                            let headerCheckData = emailData.prefix(chunkSize)
+                            if let str = String(data: headerCheckData, encoding: .utf8) ?? String(data: headerCheckData, encoding: .ascii) {
+                                content = str
+                                break
+                            }
+                        }
+                        // Case-insensitive header check (some servers use lowercase headers)
+                        let contentLower = content?.lowercased() ?? ""
+                        let hasValidHeaders = !contentLower.isEmpty && (contentLower.contains("from:") || contentLower.contains("date:") || contentLower.contains("subject:") || contentLower.contains("received:") || contentLower.contains("return-path:"))
+                        // The server itself has nothing for this message; that is its content, not a failed download
+                        let emptyOnServer = emailData.isEmpty && emailSize == 0
+
+                        guard emptyOnServer || (emailData.count > 0 && hasValidHeaders) else {
+                            // The bytes themselves only go to the debug log, never to a file of their own
+                            let hexPreview = emailData.prefix(500).map { String(format: "%02x", $0) }.joined(separator: " ")
+                            logger.log("UID \(uid) first 500 bytes (hex): \(hexPreview)", level: .debug)
+                            logger.log("Invalid email data for UID \(uid): size=\(emailData.count) bytes", level: .error)
+                            throw BackupEngineError.invalidEmailData
+                        }
+
+                        // Parse email headers to get metadata
+                        parsed = EmailParser.parseMetadata(from: emailData)
+                        emptyBody = EmailParser.hasEmptyBody(emailData)
+                        let (date, dateInFuture) = await Self.filenameDate(headerDate: parsed?.date, clamp: options.clampFutureDates) {
+                            try await service.fetchInternalDate(uid: uid)
+                        }
+                        futureDated = dateInFuture
+
+                        email = Email(
+                            messageId: parsed?.messageId ?? UUID().uuidString,
+                            uid: uid,
+                            folder: folder.path,
+                            subject: parsed?.subject ?? "(No Subject)",
+                            sender: parsed?.senderName ?? "Unknown",
+                            senderEmail: parsed?.senderEmail ?? "",
+                            date: date
+                        )
+
+                        guard sizeMatches else {
+                            // Probably truncated; keep it apart and try again on the next backup
+                            var message = "UID \(uid): downloaded \(emailData.count) bytes but the server reported \(emailSize)"
+                            if let files = files {
+                                let quarantineURL = try await files.quarantineEmail(
+                                    emailData,
+                                    email: email,
+                                    accountEmail: account.email,
+                                    folderPath: folder.path
+                                )
+                                message += ", quarantined as \(quarantineURL.lastPathComponent)"
+                            }
+                            await recordQuarantine(uid: uid, message: message, folder: folder, result: &result, events: events)
+                            lastError = nil
+                            break // Not retried again in this run
+                        }
+
+                        // Save to disk (file existence = backup record, no database needed)
+                        savedURL = try await storage.saveEmail(
+                            emailData,
+                            email: email,
+                            accountEmail: account.email,
+                            folderPath: folder.path
+                        )
+
+                        if let files = files {
+                            if await files.verifySavedEmail(at: savedURL, matches: emailData) {
+                                result.verifiedUIDs.append(uid)
+                            } else {
+                                logger.log("Checksum mismatch for email UID \(uid), it will not be removed from the server", level: .warning)
+                            }
+
+                            // Check for moved emails (deduplication)
+                            let dupResult = await files.checkAndHandleDuplicate(
+                                newFileURL: savedURL,
+                                accountEmail: account.email
+                            )
+                            if dupResult.isDuplicate, let movedFrom = dupResult.movedFrom {
+                                logger.log("Detected moved email: \(movedFrom.lastPathComponent) -> \(savedURL.lastPathComponent)", level: .debug)
+                            }
+
+                            if let attachments = options.attachments {
+                                await extractAttachments(from: emailData, emailURL: savedURL, settings: attachments)
+                            }
+                        }
+                    }
+
+                    if saveSidecars, let files = files {
+                        await saveEnvelopeSidecar(
+                            uid: uid,
+                            folder: folder,
+                            emailURL: savedURL,
+                            emptyBody: emptyBody,
+                            futureDated: futureDated,
+                            prefetchedResponse: prefetchedEnvelopes[uid],
+                            service: service,
+                            files: files
+                        )
+                    }
+                    if emptyBody {
+                        logger.log("UID \(uid) in \(folder.path) has no body (\(bytesDownloaded) bytes), saved as it is", level: .info)
+                        result.emptyBodyUIDs.append(uid)
+                    }
+                    if futureDated {
+                        let dated = parsed?.date.map { ISO8601DateFormatter().string(from: $0) } ?? "?"
+                        logger.log("\(folder.path): UID \(uid) is dated far in the future (\(dated))\(options.clampFutureDates ? ", named by when the server received it" : "")", level: .warning)
+                        result.futureDatedUIDs.append(uid)
+                    }
+
+                    result.downloaded += 1
+                    result.bytes += bytesDownloaded
+                    await events?(.saved(folder: folder, uid: uid, subject: parsed?.subject, url: savedURL, bytes: bytesDownloaded))
+
+                    if index != nil {
+                        indexed.append(IndexedEmail(
+                            accountId: account.email,
+                            messageId: parsed?.messageId ?? email.messageId,
+                            uid: uid,
+                            mailbox: folder.path,
+                            sender: parsed?.senderEmail,
+                            subject: parsed?.subject,
+                            date: parsed?.date,
+                            filePath: savedURL.path
+                        ))
+                        if indexed.count >= Self.indexBatchSize {
+                            await recordInIndex(&indexed, folder: folder)
+                        }
+                    }
+
+                    lastError = nil
+                    break // Success, exit retry loop
+
+                } catch IMAPError.bandwidthLimitExceeded(let message) {
+                    await events?(.interrupted(folder: folder, uid: uid, reason: message))
+                    throw IMAPError.bandwidthLimitExceeded(message)
+                } catch is CancellationError {
+                    // Not a failure of this email; the loop stops below
+                    lastError = nil
+                    break
+                } catch {
+                    lastError = error
+                    if attempt < Constants.maxRetryAttempts && options.retryDelayMs > 0 {
+                        // Exponential backoff: 1s, 2s, 4s by default
+                        let delay = UInt64(options.retryDelayMs) * 1_000_000 * UInt64(1 << (attempt - 1))
+                        try? await Task.sleep(nanoseconds: delay)
+                    }
+                }
+            }
+
+            // Record error after all retries failed
+            if let error = lastError {
+                logger.log("\(folder.path): skipping UID \(uid) after \(Constants.maxRetryAttempts) attempts: \(error.localizedDescription)", level: .warning)
+                result.failedUIDs.append(uid)
+                result.errors.append("UID \(uid): \(error.localizedDescription)")
+                await events?(.failed(
+                    folder: folder,
+                    uid: uid,
+                    reason: error.localizedDescription,
+                    error: BackupError(
+                        message: "Failed after \(Constants.maxRetryAttempts) attempts: \(error.localizedDescription)",
+                        folder: folder.name,
+                        email: "UID: \(uid)",
+                        kind: FailureKind.classify(error)
+                    )
+                ))
+            }
+
+            // Outside the retries: storage running out is not a failure of this email
+            if let storageCheck = storageCheck, result.downloaded > savedBefore,
+               result.downloaded.isMultiple(of: options.storageCheckInterval) {
+                do {
+                    try storageCheck()
+                } catch {
+                    await recordInIndex(&indexed, folder: folder)
+                    throw error
+                }
+            }
+
+            switch await budget.record(succeeded: result.errors.count == failuresBefore) {
+            case .withinBudget:
+                break
+            case .exceeded(let failed, let attempted):
+                let message = "Gave up on \(folder.path): \(failed) of \(attempted) emails failed, more than the allowed \(options.maxErrorPercent)%"
+                logger.log(message, level: .error)
+                result.gaveUp = true
+                result.errors.append(message)
+                await events?(.gaveUp(folder: folder, error: BackupError(message: message, folder: folder.name)))
+            case .alreadyExceeded:
+                result.gaveUp = true
+            }
+            if result.gaveUp { break }
+
+            await Self.pauseBetweenMessages(milliseconds: options.messageDelayMs)
+        }
+
+        await recordInIndex(&indexed, folder: folder)
+        return result
+    }
+
+    /// Emails recorded in the index per transaction
+    static let indexBatchSize = 100
+
+    /// Best effort: the index only speeds up lookups, the files on disk are the backup
+    private func recordInIndex(_ rows: inout [IndexedEmail], folder: IMAPFolder) async {
+        guard let index = index, !rows.isEmpty else { return }
+        do {
+            try await index.recordEmails(rows)
+        } catch {
+            logger.log("\(folder.path): could not record \(rows.count) emails in the index: \(error.localizedDescription)", level: .warning)
+        }
+        rows.removeAll()
+    }
+
+    /// A download that came down with the wrong size twice fails; the next run tries it again
+    private func recordQuarantine(
+        uid: UInt32,
+        message: String,
+        folder: IMAPFolder,
+        result: inout FolderDownloadResult,
+        events: EventHandler?
+    ) async {
+        logger.log(message, level: .warning)
+        result.quarantined.append(uid)
+        result.failedUIDs.append(uid)
+        result.errors.append(message)
+        await events?(.failed(
+            folder: folder,
+            uid: uid,
+            reason: message,
+            error: BackupError(message: message, folder: folder.name, email: "UID: \(uid)")
+        ))
+    }
+
+    // MARK: - Sidecars and Attachments
+
+    /// Best effort: a missing sidecar never fails the email itself
+    private func saveEnvelopeSidecar(
+        uid: UInt32,
+        folder: IMAPFolder,
+        emailURL: URL,
+        emptyBody: Bool,
+        futureDated: Bool,
+        prefetchedResponse: String?,
+        service: IMAPServiceProtocol,
+        files: StorageService
+    ) async {
+        do {
+            let response: String
+            if let prefetchedResponse = prefetchedResponse {
+                response = prefetchedResponse
+            } else {
+                response = try await service.fetchEnvelope(uid: uid)
+            }
+            var sidecar = EnvelopeSidecar(uid: uid, folder: folder.path, response: response)
+                .applying(options.localFlagPolicy)
+            if emptyBody {
+                sidecar.emptyBody = true
+            }
+            if futureDated {
+                sidecar.futureDated = true
+            }
+            try await files.saveEnvelopeSidecar(sidecar, for: emailURL)
+        } catch {
+            logger.log("Failed to save envelope for UID \(uid): \(error.localizedDescription)", level: .warning)
+        }
+    }
+
+    /// Save the attachments of an email with `settings`, and list `notDownloaded` ones in its metadata.
+    /// Without settings only those are recorded.
+    private func extractAttachments(
+        from emailData: Data,
+        emailURL: URL,
+        settings: AttachmentExtractionSettings?,
+        notDownloaded: [AttachmentMetadata] = []
+    ) async {
+        let attachmentService = AttachmentService()
+        var attachments: [AttachmentService.Attachment] = []
+        if settings != nil {
+            attachments = await attachmentService.extractAttachments(from: emailData)
+        }
+
+        guard !attachments.isEmpty || !notDownloaded.isEmpty else { return }
+
+        // Attachment folder has the same name as the email file without extension
+        let emailFilename = emailURL.deletingPathExtension().lastPathComponent
+
+        do {
+            let saved = try await attachmentService.saveAttachments(
+                attachments,
+                for: emailURL,
+                strategy: settings?.dedupStrategy ?? .rename,
+                skipRules: settings?.skipRules ?? AttachmentSkipRules(),
+                maxConcurrentWrites: settings?.maxConcurrentWrites ?? 1,
+                notDownloaded: notDownloaded
+            )
+            let skipped = saved.filter { $0.skipReason != nil }.count
+            if saved.count > skipped {
+                logger.log("Extracted \(saved.count - skipped) attachment(s) from \(emailFilename)", level: .debug)
+            }
+            if skipped > 0 {
+                logger.log("Skipped \(skipped) attachment(s) of \(emailFilename) by skip rules", level: .debug)
+            }
+        } catch {
+            logger.log("Failed to extract attachments from \(emailFilename): \(error.localizedDescription)", level: .warning)
+        }
+    }
+
+    // MARK: - Helpers
+
+    /// Date an email is named by. A Date header far in the future, as spam often has, is flagged and,
+    /// with `clamp`, replaced by the server's INTERNALDATE so the email does not sort ahead of real mail.
+    /// Without a usable INTERNALDATE the header date is kept.
+    static func filenameDate(
+        headerDate: Date?,
+        clamp: Bool,
+        now: Date = Date(),
+        internalDate: () async throws -> Date?
+    ) async -> (date: Date, futureDated: Bool) {
+        guard let headerDate = headerDate else { return (now, false) }
+        guard Email.isFarFuture(headerDate, now: now) else { return (headerDate, false) }
+        guard clamp, let received = try? await internalDate() else { return (headerDate, true) }
+        return (received, true)
+    }
+
+    /// Order new emails are downloaded in. A capped run keeps the newest emails whatever the
+    /// order, so it always walks newest first and keeps going past failed emails until the cap
+    /// is reached; it returns every UID.
+    static func downloadOrder(_ uids: [UInt32], order: FetchOrder = .oldestFirst, maxMessages: Int?) -> [UInt32] {
+        guard maxMessages == nil else { return FetchOrder.newestFirst.arrange(uids) }
+        return order.arrange(uids)
+    }
+
+    /// Split new UIDs into at most `connections` contiguous batches of at least `minimumBatch` UIDs,
+    /// so a small folder is not worth extra logins
+    static func fetchBatches(_ uids: [UInt32], connections: Int, minimumBatch: Int = 50) -> [[UInt32]] {
+        guard !uids.isEmpty else { return [] }
+        let count = max(1, min(connections, uids.count / max(minimumBatch, 1)))
+        let size = (uids.count + count - 1) / count
+        return stride(from: 0, to: uids.count, by: size).map { Array(uids[$0..<min($0 + size, uids.count)]) }
+    }
+
+    /// Run `batches` at the same time, the first over `main` and each other one over a connection from `open`.
+    /// Every batch is awaited and every extra connection closed on all exit paths: when all are done, when one
+    /// batch fails and the rest are cancelled, and when the calling task is cancelled.
+    /// Batches whose connection could not be opened are returned to be run over `main` afterwards.
+    static func runBatches<BatchResult>(
+        _ batches: [[UInt32]],
+        main: IMAPServiceProtocol,
+        open: () async throws -> IMAPServiceProtocol,
+        run: @escaping ([UInt32], IMAPServiceProtocol) async throws -> BatchResult
+    ) async throws -> (results: [BatchResult], unopened: [UInt32]) {
+        guard let first = batches.first else { return ([], []) }
+        var extraServices: [IMAPServiceProtocol] = []
+        var unopened: [UInt32] = []
+
+        do {
+            let results = try await withThrowingTaskGroup(of: BatchResult.self) { group -> [BatchResult] in
+                group.addTask {
+                    try await run(first, main)
+                }
+
+                for batch in batches.dropFirst() {
+                    // No new connections once cancelled; the batch is handed back unstarted
+                    guard !Task.isCancelled, let service = try? await open() else {
+                        unopened += batch
+                        continue
+                    }
+                    extraServices.append(service)
+                    group.addTask {
+                        try await run(batch, service)
+                    }
+                }
+
+                var results: [BatchResult] = []
+                for try await batchResult in group {
+                    results.append(batchResult)
+                }
+                return results
+            }
+
+            for service in extraServices {
+                try? await service.logout()
+            }
+            return (results, unopened)
+        } catch {
+            // The group has waited for every batch. A connection given up on may still be inside a
+            // FETCH, so it is dropped rather than sent a LOGOUT whose answer would never be read.
+            for service in extraServices {
+                await service.disconnect()
+            }
+            throw error
+        }
+    }
+
+    /// Sleep `milliseconds` after an email; returns early when the task is cancelled
+    static func pauseBetweenMessages(milliseconds: Int) async {
+        guard milliseconds > 0 else { return }
+        try? await Task.sleep(nanoseconds: UInt64(milliseconds) * 1_000_000)
+    }
+}
+
+/// Failed emails of one folder, counted across all batches downloading it at once, so a folder
+/// split over several connections is given up on at the same rate as one downloaded over one
+private actor FolderErrorBudget {
+    enum Outcome {
+        case withinBudget
+        /// This email pushed the folder over the limit; reported once per folder
+        case exceeded(failed: Int, attempted: Int)
+        /// Another batch already reported the folder as given up
+        case alreadyExceeded
+    }
+
+    private var budget: ErrorBudget
+
+    init(maxErrorPercent: Int) {
+        budget = ErrorBudget(maxErrorPercent: maxErrorPercent)
+    }
+
+    var isExceeded: Bool {
+        budget.isExceeded
+    }
+
+    func record(succeeded: Bool) -> Outcome {
+        guard !budget.isExceeded else { return .alreadyExceeded }
+        budget.record(succeeded: succeeded)
+        return budget.isExceeded ? .exceeded(failed: budget.failed, attempted: budget.attempted) : .withinBudget
+    }
+}
+
+/// Progress of an embedded backup, which batches of one folder may update at the same time
+private actor ProgressTracker {
+    private(set) var progress: BackupProgress
+    private let handler: BackupEngine.ProgressHandler?
+
+    init(_ progress: BackupProgress, handler: BackupEngine.ProgressHandler?) {
+        self.progress = progress
+        self.handler = handler
+    }
+
+    func update(_ change: (inout BackupProgress) -> Void) {
+        change(&progress)
+        handler?(progress)
+    }
+
+    func record(_ event: BackupEngine.Event) {
+        switch event {
+        case .saved(_, _, let subject, _, let bytes):
+            update {
+                $0.downloadedEmails += 1
+                $0.bytesDownloaded += bytes
+                $0.currentEmailSubject = subject ?? "(No Subject)"
+            }
+        case .failed(_, _, _, let error), .gaveUp(_, let error):
+            update { $0.errors.append(error) }
+        case .interrupted:
+            break
+        }
+    }
+}
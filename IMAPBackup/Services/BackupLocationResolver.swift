@@ -0,0 +1,138 @@
+import Foundation
+
+enum BackupLocationError: LocalizedError {
+    case notWritable(String)
+
+    var errorDescription: String? {
+        switch self {
+        case .notWritable(let path):
+            return "The backup location \(path) is not writable"
+        }
+    }
+}
+
+/// Works out where backups go when no location was chosen, and expands `~` and environment
+/// variables in a configured one. Everything but `checkWritable` is a pure function of its
+/// arguments, so each platform's rules can be tested anywhere.
+enum BackupLocationResolver {
+    enum Platform {
+        case macOS
+        case linux
+        case windows
+
+        static var current: Platform {
+            #if os(macOS)
+            return .macOS
+            #elseif os(Windows)
+            return .windows
+            #else
+            return .linux
+            #endif
+        }
+    }
+
+    static let directoryName = "IMAPBackup"
+
+    /// The configured path expanded, or the platform default when nothing is configured
+    static func resolve(
+        configured: String?,
+        platform: Platform = .current,
+        environment: [String: String] = ProcessInfo.processInfo.environment,
+        home: String = NSHomeDirectory()
+    ) -> String {
+        let configured = configured?.trimmingCharacters(in: .whitespaces) ?? ""
+        guard !configured.isEmpty else {
+            return defaultPath(platform: platform, environment: environment, home: home)
+        }
+        return expand(configured, platform: platform, environment: environment, home: home)
+    }
+
+    /// ~/Library/Application Support on macOS, $XDG_DATA_HOME (or ~/.local/share) on Linux,
+    /// %LOCALAPPDATA% (or ~\AppData\Local) on Windows
+    static func defaultPath(platform: Platform, environment: [String: String], home: String) -> String {
+        switch platform {
+        case .macOS:
+            return join(home, "Library", "Application Support", directoryName, separator: "/")
+        case .linux:
+            // The spec says relative values are invalid and must be ignored
+            if let dataHome = environment["XDG_DATA_HOME"], dataHome.hasPrefix("/") {
+                return join(dataHome, directoryName, separator: "/")
+            }
+            return join(home, ".local", "share", directoryName, separator: "/")
+        case .windows:
+            if let localAppData = environment["LOCALAPPDATA"], !localAppData.isEmpty {
+                return join(localAppData, directoryName, separator: "\\")
+            }
+            return join(home, "AppData", "Local", directoryName, separator: "\\")
+        }
+    }
+
+    /// Expand a leading `~` and `$NAME` / `${NAME}` (plus `%NAME%` on Windows).
+    /// Variables that are not set are left as written rather than silently becoming empty.
+    static func expand(_ path: String, platform: Platform, environment: [String: String], home: String) -> String {
+        var expanded = path
+        if expanded == "~" {
+            expanded = home
+        } else if expanded.hasPrefix("~/") || (platform == .windows && expanded.hasPrefix("~\\")) {
+            expanded = home + expanded.dropFirst()
+        }
+
+        var patterns = [#"\$\{([A-Za-z_][A-Za-z0-9_]*)\}"#, #"\$([A-Za-z_][A-Za-z0-9_]*)"#]
+        if platform == .windows {
+            patterns.append(#"%([A-Za-z_][A-Za-z0-9_()]*)%"#)
+        }
+        for pattern in patterns {
+            expanded = replacingVariables(in: expanded, pattern: pattern, environment: environment, platform: platform)
+        }
+        return expanded
+    }
+
+    /// Create the directory if needed and make sure a file can be written into it
+    static func checkWritable(_ url: URL, fileManager: FileManager = .default) throws {
+        do {
+            try fileManager.createDirectory(at: url, withIntermediateDirectories: true)
+            let probeURL = url.appendingPathComponent(".write_test_\(UUID().uuidString)")
+            try Data().write(to: probeURL)
+            try fileManager.removeItem(at: probeURL)
+        } catch {
+            throw BackupLocationError.notWritable(url.path)
+        }
+    }
+
+    // MARK: - Helpers
+
+    private static func join(_ components: String..., separator: String) -> String {
+        var path = components[0]
+        for component in components.dropFirst() {
+            if !path.hasSuffix(separator) {
+                path += separator
+            }
+            path += component
+        }
+        return path
+    }
+
+    private static func replacingVariables(
+        in path: String,
+        pattern: String,
+        environment: [String: String],
+        platform: Platform
+    ) -> String {
+        guard let regex = try? NSRegularExpression(pattern: pattern) else { return path }
+        var result = path
+        // Replace from the end so earlier ranges stay valid
+        for match in regex.matches(in: path, range: NSRange(path.startIndex..., in: path)).reversed() {
+            guard let nameRange = Range(match.range(at: 1), in: path),
+                  let wholeRange = Range(match.range, in: result) else { continue }
+            let name = String(path[nameRange])
+            // Windows variable names are case-insensitive
+            let value = environment[name] ?? (platform == .windows
+                ? environment.first { $0.key.caseInsensitiveCompare(name) == .orderedSame }?.value
+                : nil)
+            if let value = value {
+                result.replaceSubrange(wholeRange, with: value)
+            }
+        }
+        return result
+    }
+}
@@ -111,12 +111,103 @@ class BackupManager: ObservableObject {
     @Published var scheduleConfiguration: ScheduleConfiguration = ScheduleConfiguration()
     @Published var nextScheduledBackup: Date?
 
+    /// Hours between flag refreshes, which update read and flag state in envelope metadata
+    /// without downloading; 0 turns them off. Set with `-FlagRefreshIntervalHours <n>`
+    @Published var flagRefreshIntervalHours = 0
+    @Published var nextFlagRefresh: Date?
+    @Published var isRefreshingFlags = false
+    @Published var lastFlagRefreshResults: [FlagRefreshResult] = []
+
+    /// Dry-run comparison of the enabled accounts with their backups
+    @Published var isComparing = false
+    @Published var lastDiffs: [BackupDiff] = []
+
+    /// Server-side search of the enabled accounts, nothing downloaded
+    @Published var isSearchingServer = false
+    @Published var lastServerSearch: [ServerSearchResult] = []
+
     /// Threshold above which emails are streamed directly to disk (in bytes)
     @Published var streamingThresholdBytes: Int = Constants.defaultStreamingThresholdBytes
 
+    /// Store server-reported ENVELOPE/BODYSTRUCTURE as a sidecar next to each email (opt-in)
+    @Published var saveEnvelopeSidecars = false
+
+    /// Name emails whose Date header lies far in the future by their INTERNALDATE instead (opt-in)
+    @Published var clampFutureDates = false
+
+    /// Read state written to envelope metadata; can be given at launch as `-LocalFlagPolicy mark-read`
+    @Published var localFlagPolicy: LocalFlagPolicy = .preserve
+
+    /// Arrangement of email files inside folder directories
+    @Published var storageLayout: StorageLayout = .flat
+
+    /// Append a record per finished folder to backup_report.jsonl (opt-in)
+    @Published var writeBackupReports = false
+
+    /// Keep a _folder.json overview in each backed-up folder (opt-in, -WriteFolderSummaries YES)
+    @Published var writeFolderSummaries = false
+
+    /// Save only ENVELOPE, FLAGS and BODYSTRUCTURE per message, no .eml (lightweight index)
+    @Published var headersOnly = false
+
+    /// How already backed-up messages are recognized
+    @Published var incrementalStrategy: IncrementalStrategy = .uid
+
+    /// Keep every folder's backed-up UIDs in one state file per account instead of reading each folder's cache
+    @Published var useStateIndex = false
+
+    /// Which server messages are searched; can be given at launch as `-BackupSince last-run`
+    @Published var backupSince: BackupSince = .all
+
+    /// Additional locations every email is also written to, e.g. a mounted offsite volume
+    @Published var mirrorLocations: [URL] = []
+
+    /// Destinations that must accept each email; 0 means all of them. Set with `-DestinationQuorum <n>`
+    private(set) var destinationQuorum = 0
+
+    /// Order new emails are saved in; can be given at launch as `-FetchOrder newest-first`
+    @Published var fetchOrder: FetchOrder = .oldestFirst
+
+    /// Save at most this many new emails per folder, newest first; 0 for no limit.
+    /// Meant for trying settings on a huge mailbox, can be given as `-MaxMessagesPerFolder <n>`
+    @Published var maxMessagesPerFolder = 0
+
+    /// Give up on a folder once more than this percentage of its emails failed to save; 0 never gives up.
+    /// Single failures are always logged, reported by UID and skipped. Set with `-MaxErrorPercent <n>`
+    @Published var maxErrorPercent = 0
+
+    /// Stop a backup when a location's volume has fewer free inodes (files it can still hold) than this;
+    /// 0 never stops. Warns at twice this. Set with `-MinimumFreeInodes <n>`
+    @Published var minimumFreeInodes = InodeCheck.defaultMinimum
+
+    /// Connections used to download one folder's new emails in parallel batches; 1 downloads them one by one.
+    /// Capped by the account's rate limit `maxConcurrentRequests` and the provider's connection limit. Set with `-MaxConcurrentMessagesPerFolder <n>`
+    @Published var maxConcurrentMessagesPerFolder = 1
+
+    /// Fixed pause after each email, on top of the rate limiter, for extra gentle backups from shared servers.
+    /// 0 does not pause. Set with `-MessageDelayMs <n>`
+    @Published var messageDelayMs = 0
+
+    /// Folders backed up when set, e.g. INBOX and Sent; empty backs up every folder. Special-use
+    /// names find the provider's folder for that use. Set with `-DefaultFolders '(INBOX, Sent)'`
+    @Published var defaultFolders: [String] = []
+
+    /// Back up every folder this run regardless of `defaultFolders`, given at launch as
+    /// `--all-folders` or `-AllFolders YES`; never stored
+    private(set) var backUpAllFolders = false
+
+    /// Named subsets of accounts that can be backed up on their own
+    @Published var profiles = BackupProfiles()
+
+    /// Per-message results (saved path, size, or error) for live logs
+    let messageEvents = MessageEventStream()
+
     /// Accounts that are missing passwords (e.g., after migration)
     @Published var accountsWithMissingPasswords: [EmailAccount] = []
 
+    /// Where this manager and the backups it runs log to
+    private let logger: BackupLogger
+
     private var activeTasks: [UUID: Task<Void, Never>] = [:]
     private var activeHistoryIds: [UUID: UUID] = [:]  // Account ID -> History Entry ID
     private var activeIMAPServices: [UUID: IMAPService] = [:]  // Account ID -> Active IMAP Service
@@ -149,16 +240,50 @@ class BackupManager: ObservableObject {
     private let scheduleKey = "BackupSchedule"
     private let scheduleTimeKey = "BackupScheduleTime"
     private let scheduleConfigKey = "BackupScheduleConfig"
+    private let flagRefreshIntervalKey = "FlagRefreshIntervalHours"
     private let backupLocationKey = "BackupLocation"
     private let streamingThresholdKey = "StreamingThresholdBytes"
-
-    init() {
-        // Load backup location or set default
-        if let savedPath = UserDefaults.standard.string(forKey: backupLocationKey) {
-            self.backupLocation = URL(fileURLWithPath: savedPath)
+    private let envelopeSidecarsKey = "SaveEnvelopeSidecars"
+    private let storageLayoutKey = "StorageLayout"
+    private let backupReportsKey = "WriteBackupReports"
+    private let folderSummariesKey = "WriteFolderSummaries"
+    private let clampFutureDatesKey = "ClampFutureDates"
+    private let headersOnlyKey = "HeadersOnlyBackup"
+    private let incrementalStrategyKey = "IncrementalStrategy"
+    private let stateIndexKey = "UseStateIndex"
+    private let backupSinceKey = "BackupSince"
+    private let mirrorLocationsKey = "MirrorLocations"
+    private let destinationQuorumKey = "DestinationQuorum"
+    private let maxMessagesPerFolderKey = "MaxMessagesPerFolder"
+    private let maxErrorPercentKey = "MaxErrorPercent"
+    private let minimumFreeInodesKey = "MinimumFreeInodes"
+    private let maxConcurrentMessagesPerFolderKey = "MaxConcurrentMessagesPerFolder"
+    private let messageDelayMsKey = "MessageDelayMs"
+    private let defaultFoldersKey = "DefaultFolders"
+    private let allFoldersKey = "AllFolders"
+    private let fetchOrderKey = "FetchOrder"
+    private let localFlagPolicyKey = "LocalFlagPolicy"
+    private let profilesKey = "BackupProfiles"
+    /// Path of a JSON profiles file used instead of the stored profiles; can be given at launch as `-ProfilesFile <path>`
+    private let profilesFileKey = "ProfilesFile"
+    /// Profile to back up right after launch, given as `-BackupProfile <name>`
+    private let launchProfileKey = "BackupProfile"
+    /// Account to back up right after launch, repeatable: `-BackupAccount a@example.com -BackupAccount b@example.com`
+    private let launchAccountKey = "BackupAccount"
+
+    init(logger: BackupLogger = AppLogger()) {
+        self.logger = logger
+
+        // Load backup location or set default; a saved or `-BackupLocation` path may use ~ and $VARIABLES
+        let documentsURL = FileManager.default.urls(for: .documentDirectory, in: .userDomainMask).first!
+        let legacyURL = documentsURL.appendingPathComponent("IMAPBackup")
+        if let savedPath = UserDefaults.standard.string(forKey: backupLocationKey), !savedPath.isEmpty {
+            self.backupLocation = URL(fileURLWithPath: BackupLocationResolver.resolve(configured: savedPath), isDirectory: true)
+        } else if FileManager.default.fileExists(atPath: legacyURL.path) {
+            // Backups made before the platform default stay where they are
+            self.backupLocation = legacyURL
         } else {
-            let documentsURL = FileManager.default.urls(for: .documentDirectory, in: .userDomainMask).first!
-            self.backupLocation = documentsURL.appendingPathComponent("IMAPBackup")
+            self.backupLocation = URL(fileURLWithPath: BackupLocationResolver.resolve(configured: nil), isDirectory: true)
         }
 
         // Load saved accounts and schedule
@@ -169,15 +294,68 @@ class BackupManager: ObservableObject {
         if UserDefaults.standard.object(forKey: streamingThresholdKey) != nil {
             streamingThresholdBytes = UserDefaults.standard.integer(forKey: streamingThresholdKey)
         }
+        saveEnvelopeSidecars = UserDefaults.standard.bool(forKey: envelopeSidecarsKey)
+        if let rawLayout = UserDefaults.standard.string(forKey: storageLayoutKey),
+           let layout = StorageLayout(rawValue: rawLayout) {
+            storageLayout = layout
+        }
+        writeBackupReports = UserDefaults.standard.bool(forKey: backupReportsKey)
+        writeFolderSummaries = UserDefaults.standard.bool(forKey: folderSummariesKey)
+        clampFutureDates = UserDefaults.standard.bool(forKey: clampFutureDatesKey)
+        headersOnly = UserDefaults.standard.bool(forKey: headersOnlyKey)
+        useStateIndex = UserDefaults.standard.bool(forKey: stateIndexKey)
+        if let rawStrategy = UserDefaults.standard.string(forKey: incrementalStrategyKey),
+           let strategy = IncrementalStrategy(rawValue: rawStrategy) {
+            incrementalStrategy = strategy
+        }
+        if let rawSince = UserDefaults.standard.string(forKey: backupSinceKey) {
+            if let since = BackupSince(argument: rawSince) {
+                backupSince = since
+            } else {
+                logger.log("Ignoring BackupSince \"\(rawSince)\": expected all, last-run or yyyy-MM-dd", level: .warning)
+            }
+        }
+        mirrorLocations = (UserDefaults.standard.stringArray(forKey: mirrorLocationsKey) ?? [])
+            .map { URL(fileURLWithPath: $0) }
+        destinationQuorum = UserDefaults.standard.integer(forKey: destinationQuorumKey)
+        maxMessagesPerFolder = max(UserDefaults.standard.integer(forKey: maxMessagesPerFolderKey), 0)
+        maxErrorPercent = min(max(UserDefaults.standard.integer(forKey: maxErrorPercentKey), 0), 100)
+        if UserDefaults.standard.object(forKey: minimumFreeInodesKey) != nil {
+            minimumFreeInodes = max(UserDefaults.standard.integer(forKey: minimumFreeInodesKey), 0)
+        }
+        maxConcurrentMessagesPerFolder = max(UserDefaults.standard.integer(forKey: maxConcurrentMessagesPerFolderKey), 1)
+        messageDelayMs = max(UserDefaults.standard.integer(forKey: messageDelayMsKey), 0)
+        defaultFolders = UserDefaults.standard.stringArray(forKey: defaultFoldersKey) ?? []
+        backUpAllFolders = UserDefaults.standard.bool(forKey: allFoldersKey)
+            || ProcessInfo.processInfo.arguments.contains(FolderSelection.allFoldersFlag)
+        if let rawOrder = UserDefaults.standard.string(forKey: fetchOrderKey) {
+            if let order = FetchOrder(rawValue: rawOrder) {
+                fetchOrder = order
+            } else {
+                logger.log("Ignoring FetchOrder \"\(rawOrder)\": expected oldest-first or newest-first", level: .warning)
+            }
+        }
+        if let rawPolicy = UserDefaults.standard.string(forKey: localFlagPolicyKey) {
+            if let policy = LocalFlagPolicy(rawValue: rawPolicy) {
+                localFlagPolicy = policy
+            } else {
+                logger.log("Ignoring LocalFlagPolicy \"\(rawPolicy)\": expected preserve, mark-read or mark-unread", level: .warning)
+            }
+        }
+        loadProfiles()
 
         // Create backup directory
-        try? FileManager.default.createDirectory(at: backupLocation, withIntermediateDirectories: true)
+        do {
+            try BackupLocationResolver.checkWritable(backupLocation)
+        } catch {
+            logger.log("\(error.localizedDescription); backups will fail until another location is chosen", level: .error)
+        }
 
         // Clean up any incomplete downloads from previous sessions
         Task {
             let storageService = StorageService(baseURL: backupLocation)
             if let cleaned = try? await storageService.cleanupIncompleteDownloads(), cleaned > 0 {
-                print("Cleaned up \(cleaned) incomplete download(s)")
+                logger.log("Cleaned up \(cleaned) incomplete download(s)", level: .info)
             }
         }
 
@@ -192,6 +370,38 @@ class BackupManager: ObservableObject {
 
         // Subscribe to rate limit settings changes for real-time propagation
         subscribeToRateLimitChanges()
+
+        if let profile = UserDefaults.standard.string(forKey: launchProfileKey) {
+            do {
+                try startBackup(profile: profile)
+            } catch {
+                logger.log("Cannot start backup for profile \(profile): \(error.localizedDescription)", level: .error)
+            }
+        }
+
+        let launchAccounts = Self.repeatedArgument(launchAccountKey, in: ProcessInfo.processInfo.arguments)
+        if !launchAccounts.isEmpty {
+            do {
+                try startBackup(accountEmails: launchAccounts)
+            } catch {
+                logger.log("Cannot start backup: \(error.localizedDescription)", level: .error)
+            }
+        }
+    }
+
+    /// Every value given for `-name value` in launch arguments. UserDefaults only keeps the last one.
+    nonisolated static func repeatedArgument(_ name: String, in arguments: [String]) -> [String] {
+        var values: [String] = []
+        var index = arguments.startIndex
+        while index < arguments.endIndex {
+            if arguments[index] == "-\(name)" || arguments[index] == "--\(name)", index + 1 < arguments.endIndex {
+                values.append(arguments[index + 1])
+                index += 2
+            } else {
+                index += 1
+            }
+        }
+        return values
     }
 
     /// Subscribe to rate limit settings changes and propagate to active IMAP services
@@ -212,7 +422,7 @@ class BackupManager: ObservableObject {
             // Account-specific settings changed - update that account's IMAP service
             if let imapService = activeIMAPServices[accountId] {
                 await imapService.updateRateLimitSettings(change.settings)
-                logInfo("Updated rate limit settings for account \(accountId)")
+                logger.log("Updated rate limit settings for account \(accountId)", level: .info)
             }
         } else {
             // Global settings changed - update all accounts that use global settings
@@ -222,7 +432,7 @@ class BackupManager: ObservableObject {
                     await imapService.updateRateLimitSettings(change.settings)
                 }
             }
-            logInfo("Updated global rate limit settings for \(activeIMAPServices.count) active service(s)")
+            logger.log("Updated global rate limit settings for \(activeIMAPServices.count) active service(s)", level: .info)
         }
     }
 
@@ -236,7 +446,7 @@ class BackupManager: ObservableObject {
                 // Only check password-based accounts, not OAuth
                 guard account.authType == .password else { continue }
 
-                let hasPassword = await KeychainService.shared.hasPassword(for: account.id)
+                let hasPassword = await account.hasPassword()
                 if !hasPassword {
                     missing.append(account)
                 }
@@ -254,7 +464,7 @@ class BackupManager: ObservableObject {
     func addAccount(_ account: EmailAccount, password: String?) -> Bool {
         // Check for duplicate email address
         if accounts.contains(where: { $0.email.lowercased() == account.email.lowercased() }) {
-            logError("Account with email \(account.email) already exists")
+            logger.log("Account with email \(account.email) already exists", level: .error)
             return false
         }
 
@@ -269,9 +479,9 @@ class BackupManager: ObservableObject {
             Task {
                 do {
                     try await KeychainService.shared.savePassword(passwordToSave, for: account.id)
-                    logInfo("Password saved to Keychain for \(account.email)")
+                    logger.log("Password saved to Keychain for \(account.email)", level: .info)
                 } catch {
-                    logError("Failed to save password to Keychain for \(account.email): \(error.localizedDescription)")
+                    logger.log("Failed to save password to Keychain for \(account.email): \(error.localizedDescription)", level: .error)
                 }
             }
         }
@@ -287,16 +497,34 @@ class BackupManager: ObservableObject {
     func removeAccount(_ account: EmailAccount) {
         accounts.removeAll { $0.id == account.id }
         saveAccounts()
-        // Remove password from Keychain
+        // Remove password and OAuth tokens from Keychain
         Task {
-            do {
-                try await KeychainService.shared.deletePassword(for: account.id)
-            } catch {
-                logWarning("Failed to delete password from Keychain for \(account.email): \(error.localizedDescription)")
+            let result = await AccountPurgeService.purgeSecrets(of: account, store: KeychainService.shared)
+            for error in result.errors {
+                logger.log("Failed to delete Keychain item for \(account.email): \(error)", level: .warning)
             }
         }
     }
 
+    /// Remove an account with its Keychain secrets and, if asked, its backup directory.
+    /// Asking is the confirmation; the caller shows what will be deleted first.
+    func purgeAccount(_ account: EmailAccount, deleteBackups: Bool) async throws {
+        cancelBackup(for: account.id)
+        accounts.removeAll { $0.id == account.id }
+        saveAccounts()
+        invalidateStatsCache(for: account.id)
+
+        let result = await AccountPurgeService.purgeSecrets(of: account, store: KeychainService.shared)
+        for error in result.errors {
+            logger.log("Failed to delete Keychain item for \(account.email): \(error)", level: .warning)
+        }
+
+        if deleteBackups {
+            try AccountPurgeService.removeBackupDirectory(for: account, in: backupLocation, mode: .confirmed)
+        }
+        logger.log("Purged account \(account.email)\(deleteBackups ? " and its backups" : "")", level: .info)
+    }
+
     func updateAccount(_ account: EmailAccount, password: String? = nil) {
         if let index = accounts.firstIndex(where: { $0.id == account.id }) {
             accounts[index] = account
@@ -307,7 +535,7 @@ class BackupManager: ObservableObject {
                     do {
                         try await KeychainService.shared.savePassword(password, for: account.id)
                     } catch {
-                        logError("Failed to update password in Keychain for \(account.email): \(error.localizedDescription)")
+                        logger.log("Failed to update password in Keychain for \(account.email): \(error.localizedDescription)", level: .error)
                     }
                 }
             }
@@ -359,6 +587,8 @@ class BackupManager: ObservableObject {
            let config = try? JSONDecoder().decode(ScheduleConfiguration.self, from: configData) {
             self.scheduleConfiguration = config
         }
+
+        flagRefreshIntervalHours = max(UserDefaults.standard.integer(forKey: flagRefreshIntervalKey), 0)
     }
 
     func setSchedule(_ newSchedule: BackupSchedule) {
@@ -381,6 +611,12 @@ class BackupManager: ObservableObject {
         updateScheduler()
     }
 
+    func setFlagRefreshInterval(hours: Int) {
+        flagRefreshIntervalHours = max(hours, 0)
+        UserDefaults.standard.set(flagRefreshIntervalHours, forKey: flagRefreshIntervalKey)
+        updateScheduler()
+    }
+
     var scheduledTimeFormatted: String {
         let formatter = DateFormatter()
         formatter.timeStyle = .short
@@ -392,16 +628,21 @@ class BackupManager: ObservableObject {
         scheduleTimer?.invalidate()
         scheduleTimer = nil
         nextScheduledBackup = nil
+        nextFlagRefresh = nil
 
-        guard schedule != .manual else { return }
+        guard schedule != .manual || flagRefreshIntervalHours > 0 else { return }
 
         // Calculate next backup time
         nextScheduledBackup = calculateNextBackupTime()
+        if flagRefreshIntervalHours > 0 {
+            nextFlagRefresh = Date().addingTimeInterval(TimeInterval(flagRefreshIntervalHours * 3600))
+        }
 
         // Set up timer to check every minute if it's time to backup
         scheduleTimer = Timer.scheduledTimer(withTimeInterval: 60, repeats: true) { [weak self] _ in
             Task { @MainActor in
                 self?.checkScheduledBackup()
+                self?.checkScheduledFlagRefresh()
             }
         }
     }
@@ -511,6 +752,159 @@ class BackupManager: ObservableObject {
         nextScheduledBackup = calculateNextBackupTime()
     }
 
+    /// Flag refreshes wait for a running backup, which saves current flags anyway
+    private func checkScheduledFlagRefresh() {
+        guard flagRefreshIntervalHours > 0,
+              !isBackingUp, !isRefreshingFlags,
+              let nextRefresh = nextFlagRefresh,
+              Date() >= nextRefresh else { return }
+
+        nextFlagRefresh = Date().addingTimeInterval(TimeInterval(flagRefreshIntervalHours * 3600))
+        Task {
+            await refreshFlags()
+        }
+    }
+
+    // MARK: - Flag Refresh
+
+    /// Update read and flag state in the envelope metadata of all enabled accounts without
+    /// downloading any email. Accounts are refreshed a few at a time, each within its rate limit.
+    @discardableResult
+    func refreshFlags() async -> [FlagRefreshResult] {
+        guard !isRefreshingFlags else { return [] }
+        isRefreshingFlags = true
+        defer { isRefreshingFlags = false }
+
+        let results = await FlagRefreshService.refreshAll(accounts: accounts) { account in
+            await self.refreshFlags(for: account)
+        }
+        lastFlagRefreshResults = results
+        return results
+    }
+
+    private func refreshFlags(for account: EmailAccount) async -> FlagRefreshResult {
+        let imapService = IMAPService(account: account)
+        let storageService = StorageService(baseURL: backupLocation)
+        await storageService.setFolderRemap(account.folderRemap, for: account.email)
+        await storageService.setFlatFolderSeparator(account.flatFolderSeparator, for: account.email)
+        await storageService.setLayout(storageLayout)
+
+        let rateLimitSettings = RateLimitService.shared.getSettings(for: account.id)
+        let sharedTracker = RateLimitService.shared.getTracker(forServer: account.imapServer, accountId: account.id)
+        await imapService.configureRateLimit(settings: rateLimitSettings, sharedTracker: sharedTracker)
+
+        do {
+            try await imapService.connect()
+            try await imapService.login()
+            let result = try await FlagRefreshService.refreshAccount(
+                accountEmail: account.email,
+                service: imapService,
+                storageService: storageService,
+                policy: localFlagPolicy
+            )
+            try? await imapService.logout()
+            return result
+        } catch {
+            await imapService.disconnect()
+            logger.log("Flag refresh failed for \(account.email): \(error.localizedDescription)", level: .error)
+            var result = FlagRefreshResult(accountEmail: account.email)
+            result.errors.append(error.localizedDescription)
+            return result
+        }
+    }
+
+    // MARK: - Dry Run
+
+    /// Compare every enabled account with its backup without downloading or writing anything
+    @discardableResult
+    func compareWithServer() async -> [BackupDiff] {
+        guard !isComparing else { return [] }
+        isComparing = true
+        defer { isComparing = false }
+
+        var diffs: [BackupDiff] = []
+        for account in accounts where account.isEnabled {
+            guard !Task.isCancelled else { break }
+            diffs.append(await compareWithServer(account))
+        }
+        lastDiffs = diffs
+        return diffs
+    }
+
+    private func compareWithServer(_ account: EmailAccount) async -> BackupDiff {
+        let imapService = IMAPService(account: account)
+        let storageService = StorageService(baseURL: backupLocation)
+        await storageService.setFolderRemap(account.folderRemap, for: account.email)
+        await storageService.setFlatFolderSeparator(account.flatFolderSeparator, for: account.email)
+        await storageService.setLayout(storageLayout)
+
+        let rateLimitSettings = RateLimitService.shared.getSettings(for: account.id)
+        let sharedTracker = RateLimitService.shared.getTracker(forServer: account.imapServer, accountId: account.id)
+        await imapService.configureRateLimit(settings: rateLimitSettings, sharedTracker: sharedTracker)
+
+        do {
+            try await imapService.connect()
+            try await imapService.login()
+            let diff = try await BackupDiffService.diffAccount(
+                accountEmail: account.email,
+                service: imapService,
+                storageService: storageService
+            )
+            try? await imapService.logout()
+            return diff
+        } catch {
+            await imapService.disconnect()
+            logger.log("Comparing \(account.email) with its backup failed: \(error.localizedDescription)", level: .error)
+            var diff = BackupDiff(accountEmail: account.email, comparedAt: Date())
+            diff.errors.append(error.localizedDescription)
+            return diff
+        }
+    }
+
+    /// Search the enabled accounts on the server without downloading anything. With folder
+    /// names only those folders are searched, otherwise every selectable one.
+    @discardableResult
+    func searchServer(_ criteria: IMAPSearchCriteria, folderNames: [String] = []) async -> [ServerSearchResult] {
+        guard !isSearchingServer else { return [] }
+        isSearchingServer = true
+        defer { isSearchingServer = false }
+
+        var results: [ServerSearchResult] = []
+        for account in accounts where account.isEnabled {
+            guard !Task.isCancelled else { break }
+            results.append(await searchServer(account, criteria: criteria, folderNames: folderNames))
+        }
+        lastServerSearch = results
+        return results
+    }
+
+    private func searchServer(_ account: EmailAccount, criteria: IMAPSearchCriteria, folderNames: [String]) async -> ServerSearchResult {
+        let imapService = IMAPService(account: account)
+
+        let rateLimitSettings = RateLimitService.shared.getSettings(for: account.id)
+        let sharedTracker = RateLimitService.shared.getTracker(forServer: account.imapServer, accountId: account.id)
+        await imapService.configureRateLimit(settings: rateLimitSettings, sharedTracker: sharedTracker)
+
+        do {
+            try await imapService.connect()
+            try await imapService.login()
+            let result = try await ServerSearchService.searchAccount(
+                accountEmail: account.email,
+                criteria: criteria,
+                folderNames: folderNames,
+                service: imapService
+            )
+            try? await imapService.logout()
+            return result
+        } catch {
+            await imapService.disconnect()
+            logger.log("Searching \(account.email) on the server failed: \(error.localizedDescription)", level: .error)
+            var result = ServerSearchResult(accountEmail: account.email)
+            result.errors.append(error.localizedDescription)
+            return result
+        }
+    }
+
     // MARK: - Backup Operations
 
     func startBackup(for account: EmailAccount) {
@@ -530,6 +924,26 @@ class BackupManager: ObservableObject {
         }
     }
 
+    /// Back up the enabled accounts of a profile
+    func startBackup(profile: String) throws {
+        let profileAccounts = try profiles.accounts(for: profile, in: accounts)
+        logger.log("Starting backup for profile \(profile): \(profileAccounts.count) accounts", level: .info)
+        for account in profileAccounts where account.isEnabled {
+            startBackup(for: account)
+        }
+    }
+
+    /// Back up the named accounts only, for one-offs without setting up a profile.
+    /// Named accounts are backed up even when disabled; no names backs up all enabled accounts.
+    func startBackup(accountEmails: [String]) throws {
+        let selected = try BackupProfiles.accounts(named: accountEmails, in: accounts)
+            .filter { $0.isEnabled || !accountEmails.isEmpty }
+        logger.log("Starting backup for \(selected.map(\.email).joined(separator: ", "))", level: .info)
+        for account in selected {
+            startBackup(for: account)
+        }
+    }
+
     func cancelBackup(for accountId: UUID) {
         activeTasks[accountId]?.cancel()
         activeTasks.removeValue(forKey: accountId)
@@ -589,11 +1003,12 @@ class BackupManager: ObservableObject {
             totalErrors: totalErrors
         )
 
-        // Apply retention policies after all backups complete
+        // Apply retention policies after all backups complete; only reports unless confirmed
         Task {
-            let result = await RetentionService.shared.applyRetentionToAll(backupLocation: backupLocation)
+            let mode = RetentionService.shared.takeAutomaticMode()
+            let result = await RetentionService.shared.applyRetentionToAll(backupLocation: backupLocation, mode: mode)
             if result.filesDeleted > 0 {
-                logInfo("Retention policy applied: deleted \(result.filesDeleted) files, freed \(result.bytesFreedFormatted)")
+                logger.log("Retention policy \(mode == .dryRun ? "would delete" : "deleted") \(result.filesDeleted) files, \(result.bytesFreedFormatted)", level: .info)
             }
         }
     }
@@ -603,6 +1018,13 @@ class BackupManager: ObservableObject {
     private func performBackup(for account: EmailAccount) async {
         let imapService = IMAPService(account: account)
         let storageService = StorageService(baseURL: backupLocation)
+        await storageService.setFolderRemap(account.folderRemap, for: account.email)
+        await storageService.setFlatFolderSeparator(account.flatFolderSeparator, for: account.email)
+        await storageService.setLayout(storageLayout)
+        if useStateIndex {
+            await storageService.loadStateIndex(accountEmail: account.email)
+        }
+        let destinations = await makeDestinations(primary: storageService, account: account)
 
         // Configure rate limiting with shared server tracker
         let rateLimitSettings = RateLimitService.shared.getSettings(for: account.id)
@@ -612,23 +1034,72 @@ class BackupManager: ObservableObject {
         // Track active IMAP service for real-time settings propagation
         activeIMAPServices[account.id] = imapService
 
+        // Extra connections for parallel batches share the account's rate limit tracker
+        let openConnection: BackupEngine.ConnectionOpener = {
+            let service = IMAPService(account: account)
+            await service.configureRateLimit(settings: rateLimitSettings, sharedTracker: sharedTracker)
+            do {
+                try await service.connect()
+                try await service.login()
+            } catch {
+                // Connected but not logged in still holds a socket
+                await service.disconnect()
+                throw error
+            }
+            return service
+        }
+
         // Start history entry
         let historyId = BackupHistoryService.shared.startEntry(for: account.email)
         activeHistoryIds[account.id] = historyId
 
-        logInfo("Starting backup for account: \(account.email)")
+        logger.log("Starting backup for account: \(account.email)", level: .info)
+        let runStartedAt = Date()
 
         do {
+            // Nothing is fetched when the emails could not be written anyway
+            let inodeMonitor = InodeMonitor(locations: [backupLocation] + mirrorLocations, minimum: minimumFreeInodes, logger: logger)
+            try inodeMonitor.check()
+
             // Connect
             updateProgressImmediate(for: account.id) { $0.status = .connecting }
             try await imapService.connect()
             try await imapService.login()
-            logInfo("Connected and authenticated to \(account.imapServer)")
+            logger.log("Connected and authenticated to \(account.imapServer)", level: .info)
+
+            // Finding and downloading new emails is the engine's; this run adds history, checkpoints and cleanup.
+            // Its connection count holds for every folder, so the provider's limit, known only from the
+            // greeting, caps the main connection and every batch connection together.
+            let engine = makeEngine(
+                storage: destinations ?? storageService,
+                rateLimitSettings: rateLimitSettings,
+                quirks: await imapService.serverInfo()?.quirks,
+                index: await openIndex(),
+                storageCheck: inodeMonitor.check
+            )
 
             // Fetch folders
             updateProgressImmediate(for: account.id) { $0.status = .fetchingFolders }
-            let folders = try await imapService.listFolders()
-            let selectableFolders = folders.filter { $0.isSelectable }
+            var folders = try await imapService.listFolders()
+            if account.backupSharedFolders {
+                let sharedFolders = try await imapService.listSharedFolders().filter { account.includesSharedFolder($0) }
+                logger.log("Including \(sharedFolders.count) shared folders", level: .info)
+                folders += sharedFolders
+            }
+            let selectableFolders = FolderSelection.foldersToBackUp(
+                folders.filter { $0.isSelectable },
+                defaultFolders: defaultFolders,
+                allFolders: backUpAllFolders
+            )
+            if !defaultFolders.isEmpty && !backUpAllFolders {
+                logger.log("Backing up \(selectableFolders.count) default folder(s) of \(account.email)", level: .info)
+            }
+
+            // Keep folders that sanitize to the same local path from merging
+            try await storageService.resolveFolderCollisions(
+                accountEmail: account.email,
+                folderPaths: selectableFolders.map { $0.path }
+            )
 
             updateProgress(for: account.id) {
                 $0.totalFolders = selectableFolders.count
@@ -637,6 +1108,7 @@ class BackupManager: ObservableObject {
             // Phase 1: Count all emails that need to be downloaded
             updateProgressImmediate(for: account.id) { $0.status = .counting }
             var folderNewUIDs: [(IMAPFolder, [UInt32])] = []
+            var uidValidities: [String: UInt32] = [:]
             var totalNewEmails = 0
 
             for (index, folder) in selectableFolders.enumerated() {
@@ -646,16 +1118,15 @@ class BackupManager: ObservableObject {
                     $0.currentFolder = folder.name
                 }
 
-                let newUIDs = try await countNewEmails(
-                    in: folder,
-                    account: account,
-                    imapService: imapService,
-                    storageService: storageService
-                )
+                let (newUIDs, uidValidity) = try await engine.newUIDs(in: folder, account: account, service: imapService)
+                uidValidities[folder.path] = uidValidity
 
                 if !newUIDs.isEmpty {
                     folderNewUIDs.append((folder, newUIDs))
-                    totalNewEmails += newUIDs.count
+                    totalNewEmails += maxMessagesPerFolder > 0 ? min(newUIDs.count, maxMessagesPerFolder) : newUIDs.count
+                } else if writeFolderSummaries {
+                    // Nothing to download, but the last sync time still moves on
+                    await writeFolderSummary(folder, uidValidity: uidValidity, account: account, storageService: storageService)
                 }
             }
 
@@ -664,9 +1135,21 @@ class BackupManager: ObservableObject {
                 $0.totalEmails = totalNewEmails
             }
 
-            logInfo("Found \(totalNewEmails) new emails to download across \(folderNewUIDs.count) folders")
+            logger.log("Found \(totalNewEmails) new emails to download across \(folderNewUIDs.count) folders", level: .info)
+
+            // Continue where an interrupted run stopped: its folders go first
+            if let checkpoint = await storageService.loadCheckpoint(accountEmail: account.email) {
+                let pendingPaths = checkpoint.folders.map { $0.path }
+                logger.log("Resuming from checkpoint (\(checkpoint.reason)): \(checkpoint.remainingCount) emails in \(pendingPaths.count) folders", level: .info)
+                folderNewUIDs = folderNewUIDs.filter { pendingPaths.contains($0.0.path) }
+                    + folderNewUIDs.filter { !pendingPaths.contains($0.0.path) }
+            }
 
             // Phase 2: Download emails from each folder
+            // Whether any email failed or was left behind by a folder that was given up on
+            var missedEmails = false
+            // Taken once, so --yes covers the cleanup of every folder of this account
+            let cleanupMode = ServerCleanupService.shared.takeAutomaticMode()
             for (index, (folder, newUIDs)) in folderNewUIDs.enumerated() {
                 guard !Task.isCancelled else { break }
 
@@ -674,35 +1157,117 @@ class BackupManager: ObservableObject {
                     $0.currentFolder = folder.name
                     $0.processedFolders = index
                 }
+                updateProgressImmediate(for: account.id) { $0.status = .downloading }
 
-                try await downloadEmails(
-                    uids: newUIDs,
-                    from: folder,
-                    account: account,
-                    imapService: imapService,
-                    storageService: storageService
-                )
+                let folderStartedAt = Date()
+                let result: FolderDownloadResult
+                do {
+                    result = try await engine.downloadFolder(
+                        newUIDs,
+                        from: folder,
+                        account: account,
+                        service: imapService,
+                        openConnection: openConnection
+                    ) { [weak self] event in
+                        await self?.record(event, for: account)
+                    }
+                } catch IMAPError.bandwidthLimitExceeded(let message) {
+                    // Retrying cannot help until the provider resets the cap; save what is left and stop
+                    let pending = folderNewUIDs[index...].map { (path: $0.0.path, uids: $0.1) }
+                    let checkpoint = try await storageService.saveCheckpoint(
+                        accountEmail: account.email,
+                        pending: pending,
+                        reason: message
+                    )
+                    logger.log("Download limit reached for \(account.email), \(checkpoint.remainingCount) emails left for the next run: \(message)", level: .warning)
+                    throw BackupManagerError.bandwidthLimitReached(remaining: checkpoint.remainingCount)
+                }
+                let verifiedUIDs = result.verifiedUIDs
+                missedEmails = missedEmails || !result.failedUIDs.isEmpty || result.gaveUp
+
+                // Also between folders, which can be shorter than the engine's interval
+                try inodeMonitor.check()
+
+                let folderRecord = BackupReportRecord(
+                    kind: .folder,
+                    runId: historyId,
+                    accountEmail: account.email,
+                    folder: folder.path,
+                    startedAt: folderStartedAt,
+                    finishedAt: Date(),
+                    downloaded: result.downloaded,
+                    failed: result.failedUIDs.count,
+                    bytes: result.bytes,
+                    errors: result.errors,
+                    quarantined: result.quarantined.isEmpty ? nil : result.quarantined,
+                    failedUIDs: result.failedUIDs.isEmpty ? nil : result.failedUIDs,
+                    gaveUp: result.gaveUp ? true : nil,
+                    emptyBodyUIDs: result.emptyBodyUIDs.isEmpty ? nil : result.emptyBodyUIDs,
+                    futureDatedUIDs: result.futureDatedUIDs.isEmpty ? nil : result.futureDatedUIDs
+                ).withTiming()
+                if !result.emptyBodyUIDs.isEmpty {
+                    logger.log("\(folder.path): \(result.emptyBodyUIDs.count) emails have no body on the server and were saved as they are", level: .info)
+                }
+                if result.downloaded > 0 {
+                    let throughput = ByteCountFormatter.string(fromByteCount: Int64(folderRecord.bytesPerSecond ?? 0), countStyle: .file)
+                    logger.log("\(folder.path): \(result.downloaded) emails in \(folderRecord.durationMs ?? 0) ms (\(throughput)/s)", level: .info)
+                }
+
+                if writeBackupReports {
+                    await appendReportRecord(folderRecord, storageService: storageService)
+                }
+                if writeFolderSummaries {
+                    await writeFolderSummary(folder, uidValidity: uidValidities[folder.path], account: account, storageService: storageService)
+                }
+
+                // Free server quota only for messages confirmed on disk
+                if ServerCleanupService.shared.settings.isActive && !Task.isCancelled {
+                    do {
+                        _ = try await ServerCleanupService.shared.cleanup(
+                            uids: verifiedUIDs,
+                            in: folder,
+                            allFolders: selectableFolders,
+                            imapService: imapService,
+                            mode: cleanupMode
+                        )
+                    } catch {
+                        logger.log("Server cleanup failed for \(folder.name): \(error.localizedDescription)", level: .warning)
+                        updateProgress(for: account.id) {
+                            $0.errors.append(BackupError(
+                                message: "Server cleanup failed: \(error.localizedDescription)",
+                                folder: folder.name
+                            ))
+                        }
+                    }
+                }
             }
 
+            await saveStateIndex(for: account, storageService: storageService)
+
             // Complete
             updateProgressImmediate(for: account.id) {
                 $0.status = .completed
                 $0.processedFolders = folderNewUIDs.count
             }
 
-            // Update last backup date
+            // Update last backup date. A cancelled run, or one that skipped emails, does not count as
+            // successful: searching from its start next time would never retry what failed.
             var updatedAccount = account
-            updatedAccount.lastBackupDate = Date()
+            updatedAccount.recordBackup(startedAt: runStartedAt, succeeded: !Task.isCancelled && !missedEmails)
             updateAccount(updatedAccount)
 
             // Invalidate stats cache since backup added new emails
             invalidateStatsCache(for: account.id)
 
+            if !Task.isCancelled {
+                await storageService.clearCheckpoint(accountEmail: account.email)
+            }
+
             try await imapService.logout()
 
             // Update and complete history entry
             if let finalProgress = progress[account.id] {
-                logInfo("Backup completed for \(account.email): \(finalProgress.downloadedEmails) emails downloaded, \(finalProgress.errors.count) errors")
+                logger.log("Backup completed for \(account.email): \(finalProgress.downloadedEmails) emails downloaded, \(finalProgress.errors.count) errors", level: .info)
 
                 BackupHistoryService.shared.updateEntry(
                     id: historyId,
@@ -714,11 +1279,26 @@ class BackupManager: ObservableObject {
 
                 let historyStatus: BackupHistoryStatus = finalProgress.errors.isEmpty ? .completed : .completedWithErrors
                 for error in finalProgress.errors {
-                    logWarning("Backup error for \(account.email): \(error.message)")
+                    logger.log("Backup error for \(account.email): \(error.message)", level: .warning)
                     BackupHistoryService.shared.updateEntry(id: historyId, error: error.message)
                 }
                 BackupHistoryService.shared.completeEntry(id: historyId, status: historyStatus)
 
+                if writeBackupReports {
+                    await appendReportRecord(BackupReportRecord(
+                        kind: .summary,
+                        runId: historyId,
+                        accountEmail: account.email,
+                        startedAt: runStartedAt,
+                        finishedAt: Date(),
+                        downloaded: finalProgress.downloadedEmails,
+                        failed: finalProgress.errors.count,
+                        bytes: finalProgress.bytesDownloaded,
+                        errors: finalProgress.errors.map { $0.message },
+                        status: Task.isCancelled ? .cancelled : historyStatus
+                    ), storageService: storageService)
+                }
+
                 // Send completion notification
                 NotificationService.shared.notifyBackupCompleted(
                     account: account.email,
@@ -729,21 +1309,43 @@ class BackupManager: ObservableObject {
             }
 
         } catch {
-            logError("Backup failed for \(account.email): \(error.localizedDescription)")
+            let failureKind = FailureKind.classify(error)
+            logger.log("Backup failed for \(account.email) (\(failureKind.rawValue)): \(error.localizedDescription)", level: .error)
 
             updateProgressImmediate(for: account.id) {
                 $0.status = .failed
-                $0.errors.append(BackupError(message: error.localizedDescription))
+                $0.errors.append(BackupError(message: error.localizedDescription, kind: failureKind))
             }
 
+            // What was saved before the failure is recorded in it
+            await saveStateIndex(for: account, storageService: storageService)
+
             // Complete history entry with failure
             BackupHistoryService.shared.updateEntry(id: historyId, error: error.localizedDescription)
             BackupHistoryService.shared.completeEntry(id: historyId, status: .failed)
 
+            if writeBackupReports {
+                let failedProgress = progress[account.id]
+                await appendReportRecord(BackupReportRecord(
+                    kind: .summary,
+                    runId: historyId,
+                    accountEmail: account.email,
+                    startedAt: runStartedAt,
+                    finishedAt: Date(),
+                    downloaded: failedProgress?.downloadedEmails ?? 0,
+                    failed: failedProgress?.errors.count ?? 1,
+                    bytes: failedProgress?.bytesDownloaded ?? 0,
+                    errors: [error.localizedDescription],
+                    status: .failed,
+                    failureKind: failureKind
+                ), storageService: storageService)
+            }
+
             // Send failure notification
             NotificationService.shared.notifyBackupFailed(
                 account: account.email,
-                error: error.localizedDescription
+                error: error.localizedDescription,
+                kind: failureKind
             )
         }
 
@@ -756,265 +1358,143 @@ class BackupManager: ObservableObject {
         checkAllBackupsComplete()
     }
 
-    /// Phase 1: Count new emails in a folder without downloading
-    private func countNewEmails(
-        in folder: IMAPFolder,
-        account: EmailAccount,
-        imapService: IMAPService,
-        storageService: StorageService
-    ) async throws -> [UInt32] {
-        // Select folder
-        let status = try await imapService.selectFolder(folder.name)
-
-        guard status.exists > 0 else { return [] }
-
-        // Search for all emails
-        let allUIDs = try await imapService.searchAll()
-
-        // Get already backed up UIDs by scanning existing files
-        let backedUpUIDs = (try? await storageService.getExistingUIDs(
-            accountEmail: account.email,
-            folderPath: folder.path
-        )) ?? []
-
-        // Return only new UIDs
-        return allUIDs.filter { !backedUpUIDs.contains($0) }
+    // MARK: - Engine
+
+    /// The engine a backup run downloads with, configured from these settings
+    func makeEngine(
+        storage: StorageBackend,
+        rateLimitSettings: RateLimitSettings,
+        quirks: IMAPServerQuirks?,
+        index: DatabaseService? = nil,
+        storageCheck: BackupEngine.StorageCheck? = nil
+    ) -> BackupEngine {
+        BackupEngine(
+            storage: storage,
+            logger: logger,
+            options: engineOptions(connections: rateLimitSettings.folderConnections(
+                requested: maxConcurrentMessagesPerFolder,
+                quirks: quirks
+            )),
+            index: index,
+            storageCheck: storageCheck
+        )
     }
 
-    /// Phase 2: Download emails with pre-calculated UIDs
-    private func downloadEmails(
-        uids: [UInt32],
-        from folder: IMAPFolder,
-        account: EmailAccount,
-        imapService: IMAPService,
-        storageService: StorageService
-    ) async throws {
-        guard !uids.isEmpty else { return }
-
-        // Re-select folder (may have been deselected during counting phase)
-        _ = try await imapService.selectFolder(folder.name)
-
-        updateProgressImmediate(for: account.id) { $0.status = .downloading }
-
-        for uid in uids {
-            guard !Task.isCancelled else { break }
-
-            // Retry with exponential backoff (max 3 attempts)
-            var lastError: Error?
-            for attempt in 1...3 {
-                do {
-                    // Check email size first to decide whether to stream
-                    let emailSize = try await imapService.fetchEmailSize(uid: uid)
-                    let useStreaming = emailSize > streamingThresholdBytes
-
-                    var bytesDownloaded: Int64 = 0
-                    var email: Email
-                    var parsed: ParsedEmail?
-
-                    if useStreaming {
-                        // Stream large email directly to disk
-                        logInfo("Streaming large email (UID: \(uid), size: \(ByteCountFormatter.string(fromByteCount: Int64(emailSize), countStyle: .file)))")
-
-                        // Create placeholder email for filename
-                        email = Email(
-                            messageId: UUID().uuidString,
-                            uid: uid,
-                            folder: folder.path,
-                            subject: "(Streaming)",
-                            sender: "Unknown",
-                            senderEmail: "",
-                            date: Date()
-                        )
-
-                        let (tempURL, finalURL) = try await storageService.prepareStreamingDestination(
-                            email: email,
-                            accountEmail: account.email,
-                            folderPath: folder.path
-                        )
-
-                        // Stream directly to disk
-                        bytesDownloaded = try await imapService.streamEmailToFile(uid: uid, destinationURL: tempURL)
-
-                        // Move to final location and update UID cache
-                        try await storageService.finalizeStreamedFile(tempURL: tempURL, finalURL: finalURL, uid: uid)
-
-                        // Check for moved emails (deduplication)
-                        let dupResult = await storageService.checkAndHandleDuplicate(
-                            newFileURL: finalURL,
-                            accountEmail: account.email
-                        )
-                        if dupResult.isDuplicate, let movedFrom = dupResult.movedFrom {
-                            logDebug("Detected moved email: \(movedFrom.lastPathComponent) -> \(finalURL.lastPathComponent)")
-                        }
-
-                        // Read headers from saved file for metadata
-                        if let headerContent = await storageService.readEmailHeaders(at: finalURL) {
-                            if let headerData = headerContent.data(using: .utf8) {
-                                parsed = EmailParser.parseMetadata(from: headerData)
-                            }
-                        }
-
-                        // Update email with parsed metadata (file is already saved with placeholder name)
-                        // In streaming mode, we keep the placeholder filename but log the actual subject
-                        if let p = parsed {
-                            logDebug("Streamed email: \(p.subject ?? "(No Subject)") from \(p.senderEmail ?? "unknown")")
-                        }
-
-                    } else {
-                        // Normal in-memory download for smaller emails
-                        let emailData = try await imapService.fetchEmail(uid: uid)
-                        bytesDownloaded = Int64(emailData.count)
-
-                        // Verify download - check for valid email structure
-                        // Try progressively smaller chunks until string conversion succeeds
-                        // (some emails have invalid bytes in the middle that break full conversion)
-                        var content: String? = nil
-                        for chunkSize in [8192, 4096, 2048, 1024, 512] {
-                            let headerCheckData = emailData.prefix(chunkSize)
-                            if let str = String(data: headerCheckData, encoding: .utf8) ?? String(data: headerCheckData, encoding: .ascii) {
-                                content = str
-                                break
-                            }
-                        }
-                        // Case-insensitive header check (some servers use lowercase headers)
-                        let contentLower = content?.lowercased() ?? ""
-                        let hasValidHeaders = !contentLower.isEmpty && (contentLower.contains("from:") || contentLower.contains("date:") || contentLower.contains("subject:") || contentLower.contains("received:") || contentLower.contains("return-path:"))
-
-                        guard emailData.count > 0, hasValidHeaders else {
-                            // Write debug file for first failed email
-                            let debugPath = FileManager.default.urls(for: .documentDirectory, in: .userDomainMask).first!
-                                .appendingPathComponent("IMAPBackup_debug_\(uid).txt")
-                            let hexPreview = emailData.prefix(500).map { String(format: "%02x", $0) }.joined(separator: " ")
-                            let debugInfo = """
-                            UID: \(uid)
-                            Size: \(emailData.count) bytes
-                            First 500 bytes (hex): \(hexPreview)
-                            String preview (first 1000 chars): \(content?.prefix(1000) ?? "(nil)")
-                            """
-                            try? debugInfo.write(to: debugPath, atomically: true, encoding: .utf8)
-
-                            logError("Invalid email data for UID \(uid): size=\(emailData.count) bytes, debug written to \(debugPath.path)")
-                            throw BackupManagerError.invalidEmailData
-                        }
-
-                        // Parse email headers to get metadata
-                        parsed = EmailParser.parseMetadata(from: emailData)
-
-                        let messageId = parsed?.messageId ?? UUID().uuidString
-                        email = Email(
-                            messageId: messageId,
-                            uid: uid,
-                            folder: folder.path,
-                            subject: parsed?.subject ?? "(No Subject)",
-                            sender: parsed?.senderName ?? "Unknown",
-                            senderEmail: parsed?.senderEmail ?? "",
-                            date: parsed?.date ?? Date()
-                        )
-
-                        // Save to disk (file existence = backup record, no database needed)
-                        let savedURL = try await storageService.saveEmail(
-                            emailData,
-                            email: email,
-                            accountEmail: account.email,
-                            folderPath: folder.path
-                        )
-
-                        // Check for moved emails (deduplication)
-                        let dupResult = await storageService.checkAndHandleDuplicate(
-                            newFileURL: savedURL,
-                            accountEmail: account.email
-                        )
-                        if dupResult.isDuplicate, let movedFrom = dupResult.movedFrom {
-                            logDebug("Detected moved email: \(movedFrom.lastPathComponent) -> \(savedURL.lastPathComponent)")
-                        }
-
-                        // Extract attachments if enabled
-                        if AttachmentExtractionManager.shared.settings.isEnabled {
-                            await extractAttachments(
-                                from: emailData,
-                                emailURL: savedURL,
-                                accountEmail: account.email,
-                                folderPath: folder.path,
-                                storageService: storageService
-                            )
-                        }
-                    }
-
-                    // Get current count to check if we should update subject
-                    let currentDownloaded = (pendingProgressUpdates[account.id]?.downloadedEmails ?? progress[account.id]?.downloadedEmails ?? 0) + 1
-
-                    updateProgress(for: account.id) {
-                        $0.downloadedEmails += 1
-                        $0.bytesDownloaded += bytesDownloaded
-                        // Only update subject every 10 emails or 500ms to reduce UI updates
-                        if self.shouldUpdateSubject(for: account.id, currentCount: currentDownloaded) {
-                            $0.currentEmailSubject = parsed?.subject ?? "(No Subject)"
-                        }
-                    }
-
-                    lastError = nil
-                    break // Success, exit retry loop
+    /// The index of the backup location, shared by every account backed up into it so their
+    /// writes queue instead of competing for the database lock; nil when it cannot be opened
+    private func openIndex() async -> DatabaseService? {
+        let index = DatabaseService.shared(backupLocation: backupLocation)
+        do {
+            try await index.open()
+            return index
+        } catch {
+            logger.log("Cannot open the backup index, emails are saved without it: \(error.localizedDescription)", level: .warning)
+            return nil
+        }
+    }
 
-                } catch {
-                    lastError = error
-                    if attempt < Constants.maxRetryAttempts {
-                        // Exponential backoff: 1s, 2s, 4s
-                        let delay = UInt64(pow(2.0, Double(attempt - 1))) * Constants.nanosecondsPerSecond
-                        try? await Task.sleep(nanoseconds: delay)
-                    }
-                }
-            }
+    /// The engine settings of this run; `connections` already capped by the account's and the provider's limits
+    private func engineOptions(connections: Int) -> BackupEngine.Options {
+        let attachmentSettings = AttachmentExtractionManager.shared.effectiveSettings
+        return BackupEngine.Options(
+            fetchOrder: fetchOrder,
+            maxMessagesPerFolder: maxMessagesPerFolder,
+            messageDelayMs: messageDelayMs,
+            clampFutureDates: clampFutureDates,
+            maxErrorPercent: maxErrorPercent,
+            streamingThresholdBytes: streamingThresholdBytes,
+            headersOnly: headersOnly,
+            saveEnvelopeSidecars: saveEnvelopeSidecars,
+            localFlagPolicy: localFlagPolicy,
+            incrementalStrategy: incrementalStrategy,
+            backupSince: backupSince,
+            maxConcurrentMessagesPerFolder: connections,
+            attachments: attachmentSettings.isEnabled ? attachmentSettings : nil,
+            skipAttachmentsOverBytes: attachmentSettings.skipRules.maxSizeBytes
+        )
+    }
 
-            // Record error after all retries failed
-            if let error = lastError {
-                updateProgress(for: account.id) {
-                    $0.errors.append(BackupError(
-                        message: "Failed after 3 attempts: \(error.localizedDescription)",
-                        folder: folder.name,
-                        email: "UID: \(uid)"
-                    ))
+    /// Show what the engine did with one email in the progress and the per-message log
+    private func record(_ event: BackupEngine.Event, for account: EmailAccount) {
+        switch event {
+        case .saved(let folder, let uid, let subject, let url, let bytes):
+            // Get current count to check if we should update subject
+            let currentDownloaded = (pendingProgressUpdates[account.id]?.downloadedEmails ?? progress[account.id]?.downloadedEmails ?? 0) + 1
+            messageEvents.send(MessageEvent(
+                accountId: account.id,
+                folder: folder.path,
+                uid: uid,
+                subject: subject,
+                savedURL: url,
+                bytes: bytes
+            ))
+            updateProgress(for: account.id) {
+                $0.downloadedEmails += 1
+                $0.bytesDownloaded += bytes
+                // Only update subject every 10 emails or 500ms to reduce UI updates
+                if self.shouldUpdateSubject(for: account.id, currentCount: currentDownloaded) {
+                    $0.currentEmailSubject = subject ?? "(No Subject)"
                 }
             }
+        case .failed(let folder, let uid, let reason, let error):
+            messageEvents.send(MessageEvent(accountId: account.id, folder: folder.path, uid: uid, error: reason))
+            updateProgress(for: account.id) { $0.errors.append(error) }
+        case .interrupted(let folder, let uid, let reason):
+            messageEvents.send(MessageEvent(accountId: account.id, folder: folder.path, uid: uid, error: reason))
+        case .gaveUp(_, let error):
+            updateProgress(for: account.id) { $0.errors.append(error) }
         }
     }
 
-    // MARK: - Attachment Extraction
+    // MARK: - Backup Report
+
+    /// Best effort: a report that cannot be written never fails the backup
+    private func appendReportRecord(_ record: BackupReportRecord, storageService: StorageService) async {
+        do {
+            try await storageService.appendReportRecord(record)
+        } catch {
+            logger.log("Failed to append to backup report: \(error.localizedDescription)", level: .warning)
+        }
+    }
 
-    private func extractAttachments(
-        from emailData: Data,
-        emailURL: URL,
-        accountEmail: String,
-        folderPath: String,
+    /// Refresh a folder's _folder.json; a folder without one is still backed up
+    private func writeFolderSummary(
+        _ folder: IMAPFolder,
+        uidValidity: UInt32?,
+        account: EmailAccount,
         storageService: StorageService
     ) async {
-        let attachmentService = AttachmentService()
-        let attachments = await attachmentService.extractAttachments(from: emailData)
-
-        guard !attachments.isEmpty else { return }
+        do {
+            try await storageService.writeFolderSummary(
+                accountEmail: account.email,
+                folderPath: folder.path,
+                uidValidity: uidValidity == 0 ? nil : uidValidity
+            )
+        } catch {
+            logger.log("Failed to write the folder summary of \(folder.path): \(error.localizedDescription)", level: .warning)
+        }
+    }
 
-        // Create attachment folder (same name as email file without extension)
-        let emailFilename = emailURL.deletingPathExtension().lastPathComponent
-        let attachmentFolderURL = emailURL.deletingLastPathComponent().appendingPathComponent("\(emailFilename)_attachments")
+    // MARK: - State Index
 
+    private func saveStateIndex(for account: EmailAccount, storageService: StorageService) async {
+        guard useStateIndex else { return }
         do {
-            let savedURLs = try await attachmentService.saveAttachments(attachments, to: attachmentFolderURL)
-            if !savedURLs.isEmpty {
-                logDebug("Extracted \(savedURLs.count) attachment(s) from \(emailFilename)")
-            }
+            try await storageService.saveStateIndex(accountEmail: account.email)
         } catch {
-            logWarning("Failed to extract attachments from \(emailFilename): \(error.localizedDescription)")
+            logger.log("Failed to save the state index for \(account.email), the next backup reads each folder instead: \(error.localizedDescription)", level: .warning)
         }
     }
 
     // MARK: - Errors
 
     enum BackupManagerError: LocalizedError {
-        case invalidEmailData
+        case bandwidthLimitReached(remaining: Int)
 
         var errorDescription: String? {
             switch self {
-            case .invalidEmailData:
-                return "Downloaded data does not appear to be a valid email"
+            case .bandwidthLimitReached(let remaining):
+                return "The server's daily download limit was reached. \(remaining) emails remain and the next backup will continue with them."
             }
         }
     }
@@ -1128,6 +1608,127 @@ class BackupManager: ObservableObject {
         UserDefaults.standard.set(bytes, forKey: streamingThresholdKey)
     }
 
+    /// Enable or disable envelope sidecar files
+    func setSaveEnvelopeSidecars(_ enabled: Bool) {
+        saveEnvelopeSidecars = enabled
+        UserDefaults.standard.set(enabled, forKey: envelopeSidecarsKey)
+    }
+
+    /// Enable or disable naming far-future dated emails by INTERNALDATE
+    func setClampFutureDates(_ enabled: Bool) {
+        clampFutureDates = enabled
+        UserDefaults.standard.set(enabled, forKey: clampFutureDatesKey)
+    }
+
+    /// Set the layout used for newly saved emails
+    func setStorageLayout(_ layout: StorageLayout) {
+        storageLayout = layout
+        UserDefaults.standard.set(layout.rawValue, forKey: storageLayoutKey)
+    }
+
+    func setProfiles(_ newProfiles: BackupProfiles) {
+        profiles = newProfiles
+        if let path = UserDefaults.standard.string(forKey: profilesFileKey) {
+            do {
+                try newProfiles.write(to: URL(fileURLWithPath: (path as NSString).expandingTildeInPath))
+            } catch {
+                logger.log("Failed to write profiles to \(path): \(error.localizedDescription)", level: .error)
+            }
+        } else if let data = try? JSONEncoder().encode(newProfiles) {
+            UserDefaults.standard.set(data, forKey: profilesKey)
+        }
+    }
+
+    private func loadProfiles() {
+        if let path = UserDefaults.standard.string(forKey: profilesFileKey) {
+            do {
+                profiles = try BackupProfiles.load(from: URL(fileURLWithPath: (path as NSString).expandingTildeInPath))
+                logger.log("Loaded \(profiles.profiles.count) backup profiles from \(path)", level: .info)
+            } catch {
+                logger.log("Failed to load profiles from \(path): \(error.localizedDescription)", level: .error)
+            }
+        } else if let data = UserDefaults.standard.data(forKey: profilesKey),
+                  let stored = try? JSONDecoder().decode(BackupProfiles.self, from: data) {
+            profiles = stored
+        }
+
+        for problem in profiles.validate(against: accounts) {
+            logger.log(problem.localizedDescription, level: .warning)
+        }
+    }
+
+    func setHeadersOnly(_ enabled: Bool) {
+        headersOnly = enabled
+        UserDefaults.standard.set(enabled, forKey: headersOnlyKey)
+    }
+
+    func setMaxMessagesPerFolder(_ count: Int) {
+        maxMessagesPerFolder = max(count, 0)
+        UserDefaults.standard.set(maxMessagesPerFolder, forKey: maxMessagesPerFolderKey)
+    }
+
+    func setMaxErrorPercent(_ percent: Int) {
+        maxErrorPercent = min(max(percent, 0), 100)
+        UserDefaults.standard.set(maxErrorPercent, forKey: maxErrorPercentKey)
+    }
+
+    func setMinimumFreeInodes(_ count: Int) {
+        minimumFreeInodes = max(count, 0)
+        UserDefaults.standard.set(minimumFreeInodes, forKey: minimumFreeInodesKey)
+    }
+
+    func setLocalFlagPolicy(_ policy: LocalFlagPolicy) {
+        localFlagPolicy = policy
+        UserDefaults.standard.set(policy.rawValue, forKey: localFlagPolicyKey)
+    }
+
+    func setMaxConcurrentMessagesPerFolder(_ count: Int) {
+        maxConcurrentMessagesPerFolder = max(count, 1)
+        UserDefaults.standard.set(maxConcurrentMessagesPerFolder, forKey: maxConcurrentMessagesPerFolderKey)
+    }
+
+    func setMessageDelay(milliseconds: Int) {
+        messageDelayMs = max(milliseconds, 0)
+        UserDefaults.standard.set(messageDelayMs, forKey: messageDelayMsKey)
+    }
+
+    func setDefaultFolders(_ names: [String]) {
+        defaultFolders = names
+        UserDefaults.standard.set(names, forKey: defaultFoldersKey)
+    }
+
+    func setFetchOrder(_ order: FetchOrder) {
+        fetchOrder = order
+        UserDefaults.standard.set(order.rawValue, forKey: fetchOrderKey)
+    }
+
+    func setIncrementalStrategy(_ strategy: IncrementalStrategy) {
+        incrementalStrategy = strategy
+        UserDefaults.standard.set(strategy.rawValue, forKey: incrementalStrategyKey)
+    }
+
+    func setUseStateIndex(_ enabled: Bool) {
+        useStateIndex = enabled
+        UserDefaults.standard.set(enabled, forKey: stateIndexKey)
+    }
+
+    func setBackupSince(_ since: BackupSince) {
+        backupSince = since
+        UserDefaults.standard.set(since.argument, forKey: backupSinceKey)
+    }
+
+    /// Enable or disable the per-folder JSONL backup report
+    func setWriteBackupReports(_ enabled: Bool) {
+        writeBackupReports = enabled
+        UserDefaults.standard.set(enabled, forKey: backupReportsKey)
+    }
+
+    /// Enable or disable writing _folder.json into each backed-up folder
+    func setWriteFolderSummaries(_ enabled: Bool) {
+        writeFolderSummaries = enabled
+        UserDefaults.standard.set(enabled, forKey: folderSummariesKey)
+    }
+
     func selectBackupLocation() {
         let panel = NSOpenPanel()
         panel.canChooseFiles = false
@@ -1141,6 +1742,46 @@ class BackupManager: ObservableObject {
         }
     }
 
+    // MARK: - Mirror Locations
+
+    func addMirrorLocation() {
+        let panel = NSOpenPanel()
+        panel.canChooseFiles = false
+        panel.canChooseDirectories = true
+        panel.canCreateDirectories = true
+        panel.allowsMultipleSelection = false
+        panel.message = "Choose a location that receives a copy of every backed-up email"
+
+        guard panel.runModal() == .OK, let url = panel.url else { return }
+        guard url.standardizedFileURL != backupLocation.standardizedFileURL, !mirrorLocations.contains(url) else { return }
+        setMirrorLocations(mirrorLocations + [url])
+    }
+
+    func removeMirrorLocation(_ url: URL) {
+        setMirrorLocations(mirrorLocations.filter { $0 != url })
+    }
+
+    private func setMirrorLocations(_ urls: [URL]) {
+        mirrorLocations = urls
+        UserDefaults.standard.set(urls.map { $0.path }, forKey: mirrorLocationsKey)
+    }
+
+    /// The primary location plus all mirrors, or nil when there are no mirrors
+    /// Sidecars, reports and checkpoints are only written to the primary location.
+    private func makeDestinations(primary: StorageService, account: EmailAccount) async -> MultiStorage? {
+        guard !mirrorLocations.isEmpty else { return nil }
+
+        var backends: [StorageBackend] = [primary]
+        for location in mirrorLocations {
+            let mirror = StorageService(baseURL: location)
+            await mirror.setFolderRemap(account.folderRemap, for: account.email)
+            await mirror.setFlatFolderSeparator(account.flatFolderSeparator, for: account.email)
+            await mirror.setLayout(storageLayout)
+            backends.append(mirror)
+        }
+        return MultiStorage(backends: backends, quorum: destinationQuorum > 0 ? destinationQuorum : nil)
+    }
+
     // MARK: - Statistics
 
     struct AccountStats {
@@ -1149,6 +1790,29 @@ class BackupManager: ObservableObject {
         var folderCount: Int = 0
         var oldestEmail: Date?
         var newestEmail: Date?
+        /// Saved attachments per content type, from the .attachments.json sidecars
+        var attachmentTypes: [String: AttachmentTypeTotals] = [:]
+
+        /// Content types with the most bytes first
+        var attachmentTypesBySize: [(contentType: String, totals: AttachmentTypeTotals)] {
+            attachmentTypes
+                .sorted { ($0.value.size, $1.key) > ($1.value.size, $0.key) }
+                .map { (contentType: $0.key, totals: $0.value) }
+        }
+
+        /// Tally the attachments recorded for one email; skipped ones take no space and are left out
+        mutating func addAttachments(_ metadata: [AttachmentMetadata]) {
+            for attachment in metadata where attachment.skipReason == nil {
+                let contentType = attachment.contentType?.lowercased() ?? "unknown"
+                attachmentTypes[contentType, default: AttachmentTypeTotals()].count += 1
+                attachmentTypes[contentType, default: AttachmentTypeTotals()].size += Int64(attachment.size)
+            }
+        }
+    }
+
+    struct AttachmentTypeTotals: Equatable {
+        var count = 0
+        var size: Int64 = 0
     }
 
     struct GlobalStats {
@@ -1168,11 +1832,17 @@ class BackupManager: ObservableObject {
 
         // Run file enumeration on background thread
         let accountDir = backupLocation.appendingPathComponent(account.email.sanitizedForFilename())
-        let stats = await Task.detached(priority: .utility) {
+        let enumeration = Task.detached(priority: .utility) {
             return BackupManager.calculateStatsAtDirectory(accountDir)
-        }.value
+        }
+        let stats = await withTaskCancellationHandler {
+            await enumeration.value
+        } onCancel: {
+            enumeration.cancel()
+        }
 
-        // Cache the result
+        // Partial counts from a cancelled scan are not worth keeping
+        guard !Task.isCancelled else { return stats }
         statsCache[account.id] = StatsCacheEntry(stats: stats, timestamp: Date())
         return stats
     }
@@ -1234,7 +1904,8 @@ class BackupManager: ObservableObject {
     }
 
     /// Calculate stats at a directory (nonisolated static to allow calling from detached tasks)
-    private nonisolated static func calculateStatsAtDirectory(_ directory: URL) -> AccountStats {
+    /// Stops early with the counts so far once the calling task is cancelled
+    nonisolated static func calculateStatsAtDirectory(_ directory: URL) -> AccountStats {
         var stats = AccountStats()
         let fileManager = FileManager.default
 
@@ -1249,17 +1920,26 @@ class BackupManager: ObservableObject {
         var folders = Set<String>()
 
         for case let fileURL as URL in enumerator {
+            guard !Task.isCancelled else { break }
             guard let resourceValues = try? fileURL.resourceValues(forKeys: [.fileSizeKey, .creationDateKey, .isRegularFileKey]),
-                  resourceValues.isRegularFile == true,
-                  fileURL.pathExtension == "eml" else {
+                  resourceValues.isRegularFile == true else {
+                continue
+            }
+
+            if fileURL.lastPathComponent.hasSuffix(".attachments.json") {
+                if let data = try? Data(contentsOf: fileURL),
+                   let metadata = try? JSONDecoder().decode([AttachmentMetadata].self, from: data) {
+                    stats.addAttachments(metadata)
+                }
                 continue
             }
+            guard fileURL.pathExtension == "eml" else { continue }
 
             stats.totalEmails += 1
             stats.totalSize += Int64(resourceValues.fileSize ?? 0)
 
-            // Track folder
-            let folderPath = fileURL.deletingLastPathComponent().path
+            // Track folder, date partitions count as their folder
+            let folderPath = StorageService.folderURL(containing: fileURL).path
             folders.insert(folderPath)
 
             // Track dates from filename (format: YYYYMMDD_HHMMSS_sender.eml)
@@ -0,0 +1,97 @@
+import Foundation
+
+/// What this copy of MailKeep is and where it runs, for bug reports and diagnostics.
+/// Version, build and commit come from the app's Info.plist; the commit is stamped in at build time
+/// with `xcodebuild MAILKEEP_GIT_COMMIT=$(git rev-parse --short HEAD)`.
+struct BuildInfo: Equatable {
+    let version: String
+    let build: String
+    /// Short git commit, "unknown" when the build was not stamped
+    let commit: String
+    let swiftVersion: String
+    let operatingSystem: String
+    let architecture: String
+    /// Platform integration -> how it is provided, e.g. "keychain" -> "Security.framework"
+    let integrations: [String: String]
+
+    static let infoPlistCommitKey = "MailKeepGitCommit"
+
+    init(
+        infoDictionary: [String: Any],
+        operatingSystem: String = BuildInfo.currentOperatingSystem,
+        integrations: [String: String] = BuildInfo.availableIntegrations
+    ) {
+        func value(_ key: String) -> String {
+            // An unset build setting leaves an empty string behind
+            guard let value = infoDictionary[key] as? String, !value.isEmpty, !value.hasPrefix("$(") else {
+                return "unknown"
+            }
+            return value
+        }
+
+        self.version = value("CFBundleShortVersionString")
+        self.build = value("CFBundleVersion")
+        self.commit = value(Self.infoPlistCommitKey)
+        self.swiftVersion = Self.compiledSwiftVersion
+        self.operatingSystem = operatingSystem
+        self.architecture = Self.compiledArchitecture
+        self.integrations = integrations
+    }
+
+    static var current: BuildInfo {
+        BuildInfo(infoDictionary: Bundle.main.infoDictionary ?? [:])
+    }
+
+    /// One "name: value" line per field, ready to paste into an issue
+    var report: String {
+        var lines = [
+            "MailKeep \(version) (\(build))",
+            "commit: \(commit)",
+            "swift: \(swiftVersion)",
+            "os: \(operatingSystem)",
+            "arch: \(architecture)"
+        ]
+        for name in integrations.keys.sorted() {
+            lines.append("\(name): \(integrations[name] ?? "")")
+        }
+        return lines.joined(separator: "\n")
+    }
+
+    // MARK: - Environment
+
+    static var currentOperatingSystem: String {
+        let version = ProcessInfo.processInfo.operatingSystemVersion
+        return "macOS \(version.majorVersion).\(version.minorVersion).\(version.patchVersion)"
+    }
+
+    static var compiledArchitecture: String {
+        #if arch(arm64)
+        return "arm64"
+        #elseif arch(x86_64)
+        return "x86_64"
+        #else
+        return "unknown"
+        #endif
+    }
+
+    static var compiledSwiftVersion: String {
+        #if compiler(>=6.0)
+        return "6.0 or later"
+        #elseif compiler(>=5.10)
+        return "5.10"
+        #elseif compiler(>=5.9)
+        return "5.9"
+        #else
+        return "older than 5.9"
+        #endif
+    }
+
+    /// Integrations MailKeep relies on and whether this system offers them
+    static var availableIntegrations: [String: String] {
+        [
+            "keychain": "Security.framework",
+            "notifier": NSClassFromString("UNUserNotificationCenter") != nil ? "UserNotifications" : "unavailable",
+            "launch-at-login": NSClassFromString("SMAppService") != nil ? "ServiceManagement" : "unavailable"
+        ]
+    }
+}
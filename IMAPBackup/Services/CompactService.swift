@@ -0,0 +1,252 @@
+import Foundation
+
+/// What a compact run does besides removing leftovers, which it always does
+struct CompactOptions {
+    /// Only report what would be removed. The default, so a compact is always previewed first.
+    var dryRun = true
+    /// Delete downloads kept in .quarantine for inspection
+    var removeQuarantined = true
+    /// Delete emails whose content is identical to an earlier email in the same folder
+    var removeDuplicates = false
+    /// Retention policy to apply; nil leaves old emails alone
+    var retention: RetentionSettings?
+}
+
+/// What a compact run removed, or would remove in a dry run
+struct CompactReport: Equatable {
+    struct Tally: Equatable {
+        /// Files and folders removed, an attachments folder counting once
+        var items = 0
+        var bytes: Int64 = 0
+
+        mutating func add(bytes: Int64) {
+            items += 1
+            self.bytes += bytes
+        }
+    }
+
+    let dryRun: Bool
+    /// Attachment metadata and folders whose email is gone, and temp files of interrupted writes
+    var orphans = Tally()
+    var quarantined = Tally()
+    /// Duplicate emails together with their sidecars and attachments
+    var duplicates = Tally()
+    var retention = Tally()
+    /// Directories whose content-hash index was rebuilt
+    var reindexedDirectories = 0
+    var errors: [String] = []
+
+    var bytesReclaimed: Int64 {
+        orphans.bytes + quarantined.bytes + duplicates.bytes + retention.bytes
+    }
+
+    var summary: String {
+        let size = ByteCountFormatter.string(fromByteCount: bytesReclaimed, countStyle: .file)
+        var parts = [dryRun ? "Would reclaim \(size)" : "Reclaimed \(size)"]
+        if orphans.items > 0 {
+            parts.append("\(orphans.items) orphaned")
+        }
+        if quarantined.items > 0 {
+            parts.append("\(quarantined.items) quarantined")
+        }
+        if duplicates.items > 0 {
+            parts.append("\(duplicates.items) duplicate")
+        }
+        if retention.items > 0 {
+            parts.append("\(retention.items) past retention")
+        }
+        if !errors.isEmpty {
+            parts.append("\(errors.count) errors")
+        }
+        return parts.joined(separator: ", ")
+    }
+}
+
+/// Cleans up a backup in one pass: applies retention, removes duplicate emails, orphaned attachment
+/// metadata and quarantined downloads, then rebuilds the content-hash indexes.
+/// Nothing outside the backup location is ever removed, symlinks included. UID caches are left alone,
+/// so emails removed here are not downloaded again.
+enum CompactService {
+
+    static func compact(
+        backupLocation: URL,
+        options: CompactOptions = CompactOptions(),
+        storageService: StorageService? = nil
+    ) async throws -> CompactReport {
+        let fileManager = FileManager.default
+        let root = backupLocation.standardizedFileURL.resolvingSymlinksInPath()
+        let storage = storageService ?? StorageService(baseURL: root)
+        var report = CompactReport(dryRun: options.dryRun)
+
+        let accountURLs = (try? fileManager.contentsOfDirectory(
+            at: root,
+            includingPropertiesForKeys: [.isDirectoryKey],
+            options: [.skipsHiddenFiles]
+        ))?.filter(isDirectory).sorted { $0.path < $1.path } ?? []
+
+        for accountURL in accountURLs {
+            try Task.checkCancellation()
+
+            if let retention = options.retention {
+                let result = await RetentionService.shared.applyRetention(
+                    to: accountURL,
+                    settings: retention,
+                    mode: options.dryRun ? .dryRun : .confirmed
+                )
+                report.retention.items += result.filesDeleted
+                report.retention.bytes += result.bytesFreed
+            }
+
+            var scan = scanAccount(accountURL)
+
+            if options.removeDuplicates {
+                for (directoryURL, emailURLs) in scan.emailsByDirectory.sorted(by: { $0.key.path < $1.key.path }) {
+                    try Task.checkCancellation()
+                    for duplicateURL in duplicates(among: emailURLs) {
+                        for url in [duplicateURL] + companions(of: duplicateURL) where fileManager.fileExists(atPath: url.path) {
+                            do {
+                                report.duplicates.add(bytes: try remove(url, within: root, dryRun: options.dryRun))
+                            } catch {
+                                report.errors.append("\(url.lastPathComponent): \(error.localizedDescription)")
+                            }
+                        }
+                        scan.emailsByDirectory[directoryURL]?.removeAll { $0 == duplicateURL }
+                    }
+                }
+            }
+
+            for url in scan.orphans {
+                do {
+                    report.orphans.add(bytes: try remove(url, within: root, dryRun: options.dryRun))
+                } catch {
+                    report.errors.append("\(url.lastPathComponent): \(error.localizedDescription)")
+                }
+            }
+
+            let quarantineURL = accountURL.appendingPathComponent(StorageService.quarantineDirectory)
+            if options.removeQuarantined, fileManager.fileExists(atPath: quarantineURL.path) {
+                let quarantined = fileManager.enumerator(at: quarantineURL, includingPropertiesForKeys: [.isRegularFileKey])?
+                    .compactMap { $0 as? URL }
+                    .filter { (try? $0.resourceValues(forKeys: [.isRegularFileKey]).isRegularFile) == true } ?? []
+                var removedAll = true
+                for url in quarantined {
+                    do {
+                        report.quarantined.add(bytes: try remove(url, within: root, dryRun: options.dryRun))
+                    } catch {
+                        removedAll = false
+                        report.errors.append("\(url.lastPathComponent): \(error.localizedDescription)")
+                    }
+                }
+                if !options.dryRun && removedAll {
+                    // Only empty folders are left
+                    try? fileManager.removeItem(at: quarantineURL)
+                }
+            }
+
+            if !options.dryRun {
+                for directoryURL in scan.emailsByDirectory.keys.sorted(by: { $0.path < $1.path }) {
+                    do {
+                        try await storage.rebuildHashIndex(inDirectory: directoryURL)
+                        report.reindexedDirectories += 1
+                    } catch {
+                        report.errors.append("Index of \(directoryURL.lastPathComponent): \(error.localizedDescription)")
+                    }
+                }
+            }
+        }
+
+        logInfo("Compact of \(root.path): \(report.summary)")
+        return report
+    }
+
+    // MARK: - Scanning
+
+    private struct Scan {
+        var emailsByDirectory: [URL: [URL]] = [:]
+        var orphans: [URL] = []
+    }
+
+    /// Emails by the directory holding them, and leftovers whose email no longer exists.
+    /// Envelope sidecars without an email are headers-only backups, not orphans.
+    private static func scanAccount(_ accountURL: URL) -> Scan {
+        let fileManager = FileManager.default
+        var scan = Scan()
+        guard let enumerator = fileManager.enumerator(
+            at: accountURL,
+            includingPropertiesForKeys: [.isDirectoryKey],
+            options: [.skipsHiddenFiles]
+        ) else {
+            return scan
+        }
+
+        for case let url as URL in enumerator {
+            let name = url.lastPathComponent
+            if isDirectory(url) {
+                guard name.hasSuffix("_attachments") else { continue }
+                let stem = String(name.dropLast("_attachments".count))
+                // Only folders named after an email; a mail folder that happens to end in _attachments is kept
+                guard isEmailStem(stem) else { continue }
+                enumerator.skipDescendants()
+                let emailURL = url.deletingLastPathComponent().appendingPathComponent(stem).appendingPathExtension("eml")
+                if !fileManager.fileExists(atPath: emailURL.path) {
+                    scan.orphans.append(url)
+                }
+            } else if url.pathExtension == "eml" {
+                scan.emailsByDirectory[url.deletingLastPathComponent(), default: []].append(url)
+            } else if name.hasSuffix(".attachments.json") {
+                let emailURL = url.deletingPathExtension().deletingPathExtension().appendingPathExtension("eml")
+                if !fileManager.fileExists(atPath: emailURL.path) {
+                    scan.orphans.append(url)
+                }
+            } else if url.pathExtension == "tmp" {
+                scan.orphans.append(url)
+            }
+        }
+        return scan
+    }
+
+    /// Emails identical to one earlier in UID order; the first copy is the one kept
+    static func duplicates(among emailURLs: [URL]) -> [URL] {
+        let sorted = emailURLs.sorted { $0.lastPathComponent.localizedStandardCompare($1.lastPathComponent) == .orderedAscending }
+        let bySize = Dictionary(grouping: sorted) { (try? $0.resourceValues(forKeys: [.fileSizeKey]).fileSize) ?? -1 }
+
+        var duplicates: [URL] = []
+        for (size, candidates) in bySize where size >= 0 && candidates.count > 1 {
+            var seen = Set<String>()
+            for url in candidates {
+                guard let data = try? Data(contentsOf: url, options: .mappedIfSafe) else { continue }
+                if !seen.insert(AttachmentMetadata.checksum(of: data)).inserted {
+                    duplicates.append(url)
+                }
+            }
+        }
+        return duplicates.sorted { $0.path < $1.path }
+    }
+
+    /// Sidecars and attachments folder stored next to an email
+    private static func companions(of emailURL: URL) -> [URL] {
+        [
+            emailURL.deletingPathExtension().appendingPathExtension("envelope.json"),
+            AttachmentMetadata.sidecarURL(for: emailURL),
+            AttachmentMetadata.folderURL(for: emailURL),
+        ]
+    }
+
+    // MARK: - Removal
+
+    /// Remove a file or folder strictly inside `root`, returning its size; a dry run only measures it.
+    /// Symlinks leading out of the backup are refused rather than removed.
+    private static func remove(_ url: URL, within root: URL, dryRun: Bool) throws -> Int64 {
+        try DeletionGuard.remove(url, within: root, mode: dryRun ? .dryRun : .confirmed)
+    }
+
+    private static func isDirectory(_ url: URL) -> Bool {
+        (try? url.resourceValues(forKeys: [.isDirectoryKey]).isDirectory) == true
+    }
+
+    /// "<uid>_..." as email files are named
+    private static func isEmailStem(_ stem: String) -> Bool {
+        guard let underscore = stem.firstIndex(of: "_") else { return false }
+        return UInt32(stem[..<underscore]) != nil
+    }
+}
@@ -1,7 +1,26 @@
 import Foundation
 import SQLite3
 
-/// Service for tracking backed up emails using SQLite
+/// One row of the emails table
+struct IndexedEmail: Sendable {
+    let accountId: String
+    let messageId: String
+    let uid: UInt32
+    let mailbox: String
+    var sender: String?
+    var subject: String?
+    var date: Date?
+    let filePath: String
+    var hasAttachments = false
+    var attachmentCount = 0
+}
+
+/// Service for tracking backed up emails using SQLite.
+///
+/// SQLite allows one writer at a time. Within the app every write goes through the actor, so
+/// folders and accounts backed up in parallel should share `shared(backupLocation:)` and have
+/// their writes queued rather than competing for the file lock. Other connections to the same
+/// file, such as another process, are waited for through WAL and the busy timeout.
 actor DatabaseService {
     private var db: OpaquePointer?
     private let dbPath: String
@@ -10,23 +29,51 @@ actor DatabaseService {
         self.dbPath = backupLocation.appendingPathComponent(".imap_backup.db").path
     }
 
-    // MARK: - Database Setup
-
-    func open() throws {
-        if sqlite3_open(dbPath, &db) != SQLITE_OK {
-            throw DatabaseError.failedToOpen(String(cString: sqlite3_errmsg(db)))
-        }
+    /// Services by database path; guarded by `registryLock`
+    private static var registry: [String: DatabaseService] = [:]
+    private static let registryLock = NSLock()
 
-        // Enable WAL mode for better concurrent access
-        try execute("PRAGMA journal_mode=WAL")
+    /// The one service for the database in `backupLocation`, created on first use
+    static func shared(backupLocation: URL) -> DatabaseService {
+        let path = backupLocation.appendingPathComponent(".imap_backup.db").standardizedFileURL.path
+        registryLock.lock()
+        defer { registryLock.unlock() }
 
-        // Set busy timeout to 30 seconds - wait if database is locked instead of failing
-        try execute("PRAGMA busy_timeout=30000")
+        if let service = registry[path] {
+            return service
+        }
+        let service = DatabaseService(backupLocation: backupLocation)
+        registry[path] = service
+        return service
+    }
 
-        // NORMAL synchronous is safe with WAL and faster
-        try execute("PRAGMA synchronous=NORMAL")
+    // MARK: - Database Setup
 
-        try createTables()
+    /// Open the database; opening an open service does nothing, so every user of a shared one may call it.
+    /// A failed open leaves the service closed, so a later call tries again.
+    func open() throws {
+        guard db == nil else { return }
+        do {
+            if sqlite3_open(dbPath, &db) != SQLITE_OK {
+                throw DatabaseError.failedToOpen(String(cString: sqlite3_errmsg(db)))
+            }
+
+            // Set busy timeout to 30 seconds - wait if database is locked instead of failing.
+            // First, since switching to WAL needs the lock another connection may hold.
+            try execute("PRAGMA busy_timeout=30000")
+
+            // Enable WAL mode for better concurrent access
+            try execute("PRAGMA journal_mode=WAL")
+
+            // NORMAL synchronous is safe with WAL and faster
+            try execute("PRAGMA synchronous=NORMAL")
+
+            try createTables()
+        } catch {
+            // sqlite3_open returns a handle even when it fails
+            close()
+            throw error
+        }
     }
 
     func close() {
@@ -154,6 +201,39 @@ actor DatabaseService {
         hasAttachments: Bool = false,
         attachmentCount: Int = 0
     ) throws {
+        try insert(IndexedEmail(
+            accountId: accountId,
+            messageId: messageId,
+            uid: uid,
+            mailbox: mailbox,
+            sender: sender,
+            subject: subject,
+            date: date,
+            filePath: filePath,
+            hasAttachments: hasAttachments,
+            attachmentCount: attachmentCount
+        ))
+    }
+
+    /// Record many backed up emails in one transaction: all or none of them land, and the
+    /// write lock is taken once instead of once per email. The lock is taken up front so a
+    /// busy database is waited for rather than failing halfway.
+    func recordEmails(_ emails: [IndexedEmail]) throws {
+        guard !emails.isEmpty else { return }
+
+        try execute("BEGIN IMMEDIATE")
+        do {
+            for email in emails {
+                try insert(email)
+            }
+            try execute("COMMIT")
+        } catch {
+            try? execute("ROLLBACK")
+            throw error
+        }
+    }
+
+    private func insert(_ email: IndexedEmail) throws {
         let query = """
             INSERT OR REPLACE INTO emails
             (account_id, message_id, uid, mailbox, sender, subject, date, file_path,
@@ -168,33 +248,33 @@ actor DatabaseService {
             throw DatabaseError.queryFailed(String(cString: sqlite3_errmsg(db)))
         }
 
-        sqlite3_bind_text(statement, 1, accountId, -1, SQLITE_TRANSIENT)
-        sqlite3_bind_text(statement, 2, messageId, -1, SQLITE_TRANSIENT)
-        sqlite3_bind_int(statement, 3, Int32(uid))
-        sqlite3_bind_text(statement, 4, mailbox, -1, SQLITE_TRANSIENT)
+        sqlite3_bind_text(statement, 1, email.accountId, -1, SQLITE_TRANSIENT)
+        sqlite3_bind_text(statement, 2, email.messageId, -1, SQLITE_TRANSIENT)
+        sqlite3_bind_int(statement, 3, Int32(email.uid))
+        sqlite3_bind_text(statement, 4, email.mailbox, -1, SQLITE_TRANSIENT)
 
-        if let sender = sender {
+        if let sender = email.sender {
             sqlite3_bind_text(statement, 5, sender, -1, SQLITE_TRANSIENT)
         } else {
             sqlite3_bind_null(statement, 5)
         }
 
-        if let subject = subject {
+        if let subject = email.subject {
             sqlite3_bind_text(statement, 6, subject, -1, SQLITE_TRANSIENT)
         } else {
             sqlite3_bind_null(statement, 6)
         }
 
-        if let date = date {
+        if let date = email.date {
             sqlite3_bind_double(statement, 7, date.timeIntervalSince1970)
         } else {
             sqlite3_bind_null(statement, 7)
         }
 
-        sqlite3_bind_text(statement, 8, filePath, -1, SQLITE_TRANSIENT)
+        sqlite3_bind_text(statement, 8, email.filePath, -1, SQLITE_TRANSIENT)
         sqlite3_bind_double(statement, 9, Date().timeIntervalSince1970)
-        sqlite3_bind_int(statement, 10, hasAttachments ? 1 : 0)
-        sqlite3_bind_int(statement, 11, Int32(attachmentCount))
+        sqlite3_bind_int(statement, 10, email.hasAttachments ? 1 : 0)
+        sqlite3_bind_int(statement, 11, Int32(email.attachmentCount))
 
         if sqlite3_step(statement) != SQLITE_DONE {
             throw DatabaseError.insertFailed(String(cString: sqlite3_errmsg(db)))
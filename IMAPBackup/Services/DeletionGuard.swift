@@ -0,0 +1,134 @@
+import Foundation
+
+/// Whether a destructive operation deletes or only reports what it would delete. Retention,
+/// compact and purging an account's backups all preview by default; deleting takes an explicit
+/// confirmation, from a dialog that showed the preview or from a launch flag for unattended runs.
+enum DeletionMode: Equatable {
+    case dryRun
+    case confirmed
+
+    /// Launch flags confirming deletions without asking
+    static let confirmationFlags: Set<String> = ["--yes", "--force"]
+
+    /// Confirmed when launched with --yes or --force, a dry run otherwise
+    static func fromLaunchArguments(_ arguments: [String] = ProcessInfo.processInfo.arguments) -> DeletionMode {
+        arguments.contains(where: confirmationFlags.contains) ? .confirmed : .dryRun
+    }
+}
+
+/// The confirmation given by launching with --yes or --force. It covers one destructive
+/// operation, the first to take it; every later one in the same session is a dry run again.
+final class LaunchConfirmation {
+    static let shared = LaunchConfirmation()
+
+    private let lock = NSLock()
+    private var isAvailable: Bool
+
+    init(arguments: [String] = ProcessInfo.processInfo.arguments) {
+        isAvailable = DeletionMode.fromLaunchArguments(arguments) == .confirmed
+    }
+
+    /// Confirmed the first time when launched with a confirmation flag, a dry run after that
+    func take() -> DeletionMode {
+        lock.lock()
+        defer { lock.unlock() }
+
+        guard isAvailable else { return .dryRun }
+        isAvailable = false
+        return .confirmed
+    }
+}
+
+/// What a destructive operation removes, or would remove in a dry run, counted by kind
+struct DeletionPlan: Equatable {
+    let operation: String
+    let mode: DeletionMode
+    private(set) var counts: [String: Int] = [:]
+    private(set) var bytes: Int64 = 0
+
+    init(operation: String, mode: DeletionMode) {
+        self.operation = operation
+        self.mode = mode
+    }
+
+    var isEmpty: Bool {
+        counts.values.allSatisfy { $0 == 0 }
+    }
+
+    mutating func add(_ kind: String, count: Int = 1, bytes: Int64 = 0) {
+        counts[kind, default: 0] += count
+        self.bytes += bytes
+    }
+
+    /// E.g. "Retention would delete 3 email(s) (12 KB)"
+    var summary: String {
+        guard !isEmpty else { return "\(operation): nothing to delete" }
+
+        let items = counts.keys.sorted()
+            .filter { counts[$0, default: 0] > 0 }
+            .map { "\(counts[$0, default: 0]) \($0)(s)" }
+            .joined(separator: ", ")
+        var text = "\(operation) \(mode == .dryRun ? "would delete" : "deleted") \(items)"
+        if bytes > 0 {
+            text += " (\(ByteCountFormatter.string(fromByteCount: bytes, countStyle: .file)))"
+        }
+        return text
+    }
+}
+
+enum DeletionError: LocalizedError {
+    case outsideBackupLocation(String)
+
+    var errorDescription: String? {
+        switch self {
+        case .outsideBackupLocation(let path):
+            return "Refusing to delete \(path): it is not inside the backup location"
+        }
+    }
+}
+
+/// The one place backup files are deleted. A target has to lie strictly inside the backup
+/// location after resolving symlinks, so no setting or symlink can point a deletion elsewhere,
+/// and in a dry run it is only measured.
+enum DeletionGuard {
+
+    /// `url` with symlinks resolved, refused unless strictly inside `root`; `root` itself is refused too
+    static func securePath(_ url: URL, within root: URL) throws -> URL {
+        let base = root.standardizedFileURL.resolvingSymlinksInPath()
+        let resolved = url.standardizedFileURL.resolvingSymlinksInPath()
+        guard resolved.path.hasPrefix(base.path + "/") else {
+            throw DeletionError.outsideBackupLocation(resolved.path)
+        }
+        return resolved
+    }
+
+    /// Remove a file or folder inside `root` when confirmed, returning its size either way
+    @discardableResult
+    static func remove(_ url: URL, within root: URL, mode: DeletionMode, fileManager: FileManager = .default) throws -> Int64 {
+        let resolved = try securePath(url, within: root)
+
+        let size = allocatedSize(of: resolved)
+        if mode == .confirmed {
+            try fileManager.removeItem(at: url)
+        }
+        return size
+    }
+
+    /// Size of a file, or of everything in a folder
+    static func allocatedSize(of url: URL) -> Int64 {
+        guard (try? url.resourceValues(forKeys: [.isDirectoryKey]).isDirectory) == true else {
+            return Int64((try? url.resourceValues(forKeys: [.fileSizeKey]).fileSize) ?? 0)
+        }
+        return FileManager.default.enumerator(at: url, includingPropertiesForKeys: [.fileSizeKey])?
+            .compactMap { ($0 as? URL).flatMap { try? $0.resourceValues(forKeys: [.fileSizeKey]).fileSize } }
+            .reduce(Int64(0)) { $0 + Int64($1) } ?? 0
+    }
+
+    /// Number of files in a folder, for a plan's counts
+    static func fileCount(in url: URL) -> Int {
+        FileManager.default.enumerator(at: url, includingPropertiesForKeys: [.isRegularFileKey])?
+            .compactMap { $0 as? URL }
+            .filter { (try? $0.resourceValues(forKeys: [.isRegularFileKey]).isRegularFile) == true }
+            .count ?? 0
+    }
+}
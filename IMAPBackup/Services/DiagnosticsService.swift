@@ -0,0 +1,312 @@
+import Foundation
+import UserNotifications
+
+// MARK: - Diagnostic Check
+
+enum DiagnosticStatus: String {
+    case pass = "Pass"
+    case warning = "Warning"
+    case fail = "Fail"
+}
+
+/// Result of a single environment check, with a hint on how to fix failures
+struct DiagnosticCheck: Identifiable {
+    let id = UUID()
+    let name: String
+    let status: DiagnosticStatus
+    let detail: String
+    var remediation: String? = nil
+}
+
+// MARK: - Diagnostics Service
+
+/// Diagnoses the environment: OS, keychain, notifications, backup location and accounts
+@MainActor
+class DiagnosticsService: ObservableObject {
+    static let shared = DiagnosticsService()
+
+    @Published private(set) var results: [DiagnosticCheck] = []
+    @Published private(set) var isRunning = false
+
+    /// Free space below this is reported as a warning (1 GB)
+    nonisolated static let minimumFreeSpace: Int64 = 1024 * 1024 * 1024
+
+    private init() {}
+
+    /// Run all checks and publish the checklist
+    func runAll(
+        accounts: [EmailAccount],
+        backupLocation: URL,
+        mirrorLocations: [URL] = [],
+        minimumFreeInodes: Int = InodeCheck.defaultMinimum
+    ) async {
+        guard !isRunning else { return }
+        isRunning = true
+        defer { isRunning = false }
+
+        var checks: [DiagnosticCheck] = [
+            Self.checkBuild(),
+            Self.checkOperatingSystem(),
+            await Self.checkNotifications(),
+            Self.checkBackupLocation(backupLocation),
+            Self.checkFreeInodes(backupLocation, minimumFreeInodes: minimumFreeInodes)
+        ]
+        // Every email is written to each mirror as well
+        checks += mirrorLocations.map { Self.checkFreeInodes($0, minimumFreeInodes: minimumFreeInodes, isMirror: true) }
+
+        if accounts.isEmpty {
+            checks.append(DiagnosticCheck(
+                name: "Accounts",
+                status: .warning,
+                detail: "No accounts configured",
+                remediation: "Add an account in the Accounts tab."
+            ))
+        }
+
+        for account in accounts {
+            let configuration = Self.checkAccountConfiguration(account)
+            checks.append(configuration)
+            checks.append(await Self.checkCredentials(for: account))
+
+            // Connectivity is meaningless with an invalid configuration
+            if configuration.status != .fail && account.isEnabled {
+                checks.append(await Self.checkConnectivity(
+                    account: account,
+                    imapService: IMAPService(account: account)
+                ))
+            }
+        }
+
+        results = checks
+        logInfo("Diagnostics completed: \(checks.filter { $0.status == .fail }.count) failed, \(checks.filter { $0.status == .warning }.count) warnings")
+    }
+
+    func clearResults() {
+        results = []
+    }
+
+    // MARK: - Checks
+
+    nonisolated static func checkBuild(_ info: BuildInfo = .current) -> DiagnosticCheck {
+        guard info.commit != "unknown" else {
+            return DiagnosticCheck(
+                name: "Build",
+                status: .warning,
+                detail: "MailKeep \(info.version) (\(info.build)), \(info.architecture), commit unknown",
+                remediation: "Build with MAILKEEP_GIT_COMMIT=$(git rev-parse --short HEAD) so bug reports name the exact source."
+            )
+        }
+        return DiagnosticCheck(name: "Build", status: .pass, detail: "MailKeep \(info.version) (\(info.build)), \(info.architecture), commit \(info.commit)")
+    }
+
+    nonisolated static func checkOperatingSystem() -> DiagnosticCheck {
+        let version = ProcessInfo.processInfo.operatingSystemVersion
+        let versionString = "\(version.majorVersion).\(version.minorVersion).\(version.patchVersion)"
+
+        // Deployment target is macOS 14
+        guard version.majorVersion >= 14 else {
+            return DiagnosticCheck(
+                name: "Operating System",
+                status: .fail,
+                detail: "macOS \(versionString)",
+                remediation: "MailKeep requires macOS 14 or later."
+            )
+        }
+        return DiagnosticCheck(name: "Operating System", status: .pass, detail: "macOS \(versionString), Keychain backend active")
+    }
+
+    nonisolated static func checkNotifications() async -> DiagnosticCheck {
+        let settings = await UNUserNotificationCenter.current().notificationSettings()
+
+        switch settings.authorizationStatus {
+        case .authorized, .provisional:
+            return DiagnosticCheck(name: "Notifications", status: .pass, detail: "Notification Center available")
+        case .denied:
+            return DiagnosticCheck(
+                name: "Notifications",
+                status: .warning,
+                detail: "Notifications are disabled",
+                remediation: "Allow notifications for MailKeep in System Settings > Notifications."
+            )
+        default:
+            return DiagnosticCheck(
+                name: "Notifications",
+                status: .warning,
+                detail: "Notification permission not yet granted",
+                remediation: "Restart MailKeep and allow notifications when prompted."
+            )
+        }
+    }
+
+    /// Backup location must exist, be writable and have free space
+    nonisolated static func checkBackupLocation(_ url: URL, minimumFreeSpace: Int64 = minimumFreeSpace) -> DiagnosticCheck {
+        let name = "Backup Location"
+        let fileManager = FileManager.default
+        var isDirectory: ObjCBool = false
+
+        guard fileManager.fileExists(atPath: url.path, isDirectory: &isDirectory), isDirectory.boolValue else {
+            return DiagnosticCheck(
+                name: name,
+                status: .fail,
+                detail: "\(url.path) does not exist",
+                remediation: "Choose an existing folder in the General tab, or reconnect the external drive."
+            )
+        }
+
+        // Probe with a real write; isWritableFile ignores sandbox and ACL restrictions
+        let probeURL = url.appendingPathComponent(".mailkeep_write_test_\(UUID().uuidString)")
+        do {
+            try Data().write(to: probeURL)
+            try? fileManager.removeItem(at: probeURL)
+        } catch {
+            return DiagnosticCheck(
+                name: name,
+                status: .fail,
+                detail: "\(url.path) is not writable",
+                remediation: "Check folder permissions or choose a different backup location."
+            )
+        }
+
+        let values = try? url.resourceValues(forKeys: [.volumeAvailableCapacityForImportantUsageKey])
+        if let available = values?.volumeAvailableCapacityForImportantUsage {
+            let formatted = ByteCountFormatter.string(fromByteCount: available, countStyle: .file)
+            if available < minimumFreeSpace {
+                return DiagnosticCheck(
+                    name: name,
+                    status: .warning,
+                    detail: "Only \(formatted) free",
+                    remediation: "Free up disk space or move backups to a larger volume."
+                )
+            }
+            return DiagnosticCheck(name: name, status: .pass, detail: "Writable, \(formatted) free")
+        }
+
+        return DiagnosticCheck(name: name, status: .pass, detail: "Writable")
+    }
+
+    /// Each email takes its own files, so a volume can run out of inodes before it runs out of space
+    nonisolated static func checkFreeInodes(
+        _ url: URL,
+        minimumFreeInodes: Int,
+        isMirror: Bool = false,
+        usage: InodeUsage? = nil
+    ) -> DiagnosticCheck {
+        let name = isMirror ? "Mirror \(url.lastPathComponent): Free Inodes" : "Free Inodes"
+        guard let usage = usage ?? InodeUsage.of(url) else {
+            return DiagnosticCheck(name: name, status: .pass, detail: "The volume has no fixed number of inodes")
+        }
+
+        let detail = "\(usage.free) of \(usage.total) free"
+        switch InodeCheck.level(of: usage, minimum: minimumFreeInodes) {
+        case .ok:
+            return DiagnosticCheck(name: name, status: .pass, detail: detail)
+        case .low:
+            return DiagnosticCheck(name: name, status: .warning, detail: detail, remediation: InodeCheck.remedy)
+        case .exhausted:
+            return DiagnosticCheck(
+                name: name,
+                status: .fail,
+                detail: "\(detail), below the minimum of \(minimumFreeInodes); backups stop",
+                remediation: InodeCheck.remedy
+            )
+        }
+    }
+
+    nonisolated static func checkAccountConfiguration(_ account: EmailAccount) -> DiagnosticCheck {
+        let name = "\(account.email): Configuration"
+        var problems: [String] = []
+
+        if account.email.trimmingCharacters(in: .whitespaces).isEmpty {
+            problems.append("email is empty")
+        }
+        if account.imapServer.trimmingCharacters(in: .whitespaces).isEmpty {
+            problems.append("IMAP server is empty")
+        }
+        if !(1...65535).contains(account.port) {
+            problems.append("port \(account.port) is out of range")
+        }
+        if account.username.trimmingCharacters(in: .whitespaces).isEmpty {
+            problems.append("username is empty")
+        }
+
+        guard problems.isEmpty else {
+            return DiagnosticCheck(
+                name: name,
+                status: .fail,
+                detail: problems.joined(separator: ", "),
+                remediation: "Edit the account in the Accounts tab."
+            )
+        }
+
+        if !account.useSSL {
+            return DiagnosticCheck(
+                name: name,
+                status: .warning,
+                detail: "\(account.imapServer):\(account.port) without SSL/TLS",
+                remediation: "Enable SSL/TLS unless the server does not support it."
+            )
+        }
+        return DiagnosticCheck(name: name, status: .pass, detail: "\(account.imapServer):\(account.port)")
+    }
+
+    static func checkCredentials(for account: EmailAccount) async -> DiagnosticCheck {
+        let name = "\(account.email): Keychain"
+
+        switch account.authType {
+        case .password:
+            if let command = account.passwordCommand, !command.isEmpty {
+                return DiagnosticCheck(name: name, status: .pass, detail: "Password from a command, not run by this check")
+            }
+            if await account.hasPassword() {
+                return DiagnosticCheck(name: name, status: .pass, detail: "Password found")
+            }
+            return DiagnosticCheck(
+                name: name,
+                status: .fail,
+                detail: "No password stored",
+                remediation: "Edit the account and enter the password again."
+            )
+        case .oauth2:
+            if await account.getOAuthTokens() != nil {
+                return DiagnosticCheck(name: name, status: .pass, detail: "OAuth tokens found")
+            }
+            return DiagnosticCheck(
+                name: name,
+                status: .fail,
+                detail: "No OAuth tokens stored",
+                remediation: "Remove the account and sign in with Google again."
+            )
+        }
+    }
+
+    /// Connect, authenticate and log out
+    static func checkConnectivity(account: EmailAccount, imapService: IMAPServiceProtocol) async -> DiagnosticCheck {
+        let name = "\(account.email): Connection"
+
+        do {
+            try await imapService.connect()
+        } catch {
+            await imapService.disconnect()
+            return DiagnosticCheck(
+                name: name,
+                status: .fail,
+                detail: error.localizedDescription,
+                remediation: "Check the server name, port, SSL setting and your network connection."
+            )
+        }
+
+        do {
+            try await imapService.login(password: nil)
+            try? await imapService.logout()
+            return DiagnosticCheck(name: name, status: .pass, detail: "Connected and authenticated")
+        } catch {
+            await imapService.disconnect()
+            return DiagnosticCheck(
+                name: name,
+                status: .fail,
+                detail: error.localizedDescription,
+                remediation: "Check the username and password. Some providers require an app password."
+            )
+        }
+    }
+}
@@ -5,25 +5,19 @@ struct EmailParser {
 
     /// Parse email metadata from raw email data
     static func parseMetadata(from data: Data) -> ParsedEmail? {
-        guard let content = String(data: data, encoding: .utf8) ?? String(data: data, encoding: .isoLatin1) else {
+        guard let content = decodeContent(data) else {
             return nil
         }
 
-        // Split headers from body (headers end at first empty line)
-        let headerSection: String
-        if let emptyLineRange = content.range(of: "\r\n\r\n") {
-            headerSection = String(content[..<emptyLineRange.lowerBound])
-        } else if let emptyLineRange = content.range(of: "\n\n") {
-            headerSection = String(content[..<emptyLineRange.lowerBound])
-        } else {
-            headerSection = content
-        }
+        let headerSection = headerSection(of: content)
 
-        // Parse individual headers
-        let from = parseHeader("From", in: headerSection)
-        let subject = parseHeader("Subject", in: headerSection)
+        // Parse individual headers; decoded words may carry control characters
+        let from = parseHeader("From", in: headerSection)?.strippingControlCharacters()
+        let subject = parseHeader("Subject", in: headerSection)?.strippingControlCharacters()
         let date = parseHeader("Date", in: headerSection)
         let messageId = parseHeader("Message-ID", in: headerSection) ?? parseHeader("Message-Id", in: headerSection)
+        let received = parseHeaderValues("Received", in: headerSection, decodingWords: false)
+        let deliveredTo = parseHeaderValues("Delivered-To", in: headerSection, decodingWords: false).first
 
         // Extract sender name from From header
         let senderInfo = parseSender(from: from)
@@ -37,121 +31,121 @@ struct EmailParser {
             senderName: senderInfo.name,
             senderEmail: senderInfo.email,
             subject: subject ?? "(No Subject)",
-            date: emailDate ?? Date()
+            date: emailDate ?? Date(),
+            received: received,
+            deliveredTo: deliveredTo
         )
     }
 
-    /// Parse a specific header value
-    private static func parseHeader(_ name: String, in headers: String) -> String? {
-        // Headers can be folded (continued on next line with whitespace)
-        let pattern = "(?m)^\(name):\\s*(.+?)(?=\\r?\\n[^\\s]|\\r?\\n\\r?\\n|$)"
-
-        guard let regex = try? NSRegularExpression(pattern: pattern, options: [.caseInsensitive, .dotMatchesLineSeparators]),
-              let match = regex.firstMatch(in: headers, range: NSRange(headers.startIndex..., in: headers)),
-              let valueRange = Range(match.range(at: 1), in: headers) else {
+    /// The Message-ID header without angle brackets, nil when the email has none
+    static func messageId(from data: Data) -> String? {
+        guard let content = decodeContent(data) else {
             return nil
         }
-
-        // Clean up folded headers (remove CRLF + whitespace)
-        var value = String(headers[valueRange])
-        value = value.replacingOccurrences(of: "\r\n ", with: " ")
-        value = value.replacingOccurrences(of: "\r\n\t", with: " ")
-        value = value.replacingOccurrences(of: "\n ", with: " ")
-        value = value.replacingOccurrences(of: "\n\t", with: " ")
-        value = value.trimmingCharacters(in: .whitespacesAndNewlines)
-
-        // Decode RFC 2047 encoded-word strings (e.g., =?utf-8?q?...?=)
-        value = decodeRFC2047(value)
-
-        return value.isEmpty ? nil : value
+        return parseHeader("Message-ID", in: headerSection(of: content)).flatMap(normalizedMessageID)
     }
 
-    /// Decode RFC 2047 encoded-word strings
-    /// Format: =?charset?encoding?encoded_text?=
-    /// encoding: Q = quoted-printable, B = base64
-    private static func decodeRFC2047(_ input: String) -> String {
-        let pattern = #"=\?([^?]+)\?([QqBb])\?([^?]*)\?="#
-
-        guard let regex = try? NSRegularExpression(pattern: pattern, options: []) else {
-            return input
+    /// Whether the message has nothing after its headers but whitespace, including messages that are
+    /// only headers without the blank separator line, and zero-byte messages
+    static func hasEmptyBody(_ data: Data) -> Bool {
+        let body: Data.SubSequence
+        if let crlf = data.range(of: Data("\r\n\r\n".utf8)) {
+            body = data[crlf.upperBound...]
+        } else if let lf = data.range(of: Data("\n\n".utf8)) {
+            body = data[lf.upperBound...]
+        } else {
+            return true
         }
+        return body.allSatisfy { $0 == UInt8(ascii: " ") || $0 == UInt8(ascii: "\t") || $0 == UInt8(ascii: "\r") || $0 == UInt8(ascii: "\n") }
+    }
 
-        var result = input
-        let matches = regex.matches(in: input, range: NSRange(input.startIndex..., in: input))
+    /// Message-ID as it is compared between server and disk: trimmed, without angle brackets
+    static func normalizedMessageID(_ value: String) -> String? {
+        var id = value.trimmingCharacters(in: .whitespacesAndNewlines)
+        if id.hasPrefix("<") && id.hasSuffix(">") {
+            id = String(id.dropFirst().dropLast()).trimmingCharacters(in: .whitespaces)
+        }
+        return id.isEmpty ? nil : id
+    }
 
-        // Process matches in reverse order to preserve string indices
-        for match in matches.reversed() {
-            guard let fullRange = Range(match.range, in: result),
-                  let charsetRange = Range(match.range(at: 1), in: result),
-                  let encodingRange = Range(match.range(at: 2), in: result),
-                  let textRange = Range(match.range(at: 3), in: result) else {
-                continue
-            }
+    /// Text of a raw email. Emails that are not UTF-8 are read in the charset their
+    /// Content-Type declares, chosen per message, and as ISO-8859-1 when there is none.
+    private static func decodeContent(_ data: Data) -> String? {
+        if let content = String(data: data, encoding: .utf8) {
+            return content
+        }
+        guard let latin1 = String(data: data, encoding: .isoLatin1) else {
+            return nil
+        }
+        if let charset = declaredCharset(in: headerSection(of: latin1)),
+           let content = MIMEDecoding.string(from: data, charset: charset) {
+            return content
+        }
+        return latin1
+    }
 
-            let charset = String(result[charsetRange]).lowercased()
-            let encoding = String(result[encodingRange]).lowercased()
-            let encodedText = String(result[textRange])
+    /// charset parameter of the top-level Content-Type header
+    private static func declaredCharset(in headers: String) -> String? {
+        guard let contentType = parseHeader("Content-Type", in: headers),
+              let range = contentType.range(of: #"charset\s*=\s*"?[A-Za-z0-9_.:+-]+"#, options: [.regularExpression, .caseInsensitive]) else {
+            return nil
+        }
+        let parameter = contentType[range]
+        let value = parameter[parameter.index(after: parameter.firstIndex(of: "=")!)...]
+        return value.trimmingCharacters(in: CharacterSet(charactersIn: "\" ").union(.whitespaces))
+    }
 
-            var decodedData: Data?
+    /// Headers end at the first empty line
+    private static func headerSection(of content: String) -> String {
+        if let emptyLineRange = content.range(of: "\r\n\r\n") {
+            return String(content[..<emptyLineRange.lowerBound])
+        } else if let emptyLineRange = content.range(of: "\n\n") {
+            return String(content[..<emptyLineRange.lowerBound])
+        }
+        return content
+    }
 
-            if encoding == "q" {
-                // Quoted-printable decoding
-                decodedData = decodeQuotedPrintable(encodedText, isHeader: true)
-            } else if encoding == "b" {
-                // Base64 decoding
-                decodedData = Data(base64Encoded: encodedText)
-            }
+    /// Parse a specific header value
+    private static func parseHeader(_ name: String, in headers: String) -> String? {
+        parseHeaderValues(name, in: headers).first
+    }
 
-            if let data = decodedData {
-                let cfEncoding = CFStringConvertIANACharSetNameToEncoding(charset as CFString)
-                let nsEncoding = CFStringConvertEncodingToNSStringEncoding(cfEncoding)
+    /// Every non-empty value of a header that may occur more than once, in the order they appear.
+    /// For Received that is the most recent hop first.
+    private static func parseHeaderValues(_ name: String, in headers: String, decodingWords: Bool = true) -> [String] {
+        // Headers can be folded (continued on next line with whitespace); \z rather than $, which in
+        // multiline mode would end the value at the first fold
+        let pattern = "(?m)^\(name):\\s*(.+?)(?=\\r?\\n[^\\s]|\\r?\\n\\r?\\n|\\z)"
 
-                if let decoded = String(data: data, encoding: String.Encoding(rawValue: nsEncoding)) {
-                    result.replaceSubrange(fullRange, with: decoded)
-                } else if let decoded = String(data: data, encoding: .utf8) {
-                    result.replaceSubrange(fullRange, with: decoded)
-                }
-            }
+        guard let regex = try? NSRegularExpression(pattern: pattern, options: [.caseInsensitive, .dotMatchesLineSeparators]) else {
+            return []
         }
 
-        // Remove spaces between adjacent encoded words
-        result = result.replacingOccurrences(of: "  ", with: " ")
+        return regex.matches(in: headers, range: NSRange(headers.startIndex..., in: headers)).compactMap { match in
+            guard let valueRange = Range(match.range(at: 1), in: headers) else { return nil }
 
-        return result
-    }
+            // Clean up folded headers (remove CRLF + whitespace)
+            var value = String(headers[valueRange])
+            value = value.replacingOccurrences(of: "\r\n ", with: " ")
+            value = value.replacingOccurrences(of: "\r\n\t", with: " ")
+            value = value.replacingOccurrences(of: "\n ", with: " ")
+            value = value.replacingOccurrences(of: "\n\t", with: " ")
+            value = value.trimmingCharacters(in: .whitespacesAndNewlines)
 
-    /// Decode quoted-printable encoding
-    private static func decodeQuotedPrintable(_ input: String, isHeader: Bool = false) -> Data? {
-        var result = Data()
-        var index = input.startIndex
-
-        while index < input.endIndex {
-            let char = input[index]
-
-            if char == "=" && input.index(index, offsetBy: 2, limitedBy: input.endIndex) != nil {
-                let hexStart = input.index(after: index)
-                let hexEnd = input.index(hexStart, offsetBy: 2, limitedBy: input.endIndex) ?? input.endIndex
-                let hex = String(input[hexStart..<hexEnd])
-
-                if let byte = UInt8(hex, radix: 16) {
-                    result.append(byte)
-                    index = hexEnd
-                    continue
-                }
-            } else if isHeader && char == "_" {
-                // In headers, underscore represents space
-                result.append(0x20)
-                index = input.index(after: index)
-                continue
+            // Decode RFC 2047 encoded-word strings (e.g., =?utf-8?q?...?=)
+            if decodingWords {
+                value = decodeRFC2047(value)
             }
 
-            if let byte = String(char).data(using: .utf8) {
-                result.append(byte)
-            }
-            index = input.index(after: index)
+            return value.isEmpty ? nil : value
         }
+    }
 
-        return result
+    /// Decode RFC 2047 encoded-word strings
+    /// Format: =?charset?encoding?encoded_text?=
+    private static func decodeRFC2047(_ input: String) -> String {
+        // Remove spaces between adjacent encoded words
+        MIMEDecoding.decodeEncodedWords(input).replacingOccurrences(of: "  ", with: " ")
     }
 
     /// Parse sender name and email from From header
@@ -197,14 +191,6 @@ struct EmailParser {
     private static func parseDate(from dateString: String?) -> Date? {
         guard let dateString = dateString else { return nil }
 
-        let formatters: [DateFormatter] = [
-            createFormatter("EEE, d MMM yyyy HH:mm:ss Z"),      // RFC 2822
-            createFormatter("EEE, d MMM yyyy HH:mm:ss z"),      // With timezone name
-            createFormatter("d MMM yyyy HH:mm:ss Z"),           // Without day name
-            createFormatter("EEE, dd MMM yyyy HH:mm:ss Z"),     // With leading zero
-            createFormatter("yyyy-MM-dd'T'HH:mm:ssZ"),          // ISO 8601
-        ]
-
         // Clean up the date string
         var cleanDate = dateString
             .replacingOccurrences(of: "  ", with: " ")
@@ -215,7 +201,7 @@ struct EmailParser {
             cleanDate = String(cleanDate[..<parenStart.lowerBound]).trimmingCharacters(in: .whitespaces)
         }
 
-        for formatter in formatters {
+        for formatter in dateFormatters {
             if let date = formatter.date(from: cleanDate) {
                 return date
             }
@@ -224,6 +210,15 @@ struct EmailParser {
         return nil
     }
 
+    /// Created once and only read afterwards; DateFormatter is safe to use from several threads
+    private static let dateFormatters: [DateFormatter] = [
+        createFormatter("EEE, d MMM yyyy HH:mm:ss Z"),      // RFC 2822
+        createFormatter("EEE, d MMM yyyy HH:mm:ss z"),      // With timezone name
+        createFormatter("d MMM yyyy HH:mm:ss Z"),           // Without day name
+        createFormatter("EEE, dd MMM yyyy HH:mm:ss Z"),     // With leading zero
+        createFormatter("yyyy-MM-dd'T'HH:mm:ssZ"),          // ISO 8601
+    ]
+
     private static func createFormatter(_ format: String) -> DateFormatter {
         let formatter = DateFormatter()
         formatter.dateFormat = format
@@ -240,4 +235,8 @@ struct ParsedEmail {
     let senderEmail: String
     let subject: String
     let date: Date
+    /// Received headers as they appear, the last hop (the receiving server) first
+    var received: [String] = []
+    /// Mailbox the message was finally delivered to; the topmost Delivered-To when there are several
+    var deliveredTo: String? = nil
 }
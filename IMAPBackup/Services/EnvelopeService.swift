@@ -0,0 +1,321 @@
+import Foundation
+
+// MARK: - IMAP Values
+
+/// A value from an IMAP parenthesized list: NIL, a string/atom, or a nested list
+/// Encodes to JSON as null, a string, or an array so server data is kept as reported.
+indirect enum IMAPValue: Equatable, Codable {
+    case null
+    case string(String)
+    case list([IMAPValue])
+
+    init(from decoder: Decoder) throws {
+        let container = try decoder.singleValueContainer()
+        if container.decodeNil() {
+            self = .null
+        } else if let string = try? container.decode(String.self) {
+            self = .string(string)
+        } else {
+            self = .list(try container.decode([IMAPValue].self))
+        }
+    }
+
+    /// Same value with invalid text replaced and control characters removed
+    func sanitized() -> IMAPValue {
+        switch self {
+        case .null:
+            return .null
+        case .string(let string):
+            return .string(string.strippingControlCharacters())
+        case .list(let items):
+            return .list(items.map { $0.sanitized() })
+        }
+    }
+
+    func encode(to encoder: Encoder) throws {
+        var container = encoder.singleValueContainer()
+        switch self {
+        case .null:
+            try container.encodeNil()
+        case .string(let string):
+            try container.encode(string)
+        case .list(let items):
+            try container.encode(items)
+        }
+    }
+}
+
+// MARK: - Envelope Sidecar
+
+/// Server-reported ENVELOPE and BODYSTRUCTURE, stored next to the .eml for forensics
+struct EnvelopeSidecar: Codable {
+    let uid: UInt32
+    let folder: String
+    let fetchedAt: Date
+    var envelope: IMAPValue?
+    var bodyStructure: IMAPValue?
+    /// Raw IMAP flags as reported, e.g. \Seen or $Label1
+    var flags: [String]?
+    /// Readable names for `flags`, e.g. read or starred
+    var flagLabels: [String]?
+    /// Set when the message has headers but no body, or nothing at all, on the server
+    var emptyBody: Bool?
+    /// Set when the Date header lies far in the future; the email may be named by INTERNALDATE instead
+    var futureDated: Bool?
+    /// When `flags` were last updated by a flag refresh; they no longer match `rawResponse` then
+    var flagsRefreshedAt: Date?
+    /// Untouched FETCH response, in case the structured form loses anything
+    let rawResponse: String
+
+    init(uid: UInt32, folder: String, response: String, fetchedAt: Date = Date()) {
+        let attributes = EnvelopeParser.parseFetchAttributes(response)
+        self.uid = uid
+        self.folder = folder
+        self.fetchedAt = fetchedAt
+        self.envelope = attributes["ENVELOPE"]
+        self.bodyStructure = attributes["BODYSTRUCTURE"]
+        if case .list(let items)? = attributes["FLAGS"] {
+            let flags = items.compactMap { item -> String? in
+                if case .string(let flag) = item { return flag }
+                return nil
+            }
+            self.flags = flags
+            self.flagLabels = MessageFlags.labels(for: flags)
+        }
+        self.rawResponse = response
+    }
+
+    /// Date, Subject, From and Message-ID rebuilt from the envelope as header lines,
+    /// so messages saved without a body can be named and parsed like full emails
+    var headerBlock: String {
+        guard case .list(let fields)? = envelope else { return "\r\n" }
+
+        func string(at index: Int) -> String? {
+            guard index < fields.count, case .string(let value) = fields[index], !value.isEmpty else { return nil }
+            return value
+        }
+
+        var lines: [String] = []
+        if let date = string(at: 0) {
+            lines.append("Date: \(date)")
+        }
+        if let subject = string(at: 1) {
+            lines.append("Subject: \(subject)")
+        }
+        // Address: (name adl mailbox host)
+        if fields.count > 2, case .list(let addresses) = fields[2],
+           case .list(let address)? = addresses.first, address.count >= 4,
+           case .string(let mailbox) = address[2], case .string(let host) = address[3] {
+            if case .string(let name) = address[0], !name.isEmpty {
+                lines.append("From: \"\(name)\" <\(mailbox)@\(host)>")
+            } else {
+                lines.append("From: <\(mailbox)@\(host)>")
+            }
+        }
+        if let messageId = string(at: 9) {
+            lines.append("Message-ID: \(messageId)")
+        }
+        return lines.map { $0 + "\r\n" }.joined() + "\r\n"
+    }
+
+    /// Copy with the read state in `flags` and `flagLabels` set by the policy.
+    /// The raw response keeps the flags exactly as the server reported them.
+    func applying(_ policy: LocalFlagPolicy) -> EnvelopeSidecar {
+        guard let flags = flags, policy != .preserve else { return self }
+        var copy = self
+        copy.flags = policy.apply(to: flags)
+        copy.flagLabels = MessageFlags.labels(for: copy.flags ?? [])
+        return copy
+    }
+
+    /// Copy with all structured strings cleaned; the raw response is kept as received
+    func sanitized() -> EnvelopeSidecar {
+        var copy = self
+        copy.envelope = envelope?.sanitized()
+        copy.bodyStructure = bodyStructure?.sanitized()
+        return copy
+    }
+}
+
+// MARK: - Flags
+
+/// Maps IMAP flags to names that make sense to people reading the metadata
+enum MessageFlags {
+
+    /// System flags (RFC 9051) and common keywords with their readable names
+    static let knownLabels: [String: String] = [
+        "\\seen": "read",
+        "\\flagged": "starred",
+        "\\answered": "answered",
+        "\\draft": "draft",
+        "\\deleted": "deleted",
+        "\\recent": "recent",
+        "$forwarded": "forwarded",
+        "$junk": "junk",
+        "$notjunk": "not junk",
+        "$phishing": "phishing",
+        "$important": "important",
+        "$mdnsent": "receipt sent"
+    ]
+
+    /// Readable name for one flag; other keywords keep their name without the `$` or `\`
+    static func label(for flag: String) -> String {
+        if let known = knownLabels[flag.lowercased()] {
+            return known
+        }
+        var name = Substring(flag)
+        while let first = name.first, first == "$" || first == "\\" {
+            name = name.dropFirst()
+        }
+        return name.isEmpty ? flag : String(name)
+    }
+
+    /// Readable names for a flag list, in the same order and without duplicates
+    static func labels(for flags: [String]) -> [String] {
+        var seen = Set<String>()
+        return flags.map(label(for:)).filter { seen.insert($0).inserted }
+    }
+}
+
+/// How the read state is recorded in saved metadata. Only the metadata changes;
+/// the .eml and the flags on the server are left alone.
+enum LocalFlagPolicy: String, CaseIterable {
+    /// Exactly what the server reports
+    case preserve
+    /// Everything archived counts as read
+    case markRead = "mark-read"
+    /// Everything archived counts as unread
+    case markUnread = "mark-unread"
+
+    var displayName: String {
+        switch self {
+        case .preserve: return "As on the server"
+        case .markRead: return "Mark all read"
+        case .markUnread: return "Mark all unread"
+        }
+    }
+
+    /// Flags with \Seen added or removed; other flags keep their order
+    func apply(to flags: [String]) -> [String] {
+        let unseen = flags.filter { $0.lowercased() != "\\seen" }
+        switch self {
+        case .preserve: return flags
+        case .markRead: return unseen + ["\\Seen"]
+        case .markUnread: return unseen
+        }
+    }
+}
+
+// MARK: - Parser
+
+/// Parses FETCH responses into IMAP values without normalizing them
+enum EnvelopeParser {
+
+    /// Parse the attribute list of the first FETCH response into name -> value
+    static func parseFetchAttributes(_ response: String) -> [String: IMAPValue] {
+        guard let range = response.range(of: "FETCH (", options: .caseInsensitive) else {
+            return [:]
+        }
+
+        // Start at the opening parenthesis
+        let bytes = Array(response[response.index(before: range.upperBound)...].utf8)
+        var index = 0
+        guard case .list(let items)? = parseValue(bytes, &index) else {
+            return [:]
+        }
+
+        var attributes: [String: IMAPValue] = [:]
+        var i = 0
+        while i + 1 < items.count {
+            if case .string(let name) = items[i] {
+                attributes[name.uppercased()] = items[i + 1]
+            }
+            i += 2
+        }
+        return attributes
+    }
+
+    /// Parse a single value starting at `index`, advancing past it
+    static func parseValue(_ bytes: [UInt8], _ index: inout Int) -> IMAPValue? {
+        skipSpaces(bytes, &index)
+        guard index < bytes.count else { return nil }
+
+        switch bytes[index] {
+        case UInt8(ascii: "("):
+            index += 1
+            var items: [IMAPValue] = []
+            while true {
+                skipSpaces(bytes, &index)
+                guard index < bytes.count else { break }
+                if bytes[index] == UInt8(ascii: ")") {
+                    index += 1
+                    break
+                }
+                guard let item = parseValue(bytes, &index) else { break }
+                items.append(item)
+            }
+            return .list(items)
+
+        case UInt8(ascii: ")"):
+            return nil
+
+        case UInt8(ascii: "\""):
+            index += 1
+            var value: [UInt8] = []
+            while index < bytes.count && bytes[index] != UInt8(ascii: "\"") {
+                if bytes[index] == UInt8(ascii: "\\") && index + 1 < bytes.count {
+                    index += 1
+                }
+                value.append(bytes[index])
+                index += 1
+            }
+            index += 1
+            return .string(decode(value))
+
+        case UInt8(ascii: "{"):
+            // Literal: {n}\r\n followed by n bytes
+            var end = index + 1
+            while end < bytes.count && bytes[end] != UInt8(ascii: "}") {
+                end += 1
+            }
+            guard let count = Int(decode(Array(bytes[(index + 1)..<min(end, bytes.count)]))) else {
+                return nil
+            }
+            index = min(end + 3, bytes.count)  // "}\r\n"
+            let literalEnd = min(index + count, bytes.count)
+            let value = Array(bytes[index..<literalEnd])
+            index = literalEnd
+            return .string(decode(value))
+
+        default:
+            // Atom; section specifiers like BODY[HEADER.FIELDS (FROM)] may contain spaces
+            var value: [UInt8] = []
+            var bracketDepth = 0
+            while index < bytes.count {
+                let byte = bytes[index]
+                if bracketDepth == 0 && (byte == UInt8(ascii: " ") || byte == UInt8(ascii: "(") ||
+                                         byte == UInt8(ascii: ")") || byte == UInt8(ascii: "\r")) {
+                    break
+                }
+                if byte == UInt8(ascii: "[") { bracketDepth += 1 }
+                if byte == UInt8(ascii: "]") { bracketDepth -= 1 }
+                value.append(byte)
+                index += 1
+            }
+            let atom = decode(value)
+            return atom.uppercased() == "NIL" ? .null : .string(atom)
+        }
+    }
+
+    private static func skipSpaces(_ bytes: [UInt8], _ index: inout Int) {
+        while index < bytes.count && (bytes[index] == UInt8(ascii: " ") ||
+                                      bytes[index] == UInt8(ascii: "\r") ||
+                                      bytes[index] == UInt8(ascii: "\n")) {
+            index += 1
+        }
+    }
+
+    private static func decode(_ bytes: [UInt8]) -> String {
+        String(sanitizingUTF8: Data(bytes))
+    }
+}
@@ -0,0 +1,127 @@
+import Foundation
+
+/// What a flag refresh found for one account
+struct FlagRefreshResult {
+    let accountEmail: String
+    var foldersChecked = 0
+    /// Folders where CONDSTORE let the server send only the messages changed since last time
+    var incrementalFolders = 0
+    /// Messages whose flags the server reported
+    var messagesReported = 0
+    var sidecarsUpdated = 0
+    var errors: [String] = []
+
+    var summary: String {
+        var text = "Updated flags of \(sidecarsUpdated) email(s) in \(foldersChecked) folder(s)"
+        if incrementalFolders > 0 {
+            text += ", \(incrementalFolders) via CHANGEDSINCE"
+        }
+        if !errors.isEmpty {
+            text += ", \(errors.count) error(s)"
+        }
+        return text
+    }
+}
+
+/// Keeps the read and flag state in envelope metadata current between full backups without
+/// downloading any message. Uses CONDSTORE's CHANGEDSINCE where the server supports it and a
+/// full FLAGS fetch otherwise. Only emails saved with an envelope sidecar have flags to refresh.
+enum FlagRefreshService {
+
+    /// Accounts refreshed at the same time; each still goes through its server's rate limit
+    static let defaultMaxConcurrentAccounts = 2
+
+    /// Run `refreshAccount` for every enabled account, at most `maxConcurrentAccounts` at a time.
+    /// Results come back in account order.
+    static func refreshAll(
+        accounts: [EmailAccount],
+        maxConcurrentAccounts: Int = defaultMaxConcurrentAccounts,
+        refreshAccount: @escaping (EmailAccount) async -> FlagRefreshResult
+    ) async -> [FlagRefreshResult] {
+        let enabled = accounts.filter { $0.isEnabled }
+        let limit = max(1, maxConcurrentAccounts)
+
+        return await withTaskGroup(of: (Int, FlagRefreshResult).self) { group in
+            var results = [FlagRefreshResult?](repeating: nil, count: enabled.count)
+            var next = 0
+
+            while next < min(limit, enabled.count) {
+                let index = next
+                group.addTask { (index, await refreshAccount(enabled[index])) }
+                next += 1
+            }
+            for await (index, result) in group {
+                results[index] = result
+                if next < enabled.count && !Task.isCancelled {
+                    let index = next
+                    group.addTask { (index, await refreshAccount(enabled[index])) }
+                    next += 1
+                }
+            }
+            return results.compactMap { $0 }
+        }
+    }
+
+    /// Refresh the flags of every backed-up folder of one account over a logged-in connection
+    static func refreshAccount(
+        accountEmail: String,
+        service: IMAPServiceProtocol,
+        storageService: StorageService,
+        policy: LocalFlagPolicy = .preserve
+    ) async throws -> FlagRefreshResult {
+        var result = FlagRefreshResult(accountEmail: accountEmail)
+        let folders = try await service.listFolders().filter { $0.isSelectable }
+
+        for folder in folders {
+            try Task.checkCancellation()
+
+            // No sidecars means no stored flags, so the folder is not worth a request
+            let envelopeUIDs = (try? await storageService.getEnvelopeUIDs(accountEmail: accountEmail, folderPath: folder.path)) ?? []
+            guard !envelopeUIDs.isEmpty else { continue }
+
+            do {
+                let status = try await service.examineFolder(folder.name)
+                guard status.exists > 0 else { continue }
+
+                let modSeq = await storageService.flagsModSeq(
+                    accountEmail: accountEmail,
+                    folderPath: folder.path,
+                    uidValidity: status.uidValidity
+                )
+                let fetched = try await service.fetchFlags(changedSince: modSeq)
+                let updated = try await storageService.updateEnvelopeFlags(
+                    fetched.flags.filter { envelopeUIDs.contains($0.key) },
+                    accountEmail: accountEmail,
+                    folderPath: folder.path,
+                    policy: policy
+                )
+
+                // Without changes the server reports no MODSEQ; the old one is still good
+                if let highest = fetched.highestModSeq {
+                    try await storageService.recordFlagsModSeq(
+                        max(highest, modSeq ?? 0),
+                        uidValidity: status.uidValidity,
+                        accountEmail: accountEmail,
+                        folderPath: folder.path
+                    )
+                }
+
+                result.foldersChecked += 1
+                result.incrementalFolders += fetched.isIncremental ? 1 : 0
+                result.messagesReported += fetched.flags.count
+                result.sidecarsUpdated += updated
+                if updated > 0 {
+                    logDebug("Refreshed flags of \(updated) email(s) in \(folder.name)")
+                }
+            } catch is CancellationError {
+                throw CancellationError()
+            } catch {
+                result.errors.append("\(folder.name): \(error.localizedDescription)")
+                logWarning("Flag refresh of \(folder.name) failed: \(error.localizedDescription)")
+            }
+        }
+
+        logInfo("Flag refresh for \(accountEmail): \(result.summary)")
+        return result
+    }
+}
@@ -0,0 +1,99 @@
+import Foundation
+
+/// Picks the folders a backup covers when only some are wanted, e.g. INBOX and Sent. Names of
+/// special-use folders (RFC 6154) such as "Sent" find the folder the server flags for that use,
+/// whatever the provider calls it; any other name matches a folder path.
+enum FolderSelection {
+
+    /// Launch flag backing up every folder regardless of the default folders
+    static let allFoldersFlag = "--all-folders"
+
+    /// Special-use attributes by the names users give them
+    static let specialUseAttributes: [String: String] = [
+        "sent": "\\Sent",
+        "drafts": "\\Drafts",
+        "trash": "\\Trash",
+        "junk": "\\Junk",
+        "spam": "\\Junk",
+        "archive": "\\Archive",
+        "all": "\\All",
+        "flagged": "\\Flagged"
+    ]
+
+    /// What providers call special-use folders, for servers that do not flag them
+    static let commonNames: [String: [String]] = [
+        "\\Sent": ["Sent", "Sent Items", "Sent Messages", "Sent Mail", "[Gmail]/Sent Mail", "INBOX.Sent", "Gesendet", "Gesendete Elemente"],
+        "\\Drafts": ["Drafts", "[Gmail]/Drafts", "INBOX.Drafts", "Entwürfe"],
+        "\\Trash": ServerCleanupService.commonTrashNames,
+        "\\Junk": ["Junk", "Spam", "Junk E-mail", "Junk Email", "[Gmail]/Spam", "INBOX.Junk", "INBOX.Spam"],
+        "\\Archive": ["Archive", "Archives", "INBOX.Archive", "Archiv"],
+        "\\All": ["[Gmail]/All Mail", "All Mail"],
+        "\\Flagged": ["[Gmail]/Starred", "Flagged", "Starred"]
+    ]
+
+    /// Comma- or line-separated folder names as typed in settings
+    static func parseNames(_ text: String) -> [String] {
+        text.components(separatedBy: CharacterSet(charactersIn: ",\n"))
+            .map { $0.trimmingCharacters(in: .whitespaces) }
+            .filter { !$0.isEmpty }
+    }
+
+    /// The folders named by `names`, in server order, and the names that matched no folder
+    static func resolve(_ names: [String], in folders: [IMAPFolder]) -> (folders: [IMAPFolder], unmatched: [String]) {
+        var picked = Set<String>()
+        var unmatched: [String] = []
+
+        for name in names {
+            if let folder = folder(named: name, in: folders) {
+                picked.insert(folder.path)
+            } else {
+                unmatched.append(name)
+            }
+        }
+        return (folders.filter { picked.contains($0.path) }, unmatched)
+    }
+
+    /// A special-use name prefers the flagged folder, then one by that exact name, then what
+    /// providers commonly call it. Other names match a path or raw name, ignoring case.
+    static func folder(named name: String, in folders: [IMAPFolder]) -> IMAPFolder? {
+        func matching(_ candidate: String) -> IMAPFolder? {
+            folders.first {
+                $0.path.caseInsensitiveCompare(candidate) == .orderedSame
+                    || $0.name.caseInsensitiveCompare(candidate) == .orderedSame
+            }
+        }
+
+        guard let attribute = specialUseAttributes[name.lowercased()] else {
+            return matching(name)
+        }
+        if let flagged = folders.first(where: { folder in
+            folder.flags.contains { $0.caseInsensitiveCompare(attribute) == .orderedSame }
+        }) {
+            return flagged
+        }
+        if let exact = matching(name) {
+            return exact
+        }
+        for candidate in commonNames[attribute] ?? [] {
+            if let match = matching(candidate) {
+                return match
+            }
+        }
+        return nil
+    }
+
+    /// Folders to back up: the default folders when some are set and `allFolders` is not asked
+    /// for, otherwise everything. Shared folders have their own opt-in and filters and are kept.
+    static func foldersToBackUp(_ folders: [IMAPFolder], defaultFolders: [String], allFolders: Bool) -> [IMAPFolder] {
+        guard !defaultFolders.isEmpty, !allFolders else { return folders }
+
+        let personal = folders.filter { $0.namespacePrefix == nil }
+        let resolved = resolve(defaultFolders, in: personal)
+        if !resolved.unmatched.isEmpty {
+            logWarning("Default folders not found on the server: \(resolved.unmatched.joined(separator: ", "))")
+        }
+
+        let picked = Set(resolved.folders.map { $0.path })
+        return folders.filter { $0.namespacePrefix != nil || picked.contains($0.path) }
+    }
+}
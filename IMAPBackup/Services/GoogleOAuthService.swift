@@ -14,6 +14,23 @@ struct GoogleOAuthTokens: Codable {
         // Consider expired 5 minutes before actual expiry for safety margin
         Date() >= expiresAt.addingTimeInterval(-300)
     }
+
+    /// Show only the start of a token, e.g. "ya29****"
+    static func mask(_ token: String) -> String {
+        guard !token.isEmpty else { return "" }
+        return String(token.prefix(4)) + "****"
+    }
+}
+
+// Tokens are masked wherever the struct is printed or interpolated
+extension GoogleOAuthTokens: CustomStringConvertible, CustomDebugStringConvertible {
+    var description: String {
+        "GoogleOAuthTokens(accessToken: \(Self.mask(accessToken)), refreshToken: \(Self.mask(refreshToken)), expiresAt: \(expiresAt), scope: \(scope))"
+    }
+
+    var debugDescription: String {
+        description
+    }
 }
 
 /// Service for handling Google OAuth2 authentication
@@ -24,14 +41,138 @@ final class GoogleOAuthService: NSObject {
     // MARK: - Configuration
 
     /// OAuth2 configuration
-    struct Configuration {
+    struct Configuration: Equatable {
         let clientId: String
+        let clientSecret: String
         let redirectUri: String
 
         /// Bundled default credentials from OAuthSecrets.swift (gitignored)
         static let defaultClientId = OAuthSecrets.googleClientId
         static let defaultClientSecret = OAuthSecrets.googleClientSecret
 
+        /// UserDefaults keys of the custom credentials set in Settings → Advanced
+        static let customClientIdKey = "googleOAuthClientId"
+        static let clientSecretFileKey = "googleOAuthClientSecretFile"
+
+        /// Environment variables that override everything else, e.g. for builds without OAuthSecrets.swift
+        static let clientIdEnvironmentKey = "MAILKEEP_GOOGLE_CLIENT_ID"
+        static let clientSecretEnvironmentKey = "MAILKEEP_GOOGLE_CLIENT_SECRET"
+
+        /// Without a registered `redirectUri`, the reversed client ID is used as URL scheme
+        init(clientId: String, clientSecret: String, redirectUri: String? = nil) {
+            self.clientId = clientId
+            self.clientSecret = clientSecret
+            let reversedClientId = clientId.components(separatedBy: ".").reversed().joined(separator: ".")
+            self.redirectUri = redirectUri ?? "\(reversedClientId):/oauth2callback"
+        }
+
+        /// An http://localhost or http://127.0.0.1 redirect, answered by `OAuthLoopbackReceiver`
+        /// rather than a URL scheme of the app
+        var usesLoopbackRedirect: Bool {
+            Self.isLoopback(redirectUri)
+        }
+
+        private static func isLoopback(_ uri: String) -> Bool {
+            guard let url = URL(string: uri), url.scheme == "http" else { return false }
+            return ["localhost", "127.0.0.1"].contains(url.host ?? "")
+        }
+
+        /// Pick the client credentials, first found wins: the environment, a client secret file
+        /// downloaded from the Google Cloud Console, a custom client ID, the bundled defaults.
+        /// The bundled secret only ever goes with the bundled client ID.
+        static func resolve(
+            environment: [String: String] = ProcessInfo.processInfo.environment,
+            clientSecretFile: String? = UserDefaults.standard.string(forKey: clientSecretFileKey),
+            customClientId: String? = UserDefaults.standard.string(forKey: customClientIdKey),
+            bundledClientId: String = defaultClientId,
+            bundledClientSecret: String = defaultClientSecret
+        ) throws -> Configuration {
+            let environmentId = trimmed(environment[clientIdEnvironmentKey])
+            let environmentSecret = trimmed(environment[clientSecretEnvironmentKey])
+            if environmentId != nil || environmentSecret != nil {
+                return try Configuration(clientId: environmentId ?? "", clientSecret: environmentSecret ?? "").validated()
+            }
+
+            if let path = trimmed(clientSecretFile) {
+                return try cachedClientSecretFile(at: URL(fileURLWithPath: (path as NSString).expandingTildeInPath)).validated()
+            }
+
+            if let clientId = trimmed(customClientId), clientId != bundledClientId {
+                // A custom client ID needs its own secret, which only the file or the environment provide
+                return try Configuration(clientId: clientId, clientSecret: "").validated()
+            }
+
+            return try Configuration(clientId: bundledClientId, clientSecret: bundledClientSecret).validated()
+        }
+
+        /// Client secret files read so far by path, so checking the configuration, which views do
+        /// on every update, does not read the disk. Choosing a file again reads it afresh.
+        private static var clientSecretFiles: [String: Configuration] = [:]
+        private static let clientSecretFilesLock = NSLock()
+
+        private static func cachedClientSecretFile(at url: URL) throws -> Configuration {
+            clientSecretFilesLock.lock()
+            defer { clientSecretFilesLock.unlock() }
+            if let configuration = clientSecretFiles[url.path] {
+                return configuration
+            }
+            let configuration = try loadClientSecretFile(at: url)
+            clientSecretFiles[url.path] = configuration
+            return configuration
+        }
+
+        /// Forget what was read from the file at `path`, e.g. after it was chosen again
+        static func forgetClientSecretFile(at path: String) {
+            clientSecretFilesLock.lock()
+            defer { clientSecretFilesLock.unlock() }
+            clientSecretFiles[URL(fileURLWithPath: (path as NSString).expandingTildeInPath).path] = nil
+        }
+
+        /// Read the `installed` (or `web`) client of a client_secret_*.json file. A registered
+        /// loopback redirect such as "http://localhost" is used; without one the reversed client ID is.
+        static func loadClientSecretFile(at url: URL) throws -> Configuration {
+            struct ClientSecretFile: Decodable {
+                struct Client: Decodable {
+                    let client_id: String
+                    let client_secret: String?
+                    let redirect_uris: [String]?
+                }
+                let installed: Client?
+                let web: Client?
+            }
+
+            guard let data = try? Data(contentsOf: url),
+                  let file = try? JSONDecoder().decode(ClientSecretFile.self, from: data),
+                  let client = file.installed ?? file.web else {
+                throw GoogleOAuthError.invalidClientSecretFile(url.path)
+            }
+            return Configuration(
+                clientId: client.client_id,
+                clientSecret: client.client_secret ?? "",
+                redirectUri: client.redirect_uris?.first(where: isLoopback)
+            )
+        }
+
+        /// Both a client ID and a client secret are needed to exchange and refresh tokens
+        func validate() throws {
+            guard !clientId.trimmingCharacters(in: .whitespaces).isEmpty else {
+                throw GoogleOAuthError.notConfigured
+            }
+            guard !clientSecret.trimmingCharacters(in: .whitespaces).isEmpty else {
+                throw GoogleOAuthError.missingClientSecret
+            }
+        }
+
+        private func validated() throws -> Configuration {
+            try validate()
+            return self
+        }
+
+        private static func trimmed(_ value: String?) -> String? {
+            guard let value = value?.trimmingCharacters(in: .whitespacesAndNewlines), !value.isEmpty else { return nil }
+            return value
+        }
+
         /// Google's OAuth2 endpoints
         static let authorizationEndpoint = "https://accounts.google.com/o/oauth2/auth"
         static let tokenEndpoint = "https://oauth2.googleapis.com/token"
@@ -61,32 +202,19 @@ final class GoogleOAuthService: NSObject {
 
     // MARK: - Configuration Management
 
-    /// Load OAuth configuration - uses bundled default Client ID, or user override if set
-    func loadConfiguration() -> Configuration? {
-        // Use user-configured Client ID if set, otherwise use bundled default
-        let clientId: String
-        if let userClientId = UserDefaults.standard.string(forKey: "googleOAuthClientId"),
-           !userClientId.isEmpty {
-            clientId = userClientId
-        } else {
-            clientId = Configuration.defaultClientId
-        }
-
-        // Redirect URI uses the reversed client ID as URL scheme
-        let reversedClientId = clientId.components(separatedBy: ".").reversed().joined(separator: ".")
-        let redirectUri = "\(reversedClientId):/oauth2callback"
-
-        return Configuration(clientId: clientId, redirectUri: redirectUri)
+    /// Load the OAuth configuration, throwing if no complete client ID and secret are available
+    func loadConfiguration() throws -> Configuration {
+        try Configuration.resolve()
     }
 
     /// Save OAuth configuration
     func saveConfiguration(clientId: String) {
-        UserDefaults.standard.set(clientId, forKey: "googleOAuthClientId")
+        UserDefaults.standard.set(clientId, forKey: Configuration.customClientIdKey)
     }
 
-    /// Check if OAuth is configured - always true since we have a bundled default Client ID
+    /// Whether a complete client ID and secret are available to sign in with
     var isConfigured: Bool {
-        true
+        (try? loadConfiguration()) != nil
     }
 
     // MARK: - OAuth Flow
@@ -94,9 +222,7 @@ final class GoogleOAuthService: NSObject {
     /// Start the OAuth2 authorization flow
     /// - Returns: OAuth tokens on success
     func authorize() async throws -> GoogleOAuthTokens {
-        guard let config = loadConfiguration() else {
-            throw GoogleOAuthError.notConfigured
-        }
+        let config = try loadConfiguration()
 
         currentConfiguration = config
 
@@ -104,26 +230,40 @@ final class GoogleOAuthService: NSObject {
         codeVerifier = generateCodeVerifier()
         let codeChallenge = generateCodeChallenge(from: codeVerifier!)
 
-        // Build authorization URL with PKCE
-        let authURL = buildAuthorizationURL(config: config, codeChallenge: codeChallenge)
+        let callbackURL: URL
+        let redirectUri: String
+        if config.usesLoopbackRedirect {
+            // Google redirects the browser to the registered loopback address on a port of our choosing
+            let receiver = try OAuthLoopbackReceiver()
+            try await receiver.start()
+            defer { receiver.stop() }
+            redirectUri = receiver.redirectUri(for: config.redirectUri)
+            let authURL = buildAuthorizationURL(config: config, redirectUri: redirectUri, codeChallenge: codeChallenge)
+            guard NSWorkspace.shared.open(authURL) else {
+                throw GoogleOAuthError.authSessionFailed("Could not open the browser")
+            }
+            callbackURL = try await receiver.waitForCallback()
+        } else {
+            // Build authorization URL with PKCE
+            redirectUri = config.redirectUri
+            let authURL = buildAuthorizationURL(config: config, redirectUri: redirectUri, codeChallenge: codeChallenge)
 
-        // Present authentication session
-        let callbackURL = try await presentAuthSession(url: authURL, callbackScheme: getCallbackScheme(config: config))
+            // Present authentication session
+            callbackURL = try await presentAuthSession(url: authURL, callbackScheme: getCallbackScheme(config: config))
+        }
 
         // Extract authorization code from callback
         let authCode = try extractAuthorizationCode(from: callbackURL)
 
-        // Exchange code for tokens
-        let tokens = try await exchangeCodeForTokens(code: authCode, config: config)
+        // Exchange code for tokens, naming the same redirect the code was sent to
+        let tokens = try await exchangeCodeForTokens(code: authCode, config: config, redirectUri: redirectUri)
 
         return tokens
     }
 
     /// Refresh an expired access token
     func refreshAccessToken(refreshToken: String) async throws -> GoogleOAuthTokens {
-        guard let config = loadConfiguration() else {
-            throw GoogleOAuthError.notConfigured
-        }
+        let config = try loadConfiguration()
 
         let url = URL(string: Configuration.tokenEndpoint)!
 
@@ -133,7 +273,7 @@ final class GoogleOAuthService: NSObject {
 
         let body = [
             "client_id": config.clientId,
-            "client_secret": Configuration.defaultClientSecret,
+            "client_secret": config.clientSecret,
             "refresh_token": refreshToken,
             "grant_type": "refresh_token"
         ]
@@ -190,12 +330,12 @@ final class GoogleOAuthService: NSObject {
 
     // MARK: - Private Helpers
 
-    private func buildAuthorizationURL(config: Configuration, codeChallenge: String) -> URL {
+    private func buildAuthorizationURL(config: Configuration, redirectUri: String, codeChallenge: String) -> URL {
         var components = URLComponents(string: Configuration.authorizationEndpoint)!
 
         components.queryItems = [
             URLQueryItem(name: "client_id", value: config.clientId),
-            URLQueryItem(name: "redirect_uri", value: config.redirectUri),
+            URLQueryItem(name: "redirect_uri", value: redirectUri),
             URLQueryItem(name: "response_type", value: "code"),
             URLQueryItem(name: "scope", value: Configuration.scopes.joined(separator: " ")),
             URLQueryItem(name: "access_type", value: "offline"),  // Get refresh token
@@ -267,7 +407,7 @@ final class GoogleOAuthService: NSObject {
         return code
     }
 
-    private func exchangeCodeForTokens(code: String, config: Configuration) async throws -> GoogleOAuthTokens {
+    private func exchangeCodeForTokens(code: String, config: Configuration, redirectUri: String) async throws -> GoogleOAuthTokens {
         let url = URL(string: Configuration.tokenEndpoint)!
 
         var request = URLRequest(url: url)
@@ -276,9 +416,9 @@ final class GoogleOAuthService: NSObject {
 
         var body = [
             "client_id": config.clientId,
-            "client_secret": Configuration.defaultClientSecret,
+            "client_secret": config.clientSecret,
             "code": code,
-            "redirect_uri": config.redirectUri,
+            "redirect_uri": redirectUri,
             "grant_type": "authorization_code"
         ]
 
@@ -378,6 +518,8 @@ extension GoogleOAuthService {
 
 enum GoogleOAuthError: LocalizedError {
     case notConfigured
+    case missingClientSecret
+    case invalidClientSecretFile(String)
     case userCancelled
     case authSessionFailed(String)
     case noCallbackURL
@@ -394,6 +536,10 @@ enum GoogleOAuthError: LocalizedError {
         switch self {
         case .notConfigured:
             return "Google OAuth is not configured. Please set up your Google Cloud credentials in Settings."
+        case .missingClientSecret:
+            return "No client secret for the Google OAuth client ID. Choose the client secret file from the Google Cloud Console in Settings → Advanced."
+        case .invalidClientSecretFile(let path):
+            return "\(path) is not a Google OAuth client secret file."
         case .userCancelled:
             return "Sign in was cancelled."
         case .authSessionFailed(let message):
@@ -1,43 +1,7 @@
 import Foundation
 import Network
-
-// MARK: - Sensitive Data Redaction
-
-/// Redacts sensitive data from log messages to prevent credential leakage
-private func redactSensitiveData(_ message: String) -> String {
-    var result = message
-
-    // Redact LOGIN command passwords: LOGIN "user" "password" -> LOGIN "user" "[REDACTED]"
-    if let loginRange = result.range(of: #"LOGIN\s+"[^"]*"\s+"[^"]*""#, options: .regularExpression) {
-        // Find the second quoted string (password) and redact it
-        let loginPart = String(result[loginRange])
-        if let passwordMatch = loginPart.range(of: #""\s+"[^"]*"$"#, options: .regularExpression) {
-            let redacted = loginPart.replacingCharacters(in: passwordMatch, with: "\" \"[REDACTED]\"")
-            result = result.replacingCharacters(in: loginRange, with: redacted)
-        }
-    }
-
-    // Redact AUTHENTICATE XOAUTH2 tokens: AUTHENTICATE XOAUTH2 <token> -> AUTHENTICATE XOAUTH2 [REDACTED]
-    if let authRange = result.range(of: #"AUTHENTICATE\s+XOAUTH2\s+\S+"#, options: .regularExpression) {
-        result = result.replacingCharacters(in: authRange, with: "AUTHENTICATE XOAUTH2 [REDACTED]")
-    }
-
-    // Redact any base64-encoded OAuth tokens (they start with eyJ for JWT)
-    result = result.replacingOccurrences(
-        of: #"eyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+"#,
-        with: "[REDACTED_TOKEN]",
-        options: .regularExpression
-    )
-
-    // Redact any standalone base64 strings that look like tokens (40+ chars of base64)
-    result = result.replacingOccurrences(
-        of: #"(?<![A-Za-z0-9])[A-Za-z0-9+/=]{40,}(?![A-Za-z0-9])"#,
-        with: "[REDACTED_TOKEN]",
-        options: .regularExpression
-    )
-
-    return result
-}
+import Security
+import CryptoKit
 
 // Simple trace logging to file and stderr with sensitive data redaction
 private func trace(_ msg: String) {
@@ -73,12 +37,23 @@ actor IMAPService {
     private var responseBuffer = ""
     private var tagCounter = 0
     private var currentFolder: String?
+    /// Whether `currentFolder` was opened with `examineFolder`, so a reconnect opens it the same way
+    private var currentFolderReadOnly = false
+    private var serverCapabilities: Set<String>?
     private var reconnectAttempts = 0
     private let maxReconnectAttempts = 3
 
     private let account: EmailAccount
     private var throttleTracker: ThrottleTracker?
     private var rateLimitSettings: RateLimitSettings
+    /// Server a login REFERRAL sent us to, used instead of the account's server
+    private var referredServer: (host: String, port: Int)?
+    /// Password passed to `login(password:)`, so a reconnect logs in the same way
+    private var loginPassword: String?
+    /// Software announced in the server greeting
+    private var greetingInfo: IMAPServerInfo?
+    /// FETCH item list the server accepted in place of the richest one it refused
+    private var fetchItemDowngrades: [String: String] = [:]
 
     init(account: EmailAccount) {
         self.account = account
@@ -86,7 +61,8 @@ actor IMAPService {
     }
 
     /// Configure rate limiting for this service with a shared tracker
-    /// The tracker should be shared between accounts on the same server
+    /// The tracker should be shared between accounts on the same server; services with
+    /// their own tracker are paced independently
     func configureRateLimit(settings: RateLimitSettings, sharedTracker: ThrottleTracker? = nil) {
         self.rateLimitSettings = settings
         if let tracker = sharedTracker {
@@ -100,6 +76,10 @@ actor IMAPService {
     /// This allows settings changes to take effect immediately without restarting the backup
     func updateRateLimitSettings(_ settings: RateLimitSettings) async {
         self.rateLimitSettings = settings
+        // New settings do not lift the limit of the provider already recognized
+        if let maxConnections = greetingInfo?.quirks.maxConnections {
+            rateLimitSettings.maxConcurrentRequests = min(rateLimitSettings.maxConcurrentRequests, maxConnections)
+        }
         await self.throttleTracker?.updateSettings(settings)
     }
 
@@ -155,12 +135,10 @@ actor IMAPService {
 
         // Reconnect
         try await connect()
-        try await login()
+        try await login(password: loginPassword)
 
         // Re-select folder if we had one selected
-        if let folder = currentFolder {
-            _ = try await selectFolder(folder)
-        }
+        try await reopenCurrentFolder()
 
         logInfo("Reconnection successful")
         reconnectAttempts = 0  // Reset on success
@@ -172,7 +150,7 @@ actor IMAPService {
             return try await operation()
         } catch {
             // Check if this is a connection error that we can recover from
-            if isRecoverableError(error) {
+            if Self.isRecoverableError(error) {
                 logWarning("Connection error detected: \(error.localizedDescription). Attempting recovery...")
                 try await attemptReconnect()
                 // Retry the operation once after reconnecting
@@ -182,11 +160,82 @@ actor IMAPService {
         }
     }
 
+    /// Run `operation` up to `attempts` times, waiting 1s, 2s, 4s... in between like message downloads do.
+    /// Only connections lost mid-command are retried, and `beforeRetry` runs before each new attempt
+    /// so it starts on a clean connection; a failing `beforeRetry` counts as a failed attempt.
+    nonisolated static func withRetry<T>(
+        _ description: String,
+        attempts: Int = Constants.maxRetryAttempts,
+        baseDelay: UInt64 = Constants.nanosecondsPerSecond,
+        operation: () async throws -> T,
+        beforeRetry: () async throws -> Void
+    ) async throws -> T {
+        var attempt = 1
+        while true {
+            do {
+                if attempt > 1 {
+                    try await beforeRetry()
+                }
+                return try await operation()
+            } catch {
+                guard attempt < attempts, isTransientError(error) else { throw error }
+                logWarning("\(description) failed (attempt \(attempt)/\(attempts)): \(error.localizedDescription), retrying")
+                try await Task.sleep(nanoseconds: baseDelay << UInt64(attempt - 1))
+                attempt += 1
+            }
+        }
+    }
+
+    /// Replace the connection before retrying a command that failed halfway. Whatever the server still
+    /// had to send for it is dropped with the old connection instead of being read as the next answer.
+    private func reconnectForRetry() async throws {
+        await disconnect()
+        try await connect()
+        try await login(password: loginPassword)
+        try await reopenCurrentFolder()
+    }
+
+    /// Open the folder selected before a reconnect, read-only if it was
+    private func reopenCurrentFolder() async throws {
+        guard let folder = currentFolder else { return }
+        if currentFolderReadOnly {
+            _ = try await examineFolder(folder)
+        } else {
+            _ = try await selectFolder(folder)
+        }
+    }
+
+    /// A connection that failed during a command. Unlike `isRecoverableError` this leaves out
+    /// `.notConnected`, which means there was no session to begin with.
+    nonisolated static func isTransientError(_ error: Error) -> Bool {
+        if case IMAPError.notConnected = error {
+            return false
+        }
+        return isRecoverableError(error)
+    }
+
+    /// The connection was already gone: closed by the server, reset, or never open
+    nonisolated static func isClosedConnectionError(_ error: Error) -> Bool {
+        switch error as? IMAPError {
+        case .connectionClosed, .notConnected:
+            return true
+        default:
+            return false
+        }
+    }
+
+    /// Socket errors meaning the server closed or reset the connection
+    nonisolated static func isClosedByPeer(_ error: NWError) -> Bool {
+        guard case .posix(let code) = error else { return false }
+        let closedCodes: [POSIXErrorCode] = [.ECONNRESET, .EPIPE, .ENOTCONN, .ECONNABORTED, .ESHUTDOWN]
+        return closedCodes.contains(code)
+    }
+
     /// Determine if an error is recoverable via reconnection
-    private func isRecoverableError(_ error: Error) -> Bool {
+    nonisolated static func isRecoverableError(_ error: Error) -> Bool {
         if let imapError = error as? IMAPError {
             switch imapError {
-            case .notConnected, .connectionFailed, .sendFailed, .receiveFailed:
+            case .notConnected, .connectionFailed, .connectionClosed, .sendFailed, .receiveFailed:
                 return true
             default:
                 return false
@@ -205,19 +254,27 @@ actor IMAPService {
     func connect() async throws {
         trace("[DEBUG] connect() START for \(account.email)")
         trace("connect() START for \(account.email)")
-        let host = NWEndpoint.Host(account.imapServer)
-        let port = NWEndpoint.Port(integerLiteral: UInt16(account.port))
-
-        let tlsOptions = NWProtocolTLS.Options()
-        let tcpOptions = NWProtocolTCP.Options()
-        let params = NWParameters(tls: account.useSSL ? tlsOptions : nil, tcp: tcpOptions)
+        let serverHost = referredServer?.host ?? account.imapServer
+        let serverPort = referredServer?.port ?? account.port
+        let host = NWEndpoint.Host(serverHost)
+        let port = NWEndpoint.Port(integerLiteral: UInt16(serverPort))
+
+        let serverName = Self.tlsServerName(for: account, referred: referredServer != nil)
+        let trustRecorder = TLSTrustRecorder()
+        let params = Self.connectionParameters(
+            useTLS: account.useSSL,
+            addressFamily: account.addressFamily,
+            tlsServerName: serverName,
+            trustRecorder: trustRecorder
+        )
 
         connection = NWConnection(host: host, port: port, using: params)
 
         class ContinuationState { var hasResumed = false }
         let state = ContinuationState()
 
-        logInfo("Connecting to \(account.imapServer):\(account.port)...")
+        let family = account.addressFamily == .automatic ? "" : " (\(account.addressFamily.displayName))"
+        logInfo("Connecting to \(serverHost):\(serverPort)\(family)...")
 
         return try await withCheckedThrowingContinuation { continuation in
             connection?.stateUpdateHandler = { [weak self] connectionState in
@@ -236,7 +293,24 @@ actor IMAPService {
                 case .failed(let error):
                     trace("connect() FAILED: \(error)")
                     state.hasResumed = true
-                    continuation.resume(throwing: IMAPError.connectionFailed(error.localizedDescription))
+                    continuation.resume(throwing: Self.connectionError(
+                        error,
+                        host: serverName ?? serverHost,
+                        trustFailure: trustRecorder.failure
+                    ))
+                case .waiting(let error):
+                    // A refused certificate is refused again on every retry
+                    guard case .tls = error else { break }
+                    trace("connect() TLS FAILED: \(error)")
+                    state.hasResumed = true
+                    continuation.resume(throwing: Self.connectionError(
+                        error,
+                        host: serverName ?? serverHost,
+                        trustFailure: trustRecorder.failure
+                    ))
+                    Task { [weak self] in
+                        await self?.disconnect()
+                    }
                 case .cancelled:
                     trace("connect() CANCELLED")
                     state.hasResumed = true
@@ -249,6 +323,66 @@ actor IMAPService {
         }
     }
 
+    /// TCP (and TLS) parameters for a connection, limited to one IP version unless automatic.
+    /// The limit applies to name resolution too, so a host is only reached on matching addresses.
+    /// `tlsServerName` replaces the connect host as SNI and as the name the certificate must match.
+    /// `trustRecorder` learns why a certificate is refused; the system still decides whether it is.
+    nonisolated static func connectionParameters(
+        useTLS: Bool,
+        addressFamily: AddressFamily,
+        tlsServerName: String? = nil,
+        trustRecorder: TLSTrustRecorder? = nil
+    ) -> NWParameters {
+        var tlsOptions: NWProtocolTLS.Options?
+        if useTLS {
+            let options = NWProtocolTLS.Options()
+            if let serverName = tlsServerName {
+                sec_protocol_options_set_tls_server_name(options.securityProtocolOptions, serverName)
+            }
+            if let recorder = trustRecorder {
+                sec_protocol_options_set_verify_block(options.securityProtocolOptions, { _, trust, complete in
+                    var error: CFError?
+                    if SecTrustEvaluateWithError(sec_trust_copy_ref(trust).takeRetainedValue(), &error) {
+                        complete(true)
+                    } else {
+                        recorder.record(error)
+                        complete(false)
+                    }
+                }, .global(qos: .userInitiated))
+            }
+            tlsOptions = options
+        }
+
+        let params = NWParameters(tls: tlsOptions, tcp: NWProtocolTCP.Options())
+        if let ipOptions = params.defaultProtocolStack.internetProtocol as? NWProtocolIP.Options {
+            ipOptions.version = addressFamily.ipVersion
+        }
+        return params
+    }
+
+    /// Error for a connection that could not be set up. TLS failures name what is wrong with
+    /// the certificate of `host`, preferring the reason the trust evaluation recorded.
+    nonisolated static func connectionError(
+        _ error: NWError,
+        host: String,
+        trustFailure: (reason: TLSFailure.Reason, detail: String?)?
+    ) -> IMAPError {
+        if let trustFailure = trustFailure {
+            return .tlsFailed(TLSFailure(reason: trustFailure.reason, host: host, detail: trustFailure.detail))
+        }
+        if case .tls(let status) = error {
+            return .tlsFailed(TLSFailure(reason: TLSFailure.reason(forStatus: status), host: host, detail: error.localizedDescription))
+        }
+        return .connectionFailed(error.localizedDescription)
+    }
+
+    /// TLS name override to use, nil to verify against the connect host. A referred server
+    /// is a different host, so the account's override does not apply to it.
+    nonisolated static func tlsServerName(for account: EmailAccount, referred: Bool) -> String? {
+        guard account.useSSL, !referred else { return nil }
+        return account.tlsServerName.flatMap { EmailAccount.normalizedTLSServerName($0) }
+    }
+
     private func setConnected(_ value: Bool) {
         isConnected = value
     }
@@ -257,28 +391,80 @@ actor IMAPService {
         connection?.cancel()
         connection = nil
         isConnected = false
+        serverCapabilities = nil
+        fetchItemDowngrades = [:]
     }
 
     // MARK: - IMAP Commands
 
     func login(password: String? = nil) async throws {
         trace("login() START")
+        if let password = password {
+            loginPassword = password
+        }
         // Read server greeting
         trace("login() reading greeting")
-        _ = try await readResponse()
+        let greeting = try await readResponse()
         trace("login() got greeting")
 
+        // Greeting may carry pre-auth capabilities, saving a round trip
+        let greetingCaps = parseCapabilities(greeting)
+        if !greetingCaps.isEmpty {
+            serverCapabilities = greetingCaps
+        }
+        applyQuirks(of: IMAPServerInfo.parse(greeting: greeting))
+
         // Check authentication type
         trace("[DEBUG] login() authType=\(account.authType)")
-        if account.authType == .oauth2 {
-            trace("[DEBUG] login() calling loginWithOAuth2()")
-            try await loginWithOAuth2()
-        } else {
-            try await loginWithPassword(password: password)
+        do {
+            if account.authType == .oauth2 {
+                trace("[DEBUG] login() calling loginWithOAuth2()")
+                try await loginWithOAuth2()
+            } else {
+                try await loginWithPassword(password: password)
+            }
+        } catch IMAPError.referral(let url) {
+            // Follow at most one referral, and only within the account's own domain
+            guard account.followReferrals, referredServer == nil,
+                  let referral = IMAPReferral(url: url),
+                  Self.isReferralAllowed(to: referral.host, for: account) else {
+                throw IMAPError.referral(url)
+            }
+
+            logWarning("Server referred login to \(referral.host), reconnecting")
+            await disconnect()
+            referredServer = (referral.host, referral.port ?? account.port)
+            try await connect()
+            try await login(password: password)
+            return
+        }
+
+        // Capabilities may change once authenticated
+        serverCapabilities = nil
+
+        if account.sendClientID {
+            await identifyIfSupported()
         }
         trace("login() DONE")
     }
 
+    /// Server software recognized from the last greeting, nil before the first login
+    func serverInfo() -> IMAPServerInfo? {
+        greetingInfo
+    }
+
+    /// Remember the server software and keep settings within the provider's known limits
+    private func applyQuirks(of info: IMAPServerInfo) {
+        greetingInfo = info
+        logDebug("Server: \(info.description) (\(info.greeting))")
+
+        if let maxConnections = info.quirks.maxConnections,
+           rateLimitSettings.maxConcurrentRequests > maxConnections {
+            logInfo("\(info.description) allows at most \(maxConnections) connections, lowering the limit from \(rateLimitSettings.maxConcurrentRequests)")
+            rateLimitSettings.maxConcurrentRequests = maxConnections
+        }
+    }
+
     /// Login with traditional password authentication
     private func loginWithPassword(password: String? = nil) async throws {
         trace("loginWithPassword() START")
@@ -297,25 +483,84 @@ actor IMAPService {
             throw IMAPError.authenticationFailed
         }
 
-        // Escape special characters in credentials
-        let escapedUsername = username
-            .replacingOccurrences(of: "\\", with: "\\\\")
-            .replacingOccurrences(of: "\"", with: "\\\"")
-        let escapedPassword = pwd
-            .replacingOccurrences(of: "\\", with: "\\\\")
-            .replacingOccurrences(of: "\"", with: "\\\"")
+        // Pick SASL mechanisms from capabilities; refuses plaintext LOGIN when LOGINDISABLED
+        let mechanisms = try Self.passwordMechanisms(for: try await capabilities())
 
-        // Send LOGIN command
-        let response = try await sendCommand("LOGIN \"\(escapedUsername)\" \"\(escapedPassword)\"")
+        for (index, mechanism) in mechanisms.enumerated() {
+            let response: String
+            switch mechanism {
+            case .plain:
+                response = try await sendCommand("AUTHENTICATE PLAIN") { _ in
+                    Self.plainResponse(username: username, password: pwd)
+                }
+            case .cramMD5:
+                response = try await sendCommand("AUTHENTICATE CRAM-MD5") { challenge in
+                    Self.cramMD5Response(username: username, password: pwd, challenge: challenge)
+                }
+            case .login:
+                // Escape special characters in credentials
+                let escapedUsername = username
+                    .replacingOccurrences(of: "\\", with: "\\\\")
+                    .replacingOccurrences(of: "\"", with: "\\\"")
+                let escapedPassword = pwd
+                    .replacingOccurrences(of: "\\", with: "\\\\")
+                    .replacingOccurrences(of: "\"", with: "\\\"")
+                response = try await sendCommand("LOGIN \"\(escapedUsername)\" \"\(escapedPassword)\"")
+            }
 
-        // Check for success (OK) or failure (NO/BAD)
-        if response.contains(" NO ") || response.contains(" BAD ") {
+            if commandSucceeded(response) {
+                logInfo("Authenticated with \(mechanism.rawValue)")
+                return
+            }
+
+            if let referral = IMAPReferral(response: response) {
+                throw IMAPError.referral(referral.url)
+            }
+
+            // BAD means the mechanism itself was rejected, NO means wrong credentials
+            if Self.taggedStatus(response) == "BAD" && index < mechanisms.count - 1 {
+                logWarning("\(mechanism.rawValue) rejected by server, trying \(mechanisms[index + 1].rawValue)")
+                continue
+            }
             throw IMAPError.authenticationFailed
         }
+        throw IMAPError.authenticationFailed
+    }
+
+    /// Password mechanisms to try, in order: AUTH=PLAIN, AUTH=CRAM-MD5, then LOGIN
+    /// Servers advertise LOGINDISABLED until the connection is encrypted (RFC 3501 6.2.3);
+    /// PLAIN and LOGIN would then expose the password, only CRAM-MD5 remains usable.
+    nonisolated static func passwordMechanisms(for capabilities: Set<String>) throws -> [PasswordAuthMechanism] {
+        let loginDisabled = capabilities.contains("LOGINDISABLED")
+        var mechanisms: [PasswordAuthMechanism] = []
+
+        if capabilities.contains("AUTH=PLAIN") && !loginDisabled {
+            mechanisms.append(.plain)
+        }
+        if capabilities.contains("AUTH=CRAM-MD5") {
+            mechanisms.append(.cramMD5)
+        }
+        if !loginDisabled {
+            mechanisms.append(.login)
+        }
 
-        guard response.contains("OK") else {
-            throw IMAPError.authenticationFailed
+        guard !mechanisms.isEmpty else {
+            throw IMAPError.loginDisabled
         }
+        return mechanisms
+    }
+
+    /// SASL PLAIN (RFC 4616): base64 of "\0username\0password"
+    nonisolated static func plainResponse(username: String, password: String) -> String {
+        Data("\0\(username)\0\(password)".utf8).base64EncodedString()
+    }
+
+    /// SASL CRAM-MD5 (RFC 2195): base64 of "username hex(HMAC-MD5(password, challenge))"
+    nonisolated static func cramMD5Response(username: String, password: String, challenge: String) -> String {
+        let decoded = Data(base64Encoded: challenge.trimmingCharacters(in: .whitespaces)) ?? Data()
+        let mac = HMAC<Insecure.MD5>.authenticationCode(for: decoded, using: SymmetricKey(data: Data(password.utf8)))
+        let digest = mac.map { String(format: "%02x", $0) }.joined()
+        return Data("\(username) \(digest)".utf8).base64EncodedString()
     }
 
     /// Login with OAuth2 XOAUTH2 SASL mechanism
@@ -358,6 +603,10 @@ actor IMAPService {
 
         // Check for success (OK) or failure (NO/BAD)
         if response.contains(" NO ") || response.contains(" BAD ") {
+            if let referral = IMAPReferral(response: response) {
+                throw IMAPError.referral(referral.url)
+            }
+
             // Try to parse error for better debugging
             if response.contains("Invalid credentials") || response.contains("AUTHENTICATIONFAILED") {
                 logError("OAuth2 authentication failed - token may be invalid or revoked")
@@ -372,30 +621,316 @@ actor IMAPService {
         logInfo("Successfully authenticated with OAuth2")
     }
 
+    /// End the session and close the connection. A server that already dropped the connection,
+    /// after a long idle or right after its BYE, has ended the session as asked, so that is not
+    /// an error; only a refused LOGOUT or a genuine failure is thrown.
     func logout() async throws {
-        _ = try await sendCommand("LOGOUT")
+        do {
+            _ = try await sendCommand("LOGOUT")
+        } catch let error where Self.isClosedConnectionError(error) {
+            logDebug("Connection to \(account.imapServer) was already closed at LOGOUT: \(error.localizedDescription)")
+        } catch {
+            await disconnect()
+            throw error
+        }
         await disconnect()
     }
 
+    /// List the user's folders, retrying on a fresh connection when the connection fails,
+    /// so one dropped LIST does not skip the whole account
     func listFolders() async throws -> [IMAPFolder] {
-        let response = try await sendCommand("LIST \"\" \"*\"")
-        return parseListResponse(response)
+        try await Self.withRetry("LIST") {
+            try await self.listPersonalFolders()
+        } beforeRetry: {
+            try await self.reconnectForRetry()
+        }
+    }
+
+    private func listPersonalFolders() async throws -> [IMAPFolder] {
+        // The personal namespace tells us where the user's folders live and how they are separated
+        let personal = try await namespaces()?.personal.first
+        let prefix = personal?.prefix ?? ""
+        let escapedPrefix = prefix.imapQuotedMailbox
+
+        let response = try await sendCommand("LIST \"\" \"\(escapedPrefix)*\"")
+        var folders = Self.parseListResponse(response, defaultDelimiter: personal?.delimiter)
+
+        // INBOX is outside a prefix like "INBOX." but must always be backed up
+        if !prefix.isEmpty && !folders.contains(where: { $0.name.uppercased() == "INBOX" }) {
+            let inboxResponse = try await sendCommand("LIST \"\" \"INBOX\"")
+            folders.insert(contentsOf: Self.parseListResponse(inboxResponse, defaultDelimiter: personal?.delimiter), at: 0)
+        }
+        return folders
+    }
+
+    /// Folders in other users' and shared namespaces, stored locally under shared/<owner>/
+    func listSharedFolders() async throws -> [IMAPFolder] {
+        try await Self.withRetry("LIST of shared folders") {
+            try await self.listSharedNamespaceFolders()
+        } beforeRetry: {
+            try await self.reconnectForRetry()
+        }
+    }
+
+    private func listSharedNamespaceFolders() async throws -> [IMAPFolder] {
+        guard let namespaces = try await namespaces() else {
+            return []
+        }
+
+        // A shared namespace with the same prefix as the personal one would list our own folders again
+        let personalPrefixes = Set(namespaces.personal.map { $0.prefix })
+        var folders: [IMAPFolder] = []
+
+        for (namespace, isOtherUsers) in namespaces.otherUsers.map({ ($0, true) }) + namespaces.shared.map({ ($0, false) })
+        where !personalPrefixes.contains(namespace.prefix) {
+            let escapedPrefix = namespace.prefix.imapQuotedMailbox
+            let response = try await sendCommand("LIST \"\" \"\(escapedPrefix)*\"")
+            folders += Self.sharedFolders(in: response, namespace: namespace, isOtherUsers: isOtherUsers)
+        }
+        return folders
+    }
+
+    /// Parse a LIST response for one shared namespace, giving each folder its shared/<owner>/ path
+    nonisolated static func sharedFolders(in response: String, namespace: IMAPNamespace, isOtherUsers: Bool) -> [IMAPFolder] {
+        parseListResponse(response, defaultDelimiter: namespace.delimiter)
+            .filter { $0.name.hasPrefix(namespace.prefix) }
+            .map { folder in
+                IMAPFolder(
+                    name: folder.name,
+                    delimiter: folder.delimiter,
+                    flags: folder.flags,
+                    path: sharedLocalPath(for: folder.name, in: namespace, isOtherUsers: isOtherUsers),
+                    namespacePrefix: namespace.prefix
+                )
+            }
+    }
+
+    /// Local path for a shared folder: shared/<owner>/<rest>.
+    /// The owner is the user for other-users namespaces (their root folder is their INBOX),
+    /// and the namespace name, or the first level below an empty prefix, for public ones.
+    nonisolated static func sharedLocalPath(for name: String, in namespace: IMAPNamespace, isOtherUsers: Bool) -> String {
+        let relative = String(name.dropFirst(namespace.prefix.count))
+        var components = namespace.delimiter.isEmpty
+            ? [relative]
+            : relative.components(separatedBy: namespace.delimiter).filter { !$0.isEmpty }
+
+        let owner: String
+        let namespaceName = namespace.delimiter.isEmpty
+            ? namespace.prefix
+            : namespace.prefix.trimmingCharacters(in: CharacterSet(charactersIn: namespace.delimiter))
+        if isOtherUsers || namespaceName.isEmpty {
+            owner = components.isEmpty ? "unknown" : components.removeFirst()
+            if isOtherUsers && components.isEmpty {
+                components = ["INBOX"]
+            }
+        } else {
+            owner = namespaceName
+        }
+
+        return (["shared", owner] + components).joined(separator: "/")
+    }
+
+    /// Namespaces the server reports, or nil when it does not support NAMESPACE (RFC 2342)
+    func namespaces() async throws -> IMAPNamespaces? {
+        guard try await capabilities().contains("NAMESPACE") else {
+            return nil
+        }
+
+        let response = try await sendCommand("NAMESPACE")
+        guard commandSucceeded(response) else {
+            throw IMAPError.commandFailed("NAMESPACE")
+        }
+        return IMAPNamespaces.parse(response)
     }
 
     func selectFolder(_ folder: String) async throws -> FolderStatus {
+        let response = try await openFolder(folder, command: "SELECT")
+        currentFolderReadOnly = false
+        return parseFolderStatus(response)
+    }
+
+    /// Open a folder read-only, so nothing a backup does can change it. Some servers refuse
+    /// EXAMINE on certain mailboxes; those are selected read-write instead, where bodies are
+    /// still only fetched with peek items, so no message is marked read either way.
+    func examineFolder(_ folder: String) async throws -> FolderStatus {
+        let result = try await Self.examineWithFallback(folder) { command in
+            try await self.openFolder(folder, command: command)
+        }
+        currentFolderReadOnly = true
+        return parseFolderStatus(result.response)
+    }
+
+    /// EXAMINE `folder` through `open`, and SELECT it when the server answers NO or BAD.
+    /// Errors thrown by `open`, such as a referral, are not retried.
+    nonisolated static func examineWithFallback(
+        _ folder: String,
+        open: (String) async throws -> String
+    ) async throws -> (response: String, readOnly: Bool) {
+        let response = try await open("EXAMINE")
+        guard let status = taggedStatus(response), status == "NO" || status == "BAD" else {
+            return (response, true)
+        }
+        logWarning("Server answered \(status) to EXAMINE \(folder), selecting it read-write and fetching with BODY.PEEK[] only")
+        return (try await open("SELECT"), false)
+    }
+
+    /// Send SELECT or EXAMINE for `folder` and return the response
+    private func openFolder(_ folder: String, command: String) async throws -> String {
         // Encode folder name to IMAP modified UTF-7 for the server
-        let encodedFolder = folder.encodingIMAPUTF7()
-        let escapedFolder = encodedFolder.replacingOccurrences(of: "\"", with: "\\\"")
-        let response = try await sendCommand("SELECT \"\(escapedFolder)\"")
+        let escapedFolder = folder.imapQuotedMailbox
+        let response = try await sendCommand("\(command) \"\(escapedFolder)\"")
+
+        // The mailbox lives on another server; we cannot select it over this connection
+        if Self.taggedStatus(response) == "NO", let referral = IMAPReferral(response: response) {
+            throw IMAPError.referral(referral.url)
+        }
+
         currentFolder = folder  // Track for reconnection (store decoded name)
-        return parseFolderStatus(response)
+        return response
     }
 
     func fetchEmailHeaders(uids: ClosedRange<UInt32>) async throws -> [EmailHeader] {
+        let response = try await fetch(uidSet: "\(uids.lowerBound):\(uids.upperBound)", itemLists: Self.headerFetchItems)
+        return parseEmailHeaders(response)
+    }
+
+    // MARK: - FETCH Item Downgrade
+
+    /// Item lists for header fetches, richest first
+    nonisolated static let headerFetchItems = [
+        "(UID FLAGS BODY.PEEK[HEADER.FIELDS (FROM SUBJECT DATE MESSAGE-ID)] BODYSTRUCTURE)",
+        "(UID FLAGS BODY.PEEK[HEADER.FIELDS (FROM SUBJECT DATE MESSAGE-ID)])",
+        "(UID FLAGS BODY.PEEK[HEADER])"
+    ]
+
+    /// Item lists for envelope fetches, richest first
+    nonisolated static let envelopeFetchItems = [
+        "(UID FLAGS ENVELOPE BODYSTRUCTURE)",
+        "(UID FLAGS ENVELOPE)"
+    ]
+
+    /// Items of the first phase of a two-phase fetch; no BODYSTRUCTURE, so there is nothing to downgrade
+    nonisolated static let twoPhaseEnvelopeItems = "(UID FLAGS RFC822.SIZE ENVELOPE)"
+
+    /// UID FETCH with the first item list the server accepts. Once a server has refused
+    /// a list, later fetches on this connection start with the list it accepted instead.
+    private func fetch(uidSet: String, itemLists: [String]) async throws -> String {
+        guard let primary = itemLists.first else {
+            throw IMAPError.fetchFailed("UID \(uidSet): no FETCH items")
+        }
+
+        let remaining = Array(itemLists.drop(while: { $0 != fetchItemDowngrades[primary] ?? primary }))
+        let result = try await Self.firstAcceptedFetch(uidSet: uidSet, itemLists: remaining) { command in
+            let response = try await self.sendCommand(command)
+            try await self.checkBandwidthCap(response)
+            return response
+        }
+        if result.items != primary {
+            fetchItemDowngrades[primary] = result.items
+        }
+        return result.response
+    }
+
+    /// Send UID FETCH with each item list in turn until the server answers OK.
+    /// A BAD or NO moves on to the next list and is logged; errors thrown by `send` are not retried.
+    nonisolated static func firstAcceptedFetch(
+        uidSet: String,
+        itemLists: [String],
+        send: (String) async throws -> String
+    ) async throws -> (items: String, response: String) {
+        var lastStatus = "no response"
+        for (index, items) in itemLists.enumerated() {
+            let response = try await send("UID FETCH \(uidSet) \(items)")
+            let status = taggedStatus(response) ?? "no response"
+            if status == "OK" {
+                return (items, response)
+            }
+
+            lastStatus = status
+            if index + 1 < itemLists.count {
+                logWarning("Server answered \(status) to FETCH \(items) for UID \(uidSet), downgrading to \(itemLists[index + 1])")
+            }
+        }
+        throw IMAPError.fetchFailed("UID \(uidSet): server answered \(lastStatus) to every FETCH item list")
+    }
+
+    /// Message-ID of each message in a UID range, without angle brackets.
+    /// Messages that have no Message-ID header are left out.
+    func fetchMessageIDs(uids: ClosedRange<UInt32>) async throws -> [UInt32: String] {
+        await applyRateLimit()
         let response = try await sendCommand(
-            "UID FETCH \(uids.lowerBound):\(uids.upperBound) (UID FLAGS BODY.PEEK[HEADER.FIELDS (FROM SUBJECT DATE MESSAGE-ID)] BODYSTRUCTURE)"
+            "UID FETCH \(uids.lowerBound):\(uids.upperBound) (UID BODY.PEEK[HEADER.FIELDS (MESSAGE-ID)])"
         )
-        return parseEmailHeaders(response)
+        guard commandSucceeded(response) else {
+            throw IMAPError.fetchFailed("Message-IDs for UIDs \(uids.lowerBound):\(uids.upperBound)")
+        }
+        await recordSuccess()
+        return Self.parseMessageIDs(response)
+    }
+
+    /// UID -> Message-ID from a FETCH response; the UID may come before or after the header literal
+    nonisolated static func parseMessageIDs(_ response: String) -> [UInt32: String] {
+        guard let uidRegex = try? NSRegularExpression(pattern: #"\bUID\s+(\d+)"#),
+              let idRegex = try? NSRegularExpression(pattern: #"^Message-ID:\s*(<[^>]*>|\S+)"#,
+                                                     options: [.caseInsensitive, .anchorsMatchLines]) else {
+            return [:]
+        }
+
+        let chunks = fetchChunks(response)
+
+        var messageIds: [UInt32: String] = [:]
+        var duplicates = 0
+        for chunk in chunks {
+            let range = NSRange(chunk.startIndex..., in: chunk)
+            guard let uidMatch = uidRegex.firstMatch(in: chunk, range: range),
+                  let uidRange = Range(uidMatch.range(at: 1), in: chunk),
+                  let uid = UInt32(chunk[uidRange]),
+                  let idMatch = idRegex.firstMatch(in: chunk, range: range),
+                  let idRange = Range(idMatch.range(at: 1), in: chunk),
+                  let messageId = EmailParser.normalizedMessageID(String(chunk[idRange])) else {
+                continue
+            }
+            // The first answer for a UID wins; a repeat must not silently replace it
+            guard messageIds[uid] == nil else {
+                duplicates += 1
+                continue
+            }
+            messageIds[uid] = messageId
+        }
+        if duplicates > 0 {
+            logWarning("Server returned \(duplicates) duplicate UIDs in one FETCH response, ignoring the repeats")
+        }
+        return messageIds
+    }
+
+    /// Each "* n FETCH" line of a response together with whatever follows it, such as literals
+    nonisolated static func fetchChunks(_ response: String) -> [String] {
+        var chunks: [String] = []
+        for line in response.components(separatedBy: "\r\n") {
+            if line.range(of: #"^\* \d+ FETCH"#, options: .regularExpression) != nil {
+                chunks.append(line)
+            } else if !chunks.isEmpty {
+                chunks[chunks.count - 1] += "\r\n" + line
+            }
+        }
+        return chunks
+    }
+
+    /// The FETCH response of a multi-UID command split up by UID. The first answer for a UID wins.
+    nonisolated static func fetchResponsesByUID(_ response: String) -> [UInt32: String] {
+        guard let uidRegex = try? NSRegularExpression(pattern: #"\bUID\s+(\d+)"#) else { return [:] }
+
+        var responses: [UInt32: String] = [:]
+        for chunk in fetchChunks(response) {
+            guard let match = uidRegex.firstMatch(in: chunk, range: NSRange(chunk.startIndex..., in: chunk)),
+                  let range = Range(match.range(at: 1), in: chunk),
+                  let uid = UInt32(chunk[range]),
+                  responses[uid] == nil else {
+                continue
+            }
+            responses[uid] = chunk
+        }
+        return responses
     }
 
     func fetchEmail(uid: UInt32) async throws -> Data {
@@ -403,23 +938,99 @@ actor IMAPService {
         await applyRateLimit()
 
         // Must use binary-safe fetch for emails with attachments
-        let result = try await fetchEmailWithLiteralParsing(uid: uid)
+        let result = try await Self.fetchFirstNonEmpty(uid: uid, items: bodyFetchItems) { item in
+            do {
+                return try await self.fetchEmailWithLiteralParsing(uid: uid, item: item.rawValue)
+            } catch IMAPError.fetchFailed(let message) {
+                await self.refuseBodyFetchItem(item)
+                throw IMAPError.fetchFailed(message)
+            }
+        }
 
         // Record success for adaptive rate limiting
         await recordSuccess()
         return result
     }
 
+    /// Body fetch items to try on this connection: the fallback order, starting at the item
+    /// the server accepted in place of one it refused
+    private var bodyFetchItems: [BodyFetchItem] {
+        let primary = BodyFetchItem.fallbackOrder[0]
+        let start = fetchItemDowngrades[primary.rawValue].flatMap(BodyFetchItem.init(rawValue:)) ?? primary
+        return Array(BodyFetchItem.fallbackOrder.drop(while: { $0 != start }))
+    }
+
+    /// Remember that the server answered BAD or NO to `item`, so later bodies on this
+    /// connection start with the next item instead of being refused once each
+    private func refuseBodyFetchItem(_ item: BodyFetchItem) {
+        let order = BodyFetchItem.fallbackOrder
+        guard let index = order.firstIndex(of: item), index + 1 < order.count else { return }
+        let primary = order[0].rawValue
+        if fetchItemDowngrades[primary] != order[index + 1].rawValue {
+            logWarning("Server refused FETCH \(item.rawValue), downgrading body fetches to \(order[index + 1].rawValue)")
+            fetchItemDowngrades[primary] = order[index + 1].rawValue
+        }
+    }
+
+    /// Try each fetch item in turn until one returns message data.
+    /// A refused fetch or an empty answer moves on to the next item; connection
+    /// and bandwidth errors are not something another item can fix and are rethrown.
+    nonisolated static func fetchFirstNonEmpty(
+        uid: UInt32,
+        items: [BodyFetchItem],
+        fetch: (BodyFetchItem) async throws -> Data
+    ) async throws -> Data {
+        var lastError: Error?
+        for item in items {
+            do {
+                let data = try await fetch(item)
+                if !data.isEmpty {
+                    return data
+                }
+                logWarning("UID \(uid): \(item.rawValue) returned no message data")
+            } catch IMAPError.fetchFailed(let message) {
+                logWarning("UID \(uid): \(item.rawValue) was refused: \(message)")
+                lastError = IMAPError.fetchFailed(message)
+            }
+        }
+        throw lastError ?? IMAPError.fetchFailed("UID \(uid): no message data returned")
+    }
+
+    /// Whether a download has the size the server reported in RFC822.SIZE.
+    /// Servers differ slightly in how they count line endings, so a small difference is allowed;
+    /// an unknown size (0) always matches.
+    nonisolated static func sizeMatches(reported: Int, actual: Int) -> Bool {
+        guard reported > 0 else { return true }
+        return abs(reported - actual) <= max(16, reported / 1000)
+    }
+
+    /// Fetch a message and compare it to its RFC822.SIZE, fetching once more on a mismatch.
+    /// `sizeMatches` is false when the second download is still off, e.g. truncated by the server.
+    nonisolated static func fetchVerifyingSize(
+        uid: UInt32,
+        reportedSize: Int,
+        fetch: () async throws -> Data
+    ) async throws -> (data: Data, sizeMatches: Bool) {
+        let data = try await fetch()
+        if sizeMatches(reported: reportedSize, actual: data.count) {
+            return (data, true)
+        }
+
+        logWarning("UID \(uid): downloaded \(data.count) bytes but the server reported \(reportedSize), fetching again")
+        let retry = try await fetch()
+        return (retry, sizeMatches(reported: reportedSize, actual: retry.count))
+    }
+
     /// Fetch email with proper IMAP literal parsing
-    private func fetchEmailWithLiteralParsing(uid: UInt32) async throws -> Data {
-        trace("fetchEmailWithLiteralParsing(\(uid)) START")
+    private func fetchEmailWithLiteralParsing(uid: UInt32, item: String) async throws -> Data {
+        trace("fetchEmailWithLiteralParsing(\(uid), \(item)) START")
         guard let connection = connection else {
             throw IMAPError.notConnected
         }
 
         tagCounter += 1
         let tag = "A\(String(format: "%04d", tagCounter))"
-        let command = "\(tag) UID FETCH \(uid) BODY.PEEK[]\r\n"
+        let command = "\(tag) UID FETCH \(uid) \(item)\r\n"
 
         // Send command
         trace("fetchEmailWithLiteralParsing: sending command")
@@ -499,6 +1110,19 @@ actor IMAPService {
                 }
             }
 
+            // No literal: the server refused the fetch instead of sending the message
+            if literalSize == nil, let text = String(data: allData, encoding: .utf8),
+               text.contains("\(tag) NO") || text.contains("\(tag) BAD") || text.contains("* BYE") {
+                try checkBandwidthCap(text)
+                throw IMAPError.fetchFailed("UID \(uid): \(text.trimmingCharacters(in: .whitespacesAndNewlines))")
+            }
+
+            // Tagged OK without a literal: the server accepted the fetch but sent no body
+            if literalSize == nil, let text = String(data: allData, encoding: .utf8), text.contains("\(tag) OK") {
+                trace("fetchEmailWithLiteralParsing: OK without literal")
+                return Data()
+            }
+
             // If we know the literal size, check if we have all the data
             if let size = literalSize {
                 let availableBytes = allData.count - literalOffset
@@ -555,6 +1179,7 @@ actor IMAPService {
         await applyRateLimit()
 
         let response = try await sendCommand("UID FETCH \(uid) RFC822.SIZE")
+        try checkBandwidthCap(response)
         let size = extractEmailSize(from: response)
 
         // Record success for adaptive rate limiting
@@ -562,110 +1187,246 @@ actor IMAPService {
         return size
     }
 
-    /// Stream email directly to file for large messages
-    func streamEmailToFile(uid: UInt32, destinationURL: URL) async throws -> Int64 {
-        // Apply rate limiting before request
+    /// The MIME structure of an email, nil when the server sends none that can be parsed
+    func fetchBodyStructure(uid: UInt32) async throws -> BodyStructure? {
         await applyRateLimit()
 
-        let result = try await performStreamingFetch(uid: uid, destinationURL: destinationURL)
+        let response = try await fetch(uidSet: String(uid), itemLists: ["(UID BODYSTRUCTURE)"])
 
-        // Record success for adaptive rate limiting
         await recordSuccess()
-        return result
+        return BodyStructure(response: response)
     }
 
-    /// Perform streaming fetch directly to disk
-    private func performStreamingFetch(uid: UInt32, destinationURL: URL) async throws -> Int64 {
-        guard let connection = connection else {
-            throw IMAPError.notConnected
-        }
+    /// One section of an email, e.g. "HEADER", "2.MIME" or "2", fetched with BODY.PEEK so \Seen is not set
+    func fetchBodySection(uid: UInt32, section: String) async throws -> Data {
+        await applyRateLimit()
 
-        tagCounter += 1
-        let tag = "A\(String(format: "%04d", tagCounter))"
-        let command = "\(tag) UID FETCH \(uid) BODY.PEEK[]\r\n"
+        let data = try await fetchEmailWithLiteralParsing(uid: uid, item: "BODY.PEEK[\(section)]")
 
-        // Create temp file for streaming
-        let tempURL = destinationURL.appendingPathExtension("streaming")
-        FileManager.default.createFile(atPath: tempURL.path, contents: nil)
-        let fileHandle = try FileHandle(forWritingTo: tempURL)
+        await recordSuccess()
+        return data
+    }
 
-        defer {
-            try? fileHandle.close()
-        }
+    /// Fetch the date the server received an email
+    func fetchInternalDate(uid: UInt32) async throws -> Date? {
+        await applyRateLimit()
 
-        // Send command
-        try await withCheckedThrowingContinuation { (continuation: CheckedContinuation<Void, Error>) in
-            connection.send(
-                content: command.data(using: .utf8),
-                completion: .contentProcessed { error in
-                    if let error = error {
-                        continuation.resume(throwing: IMAPError.sendFailed(error.localizedDescription))
-                    } else {
-                        continuation.resume()
-                    }
-                }
-            )
-        }
+        let response = try await sendCommand("UID FETCH \(uid) INTERNALDATE")
+        try checkBandwidthCap(response)
 
-        // Read response and stream to file
-        var totalBytesWritten: Int64 = 0
-        var headerBuffer = ""
-        var foundLiteralSize = false
-        var literalSize: Int = 0
-        var literalBytesReceived: Int = 0
-        var isComplete = false
+        await recordSuccess()
+        return Self.parseInternalDate(response)
+    }
 
-        while !isComplete {
-            let chunk = try await readResponse()
+    /// Fetch the raw server-reported FLAGS, ENVELOPE and BODYSTRUCTURE of an email
+    func fetchEnvelope(uid: UInt32) async throws -> String {
+        await applyRateLimit()
+
+        let response = try await fetch(uidSet: String(uid), itemLists: Self.envelopeFetchItems)
+
+        await recordSuccess()
+        return response
+    }
+
+    /// Fetch UID, FLAGS, RFC822.SIZE and ENVELOPE of several emails in one command, the first phase of
+    /// `FetchStrategy.twoPhase`. Returns each email's part of the response by UID.
+    func fetchEnvelopes(uids: [UInt32]) async throws -> [UInt32: String] {
+        guard !uids.isEmpty else { return [:] }
+        await applyRateLimit()
+
+        let uidSet = uids.sorted().map(String.init).joined(separator: ",")
+        let response = try await fetch(uidSet: uidSet, itemLists: [Self.twoPhaseEnvelopeItems])
+
+        await recordSuccess()
+        return Self.fetchResponsesByUID(response)
+    }
+
+    /// Flags of every message in the selected folder. With CONDSTORE and a `modSeq` from an earlier
+    /// call, only messages whose flags changed since then are returned (CHANGEDSINCE, RFC 7162).
+    /// Servers without CONDSTORE always get a full FLAGS fetch.
+    func fetchFlags(changedSince modSeq: UInt64?) async throws -> FlagFetchResult {
+        let condStore = (try? await capabilities())?.contains("CONDSTORE") == true
+        await applyRateLimit()
+
+        var command = "UID FETCH 1:* (UID FLAGS\(condStore ? " MODSEQ" : ""))"
+        if condStore, let modSeq = modSeq {
+            command += " (CHANGEDSINCE \(modSeq))"
+        }
+        let response = try await sendCommand(command)
+        guard commandSucceeded(response) else {
+            throw IMAPError.fetchFailed("FLAGS of \(currentFolder ?? "the selected folder")")
+        }
+
+        await recordSuccess()
+        return Self.parseFlagFetch(response, isIncremental: condStore && modSeq != nil)
+    }
+
+    /// UID -> flags from a FETCH (UID FLAGS [MODSEQ]) response, with the highest MODSEQ seen
+    nonisolated static func parseFlagFetch(_ response: String, isIncremental: Bool) -> FlagFetchResult {
+        var flags: [UInt32: [String]] = [:]
+        var highestModSeq: UInt64?
+        for (uid, chunk) in fetchResponsesByUID(response) {
+            let attributes = EnvelopeParser.parseFetchAttributes(chunk)
+            if case .list(let items)? = attributes["FLAGS"] {
+                flags[uid] = items.compactMap { item -> String? in
+                    if case .string(let flag) = item { return flag }
+                    return nil
+                }
+            }
+            // MODSEQ (12345)
+            if case .list(let values)? = attributes["MODSEQ"], case .string(let text)? = values.first,
+               let modSeq = UInt64(text) {
+                highestModSeq = max(highestModSeq ?? 0, modSeq)
+            }
+        }
+        return FlagFetchResult(flags: flags, highestModSeq: highestModSeq, isIncremental: isIncremental)
+    }
+
+    /// Stream email directly to file for large messages
+    func streamEmailToFile(uid: UInt32, destinationURL: URL) async throws -> Int64 {
+        // Apply rate limiting before request
+        await applyRateLimit()
+
+        // BODY.PEEK[] first, RFC822.PEEK if the server refuses it or sends nothing; neither sets \Seen
+        var lastError: Error?
+        for item in bodyFetchItems {
+            let result: Int64
+            do {
+                result = try await performStreamingFetch(uid: uid, destinationURL: destinationURL, item: item)
+            } catch IMAPError.fetchFailed(let message) {
+                logWarning("UID \(uid): \(item.rawValue) was refused: \(message)")
+                refuseBodyFetchItem(item)
+                lastError = IMAPError.fetchFailed(message)
+                continue
+            }
+            if result > 0 {
+                // Record success for adaptive rate limiting
+                await recordSuccess()
+                return result
+            }
+            logWarning("UID \(uid): \(item.rawValue) returned no message data")
+        }
+
+        try? FileManager.default.removeItem(at: destinationURL)
+        throw lastError ?? IMAPError.fetchFailed("UID \(uid): no message data returned")
+    }
+
+    /// Perform streaming fetch directly to disk
+    private func performStreamingFetch(uid: UInt32, destinationURL: URL, item: BodyFetchItem) async throws -> Int64 {
+        guard let connection = connection else {
+            throw IMAPError.notConnected
+        }
 
-            if !foundLiteralSize {
-                // Still looking for the literal size in the header
-                headerBuffer += chunk
-
-                // Look for {size} pattern
-                if let braceStart = headerBuffer.range(of: "{"),
-                   let braceEnd = headerBuffer.range(of: "}", range: braceStart.upperBound..<headerBuffer.endIndex) {
-
-                    let sizeString = String(headerBuffer[braceStart.upperBound..<braceEnd.lowerBound])
-                    if let size = Int(sizeString) {
-                        literalSize = size
-                        foundLiteralSize = true
-                        logDebug("Streaming email UID \(uid): \(size) bytes")
-
-                        // Find where the actual data starts (after }\r\n)
-                        if let dataStart = headerBuffer.range(of: "}\r\n")?.upperBound {
-                            let remainingData = String(headerBuffer[dataStart...])
-                            if let data = remainingData.data(using: .utf8) ?? remainingData.data(using: .ascii) {
-                                let bytesToWrite = min(data.count, literalSize)
-                                if bytesToWrite > 0 {
-                                    try fileHandle.write(contentsOf: data.prefix(bytesToWrite))
-                                    literalBytesReceived += bytesToWrite
-                                    totalBytesWritten += Int64(bytesToWrite)
+        tagCounter += 1
+        let tag = "A\(String(format: "%04d", tagCounter))"
+        let command = "\(tag) UID FETCH \(uid) \(item.rawValue)\r\n"
+
+        // Create temp file for streaming
+        let tempURL = destinationURL.appendingPathExtension("streaming")
+        FileManager.default.createFile(atPath: tempURL.path, contents: nil)
+        let fileHandle = try FileHandle(forWritingTo: tempURL)
+        var moved = false
+
+        defer {
+            try? fileHandle.close()
+            // A failed or cancelled fetch leaves no partial file behind
+            if !moved {
+                try? FileManager.default.removeItem(at: tempURL)
+            }
+        }
+
+        // Send command
+        try await withCheckedThrowingContinuation { (continuation: CheckedContinuation<Void, Error>) in
+            connection.send(
+                content: command.data(using: .utf8),
+                completion: .contentProcessed { error in
+                    if let error = error {
+                        continuation.resume(throwing: IMAPError.sendFailed(error.localizedDescription))
+                    } else {
+                        continuation.resume()
+                    }
+                }
+            )
+        }
+
+        // Read response and stream to file
+        var totalBytesWritten: Int64 = 0
+        var headerBuffer = ""
+        var foundLiteralSize = false
+        var literalSize: Int = 0
+        var literalBytesReceived: Int = 0
+        var isComplete = false
+        var completion = ""
+
+        do {
+            while !isComplete {
+                try Task.checkCancellation()
+                let chunk = try await readResponse()
+
+                if !foundLiteralSize {
+                    // Still looking for the literal size in the header
+                    headerBuffer += chunk
+
+                    // Look for {size} pattern
+                    if let braceStart = headerBuffer.range(of: "{"),
+                       let braceEnd = headerBuffer.range(of: "}", range: braceStart.upperBound..<headerBuffer.endIndex) {
+
+                        let sizeString = String(headerBuffer[braceStart.upperBound..<braceEnd.lowerBound])
+                        if let size = Int(sizeString) {
+                            literalSize = size
+                            foundLiteralSize = true
+                            logDebug("Streaming email UID \(uid): \(size) bytes")
+
+                            // Find where the actual data starts (after }\r\n)
+                            if let dataStart = headerBuffer.range(of: "}\r\n")?.upperBound {
+                                let remainingData = String(headerBuffer[dataStart...])
+                                if let data = remainingData.data(using: .utf8) ?? remainingData.data(using: .ascii) {
+                                    let bytesToWrite = min(data.count, literalSize)
+                                    if bytesToWrite > 0 {
+                                        try fileHandle.write(contentsOf: data.prefix(bytesToWrite))
+                                        literalBytesReceived += bytesToWrite
+                                        totalBytesWritten += Int64(bytesToWrite)
+                                    }
                                 }
                             }
                         }
                     }
-                }
-            } else {
-                // Streaming mode - write data directly to file
-                let bytesRemaining = literalSize - literalBytesReceived
-
-                if bytesRemaining > 0 {
-                    if let data = chunk.data(using: .utf8) ?? chunk.data(using: .ascii) {
-                        let bytesToWrite = min(data.count, bytesRemaining)
-                        if bytesToWrite > 0 {
-                            try fileHandle.write(contentsOf: data.prefix(bytesToWrite))
-                            literalBytesReceived += bytesToWrite
-                            totalBytesWritten += Int64(bytesToWrite)
+                } else {
+                    // Streaming mode - write data directly to file
+                    let bytesRemaining = literalSize - literalBytesReceived
+
+                    if bytesRemaining > 0 {
+                        if let data = chunk.data(using: .utf8) ?? chunk.data(using: .ascii) {
+                            let bytesToWrite = min(data.count, bytesRemaining)
+                            if bytesToWrite > 0 {
+                                try fileHandle.write(contentsOf: data.prefix(bytesToWrite))
+                                literalBytesReceived += bytesToWrite
+                                totalBytesWritten += Int64(bytesToWrite)
+                            }
                         }
                     }
                 }
-            }
 
-            // Check for completion
-            if chunk.contains("\(tag) OK") || chunk.contains("\(tag) NO") || chunk.contains("\(tag) BAD") {
-                isComplete = true
+                // Check for completion
+                if chunk.contains("\(tag) OK") || chunk.contains("\(tag) NO") || chunk.contains("\(tag) BAD") {
+                    isComplete = true
+                    completion = chunk
+                }
             }
+        } catch {
+            // The rest of this response is still on the wire and would be read as the answer
+            // to the next command, so the connection cannot be reused
+            logWarning("Streaming fetch of UID \(uid) interrupted, dropping the connection: \(error.localizedDescription)")
+            await disconnect()
+            throw error
+        }
+
+        // A daily cap refuses the fetch outright; trying another item or UID would be refused too
+        try checkBandwidthCap(foundLiteralSize ? completion : headerBuffer)
+
+        // Refused outright, as opposed to accepted without a body
+        if !foundLiteralSize, let status = Self.taggedStatus(headerBuffer), status != "OK" {
+            throw IMAPError.fetchFailed("UID \(uid): server answered \(status) to \(item.rawValue)")
         }
 
         // Close file handle
@@ -676,10 +1437,26 @@ actor IMAPService {
             try FileManager.default.removeItem(at: destinationURL)
         }
         try FileManager.default.moveItem(at: tempURL, to: destinationURL)
+        moved = true
 
         return totalBytesWritten
     }
 
+    /// Read INTERNALDATE from a FETCH response: * 1 FETCH (UID 5 INTERNALDATE " 7-Jul-2024 02:44:25 -0700")
+    nonisolated static func parseInternalDate(_ response: String) -> Date? {
+        let pattern = #"INTERNALDATE\s+"([^"]+)""#
+        guard let regex = try? NSRegularExpression(pattern: pattern, options: [.caseInsensitive]),
+              let match = regex.firstMatch(in: response, range: NSRange(response.startIndex..., in: response)),
+              let dateRange = Range(match.range(at: 1), in: response) else {
+            return nil
+        }
+
+        let formatter = DateFormatter()
+        formatter.locale = Locale(identifier: "en_US_POSIX")
+        formatter.dateFormat = "d-MMM-yyyy HH:mm:ss Z"
+        return formatter.date(from: response[dateRange].trimmingCharacters(in: .whitespaces))
+    }
+
     /// Extract email size from RFC822.SIZE response
     private func extractEmailSize(from response: String) -> Int {
         // Response format: * uid FETCH (RFC822.SIZE size)
@@ -697,16 +1474,369 @@ actor IMAPService {
         await applyRateLimit()
 
         let response = try await sendCommand("UID SEARCH ALL")
-        let uids = parseSearchResponse(response)
+        let uids = Self.parseSearchResponse(response)
 
         // Record success for adaptive rate limiting
         await recordSuccess()
         return uids
     }
 
+    /// UIDs of messages with an internal date on or after the day of `date`
+    func searchSince(_ date: Date) async throws -> [UInt32] {
+        await applyRateLimit()
+
+        let response = try await sendCommand("UID SEARCH SINCE \(Self.searchDate(date))")
+        guard commandSucceeded(response) else {
+            throw IMAPError.commandFailed("UID SEARCH SINCE")
+        }
+        let uids = Self.parseSearchResponse(response)
+
+        await recordSuccess()
+        return uids
+    }
+
+    /// UIDs of the selected folder's messages matching `criteria`; nothing is fetched
+    func search(_ criteria: IMAPSearchCriteria) async throws -> [UInt32] {
+        await applyRateLimit()
+
+        let response: String
+        if criteria.needsUTF8 {
+            response = try await sendCommand("UID SEARCH", arguments: criteria.arguments)
+        } else {
+            response = try await sendCommand("UID SEARCH \(criteria.searchKeys)")
+        }
+        guard commandSucceeded(response) else {
+            throw IMAPError.commandFailed("UID SEARCH \(criteria.searchKeys)")
+        }
+        let uids = Self.parseSearchResponse(response)
+
+        await recordSuccess()
+        return uids
+    }
+
+    /// Date in SEARCH syntax, e.g. 5-Jan-2026
+    nonisolated static func searchDate(_ date: Date) -> String {
+        let formatter = DateFormatter()
+        formatter.locale = Locale(identifier: "en_US_POSIX")
+        formatter.dateFormat = "d-MMM-yyyy"
+        return formatter.string(from: date)
+    }
+
+    // MARK: - Referrals
+
+    /// Whether a login referral may be followed: to the account's own server, or to a host within
+    /// the domain of its email address. Comparing the last labels of two hosts is not enough, as
+    /// they can be a public suffix anyone registers under (imap.foo.co.uk and evil.co.uk).
+    nonisolated static func isReferralAllowed(to host: String, for account: EmailAccount) -> Bool {
+        let host = host.lowercased().trimmingCharacters(in: CharacterSet(charactersIn: "."))
+        guard !host.isEmpty else { return false }
+        if host == account.imapServer.lowercased() {
+            return true
+        }
+
+        guard let at = account.email.lastIndex(of: "@") else { return false }
+        let domain = account.email[account.email.index(after: at)...].lowercased()
+        return !domain.isEmpty && (host == domain || host.hasSuffix(".\(domain)"))
+    }
+
+    // MARK: - Client Identification
+
+    /// Fields sent with the ID command (RFC 2971)
+    nonisolated static var clientIdentification: [String: String] {
+        [
+            "name": "MailKeep",
+            "version": Bundle.main.infoDictionary?["CFBundleShortVersionString"] as? String ?? "unknown",
+            "vendor": "kzahedi"
+        ]
+    }
+
+    /// Build an ID command: ID ("key" "value" ...) with keys sorted, or ID NIL
+    nonisolated static func idCommand(_ fields: [String: String]) -> String {
+        guard !fields.isEmpty else { return "ID NIL" }
+
+        func quoted(_ value: String) -> String {
+            "\"" + value.replacingOccurrences(of: "\\", with: "\\\\").replacingOccurrences(of: "\"", with: "\\\"") + "\""
+        }
+        let pairs = fields.keys.sorted().map { "\(quoted($0)) \(quoted(fields[$0]!))" }
+        return "ID (\(pairs.joined(separator: " ")))"
+    }
+
+    /// Parse an ID parameter list ("key" "value" ...) or NIL into fields
+    nonisolated static func parseIDParameters(_ text: String) -> [String: String] {
+        var index = 0
+        guard case .list(let items)? = EnvelopeParser.parseValue(Array(text.utf8), &index) else {
+            return [:]
+        }
+
+        var fields: [String: String] = [:]
+        var i = 0
+        while i + 1 < items.count {
+            if case .string(let key) = items[i], case .string(let value) = items[i + 1] {
+                fields[key] = value
+            }
+            i += 2
+        }
+        return fields
+    }
+
+    /// Parse the server's untagged * ID response
+    nonisolated static func parseIDResponse(_ response: String) -> [String: String] {
+        for line in response.components(separatedBy: "\r\n") where line.uppercased().hasPrefix("* ID ") {
+            return parseIDParameters(String(line.dropFirst(5)))
+        }
+        return [:]
+    }
+
+    /// Send the ID command and return the server's identification
+    func sendClientID(_ fields: [String: String]) async throws -> [String: String] {
+        let response = try await sendCommand(Self.idCommand(fields))
+        guard commandSucceeded(response) else {
+            throw IMAPError.commandFailed("ID")
+        }
+        return Self.parseIDResponse(response)
+    }
+
+    /// Some servers behave better once the client has identified itself; never fails the login
+    private func identifyIfSupported() async {
+        do {
+            guard try await capabilities().contains("ID") else { return }
+            let server = try await sendClientID(Self.clientIdentification)
+            if !server.isEmpty {
+                logDebug("Server identification: \(server.keys.sorted().map { "\($0)=\(server[$0]!)" }.joined(separator: ", "))")
+            }
+        } catch {
+            logWarning("ID command failed: \(error.localizedDescription)")
+        }
+    }
+
+    // MARK: - Capabilities
+
+    /// Get the server's advertised capabilities (cached per connection)
+    func capabilities() async throws -> Set<String> {
+        if let cached = serverCapabilities {
+            return cached
+        }
+        let response = try await sendCommand("CAPABILITY")
+        let caps = parseCapabilities(response)
+        serverCapabilities = caps
+        return caps
+    }
+
+    // MARK: - Server Cleanup
+
+    /// Move messages from the selected folder to another folder
+    /// Uses UID MOVE when advertised, otherwise UID COPY followed by delete; without UIDPLUS
+    /// either, the originals stay in the folder flagged \Deleted
+    func moveEmails(uids: [UInt32], to folder: String) async throws {
+        guard !uids.isEmpty else { return }
+
+        let encodedFolder = folder.imapQuotedMailbox
+        let supportsMove = try await capabilities().contains("MOVE")
+
+        for batch in uidBatches(uids) {
+            await applyRateLimit()
+
+            if supportsMove {
+                let response = try await sendCommand("UID MOVE \(batch) \"\(encodedFolder)\"")
+                guard commandSucceeded(response) else {
+                    throw IMAPError.commandFailed("UID MOVE to \(folder)")
+                }
+            } else {
+                let response = try await sendCommand("UID COPY \(batch) \"\(encodedFolder)\"")
+                guard commandSucceeded(response) else {
+                    throw IMAPError.commandFailed("UID COPY to \(folder)")
+                }
+                try await markDeletedAndExpunge(batch)
+            }
+
+            await recordSuccess()
+        }
+    }
+
+    /// Permanently delete messages from the selected folder (STORE \Deleted + UID EXPUNGE)
+    /// Servers without UIDPLUS only get the messages flagged \Deleted
+    func deleteEmails(uids: [UInt32]) async throws {
+        guard !uids.isEmpty else { return }
+
+        for batch in uidBatches(uids) {
+            await applyRateLimit()
+            try await markDeletedAndExpunge(batch)
+            await recordSuccess()
+        }
+    }
+
+    /// Flag a UID set as deleted and expunge it with UID EXPUNGE (UIDPLUS). A plain EXPUNGE
+    /// would also remove every other message flagged \Deleted in the folder, so without UIDPLUS
+    /// the messages are left flagged for the user's mail client to expunge.
+    private func markDeletedAndExpunge(_ uidSet: String) async throws {
+        let storeResponse = try await sendCommand("UID STORE \(uidSet) +FLAGS.SILENT (\\Deleted)")
+        guard commandSucceeded(storeResponse) else {
+            throw IMAPError.commandFailed("UID STORE \\Deleted")
+        }
+
+        guard try await capabilities().contains("UIDPLUS") else {
+            logWarning("Server lacks UIDPLUS, leaving messages flagged \\Deleted instead of expunging the whole folder")
+            return
+        }
+
+        let expungeResponse = try await sendCommand("UID EXPUNGE \(uidSet)")
+        guard commandSucceeded(expungeResponse) else {
+            throw IMAPError.commandFailed("UID EXPUNGE")
+        }
+    }
+
+    /// Split UIDs into comma-separated sets to keep command lines short
+    private func uidBatches(_ uids: [UInt32], size: Int = 100) -> [String] {
+        let sorted = uids.sorted()
+        return stride(from: 0, to: sorted.count, by: size).map { start in
+            sorted[start..<min(start + size, sorted.count)].map(String.init).joined(separator: ",")
+        }
+    }
+
+    // MARK: - Restore
+
+    /// Largest message the server accepts with APPEND to `folder`, nil when there is no limit.
+    /// APPENDLIMIT=n applies to every folder; a bare APPENDLIMIT means each folder reports its own (RFC 7889).
+    func appendLimit(for folder: String) async throws -> Int? {
+        let caps = try await capabilities()
+        if let limit = Self.appendLimit(in: caps) {
+            return limit
+        }
+        guard caps.contains("APPENDLIMIT") else {
+            return nil
+        }
+
+        let encodedFolder = folder.imapQuotedMailbox
+        let response = try await sendCommand("STATUS \"\(encodedFolder)\" (APPENDLIMIT)")
+        guard commandSucceeded(response) else {
+            throw IMAPError.commandFailed("STATUS \(folder) (APPENDLIMIT)")
+        }
+        return Self.statusAppendLimit(response)
+    }
+
+    /// Server-wide limit from an "APPENDLIMIT=n" capability
+    nonisolated static func appendLimit(in capabilities: Set<String>) -> Int? {
+        for capability in capabilities where capability.hasPrefix("APPENDLIMIT=") {
+            if let limit = Int(capability.dropFirst("APPENDLIMIT=".count)) {
+                return limit
+            }
+        }
+        return nil
+    }
+
+    /// Limit from "* STATUS folder (APPENDLIMIT n)"; NIL means unlimited
+    nonisolated static func statusAppendLimit(_ response: String) -> Int? {
+        guard let regex = try? NSRegularExpression(pattern: "APPENDLIMIT\\s+(\\d+)", options: .caseInsensitive),
+              let match = regex.firstMatch(in: response, range: NSRange(response.startIndex..., in: response)),
+              let range = Range(match.range(at: 1), in: response) else {
+            return nil
+        }
+        return Int(response[range])
+    }
+
+    /// Upload a message to a folder with APPEND.
+    /// Throws `messageTooLarge` when the server refuses the size, before or after the literal is sent.
+    func appendEmail(_ data: Data, to folder: String, flags: [String] = []) async throws {
+        guard connection != nil else {
+            throw IMAPError.notConnected
+        }
+
+        await applyRateLimit()
+
+        tagCounter += 1
+        let tag = "A\(String(format: "%04d", tagCounter))"
+        let encodedFolder = folder.imapQuotedMailbox
+        let flagList = flags.isEmpty ? "" : " (\(flags.joined(separator: " ")))"
+
+        try await sendRaw(Data("\(tag) APPEND \"\(encodedFolder)\"\(flagList) {\(data.count)}\r\n".utf8))
+
+        // The server either asks for the literal or refuses right away (e.g. [TOOBIG])
+        var response = ""
+        while !(response.hasPrefix("+") || response.contains("\r\n+")) {
+            response += try await readResponse()
+            if response.contains("\(tag) NO") || response.contains("\(tag) BAD") {
+                throw Self.appendError(response, folder: folder)
+            }
+        }
+
+        try await sendRaw(data + Data("\r\n".utf8))
+
+        response = ""
+        while !(response.contains("\(tag) OK") || response.contains("\(tag) NO") || response.contains("\(tag) BAD")) {
+            response += try await readResponse()
+        }
+        guard response.contains("\(tag) OK") else {
+            throw Self.appendError(response, folder: folder)
+        }
+
+        await recordSuccess()
+    }
+
+    nonisolated static func appendError(_ response: String, folder: String) -> IMAPError {
+        if response.uppercased().contains("[TOOBIG]") {
+            return .messageTooLarge(folder)
+        }
+        return .commandFailed("APPEND to \(folder)")
+    }
+
     // MARK: - Low-level Communication
 
-    private func sendCommand(_ command: String) async throws -> String {
+    /// Write bytes as they are, without a tag or line ending
+    private func sendRaw(_ data: Data) async throws {
+        guard let connection = connection else {
+            throw IMAPError.notConnected
+        }
+
+        try await withCheckedThrowingContinuation { (continuation: CheckedContinuation<Void, Error>) in
+            connection.send(content: data, completion: .contentProcessed { error in
+                if let error = error {
+                    continuation.resume(throwing: IMAPError.sendFailed(error.localizedDescription))
+                } else {
+                    continuation.resume()
+                }
+            })
+        }
+    }
+
+    /// Send a tagged command whose arguments hold literals and read until its completion. Each
+    /// literal is sent once the server asks for it with "+"; a refusal instead ends the command.
+    private func sendCommand(_ command: String, arguments: [IMAPSearchCriteria.Argument]) async throws -> String {
+        tagCounter += 1
+        let tag = "A\(String(format: "%04d", tagCounter))"
+        let completed = { (response: String) in
+            response.contains("\(tag) OK") || response.contains("\(tag) NO") || response.contains("\(tag) BAD")
+        }
+
+        var pending = Data("\(tag) \(command)".utf8)
+        for argument in arguments {
+            switch argument {
+            case .text(let text):
+                pending += Data(" \(text)".utf8)
+            case .literal(let string):
+                let bytes = Data(string.utf8)
+                try await sendRaw(pending + Data(" {\(bytes.count)}\r\n".utf8))
+                var response = ""
+                while !(response.hasPrefix("+") || response.contains("\r\n+")) {
+                    response += try await readResponse()
+                    if completed(response) {
+                        return response
+                    }
+                }
+                pending = bytes
+            }
+        }
+        try await sendRaw(pending + Data("\r\n".utf8))
+
+        var response = ""
+        while !completed(response) {
+            response += try await readResponse()
+        }
+        return response
+    }
+
+    /// Send a tagged command and read until its completion
+    /// `onContinuation` answers the first "+" challenge (e.g. SASL), later ones get an empty line.
+    private func sendCommand(_ command: String, onContinuation: ((String) -> String)? = nil) async throws -> String {
         trace("sendCommand(\(command.prefix(30))...)")
         guard let connection = connection else {
             throw IMAPError.notConnected
@@ -724,7 +1854,9 @@ actor IMAPService {
                 completion: .contentProcessed { error in
                     if let error = error {
                         trace("sendCommand: send error \(error)")
-                        continuation.resume(throwing: IMAPError.sendFailed(error.localizedDescription))
+                        continuation.resume(throwing: Self.isClosedByPeer(error)
+                            ? IMAPError.connectionClosed
+                            : IMAPError.sendFailed(error.localizedDescription))
                     } else {
                         trace("sendCommand: sent OK")
                         continuation.resume()
@@ -737,6 +1869,7 @@ actor IMAPService {
         trace("sendCommand: reading response...")
         trace("[DEBUG] sendCommand: reading response for tag \(tag)...")
         var fullResponse = ""
+        var continuationHandler = onContinuation
         while true {
             let chunk = try await readResponse()
             fullResponse += chunk
@@ -745,10 +1878,12 @@ actor IMAPService {
 
             // Check for SASL continuation (+ response) - need to handle auth errors
             if chunk.hasPrefix("+ ") || chunk.contains("\r\n+ ") {
-                trace("[DEBUG] sendCommand: got SASL continuation, sending empty response")
-                // Send empty response to complete SASL exchange
+                trace("[DEBUG] sendCommand: got SASL continuation")
+                // Answer the challenge once; an empty response completes or aborts the SASL exchange
+                let reply = continuationHandler.map { $0(continuationText(chunk)) } ?? ""
+                continuationHandler = nil
                 try await withCheckedThrowingContinuation { (continuation: CheckedContinuation<Void, Error>) in
-                    connection.send(content: "\r\n".data(using: .utf8), completion: .contentProcessed { error in
+                    connection.send(content: "\(reply)\r\n".data(using: .utf8), completion: .contentProcessed { error in
                         if let error = error {
                             continuation.resume(throwing: IMAPError.sendFailed(error.localizedDescription))
                         } else {
@@ -770,16 +1905,33 @@ actor IMAPService {
         return fullResponse
     }
 
+    /// Text following "+ " in a continuation request
+    private func continuationText(_ chunk: String) -> String {
+        for line in chunk.components(separatedBy: "\r\n") where line.hasPrefix("+") {
+            return String(line.dropFirst()).trimmingCharacters(in: .whitespaces)
+        }
+        return ""
+    }
+
     private func readResponse() async throws -> String {
         guard let connection = connection else {
             throw IMAPError.notConnected
         }
 
         return try await withCheckedThrowingContinuation { continuation in
-            connection.receive(minimumIncompleteLength: 1, maximumLength: 65536) { data, _, _, error in
+            connection.receive(minimumIncompleteLength: 1, maximumLength: 65536) { data, _, isComplete, error in
                 if let error = error {
                     trace("readResponse: error \(error)")
-                    continuation.resume(throwing: IMAPError.receiveFailed(error.localizedDescription))
+                    continuation.resume(throwing: Self.isClosedByPeer(error)
+                        ? IMAPError.connectionClosed
+                        : IMAPError.receiveFailed(error.localizedDescription))
+                    return
+                }
+
+                // End of stream: reading again would only return nothing forever
+                if isComplete && (data?.isEmpty ?? true) {
+                    trace("readResponse: closed by server")
+                    continuation.resume(throwing: IMAPError.connectionClosed)
                     return
                 }
 
@@ -796,14 +1948,15 @@ actor IMAPService {
 
     // MARK: - Response Parsing
 
-    private func parseListResponse(_ response: String) -> [IMAPFolder] {
+    /// Parse LIST/LSUB lines; `defaultDelimiter` is used when the server reports a NIL delimiter
+    nonisolated static func parseListResponse(_ response: String, defaultDelimiter: String? = nil) -> [IMAPFolder] {
         var folders: [IMAPFolder] = []
-        let lines = response.components(separatedBy: "\r\n")
+        let lines = inliningLiterals(response.components(separatedBy: "\r\n"))
 
         for line in lines {
             // Parse lines like: * LIST (\HasNoChildren) "/" "INBOX"
             if line.hasPrefix("* LIST") || line.hasPrefix("* LSUB") {
-                if let folder = parseListLine(line) {
+                if let folder = parseListLine(line, defaultDelimiter: defaultDelimiter) {
                     folders.append(folder)
                 }
             }
@@ -812,21 +1965,48 @@ actor IMAPService {
         return folders
     }
 
-    private func parseListLine(_ line: String) -> IMAPFolder? {
-        // Match pattern: * LIST (flags) "delimiter" "name"
-        let pattern = #"\* (?:LIST|LSUB) \(([^)]*)\) "(.)" "?([^"]+)"?"#
+    /// A mailbox name sent as a literal, `* LIST () "/" {8}` followed by the name on its own line,
+    /// is folded back into its LIST line as a quoted string so it parses like any other name
+    private nonisolated static func inliningLiterals(_ lines: [String]) -> [String] {
+        var result: [String] = []
+        var index = 0
+        while index < lines.count {
+            let line = lines[index]
+            if line.hasPrefix("* LIST") || line.hasPrefix("* LSUB"),
+               let literal = line.range(of: #"\{(\d+)\+?\}$"#, options: .regularExpression),
+               let length = Int(line[literal].filter(\.isNumber)),
+               index + 1 < lines.count {
+                // The literal counts bytes; names can be raw UTF-8 when the server sends them that way
+                let next = Data(lines[index + 1].utf8)
+                let name = String(decoding: next.prefix(length), as: UTF8.self)
+                let rest = String(decoding: next.dropFirst(length), as: UTF8.self)
+                result.append(line[..<literal.lowerBound] + "\"" + name.imapQuotedMailboxEscaped + "\"" + rest)
+                index += 2
+            } else {
+                result.append(line)
+                index += 1
+            }
+        }
+        return result
+    }
+
+    private nonisolated static func parseListLine(_ line: String, defaultDelimiter: String?) -> IMAPFolder? {
+        // Match pattern: * LIST (flags) "delimiter" "name" (delimiter may be NIL for flat hierarchies).
+        // Quoted names may contain escaped quotes and backslashes.
+        let pattern = #"\* (?:LIST|LSUB) \(([^)]*)\) (?:"(\\.|[^"\\])"|NIL) (?:"((?:\\.|[^"\\])*)"|(\S+))"#
         guard let regex = try? NSRegularExpression(pattern: pattern, options: []),
               let match = regex.firstMatch(in: line, range: NSRange(line.startIndex..., in: line)) else {
             return nil
         }
 
         let flagsRange = Range(match.range(at: 1), in: line)!
-        let delimiterRange = Range(match.range(at: 2), in: line)!
-        let nameRange = Range(match.range(at: 3), in: line)!
+        guard let nameRange = Range(match.range(at: 3), in: line) ?? Range(match.range(at: 4), in: line) else {
+            return nil
+        }
 
         let flags = String(line[flagsRange])
-        let delimiter = String(line[delimiterRange])
-        let rawName = String(line[nameRange])
+        let delimiter = Range(match.range(at: 2), in: line).map { unescapeQuoted(String(line[$0])) } ?? defaultDelimiter ?? ""
+        let rawName = unescapeQuoted(String(line[nameRange]))
 
         // Decode IMAP modified UTF-7 encoding (RFC 3501)
         let name = rawName.decodingIMAPUTF7()
@@ -835,10 +2015,26 @@ actor IMAPService {
             name: name,
             delimiter: delimiter,
             flags: flags.components(separatedBy: " "),
-            path: name.replacingOccurrences(of: delimiter, with: "/")
+            path: delimiter.isEmpty ? name : name.replacingOccurrences(of: delimiter, with: "/")
         )
     }
 
+    /// Undo the `\\` and `\"` escapes of an IMAP quoted string
+    private nonisolated static func unescapeQuoted(_ value: String) -> String {
+        guard value.contains("\\") else { return value }
+        var result = ""
+        var escaped = false
+        for char in value {
+            if escaped || char != "\\" {
+                result.append(char)
+                escaped = false
+            } else {
+                escaped = true
+            }
+        }
+        return result
+    }
+
     private func parseFolderStatus(_ response: String) -> FolderStatus {
         var exists = 0
         var recent = 0
@@ -877,7 +2073,52 @@ actor IMAPService {
         return headers
     }
 
-    private func parseSearchResponse(_ response: String) -> [UInt32] {
+    private func parseCapabilities(_ response: String) -> Set<String> {
+        var caps = Set<String>()
+        for line in response.components(separatedBy: "\r\n") {
+            // Untagged: * CAPABILITY IMAP4rev1 MOVE ...
+            // Response code: * OK [CAPABILITY IMAP4rev1 ...] ...
+            var text: Substring?
+            if let range = line.range(of: "* CAPABILITY ") {
+                text = line[range.upperBound...]
+            } else if let start = line.range(of: "[CAPABILITY "),
+                      let end = line.range(of: "]", range: start.upperBound..<line.endIndex) {
+                text = line[start.upperBound..<end.lowerBound]
+            }
+            if let text = text {
+                for cap in text.split(separator: " ") {
+                    caps.insert(cap.uppercased())
+                }
+            }
+        }
+        return caps
+    }
+
+    /// Throw when the server reports its download cap, so the backup stops instead of retrying
+    private func checkBandwidthCap(_ response: String) throws {
+        guard RateLimitService.isBandwidthCapResponse(response) else { return }
+        let line = response.components(separatedBy: "\r\n")
+            .first { RateLimitService.isBandwidthCapResponse($0) } ?? response
+        throw IMAPError.bandwidthLimitExceeded(line.trimmingCharacters(in: .whitespacesAndNewlines))
+    }
+
+    /// Check whether the tagged completion line of a response is OK
+    private func commandSucceeded(_ response: String) -> Bool {
+        Self.taggedStatus(response) == "OK"
+    }
+
+    /// Status (OK, NO, BAD) of the tagged completion line of a response
+    nonisolated static func taggedStatus(_ response: String) -> String? {
+        let lines = response.components(separatedBy: "\r\n").filter { !$0.isEmpty }
+        guard let tagged = lines.last(where: { !$0.hasPrefix("*") && !$0.hasPrefix("+") }) else {
+            return nil
+        }
+        let parts = tagged.split(separator: " ", maxSplits: 2)
+        return parts.count >= 2 ? parts[1].uppercased() : nil
+    }
+
+    /// UIDs of SEARCH responses in server order; a UID the server repeats is kept once
+    nonisolated static func parseSearchResponse(_ response: String) -> [UInt32] {
         var uids: [UInt32] = []
         let lines = response.components(separatedBy: "\r\n")
 
@@ -892,7 +2133,18 @@ actor IMAPService {
             }
         }
 
-        return uids
+        return uniqueUIDs(uids, in: "SEARCH")
+    }
+
+    /// Drop repeated UIDs, keeping the first of each. A well-behaved server never repeats one,
+    /// but if it does, downloading the message twice would leave a second copy with a counter suffix.
+    nonisolated static func uniqueUIDs(_ uids: [UInt32], in response: String) -> [UInt32] {
+        var seen = Set<UInt32>()
+        let unique = uids.filter { seen.insert($0).inserted }
+        if unique.count < uids.count {
+            logWarning("Server returned \(uids.count - unique.count) duplicate UIDs in one \(response) response, ignoring the repeats")
+        }
+        return unique
     }
 
     private func extractEmailData(from response: String) -> Data {
@@ -946,18 +2198,148 @@ actor IMAPService {
 
 // MARK: - Supporting Types
 
+/// FETCH data items that return a whole message, in the order they are tried. Only peek
+/// items: plain RFC822 or BODY[] would set \Seen on every message backed up.
+enum BodyFetchItem: String {
+    case peek = "BODY.PEEK[]"
+    /// Some servers only answer this form for certain messages
+    case rfc822Peek = "RFC822.PEEK"
+
+    static let fallbackOrder: [BodyFetchItem] = [.peek, .rfc822Peek]
+}
+
 struct IMAPFolder: Identifiable, Hashable {
     let id = UUID()
     let name: String
     let delimiter: String
     let flags: [String]
     let path: String
+    /// Prefix of the other-users or shared namespace the folder was listed from; nil for personal folders
+    var namespacePrefix: String? = nil
 
     var isSelectable: Bool {
         !flags.contains("\\Noselect")
     }
 }
 
+/// One namespace from a NAMESPACE response: a mailbox name prefix and its hierarchy delimiter
+struct IMAPNamespace: Equatable {
+    let prefix: String
+    /// Empty when the server reports NIL (flat namespace)
+    let delimiter: String
+}
+
+/// Personal, other users' and shared namespaces (RFC 2342)
+struct IMAPNamespaces: Equatable {
+    var personal: [IMAPNamespace] = []
+    var otherUsers: [IMAPNamespace] = []
+    var shared: [IMAPNamespace] = []
+
+    /// Parse an untagged `* NAMESPACE (("" "/")) NIL NIL` response
+    static func parse(_ response: String) -> IMAPNamespaces? {
+        guard let line = response.components(separatedBy: "\r\n").first(where: {
+            $0.uppercased().hasPrefix("* NAMESPACE ")
+        }) else {
+            return nil
+        }
+
+        let bytes = Array(line.dropFirst("* NAMESPACE ".count).utf8)
+        var index = 0
+        var groups: [[IMAPNamespace]] = []
+        for _ in 0..<3 {
+            guard let value = EnvelopeParser.parseValue(bytes, &index) else { return nil }
+            groups.append(namespaces(in: value))
+        }
+        return IMAPNamespaces(personal: groups[0], otherUsers: groups[1], shared: groups[2])
+    }
+
+    private static func namespaces(in value: IMAPValue) -> [IMAPNamespace] {
+        guard case .list(let entries) = value else { return [] }
+        return entries.compactMap { entry in
+            // Each entry is (prefix delimiter [extensions...])
+            guard case .list(let fields) = entry, fields.count >= 2,
+                  case .string(let prefix) = fields[0] else {
+                return nil
+            }
+            var delimiter = ""
+            if case .string(let value) = fields[1] {
+                delimiter = value
+            }
+            return IMAPNamespace(prefix: prefix.decodingIMAPUTF7(), delimiter: delimiter)
+        }
+    }
+}
+
+/// Server software as announced in the greeting, and the provider quirks that go with it
+struct IMAPServerInfo: Equatable {
+    /// The greeting line without the leading "* OK"
+    let greeting: String
+    /// E.g. "Dovecot", "Gmail", "Cyrus IMAP"; nil when the banner is not recognized
+    let software: String?
+    let version: String?
+
+    /// Limits the provider is known to enforce
+    var quirks: IMAPServerQuirks {
+        switch software {
+        case "Gmail":
+            // Gmail refuses more than 15 simultaneous IMAP connections per account
+            return IMAPServerQuirks(maxConnections: 15)
+        default:
+            return IMAPServerQuirks()
+        }
+    }
+
+    var description: String {
+        [software ?? "Unknown server", version].compactMap { $0 }.joined(separator: " ")
+    }
+
+    /// Banner patterns, most specific first: (software name, regex with an optional version group)
+    private static let banners: [(String, String)] = [
+        ("Gmail", #"\bGimap\b"#),
+        ("Dovecot", #"\bDovecot\b(?:\s+v?(\d[\w.]*))?"#),
+        ("Cyrus IMAP", #"\bCyrus IMAP\d*(?:\s+(?:Murder\s+)?v?(\d[\w.\-]*))?"#),
+        ("Courier-IMAP", #"\bCourier-IMAP\b"#),
+        ("Microsoft Exchange", #"\bMicrosoft Exchange\b(?:\s+Server\s+(\d+))?"#),
+        ("Zimbra", #"\bZimbra\b"#),
+        ("UW IMAP", #"\bIMAP4rev1\s+(\d{4}[a-z]?\.\d+)"#),
+        ("Yandex", #"\bYandex\b"#),
+        ("iCloud", #"\biCloud\b"#)
+    ]
+
+    /// Recognize the software from an untagged OK or PREAUTH greeting
+    static func parse(greeting: String) -> IMAPServerInfo {
+        let line = greeting.components(separatedBy: "\r\n").first { $0.hasPrefix("* ") } ?? greeting
+        var text = line
+        for prefix in ["* OK ", "* PREAUTH "] where text.uppercased().hasPrefix(prefix) {
+            text = String(text.dropFirst(prefix.count))
+        }
+        text = text.trimmingCharacters(in: .whitespaces)
+
+        // Ignore response codes such as [CAPABILITY ...], which list extension names, not software
+        let banner = text.replacingOccurrences(of: #"\[[^\]]*\]"#, with: " ", options: .regularExpression)
+        let range = NSRange(banner.startIndex..., in: banner)
+
+        for (software, pattern) in banners {
+            guard let regex = try? NSRegularExpression(pattern: pattern, options: [.caseInsensitive]),
+                  let match = regex.firstMatch(in: banner, range: range) else {
+                continue
+            }
+            var version: String?
+            if match.numberOfRanges > 1, let versionRange = Range(match.range(at: 1), in: banner) {
+                version = String(banner[versionRange]).trimmingCharacters(in: CharacterSet(charactersIn: "."))
+            }
+            return IMAPServerInfo(greeting: text, software: software, version: version)
+        }
+        return IMAPServerInfo(greeting: text, software: nil, version: nil)
+    }
+}
+
+/// Provider limits applied automatically once the server is recognized
+struct IMAPServerQuirks: Equatable {
+    /// Most simultaneous connections the provider allows per account
+    var maxConnections: Int?
+}
+
 struct FolderStatus {
     let exists: Int
     let recent: Int
@@ -965,6 +2347,15 @@ struct FolderStatus {
     let uidValidity: UInt32
 }
 
+/// Flags returned by `fetchFlags(changedSince:)`
+struct FlagFetchResult {
+    let flags: [UInt32: [String]]
+    /// Highest MODSEQ among the returned messages, nil without CONDSTORE or when nothing changed
+    let highestModSeq: UInt64?
+    /// Only messages changed since the given mod-sequence were asked for
+    let isIncremental: Bool
+}
+
 struct EmailHeader {
     let uid: UInt32
     let messageId: String
@@ -977,15 +2368,75 @@ struct EmailHeader {
 
 // MARK: - Errors
 
+/// SASL mechanisms and LOGIN used for password accounts
+enum PasswordAuthMechanism: String {
+    case plain = "PLAIN"
+    case cramMD5 = "CRAM-MD5"
+    case login = "LOGIN"
+}
+
+/// A REFERRAL response code (RFC 2221, RFC 2193) pointing at another server
+struct IMAPReferral: Equatable {
+    let url: String
+    let host: String
+    let port: Int?
+    /// Mailbox on the referred server, for SELECT referrals
+    let mailbox: String?
+
+    /// Parse an IMAP URL (RFC 5092): imap://[user[;AUTH=...]@]host[:port][/mailbox]
+    init?(url: String) {
+        guard url.lowercased().hasPrefix("imap://") else { return nil }
+        var rest = url.dropFirst("imap://".count)
+
+        var path: Substring?
+        if let slash = rest.firstIndex(of: "/") {
+            path = rest[rest.index(after: slash)...]
+            rest = rest[..<slash]
+        }
+        if let at = rest.lastIndex(of: "@") {
+            rest = rest[rest.index(after: at)...]
+        }
+
+        var port: Int?
+        if let colon = rest.lastIndex(of: ":") {
+            port = Int(rest[rest.index(after: colon)...])
+            rest = rest[..<colon]
+        }
+        guard !rest.isEmpty else { return nil }
+
+        self.url = url
+        self.host = String(rest)
+        self.port = port
+        self.mailbox = path.flatMap { $0.isEmpty ? nil : String($0).removingPercentEncoding ?? String($0) }
+    }
+
+    /// Find a [REFERRAL url] response code in a server response
+    init?(response: String) {
+        guard let start = response.range(of: "[REFERRAL ", options: .caseInsensitive),
+              let end = response.range(of: "]", range: start.upperBound..<response.endIndex) else {
+            return nil
+        }
+        let url = response[start.upperBound..<end.lowerBound].trimmingCharacters(in: .whitespaces)
+        self.init(url: url)
+    }
+}
+
 enum IMAPError: LocalizedError {
     case notConnected
     case connectionFailed(String)
     case connectionCancelled
+    case connectionClosed
+    case tlsFailed(TLSFailure)
     case authenticationFailed
     case sendFailed(String)
     case receiveFailed(String)
     case folderNotFound(String)
     case fetchFailed(String)
+    case commandFailed(String)
+    case loginDisabled
+    case bandwidthLimitExceeded(String)
+    case referral(String)
+    case messageTooLarge(String)
 
     var errorDescription: String? {
         switch self {
@@ -995,6 +2446,10 @@ enum IMAPError: LocalizedError {
             return "Connection failed: \(reason)"
         case .connectionCancelled:
             return "Connection was cancelled"
+        case .connectionClosed:
+            return "Server closed the connection"
+        case .tlsFailed(let failure):
+            return "\(failure.message). \(failure.suggestion)"
         case .authenticationFailed:
             return "Authentication failed - check username and password"
         case .sendFailed(let reason):
@@ -1005,6 +2460,19 @@ enum IMAPError: LocalizedError {
             return "Folder not found: \(name)"
         case .fetchFailed(let reason):
             return "Failed to fetch email: \(reason)"
+        case .commandFailed(let command):
+            return "Server rejected command: \(command)"
+        case .loginDisabled:
+            return "Server does not allow password login over an unencrypted connection - enable SSL/TLS for this account"
+        case .bandwidthLimitExceeded(let message):
+            return "Server download limit reached: \(message)"
+        case .referral(let url):
+            if let host = IMAPReferral(url: url)?.host {
+                return "Server referred MailKeep to \(url) - change the account's IMAP server to \(host)"
+            }
+            return "Server referred MailKeep to \(url)"
+        case .messageTooLarge(let folder):
+            return "Server refused the message as too large for \(folder)"
         }
     }
 }
@@ -1069,6 +2537,16 @@ extension String {
         return result
     }
 
+    /// Mailbox name as it goes between the quotes of a command: modified UTF-7, with `\\` and `"` escaped
+    var imapQuotedMailbox: String {
+        encodingIMAPUTF7().imapQuotedMailboxEscaped
+    }
+
+    /// Escape `\\` and `"` for an IMAP quoted string
+    fileprivate var imapQuotedMailboxEscaped: String {
+        replacingOccurrences(of: "\\", with: "\\\\").replacingOccurrences(of: "\"", with: "\\\"")
+    }
+
     /// Encode string to IMAP modified UTF-7
     func encodingIMAPUTF7() -> String {
         var result = ""
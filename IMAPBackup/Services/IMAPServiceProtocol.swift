@@ -1,7 +1,7 @@
 import Foundation
 
 /// Protocol defining IMAP service operations for testability
-protocol IMAPServiceProtocol {
+protocol IMAPServiceProtocol: Sendable {
     /// Connect to the IMAP server
     func connect() async throws
 
@@ -17,23 +17,80 @@ protocol IMAPServiceProtocol {
     /// List all folders on the server
     func listFolders() async throws -> [IMAPFolder]
 
+    /// Namespaces reported by NAMESPACE, nil when the server does not support it
+    func namespaces() async throws -> IMAPNamespaces?
+
+    /// List folders in other users' and shared namespaces
+    func listSharedFolders() async throws -> [IMAPFolder]
+
     /// Select a folder for operations
     func selectFolder(_ folder: String) async throws -> FolderStatus
 
+    /// Select a folder read-only, falling back to a read-write SELECT that never marks messages read
+    func examineFolder(_ folder: String) async throws -> FolderStatus
+
     /// Fetch email headers for a range of UIDs
     func fetchEmailHeaders(uids: ClosedRange<UInt32>) async throws -> [EmailHeader]
 
+    /// Fetch the Message-IDs of messages in a UID range
+    func fetchMessageIDs(uids: ClosedRange<UInt32>) async throws -> [UInt32: String]
+
     /// Fetch complete email data by UID
     func fetchEmail(uid: UInt32) async throws -> Data
 
     /// Get size of an email before downloading
     func fetchEmailSize(uid: UInt32) async throws -> Int
 
+    /// MIME structure of an email from BODYSTRUCTURE, nil if the server sent none that parses
+    func fetchBodyStructure(uid: UInt32) async throws -> BodyStructure?
+
+    /// One section of an email without setting \Seen, e.g. "HEADER", "2.MIME" or "2"
+    func fetchBodySection(uid: UInt32, section: String) async throws -> Data
+
+    /// Date the server received an email (INTERNALDATE), nil if it did not say
+    func fetchInternalDate(uid: UInt32) async throws -> Date?
+
+    /// Fetch the raw ENVELOPE and BODYSTRUCTURE response for an email
+    func fetchEnvelope(uid: UInt32) async throws -> String
+
+    /// Fetch UID, FLAGS, RFC822.SIZE and ENVELOPE of several emails at once, keyed by UID
+    func fetchEnvelopes(uids: [UInt32]) async throws -> [UInt32: String]
+
+    /// Fetch the flags of the selected folder's messages, only those changed since `modSeq` where CONDSTORE allows
+    func fetchFlags(changedSince modSeq: UInt64?) async throws -> FlagFetchResult
+
     /// Stream large email directly to file
     func streamEmailToFile(uid: UInt32, destinationURL: URL) async throws -> Int64
 
     /// Search for all email UIDs in selected folder
     func searchAll() async throws -> [UInt32]
+
+    /// Search for emails in the selected folder received on or after a day
+    func searchSince(_ date: Date) async throws -> [UInt32]
+
+    /// Search the selected folder on the server for messages matching `criteria`
+    func search(_ criteria: IMAPSearchCriteria) async throws -> [UInt32]
+
+    /// Server software recognized from the greeting, nil before login
+    func serverInfo() async -> IMAPServerInfo?
+
+    /// Capabilities advertised by the server
+    func capabilities() async throws -> Set<String>
+
+    /// Identify the client with the ID command, returning the server's identification
+    func sendClientID(_ fields: [String: String]) async throws -> [String: String]
+
+    /// Move messages from the selected folder to another folder
+    func moveEmails(uids: [UInt32], to folder: String) async throws
+
+    /// Permanently delete messages from the selected folder
+    func deleteEmails(uids: [UInt32]) async throws
+
+    /// Largest message APPEND accepts for a folder, nil when unlimited
+    func appendLimit(for folder: String) async throws -> Int?
+
+    /// Upload a message to a folder
+    func appendEmail(_ data: Data, to folder: String, flags: [String]) async throws
 }
 
 // MARK: - IMAPService conformance
@@ -0,0 +1,103 @@
+import Foundation
+
+/// File slots (inodes) of a volume. Every email, sidecar and attachment folder takes one, so a
+/// volume formatted with few of them fills up while it still has plenty of space.
+struct InodeUsage: Equatable {
+    let total: UInt64
+    let free: UInt64
+
+    var used: UInt64 {
+        total - min(free, total)
+    }
+
+    /// Inodes of the volume holding `url`, from statfs; nil when it cannot be read or the
+    /// volume has no fixed number of them and reports zero
+    static func of(_ url: URL) -> InodeUsage? {
+        var stats = statfs()
+        guard statfs(url.path, &stats) == 0, stats.f_files > 0 else { return nil }
+        return InodeUsage(total: UInt64(stats.f_files), free: UInt64(stats.f_ffree))
+    }
+}
+
+enum InodeCheckError: LocalizedError {
+    case tooFewInodes(path: String, free: UInt64, minimum: Int)
+
+    var errorDescription: String? {
+        switch self {
+        case .tooFewInodes(let path, let free, let minimum):
+            return "Only \(free) files can still be created on the volume of \(path), below the minimum of \(minimum). \(InodeCheck.remedy)"
+        }
+    }
+}
+
+/// Whether a backup location can still take new files. The usual layout stores every email in
+/// its own files, so this complements the disk space check; a backup checks before it starts,
+/// after every folder and every few hundred saved emails in between, and stops
+/// rather than failing email by email.
+enum InodeCheck {
+    enum Level: Equatable {
+        case ok
+        /// Under twice the minimum
+        case low
+        /// Under the minimum; backups stop
+        case exhausted
+    }
+
+    /// Free inodes a backup leaves on a volume, unless set with `-MinimumFreeInodes <n>`
+    static let defaultMinimum = 100_000
+
+    static let remedy = "Free up files on the volume, move backups to a volume with more inodes, or keep old emails as an mbox export."
+
+    /// A minimum of 0 turns the check off
+    static func level(of usage: InodeUsage, minimum: Int) -> Level {
+        guard minimum > 0 else { return .ok }
+        if usage.free < UInt64(minimum) {
+            return .exhausted
+        }
+        return usage.free < 2 * UInt64(minimum) ? .low : .ok
+    }
+
+    /// Throw when the volume of `url` has fewer free inodes than `minimum`; otherwise its level,
+    /// `.ok` for volumes without a fixed number of inodes
+    @discardableResult
+    static func check(_ url: URL, minimum: Int) throws -> Level {
+        guard let usage = InodeUsage.of(url) else { return .ok }
+
+        let result = level(of: usage, minimum: minimum)
+        if result == .exhausted {
+            throw InodeCheckError.tooFewInodes(path: url.path, free: usage.free, minimum: minimum)
+        }
+        return result
+    }
+}
+
+/// The inode check of one backup run over all its locations, warning once per location when it
+/// runs low. Parallel downloads of the run share it.
+final class InodeMonitor {
+    private let locations: [URL]
+    private let minimum: Int
+    private let logger: BackupLogger
+    private let lock = NSLock()
+    private var warned: Set<String> = []
+
+    init(locations: [URL], minimum: Int, logger: BackupLogger) {
+        self.locations = locations
+        self.minimum = minimum
+        self.logger = logger
+    }
+
+    /// Throw when a location is nearly out of inodes. Each email takes its own files in every location.
+    func check() throws {
+        for location in locations {
+            guard try InodeCheck.check(location, minimum: minimum) == .low, firstWarning(for: location) else { continue }
+            let free = InodeUsage.of(location)?.free ?? 0
+            logger.log("Only \(free) files can still be created on the volume of \(location.path). \(InodeCheck.remedy)", level: .warning)
+        }
+    }
+
+    private func firstWarning(for location: URL) -> Bool {
+        lock.lock()
+        defer { lock.unlock() }
+        return warned.insert(location.path).inserted
+    }
+}
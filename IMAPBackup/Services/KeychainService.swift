@@ -5,7 +5,9 @@ import Security
 actor KeychainService {
     static let shared = KeychainService()
 
-    private let defaultService = "com.kzahedi.MailKeep"
+    static let defaultService = "com.kzahedi.MailKeep"
+    /// Keychain service holding OAuth tokens
+    static let oauthService = "com.kzahedi.MailKeep.oauth"
 
     private init() {}
 
@@ -17,7 +19,7 @@ actor KeychainService {
     ///   - accountId: The account identifier
     ///   - service: Optional custom service name (defaults to app service)
     func savePassword(_ password: String, for accountId: UUID, service: String? = nil) throws {
-        let serviceName = service ?? defaultService
+        let serviceName = service ?? Self.defaultService
         let account = accountId.uuidString
         guard let passwordData = password.data(using: .utf8) else {
             throw KeychainError.encodingFailed
@@ -46,7 +48,7 @@ actor KeychainService {
     ///   - service: Optional custom service name (defaults to app service)
     /// - Returns: The stored password
     func getPassword(for accountId: UUID, service: String? = nil) throws -> String {
-        let serviceName = service ?? defaultService
+        let serviceName = service ?? Self.defaultService
         let account = accountId.uuidString
 
         let query: [String: Any] = [
@@ -69,12 +71,46 @@ actor KeychainService {
         return password
     }
 
+    /// Return the first password found among several service/account pairs
+    /// - Parameter lookups: Entries to try, in order
+    func getPassword(trying lookups: [KeychainLookup]) throws -> String {
+        for lookup in lookups {
+            let query: [String: Any] = [
+                kSecClass as String: kSecClassGenericPassword,
+                kSecAttrService as String: lookup.service,
+                kSecAttrAccount as String: lookup.account,
+                kSecReturnData as String: true,
+                kSecMatchLimit as String: kSecMatchLimitOne
+            ]
+
+            var result: AnyObject?
+            if SecItemCopyMatching(query as CFDictionary, &result) == errSecSuccess,
+               let passwordData = result as? Data,
+               let password = String(data: passwordData, encoding: .utf8) {
+                return password
+            }
+        }
+        throw KeychainError.notFound
+    }
+
+    /// Keychain entries that may hold an account's password, most specific first.
+    /// A custom service is tried with the username, as other tools store it, and with the account id.
+    nonisolated static func passwordLookups(accountId: UUID, username: String, customService: String?) -> [KeychainLookup] {
+        var lookups: [KeychainLookup] = []
+        if let service = customService, !service.isEmpty {
+            lookups.append(KeychainLookup(service: service, account: username))
+            lookups.append(KeychainLookup(service: service, account: accountId.uuidString))
+        }
+        lookups.append(KeychainLookup(service: defaultService, account: accountId.uuidString))
+        return lookups
+    }
+
     /// Delete password from Keychain
     /// - Parameters:
     ///   - accountId: The account identifier
     ///   - service: Optional custom service name (defaults to app service)
     func deletePassword(for accountId: UUID, service: String? = nil) throws {
-        let serviceName = service ?? defaultService
+        let serviceName = service ?? Self.defaultService
         let account = accountId.uuidString
 
         let query: [String: Any] = [
@@ -110,6 +146,12 @@ actor KeychainService {
     }
 }
 
+/// A generic password entry identified by service and account
+struct KeychainLookup: Equatable {
+    let service: String
+    let account: String
+}
+
 // MARK: - Errors
 
 enum KeychainError: LocalizedError {
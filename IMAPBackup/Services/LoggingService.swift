@@ -22,6 +22,65 @@ enum LogLevel: Int, Comparable, Codable {
     }
 }
 
+// MARK: - Sensitive Data Redaction
+
+/// Redacts sensitive data from log messages to prevent credential leakage
+func redactSensitiveData(_ message: String) -> String {
+    var result = message
+
+    // Redact LOGIN command passwords: LOGIN "user" "password" -> LOGIN "user" "[REDACTED]"
+    if let loginRange = result.range(of: #"LOGIN\s+"[^"]*"\s+"[^"]*""#, options: .regularExpression) {
+        // Find the second quoted string (password) and redact it
+        let loginPart = String(result[loginRange])
+        if let passwordMatch = loginPart.range(of: #""\s+"[^"]*"$"#, options: .regularExpression) {
+            let redacted = loginPart.replacingCharacters(in: passwordMatch, with: "\" \"[REDACTED]\"")
+            result = result.replacingCharacters(in: loginRange, with: redacted)
+        }
+    }
+
+    // Redact AUTHENTICATE XOAUTH2 tokens: AUTHENTICATE XOAUTH2 <token> -> AUTHENTICATE XOAUTH2 [REDACTED]
+    if let authRange = result.range(of: #"AUTHENTICATE\s+XOAUTH2\s+\S+"#, options: .regularExpression) {
+        result = result.replacingCharacters(in: authRange, with: "AUTHENTICATE XOAUTH2 [REDACTED]")
+    }
+
+    // Redact AUTHENTICATE PLAIN initial responses and Bearer headers
+    result = result.replacingOccurrences(
+        of: #"(AUTHENTICATE\s+PLAIN|Bearer)\s+\S+"#,
+        with: "$1 [REDACTED]",
+        options: [.regularExpression, .caseInsensitive]
+    )
+
+    // Redact token fields in JSON or form bodies: "access_token": "..." / refreshToken=...
+    result = result.replacingOccurrences(
+        of: #"("?(?:access_token|refresh_token|id_token|accessToken|refreshToken)"?\s*[:=]\s*"?)[^"&,\s}]+"#,
+        with: "$1[REDACTED_TOKEN]",
+        options: .regularExpression
+    )
+
+    // Redact Google access tokens (ya29.) and refresh tokens (1//)
+    result = result.replacingOccurrences(
+        of: #"(?:ya29\.|1//)[A-Za-z0-9._\-/]+"#,
+        with: "[REDACTED_TOKEN]",
+        options: .regularExpression
+    )
+
+    // Redact any base64-encoded OAuth tokens (they start with eyJ for JWT)
+    result = result.replacingOccurrences(
+        of: #"eyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+"#,
+        with: "[REDACTED_TOKEN]",
+        options: .regularExpression
+    )
+
+    // Redact any standalone base64 strings that look like tokens (40+ chars of base64)
+    result = result.replacingOccurrences(
+        of: #"(?<![A-Za-z0-9])[A-Za-z0-9+/=]{40,}(?![A-Za-z0-9])"#,
+        with: "[REDACTED_TOKEN]",
+        options: .regularExpression
+    )
+
+    return result
+}
+
 /// Service for writing detailed logs to file
 actor LoggingService {
     static let shared = LoggingService()
@@ -90,6 +149,9 @@ actor LoggingService {
 
         guard level >= currentLevel else { return }
 
+        // Credentials must never reach the log file or the system console
+        let message = redactSensitiveData(message)
+
         let timestamp = dateFormatter.string(from: Date())
         let fileName = (file as NSString).lastPathComponent
         let logMessage = "\(timestamp) \(level.prefix) [\(fileName):\(line)] \(function): \(message)\n"
@@ -226,6 +288,29 @@ actor LoggingService {
     }
 }
 
+// MARK: - Injectable logger
+
+/// Where log messages go, for code that is handed a logger instead of using the shared log
+protocol BackupLogger {
+    func log(_ message: String, level: LogLevel)
+}
+
+/// The app's log file and the system console
+struct AppLogger: BackupLogger {
+    func log(_ message: String, level: LogLevel) {
+        switch level {
+        case .debug:
+            logDebug(message)
+        case .info:
+            logInfo(message)
+        case .warning:
+            logWarning(message)
+        case .error:
+            logError(message)
+        }
+    }
+}
+
 // MARK: - Convenience global functions
 
 func logDebug(_ message: String, file: String = #file, function: String = #function, line: Int = #line) {
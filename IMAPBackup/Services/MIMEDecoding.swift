@@ -0,0 +1,212 @@
+import Foundation
+
+/// Charset and transfer-encoding decoding shared by the header and attachment parsers.
+/// Everything here is a pure function of its input, so messages can be parsed from any
+/// number of tasks at once.
+enum MIMEDecoding {
+
+    /// Text of `data` in an IANA charset such as "iso-8859-1" or "koi8-r",
+    /// falling back to UTF-8 when the charset is unknown or the bytes do not fit it
+    static func string(from data: Data, charset: String) -> String? {
+        let cfEncoding = CFStringConvertIANACharSetNameToEncoding(charset.lowercased() as CFString)
+        if cfEncoding != kCFStringEncodingInvalidId {
+            let encoding = String.Encoding(rawValue: CFStringConvertEncodingToNSStringEncoding(cfEncoding))
+            if let decoded = String(data: data, encoding: encoding) {
+                return decoded
+            }
+        }
+        return String(data: data, encoding: .utf8)
+    }
+
+    /// Decode RFC 2047 encoded words (=?charset?Q|B?text?=); words that cannot be decoded are kept
+    static func decodeEncodedWords(_ input: String) -> String {
+        guard let regex = encodedWordRegex else {
+            return input
+        }
+
+        // Whitespace between two encoded words is not part of the text, e.g. a long name split in two
+        let text = encodedWordGapRegex?.stringByReplacingMatches(
+            in: input, range: NSRange(input.startIndex..., in: input), withTemplate: ""
+        ) ?? input
+
+        var result = text
+        let matches = regex.matches(in: text, range: NSRange(text.startIndex..., in: text))
+
+        // Process matches in reverse order to preserve string indices
+        for match in matches.reversed() {
+            guard let fullRange = Range(match.range, in: result),
+                  let charsetRange = Range(match.range(at: 1), in: result),
+                  let encodingRange = Range(match.range(at: 2), in: result),
+                  let textRange = Range(match.range(at: 3), in: result) else {
+                continue
+            }
+
+            let charset = String(result[charsetRange])
+            let encoding = String(result[encodingRange]).lowercased()
+            let encodedText = String(result[textRange])
+
+            let decodedData = encoding == "q"
+                ? decodeQuotedPrintable(encodedText, isHeader: true)
+                : Data(base64Encoded: encodedText)
+
+            if let data = decodedData, let decoded = string(from: data, charset: charset) {
+                result.replaceSubrange(fullRange, with: decoded)
+            }
+        }
+
+        return result
+    }
+
+    /// Compiled once; NSRegularExpression is immutable and can be shared between threads
+    private static let encodedWordRegex = try? NSRegularExpression(pattern: #"=\?([^?]+)\?([QqBb])\?([^?]*)\?="#)
+    private static let encodedWordGapRegex = try? NSRegularExpression(pattern: #"(?<=\?=)\s+(?==\?[^?]+\?[QqBb]\?[^?]*\?=)"#)
+
+    /// Value of the parameter `name` in a header such as Content-Disposition, decoded: RFC 2231
+    /// extended values (name*=charset'language'%XX) and continuations (name*0*=, name*1=) are
+    /// joined and decoded in their charset, and plain values may hold RFC 2047 encoded words.
+    /// Nil when the header has no such parameter.
+    static func headerParameter(_ name: String, in header: String) -> String? {
+        let name = name.lowercased()
+        var plain: String?
+        var sections: [Int: (value: String, encoded: Bool)] = [:]
+
+        for parameter in headerParameters(header) {
+            if parameter.name == name {
+                plain = plain ?? parameter.value
+            } else if parameter.name == name + "*" {
+                // A single extended value is an encoded section 0
+                sections[0] = sections[0] ?? (parameter.value, true)
+            } else if parameter.name.hasPrefix(name + "*") {
+                var number = parameter.name.dropFirst(name.count + 1)
+                let encoded = number.hasSuffix("*")
+                if encoded {
+                    number = number.dropLast()
+                }
+                if let index = Int(number), index >= 0, sections[index] == nil {
+                    sections[index] = (parameter.value, encoded)
+                }
+            }
+        }
+
+        return joinSections(sections) ?? plain.map(decodeEncodedWords)
+    }
+
+    /// RFC 2231 sections from 0 up to the first missing one, as text in the charset named by section 0.
+    /// Encoded sections are percent-decoded to bytes first, so any charset works, not only UTF-8.
+    private static func joinSections(_ sections: [Int: (value: String, encoded: Bool)]) -> String? {
+        var charset = "utf-8"
+        var bytes = Data()
+        var index = 0
+
+        while let section = sections[index] {
+            var value = section.value
+            if section.encoded {
+                if index == 0 {
+                    let parts = value.split(separator: "'", maxSplits: 2, omittingEmptySubsequences: false)
+                    if parts.count == 3 {
+                        if !parts[0].isEmpty {
+                            charset = String(parts[0])
+                        }
+                        value = String(parts[2])
+                    }
+                }
+                bytes.append(percentDecoded(value))
+            } else {
+                bytes.append(Data(value.utf8))
+            }
+            index += 1
+        }
+        guard index > 0 else { return nil }
+
+        // Bytes that fit neither the charset nor UTF-8 still leave the readable part of the name
+        return string(from: bytes, charset: charset) ?? String(decoding: bytes, as: UTF8.self)
+    }
+
+    /// Bytes of %XX escapes, other characters as their UTF-8 bytes
+    private static func percentDecoded(_ value: String) -> Data {
+        let utf8 = Array(value.utf8)
+        var result = Data()
+        var index = 0
+
+        while index < utf8.count {
+            let hex = index + 2 < utf8.count ? String(decoding: utf8[(index + 1)...(index + 2)], as: UTF8.self) : ""
+            if utf8[index] == UInt8(ascii: "%"), hex.allSatisfy(\.isHexDigit), let byte = UInt8(hex, radix: 16) {
+                result.append(byte)
+                index += 3
+            } else {
+                result.append(utf8[index])
+                index += 1
+            }
+        }
+        return result
+    }
+
+    /// Parameters of a header value, e.g. ("filename", "a.pdf") from `attachment; filename="a.pdf"`,
+    /// with names lowercased and quotes removed. A semicolon inside quotes does not end a value.
+    private static func headerParameters(_ header: String) -> [(name: String, value: String)] {
+        var segments: [String] = []
+        var current = ""
+        var inQuotes = false
+        var escaped = false
+
+        for character in header {
+            if escaped {
+                escaped = false
+            } else if character == "\\" && inQuotes {
+                escaped = true
+            } else if character == "\"" {
+                inQuotes.toggle()
+            } else if character == ";" && !inQuotes {
+                segments.append(current)
+                current = ""
+                continue
+            }
+            current.append(character)
+        }
+        segments.append(current)
+
+        return segments.compactMap { segment in
+            guard let equals = segment.firstIndex(of: "=") else { return nil }
+            let name = segment[..<equals].trimmingCharacters(in: .whitespacesAndNewlines).lowercased()
+            var value = segment[segment.index(after: equals)...].trimmingCharacters(in: .whitespacesAndNewlines)
+            if value.count >= 2, value.hasPrefix("\""), value.hasSuffix("\"") {
+                value = String(value.dropFirst().dropLast())
+                    .replacingOccurrences(of: #"\\(.)"#, with: "$1", options: .regularExpression)
+            }
+            return name.isEmpty ? nil : (name, value)
+        }
+    }
+
+    /// Decode quoted-printable; in headers an underscore stands for a space
+    static func decodeQuotedPrintable(_ input: String, isHeader: Bool = false) -> Data? {
+        var result = Data()
+        var index = input.startIndex
+
+        while index < input.endIndex {
+            let char = input[index]
+
+            if char == "=" && input.index(index, offsetBy: 2, limitedBy: input.endIndex) != nil {
+                let hexStart = input.index(after: index)
+                let hexEnd = input.index(hexStart, offsetBy: 2, limitedBy: input.endIndex) ?? input.endIndex
+                let hex = String(input[hexStart..<hexEnd])
+
+                if let byte = UInt8(hex, radix: 16) {
+                    result.append(byte)
+                    index = hexEnd
+                    continue
+                }
+            } else if isHeader && char == "_" {
+                result.append(0x20)
+                index = input.index(after: index)
+                continue
+            }
+
+            if let byte = String(char).data(using: .utf8) {
+                result.append(byte)
+            }
+            index = input.index(after: index)
+        }
+
+        return result
+    }
+}
@@ -0,0 +1,179 @@
+import Foundation
+import SQLite3
+
+/// An email account found in macOS Internet Accounts
+struct DiscoveredMailAccount: Identifiable, Hashable {
+    let id: String
+    let accountDescription: String
+    let username: String
+    let hostname: String?
+    let port: Int?
+    let useSSL: Bool
+    let isGoogle: Bool
+}
+
+enum MacAccountImportError: LocalizedError {
+    case databaseUnavailable(String)
+
+    var errorDescription: String? {
+        switch self {
+        case .databaseUnavailable(let message):
+            return "Cannot read macOS Internet Accounts: \(message). Grant MailKeep Full Disk Access in System Settings > Privacy & Security."
+        }
+    }
+}
+
+/// Discovers email accounts configured in macOS and converts them into backup accounts.
+/// Passwords of discovered accounts are owned by the system and cannot be read; imported
+/// password accounts must have their password entered once, Google accounts sign in via OAuth.
+enum MacAccountImportService {
+
+    /// Location of the Internet Accounts database
+    static var accountsDatabaseURL: URL {
+        FileManager.default.homeDirectoryForCurrentUser
+            .appendingPathComponent("Library/Accounts/Accounts4.sqlite")
+    }
+
+    // MARK: - Discovery
+
+    /// Read IMAP and Google accounts from the Internet Accounts database
+    static func discoverAccounts(databaseURL: URL = accountsDatabaseURL) throws -> [DiscoveredMailAccount] {
+        guard FileManager.default.fileExists(atPath: databaseURL.path) else {
+            return []
+        }
+
+        var db: OpaquePointer?
+        defer { sqlite3_close(db) }
+
+        guard sqlite3_open_v2(databaseURL.path, &db, SQLITE_OPEN_READONLY, nil) == SQLITE_OK else {
+            throw MacAccountImportError.databaseUnavailable(String(cString: sqlite3_errmsg(db)))
+        }
+
+        let query = """
+            SELECT a.Z_PK, a.ZIDENTIFIER, a.ZACCOUNTDESCRIPTION, a.ZUSERNAME, t.ZIDENTIFIER
+            FROM ZACCOUNT a JOIN ZACCOUNTTYPE t ON a.ZACCOUNTTYPE = t.Z_PK
+            WHERE t.ZIDENTIFIER LIKE '%IMAP%' OR t.ZIDENTIFIER = 'com.apple.account.Google'
+            """
+
+        var statement: OpaquePointer?
+        defer { sqlite3_finalize(statement) }
+
+        guard sqlite3_prepare_v2(db, query, -1, &statement, nil) == SQLITE_OK else {
+            throw MacAccountImportError.databaseUnavailable(String(cString: sqlite3_errmsg(db)))
+        }
+
+        var accounts: [DiscoveredMailAccount] = []
+        while sqlite3_step(statement) == SQLITE_ROW {
+            let primaryKey = sqlite3_column_int64(statement, 0)
+            guard let username = columnText(statement, 3), !username.isEmpty else { continue }
+
+            let identifier = columnText(statement, 1) ?? UUID().uuidString
+            let typeIdentifier = columnText(statement, 4) ?? ""
+            let properties = readProperties(db: db, owner: primaryKey)
+
+            accounts.append(DiscoveredMailAccount(
+                id: identifier,
+                accountDescription: columnText(statement, 2) ?? username,
+                username: username,
+                hostname: properties["Hostname"] as? String,
+                port: (properties["PortNumber"] as? NSNumber)?.intValue,
+                useSSL: (properties["SSLEnabled"] as? NSNumber)?.boolValue ?? true,
+                isGoogle: typeIdentifier == "com.apple.account.Google"
+            ))
+        }
+
+        logInfo("Discovered \(accounts.count) email accounts in macOS Internet Accounts")
+        return accounts
+    }
+
+    /// Read the archived key/value properties of an account
+    private static func readProperties(db: OpaquePointer?, owner: Int64) -> [String: Any] {
+        let query = "SELECT ZKEY, ZVALUE FROM ZACCOUNTPROPERTY WHERE ZOWNER = ?"
+
+        var statement: OpaquePointer?
+        defer { sqlite3_finalize(statement) }
+
+        guard sqlite3_prepare_v2(db, query, -1, &statement, nil) == SQLITE_OK else {
+            return [:]
+        }
+        sqlite3_bind_int64(statement, 1, owner)
+
+        var properties: [String: Any] = [:]
+        while sqlite3_step(statement) == SQLITE_ROW {
+            guard let key = columnText(statement, 0),
+                  let bytes = sqlite3_column_blob(statement, 1) else { continue }
+            let data = Data(bytes: bytes, count: Int(sqlite3_column_bytes(statement, 1)))
+
+            // Values are keyed archives, older databases use plain property lists
+            if let value = try? NSKeyedUnarchiver.unarchivedObject(ofClasses: [NSString.self, NSNumber.self], from: data) {
+                properties[key] = value
+            } else if let value = try? PropertyListSerialization.propertyList(from: data, format: nil) {
+                properties[key] = value
+            }
+        }
+        return properties
+    }
+
+    private static func columnText(_ statement: OpaquePointer?, _ index: Int32) -> String? {
+        guard let text = sqlite3_column_text(statement, index) else { return nil }
+        return String(cString: text)
+    }
+
+    // MARK: - Conversion
+
+    /// Convert a discovered account into a backup account. Settings missing from the discovery
+    /// are taken from the provider table when the address belongs to a known provider; nil
+    /// if the account would still have no server or no usable port.
+    static func convert(_ discovered: DiscoveredMailAccount) -> EmailAccount? {
+        if discovered.isGoogle {
+            return .gmailOAuth(email: discovered.username)
+        }
+
+        let hostname = discovered.hostname?.trimmingCharacters(in: .whitespaces) ?? ""
+        // A port of 0 is as good as none
+        let discoveredPort = discovered.port.flatMap { (1...65535).contains($0) ? $0 : nil }
+
+        if !hostname.isEmpty {
+            return EmailAccount(
+                email: discovered.username,
+                imapServer: hostname,
+                port: discoveredPort ?? (discovered.useSSL ? 993 : 143),
+                username: discovered.username,
+                useSSL: discovered.useSSL,
+                authType: .password
+            )
+        } else if let provider = MailProvider.forEmail(discovered.username) {
+            // Without a discovered host the discovered port and SSL setting mean nothing either
+            logInfo("Completed \(discovered.username) with the IMAP settings of \(provider.name)")
+            return EmailAccount(
+                email: discovered.username,
+                imapServer: provider.host,
+                port: provider.port,
+                username: discovered.username,
+                useSSL: true,
+                authType: .password
+            )
+        } else {
+            logWarning("Skipping \(discovered.username): no IMAP server in its settings")
+            return nil
+        }
+    }
+
+    /// Convert discovered accounts, skipping those already configured (same username and host)
+    static func importableAccounts(from discovered: [DiscoveredMailAccount], existing: [EmailAccount]) -> [EmailAccount] {
+        var seen = Set(existing.map { dedupKey(username: $0.username, host: $0.imapServer) })
+        var result: [EmailAccount] = []
+
+        for account in discovered.compactMap(convert) {
+            let key = dedupKey(username: account.username, host: account.imapServer)
+            guard !seen.contains(key) else { continue }
+            seen.insert(key)
+            result.append(account)
+        }
+        return result
+    }
+
+    private static func dedupKey(username: String, host: String) -> String {
+        "\(username.lowercased())@\(host.lowercased())"
+    }
+}
@@ -0,0 +1,171 @@
+import Foundation
+
+/// What has already gone into an mbox export, kept next to it as `<name>.mbox.manifest.json`
+/// so the next export of the same folder only appends new emails
+struct MboxExportManifest: Codable, Equatable {
+    struct Entry: Codable, Equatable {
+        let uid: UInt32
+        let exportedAt: Date
+    }
+
+    var entries: [Entry] = []
+    var lastExportedAt: Date?
+    /// Length of the mbox the entries describe. Anything after it was written by a run that
+    /// stopped before saving the manifest, and is cut off so those emails are not in it twice.
+    var mboxSize: UInt64?
+
+    var exportedUIDs: Set<UInt32> {
+        Set(entries.map(\.uid))
+    }
+}
+
+/// Outcome of one export run
+struct MboxExportResult: Equatable {
+    /// Emails appended to the mbox in this run
+    let appended: Int
+    /// Emails already in the mbox from an earlier run
+    let alreadyExported: Int
+}
+
+/// Exports a backed-up folder to a single mbox file (mboxrd quoting).
+/// Emails are written in UID order, i.e. the order they arrived on the server. An incremental export
+/// appends what was backed up since the last run at the end, so an email with an older date that
+/// arrived late ends up after newer ones rather than being sorted in.
+enum MboxExportService {
+    static func manifestURL(for mboxURL: URL) -> URL {
+        mboxURL.appendingPathExtension("manifest.json")
+    }
+
+    /// Append the folder's emails that are not in the mbox yet and update its manifest.
+    /// Without the mbox, or without its manifest, the export starts over from scratch.
+    /// A cancelled task stops between emails with `CancellationError`; what was written by then
+    /// is complete and in the manifest, so the next export carries on from there.
+    @discardableResult
+    static func exportFolder(
+        at folderURL: URL,
+        to mboxURL: URL,
+        now: Date = Date(),
+        progress: ((_ exported: Int, _ total: Int) -> Void)? = nil
+    ) throws -> MboxExportResult {
+        let fileManager = FileManager.default
+        var manifest = MboxExportManifest()
+        if fileManager.fileExists(atPath: mboxURL.path) {
+            if let loaded = loadManifest(for: mboxURL) {
+                manifest = loaded
+            } else {
+                logWarning("No export manifest for \(mboxURL.lastPathComponent), exporting the whole folder again")
+            }
+        }
+
+        let exported = manifest.exportedUIDs
+        // One entry per UID, also when a UID has more than one file
+        var queued = exported
+        let pending = try emailFiles(in: folderURL).filter { queued.insert($0.uid).inserted }
+
+        if manifest.entries.isEmpty {
+            try Data().write(to: mboxURL, options: .atomic)
+        }
+        let handle = try FileHandle(forWritingTo: mboxURL)
+        defer { try? handle.close() }
+        let end = try handle.seekToEnd()
+        if let recorded = manifest.mboxSize, end > recorded {
+            logWarning("\(mboxURL.lastPathComponent) has \(end - recorded) bytes its manifest does not list, removing them")
+            try handle.truncate(atOffset: recorded)
+        }
+        manifest.mboxSize = min(end, manifest.mboxSize ?? end)
+
+        var appended = 0
+        defer {
+            // Also on errors and cancellation, so the manifest matches what is in the mbox
+            manifest.lastExportedAt = now
+            do {
+                try saveManifest(manifest, for: mboxURL)
+            } catch {
+                logError("Failed to save export manifest for \(mboxURL.lastPathComponent): \(error.localizedDescription)")
+            }
+        }
+
+        for (uid, url) in pending {
+            guard !Task.isCancelled else {
+                logInfo("Export to \(mboxURL.lastPathComponent) cancelled after \(appended) of \(pending.count) emails")
+                throw CancellationError()
+            }
+            let data = try Data(contentsOf: url)
+            let modified = (try? url.resourceValues(forKeys: [.contentModificationDateKey]))?.contentModificationDate
+            try handle.write(contentsOf: mboxEntry(for: data, date: modified ?? now))
+            manifest.entries.append(MboxExportManifest.Entry(uid: uid, exportedAt: now))
+            manifest.mboxSize = try handle.offset()
+            appended += 1
+            progress?(appended, pending.count)
+        }
+
+        if !pending.isEmpty {
+            logInfo("Exported \(pending.count) emails from \(folderURL.lastPathComponent) to \(mboxURL.lastPathComponent)")
+        }
+        return MboxExportResult(appended: pending.count, alreadyExported: exported.count)
+    }
+
+    static func loadManifest(for mboxURL: URL) -> MboxExportManifest? {
+        guard let data = try? Data(contentsOf: manifestURL(for: mboxURL)) else { return nil }
+        let decoder = JSONDecoder()
+        decoder.dateDecodingStrategy = .iso8601
+        return try? decoder.decode(MboxExportManifest.self, from: data)
+    }
+
+    private static func saveManifest(_ manifest: MboxExportManifest, for mboxURL: URL) throws {
+        let encoder = JSONEncoder()
+        encoder.dateEncodingStrategy = .iso8601
+        encoder.outputFormatting = [.prettyPrinted, .sortedKeys]
+        try encoder.encode(manifest).write(to: manifestURL(for: mboxURL), options: .atomic)
+    }
+
+    /// The folder's .eml files by UID, oldest arrival first
+    private static func emailFiles(in folderURL: URL) throws -> [(uid: UInt32, url: URL)] {
+        try StorageService.messageFiles(in: folderURL)
+            .filter { $0.pathExtension == "eml" }
+            .compactMap { url -> (uid: UInt32, url: URL)? in
+                let name = url.deletingPathExtension().lastPathComponent
+                guard let underscore = name.firstIndex(of: "_"), let uid = UInt32(name[..<underscore]) else {
+                    return nil
+                }
+                return (uid, url)
+            }
+            .sorted { $0.uid < $1.uid }
+    }
+
+    // MARK: - mbox Format
+
+    /// One message as it goes into the mbox: a From_ line, the message with LF line endings
+    /// and `>` added to lines starting with `From ` (or `>From `), then a blank line
+    static func mboxEntry(for emailData: Data, date: Date) -> Data {
+        // Work on bytes so 8-bit bodies in other charsets pass through unchanged
+        var lines = emailData.split(separator: UInt8(ascii: "\n"), omittingEmptySubsequences: false)
+        if lines.last?.isEmpty == true {
+            lines.removeLast()
+        }
+
+        var entry = Data("From MAILER-DAEMON \(fromLineFormatter.string(from: date))\n".utf8)
+        for var line in lines {
+            if line.last == UInt8(ascii: "\r") {
+                line = line.dropLast()
+            }
+            if line.drop(while: { $0 == UInt8(ascii: ">") }).starts(with: fromPrefix) {
+                entry.append(UInt8(ascii: ">"))
+            }
+            entry.append(contentsOf: line)
+            entry.append(UInt8(ascii: "\n"))
+        }
+        entry.append(UInt8(ascii: "\n"))
+        return entry
+    }
+
+    private static let fromPrefix = Array("From ".utf8)
+
+    private static let fromLineFormatter: DateFormatter = {
+        let formatter = DateFormatter()
+        formatter.locale = Locale(identifier: "en_US_POSIX")
+        formatter.timeZone = TimeZone(identifier: "UTC")
+        formatter.dateFormat = "EEE MMM d HH:mm:ss yyyy"
+        return formatter
+    }()
+}
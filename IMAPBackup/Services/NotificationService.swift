@@ -1,8 +1,14 @@
 import Foundation
 import UserNotifications
 
+/// Told when a backup ends, for code that is handed a notifier instead of using the system one
+protocol BackupNotifier {
+    func notifyBackupCompleted(account: String, emailsDownloaded: Int, totalEmails: Int, errors: Int)
+    func notifyBackupFailed(account: String, error: String, kind: FailureKind)
+}
+
 /// Service for managing system notifications
-class NotificationService {
+class NotificationService: BackupNotifier {
     static let shared = NotificationService()
 
     private init() {
@@ -14,7 +20,7 @@ class NotificationService {
     func requestAuthorization() {
         UNUserNotificationCenter.current().requestAuthorization(options: [.alert, .sound, .badge]) { granted, error in
             if let error = error {
-                print("Notification authorization error: \(error)")
+                logWarning("Notification authorization error: \(error.localizedDescription)")
             }
         }
     }
@@ -47,10 +53,13 @@ class NotificationService {
         UNUserNotificationCenter.current().add(request)
     }
 
-    func notifyBackupFailed(account: String, error: String) {
+    func notifyBackupFailed(account: String, error: String, kind: FailureKind) {
         let content = UNMutableNotificationContent()
-        content.title = "Backup Failed"
+        content.title = kind == .other ? "Backup Failed" : "Backup Failed: \(kind.displayName)"
         content.body = "\(account): \(error)"
+        if let advice = kind.advice {
+            content.body += " \(advice)"
+        }
         content.sound = .default
         content.categoryIdentifier = "BACKUP_ERROR"
 
@@ -0,0 +1,136 @@
+import Foundation
+import Network
+
+/// Receives the browser's redirect to a loopback address at the end of a sign-in, the flow Google
+/// prescribes for desktop clients whose client secret file registers http://localhost (RFC 8252 section 7.3)
+final class OAuthLoopbackReceiver {
+    private let queue = DispatchQueue(label: "OAuthLoopbackReceiver")
+    private let listener: NWListener
+    private var connections: [NWConnection] = []
+    private var result: Result<URL, Error>?
+    private var continuation: CheckedContinuation<URL, Error>?
+
+    /// Listens on a free port of 127.0.0.1 once started
+    init() throws {
+        let parameters = NWParameters.tcp
+        parameters.requiredLocalEndpoint = .hostPort(host: "127.0.0.1", port: .any)
+        listener = try NWListener(using: parameters)
+    }
+
+    /// Start listening, returning once the port is known
+    func start() async throws {
+        try await withCheckedThrowingContinuation { (continuation: CheckedContinuation<Void, Error>) in
+            var resumed = false
+            listener.stateUpdateHandler = { state in
+                guard !resumed else { return }
+                switch state {
+                case .ready:
+                    resumed = true
+                    continuation.resume()
+                case .failed(let error):
+                    resumed = true
+                    continuation.resume(throwing: error)
+                default:
+                    break
+                }
+            }
+            listener.newConnectionHandler = { [weak self] connection in
+                self?.accept(connection)
+            }
+            listener.start(queue: queue)
+        }
+    }
+
+    func stop() {
+        listener.cancel()
+        queue.sync {
+            connections.forEach { $0.cancel() }
+            connections.removeAll()
+        }
+    }
+
+    var port: Int {
+        Int(listener.port?.rawValue ?? 0)
+    }
+
+    /// The registered redirect, e.g. "http://localhost", with the port this receiver listens on
+    func redirectUri(for registered: String) -> String {
+        guard var components = URLComponents(string: registered) else { return registered }
+        components.port = port
+        return components.string ?? registered
+    }
+
+    /// The URL the browser was redirected to, carrying the authorization code or the error.
+    /// Gives up after `timeout` seconds, e.g. when the browser window was closed.
+    func waitForCallback(timeout: TimeInterval = 300) async throws -> URL {
+        queue.asyncAfter(deadline: .now() + timeout) { [weak self] in
+            self?.finish(.failure(GoogleOAuthError.authSessionFailed("No answer from the browser")))
+        }
+        return try await withCheckedThrowingContinuation { continuation in
+            queue.async {
+                if let result = self.result {
+                    continuation.resume(with: result)
+                } else {
+                    self.continuation = continuation
+                }
+            }
+        }
+    }
+
+    // MARK: - Connections
+
+    private func accept(_ connection: NWConnection) {
+        connections.append(connection)
+        connection.start(queue: queue)
+        receive(on: connection, buffer: Data())
+    }
+
+    private func receive(on connection: NWConnection, buffer: Data) {
+        connection.receive(minimumIncompleteLength: 1, maximumLength: 65536) { [weak self] data, _, isComplete, error in
+            guard let self = self else { return }
+            var buffer = buffer
+            if let data = data {
+                buffer.append(data)
+            }
+
+            // Only the request line matters: "GET /?code=...&state=... HTTP/1.1"
+            guard let end = buffer.range(of: Data("\r\n".utf8)) else {
+                if error == nil && !isComplete {
+                    self.receive(on: connection, buffer: buffer)
+                } else {
+                    connection.cancel()
+                }
+                return
+            }
+            let requestLine = String(decoding: buffer[..<end.lowerBound], as: UTF8.self)
+            let words = requestLine.split(separator: " ")
+            let callbackURL = words.count >= 2 ? URL(string: "http://127.0.0.1:\(self.port)\(words[1])") : nil
+            let query = callbackURL.flatMap { URLComponents(url: $0, resolvingAgainstBaseURL: false)?.queryItems } ?? []
+
+            // The browser may also ask for a favicon, which is not the redirect
+            guard let url = callbackURL, query.contains(where: { $0.name == "code" || $0.name == "error" }) else {
+                self.respond(on: connection, status: "404 Not Found", message: "Not found")
+                return
+            }
+            self.respond(on: connection, status: "200 OK", message: "You can close this window and return to MailKeep.")
+            self.finish(.success(url))
+        }
+    }
+
+    private func respond(on connection: NWConnection, status: String, message: String) {
+        let body = "<html><body><p>\(message)</p></body></html>"
+        let response = "HTTP/1.1 \(status)\r\nContent-Type: text/html; charset=utf-8\r\n"
+            + "Content-Length: \(body.utf8.count)\r\nConnection: close\r\n\r\n\(body)"
+        connection.send(content: Data(response.utf8), completion: .contentProcessed { _ in
+            connection.cancel()
+        })
+    }
+
+    /// Runs on `queue`; only the first result counts
+    private func finish(_ result: Result<URL, Error>) {
+        guard self.result == nil else { return }
+        self.result = result
+        continuation?.resume(with: result)
+        continuation = nil
+    }
+}
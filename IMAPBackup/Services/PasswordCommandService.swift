@@ -0,0 +1,156 @@
+import Foundation
+
+enum PasswordCommandError: LocalizedError, Equatable {
+    case invalidCommand(String)
+    case launchFailed(String)
+    case failed(status: Int32)
+    case timedOut(TimeInterval)
+    case emptyOutput
+
+    var errorDescription: String? {
+        switch self {
+        case .invalidCommand(let reason):
+            return "Invalid password command: \(reason)"
+        case .launchFailed(let message):
+            return "Could not run password command: \(message)"
+        case .failed(let status):
+            return "Password command exited with status \(status)"
+        case .timedOut(let seconds):
+            return "Password command did not finish within \(Int(seconds)) seconds"
+        case .emptyOutput:
+            return "Password command printed no password"
+        }
+    }
+}
+
+/// Runs an account's password command, e.g. `pass show email/work`, and returns what it prints.
+/// The command is split into arguments and started without a shell, so quotes group words
+/// but `;`, `|` or `$(...)` are passed on literally. The output is never logged.
+enum PasswordCommandService {
+
+    static let defaultTimeout: TimeInterval = 10
+
+    /// Directories searched for the command in addition to the app's PATH, which does not
+    /// include Homebrew when launched from Finder
+    static let extraSearchPaths = ["/opt/homebrew/bin", "/usr/local/bin"]
+
+    static func run(_ command: String, timeout: TimeInterval = defaultTimeout) async throws -> String {
+        let arguments = try splitArguments(command)
+        guard !arguments.isEmpty else {
+            throw PasswordCommandError.invalidCommand("empty command")
+        }
+
+        let process = Process()
+        // env looks the program up in PATH without involving a shell
+        process.executableURL = URL(fileURLWithPath: "/usr/bin/env")
+        process.arguments = ["--"] + arguments
+        var environment = ProcessInfo.processInfo.environment
+        environment["PATH"] = searchPath(environment["PATH"])
+        process.environment = environment
+
+        let output = Pipe()
+        process.standardOutput = output
+        process.standardError = FileHandle.nullDevice
+        process.standardInput = FileHandle.nullDevice
+
+        return try await withCheckedThrowingContinuation { continuation in
+            DispatchQueue.global(qos: .userInitiated).async {
+                do {
+                    try process.run()
+                } catch {
+                    continuation.resume(throwing: PasswordCommandError.launchFailed(error.localizedDescription))
+                    return
+                }
+
+                let deadline = Date().addingTimeInterval(timeout)
+                let timer = DispatchWorkItem { process.terminate() }
+                DispatchQueue.global().asyncAfter(deadline: .now() + timeout, execute: timer)
+
+                let data = output.fileHandleForReading.readDataToEndOfFile()
+                process.waitUntilExit()
+                timer.cancel()
+
+                if process.terminationReason == .uncaughtSignal && Date() >= deadline {
+                    continuation.resume(throwing: PasswordCommandError.timedOut(timeout))
+                } else if process.terminationStatus != 0 {
+                    continuation.resume(throwing: PasswordCommandError.failed(status: process.terminationStatus))
+                } else if let password = password(from: data) {
+                    continuation.resume(returning: password)
+                } else {
+                    continuation.resume(throwing: PasswordCommandError.emptyOutput)
+                }
+            }
+        }
+    }
+
+    /// The first line of the output without its line ending, like `pass` and `op` print it
+    static func password(from output: Data) -> String? {
+        guard let text = String(data: output, encoding: .utf8) else { return nil }
+        let firstLine = text.split(separator: "\n", maxSplits: 1, omittingEmptySubsequences: false).first ?? ""
+        let password = firstLine.hasSuffix("\r") ? String(firstLine.dropLast()) : String(firstLine)
+        return password.isEmpty ? nil : password
+    }
+
+    /// Split a command line into arguments with POSIX shell quoting rules:
+    /// whitespace separates, '...' is literal, "..." allows \" and \\, a backslash escapes the next character
+    static func splitArguments(_ command: String) throws -> [String] {
+        var arguments: [String] = []
+        var current = ""
+        var inArgument = false
+        var quote: Character?
+        var iterator = command.makeIterator()
+
+        while let character = iterator.next() {
+            switch (quote, character) {
+            case ("'"?, "'"), ("\""?, "\""):
+                quote = nil
+            case ("'"?, _):
+                current.append(character)
+            case ("\""?, "\\"):
+                guard let next = iterator.next() else {
+                    throw PasswordCommandError.invalidCommand("unterminated quote")
+                }
+                if next != "\"" && next != "\\" {
+                    current.append(character)
+                }
+                current.append(next)
+            case ("\""?, _):
+                current.append(character)
+            case (nil, "'"), (nil, "\""):
+                quote = character
+                inArgument = true
+            case (nil, "\\"):
+                guard let next = iterator.next() else {
+                    throw PasswordCommandError.invalidCommand("trailing backslash")
+                }
+                current.append(next)
+                inArgument = true
+            case (nil, _) where character.isWhitespace:
+                if inArgument {
+                    arguments.append(current)
+                    current = ""
+                    inArgument = false
+                }
+            default:
+                current.append(character)
+                inArgument = true
+            }
+        }
+
+        guard quote == nil else {
+            throw PasswordCommandError.invalidCommand("unterminated quote")
+        }
+        if inArgument {
+            arguments.append(current)
+        }
+        return arguments
+    }
+
+    private static func searchPath(_ path: String?) -> String {
+        var directories = (path ?? "/usr/bin:/bin:/usr/sbin:/sbin").components(separatedBy: ":")
+        for directory in extraSearchPaths where !directories.contains(directory) {
+            directories.append(directory)
+        }
+        return directories.joined(separator: ":")
+    }
+}
@@ -6,7 +6,7 @@ struct RateLimitSettings: Codable, Hashable {
     /// Minimum delay between requests in milliseconds
     var requestDelayMs: Int = 100
 
-    /// Maximum concurrent connections (not used yet, for future)
+    /// Maximum concurrent connections per account, caps parallel downloads within a folder
     var maxConcurrentRequests: Int = 5
 
     /// Whether rate limiting is enabled
@@ -20,6 +20,16 @@ struct RateLimitSettings: Codable, Hashable {
 
     static let `default` = RateLimitSettings()
 
+    /// Connections one folder is downloaded over, the main one included: `requested`, but no more than
+    /// `maxConcurrentRequests` nor the provider's known limit
+    func folderConnections(requested: Int, quirks: IMAPServerQuirks?) -> Int {
+        var connections = min(requested, maxConcurrentRequests)
+        if let maxConnections = quirks?.maxConnections {
+            connections = min(connections, maxConnections)
+        }
+        return max(connections, 1)
+    }
+
     /// Preset for conservative rate limiting (slow but safe)
     static let conservative = RateLimitSettings(
         requestDelayMs: 500,
@@ -39,7 +49,13 @@ struct RateLimitSettings: Codable, Hashable {
     )
 }
 
-/// Tracks throttling state for a connection
+/// Tracks throttling state for a server.
+///
+/// Sharing model: every IMAPService that is handed the same tracker draws from one
+/// request budget, so N concurrent connections to a host together make at most one
+/// request per `requestDelayMs` rather than N. RateLimitService hands out one tracker
+/// per server hostname; services configured without a tracker get their own and do
+/// not affect each other.
 actor ThrottleTracker {
     private var currentDelayMs: Int
     private var baseDelayMs: Int
@@ -57,21 +73,23 @@ actor ThrottleTracker {
 
     /// Wait for rate limit before proceeding
     func waitForRateLimit() async {
-        // Calculate time since last request
+        // Reserve the next slot before suspending so concurrent callers queue up
+        // behind each other instead of all seeing the same last request time
+        let now = Date()
+        var slot = now
         if let lastTime = lastRequestTime {
-            let elapsed = Date().timeIntervalSince(lastTime) * 1000  // in ms
-            let remainingDelay = Double(currentDelayMs) - elapsed
-
-            if remainingDelay > 0 {
-                do {
-                    try await Task.sleep(nanoseconds: UInt64(remainingDelay) * Constants.nanosecondsPerMillisecond)
-                } catch {
-                    // Task cancelled, just continue
-                }
+            slot = max(now, lastTime.addingTimeInterval(Double(currentDelayMs) / 1000))
+        }
+        lastRequestTime = slot
+
+        let remainingDelay = slot.timeIntervalSince(now) * 1000  // in ms
+        if remainingDelay > 0 {
+            do {
+                try await Task.sleep(nanoseconds: UInt64(remainingDelay) * Constants.nanosecondsPerMillisecond)
+            } catch {
+                // Task cancelled, just continue
             }
         }
-
-        lastRequestTime = Date()
     }
 
     /// Called when server indicates throttling
@@ -211,7 +229,8 @@ class RateLimitService: ObservableObject {
     // MARK: - Throttle Tracking (Per-Server)
 
     /// Get or create throttle tracker for a server
-    /// Multiple accounts on the same server share the same tracker
+    /// Multiple accounts and connections on the same server share the same tracker,
+    /// so their combined request rate stays within the server's limit
     func getTracker(forServer server: String, accountId: UUID) -> ThrottleTracker {
         let serverKey = server.lowercased()
 
@@ -276,6 +295,15 @@ class RateLimitService: ObservableObject {
         let errorDesc = error.localizedDescription.uppercased()
         return isThrottleResponse(errorDesc)
     }
+
+    /// Check if a response reports a daily download cap (e.g. Gmail's ~2.5 GB/day),
+    /// which waiting a few seconds will not lift
+    nonisolated static func isBandwidthCapResponse(_ response: String) -> Bool {
+        let upperResponse = response.uppercased()
+        return upperResponse.contains("BANDWIDTH LIMIT")
+            || upperResponse.contains("DOWNLOAD LIMIT")
+            || (upperResponse.contains("OVERQUOTA") && upperResponse.contains("EXCEEDED"))
+    }
 }
 
 /// Preset names for UI
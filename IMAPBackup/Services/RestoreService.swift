@@ -0,0 +1,260 @@
+import Foundation
+
+/// How messages that do not fit the server are handled, and what is added to restored messages
+struct RestoreOptions {
+    /// Replace attachments with a short note when that brings a message under APPENDLIMIT
+    var stripAttachmentsToFit = false
+    /// "Name: value" lines stamped onto every restored message, e.g. "X-Archived-From: {folder}".
+    /// `{folder}` is replaced with the backed-up folder's name and `{date}` with the time of the restore.
+    var addedHeaders: [String] = []
+}
+
+/// What a restore uploaded, trimmed, skipped and failed on
+struct RestoreReport {
+    struct Entry: Equatable {
+        let file: String
+        let reason: String
+    }
+
+    var restored = 0
+    /// Restored with their attachments removed
+    var trimmed: [Entry] = []
+    /// Not uploaded because the server would not accept their size
+    var skipped: [Entry] = []
+    var failed: [Entry] = []
+
+    var summary: String {
+        var parts = ["Restored \(restored) emails"]
+        if !trimmed.isEmpty {
+            parts.append("\(trimmed.count) without attachments")
+        }
+        if !skipped.isEmpty {
+            parts.append("skipped \(skipped.count) too large for the server")
+        }
+        if !failed.isEmpty {
+            parts.append("\(failed.count) failed")
+        }
+        return parts.joined(separator: ", ")
+    }
+}
+
+/// Uploads backed-up .eml files to a server folder with APPEND
+enum RestoreService {
+
+    /// Restore every email of a backup folder into `folder` on an already logged-in connection.
+    /// Messages over the server's APPENDLIMIT are skipped (or trimmed, see `RestoreOptions`) instead of aborting the restore.
+    static func restore(
+        folderURL: URL,
+        to folder: String,
+        using service: IMAPServiceProtocol,
+        options: RestoreOptions = RestoreOptions()
+    ) async throws -> RestoreReport {
+        let files = try StorageService.messageFiles(in: folderURL)
+            .filter { $0.pathExtension == "eml" }
+            .sorted { $0.lastPathComponent.localizedStandardCompare($1.lastPathComponent) == .orderedAscending }
+
+        let limit = try await service.appendLimit(for: folder)
+        if let limit = limit {
+            logInfo("Server accepts messages up to \(ByteCountFormatter.string(fromByteCount: Int64(limit), countStyle: .file)) in \(folder)")
+        }
+
+        var report = RestoreReport()
+        let addedHeaders = expandingPlaceholders(in: options.addedHeaders, folder: folderURL.lastPathComponent, date: Date())
+
+        for fileURL in files {
+            try Task.checkCancellation()
+            let name = fileURL.lastPathComponent
+
+            guard var data = try? Data(contentsOf: fileURL) else {
+                report.failed.append(.init(file: name, reason: "Could not read the file"))
+                continue
+            }
+            if !addedHeaders.isEmpty {
+                data = addingHeaders(addedHeaders, to: data)
+            }
+
+            var trimmed = false
+            if let limit = limit, data.count > limit {
+                guard options.stripAttachmentsToFit,
+                      let stripped = strippingAttachments(from: data),
+                      stripped.count <= limit else {
+                    let reason = "\(data.count) bytes exceeds the server's APPENDLIMIT of \(limit) bytes"
+                    logWarning("Skipping \(name): \(reason)")
+                    report.skipped.append(.init(file: name, reason: reason))
+                    continue
+                }
+                data = stripped
+                trimmed = true
+            }
+
+            do {
+                try await service.appendEmail(data, to: folder, flags: flags(for: fileURL))
+                report.restored += 1
+                if trimmed {
+                    report.trimmed.append(.init(file: name, reason: "Attachments removed to fit the server's APPENDLIMIT"))
+                }
+            } catch IMAPError.messageTooLarge {
+                // Servers that do not advertise a limit still answer [TOOBIG]
+                let reason = "Server refused \(data.count) bytes as too large"
+                logWarning("Skipping \(name): \(reason)")
+                report.skipped.append(.init(file: name, reason: reason))
+            } catch IMAPError.commandFailed(let command) {
+                report.failed.append(.init(file: name, reason: "Server rejected \(command)"))
+            }
+        }
+
+        logInfo("Restore to \(folder): \(report.summary)")
+        return report
+    }
+
+    /// Connect as `account`, restore a backup folder and log out
+    static func restore(
+        folderURL: URL,
+        account: EmailAccount,
+        to folder: String,
+        options: RestoreOptions = RestoreOptions()
+    ) async throws -> RestoreReport {
+        let imapService = IMAPService(account: account)
+        try await imapService.connect()
+        try await imapService.login()
+
+        do {
+            let report = try await restore(folderURL: folderURL, to: folder, using: imapService, options: options)
+            try? await imapService.logout()
+            return report
+        } catch {
+            await imapService.disconnect()
+            throw error
+        }
+    }
+
+    /// Flags saved in the envelope sidecar, minus the ones a server sets by itself
+    private static func flags(for emailURL: URL) -> [String] {
+        let sidecarURL = emailURL.deletingPathExtension().appendingPathExtension("envelope.json")
+        guard let data = try? Data(contentsOf: sidecarURL) else { return [] }
+
+        let decoder = JSONDecoder()
+        decoder.dateDecodingStrategy = .iso8601
+        guard let sidecar = try? decoder.decode(EnvelopeSidecar.self, from: data) else { return [] }
+        return (sidecar.flags ?? []).filter { $0.caseInsensitiveCompare("\\Recent") != .orderedSame }
+    }
+
+    // MARK: - Added Headers
+
+    /// The message with `headers` appended to its top-level header block, in the message's own line ending.
+    /// Existing headers and the body are left byte for byte as they were. Lines that are not a valid
+    /// "Name: value" header are dropped, and so is Message-ID, which duplicate detection relies on.
+    static func addingHeaders(_ headers: [String], to data: Data) -> Data {
+        let lines = headers.filter { line in
+            guard let name = headerName(of: line) else {
+                logWarning("Ignoring invalid header for restore: \(line)")
+                return false
+            }
+            if name.caseInsensitiveCompare("Message-ID") == .orderedSame {
+                logWarning("Not replacing Message-ID on restored messages")
+                return false
+            }
+            return true
+        }
+        guard !lines.isEmpty else { return data }
+
+        // The blank line ending the headers; a message without one is all headers
+        let lineEnding: [UInt8]
+        let insertAt: Data.Index
+        if let crlf = data.range(of: Data("\r\n\r\n".utf8)) {
+            lineEnding = Array("\r\n".utf8)
+            insertAt = crlf.lowerBound + 2
+        } else if let lf = data.range(of: Data("\n\n".utf8)) {
+            lineEnding = Array("\n".utf8)
+            insertAt = lf.lowerBound + 1
+        } else {
+            lineEnding = data.range(of: Data("\r\n".utf8)) == nil ? Array("\n".utf8) : Array("\r\n".utf8)
+            insertAt = data.endIndex
+        }
+
+        var added = Data()
+        if insertAt == data.endIndex, let last = data.last, last != UInt8(ascii: "\n") {
+            added.append(contentsOf: lineEnding)
+        }
+        for line in lines {
+            added.append(Data(line.utf8))
+            added.append(contentsOf: lineEnding)
+        }
+
+        var result = data
+        result.insert(contentsOf: added, at: insertAt)
+        return result
+    }
+
+    /// Field name of a "Name: value" line: printable ASCII without spaces, and no line breaks in the value
+    private static func headerName(of line: String) -> String? {
+        guard let colon = line.firstIndex(of: ":"), !line.contains("\r"), !line.contains("\n") else { return nil }
+        let name = line[..<colon]
+        guard !name.isEmpty, name.unicodeScalars.allSatisfy({ $0.value > 32 && $0.value < 127 }) else { return nil }
+        return String(name)
+    }
+
+    static func expandingPlaceholders(in headers: [String], folder: String, date: Date) -> [String] {
+        let formatter = DateFormatter()
+        formatter.locale = Locale(identifier: "en_US_POSIX")
+        formatter.dateFormat = "EEE, d MMM yyyy HH:mm:ss Z"
+        let stamp = formatter.string(from: date)
+        return headers.map {
+            $0.replacingOccurrences(of: "{folder}", with: folder).replacingOccurrences(of: "{date}", with: stamp)
+        }
+    }
+
+    // MARK: - Trimming
+
+    /// The message with each top-level attachment part replaced by a one-line text note.
+    /// Returns nil when the message is not multipart or has no attachments.
+    static func strippingAttachments(from data: Data) -> Data? {
+        // ISO Latin 1 maps every byte to one character, so everything we keep round-trips unchanged
+        guard let content = String(data: data, encoding: .isoLatin1),
+              let boundary = boundary(in: content) else {
+            return nil
+        }
+
+        let delimiter = "--\(boundary)"
+        var parts = content.components(separatedBy: delimiter)
+        var removed = 0
+
+        for index in parts.indices.dropFirst() where !parts[index].hasPrefix("--") {
+            guard let filename = attachmentFilename(in: parts[index]) else { continue }
+            let size = parts[index].utf8.count
+            parts[index] = "\r\nContent-Type: text/plain; charset=us-ascii\r\n\r\n"
+                + "[Attachment \(filename) (\(size) bytes) was removed to fit the server's size limit]\r\n"
+            removed += 1
+        }
+
+        guard removed > 0 else { return nil }
+        return parts.joined(separator: delimiter).data(using: .isoLatin1)
+    }
+
+    private static func boundary(in content: String) -> String? {
+        let headers = content.components(separatedBy: "\r\n\r\n").first ?? content
+        let pattern = #"Content-Type:\s*multipart/[^;]+;\s*boundary="?([^"\r\n;]+)"?"#
+
+        guard let regex = try? NSRegularExpression(pattern: pattern, options: .caseInsensitive),
+              let match = regex.firstMatch(in: headers, range: NSRange(headers.startIndex..., in: headers)),
+              let range = Range(match.range(at: 1), in: headers) else {
+            return nil
+        }
+        return String(headers[range]).trimmingCharacters(in: .whitespaces)
+    }
+
+    /// Name of the attachment in a MIME part, "unnamed" for an attachment without one, nil for body parts
+    private static func attachmentFilename(in part: String) -> String? {
+        let headers = part.components(separatedBy: "\r\n\r\n").first ?? part
+        let pattern = #"(?:file)?name\*?=\s*"?([^";\r\n]+)"?"#
+
+        if let regex = try? NSRegularExpression(pattern: pattern, options: .caseInsensitive),
+           let match = regex.firstMatch(in: headers, range: NSRange(headers.startIndex..., in: headers)),
+           let range = Range(match.range(at: 1), in: headers) {
+            return String(headers[range])
+        }
+        return headers.range(of: "Content-Disposition:\\s*attachment", options: [.regularExpression, .caseInsensitive]) != nil
+            ? "unnamed"
+            : nil
+    }
+}
@@ -25,7 +25,14 @@ class RetentionService: ObservableObject {
         didSet { saveSettings() }
     }
 
+    /// Whether the policy deletes after each backup run. Off until confirmed in settings, so
+    /// a policy alone only reports what it would delete, unless launched with --yes for one run.
+    @Published var deletesAutomatically: Bool {
+        didSet { UserDefaults.standard.set(deletesAutomatically, forKey: deletesAutomaticallyKey) }
+    }
+
     private let settingsKey = "RetentionSettings"
+    private let deletesAutomaticallyKey = "RetentionDeletesAutomatically"
     private let fileManager = FileManager.default
 
     private init() {
@@ -35,6 +42,13 @@ class RetentionService: ObservableObject {
         } else {
             self.globalSettings = RetentionSettings.default
         }
+        self.deletesAutomatically = UserDefaults.standard.bool(forKey: deletesAutomaticallyKey)
+    }
+
+    /// Mode of the retention run after backups. Takes the launch confirmation, so --yes deletes
+    /// in the first run only.
+    func takeAutomaticMode() -> DeletionMode {
+        deletesAutomatically ? .confirmed : LaunchConfirmation.shared.take()
     }
 
     private func saveSettings() {
@@ -45,8 +59,9 @@ class RetentionService: ObservableObject {
 
     // MARK: - Retention Execution
 
-    /// Apply retention policy to a backup directory
-    func applyRetention(to directory: URL, settings: RetentionSettings? = nil) async -> RetentionResult {
+    /// Apply retention policy to a backup directory. Only counts what would be deleted unless
+    /// `mode` is confirmed; files are only ever deleted inside `directory`.
+    func applyRetention(to directory: URL, settings: RetentionSettings? = nil, mode: DeletionMode = .dryRun) async -> RetentionResult {
         let effectiveSettings = settings ?? globalSettings
 
         guard effectiveSettings.policy != .keepAll else {
@@ -65,21 +80,23 @@ class RetentionService: ObservableObject {
             break
 
         case .byAge:
-            result = await deleteByAge(files: emlFiles, maxAgeDays: effectiveSettings.maxAgeDays)
+            result = await deleteByAge(files: emlFiles, maxAgeDays: effectiveSettings.maxAgeDays, within: directory, mode: mode)
 
         case .byCount:
-            result = await deleteByCount(files: emlFiles, maxCount: effectiveSettings.maxCount)
+            result = await deleteByCount(files: emlFiles, maxCount: effectiveSettings.maxCount, within: directory, mode: mode)
         }
 
         if result.filesDeleted > 0 {
-            logInfo("Retention completed: deleted \(result.filesDeleted) files, freed \(ByteCountFormatter.string(fromByteCount: result.bytesFreed, countStyle: .file))")
+            var plan = DeletionPlan(operation: "Retention in \(directory.lastPathComponent)", mode: mode)
+            plan.add("email", count: result.filesDeleted, bytes: result.bytesFreed)
+            logInfo(plan.summary)
         }
 
         return result
     }
 
     /// Apply retention to all account directories
-    func applyRetentionToAll(backupLocation: URL) async -> RetentionResult {
+    func applyRetentionToAll(backupLocation: URL, mode: DeletionMode = .dryRun) async -> RetentionResult {
         var totalResult = RetentionResult(filesDeleted: 0, bytesFreed: 0)
 
         do {
@@ -91,7 +108,7 @@ class RetentionService: ObservableObject {
             }
 
             for accountDir in accountDirs {
-                let result = await applyRetention(to: accountDir)
+                let result = await applyRetention(to: accountDir, mode: mode)
                 totalResult.filesDeleted += result.filesDeleted
                 totalResult.bytesFreed += result.bytesFreed
             }
@@ -104,7 +121,7 @@ class RetentionService: ObservableObject {
 
     // MARK: - Retention Strategies
 
-    private func deleteByAge(files: [FileInfo], maxAgeDays: Int) async -> RetentionResult {
+    private func deleteByAge(files: [FileInfo], maxAgeDays: Int, within root: URL, mode: DeletionMode) async -> RetentionResult {
         let cutoffDate = Calendar.current.date(byAdding: .day, value: -maxAgeDays, to: Date()) ?? Date()
         var deleted = 0
         var bytesFreed: Int64 = 0
@@ -112,10 +129,10 @@ class RetentionService: ObservableObject {
         for file in files {
             if file.modificationDate < cutoffDate {
                 do {
-                    try fileManager.removeItem(at: file.url)
+                    try DeletionGuard.remove(file.url, within: root, mode: mode)
                     deleted += 1
                     bytesFreed += file.size
-                    logDebug("Deleted old backup: \(file.url.lastPathComponent) (age: \(file.modificationDate))")
+                    logDebug("\(mode == .dryRun ? "Would delete" : "Deleted") old backup: \(file.url.lastPathComponent) (age: \(file.modificationDate))")
                 } catch {
                     logWarning("Failed to delete \(file.url.lastPathComponent): \(error.localizedDescription)")
                 }
@@ -125,7 +142,7 @@ class RetentionService: ObservableObject {
         return RetentionResult(filesDeleted: deleted, bytesFreed: bytesFreed)
     }
 
-    private func deleteByCount(files: [FileInfo], maxCount: Int) async -> RetentionResult {
+    private func deleteByCount(files: [FileInfo], maxCount: Int, within root: URL, mode: DeletionMode) async -> RetentionResult {
         guard files.count > maxCount else {
             return RetentionResult(filesDeleted: 0, bytesFreed: 0)
         }
@@ -140,10 +157,10 @@ class RetentionService: ObservableObject {
 
         for file in filesToDelete {
             do {
-                try fileManager.removeItem(at: file.url)
+                try DeletionGuard.remove(file.url, within: root, mode: mode)
                 deleted += 1
                 bytesFreed += file.size
-                logDebug("Deleted excess backup: \(file.url.lastPathComponent)")
+                logDebug("\(mode == .dryRun ? "Would delete" : "Deleted") excess backup: \(file.url.lastPathComponent)")
             } catch {
                 logWarning("Failed to delete \(file.url.lastPathComponent): \(error.localizedDescription)")
             }
@@ -186,46 +203,6 @@ class RetentionService: ObservableObject {
 
         return files
     }
-
-    // MARK: - Preview
-
-    /// Preview what would be deleted without actually deleting
-    func previewRetention(at directory: URL, settings: RetentionSettings? = nil) -> RetentionResult {
-        let effectiveSettings = settings ?? globalSettings
-
-        guard effectiveSettings.policy != .keepAll else {
-            return RetentionResult(filesDeleted: 0, bytesFreed: 0)
-        }
-
-        let emlFiles = getEmlFiles(in: directory)
-        var wouldDelete = 0
-        var wouldFree: Int64 = 0
-
-        switch effectiveSettings.policy {
-        case .keepAll:
-            break
-
-        case .byAge:
-            let cutoffDate = Calendar.current.date(byAdding: .day, value: -effectiveSettings.maxAgeDays, to: Date()) ?? Date()
-            for file in emlFiles {
-                if file.modificationDate < cutoffDate {
-                    wouldDelete += 1
-                    wouldFree += file.size
-                }
-            }
-
-        case .byCount:
-            if emlFiles.count > effectiveSettings.maxCount {
-                let sortedFiles = emlFiles.sorted { $0.modificationDate > $1.modificationDate }
-                for file in sortedFiles.dropFirst(effectiveSettings.maxCount) {
-                    wouldDelete += 1
-                    wouldFree += file.size
-                }
-            }
-        }
-
-        return RetentionResult(filesDeleted: wouldDelete, bytesFreed: wouldFree)
-    }
 }
 
 /// Result of a retention operation
@@ -7,6 +7,7 @@ enum SearchScope: String, CaseIterable, Identifiable {
     case subject = "Subject Only"
     case sender = "From/Sender"
     case recipient = "To/Recipient"
+    case routing = "Received/Delivered-To"
     case body = "Body Only"
     case attachments = "Attachments"
 
@@ -59,6 +60,7 @@ struct SearchResult: Identifiable {
         case body = "Body"
         case attachment = "Attachment"
         case attachmentContent = "Attachment Content"
+        case routing = "Routing"
     }
 }
 
@@ -304,6 +306,23 @@ actor SearchService {
                 snippet: createSnippet(from: "To: \(recipient)", searchTerms: searchTerms)
             )
 
+        case .routing:
+            // Only search the delivery path: Received hops and Delivered-To
+            let parsed = EmailParser.parseMetadata(from: Data(headers.utf8))
+            let routing = (parsed.flatMap { $0.deliveredTo.map { ["Delivered-To: \($0)"] } } ?? [])
+                + (parsed?.received ?? []).map { "Received: \($0)" }
+            let routingLower = routing.joined(separator: "\n").lowercased()
+            for term in searchTerms {
+                if !routingLower.contains(term) { return nil }
+            }
+            let matchedLine = routing.first { line in searchTerms.contains { line.lowercased().contains($0) } } ?? ""
+            return SearchResult(
+                accountId: accountId, mailbox: mailbox, messageId: messageId,
+                sender: sender, senderEmail: senderEmail, subject: subject,
+                date: date, filePath: url.path, matchType: .routing,
+                snippet: createSnippet(from: matchedLine, searchTerms: searchTerms)
+            )
+
         case .body:
             // Only search body - must read full content
             handle.seek(toFileOffset: 0)
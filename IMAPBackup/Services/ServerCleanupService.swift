@@ -0,0 +1,134 @@
+import Foundation
+
+/// What to do with messages on the server once they are safely backed up
+enum ServerCleanupAction: String, Codable, CaseIterable {
+    case moveToTrash = "Move to Trash"
+    case delete = "Delete Permanently"
+}
+
+/// Settings for removing backed-up messages from the server
+struct ServerCleanupSettings: Codable {
+    var isEnabled: Bool = false
+    var action: ServerCleanupAction = .moveToTrash
+    /// Set only after the user explicitly confirmed the destructive behaviour
+    var isConfirmed: Bool = false
+
+    /// Cleanup only runs when enabled and confirmed
+    var isActive: Bool {
+        isEnabled && isConfirmed
+    }
+
+    static let `default` = ServerCleanupSettings()
+}
+
+/// Service for freeing server quota after a successful backup
+@MainActor
+class ServerCleanupService: ObservableObject {
+    static let shared = ServerCleanupService()
+
+    @Published var settings: ServerCleanupSettings {
+        didSet { saveSettings() }
+    }
+
+    /// Whether permanent deletion runs after each backup. Off until confirmed in settings, so
+    /// the delete action alone only logs what it would delete, unless launched with --yes for one run.
+    @Published var deletesAutomatically: Bool {
+        didSet { UserDefaults.standard.set(deletesAutomatically, forKey: deletesAutomaticallyKey) }
+    }
+
+    private let settingsKey = "ServerCleanupSettings"
+    private let deletesAutomaticallyKey = "ServerCleanupDeletesAutomatically"
+
+    /// Common trash folder names for servers that don't advertise \Trash
+    nonisolated static let commonTrashNames = [
+        "Trash", "Deleted Items", "Deleted Messages", "[Gmail]/Trash", "Papierkorb", "Gelöschte Elemente"
+    ]
+
+    private init() {
+        if let data = UserDefaults.standard.data(forKey: settingsKey),
+           let settings = try? JSONDecoder().decode(ServerCleanupSettings.self, from: data) {
+            self.settings = settings
+        } else {
+            self.settings = ServerCleanupSettings.default
+        }
+        self.deletesAutomatically = UserDefaults.standard.bool(forKey: deletesAutomaticallyKey)
+    }
+
+    private func saveSettings() {
+        if let data = try? JSONEncoder().encode(settings) {
+            UserDefaults.standard.set(data, forKey: settingsKey)
+        }
+    }
+
+    /// Enable cleanup after the user confirmed the warning
+    func enable(action: ServerCleanupAction) {
+        settings = ServerCleanupSettings(isEnabled: true, action: action, isConfirmed: true)
+    }
+
+    /// Disable cleanup and require confirmation again before re-enabling
+    func disable() {
+        settings = ServerCleanupSettings.default
+        deletesAutomatically = false
+    }
+
+    /// Mode of the cleanup after a backup run. Only permanent deletion takes the launch
+    /// confirmation, so --yes is not spent on a run that moves to the trash.
+    func takeAutomaticMode(launch: LaunchConfirmation = .shared) -> DeletionMode {
+        guard settings.isActive, settings.action == .delete else { return .dryRun }
+        return deletesAutomatically ? .confirmed : launch.take()
+    }
+
+    // MARK: - Folder Resolution
+
+    /// Find the server's trash folder, preferring the \Trash special-use flag
+    nonisolated static func trashFolder(in folders: [IMAPFolder]) -> IMAPFolder? {
+        if let flagged = folders.first(where: { $0.flags.contains("\\Trash") }) {
+            return flagged
+        }
+        for name in commonTrashNames {
+            if let match = folders.first(where: { $0.name.caseInsensitiveCompare(name) == .orderedSame }) {
+                return match
+            }
+        }
+        return nil
+    }
+
+    // MARK: - Cleanup
+
+    /// Remove verified UIDs from a folder on the server
+    /// Returns the number of messages removed, or that would be deleted in a dry run. Permanent
+    /// deletion only logs its plan unless `mode` is confirmed; moving to the trash can be undone.
+    func cleanup(
+        uids: [UInt32],
+        in folder: IMAPFolder,
+        allFolders: [IMAPFolder],
+        imapService: IMAPServiceProtocol,
+        mode: DeletionMode = .dryRun
+    ) async throws -> Int {
+        guard settings.isActive, !uids.isEmpty else { return 0 }
+
+        switch settings.action {
+        case .moveToTrash:
+            guard let trash = ServerCleanupService.trashFolder(in: allFolders) else {
+                logWarning("No trash folder found on server, skipping cleanup of \(folder.name)")
+                return 0
+            }
+            // Messages already in the trash stay there
+            guard trash.name != folder.name else { return 0 }
+            _ = try await imapService.selectFolder(folder.name)
+            try await imapService.moveEmails(uids: uids, to: trash.name)
+            logInfo("Moved \(uids.count) backed-up email(s) from \(folder.name) to \(trash.name)")
+
+        case .delete:
+            var plan = DeletionPlan(operation: "Server cleanup of \(folder.name)", mode: mode)
+            plan.add("backed-up email", count: uids.count)
+            if mode == .confirmed {
+                _ = try await imapService.selectFolder(folder.name)
+                try await imapService.deleteEmails(uids: uids)
+            }
+            logInfo(plan.summary)
+        }
+
+        return uids.count
+    }
+}
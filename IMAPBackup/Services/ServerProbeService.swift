@@ -0,0 +1,276 @@
+import Foundation
+import Network
+
+/// How a server expects the connection to be secured
+enum IMAPConnectionSecurity: String, Equatable {
+    /// TLS from the first byte, usually port 993
+    case implicitTLS = "SSL/TLS"
+    /// Plain connection upgraded with STARTTLS, usually port 143
+    case startTLS = "STARTTLS"
+    /// No encryption offered
+    case none = "None"
+}
+
+/// Settings found by probing a server, for the add-account form
+struct IMAPServerProbeResult: Equatable {
+    let host: String
+    let port: Int
+    let security: IMAPConnectionSecurity
+    /// The server refuses LOGIN until STARTTLS was issued (LOGINDISABLED)
+    let startTLSRequired: Bool
+    let capabilities: Set<String>
+
+    /// Value for EmailAccount.useSSL
+    var useSSL: Bool {
+        security == .implicitTLS
+    }
+
+    var summary: String {
+        switch security {
+        case .implicitTLS:
+            return "\(host):\(port) uses SSL/TLS"
+        case .startTLS:
+            return "\(host):\(port) uses STARTTLS" + (startTLSRequired ? " and requires it before login" : "")
+        case .none:
+            return "\(host):\(port) offers no encryption"
+        }
+    }
+}
+
+/// A line-based connection used while probing
+protocol ProbeConnection {
+    /// The untagged greeting the server sends on connect
+    func readGreeting() async throws -> String
+    /// Send a tagged command and return everything up to its tagged response
+    func send(_ command: String, tag: String) async throws -> String
+    func close() async
+}
+
+/// Opens a probe connection to host:port, with TLS from the start or in plain text
+typealias ProbeConnector = (_ host: String, _ port: Int, _ implicitTLS: Bool) async throws -> ProbeConnection
+
+/// Finds the host, port and security of an IMAP server: tries implicit TLS on 993, then STARTTLS on 143
+struct ServerProbeService {
+    static let implicitTLSPort = 993
+    static let startTLSPort = 143
+
+    private let connector: ProbeConnector
+    private let implicitTLSPort: Int
+    private let startTLSPort: Int
+
+    init(
+        implicitTLSPort: Int = ServerProbeService.implicitTLSPort,
+        startTLSPort: Int = ServerProbeService.startTLSPort,
+        timeout: TimeInterval = 10,
+        connector: ProbeConnector? = nil
+    ) {
+        self.implicitTLSPort = implicitTLSPort
+        self.startTLSPort = startTLSPort
+        self.connector = connector ?? { host, port, implicitTLS in
+            try await NetworkProbeConnection.open(host: host, port: port, implicitTLS: implicitTLS, timeout: timeout)
+        }
+    }
+
+    /// Hosts to try for an email address, most likely first
+    static func candidateHosts(for email: String) -> [String] {
+        guard let at = email.lastIndex(of: "@") else { return [] }
+        let domain = email[email.index(after: at)...].trimmingCharacters(in: .whitespaces).lowercased()
+        guard !domain.isEmpty else { return [] }
+        return ["imap.\(domain)", "mail.\(domain)", domain]
+    }
+
+    /// Probe the usual hosts for an email address; nil when none answered like an IMAP server
+    func detect(email: String) async -> IMAPServerProbeResult? {
+        for host in Self.candidateHosts(for: email) {
+            if let result = await probe(host: host) {
+                return result
+            }
+        }
+        return nil
+    }
+
+    /// Try implicit TLS first, then a plain connection that may offer STARTTLS
+    func probe(host: String) async -> IMAPServerProbeResult? {
+        if let capabilities = await exchange(host: host, port: implicitTLSPort, implicitTLS: true) {
+            logInfo("Probe: \(host):\(implicitTLSPort) answered over TLS")
+            return IMAPServerProbeResult(
+                host: host,
+                port: implicitTLSPort,
+                security: .implicitTLS,
+                startTLSRequired: false,
+                capabilities: capabilities
+            )
+        }
+
+        if let capabilities = await exchange(host: host, port: startTLSPort, implicitTLS: false) {
+            let offersStartTLS = capabilities.contains("STARTTLS")
+            logInfo("Probe: \(host):\(startTLSPort) answered in plain text, STARTTLS \(offersStartTLS ? "offered" : "not offered")")
+            return IMAPServerProbeResult(
+                host: host,
+                port: startTLSPort,
+                security: offersStartTLS ? .startTLS : .none,
+                startTLSRequired: offersStartTLS && capabilities.contains("LOGINDISABLED"),
+                capabilities: capabilities
+            )
+        }
+
+        return nil
+    }
+
+    /// Connect, check for an IMAP greeting and ask for capabilities; nil if anything fails
+    private func exchange(host: String, port: Int, implicitTLS: Bool) async -> Set<String>? {
+        guard let connection = try? await connector(host, port, implicitTLS) else {
+            return nil
+        }
+
+        do {
+            let greeting = try await connection.readGreeting()
+            guard Self.isIMAPGreeting(greeting) else {
+                await connection.close()
+                return nil
+            }
+
+            let response = try await connection.send("P1 CAPABILITY", tag: "P1")
+            _ = try? await connection.send("P2 LOGOUT", tag: "P2")
+            await connection.close()
+            return Self.parseCapabilities(greeting + response)
+        } catch {
+            await connection.close()
+            return nil
+        }
+    }
+
+    static func isIMAPGreeting(_ greeting: String) -> Bool {
+        let upper = greeting.uppercased()
+        return upper.hasPrefix("* OK") || upper.hasPrefix("* PREAUTH")
+    }
+
+    /// Capabilities from a CAPABILITY response or a [CAPABILITY ...] response code
+    static func parseCapabilities(_ response: String) -> Set<String> {
+        var capabilities = Set<String>()
+        for line in response.components(separatedBy: "\r\n") {
+            let upper = line.uppercased()
+            let list: Substring?
+            if upper.hasPrefix("* CAPABILITY ") {
+                list = upper.dropFirst("* CAPABILITY ".count)[...]
+            } else if let start = upper.range(of: "[CAPABILITY "),
+                      let end = upper[start.upperBound...].firstIndex(of: "]") {
+                list = upper[start.upperBound..<end]
+            } else {
+                list = nil
+            }
+            list?.split(separator: " ").forEach { capabilities.insert(String($0)) }
+        }
+        return capabilities
+    }
+}
+
+// MARK: - Network Connection
+
+/// Probe connection over Network.framework, with a timeout on every step
+final class NetworkProbeConnection: ProbeConnection {
+    private let connection: NWConnection
+    private let timeout: TimeInterval
+    private var buffer = ""
+
+    private init(connection: NWConnection, timeout: TimeInterval) {
+        self.connection = connection
+        self.timeout = timeout
+    }
+
+    static func open(host: String, port: Int, implicitTLS: Bool, timeout: TimeInterval) async throws -> ProbeConnection {
+        guard let endpointPort = NWEndpoint.Port(rawValue: UInt16(clamping: port)) else {
+            throw IMAPError.connectionFailed("Invalid port \(port)")
+        }
+        let params = NWParameters(tls: implicitTLS ? NWProtocolTLS.Options() : nil, tcp: NWProtocolTCP.Options())
+        let connection = NWConnection(host: NWEndpoint.Host(host), port: endpointPort, using: params)
+        let probe = NetworkProbeConnection(connection: connection, timeout: timeout)
+
+        try await probe.withTimeout {
+            try await withCheckedThrowingContinuation { (continuation: CheckedContinuation<Void, Error>) in
+                class ResumeState { var hasResumed = false }
+                let state = ResumeState()
+                connection.stateUpdateHandler = { newState in
+                    guard !state.hasResumed else { return }
+                    switch newState {
+                    case .ready:
+                        state.hasResumed = true
+                        continuation.resume()
+                    case .failed(let error), .waiting(let error):
+                        state.hasResumed = true
+                        continuation.resume(throwing: IMAPError.connectionFailed(error.localizedDescription))
+                    case .cancelled:
+                        state.hasResumed = true
+                        continuation.resume(throwing: IMAPError.connectionCancelled)
+                    default:
+                        break
+                    }
+                }
+                connection.start(queue: .global(qos: .userInitiated))
+            }
+        }
+        return probe
+    }
+
+    func readGreeting() async throws -> String {
+        try await readUntil { $0.contains("\r\n") }
+    }
+
+    func send(_ command: String, tag: String) async throws -> String {
+        let data = Data((command + "\r\n").utf8)
+        try await withTimeout {
+            try await withCheckedThrowingContinuation { (continuation: CheckedContinuation<Void, Error>) in
+                self.connection.send(content: data, completion: .contentProcessed { error in
+                    if let error = error {
+                        continuation.resume(throwing: IMAPError.sendFailed(error.localizedDescription))
+                    } else {
+                        continuation.resume()
+                    }
+                })
+            }
+        }
+        return try await readUntil { $0.contains("\r\n\(tag) ") || $0.hasPrefix("\(tag) ") }
+    }
+
+    func close() async {
+        connection.cancel()
+    }
+
+    /// Read until the accumulated text satisfies `isComplete`, then hand it out and reset the buffer
+    private func readUntil(_ isComplete: @escaping (String) -> Bool) async throws -> String {
+        while !isComplete(buffer) {
+            let chunk = try await withTimeout {
+                try await withCheckedThrowingContinuation { (continuation: CheckedContinuation<String, Error>) in
+                    self.connection.receive(minimumIncompleteLength: 1, maximumLength: 8192) { data, _, isComplete, error in
+                        if let error = error {
+                            continuation.resume(throwing: IMAPError.receiveFailed(error.localizedDescription))
+                        } else if let data = data, !data.isEmpty {
+                            continuation.resume(returning: String(decoding: data, as: UTF8.self))
+                        } else if isComplete {
+                            continuation.resume(throwing: IMAPError.receiveFailed("Connection closed"))
+                        } else {
+                            continuation.resume(returning: "")
+                        }
+                    }
+                }
+            }
+            buffer += chunk
+        }
+        defer { buffer = "" }
+        return buffer
+    }
+
+    private func withTimeout<T>(_ operation: @escaping () async throws -> T) async throws -> T {
+        try await withThrowingTaskGroup(of: T.self) { group in
+            group.addTask { try await operation() }
+            group.addTask {
+                try await Task.sleep(nanoseconds: UInt64(self.timeout * Double(Constants.nanosecondsPerSecond)))
+                // Cancelling makes the pending connect or receive finish, so the group can return
+                self.connection.cancel()
+                throw IMAPError.connectionFailed("No answer within \(Int(self.timeout))s")
+            }
+            defer { group.cancelAll() }
+            return try await group.next()!
+        }
+    }
+}
@@ -0,0 +1,203 @@
+import Foundation
+
+/// What a server-side SEARCH looks for. Unset fields match everything, but at least one must be
+/// set; text is matched as a substring ignoring case, as the server defines it.
+struct IMAPSearchCriteria: Equatable {
+    var from: String?
+    var subject: String?
+    /// Text in the message body; some servers do not index bodies and find nothing or refuse
+    var body: String?
+    /// Received on or after this day
+    var since: Date?
+    /// Received before this day
+    var before: Date?
+
+    /// One piece of the search keys: text sent as it is, or a string sent as a literal
+    enum Argument: Equatable {
+        case text(String)
+        case literal(String)
+    }
+
+    /// Nothing set; such a search would list every message, so it is refused
+    var isEmpty: Bool {
+        textKeys.isEmpty && since == nil && before == nil
+    }
+
+    /// Text outside ASCII is searched for. It needs CHARSET UTF-8, which a server without it refuses
+    /// with BADCHARSET, and literals: quoted strings may only hold 7-bit text (RFC 3501 section 4.3).
+    var needsUTF8: Bool {
+        textKeys.contains { !$0.value.unicodeScalars.allSatisfy(\.isASCII) }
+    }
+
+    /// The search keys as sent, e.g. FROM "boss" SINCE 5-Jan-2026. With text outside ASCII
+    /// CHARSET UTF-8 comes first and every string is a literal.
+    var arguments: [Argument] {
+        let utf8 = needsUTF8
+        var arguments: [Argument] = utf8 ? [.text("CHARSET UTF-8")] : []
+        for (key, value) in textKeys {
+            arguments.append(.text(key))
+            arguments.append(utf8 ? .literal(value) : .text(Self.quoted(value)))
+        }
+        if let since = since {
+            arguments.append(.text("SINCE \(IMAPService.searchDate(since))"))
+        }
+        if let before = before {
+            arguments.append(.text("BEFORE \(IMAPService.searchDate(before))"))
+        }
+        return arguments
+    }
+
+    /// The search keys on one line, literals shown quoted, for logs and messages
+    var searchKeys: String {
+        arguments.map { argument -> String in
+            switch argument {
+            case .text(let text): return text
+            case .literal(let string): return Self.quoted(string)
+            }
+        }.joined(separator: " ")
+    }
+
+    /// Set text criteria with their SEARCH key, in a fixed order
+    private var textKeys: [(key: String, value: String)] {
+        [("FROM", from), ("SUBJECT", subject), ("BODY", body)].compactMap { key, value in
+            guard let value = value?.trimmingCharacters(in: .whitespacesAndNewlines), !value.isEmpty else { return nil }
+            return (key, value)
+        }
+    }
+
+    /// Quoted string; line breaks cannot be quoted and become spaces
+    private static func quoted(_ value: String) -> String {
+        let escaped = value
+            .replacingOccurrences(of: "\\", with: "\\\\")
+            .replacingOccurrences(of: "\"", with: "\\\"")
+            .components(separatedBy: .newlines)
+            .joined(separator: " ")
+        return "\"\(escaped)\""
+    }
+}
+
+/// One message the server found, described from its envelope
+struct ServerSearchMatch: Equatable, Identifiable {
+    let folder: String
+    let uid: UInt32
+    var subject: String
+    var from: String?
+    /// Date header as the server gave it
+    var date: String?
+
+    var id: String { "\(folder)/\(uid)" }
+
+    init(folder: String, uid: UInt32, subject: String, from: String? = nil, date: String? = nil) {
+        self.folder = folder
+        self.uid = uid
+        self.subject = subject
+        self.from = from
+        self.date = date
+    }
+
+    /// From the raw FETCH response of the message's envelope, if the server sent one
+    init(folder: String, uid: UInt32, response: String?) {
+        self.init(folder: folder, uid: uid, subject: "(No Subject)")
+        guard let response = response,
+              case .list(let fields)? = EnvelopeParser.parseFetchAttributes(response)["ENVELOPE"] else { return }
+
+        if fields.count > 0, case .string(let date) = fields[0], !date.isEmpty {
+            self.date = date
+        }
+        if fields.count > 1, case .string(let subject) = fields[1], !subject.isEmpty {
+            self.subject = MIMEDecoding.decodeEncodedWords(subject)
+        }
+        // Address: (name adl mailbox host)
+        if fields.count > 2, case .list(let addresses) = fields[2],
+           case .list(let address)? = addresses.first, address.count >= 4,
+           case .string(let mailbox) = address[2], case .string(let host) = address[3] {
+            if case .string(let name) = address[0], !name.isEmpty {
+                self.from = "\(MIMEDecoding.decodeEncodedWords(name)) <\(mailbox)@\(host)>"
+            } else {
+                self.from = "\(mailbox)@\(host)"
+            }
+        }
+    }
+}
+
+/// What a server-side search of one account found
+struct ServerSearchResult {
+    let accountEmail: String
+    var matches: [ServerSearchMatch] = []
+    var errors: [String] = []
+
+    var summary: String {
+        let folders = Set(matches.map(\.folder)).count
+        var text = "\(matches.count) match(es) in \(folders) folder(s)"
+        if !errors.isEmpty {
+            text += ", \(errors.count) error(s)"
+        }
+        return text
+    }
+
+    /// One line per match: folder, UID and subject separated by tabs
+    var report: String {
+        matches.map { "\($0.folder)\t\($0.uid)\t\($0.subject)" }.joined(separator: "\n")
+    }
+}
+
+enum ServerSearchError: LocalizedError {
+    case noCriteria
+
+    var errorDescription: String? {
+        switch self {
+        case .noCriteria:
+            return "Enter a sender, subject, body text or date to search for"
+        }
+    }
+}
+
+/// Finds messages on the server with IMAP SEARCH, to decide what to back up, without
+/// downloading any bodies: matching UIDs are described from their envelopes only. Folders are
+/// EXAMINEd so nothing is marked read, and nothing on disk is written.
+enum ServerSearchService {
+
+    /// Search the named folders of one account over a logged-in connection, all selectable
+    /// folders when no names are given. Names resolve like default folders, so "Sent" works.
+    /// Empty criteria are refused rather than listing, and fetching envelopes of, every message.
+    static func searchAccount(
+        accountEmail: String,
+        criteria: IMAPSearchCriteria,
+        folderNames: [String] = [],
+        service: IMAPServiceProtocol
+    ) async throws -> ServerSearchResult {
+        guard !criteria.isEmpty else {
+            throw ServerSearchError.noCriteria
+        }
+        var result = ServerSearchResult(accountEmail: accountEmail)
+        var folders = try await service.listFolders().filter { $0.isSelectable }
+        if !folderNames.isEmpty {
+            let resolved = FolderSelection.resolve(folderNames, in: folders)
+            folders = resolved.folders
+            result.errors += resolved.unmatched.map { "\($0): no such folder" }
+        }
+
+        for folder in folders {
+            try Task.checkCancellation()
+
+            do {
+                let status = try await service.examineFolder(folder.name)
+                guard status.exists > 0 else { continue }
+
+                let uids = try await service.search(criteria)
+                let envelopes = try await FetchStrategy.twoPhase.prefetchEnvelopes(for: uids, using: service)
+                result.matches += uids.sorted().map {
+                    ServerSearchMatch(folder: folder.path, uid: $0, response: envelopes[$0])
+                }
+            } catch is CancellationError {
+                throw CancellationError()
+            } catch {
+                result.errors.append("\(folder.name): \(error.localizedDescription)")
+                logWarning("Searching \(folder.name) failed: \(error.localizedDescription)")
+            }
+        }
+
+        logInfo("Searched \(accountEmail) on the server for \(criteria.searchKeys): \(result.summary)")
+        return result
+    }
+}
@@ -0,0 +1,166 @@
+import Foundation
+
+/// A place backed-up emails are written to
+protocol StorageBackend: AnyObject {
+    /// Shown in logs and errors
+    var name: String { get }
+
+    func saveEmail(_ emailData: Data, email: Email, accountEmail: String, folderPath: String) async throws -> URL
+    func getExistingUIDs(accountEmail: String, folderPath: String) async throws -> Set<UInt32>
+    /// Where an email saved earlier is kept; nil when it is not there
+    func savedEmailURL(uid: UInt32, accountEmail: String, folderPath: String) async throws -> URL?
+}
+
+extension StorageService: StorageBackend {
+    nonisolated var name: String { baseURL.path }
+}
+
+enum MultiStorageError: LocalizedError {
+    case quorumNotMet(succeeded: Int, required: Int, errors: [String])
+    case primaryFailed(String)
+
+    var errorDescription: String? {
+        switch self {
+        case .quorumNotMet(let succeeded, let required, let errors):
+            return "Saved to \(succeeded) of \(required) required destinations: \(errors.joined(separator: "; "))"
+        case .primaryFailed(let error):
+            return "Not saved to the primary destination: \(error)"
+        }
+    }
+}
+
+/// Writes every email to several backends, e.g. a local folder and a mounted offsite volume,
+/// so one download fills all of them. The first backend is the primary: its file URL is the one
+/// returned, and a save it does not hold fails even when the quorum is met.
+actor MultiStorage: StorageBackend {
+    let backends: [StorageBackend]
+    /// Backends that must succeed for a save to count; all of them by default
+    let quorum: Int
+
+    /// UIDs each backend reported per folder, so a re-save only goes where the email is missing
+    private var knownUIDs: [String: [Set<UInt32>]] = [:]
+
+    init(backends: [StorageBackend], quorum: Int? = nil) {
+        self.backends = backends
+        self.quorum = min(max(quorum ?? backends.count, 1), backends.count)
+    }
+
+    nonisolated var name: String {
+        backends.map(\.name).joined(separator: ", ")
+    }
+
+    /// UIDs present in every backend, so an email missing from any of them is downloaded again.
+    /// A backend that cannot be read counts as empty.
+    func getExistingUIDs(accountEmail: String, folderPath: String) async throws -> Set<UInt32> {
+        var perBackend: [Set<UInt32>] = []
+        for backend in backends {
+            do {
+                perBackend.append(try await backend.getExistingUIDs(accountEmail: accountEmail, folderPath: folderPath))
+            } catch {
+                logWarning("Could not read backed-up UIDs from \(backend.name): \(error.localizedDescription)")
+                perBackend.append([])
+            }
+        }
+
+        knownUIDs[Self.key(accountEmail, folderPath)] = perBackend
+        guard var common = perBackend.first else { return [] }
+        for uids in perBackend.dropFirst() {
+            common.formIntersection(uids)
+        }
+        return common
+    }
+
+    /// Save to every backend that lacks the email. Returns the primary's file, also when the
+    /// primary already had the email, since callers verify and extract from what it holds.
+    func saveEmail(_ emailData: Data, email: Email, accountEmail: String, folderPath: String) async throws -> URL {
+        let (urls, errors) = try await fanOut(emailData, email: email, accountEmail: accountEmail, folderPath: folderPath, excluding: [])
+        if let url = urls[0] {
+            return url
+        }
+        if let error = errors[0] {
+            throw MultiStorageError.primaryFailed(error)
+        }
+
+        // The primary was skipped because it already had the email
+        guard let primary = backends.first,
+              let url = try await primary.savedEmailURL(uid: email.uid, accountEmail: accountEmail, folderPath: folderPath) else {
+            throw MultiStorageError.primaryFailed("\(backends.first?.name ?? "?"): email UID \(email.uid) is not there")
+        }
+        return url
+    }
+
+    /// The primary's file
+    func savedEmailURL(uid: UInt32, accountEmail: String, folderPath: String) async throws -> URL? {
+        try await backends.first?.savedEmailURL(uid: uid, accountEmail: accountEmail, folderPath: folderPath)
+    }
+
+    /// Copy an email the primary already wrote itself (e.g. streamed to disk) to the other backends
+    @discardableResult
+    func mirrorEmail(_ emailData: Data, email: Email, accountEmail: String, folderPath: String) async throws -> [URL] {
+        let primary = Array(backends.prefix(1))
+        let (urls, _) = try await fanOut(emailData, email: email, accountEmail: accountEmail, folderPath: folderPath, excluding: primary)
+        return urls.sorted { $0.key < $1.key }.map(\.value)
+    }
+
+    /// Write to all backends that do not have the email yet, concurrently.
+    /// Backends in `excluding` and those that already have it count towards the quorum.
+    private func fanOut(
+        _ emailData: Data,
+        email: Email,
+        accountEmail: String,
+        folderPath: String,
+        excluding: [StorageBackend]
+    ) async throws -> (urls: [Int: URL], errors: [Int: String]) {
+        let key = Self.key(accountEmail, folderPath)
+        let known = knownUIDs[key] ?? []
+        var urls: [Int: URL] = [:]
+        var alreadyThere = 0
+        var errors: [Int: String] = [:]
+
+        await withTaskGroup(of: (Int, Result<URL, Error>).self) { group in
+            for (index, backend) in backends.enumerated() {
+                if excluding.contains(where: { $0 === backend }) ||
+                    (index < known.count && known[index].contains(email.uid)) {
+                    alreadyThere += 1
+                    continue
+                }
+                group.addTask {
+                    do {
+                        return (index, .success(try await backend.saveEmail(
+                            emailData, email: email, accountEmail: accountEmail, folderPath: folderPath
+                        )))
+                    } catch {
+                        return (index, .failure(error))
+                    }
+                }
+            }
+
+            for await (index, result) in group {
+                switch result {
+                case .success(let url):
+                    urls[index] = url
+                case .failure(let error):
+                    errors[index] = "\(backends[index].name): \(error.localizedDescription)"
+                }
+            }
+        }
+
+        let succeeded = urls.count + alreadyThere
+        let messages = errors.sorted { $0.key < $1.key }.map(\.value)
+        guard succeeded >= quorum else {
+            throw MultiStorageError.quorumNotMet(succeeded: succeeded, required: quorum, errors: messages)
+        }
+        for error in messages {
+            logWarning("Email UID \(email.uid) was not saved to \(error)")
+        }
+
+        for index in urls.keys where index < known.count {
+            knownUIDs[key]?[index].insert(email.uid)
+        }
+        return (urls, errors)
+    }
+
+    private static func key(_ accountEmail: String, _ folderPath: String) -> String {
+        "\(accountEmail)\n\(folderPath)"
+    }
+}
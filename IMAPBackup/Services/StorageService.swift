@@ -1,24 +1,79 @@
 import Foundation
 import CryptoKit
 
+/// How email files are arranged inside a folder directory
+enum StorageLayout: String, Codable, CaseIterable {
+    /// All emails directly in the folder directory
+    case flat
+    /// Emails in YYYY/MM subdirectories by message date
+    case datePartitioned
+
+    var displayName: String {
+        switch self {
+        case .flat: return "Flat"
+        case .datePartitioned: return "By Year and Month"
+        }
+    }
+}
+
 /// Service for storing emails and attachments to disk
 actor StorageService {
-    private let baseURL: URL
+    let baseURL: URL
     private let fileManager = FileManager.default
 
     /// Cache file name for storing UIDs (hidden file)
     private let uidCacheFilename = ".uid_cache"
 
+    /// Every folder's UIDs of an account in one file, read once per run (hidden file)
+    private let stateIndexFilename = ".backup_state.json"
+
+    /// Cache file name for storing Message-IDs (hidden file)
+    private let messageIdCacheFilename = ".message_id_cache"
+
     /// Cache file name for storing content hashes (hidden file)
     private let hashIndexFilename = ".hash_index"
 
     /// Size of content to hash for deduplication (64KB)
     private let hashContentSize = 64 * 1024
 
+    /// Mapping file recording folders suffixed to avoid collisions (hidden file)
+    private let folderMapFilename = ".folder_map.json"
+
+    /// Remaining work from an interrupted backup (hidden file)
+    private let checkpointFilename = ".resume_checkpoint.json"
+    private let reportFilename = "backup_report.jsonl"
+    /// Start time of the last attachment verification of a folder, ISO 8601
+    private let lastVerifiedFilename = ".last_verified"
+    private let flagsModSeqFilename = ".flags_modseq"
+    /// Per-folder overview; visible on purpose, it is meant to be read by people and other tools
+    static let folderSummaryFilename = "_folder.json"
+    /// Downloads that did not match the server's size, kept out of the backup so they are fetched again
+    static let quarantineDirectory = ".quarantine"
+
+    /// Per-account folder remap tables keyed by sanitized account email
+    private var folderRemaps: [String: [String: String]] = [:]
+
+    /// Per-account separators of flattened folder directories keyed by sanitized account email;
+    /// accounts without one nest folders
+    private var flatFolderSeparators: [String: String] = [:]
+
+    /// Per-account collision assignments (server folder path -> local path), loaded lazily
+    private var folderAssignments: [String: [String: String]] = [:]
+
+    /// State indexes loaded for this run, keyed by sanitized account email
+    private var stateIndexes: [String: BackupStateIndex] = [:]
+
+    /// Layout for newly saved emails; existing files are found in either layout
+    private var layout: StorageLayout = .flat
+
     init(baseURL: URL) {
         self.baseURL = baseURL
     }
 
+    func setLayout(_ layout: StorageLayout) {
+        self.layout = layout
+    }
+
     // MARK: - UID Cache Management
 
     /// Get the UID cache file URL for a folder
@@ -44,6 +99,7 @@ actor StorageService {
                 try? data.write(to: cacheURL)
             }
         }
+        recordInStateIndex(uid, folderURL: folderURL)
     }
 
     /// Read UIDs from cache file (O(1) file read instead of O(n) directory scan)
@@ -63,22 +119,147 @@ actor StorageService {
         return uids
     }
 
+    // MARK: - State Index
+
+    /// Read an account's state index for this run. From then on saved UIDs are added to it,
+    /// and `saveStateIndex` writes it back. A missing or unreadable file starts an empty index.
+    func loadStateIndex(accountEmail: String) {
+        let accountKey = accountEmail.sanitizedForFilename()
+        guard stateIndexes[accountKey] == nil else { return }
+
+        let url = baseURL.appendingPathComponent(accountKey).appendingPathComponent(stateIndexFilename)
+        if let data = try? Data(contentsOf: url), let index = try? JSONDecoder().decode(BackupStateIndex.self, from: data) {
+            stateIndexes[accountKey] = index
+        } else {
+            stateIndexes[accountKey] = BackupStateIndex()
+        }
+    }
+
+    /// A folder's UIDs from the loaded state index. Nil when the folder is not in it, its UIDVALIDITY
+    /// changed, or its UID cache was written after the index was saved (the last run did not finish);
+    /// `getExistingUIDs` is the fallback then.
+    func indexedUIDs(accountEmail: String, folderPath: String, uidValidity: UInt32) -> Set<UInt32>? {
+        let localPath = localFolderPath(accountEmail: accountEmail, folderPath: folderPath)
+        guard let index = stateIndexes[accountEmail.sanitizedForFilename()],
+              let folder = index.folders[localPath],
+              folder.uidValidity == uidValidity else {
+            return nil
+        }
+
+        let cacheURL = uidCacheURL(for: resolveFolderURL(accountEmail: accountEmail, folderPath: folderPath))
+        if let savedAt = index.savedAt,
+           let modified = (try? fileManager.attributesOfItem(atPath: cacheURL.path))?[.modificationDate] as? Date,
+           modified > savedAt {
+            return nil
+        }
+        return folder.uids
+    }
+
+    /// Whether the folder's UIDs in the loaded state index were all saved under its current
+    /// UIDVALIDITY, so a message is known to be backed up by its UID alone
+    func indexedUIDsAreVerified(accountEmail: String, folderPath: String) -> Bool {
+        let localPath = localFolderPath(accountEmail: accountEmail, folderPath: folderPath)
+        return stateIndexes[accountEmail.sanitizedForFilename()]?.folders[localPath]?.isVerified ?? false
+    }
+
+    /// Replace a folder's entry in the loaded state index with what the filesystem fallback found.
+    /// Files do not tell which UIDVALIDITY their UIDs belong to, so the entry is unverified
+    /// unless it is empty; UIDs saved from then on are of `uidValidity`.
+    func updateStateIndex(_ uids: Set<UInt32>, accountEmail: String, folderPath: String, uidValidity: UInt32) {
+        let accountKey = accountEmail.sanitizedForFilename()
+        guard stateIndexes[accountKey] != nil else { return }
+
+        let localPath = localFolderPath(accountEmail: accountEmail, folderPath: folderPath)
+        stateIndexes[accountKey]?.folders[localPath] = BackupStateIndex.Folder(
+            uidValidity: uidValidity,
+            uids: uids,
+            isVerified: uids.isEmpty
+        )
+    }
+
+    /// Write the loaded state index atomically, once at the end of a run
+    func saveStateIndex(accountEmail: String) throws {
+        let accountKey = accountEmail.sanitizedForFilename()
+        guard var index = stateIndexes[accountKey] else { return }
+
+        index.savedAt = Date()
+        let accountURL = try createAccountDirectory(email: accountEmail)
+        let encoder = JSONEncoder()
+        encoder.outputFormatting = [.sortedKeys]
+        // Dates keep their full precision; they are compared to file modification dates
+        try encoder.encode(index).write(to: accountURL.appendingPathComponent(stateIndexFilename), options: .atomic)
+        stateIndexes[accountKey] = index
+    }
+
+    /// Add a saved UID to its folder in a loaded state index; folders not looked up this run are left alone
+    private func recordInStateIndex(_ uid: UInt32, folderURL: URL) {
+        guard !stateIndexes.isEmpty else { return }
+
+        let base = baseURL.standardizedFileURL.pathComponents
+        let components = folderURL.standardizedFileURL.pathComponents
+        guard components.count > base.count + 1, Array(components.prefix(base.count)) == base else { return }
+
+        let accountKey = components[base.count]
+        let localPath = components.dropFirst(base.count + 1).joined(separator: "/")
+        stateIndexes[accountKey]?.folders[localPath]?.uids.insert(uid)
+    }
+
+    // MARK: - Message-ID Cache
+
+    /// Add an email's Message-ID to the cache. Only an existing cache is extended;
+    /// a missing one is built from all files by the next `getExistingMessageIDs`.
+    private func appendMessageIDToCache(of emailData: Data, folderURL: URL) {
+        let cacheURL = folderURL.appendingPathComponent(messageIdCacheFilename)
+        guard fileManager.fileExists(atPath: cacheURL.path),
+              let messageId = EmailParser.messageId(from: emailData),
+              let handle = try? FileHandle(forWritingTo: cacheURL) else {
+            return
+        }
+        handle.seekToEndOfFile()
+        handle.write(Data("\(messageId)\n".utf8))
+        try? handle.close()
+    }
+
+    /// Message-IDs of the emails saved in a folder, for Message-ID based incremental backups
+    func getExistingMessageIDs(accountEmail: String, folderPath: String) throws -> Set<String> {
+        let folderURL = resolveFolderURL(accountEmail: accountEmail, folderPath: folderPath)
+        guard fileManager.fileExists(atPath: folderURL.path) else {
+            return []
+        }
+
+        let cacheURL = folderURL.appendingPathComponent(messageIdCacheFilename)
+        if let content = try? String(contentsOf: cacheURL, encoding: .utf8) {
+            return Set(content.components(separatedBy: .newlines).filter { !$0.isEmpty })
+        }
+
+        // Cache miss - read the headers of every email and build the cache
+        var messageIds = Set<String>()
+        for fileURL in try Self.messageFiles(in: folderURL) where fileURL.pathExtension == "eml" {
+            if let head = Self.headerPrefix(of: fileURL), let messageId = EmailParser.messageId(from: head) {
+                messageIds.insert(messageId)
+            }
+        }
+        let content = messageIds.sorted().joined(separator: "\n") + (messageIds.isEmpty ? "" : "\n")
+        try? content.write(to: cacheURL, atomically: true, encoding: .utf8)
+
+        return messageIds
+    }
+
+    /// Start of an email file, enough to hold its headers
+    private nonisolated static func headerPrefix(of fileURL: URL, maxBytes: Int = 65536) -> Data? {
+        guard let handle = FileHandle(forReadingAtPath: fileURL.path) else { return nil }
+        defer { try? handle.close() }
+        return handle.readData(ofLength: maxBytes)
+    }
+
     /// Rebuild UID cache from existing files (migration for existing backups)
     func rebuildUIDCache(accountEmail: String, folderPath: String) throws {
-        let sanitizedEmail = accountEmail.sanitizedForFilename()
-        let sanitizedPath = folderPath
-            .components(separatedBy: "/")
-            .map { $0.sanitizedForFilename() }
-            .joined(separator: "/")
-
-        let folderURL = baseURL
-            .appendingPathComponent(sanitizedEmail)
-            .appendingPathComponent(sanitizedPath)
+        let folderURL = resolveFolderURL(accountEmail: accountEmail, folderPath: folderPath)
 
         guard fileManager.fileExists(atPath: folderURL.path) else { return }
 
         // Scan files and build cache
-        let contents = try fileManager.contentsOfDirectory(at: folderURL, includingPropertiesForKeys: nil)
+        let contents = try Self.messageFiles(in: folderURL)
         var uids: [UInt32] = []
 
         for fileURL in contents where fileURL.pathExtension == "eml" {
@@ -122,7 +303,7 @@ actor StorageService {
 
                 while let fileURL = enumerator.nextObject() as? URL {
                     if fileURL.pathExtension == "eml" {
-                        let folderURL = fileURL.deletingLastPathComponent()
+                        let folderURL = Self.folderURL(containing: fileURL)
                         if !foldersToCheck.contains(folderURL) {
                             foldersToCheck.append(folderURL)
                         }
@@ -147,7 +328,7 @@ actor StorageService {
         let cacheURL = uidCacheURL(for: folderURL)
 
         // Get actual UIDs from .eml files
-        guard let contents = try? fileManager.contentsOfDirectory(at: folderURL, includingPropertiesForKeys: nil) else {
+        guard let contents = try? Self.messageFiles(in: folderURL) else {
             return false
         }
 
@@ -316,32 +497,285 @@ actor StorageService {
         return (false, nil)
     }
 
+    /// Rebuild the hash index of a single directory holding emails, such as one date partition
+    func rebuildHashIndex(inDirectory directoryURL: URL) throws {
+        let entries = try fileManager.contentsOfDirectory(at: directoryURL, includingPropertiesForKeys: nil)
+            .filter { $0.pathExtension == "eml" }
+            .sorted { $0.lastPathComponent < $1.lastPathComponent }
+            .compactMap { fileURL in computeContentHash(at: fileURL).map { "\($0)\t\(fileURL.lastPathComponent)" } }
+        let content = entries.joined(separator: "\n") + (entries.isEmpty ? "" : "\n")
+        try content.write(to: hashIndexURL(for: directoryURL), atomically: true, encoding: .utf8)
+    }
+
     /// Rebuild hash index for a folder from existing .eml files
     func rebuildHashIndex(accountEmail: String, folderPath: String) throws {
-        let sanitizedEmail = accountEmail.sanitizedForFilename()
-        let sanitizedPath = folderPath
+        let folderURL = resolveFolderURL(accountEmail: accountEmail, folderPath: folderPath)
+
+        guard fileManager.fileExists(atPath: folderURL.path) else { return }
+
+        // One index per directory holding emails, date partitions included
+        var hashEntries: [URL: [String]] = [folderURL: []]
+
+        for fileURL in try Self.messageFiles(in: folderURL) where fileURL.pathExtension == "eml" {
+            if let hash = computeContentHash(at: fileURL) {
+                hashEntries[fileURL.deletingLastPathComponent(), default: []].append("\(hash)\t\(fileURL.lastPathComponent)")
+            }
+        }
+
+        for (directoryURL, entries) in hashEntries {
+            let indexURL = hashIndexURL(for: directoryURL)
+            let content = entries.joined(separator: "\n") + (entries.isEmpty ? "" : "\n")
+            try content.write(to: indexURL, atomically: true, encoding: .utf8)
+        }
+    }
+
+    // MARK: - Folder Paths
+
+    /// Set the folder remap table for an account (server folder path -> local path)
+    func setFolderRemap(_ remap: [String: String], for accountEmail: String) {
+        folderRemaps[accountEmail.sanitizedForFilename()] = remap
+    }
+
+    /// Store the folders of an account in one directory each, named by their whole path joined
+    /// with `separator`; nil nests them. Folders already on disk are moved by `resolveFolderCollisions`.
+    func setFlatFolderSeparator(_ separator: String?, for accountEmail: String) {
+        flatFolderSeparators[accountEmail.sanitizedForFilename()] = separator.map {
+            EmailAccount.normalizedFlatFolderSeparator($0)
+        }
+    }
+
+    /// Relative local path for a server folder
+    /// Collision assignments win, then remapped paths, then plain sanitization
+    func localFolderPath(accountEmail: String, folderPath: String) -> String {
+        let base = baseFolderPath(accountEmail: accountEmail, folderPath: folderPath)
+        if let assigned = loadFolderAssignments(for: accountEmail)[folderPath],
+           Self.isAssignment(assigned, of: base) {
+            return assigned
+        }
+        return base
+    }
+
+    /// Whether a recorded local path still belongs to `base`: the base itself or a suffixed copy.
+    /// After a remap or layout change it does not, and the folder is assigned again.
+    private nonisolated static func isAssignment(_ local: String, of base: String) -> Bool {
+        guard local != base else { return true }
+        let prefix = "\(base)_"
+        guard local.hasPrefix(prefix) else { return false }
+        let suffix = local.dropFirst(prefix.count)
+        return !suffix.isEmpty && suffix.allSatisfy { $0.isASCII && $0.isNumber }
+    }
+
+    /// Local path before collision handling, all components are sanitized. Flattened
+    /// accounts join them into a single directory name; `separator` overrides the account's.
+    private func baseFolderPath(accountEmail: String, folderPath: String, separator: String? = nil) -> String {
+        let accountKey = accountEmail.sanitizedForFilename()
+        let separator = separator ?? flatFolderSeparators[accountKey] ?? "/"
+
+        if let mapped = folderRemaps[accountKey]?[folderPath] {
+            return mapped
+                .components(separatedBy: "/")
+                .filter { !$0.isEmpty }
+                .map { $0.sanitizedForFilename() }
+                .joined(separator: separator)
+        }
+
+        return folderPath
             .components(separatedBy: "/")
             .map { $0.sanitizedForFilename() }
-            .joined(separator: "/")
+            .joined(separator: separator)
+    }
 
-        let folderURL = baseURL
-            .appendingPathComponent(sanitizedEmail)
-            .appendingPathComponent(sanitizedPath)
+    /// Pre-compute local paths for all folders and suffix any that collide (`Folder`, `Folder_2`, ...)
+    /// Every folder's path is recorded, unsuffixed ones too, so a folder appearing later can never
+    /// claim a directory another folder already fills; assignments are made in sorted order.
+    /// Folders backed up under another layout or remap are moved to their new path.
+    /// Returns the folders that were suffixed (server folder path -> local path).
+    @discardableResult
+    func resolveFolderCollisions(accountEmail: String, folderPaths: [String]) throws -> [String: String] {
+        let previous = loadFolderAssignments(for: accountEmail)
+        var assignments = previous.filter { folderPath, local in
+            Self.isAssignment(local, of: baseFolderPath(accountEmail: accountEmail, folderPath: folderPath))
+        }
 
-        guard fileManager.fileExists(atPath: folderURL.path) else { return }
+        // Case-insensitive: the default macOS file system folds case
+        var taken = Set(assignments.values.map { $0.lowercased() })
+
+        for folderPath in Set(folderPaths).sorted() where assignments[folderPath] == nil {
+            let base = baseFolderPath(accountEmail: accountEmail, folderPath: folderPath)
+            var local = base
+            var suffix = 2
+            while taken.contains(local.lowercased()) {
+                local = "\(base)_\(suffix)"
+                suffix += 1
+            }
+            if local != base {
+                logWarning("Folder '\(folderPath)' collides with another folder at '\(base)', storing as '\(local)'")
+            }
+            taken.insert(local.lowercased())
+            assignments[folderPath] = local
+        }
 
-        let contents = try fileManager.contentsOfDirectory(at: folderURL, includingPropertiesForKeys: nil)
-        var hashEntries: [String] = []
+        moveFoldersBackedUpElsewhere(accountEmail: accountEmail, previous: previous, assignments: assignments)
 
-        for fileURL in contents where fileURL.pathExtension == "eml" {
-            if let hash = computeContentHash(at: fileURL) {
-                hashEntries.append("\(hash)\t\(fileURL.lastPathComponent)")
+        if assignments != previous {
+            try saveFolderAssignments(assignments, for: accountEmail)
+        }
+        return assignments.filter { folderPath, local in
+            local != baseFolderPath(accountEmail: accountEmail, folderPath: folderPath)
+        }
+    }
+
+    /// Move folders whose local path changed, e.g. after flattening was turned on or off, so their
+    /// emails are found instead of downloaded again into a new tree. Without a recorded path a
+    /// folder was last stored nested. Deepest sources move first, so a parent never carries a
+    /// child away before it moved; targets that already exist are left alone.
+    private func moveFoldersBackedUpElsewhere(accountEmail: String, previous: [String: String], assignments: [String: String]) {
+        let accountURL = baseURL.appendingPathComponent(accountEmail.sanitizedForFilename())
+        func depth(_ path: String) -> Int { path.components(separatedBy: "/").count }
+
+        let moves = assignments.compactMap { folderPath, local -> (from: String, to: String)? in
+            let old = previous[folderPath] ?? baseFolderPath(accountEmail: accountEmail, folderPath: folderPath, separator: "/")
+            return old == local ? nil : (old, local)
+        }.sorted { depth($0.from) != depth($1.from) ? depth($0.from) > depth($1.from) : depth($0.to) < depth($1.to) }
+
+        for move in moves {
+            let source = accountURL.appendingPathComponent(move.from)
+            let target = accountURL.appendingPathComponent(move.to)
+            guard fileManager.fileExists(atPath: source.path) else { continue }
+            guard !fileManager.fileExists(atPath: target.path) else {
+                logWarning("Cannot move folder '\(move.from)' to '\(move.to)', which already exists; its emails will be downloaded again")
+                continue
+            }
+            do {
+                try fileManager.createDirectory(at: target.deletingLastPathComponent(), withIntermediateDirectories: true)
+                try fileManager.moveItem(at: source, to: target)
+                logInfo("Moved folder '\(move.from)' to '\(move.to)'")
+            } catch {
+                logWarning("Cannot move folder '\(move.from)' to '\(move.to)': \(error.localizedDescription)")
             }
         }
+    }
 
-        let indexURL = hashIndexURL(for: folderURL)
-        let content = hashEntries.joined(separator: "\n") + (hashEntries.isEmpty ? "" : "\n")
-        try content.write(to: indexURL, atomically: true, encoding: .utf8)
+    /// Read collision assignments from the account directory, caching them in memory
+    private func loadFolderAssignments(for accountEmail: String) -> [String: String] {
+        let key = accountEmail.sanitizedForFilename()
+        if let cached = folderAssignments[key] {
+            return cached
+        }
+
+        let mapURL = baseURL.appendingPathComponent(key).appendingPathComponent(folderMapFilename)
+        var assignments: [String: String] = [:]
+        if let data = try? Data(contentsOf: mapURL),
+           let decoded = try? JSONDecoder().decode([String: String].self, from: data) {
+            assignments = decoded
+        }
+        folderAssignments[key] = assignments
+        return assignments
+    }
+
+    /// Persist collision assignments atomically in the account directory
+    private func saveFolderAssignments(_ assignments: [String: String], for accountEmail: String) throws {
+        let accountURL = try createAccountDirectory(email: accountEmail)
+        let mapURL = accountURL.appendingPathComponent(folderMapFilename)
+
+        let encoder = JSONEncoder()
+        encoder.outputFormatting = [.prettyPrinted, .sortedKeys]
+        try encoder.encode(assignments).write(to: mapURL, options: .atomic)
+
+        folderAssignments[accountEmail.sanitizedForFilename()] = assignments
+    }
+
+    /// Local directory URL for a server folder
+    private func resolveFolderURL(accountEmail: String, folderPath: String) -> URL {
+        baseURL
+            .appendingPathComponent(accountEmail.sanitizedForFilename())
+            .appendingPathComponent(localFolderPath(accountEmail: accountEmail, folderPath: folderPath))
+    }
+
+    // MARK: - Resume Checkpoint
+
+    /// Record which of the pending UIDs are still missing on disk
+    @discardableResult
+    func saveCheckpoint(accountEmail: String, pending: [(path: String, uids: [UInt32])], reason: String) throws -> BackupCheckpoint {
+        var folders: [BackupCheckpoint.PendingFolder] = []
+        for (path, uids) in pending {
+            let existing = (try? getExistingUIDs(accountEmail: accountEmail, folderPath: path)) ?? []
+            let remaining = uids.filter { !existing.contains($0) }
+            if !remaining.isEmpty {
+                folders.append(BackupCheckpoint.PendingFolder(path: path, uids: remaining))
+            }
+        }
+
+        let checkpoint = BackupCheckpoint(createdAt: Date(), reason: reason, folders: folders)
+        let accountURL = try createAccountDirectory(email: accountEmail)
+
+        let encoder = JSONEncoder()
+        encoder.outputFormatting = [.prettyPrinted, .sortedKeys]
+        encoder.dateEncodingStrategy = .iso8601
+        try encoder.encode(checkpoint).write(to: accountURL.appendingPathComponent(checkpointFilename), options: .atomic)
+
+        return checkpoint
+    }
+
+    /// Checkpoint left by an interrupted backup, if any
+    func loadCheckpoint(accountEmail: String) -> BackupCheckpoint? {
+        let checkpointURL = baseURL
+            .appendingPathComponent(accountEmail.sanitizedForFilename())
+            .appendingPathComponent(checkpointFilename)
+        guard let data = try? Data(contentsOf: checkpointURL) else { return nil }
+
+        let decoder = JSONDecoder()
+        decoder.dateDecodingStrategy = .iso8601
+        return try? decoder.decode(BackupCheckpoint.self, from: data)
+    }
+
+    /// Remove the checkpoint once a backup finished all its work
+    func clearCheckpoint(accountEmail: String) {
+        let checkpointURL = baseURL
+            .appendingPathComponent(accountEmail.sanitizedForFilename())
+            .appendingPathComponent(checkpointFilename)
+        try? fileManager.removeItem(at: checkpointURL)
+    }
+
+    // MARK: - Backup Report
+
+    /// backup_report.jsonl in the account directory
+    func reportURL(accountEmail: String) -> URL {
+        baseURL
+            .appendingPathComponent(accountEmail.sanitizedForFilename())
+            .appendingPathComponent(reportFilename)
+    }
+
+    /// Append one record as a single line and flush it to disk
+    func appendReportRecord(_ record: BackupReportRecord) throws {
+        _ = try createAccountDirectory(email: record.accountEmail)
+        let url = reportURL(accountEmail: record.accountEmail)
+
+        let encoder = JSONEncoder()
+        encoder.outputFormatting = [.sortedKeys]
+        encoder.dateEncodingStrategy = .iso8601
+        var line = try encoder.encode(record)
+        line.append(UInt8(ascii: "\n"))
+
+        if !fileManager.fileExists(atPath: url.path) {
+            fileManager.createFile(atPath: url.path, contents: nil)
+        }
+        let handle = try FileHandle(forWritingTo: url)
+        defer { try? handle.close() }
+        try handle.seekToEnd()
+        try handle.write(contentsOf: line)
+        try handle.synchronize()
+    }
+
+    /// All records of the report; a line cut off by a crash is skipped
+    func loadReportRecords(accountEmail: String) -> [BackupReportRecord] {
+        guard let data = try? Data(contentsOf: reportURL(accountEmail: accountEmail)) else { return [] }
+
+        let decoder = JSONDecoder()
+        decoder.dateDecodingStrategy = .iso8601
+        return data.split(separator: UInt8(ascii: "\n")).compactMap {
+            try? decoder.decode(BackupReportRecord.self, from: Data($0))
+        }
     }
 
     // MARK: - Directory Management
@@ -358,16 +792,11 @@ actor StorageService {
     }
 
     func createFolderDirectory(accountEmail: String, folderPath: String) throws -> URL {
-        let accountURL = try createAccountDirectory(email: accountEmail)
+        _ = try createAccountDirectory(email: accountEmail)
 
         // Convert IMAP folder path to filesystem path
         // e.g., "Work/Projects/Alpha" -> "Work/Projects/Alpha"
-        let sanitizedPath = folderPath
-            .components(separatedBy: "/")
-            .map { $0.sanitizedForFilename() }
-            .joined(separator: "/")
-
-        let folderURL = accountURL.appendingPathComponent(sanitizedPath)
+        let folderURL = resolveFolderURL(accountEmail: accountEmail, folderPath: folderPath)
 
         if !fileManager.fileExists(atPath: folderURL.path) {
             try fileManager.createDirectory(at: folderURL, withIntermediateDirectories: true)
@@ -382,7 +811,7 @@ actor StorageService {
     func saveEmail(_ emailData: Data, email: Email, accountEmail: String, folderPath: String) throws -> URL {
         let folderURL = try createFolderDirectory(accountEmail: accountEmail, folderPath: folderPath)
         let filename = email.filename()
-        let fileURL = folderURL.appendingPathComponent(filename)
+        let fileURL = try messageDirectory(for: email, in: folderURL).appendingPathComponent(filename)
 
         // Check for duplicate filename and increment if needed
         let finalURL = uniqueFileURL(for: fileURL)
@@ -395,15 +824,315 @@ actor StorageService {
 
         // Append UID to cache for O(1) lookup on next backup
         appendUIDToCache(email.uid, folderURL: folderURL)
+        appendMessageIDToCache(of: emailData, folderURL: folderURL)
 
         return finalURL
     }
 
+    /// Keep a suspect download under <account>/.quarantine/<folder> for inspection.
+    /// It is not recorded as backed up, so the next backup downloads the email again.
+    /// A download identical to one already quarantined for the same UID is not kept twice.
+    func quarantineEmail(_ emailData: Data, email: Email, accountEmail: String, folderPath: String) throws -> URL {
+        let folderURL = try quarantineFolder(accountEmail: accountEmail, folderPath: folderPath)
+        if let existing = quarantinedCopy(uid: email.uid, in: folderURL, size: emailData.count, sameContent: {
+            (try? Data(contentsOf: $0)) == emailData
+        }) {
+            return existing
+        }
+
+        let fileURL = uniqueFileURL(for: folderURL.appendingPathComponent(email.filename()))
+        try emailData.write(to: fileURL, options: .atomic)
+        return fileURL
+    }
+
+    /// Quarantine a streamed download from its temporary file, like `quarantineEmail`
+    func quarantineStreamedFile(_ tempURL: URL, email: Email, accountEmail: String, folderPath: String) throws -> URL {
+        let folderURL = try quarantineFolder(accountEmail: accountEmail, folderPath: folderPath)
+        let size = (try? fileManager.attributesOfItem(atPath: tempURL.path)[.size] as? Int) ?? 0
+        if let existing = quarantinedCopy(uid: email.uid, in: folderURL, size: size, sameContent: {
+            fileManager.contentsEqual(atPath: $0.path, andPath: tempURL.path)
+        }) {
+            try fileManager.removeItem(at: tempURL)
+            return existing
+        }
+
+        let fileURL = uniqueFileURL(for: folderURL.appendingPathComponent(email.filename()))
+        try fileManager.moveItem(at: tempURL, to: fileURL)
+        return fileURL
+    }
+
+    private func quarantineFolder(accountEmail: String, folderPath: String) throws -> URL {
+        let folderURL = try createAccountDirectory(email: accountEmail)
+            .appendingPathComponent(Self.quarantineDirectory)
+            .appendingPathComponent(localFolderPath(accountEmail: accountEmail, folderPath: folderPath))
+        try fileManager.createDirectory(at: folderURL, withIntermediateDirectories: true)
+        return folderURL
+    }
+
+    /// A file quarantined earlier for `uid` with the same content. Names carry the date and sender,
+    /// which a streamed download only guesses, so files are matched by UID and compared.
+    private func quarantinedCopy(uid: UInt32, in folderURL: URL, size: Int, sameContent: (URL) -> Bool) -> URL? {
+        let files = (try? fileManager.contentsOfDirectory(at: folderURL, includingPropertiesForKeys: [.fileSizeKey])) ?? []
+        return files.first { url in
+            url.lastPathComponent.hasPrefix("\(uid)_")
+                && (try? url.resourceValues(forKeys: [.fileSizeKey]).fileSize) == size
+                && sameContent(url)
+        }
+    }
+
+    /// Write the envelope sidecar next to an email: <name>.envelope.json
+    @discardableResult
+    func saveEnvelopeSidecar(_ sidecar: EnvelopeSidecar, for emailURL: URL) throws -> URL {
+        let sidecarURL = emailURL.deletingPathExtension().appendingPathExtension("envelope.json")
+
+        let encoder = JSONEncoder()
+        encoder.outputFormatting = [.prettyPrinted, .sortedKeys]
+        encoder.dateEncodingStrategy = .iso8601
+        try encoder.encode(sidecar).write(to: sidecarURL, options: .atomic)
+
+        return sidecarURL
+    }
+
+    /// Headers-only backup: write just the envelope sidecar where the email would go.
+    /// The UID is not recorded as backed up, so a later full backup still downloads the body.
+    @discardableResult
+    func saveHeadersOnly(_ sidecar: EnvelopeSidecar, email: Email, accountEmail: String, folderPath: String) throws -> URL {
+        let folderURL = try createFolderDirectory(accountEmail: accountEmail, folderPath: folderPath)
+        let emailURL = try messageDirectory(for: email, in: folderURL).appendingPathComponent(email.filename())
+        return try saveEnvelopeSidecar(sidecar, for: emailURL)
+    }
+
+    /// UIDs that have an envelope sidecar, with or without the email itself
+    func getEnvelopeUIDs(accountEmail: String, folderPath: String) throws -> Set<UInt32> {
+        let folderURL = resolveFolderURL(accountEmail: accountEmail, folderPath: folderPath)
+        guard fileManager.fileExists(atPath: folderURL.path) else {
+            return []
+        }
+
+        var uids = Set<UInt32>()
+        for fileURL in try Self.messageFiles(in: folderURL) where fileURL.lastPathComponent.hasSuffix(".envelope.json") {
+            let filename = fileURL.lastPathComponent
+            if let firstUnderscore = filename.firstIndex(of: "_"),
+               let uid = UInt32(filename[..<firstUnderscore]) {
+                uids.insert(uid)
+            }
+        }
+        return uids
+    }
+
+    /// Rewrite envelope sidecars in a folder whose text is not clean UTF-8
+    /// Returns the number of sidecars repaired
+    func repairEnvelopeSidecars(accountEmail: String, folderPath: String) throws -> Int {
+        let folderURL = resolveFolderURL(accountEmail: accountEmail, folderPath: folderPath)
+        guard fileManager.fileExists(atPath: folderURL.path) else { return 0 }
+
+        let decoder = JSONDecoder()
+        decoder.dateDecodingStrategy = .iso8601
+
+        var repaired = 0
+        let contents = try Self.messageFiles(in: folderURL)
+        for fileURL in contents where fileURL.lastPathComponent.hasSuffix(".envelope.json") {
+            guard let data = try? Data(contentsOf: fileURL) else { continue }
+
+            // Invalid bytes become U+FFFD so the JSON can be decoded at all
+            let cleanData = Data(String(decoding: data, as: UTF8.self).utf8)
+            guard let sidecar = try? decoder.decode(EnvelopeSidecar.self, from: cleanData) else {
+                logWarning("Unreadable envelope sidecar: \(fileURL.lastPathComponent)")
+                continue
+            }
+
+            let sanitized = sidecar.sanitized()
+            guard cleanData != data || sanitized.envelope != sidecar.envelope || sanitized.bodyStructure != sidecar.bodyStructure else {
+                continue
+            }
+
+            let emailURL = fileURL.deletingPathExtension().deletingPathExtension().appendingPathExtension("eml")
+            try saveEnvelopeSidecar(sanitized, for: emailURL)
+            repaired += 1
+        }
+
+        if repaired > 0 {
+            logInfo("Repaired \(repaired) envelope sidecars in \(folderPath)")
+        }
+        return repaired
+    }
+
+    /// Write refreshed server flags into the envelope sidecars of a folder, with the read state set by `policy`.
+    /// Emails without a sidecar have no stored flags and are left alone.
+    /// Returns the number of sidecars whose flags changed
+    func updateEnvelopeFlags(
+        _ flags: [UInt32: [String]],
+        accountEmail: String,
+        folderPath: String,
+        policy: LocalFlagPolicy = .preserve,
+        refreshedAt: Date = Date()
+    ) throws -> Int {
+        let folderURL = resolveFolderURL(accountEmail: accountEmail, folderPath: folderPath)
+        guard !flags.isEmpty, fileManager.fileExists(atPath: folderURL.path) else { return 0 }
+
+        let decoder = JSONDecoder()
+        decoder.dateDecodingStrategy = .iso8601
+
+        var updated = 0
+        for fileURL in try Self.messageFiles(in: folderURL) where fileURL.lastPathComponent.hasSuffix(".envelope.json") {
+            let filename = fileURL.lastPathComponent
+            guard let firstUnderscore = filename.firstIndex(of: "_"),
+                  let uid = UInt32(filename[..<firstUnderscore]),
+                  let serverFlags = flags[uid],
+                  let data = try? Data(contentsOf: fileURL),
+                  let sidecar = try? decoder.decode(EnvelopeSidecar.self, from: data) else {
+                continue
+            }
+
+            var refreshed = sidecar
+            refreshed.flags = serverFlags
+            refreshed = refreshed.applying(policy)
+            guard refreshed.flags != sidecar.flags else { continue }
+            refreshed.flagLabels = MessageFlags.labels(for: refreshed.flags ?? [])
+            refreshed.flagsRefreshedAt = refreshedAt
+
+            let emailURL = fileURL.deletingPathExtension().deletingPathExtension().appendingPathExtension("eml")
+            try saveEnvelopeSidecar(refreshed, for: emailURL)
+            updated += 1
+        }
+        return updated
+    }
+
+    /// Highest mod-sequence of the last flag refresh, nil if none or the folder's UIDVALIDITY changed since
+    func flagsModSeq(accountEmail: String, folderPath: String, uidValidity: UInt32) -> UInt64? {
+        let url = resolveFolderURL(accountEmail: accountEmail, folderPath: folderPath)
+            .appendingPathComponent(flagsModSeqFilename)
+        guard let text = try? String(contentsOf: url, encoding: .utf8) else { return nil }
+        // "<uidvalidity> <modseq>"
+        let parts = text.split(separator: " ").map { $0.trimmingCharacters(in: .whitespacesAndNewlines) }
+        guard parts.count == 2, UInt32(parts[0]) == uidValidity else { return nil }
+        return UInt64(parts[1])
+    }
+
+    /// Remember where the next flag refresh of a folder can start with CHANGEDSINCE
+    func recordFlagsModSeq(_ modSeq: UInt64, uidValidity: UInt32, accountEmail: String, folderPath: String) throws {
+        let folderURL = resolveFolderURL(accountEmail: accountEmail, folderPath: folderPath)
+        guard fileManager.fileExists(atPath: folderURL.path) else { return }
+        try "\(uidValidity) \(modSeq)"
+            .write(to: folderURL.appendingPathComponent(flagsModSeqFilename), atomically: true, encoding: .utf8)
+    }
+
+    // MARK: - Folder Summary
+
+    /// Count the folder's emails and write `_folder.json`. Returns nil without writing
+    /// anything when the folder has never been backed up.
+    @discardableResult
+    func writeFolderSummary(
+        accountEmail: String,
+        folderPath: String,
+        uidValidity: UInt32?,
+        syncedAt: Date = Date()
+    ) throws -> FolderSummary? {
+        let folderURL = resolveFolderURL(accountEmail: accountEmail, folderPath: folderPath)
+        guard fileManager.fileExists(atPath: folderURL.path) else { return nil }
+
+        var summary = FolderSummary(folder: folderPath, messageCount: 0, totalBytes: 0, uidValidity: uidValidity, lastSync: syncedAt)
+        for fileURL in try Self.messageFiles(in: folderURL) where fileURL.pathExtension == "eml" {
+            summary.messageCount += 1
+            summary.totalBytes += Int64((try? fileURL.resourceValues(forKeys: [.fileSizeKey]).fileSize) ?? 0)
+            if let date = Self.messageDate(fromFilename: fileURL.lastPathComponent) {
+                summary.oldestMessage = min(summary.oldestMessage ?? date, date)
+                summary.newestMessage = max(summary.newestMessage ?? date, date)
+            }
+        }
+
+        let encoder = JSONEncoder()
+        encoder.outputFormatting = [.prettyPrinted, .sortedKeys]
+        encoder.dateEncodingStrategy = .iso8601
+        try encoder.encode(summary).write(to: folderURL.appendingPathComponent(Self.folderSummaryFilename), options: .atomic)
+        return summary
+    }
+
+    /// The folder's `_folder.json`, if one was written
+    func folderSummary(accountEmail: String, folderPath: String) -> FolderSummary? {
+        let url = resolveFolderURL(accountEmail: accountEmail, folderPath: folderPath)
+            .appendingPathComponent(Self.folderSummaryFilename)
+        guard let data = try? Data(contentsOf: url) else { return nil }
+        let decoder = JSONDecoder()
+        decoder.dateDecodingStrategy = .iso8601
+        return try? decoder.decode(FolderSummary.self, from: data)
+    }
+
+    /// Date in a `<UID>_<yyyyMMdd>_<HHmmss>_<sender>.eml` filename, read the way `Email.filename()` wrote it
+    nonisolated static func messageDate(fromFilename filename: String) -> Date? {
+        let parts = filename.components(separatedBy: "_")
+        guard parts.count >= 3, parts[1].count == 8, parts[2].count == 6 else { return nil }
+
+        let dateFormatter = DateFormatter()
+        dateFormatter.dateFormat = "yyyyMMdd_HHmmss"
+        return dateFormatter.date(from: "\(parts[1])_\(parts[2])")
+    }
+
+    /// Check recorded attachments in a folder against their stored size and checksum.
+    /// With `since`, only emails whose attachment metadata was written after that date are checked.
+    /// Throws `CancellationError` between emails once the calling task is cancelled.
+    func verifyAttachments(accountEmail: String, folderPath: String, since: Date? = nil) throws -> [AttachmentIntegrityIssue] {
+        let folderURL = resolveFolderURL(accountEmail: accountEmail, folderPath: folderPath)
+        guard fileManager.fileExists(atPath: folderURL.path) else {
+            return []
+        }
+        let emailURLs = try Self.messageFiles(in: folderURL)
+            .filter { $0.pathExtension == "eml" }
+            .filter { emailURL in
+                guard let since = since else { return true }
+                let sidecarURL = AttachmentMetadata.sidecarURL(for: emailURL)
+                guard let modified = try? sidecarURL.resourceValues(forKeys: [.contentModificationDateKey]).contentModificationDate else {
+                    return false
+                }
+                return modified >= since
+            }
+
+        var issues: [AttachmentIntegrityIssue] = []
+        for emailURL in emailURLs {
+            try Task.checkCancellation()
+            issues += AttachmentService.verifyAttachments(for: emailURL)
+        }
+        return issues
+    }
+
+    /// When the folder's attachments were last verified, nil if never
+    func lastVerification(accountEmail: String, folderPath: String) -> Date? {
+        let url = resolveFolderURL(accountEmail: accountEmail, folderPath: folderPath)
+            .appendingPathComponent(lastVerifiedFilename)
+        guard let text = try? String(contentsOf: url, encoding: .utf8) else { return nil }
+        return ISO8601DateFormatter().date(from: text.trimmingCharacters(in: .whitespacesAndNewlines))
+    }
+
+    /// Remember a verification; use its start time so files added meanwhile are checked next time
+    func recordVerification(at date: Date, accountEmail: String, folderPath: String) throws {
+        let folderURL = resolveFolderURL(accountEmail: accountEmail, folderPath: folderPath)
+        guard fileManager.fileExists(atPath: folderURL.path) else { return }
+        try ISO8601DateFormatter().string(from: date)
+            .write(to: folderURL.appendingPathComponent(lastVerifiedFilename), atomically: true, encoding: .utf8)
+    }
+
+    /// Verify a saved email matches the downloaded data (SHA256 checksum)
+    func verifySavedEmail(at url: URL, matches data: Data) -> Bool {
+        guard let saved = try? Data(contentsOf: url), saved.count == data.count else {
+            return false
+        }
+        return SHA256.hash(data: saved) == SHA256.hash(data: data)
+    }
+
+    /// Verify a streamed email was written completely
+    func verifySavedEmail(at url: URL, expectedSize: Int) -> Bool {
+        guard let attributes = try? fileManager.attributesOfItem(atPath: url.path),
+              let size = attributes[.size] as? Int else {
+            return false
+        }
+        return size == expectedSize
+    }
+
     /// Prepare a destination URL for streaming large emails directly to disk
     func prepareStreamingDestination(email: Email, accountEmail: String, folderPath: String) throws -> (tempURL: URL, finalURL: URL) {
         let folderURL = try createFolderDirectory(accountEmail: accountEmail, folderPath: folderPath)
         let filename = email.filename()
-        let fileURL = folderURL.appendingPathComponent(filename)
+        let fileURL = try messageDirectory(for: email, in: folderURL).appendingPathComponent(filename)
         let finalURL = uniqueFileURL(for: fileURL)
         let tempURL = finalURL.appendingPathExtension("tmp")
         return (tempURL, finalURL)
@@ -418,8 +1147,11 @@ actor StorageService {
 
         // Append UID to cache for O(1) lookup on next backup
         if let uid = uid {
-            let folderURL = finalURL.deletingLastPathComponent()
+            let folderURL = Self.folderURL(containing: finalURL)
             appendUIDToCache(uid, folderURL: folderURL)
+            if let head = Self.headerPrefix(of: finalURL) {
+                appendMessageIDToCache(of: head, folderURL: folderURL)
+            }
         }
     }
 
@@ -450,7 +1182,7 @@ actor StorageService {
     func saveAttachment(_ data: Data, filename: String, email: Email, accountEmail: String, folderPath: String) throws -> URL {
         let folderURL = try createFolderDirectory(accountEmail: accountEmail, folderPath: folderPath)
         let attachmentFolderName = email.attachmentFolderName()
-        let attachmentFolderURL = folderURL.appendingPathComponent(attachmentFolderName)
+        let attachmentFolderURL = try messageDirectory(for: email, in: folderURL).appendingPathComponent(attachmentFolderName)
 
         if !fileManager.fileExists(atPath: attachmentFolderURL.path) {
             try fileManager.createDirectory(at: attachmentFolderURL, withIntermediateDirectories: true)
@@ -473,15 +1205,7 @@ actor StorageService {
     /// Get UIDs of already downloaded emails
     /// Uses cache file for O(1) lookup, falls back to O(n) file scan if cache missing
     func getExistingUIDs(accountEmail: String, folderPath: String) throws -> Set<UInt32> {
-        let sanitizedEmail = accountEmail.sanitizedForFilename()
-        let sanitizedPath = folderPath
-            .components(separatedBy: "/")
-            .map { $0.sanitizedForFilename() }
-            .joined(separator: "/")
-
-        let folderURL = baseURL
-            .appendingPathComponent(sanitizedEmail)
-            .appendingPathComponent(sanitizedPath)
+        let folderURL = resolveFolderURL(accountEmail: accountEmail, folderPath: folderPath)
 
         guard fileManager.fileExists(atPath: folderURL.path) else {
             return []
@@ -493,10 +1217,30 @@ actor StorageService {
         }
 
         // Cache miss - fall back to file scan (slow path, builds cache)
-        let contents = try fileManager.contentsOfDirectory(at: folderURL, includingPropertiesForKeys: nil)
-        var uids = Set<UInt32>()
+        let uids = try Self.scanUIDs(in: folderURL)
 
-        for fileURL in contents where fileURL.pathExtension == "eml" {
+        // Build cache for next time
+        let cacheURL = uidCacheURL(for: folderURL)
+        let content = uids.map { String($0) }.joined(separator: "\n") + (uids.isEmpty ? "" : "\n")
+        try? content.write(to: cacheURL, atomically: true, encoding: .utf8)
+
+        return uids
+    }
+
+    /// Backed-up UIDs like `getExistingUIDs`, but a missing UID cache is not written, for dry runs
+    func peekExistingUIDs(accountEmail: String, folderPath: String) throws -> Set<UInt32> {
+        let folderURL = resolveFolderURL(accountEmail: accountEmail, folderPath: folderPath)
+
+        guard fileManager.fileExists(atPath: folderURL.path) else {
+            return []
+        }
+        return try readUIDsFromCache(folderURL: folderURL) ?? Self.scanUIDs(in: folderURL)
+    }
+
+    /// UIDs of the .eml files in a folder, read from the start of their names
+    private nonisolated static func scanUIDs(in folderURL: URL) throws -> Set<UInt32> {
+        var uids = Set<UInt32>()
+        for fileURL in try messageFiles(in: folderURL) where fileURL.pathExtension == "eml" {
             let filename = fileURL.deletingPathExtension().lastPathComponent
             // Extract UID from start of filename (before first underscore)
             if let firstUnderscore = filename.firstIndex(of: "_"),
@@ -504,19 +1248,55 @@ actor StorageService {
                 uids.insert(uid)
             }
         }
+        return uids
+    }
 
-        // Build cache for next time
-        let cacheURL = uidCacheURL(for: folderURL)
-        let content = uids.map { String($0) }.joined(separator: "\n") + (uids.isEmpty ? "" : "\n")
-        try? content.write(to: cacheURL, atomically: true, encoding: .utf8)
+    /// The .eml saved for a UID, found by the UID its name starts with
+    func savedEmailURL(uid: UInt32, accountEmail: String, folderPath: String) throws -> URL? {
+        let folderURL = resolveFolderURL(accountEmail: accountEmail, folderPath: folderPath)
+        guard fileManager.fileExists(atPath: folderURL.path) else {
+            return nil
+        }
+        return try Self.messageFiles(in: folderURL).first {
+            $0.pathExtension == "eml" && $0.lastPathComponent.hasPrefix("\(uid)_")
+        }
+    }
 
-        return uids
+    /// UIDs among `candidates` whose .eml is on disk although the UID cache does not list them,
+    /// e.g. after the cache was lost or truncated. Their cache entries are restored so the
+    /// emails are not downloaded again as duplicates.
+    func recoverUncachedUIDs(_ candidates: [UInt32], accountEmail: String, folderPath: String) throws -> Set<UInt32> {
+        guard !candidates.isEmpty else { return [] }
+
+        let folderURL = resolveFolderURL(accountEmail: accountEmail, folderPath: folderPath)
+        guard fileManager.fileExists(atPath: folderURL.path) else {
+            return []
+        }
+
+        let wanted = Set(candidates)
+        var found = Set<UInt32>()
+        for fileURL in try Self.messageFiles(in: folderURL) where fileURL.pathExtension == "eml" {
+            let filename = fileURL.deletingPathExtension().lastPathComponent
+            if let firstUnderscore = filename.firstIndex(of: "_"),
+               let uid = UInt32(filename[..<firstUnderscore]),
+               wanted.contains(uid) {
+                found.insert(uid)
+            }
+        }
+
+        for uid in found.sorted() {
+            appendUIDToCache(uid, folderURL: folderURL)
+        }
+        if !found.isEmpty {
+            logInfo("Restored \(found.count) missing UID cache entries in \(folderPath)")
+        }
+        return found
     }
 
     func emailExists(messageId: String, accountEmail: String, folderPath: String) throws -> Bool {
         // This is a simple check - in production, use the database
         let folderURL = try createFolderDirectory(accountEmail: accountEmail, folderPath: folderPath)
-        let contents = try fileManager.contentsOfDirectory(at: folderURL, includingPropertiesForKeys: nil)
+        let contents = try Self.messageFiles(in: folderURL)
         return contents.contains { $0.pathExtension == "eml" }
     }
 
@@ -530,6 +1310,71 @@ actor StorageService {
         return try countFiles(at: accountURL, withExtension: "eml")
     }
 
+    // MARK: - Date Partitions
+
+    /// Directory a new email is written to: the folder itself, or its YYYY/MM partition
+    private func messageDirectory(for email: Email, in folderURL: URL) throws -> URL {
+        guard layout == .datePartitioned else { return folderURL }
+
+        let components = Calendar.current.dateComponents([.year, .month], from: email.date)
+        let partitionURL = folderURL
+            .appendingPathComponent(String(format: "%04d", components.year ?? 1970))
+            .appendingPathComponent(String(format: "%02d", components.month ?? 1))
+
+        if !fileManager.fileExists(atPath: partitionURL.path) {
+            try fileManager.createDirectory(at: partitionURL, withIntermediateDirectories: true)
+        }
+        return partitionURL
+    }
+
+    /// Whether a directory is a YYYY/MM partition inside a folder
+    nonisolated static func isDatePartition(_ url: URL) -> Bool {
+        let month = url.lastPathComponent
+        let year = url.deletingLastPathComponent().lastPathComponent
+        guard month.count == 2, year.count == 4,
+              let monthNumber = Int(month), (1...12).contains(monthNumber),
+              Int(year) != nil else {
+            return false
+        }
+        return true
+    }
+
+    /// Whether a directory is the YYYY level of a date partition
+    nonisolated static func isDatePartitionYear(_ url: URL) -> Bool {
+        let year = url.lastPathComponent
+        guard year.count == 4, Int(year) != nil,
+              let months = try? FileManager.default.contentsOfDirectory(at: url, includingPropertiesForKeys: nil) else {
+            return false
+        }
+        return months.contains { isDatePartition($0) }
+    }
+
+    /// Folder directory an email file belongs to, skipping any date partition
+    nonisolated static func folderURL(containing fileURL: URL) -> URL {
+        let directoryURL = fileURL.deletingLastPathComponent()
+        guard isDatePartition(directoryURL) else { return directoryURL }
+        return directoryURL.deletingLastPathComponent().deletingLastPathComponent()
+    }
+
+    /// Files of a folder in either layout: its own files plus those in YYYY/MM partitions
+    /// Subfolders that are IMAP folders themselves are not included.
+    nonisolated static func messageFiles(in folderURL: URL) throws -> [URL] {
+        let fileManager = FileManager.default
+        var files: [URL] = []
+
+        for url in try fileManager.contentsOfDirectory(at: folderURL, includingPropertiesForKeys: nil) {
+            guard isDatePartitionYear(url) else {
+                files.append(url)
+                continue
+            }
+            let months = try fileManager.contentsOfDirectory(at: url, includingPropertiesForKeys: nil)
+            for monthURL in months where isDatePartition(monthURL) {
+                files.append(contentsOf: try fileManager.contentsOfDirectory(at: monthURL, includingPropertiesForKeys: nil))
+            }
+        }
+        return files
+    }
+
     // MARK: - Helpers
 
     private func uniqueFileURL(for url: URL) -> URL {
@@ -561,7 +1406,8 @@ actor StorageService {
 
     private func countFiles(at url: URL, withExtension ext: String) throws -> Int {
         var count = 0
-        let enumerator = fileManager.enumerator(at: url, includingPropertiesForKeys: nil)
+        // Hidden directories such as .quarantine are not part of the backup
+        let enumerator = fileManager.enumerator(at: url, includingPropertiesForKeys: nil, options: [.skipsHiddenFiles])
 
         while let fileURL = enumerator?.nextObject() as? URL {
             if fileURL.pathExtension == ext {
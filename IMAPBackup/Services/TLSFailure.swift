@@ -0,0 +1,122 @@
+import Foundation
+import Network
+import Security
+
+/// Why a secure connection could not be set up. A rejected certificate is told apart from a
+/// server that is down, with what to do about it.
+struct TLSFailure: Equatable {
+    enum Reason: String, Equatable {
+        case expired
+        case notYetValid
+        case unknownAuthority
+        case hostnameMismatch
+        case revoked
+        /// Some other problem with the certificate
+        case rejected
+        /// The handshake failed for a reason other than the certificate
+        case handshake
+    }
+
+    let reason: Reason
+    /// Name the certificate was checked against
+    let host: String
+    /// The system's own wording, for the log
+    var detail: String?
+
+    var message: String {
+        switch reason {
+        case .expired:
+            return "The certificate of \(host) has expired"
+        case .notYetValid:
+            return "The certificate of \(host) is not valid yet"
+        case .unknownAuthority:
+            return "The certificate of \(host) is not issued by an authority this Mac trusts"
+        case .hostnameMismatch:
+            return "The certificate presented by the server is not issued for \(host)"
+        case .revoked:
+            return "The certificate of \(host) has been revoked"
+        case .rejected:
+            return "The certificate of \(host) was rejected" + (detail.map { ": \($0)" } ?? "")
+        case .handshake:
+            return "The secure connection to \(host) could not be set up" + (detail.map { ": \($0)" } ?? "")
+        }
+    }
+
+    var suggestion: String {
+        switch reason {
+        case .expired, .notYetValid:
+            return "Check that this Mac's date and time are right; otherwise the provider has to renew the certificate."
+        case .unknownAuthority:
+            return "If the server uses its own or a company CA, add that certificate in Keychain Access and set it to Always Trust."
+        case .hostnameMismatch:
+            return "Connect using the name on the certificate, or set it as the account's TLS Server Name."
+        case .revoked:
+            return "Do not connect until the provider replaces the certificate."
+        case .rejected:
+            return "Check the server's certificate in Keychain Access or with the provider."
+        case .handshake:
+            return "Check the port and that the server expects SSL/TLS from the start."
+        }
+    }
+
+    /// Reason for a certificate the system's trust evaluation refused
+    static func reason(forTrustError error: CFError?) -> Reason {
+        guard let error = error else { return .rejected }
+        switch OSStatus(CFErrorGetCode(error)) {
+        case errSecCertificateExpired:
+            return .expired
+        case errSecCertificateNotValidYet:
+            return .notYetValid
+        case errSecHostNameMismatch:
+            return .hostnameMismatch
+        case errSecNotTrusted, errSecCreateChainFailed:
+            return .unknownAuthority
+        case errSecCertificateRevoked:
+            return .revoked
+        default:
+            return .rejected
+        }
+    }
+
+    /// Reason for a TLS status the connection failed with. Trust failures usually come back
+    /// as errSSLBadCert, so the trust evaluation's own reason is preferred when there is one.
+    static func reason(forStatus status: OSStatus) -> Reason {
+        switch status {
+        case errSSLCertExpired, errSSLPeerCertExpired:
+            return .expired
+        case errSSLCertNotYetValid:
+            return .notYetValid
+        case errSSLUnknownRootCert, errSSLNoRootCert, errSSLPeerUnknownCA:
+            return .unknownAuthority
+        case errSSLHostNameMismatch:
+            return .hostnameMismatch
+        case errSSLPeerCertRevoked:
+            return .revoked
+        case errSSLXCertChainInvalid, errSSLBadCert, errSSLPeerBadCert:
+            return .rejected
+        default:
+            return .handshake
+        }
+    }
+}
+
+/// Keeps why the system refused a server certificate during one connection attempt, which the
+/// connection's own error does not say. The verify block runs on another queue, hence the lock.
+final class TLSTrustRecorder: @unchecked Sendable {
+    private let lock = NSLock()
+    private var recorded: (reason: TLSFailure.Reason, detail: String?)?
+
+    var failure: (reason: TLSFailure.Reason, detail: String?)? {
+        lock.lock()
+        defer { lock.unlock() }
+        return recorded
+    }
+
+    func record(_ error: CFError?) {
+        let reason = TLSFailure.reason(forTrustError: error)
+        let detail = error.map { CFErrorCopyDescription($0) as String }
+        lock.lock()
+        recorded = (reason, detail)
+        lock.unlock()
+    }
+}
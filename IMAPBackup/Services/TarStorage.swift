@@ -0,0 +1,495 @@
+import Foundation
+
+enum TarStorageError: LocalizedError {
+    case corruptArchive(String)
+    case entryMissing(UInt32)
+
+    var errorDescription: String? {
+        switch self {
+        case .corruptArchive(let path):
+            return "The archive \(path) is damaged"
+        case .entryMissing(let uid):
+            return "Email UID \(uid) is not in the archive"
+        }
+    }
+}
+
+/// One email in a folder's archive
+struct TarIndexEntry: Equatable {
+    let uid: UInt32
+    /// Name of the file inside the archive
+    let name: String
+    /// Offset of the entry's 512-byte header; the email follows it
+    let offset: UInt64
+    let size: UInt64
+
+    /// Header, email and padding to the next block
+    var length: UInt64 {
+        TarStorage.blockSize + TarStorage.paddedSize(size)
+    }
+}
+
+/// Stores each folder as one growing tar archive, messages.tar, plus an index, messages.tar.index,
+/// instead of one file per email, so millions of emails take two files per folder and not millions
+/// of inodes. New emails are appended; the index gives each UID's offset for lookups and reads.
+/// Removed emails stay in the archive until `compact` rewrites it. The archive is plain ustar and
+/// opens with any tar tool; a lost or stale index is rebuilt from it.
+actor TarStorage: StorageBackend {
+    static let archiveFilename = "messages.tar"
+    static let indexFilename = "messages.tar.index"
+    /// Server folder path -> local directory, per account, like `StorageService` keeps it
+    static let folderMapFilename = ".folder_map.json"
+    static let blockSize: UInt64 = 512
+
+    let baseURL: URL
+    private let fileManager = FileManager.default
+
+    /// A folder's index as loaded: live entries by UID and where the next entry goes
+    private struct Folder {
+        var entries: [UInt32: TarIndexEntry] = [:]
+        /// End of the last entry, live or removed; the end-of-archive blocks follow
+        var end: UInt64 = 0
+    }
+
+    /// Indexes loaded this run, keyed by archive path
+    private var folders: [String: Folder] = [:]
+
+    /// Local directories of the folders archived so far, by account, read from the folder maps
+    private var folderAssignments: [String: [String: String]] = [:]
+
+    init(baseURL: URL) {
+        self.baseURL = baseURL
+    }
+
+    nonisolated var name: String { baseURL.path + " (tar)" }
+
+    // MARK: - StorageBackend
+
+    /// Append an email to its folder's archive and return the archive's URL
+    func saveEmail(_ emailData: Data, email: Email, accountEmail: String, folderPath: String) throws -> URL {
+        let archiveURL = try createArchive(accountEmail: accountEmail, folderPath: folderPath)
+        var folder = try loadFolder(archiveURL)
+
+        let entry = TarIndexEntry(
+            uid: email.uid,
+            name: Self.entryName(for: email),
+            offset: folder.end,
+            size: UInt64(emailData.count)
+        )
+        var block = Self.header(name: entry.name, size: entry.size, modified: email.date)
+        block.append(emailData)
+        block.append(Data(count: Int(Self.paddedSize(entry.size) - entry.size)))
+        // End-of-archive marker: two zero blocks, overwritten by the next append
+        block.append(Data(count: Int(2 * Self.blockSize)))
+
+        // The archive is written before the index, so a crash in between leaves an entry
+        // nothing points to, which the next append overwrites
+        let handle = try FileHandle(forUpdating: archiveURL)
+        defer { try? handle.close() }
+        try handle.seek(toOffset: entry.offset)
+        try handle.write(contentsOf: block)
+        try handle.truncate(atOffset: entry.offset + UInt64(block.count))
+        try handle.synchronize()
+
+        try appendToIndex(Self.indexLine(for: entry), archiveURL: archiveURL)
+        folder.entries[entry.uid] = entry
+        folder.end = entry.offset + entry.length
+        folders[archiveURL.path] = folder
+        return archiveURL
+    }
+
+    /// UIDs in the folder's index
+    func getExistingUIDs(accountEmail: String, folderPath: String) throws -> Set<UInt32> {
+        let archiveURL = archiveURL(accountEmail: accountEmail, folderPath: folderPath)
+        guard fileManager.fileExists(atPath: archiveURL.path) else { return [] }
+        return Set(try loadFolder(archiveURL).entries.keys)
+    }
+
+    /// The folder's archive when it holds the email
+    func savedEmailURL(uid: UInt32, accountEmail: String, folderPath: String) throws -> URL? {
+        let archiveURL = archiveURL(accountEmail: accountEmail, folderPath: folderPath)
+        guard fileManager.fileExists(atPath: archiveURL.path),
+              try loadFolder(archiveURL).entries[uid] != nil else {
+            return nil
+        }
+        return archiveURL
+    }
+
+    // MARK: - Reading
+
+    /// Index entries of a folder's archive, in archive order
+    func entries(accountEmail: String, folderPath: String) throws -> [TarIndexEntry] {
+        let archiveURL = archiveURL(accountEmail: accountEmail, folderPath: folderPath)
+        guard fileManager.fileExists(atPath: archiveURL.path) else { return [] }
+        return try loadFolder(archiveURL).entries.values.sorted { $0.offset < $1.offset }
+    }
+
+    /// An email read straight from its offset in the archive
+    func readEmail(uid: UInt32, accountEmail: String, folderPath: String) throws -> Data {
+        let archiveURL = archiveURL(accountEmail: accountEmail, folderPath: folderPath)
+        guard fileManager.fileExists(atPath: archiveURL.path),
+              let entry = try loadFolder(archiveURL).entries[uid] else {
+            throw TarStorageError.entryMissing(uid)
+        }
+
+        let handle = try FileHandle(forReadingFrom: archiveURL)
+        defer { try? handle.close() }
+        try handle.seek(toOffset: entry.offset + Self.blockSize)
+        guard let data = try handle.read(upToCount: Int(entry.size)), data.count == Int(entry.size) else {
+            throw TarStorageError.corruptArchive(archiveURL.path)
+        }
+        return data
+    }
+
+    // MARK: - Removing and Compacting
+
+    /// Drop emails from the index. Their bytes stay in the archive until `compact`.
+    /// Returns how many were in the index.
+    @discardableResult
+    func removeEmails(_ uids: Set<UInt32>, accountEmail: String, folderPath: String) throws -> Int {
+        let archiveURL = archiveURL(accountEmail: accountEmail, folderPath: folderPath)
+        guard fileManager.fileExists(atPath: archiveURL.path) else { return 0 }
+
+        var folder = try loadFolder(archiveURL)
+        let removed = uids.filter { folder.entries[$0] != nil }.sorted()
+        guard !removed.isEmpty else { return 0 }
+
+        try appendToIndex(removed.map { "-\($0)\n" }.joined(), archiveURL: archiveURL)
+        for uid in removed {
+            folder.entries[uid] = nil
+        }
+        folders[archiveURL.path] = folder
+        return removed.count
+    }
+
+    /// Rewrite a folder's archive with only the emails still in the index, returning the bytes freed.
+    /// The new archive and index are written next to the old ones and then moved over them; should
+    /// the index not follow, it no longer matches the archive and is rebuilt from it on next load.
+    @discardableResult
+    func compact(accountEmail: String, folderPath: String) throws -> Int64 {
+        let archiveURL = archiveURL(accountEmail: accountEmail, folderPath: folderPath)
+        guard fileManager.fileExists(atPath: archiveURL.path) else { return 0 }
+
+        let folder = try loadFolder(archiveURL)
+        let before = (try? fileManager.attributesOfItem(atPath: archiveURL.path)[.size] as? Int64) ?? 0
+        let live = folder.entries.values.sorted { $0.offset < $1.offset }
+
+        let compactedURL = archiveURL.appendingPathExtension("compacting")
+        let compactedIndexURL = indexURL(for: archiveURL).appendingPathExtension("compacting")
+        fileManager.createFile(atPath: compactedURL.path, contents: nil)
+        defer {
+            try? fileManager.removeItem(at: compactedURL)
+            try? fileManager.removeItem(at: compactedIndexURL)
+        }
+
+        let source = try FileHandle(forReadingFrom: archiveURL)
+        defer { try? source.close() }
+        let destination = try FileHandle(forWritingTo: compactedURL)
+        defer { try? destination.close() }
+
+        var compacted = Folder()
+        var index = ""
+        for entry in live {
+            // Header and padding are copied along with the email, so names and dates are kept
+            try source.seek(toOffset: entry.offset)
+            guard let block = try source.read(upToCount: Int(entry.length)), block.count == Int(entry.length) else {
+                throw TarStorageError.corruptArchive(archiveURL.path)
+            }
+            try destination.write(contentsOf: block)
+
+            let moved = TarIndexEntry(uid: entry.uid, name: entry.name, offset: compacted.end, size: entry.size)
+            compacted.entries[moved.uid] = moved
+            compacted.end += moved.length
+            index += Self.indexLine(for: moved)
+        }
+        try destination.write(contentsOf: Data(count: Int(2 * Self.blockSize)))
+        try destination.synchronize()
+        try Data(index.utf8).write(to: compactedIndexURL, options: .atomic)
+
+        _ = try fileManager.replaceItemAt(archiveURL, withItemAt: compactedURL)
+        _ = try fileManager.replaceItemAt(indexURL(for: archiveURL), withItemAt: compactedIndexURL)
+        folders[archiveURL.path] = compacted
+
+        let after = Int64(compacted.end + 2 * Self.blockSize)
+        logInfo("Compacted \(archiveURL.path): kept \(live.count) emails, freed \(before - after) bytes")
+        return before - after
+    }
+
+    // MARK: - Paths
+
+    /// <base>/<account>/<folder>/messages.tar, with each part of the folder path sanitized and
+    /// colliding folders suffixed
+    func archiveURL(accountEmail: String, folderPath: String) -> URL {
+        baseURL
+            .appendingPathComponent(accountEmail.sanitizedForFilename())
+            .appendingPathComponent(localFolderPath(accountEmail: accountEmail, folderPath: folderPath))
+            .appendingPathComponent(Self.archiveFilename)
+    }
+
+    /// The folder's recorded directory. A folder not archived yet gets its sanitized path, suffixed
+    /// (`Folder_2`, ...) when another folder that sanitizes the same way already holds it, so two
+    /// folders never share an archive.
+    private func localFolderPath(accountEmail: String, folderPath: String) -> String {
+        let assignments = loadFolderAssignments(for: accountEmail)
+        if let assigned = assignments[folderPath] {
+            return assigned
+        }
+
+        let base = Self.sanitizedPath(folderPath)
+        // Case-insensitive: the default macOS file system folds case
+        let taken = Set(assignments.values.map { $0.lowercased() })
+        var local = base
+        var suffix = 2
+        while taken.contains(local.lowercased()) {
+            local = "\(base)_\(suffix)"
+            suffix += 1
+        }
+        return local
+    }
+
+    /// Record the directory of a folder about to be archived in the account's folder map
+    private func assignFolder(accountEmail: String, folderPath: String) throws {
+        let key = accountEmail.sanitizedForFilename()
+        var assignments = loadFolderAssignments(for: accountEmail)
+        guard assignments[folderPath] == nil else { return }
+
+        let local = localFolderPath(accountEmail: accountEmail, folderPath: folderPath)
+        let base = Self.sanitizedPath(folderPath)
+        if local != base {
+            logWarning("Folder '\(folderPath)' collides with another folder at '\(base)', storing as '\(local)'")
+        }
+        assignments[folderPath] = local
+
+        let accountURL = baseURL.appendingPathComponent(key)
+        try fileManager.createDirectory(at: accountURL, withIntermediateDirectories: true)
+        let encoder = JSONEncoder()
+        encoder.outputFormatting = [.prettyPrinted, .sortedKeys]
+        try encoder.encode(assignments).write(to: accountURL.appendingPathComponent(Self.folderMapFilename), options: .atomic)
+        folderAssignments[key] = assignments
+    }
+
+    /// Each part of the folder path sanitized
+    private static func sanitizedPath(_ folderPath: String) -> String {
+        folderPath.split(separator: "/").map { String($0).sanitizedForFilename() }.joined(separator: "/")
+    }
+
+    private func loadFolderAssignments(for accountEmail: String) -> [String: String] {
+        let key = accountEmail.sanitizedForFilename()
+        if let cached = folderAssignments[key] {
+            return cached
+        }
+
+        let mapURL = baseURL.appendingPathComponent(key).appendingPathComponent(Self.folderMapFilename)
+        var assignments: [String: String] = [:]
+        if let data = try? Data(contentsOf: mapURL),
+           let decoded = try? JSONDecoder().decode([String: String].self, from: data) {
+            assignments = decoded
+        }
+        folderAssignments[key] = assignments
+        return assignments
+    }
+
+    private func indexURL(for archiveURL: URL) -> URL {
+        archiveURL.deletingLastPathComponent().appendingPathComponent(Self.indexFilename)
+    }
+
+    /// The folder's archive, created empty with its end-of-archive blocks when missing
+    private func createArchive(accountEmail: String, folderPath: String) throws -> URL {
+        try assignFolder(accountEmail: accountEmail, folderPath: folderPath)
+        let archiveURL = archiveURL(accountEmail: accountEmail, folderPath: folderPath)
+        if !fileManager.fileExists(atPath: archiveURL.path) {
+            try fileManager.createDirectory(at: archiveURL.deletingLastPathComponent(), withIntermediateDirectories: true)
+            try Data(count: Int(2 * Self.blockSize)).write(to: archiveURL)
+            try? fileManager.removeItem(at: indexURL(for: archiveURL))
+        }
+        return archiveURL
+    }
+
+    // MARK: - Index
+
+    /// Index lines are "<uid>\t<offset>\t<size>\t<name>" per appended email and "-<uid>" per removal
+    private static func indexLine(for entry: TarIndexEntry) -> String {
+        "\(entry.uid)\t\(entry.offset)\t\(entry.size)\t\(entry.name)\n"
+    }
+
+    private func appendToIndex(_ lines: String, archiveURL: URL) throws {
+        let url = indexURL(for: archiveURL)
+        if !fileManager.fileExists(atPath: url.path) {
+            fileManager.createFile(atPath: url.path, contents: nil)
+        }
+        let handle = try FileHandle(forWritingTo: url)
+        defer { try? handle.close() }
+        try handle.seekToEnd()
+        try handle.write(contentsOf: Data(lines.utf8))
+    }
+
+    /// The folder's index, read once per run. One that is missing or does not match the
+    /// archive, e.g. after a crash during compaction, is rebuilt by scanning the archive.
+    private func loadFolder(_ archiveURL: URL) throws -> Folder {
+        if let folder = folders[archiveURL.path] {
+            return folder
+        }
+
+        var folder = Folder()
+        if let content = try? String(contentsOf: indexURL(for: archiveURL), encoding: .utf8) {
+            folder = Self.parseIndex(content)
+        }
+        if !indexMatchesArchive(folder, archiveURL: archiveURL) {
+            logWarning("Rebuilding the index of \(archiveURL.path) from the archive")
+            folder = try scanArchive(archiveURL)
+            let index = folder.entries.values.sorted { $0.offset < $1.offset }.map(Self.indexLine).joined()
+            try Data(index.utf8).write(to: indexURL(for: archiveURL), options: .atomic)
+        }
+
+        folders[archiveURL.path] = folder
+        return folder
+    }
+
+    /// Replay an index; a line cut off by a crash is skipped
+    private static func parseIndex(_ content: String) -> Folder {
+        var folder = Folder()
+        for line in content.split(separator: "\n") {
+            if line.hasPrefix("-") {
+                if let uid = UInt32(line.dropFirst()) {
+                    folder.entries[uid] = nil
+                }
+                continue
+            }
+
+            let fields = line.split(separator: "\t", maxSplits: 3, omittingEmptySubsequences: false)
+            guard fields.count == 4,
+                  let uid = UInt32(fields[0]),
+                  let offset = UInt64(fields[1]),
+                  let size = UInt64(fields[2]) else { continue }
+            let entry = TarIndexEntry(uid: uid, name: String(fields[3]), offset: offset, size: size)
+            folder.entries[uid] = entry
+            folder.end = max(folder.end, entry.offset + entry.length)
+        }
+        return folder
+    }
+
+    /// Whether the archive is long enough for the index and its last entry's header matches
+    private func indexMatchesArchive(_ folder: Folder, archiveURL: URL) -> Bool {
+        let size = UInt64((try? fileManager.attributesOfItem(atPath: archiveURL.path)[.size] as? Int64) ?? 0)
+        guard size >= folder.end else { return false }
+        guard let last = folder.entries.values.max(by: { $0.offset < $1.offset }) else {
+            // Only removed entries, or none at all; an empty archive is just its end blocks
+            return folder.end > 0 || size <= 2 * Self.blockSize
+        }
+
+        guard let handle = try? FileHandle(forReadingFrom: archiveURL) else { return false }
+        defer { try? handle.close() }
+        guard (try? handle.seek(toOffset: last.offset)) != nil,
+              let header = try? handle.read(upToCount: Int(Self.blockSize)),
+              let parsed = Self.parseHeader(header) else { return false }
+        return parsed.name == last.name && parsed.size == last.size
+    }
+
+    /// Index entries of every email in the archive, up to the end blocks or the first damaged header.
+    /// Removals are not in the archive, so emails removed but not yet compacted come back.
+    private func scanArchive(_ archiveURL: URL) throws -> Folder {
+        let handle = try FileHandle(forReadingFrom: archiveURL)
+        defer { try? handle.close() }
+
+        let size = try handle.seekToEnd()
+        var folder = Folder()
+        while true {
+            try handle.seek(toOffset: folder.end)
+            guard let header = try handle.read(upToCount: Int(Self.blockSize)),
+                  let parsed = Self.parseHeader(header) else { break }
+
+            let entry = TarIndexEntry(uid: Self.uid(fromEntryName: parsed.name) ?? 0, name: parsed.name, offset: folder.end, size: parsed.size)
+            // The email has to be complete; a cut-off last entry is dropped and later overwritten
+            guard entry.offset + Self.blockSize + entry.size <= size else { break }
+
+            if entry.uid != 0 {
+                folder.entries[entry.uid] = entry
+            }
+            folder.end += entry.length
+        }
+        return folder
+    }
+
+    // MARK: - Tar Format
+
+    /// The email's usual file name, shortened to fit the 100 bytes of a tar name
+    static func entryName(for email: Email) -> String {
+        var name = email.filename()
+        while name.utf8.count > 100 {
+            let stem = (name as NSString).deletingPathExtension
+            name = String(stem.dropLast()) + ".eml"
+        }
+        return name
+    }
+
+    /// UID an entry name starts with, "<uid>_..."
+    static func uid(fromEntryName name: String) -> UInt32? {
+        name.split(separator: "_", maxSplits: 1).first.flatMap { UInt32($0) }
+    }
+
+    static func paddedSize(_ size: UInt64) -> UInt64 {
+        (size + blockSize - 1) / blockSize * blockSize
+    }
+
+    /// A ustar header for a regular file
+    static func header(name: String, size: UInt64, modified: Date) -> Data {
+        var block = [UInt8](repeating: 0, count: Int(blockSize))
+
+        func put(_ text: String, at offset: Int, length: Int) {
+            for (index, byte) in text.utf8.prefix(length).enumerated() {
+                block[offset + index] = byte
+            }
+        }
+        func putOctal(_ value: UInt64, at offset: Int, length: Int) {
+            put(String(value, radix: 8).leftPadded(to: length - 1), at: offset, length: length - 1)
+        }
+
+        put(name, at: 0, length: 100)
+        put("0000644", at: 100, length: 7)
+        put("0000000", at: 108, length: 7)
+        put("0000000", at: 116, length: 7)
+        putOctal(size, at: 124, length: 12)
+        putOctal(UInt64(max(0, modified.timeIntervalSince1970)), at: 136, length: 12)
+        put("0", at: 156, length: 1)
+        put("ustar", at: 257, length: 6)
+        put("00", at: 263, length: 2)
+
+        // The checksum is summed with its own field as spaces
+        put("        ", at: 148, length: 8)
+        let checksum = block.reduce(0) { $0 + UInt64($1) }
+        put(String(checksum, radix: 8).leftPadded(to: 6), at: 148, length: 6)
+        block[154] = 0
+        block[155] = UInt8(ascii: " ")
+
+        return Data(block)
+    }
+
+    /// Name and size from a header block, nil for the end blocks or a header whose checksum is wrong
+    static func parseHeader(_ data: Data) -> (name: String, size: UInt64)? {
+        let block = [UInt8](data)
+        guard block.count == Int(blockSize), block.contains(where: { $0 != 0 }) else { return nil }
+
+        func field(_ offset: Int, _ length: Int) -> String {
+            let bytes = block[offset..<(offset + length)].prefix { $0 != 0 }
+            return String(decoding: bytes, as: UTF8.self)
+        }
+        func octal(_ offset: Int, _ length: Int) -> UInt64? {
+            UInt64(field(offset, length).trimmingCharacters(in: .whitespaces), radix: 8)
+        }
+
+        var unsigned = block
+        for index in 148..<156 {
+            unsigned[index] = UInt8(ascii: " ")
+        }
+        guard let checksum = octal(148, 8),
+              checksum == unsigned.reduce(0, { $0 + UInt64($1) }),
+              let size = octal(124, 12) else { return nil }
+        return (field(0, 100), size)
+    }
+}
+
+private extension String {
+    func leftPadded(to length: Int) -> String {
+        count >= length ? self : String(repeating: "0", count: length - count) + self
+    }
+}
@@ -0,0 +1,174 @@
+import Foundation
+
+/// Discovers IMAP accounts in Thunderbird profiles, for users coming from Thunderbird rather
+/// than Mail. Only server settings are read: Thunderbird keeps passwords in its own encrypted
+/// store, so imported password accounts must have their password entered once, like those
+/// imported from macOS; OAuth2 accounts sign in via Google.
+enum ThunderbirdImportService {
+
+    /// Thunderbird's data directory, holding profiles.ini
+    static var thunderbirdDirectoryURL: URL {
+        FileManager.default.homeDirectoryForCurrentUser
+            .appendingPathComponent("Library/Thunderbird")
+    }
+
+    /// `authMethod` value of accounts signing in with OAuth2
+    private static let oauth2AuthMethod = "10"
+
+    // MARK: - Discovery
+
+    /// Read the IMAP accounts of every profile listed in `directory`/profiles.ini.
+    /// An account configured in several profiles is returned once per profile.
+    static func discoverAccounts(directory: URL = thunderbirdDirectoryURL) -> [DiscoveredMailAccount] {
+        let iniURL = directory.appendingPathComponent("profiles.ini")
+        guard let ini = try? String(contentsOf: iniURL, encoding: .utf8) else {
+            return []
+        }
+
+        var accounts: [DiscoveredMailAccount] = []
+        for profileURL in profileDirectories(fromProfilesIni: ini, relativeTo: directory) {
+            let prefsURL = profileURL.appendingPathComponent("prefs.js")
+            guard let prefs = try? String(contentsOf: prefsURL, encoding: .utf8) else {
+                logWarning("Cannot read Thunderbird preferences at \(prefsURL.path)")
+                continue
+            }
+            accounts += Self.accounts(fromPrefs: parsePrefs(prefs), profile: profileURL.lastPathComponent)
+        }
+
+        logInfo("Discovered \(accounts.count) email accounts in Thunderbird")
+        return accounts
+    }
+
+    /// Profile directories named in profiles.ini, each once, in file order
+    static func profileDirectories(fromProfilesIni ini: String, relativeTo directory: URL) -> [URL] {
+        var directories: [URL] = []
+        var section = ""
+        var path: String?
+        var isRelative = true
+
+        func finishSection() {
+            if section.hasPrefix("Profile"), let path = path, !path.isEmpty {
+                let url = isRelative ? directory.appendingPathComponent(path) : URL(fileURLWithPath: path)
+                if !directories.contains(url.standardizedFileURL) {
+                    directories.append(url.standardizedFileURL)
+                }
+            }
+            path = nil
+            isRelative = true
+        }
+
+        for rawLine in ini.components(separatedBy: .newlines) {
+            let line = rawLine.trimmingCharacters(in: .whitespaces)
+            if line.hasPrefix("[") && line.hasSuffix("]") {
+                finishSection()
+                section = String(line.dropFirst().dropLast())
+                continue
+            }
+            guard let equals = line.firstIndex(of: "=") else { continue }
+            let key = line[..<equals].trimmingCharacters(in: .whitespaces)
+            let value = line[line.index(after: equals)...].trimmingCharacters(in: .whitespaces)
+            switch key {
+            case "Path": path = value
+            case "IsRelative": isRelative = value != "0"
+            default: break
+            }
+        }
+        finishSection()
+        return directories
+    }
+
+    // MARK: - Preferences
+
+    /// Values of the `user_pref("name", value);` lines of a prefs.js. Strings are unquoted,
+    /// numbers and booleans kept as written.
+    static func parsePrefs(_ text: String) -> [String: String] {
+        var prefs: [String: String] = [:]
+        for rawLine in text.components(separatedBy: .newlines) {
+            let line = rawLine.trimmingCharacters(in: .whitespaces)
+            guard line.hasPrefix("user_pref("), line.hasSuffix(");") else { continue }
+            let arguments = String(line.dropFirst("user_pref(".count).dropLast(2))
+
+            guard let key = readQuoted(arguments) else { continue }
+            var valueText = key.rest.trimmingCharacters(in: .whitespaces)
+            guard valueText.hasPrefix(",") else { continue }
+            valueText = valueText.dropFirst().trimmingCharacters(in: .whitespaces)
+
+            if valueText.hasPrefix("\"") {
+                guard let value = readQuoted(valueText) else { continue }
+                prefs[key.value] = value.value
+            } else {
+                prefs[key.value] = valueText
+            }
+        }
+        return prefs
+    }
+
+    /// A JavaScript string literal at the start of `text` and what follows it
+    private static func readQuoted(_ text: String) -> (value: String, rest: String)? {
+        guard text.first == "\"" else { return nil }
+        var value = ""
+        var escaped = false
+        var index = text.index(after: text.startIndex)
+
+        while index < text.endIndex {
+            let character = text[index]
+            if escaped {
+                value.append(character)
+                escaped = false
+            } else if character == "\\" {
+                escaped = true
+            } else if character == "\"" {
+                return (value, String(text[text.index(after: index)...]))
+            } else {
+                value.append(character)
+            }
+            index = text.index(after: index)
+        }
+        return nil
+    }
+
+    /// IMAP accounts configured in parsed preferences. The address comes from the account's
+    /// first identity, falling back to the login name.
+    static func accounts(fromPrefs prefs: [String: String], profile: String = "") -> [DiscoveredMailAccount] {
+        // Only servers attached to an account are in use; deleted ones leave their prefs behind
+        let accountKeys = prefs["mail.accountmanager.accounts"]?
+            .split(separator: ",")
+            .map { $0.trimmingCharacters(in: .whitespaces) } ?? []
+
+        var accounts: [DiscoveredMailAccount] = []
+        for accountKey in accountKeys {
+            guard let server = prefs["mail.account.\(accountKey).server"] else { continue }
+            let serverPrefix = "mail.server.\(server)."
+            guard prefs[serverPrefix + "type"] == "imap",
+                  let hostname = prefs[serverPrefix + "hostname"], !hostname.isEmpty,
+                  let username = prefs[serverPrefix + "userName"], !username.isEmpty else { continue }
+
+            let identity = prefs["mail.account.\(accountKey).identities"]?
+                .split(separator: ",").first
+                .map { $0.trimmingCharacters(in: .whitespaces) }
+            let address = identity.flatMap { prefs["mail.identity.\($0).useremail"] }
+            let email = address.flatMap { $0.isEmpty ? nil : $0 } ?? username
+
+            // socketType 3 is TLS from the start, 2 is STARTTLS, which MailKeep does not speak;
+            // those servers also accept TLS on the IMAPS port
+            let socketType = prefs[serverPrefix + "socketType"]
+            let useSSL = socketType == "3" || socketType == "2"
+            var port = prefs[serverPrefix + "port"].flatMap { Int($0) }
+            if socketType == "2" {
+                port = 993
+            }
+
+            accounts.append(DiscoveredMailAccount(
+                id: "thunderbird:\(profile):\(server)",
+                accountDescription: prefs[serverPrefix + "name"] ?? email,
+                username: email,
+                hostname: hostname,
+                port: port,
+                useSSL: useSSL,
+                isGoogle: prefs[serverPrefix + "authMethod"] == oauth2AuthMethod
+                    && hostname.lowercased() == "imap.gmail.com"
+            ))
+        }
+        return accounts
+    }
+}
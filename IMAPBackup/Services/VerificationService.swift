@@ -5,6 +5,10 @@ struct FolderVerificationResult {
     let folderName: String
     let serverUIDs: Set<UInt32>
     let localUIDs: Set<UInt32>
+    /// Attachment files that are missing or no longer match their checksum
+    var corruptAttachments: [AttachmentIntegrityIssue] = []
+    /// Envelope sidecars rewritten because their text was not clean UTF-8
+    var repairedSidecars = 0
 
     /// UIDs on server but not backed up locally
     var missingLocally: Set<UInt32> {
@@ -22,7 +26,7 @@ struct FolderVerificationResult {
     }
 
     var isFullySynced: Bool {
-        missingLocally.isEmpty && deletedOnServer.isEmpty
+        missingLocally.isEmpty && deletedOnServer.isEmpty && corruptAttachments.isEmpty
     }
 
     var summary: String {
@@ -36,6 +40,9 @@ struct FolderVerificationResult {
             if !deletedOnServer.isEmpty {
                 parts.append("\(deletedOnServer.count) deleted on server")
             }
+            if !corruptAttachments.isEmpty {
+                parts.append("\(corruptAttachments.count) corrupt attachments")
+            }
             return "⚠ " + parts.joined(separator: ", ")
         }
     }
@@ -47,6 +54,8 @@ struct AccountVerificationResult: Identifiable {
     let accountEmail: String
     let folderResults: [FolderVerificationResult]
     let verifiedAt: Date
+    /// Stopped before all folders were checked; `folderResults` has the finished ones
+    var wasCancelled = false
 
     var totalServerEmails: Int {
         folderResults.reduce(0) { $0 + $1.serverUIDs.count }
@@ -64,12 +73,18 @@ struct AccountVerificationResult: Identifiable {
         folderResults.reduce(0) { $0 + $1.deletedOnServer.count }
     }
 
+    var totalCorruptAttachments: Int {
+        folderResults.reduce(0) { $0 + $1.corruptAttachments.count }
+    }
+
     var isFullySynced: Bool {
         folderResults.allSatisfy { $0.isFullySynced }
     }
 
     var summary: String {
-        if isFullySynced {
+        if wasCancelled {
+            return "Cancelled after \(folderResults.count) folders"
+        } else if isFullySynced {
             return "✓ All \(folderResults.count) folders fully synced"
         } else {
             var parts: [String] = []
@@ -79,6 +94,9 @@ struct AccountVerificationResult: Identifiable {
             if totalDeletedOnServer > 0 {
                 parts.append("\(totalDeletedOnServer) emails deleted on server")
             }
+            if totalCorruptAttachments > 0 {
+                parts.append("\(totalCorruptAttachments) corrupt attachments")
+            }
             return "⚠ " + parts.joined(separator: ", ")
         }
     }
@@ -135,15 +153,35 @@ class VerificationService: ObservableObject {
     @Published var repairProgress = RepairProgress()
     @Published var lastRepairResults: [RepairResult] = []
 
+    /// Running verifyAll, so it can be cancelled from the UI
+    private var verifyTask: Task<[AccountVerificationResult], Never>?
+
     private init() {}
 
+    /// Start verifying all accounts in the background; a running verification is left alone
+    func startVerifyAll(accounts: [EmailAccount], backupLocation: URL, full: Bool = false) {
+        guard verifyTask == nil else { return }
+        verifyTask = Task {
+            let results = await verifyAll(accounts: accounts, backupLocation: backupLocation, full: full)
+            verifyTask = nil
+            return results
+        }
+    }
+
+    /// Stop after the file being checked; folders already verified are kept in the results
+    func cancelVerification() {
+        verifyTask?.cancel()
+    }
+
     /// Verify all accounts
-    func verifyAll(accounts: [EmailAccount], backupLocation: URL) async -> [AccountVerificationResult] {
+    /// - Parameter full: Recompute every attachment checksum instead of only those added since the last verification
+    func verifyAll(accounts: [EmailAccount], backupLocation: URL, full: Bool = false) async -> [AccountVerificationResult] {
         isVerifying = true
         var results: [AccountVerificationResult] = []
 
         for account in accounts where account.isEnabled {
-            if let result = await verifyAccount(account, backupLocation: backupLocation) {
+            guard !Task.isCancelled else { break }
+            if let result = await verifyAccount(account, backupLocation: backupLocation, full: full) {
                 results.append(result)
             }
         }
@@ -157,12 +195,14 @@ class VerificationService: ObservableObject {
     }
 
     /// Verify a single account
-    func verifyAccount(_ account: EmailAccount, backupLocation: URL) async -> AccountVerificationResult? {
+    func verifyAccount(_ account: EmailAccount, backupLocation: URL, full: Bool = false) async -> AccountVerificationResult? {
         currentAccount = account.email
-        logInfo("Starting verification for account: \(account.email)")
+        logInfo("Starting \(full ? "full" : "incremental") verification for account: \(account.email)")
 
         let imapService = IMAPService(account: account)
         let storageService = StorageService(baseURL: backupLocation)
+        await storageService.setFolderRemap(account.folderRemap, for: account.email)
+        await storageService.setFlatFolderSeparator(account.flatFolderSeparator, for: account.email)
 
         do {
             // Connect to server
@@ -174,12 +214,17 @@ class VerificationService: ObservableObject {
             let selectableFolders = folders.filter { $0.isSelectable }
 
             var folderResults: [FolderVerificationResult] = []
+            var wasCancelled = false
 
             for folder in selectableFolders {
+                guard !Task.isCancelled else {
+                    wasCancelled = true
+                    break
+                }
                 currentFolder = folder.name
 
                 // Get server UIDs
-                _ = try await imapService.selectFolder(folder.name)
+                _ = try await imapService.examineFolder(folder.name)
                 let serverUIDs = try await imapService.searchAll()
 
                 // Get local UIDs
@@ -188,10 +233,51 @@ class VerificationService: ObservableObject {
                     folderPath: folder.path
                 )) ?? []
 
+                // Recompute attachment checksums to catch silent corruption on disk;
+                // routine checks only cover files added since the folder was last verified
+                let startedAt = Date()
+                let since = full ? nil : await storageService.lastVerification(accountEmail: account.email, folderPath: folder.path)
+                let corruptAttachments: [AttachmentIntegrityIssue]
+                let attachmentsChecked: Bool
+                do {
+                    corruptAttachments = try await storageService.verifyAttachments(
+                        accountEmail: account.email,
+                        folderPath: folder.path,
+                        since: since
+                    )
+                    attachmentsChecked = true
+                } catch is CancellationError {
+                    // A half-checked folder is not reported, and keeps its date for next time
+                    wasCancelled = true
+                    break
+                } catch {
+                    logWarning("Could not check attachments in \(folder.name): \(error.localizedDescription)")
+                    corruptAttachments = []
+                    attachmentsChecked = false
+                }
+                for issue in corruptAttachments {
+                    logWarning("Attachment \(issue.kind.rawValue): \(issue.fileURL.path)")
+                }
+                if attachmentsChecked && corruptAttachments.isEmpty {
+                    // A folder with problems, or that could not be checked, keeps its old date so it is checked again
+                    try? await storageService.recordVerification(at: startedAt, accountEmail: account.email, folderPath: folder.path)
+                }
+
+                // Sidecars written before their text was sanitized are fixed in place
+                let repairedSidecars: Int
+                do {
+                    repairedSidecars = try await storageService.repairEnvelopeSidecars(accountEmail: account.email, folderPath: folder.path)
+                } catch {
+                    logWarning("Could not check envelope sidecars in \(folder.name): \(error.localizedDescription)")
+                    repairedSidecars = 0
+                }
+
                 let result = FolderVerificationResult(
                     folderName: folder.name,
                     serverUIDs: Set(serverUIDs),
-                    localUIDs: localUIDs
+                    localUIDs: localUIDs,
+                    corruptAttachments: corruptAttachments,
+                    repairedSidecars: repairedSidecars
                 )
 
                 folderResults.append(result)
@@ -206,7 +292,8 @@ class VerificationService: ObservableObject {
             let accountResult = AccountVerificationResult(
                 accountEmail: account.email,
                 folderResults: folderResults,
-                verifiedAt: Date()
+                verifiedAt: Date(),
+                wasCancelled: wasCancelled
             )
 
             logInfo("Verification complete for \(account.email): \(accountResult.summary)")
@@ -285,6 +372,8 @@ class VerificationService: ObservableObject {
 
         let imapService = IMAPService(account: account)
         let storageService = StorageService(baseURL: backupLocation)
+        await storageService.setFolderRemap(account.folderRemap, for: account.email)
+        await storageService.setFlatFolderSeparator(account.flatFolderSeparator, for: account.email)
 
         // Configure rate limiting
         let rateLimitSettings = RateLimitService.shared.getSettings(for: account.id)
@@ -301,7 +390,7 @@ class VerificationService: ObservableObject {
                 repairProgress.currentFolder = folderResult.folderName
 
                 // Select the folder
-                _ = try await imapService.selectFolder(folderResult.folderName)
+                _ = try await imapService.examineFolder(folderResult.folderName)
 
                 // Download each missing email
                 for uid in folderResult.missingLocally.sorted() {
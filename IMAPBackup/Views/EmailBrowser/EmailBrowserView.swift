@@ -80,6 +80,14 @@ struct EmailBrowserView: View {
                 .help("Open in Finder")
                 .disabled(selectedEmail == nil)
             }
+
+            ToolbarItem(placement: .primaryAction) {
+                Button(action: { exportFolderAsMbox() }) {
+                    Image(systemName: "square.and.arrow.up")
+                }
+                .help("Export folder as mbox; exporting to the same file again only appends new emails")
+                .disabled(selectedFolder == nil)
+            }
         }
     }
 
@@ -136,6 +144,28 @@ struct EmailBrowserView: View {
         }
     }
 
+    private func exportFolderAsMbox() {
+        guard let selection = selectedFolder else { return }
+        let parts = selection.split(separator: "/", maxSplits: 1)
+        guard parts.count == 2 else { return }
+        let folderURL = backupManager.backupLocation
+            .appendingPathComponent(String(parts[0]))
+            .appendingPathComponent(String(parts[1]))
+
+        let panel = NSSavePanel()
+        panel.nameFieldStringValue = "\(parts[1].replacingOccurrences(of: "/", with: "-")).mbox"
+        panel.canCreateDirectories = true
+        guard panel.runModal() == .OK, let url = panel.url else { return }
+
+        Task.detached {
+            do {
+                try MboxExportService.exportFolder(at: folderURL, to: url)
+            } catch {
+                logError("Failed to export \(folderURL.lastPathComponent) to mbox: \(error.localizedDescription)")
+            }
+        }
+    }
+
     private func openInFinder() {
         guard let email = selectedEmail else { return }
         NSWorkspace.shared.selectFile(email.filePath, inFileViewerRootedAtPath: "")
@@ -215,6 +245,30 @@ struct EmailPreviewView: View {
                         Text(email.date, format: .dateTime)
                     }
                     .font(.subheadline)
+
+                    if let deliveredTo = headers.deliveredTo {
+                        HStack {
+                            Text("Delivered-To:")
+                                .foregroundStyle(.secondary)
+                            Text(deliveredTo)
+                        }
+                        .font(.subheadline)
+                    }
+
+                    if !headers.received.isEmpty {
+                        DisclosureGroup("Received (\(headers.received.count) hops)") {
+                            VStack(alignment: .leading, spacing: 4) {
+                                ForEach(Array(headers.received.enumerated()), id: \.offset) { _, hop in
+                                    Text(hop)
+                                        .font(.caption.monospaced())
+                                        .textSelection(.enabled)
+                                }
+                            }
+                            .frame(maxWidth: .infinity, alignment: .leading)
+                        }
+                        .font(.subheadline)
+                        .foregroundStyle(.secondary)
+                    }
                 }
 
                 // Attachments
@@ -478,7 +532,15 @@ struct EmailPreviewView: View {
             }
         }
 
-        return EmailHeaders(from: from, to: to, subject: subject)
+        // Received is repeated and nearly always folded, so leave it to the parser
+        let parsed = EmailParser.parseMetadata(from: Data(content.utf8))
+        return EmailHeaders(
+            from: from,
+            to: to,
+            subject: subject,
+            received: parsed?.received ?? [],
+            deliveredTo: parsed?.deliveredTo
+        )
     }
 
     private func extractBody(from content: String) -> String {
@@ -528,6 +590,8 @@ struct EmailHeaders {
     let from: String
     let to: String
     let subject: String
+    let received: [String]
+    let deliveredTo: String?
 }
 
 // MARK: - Attachment Info
@@ -544,6 +608,10 @@ struct EmailAttachmentInfo: Identifiable, Hashable {
         size > 0 ? ByteCountFormatter.string(fromByteCount: size, countStyle: .file) : ""
     }
 
+    var risk: AttachmentRisk {
+        AttachmentRisk.classify(filename: filename, contentType: mimeType)
+    }
+
     var icon: String {
         let ext = (filename as NSString).pathExtension.lowercased()
         switch ext {
@@ -614,6 +682,15 @@ struct AttachmentItemView: View {
                         .offset(x: 4, y: -4)
                 }
             }
+            .overlay(alignment: .topLeading) {
+                if attachment.risk == .dangerous {
+                    Image(systemName: "exclamationmark.triangle.fill")
+                        .font(.caption)
+                        .foregroundStyle(.red)
+                        .offset(x: -4, y: -4)
+                        .help(attachment.risk.displayName)
+                }
+            }
 
             Text(attachment.filename)
                 .font(.caption)
@@ -817,11 +894,11 @@ class EmailBrowserService: ObservableObject {
 
         for url in contents {
             let isDir = (try? url.resourceValues(forKeys: [.isDirectoryKey]).isDirectory) ?? false
-            if isDir && !url.lastPathComponent.hasPrefix(".") {
+            if isDir && !url.lastPathComponent.hasPrefix(".") && !StorageService.isDatePartitionYear(url) {
                 let folderName = prefix.isEmpty ? url.lastPathComponent : "\(prefix)/\(url.lastPathComponent)"
 
-                // Check if this folder has .eml files
-                let hasEmails = (try? fileManager.contentsOfDirectory(at: url, includingPropertiesForKeys: nil))?
+                // Check if this folder has .eml files, including YYYY/MM partitions
+                let hasEmails = (try? StorageService.messageFiles(in: url))?
                     .contains { $0.pathExtension == "eml" } ?? false
 
                 if hasEmails {
@@ -844,7 +921,7 @@ class EmailBrowserService: ObservableObject {
             .appendingPathComponent(account)
             .appendingPathComponent(folder)
 
-        guard let contents = try? fileManager.contentsOfDirectory(at: folderURL, includingPropertiesForKeys: [.fileSizeKey, .contentModificationDateKey]) else {
+        guard let contents = try? StorageService.messageFiles(in: folderURL) else {
             isLoading = false
             return
         }
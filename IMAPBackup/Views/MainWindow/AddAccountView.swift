@@ -12,6 +12,8 @@ struct AddAccountView: View {
     @State private var useSSL = true
 
     @State private var isTesting = false
+    @State private var isDetecting = false
+    @State private var detectionMessage: String?
     @State private var isSigningIn = false
     @State private var testResult: TestResult?
 
@@ -148,6 +150,25 @@ struct AddAccountView: View {
                     TextField("IMAP Server", text: $imapServer)
                     TextField("Port", text: $port)
                     Toggle("Use SSL/TLS", isOn: $useSSL)
+
+                    HStack {
+                        Button("Detect Settings") {
+                            detectSettings()
+                        }
+                        .disabled(isDetecting || !email.contains("@"))
+                        .help("Try imap., mail. and the bare domain of the email address on ports 993 (SSL/TLS) and 143 (STARTTLS)")
+
+                        if isDetecting {
+                            ProgressView()
+                                .scaleEffect(0.7)
+                        }
+                    }
+
+                    if let detectionMessage = detectionMessage {
+                        Text(detectionMessage)
+                            .font(.caption)
+                            .foregroundStyle(.secondary)
+                    }
                 }
 
             }
@@ -244,6 +265,35 @@ struct AddAccountView: View {
         }
     }
 
+    func detectSettings() {
+        isDetecting = true
+        detectionMessage = nil
+
+        Task {
+            let result = await ServerProbeService().detect(email: email)
+
+            await MainActor.run {
+                isDetecting = false
+                guard let result = result else {
+                    detectionMessage = "No IMAP server found for this address. Enter the settings from your provider."
+                    return
+                }
+
+                switch result.security {
+                case .implicitTLS:
+                    imapServer = result.host
+                    port = String(result.port)
+                    useSSL = true
+                    detectionMessage = "Found \(result.summary)."
+                case .startTLS, .none:
+                    // STARTTLS upgrades are not supported, so this port would send the password unencrypted;
+                    // it is never filled in automatically, only typed in with SSL/TLS turned off by hand
+                    detectionMessage = "Found \(result.summary). MailKeep connects with SSL/TLS only, so the settings were left unchanged; ask your provider for an SSL/TLS port."
+                }
+            }
+        }
+    }
+
     func testConnection() {
         isTesting = true
         testResult = nil
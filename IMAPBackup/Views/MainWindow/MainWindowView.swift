@@ -352,6 +352,20 @@ struct StatsSection: View {
                 }
             }
 
+            // Attachment types, largest first
+            if !isLoading && !stats.attachmentTypes.isEmpty {
+                Grid(alignment: .leading, horizontalSpacing: 20, verticalSpacing: 4) {
+                    ForEach(stats.attachmentTypesBySize.prefix(5), id: \.contentType) { entry in
+                        GridRow {
+                            Text(entry.contentType).foregroundStyle(.secondary)
+                            Text("\(entry.totals.count)")
+                            Text(formatBytes(entry.totals.size))
+                        }
+                    }
+                }
+                .font(.caption)
+            }
+
             Divider()
 
             // Account Info
@@ -378,6 +392,12 @@ struct StatsSection: View {
                         Text(lastBackup, style: .relative) + Text(" ago")
                     }
                 }
+                if let lastSuccess = account.lastSuccessfulBackupDate {
+                    GridRow {
+                        Text("Last successful:").foregroundStyle(.secondary)
+                        Text(lastSuccess, style: .relative) + Text(" ago")
+                    }
+                }
             }
         }
         .task(id: account.id) {
@@ -121,6 +121,24 @@ struct MenubarView: View {
             .disabled(backupManager.accounts.isEmpty || backupManager.isBackingUp)
             .buttonStyle(.plain)
 
+            if !backupManager.profiles.names.isEmpty {
+                Menu {
+                    ForEach(backupManager.profiles.names, id: \.self) { name in
+                        Button(name) {
+                            do {
+                                try backupManager.startBackup(profile: name)
+                            } catch {
+                                logError(error.localizedDescription)
+                            }
+                        }
+                    }
+                } label: {
+                    Label("Backup Profile", systemImage: "person.2")
+                }
+                .menuStyle(.borderlessButton)
+                .disabled(backupManager.isBackingUp)
+            }
+
             if backupManager.isBackingUp {
                 Button(action: {
                     backupManager.cancelAllBackups()
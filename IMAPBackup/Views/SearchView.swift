@@ -493,6 +493,7 @@ struct SearchResultRow: View {
         case .body: return .orange
         case .attachment: return .purple
         case .attachmentContent: return .pink
+        case .routing: return .teal
         }
     }
 }
@@ -3,9 +3,12 @@ import SwiftUI
 struct AccountsSettingsView: View {
     @EnvironmentObject var backupManager: BackupManager
     @State private var showingAddAccount = false
+    @State private var importSource: AccountImportSource?
     @State private var accountToEdit: EmailAccount?
     @State private var accountToDelete: EmailAccount?
     @State private var showingDeleteConfirmation = false
+    /// What deleting the account's backups would remove, shown before confirming
+    @State private var backupDeletionPlan: DeletionPlan?
 
     var body: some View {
         VStack {
@@ -42,6 +45,7 @@ struct AccountsSettingsView: View {
                         // Delete button
                         Button(action: {
                             accountToDelete = account
+                            backupDeletionPlan = try? AccountPurgeService.backupDeletionPlan(for: account, in: backupManager.backupLocation)
                             showingDeleteConfirmation = true
                         }) {
                             Image(systemName: "trash")
@@ -70,13 +74,41 @@ struct AccountsSettingsView: View {
                     Label("Add Account", systemImage: "plus")
                 }
 
+                Menu {
+                    ForEach(AccountImportSource.allCases) { source in
+                        Button("From \(source.displayName)...") {
+                            importSource = source
+                        }
+                    }
+                } label: {
+                    Label("Import", systemImage: "square.and.arrow.down")
+                }
+                .fixedSize()
+                .help("Import email accounts configured in macOS Internet Accounts or Thunderbird")
+
                 Spacer()
+
+                Menu {
+                    ForEach(AccountListFormat.allCases, id: \.self) { format in
+                        Button("As \(format.rawValue)...") {
+                            exportAccountList(format: format)
+                        }
+                    }
+                } label: {
+                    Label("Export List", systemImage: "square.and.arrow.up")
+                }
+                .fixedSize()
+                .disabled(backupManager.accounts.isEmpty)
+                .help("Save the account list for scripting; passwords and tokens are never included")
             }
             .padding()
         }
         .sheet(isPresented: $showingAddAccount) {
             AddAccountView()
         }
+        .sheet(item: $importSource) { source in
+            ImportMacAccountsView(source: source)
+        }
         .sheet(item: $accountToEdit) { account in
             EditAccountView(account: account)
         }
@@ -90,12 +122,40 @@ struct AccountsSettingsView: View {
                 }
                 accountToDelete = nil
             }
+            Button("Delete Account and Backups", role: .destructive) {
+                if let account = accountToDelete {
+                    Task {
+                        do {
+                            try await backupManager.purgeAccount(account, deleteBackups: true)
+                        } catch {
+                            logError("Failed to purge \(account.email): \(error.localizedDescription)")
+                        }
+                    }
+                }
+                accountToDelete = nil
+            }
         } message: {
             if let account = accountToDelete {
-                Text("Are you sure you want to delete \(account.email)? This will remove the account from the app but will not delete any backed up emails.")
+                Text("Are you sure you want to delete \(account.email)? Its password and tokens are removed from the Keychain. \"Delete\" keeps the backed up emails; \"Delete Account and Backups\" also removes its folder from the backup location."
+                     + (backupDeletionPlan.map { "\n\n\($0.summary)." } ?? ""))
             }
         }
     }
+
+    private func exportAccountList(format: AccountListFormat) {
+        let panel = NSSavePanel()
+        panel.nameFieldStringValue = "MailKeep Accounts.\(format.fileExtension)"
+        panel.canCreateDirectories = true
+
+        guard panel.runModal() == .OK, let url = panel.url else { return }
+
+        do {
+            let output = try AccountExportService.render(backupManager.accounts, format: format)
+            try output.write(to: url, atomically: true, encoding: .utf8)
+        } catch {
+            logError("Failed to export account list: \(error.localizedDescription)")
+        }
+    }
 }
 
 struct EditAccountView: View {
@@ -109,6 +169,18 @@ struct EditAccountView: View {
     @State private var imapServer: String
     @State private var port: String
     @State private var useSSL: Bool
+    @State private var folderRemapText: String
+    @State private var flattenFolders: Bool
+    @State private var flatFolderSeparator: String
+    @State private var sendClientID: Bool
+    @State private var followReferrals: Bool
+    @State private var fetchStrategy: FetchStrategy
+    @State private var addressFamily: AddressFamily
+    @State private var tlsServerName: String
+    @State private var backupSharedFolders: Bool
+    @State private var sharedFolderFiltersText: String
+    @State private var keychainService: String
+    @State private var passwordCommand: String
 
     @State private var isTesting = false
     @State private var testResult: TestResult?
@@ -124,6 +196,18 @@ struct EditAccountView: View {
         _imapServer = State(initialValue: account.imapServer)
         _port = State(initialValue: String(account.port))
         _useSSL = State(initialValue: account.useSSL)
+        _folderRemapText = State(initialValue: EmailAccount.formatFolderRemap(account.folderRemap))
+        _flattenFolders = State(initialValue: account.flatFolderSeparator != nil)
+        _flatFolderSeparator = State(initialValue: account.flatFolderSeparator ?? "_")
+        _sendClientID = State(initialValue: account.sendClientID)
+        _followReferrals = State(initialValue: account.followReferrals)
+        _fetchStrategy = State(initialValue: account.fetchStrategy)
+        _addressFamily = State(initialValue: account.addressFamily)
+        _tlsServerName = State(initialValue: account.tlsServerName ?? "")
+        _backupSharedFolders = State(initialValue: account.backupSharedFolders)
+        _sharedFolderFiltersText = State(initialValue: EmailAccount.formatSharedFolderFilters(account.sharedFolderFilters))
+        _keychainService = State(initialValue: account.keychainService ?? "")
+        _passwordCommand = State(initialValue: account.passwordCommand ?? "")
     }
 
     var body: some View {
@@ -180,6 +264,95 @@ struct EditAccountView: View {
                     TextField("IMAP Server", text: $imapServer)
                     TextField("Port", text: $port)
                     Toggle("Use SSL/TLS", isOn: $useSSL)
+
+                    if useSSL {
+                        TextField("TLS Server Name (optional)", text: $tlsServerName)
+                            .help("Host name the server's certificate is issued for, when connecting by IP address or alias")
+
+                        if let problem = EmailAccount.tlsServerNameProblem(tlsServerName) {
+                            Text(problem)
+                                .font(.caption)
+                                .foregroundStyle(.red)
+                        }
+                    }
+
+                    TextField("Keychain Service (optional)", text: $keychainService)
+                        .help("Service name of a keychain entry created by another app, looked up with the username")
+
+                    if let problem = EmailAccount.keychainServiceProblem(keychainService) {
+                        Text(problem)
+                            .font(.caption)
+                            .foregroundStyle(.red)
+                    }
+
+                    TextField("Password Command (optional)", text: $passwordCommand)
+                        .font(.system(.body, design: .monospaced))
+                        .help("Runs this command to get the password instead of using the Keychain, e.g. pass show email/work. It is run without a shell.")
+
+                    if let problem = EmailAccount.passwordCommandProblem(passwordCommand) {
+                        Text(problem)
+                            .font(.caption)
+                            .foregroundStyle(.red)
+                    }
+                }
+
+                Section("Folder Mapping") {
+                    TextEditor(text: $folderRemapText)
+                        .font(.system(.caption, design: .monospaced))
+                        .frame(height: 60)
+
+                    Text("One mapping per line: Server/Folder = Local/Path. Use this to keep folders apart whose names would otherwise collide on disk.")
+                        .font(.caption)
+                        .foregroundStyle(.secondary)
+
+                    Toggle("Flatten folders into one directory each", isOn: $flattenFolders)
+                        .help("Stores Work/Projects as Work_Projects instead of nested directories, for file systems and sync tools that handle deep trees badly")
+
+                    if flattenFolders {
+                        TextField("Separator", text: $flatFolderSeparator)
+                            .font(.system(.body, design: .monospaced))
+                            .frame(width: 120)
+
+                        Text("Folders already backed up are moved to the new layout at the start of the next backup. Names that flatten to the same directory get a numeric suffix.")
+                            .font(.caption)
+                            .foregroundStyle(.secondary)
+                    }
+                }
+
+                Section("Shared Folders") {
+                    Toggle("Back up shared and other users' folders", isOn: $backupSharedFolders)
+                        .help("Uses the server's NAMESPACE list. Folders are stored under shared/<owner>/.")
+
+                    if backupSharedFolders {
+                        TextEditor(text: $sharedFolderFiltersText)
+                            .font(.system(.caption, design: .monospaced))
+                            .frame(height: 60)
+
+                        Text("Optional filters, one per line: <namespace prefix> include|exclude <pattern>, e.g. user. exclude *.Spam. Use \"\" for an empty prefix.")
+                            .font(.caption)
+                            .foregroundStyle(.secondary)
+                    }
+                }
+
+                Section("Compatibility") {
+                    Toggle("Identify as MailKeep to the server", isOn: $sendClientID)
+                        .help("Sends the IMAP ID command after login when the server supports it. Some providers are more reliable with it.")
+                    Toggle("Follow server referrals", isOn: $followReferrals)
+                        .help("When the server refers the login to a host within the domain of the email address, reconnect there. Otherwise the referral is reported as an error.")
+                    Picker("Fetch strategy", selection: $fetchStrategy) {
+                        ForEach(FetchStrategy.allCases, id: \.self) { strategy in
+                            Text(strategy.displayName).tag(strategy)
+                        }
+                    }
+                    .pickerStyle(.menu)
+                    .help("Two-phase fetches sizes, envelopes and flags for a batch first, then only each body on its own. Try it when a server fails or returns garbled data with the combined fetch.")
+                    Picker("Connect over", selection: $addressFamily) {
+                        ForEach(AddressFamily.allCases, id: \.self) { family in
+                            Text(family.displayName).tag(family)
+                        }
+                    }
+                    .pickerStyle(.menu)
+                    .help("Limit the connection to IPv4 or IPv6. Choose IPv4 when connecting hangs on a network with a broken IPv6 path.")
                 }
             }
             .formStyle(.grouped)
@@ -232,11 +405,14 @@ struct EditAccountView: View {
             }
             .padding()
         }
-        .frame(width: 450, height: account.authType == .oauth2 ? 300 : 380)
+        .frame(width: 450, height: account.authType == .oauth2 ? 540 : 620)
     }
 
     var isFormValid: Bool {
-        !email.isEmpty && !imapServer.isEmpty && !port.isEmpty
+        !email.isEmpty && !imapServer.isEmpty && !port.isEmpty &&
+            EmailAccount.keychainServiceProblem(keychainService) == nil &&
+            EmailAccount.tlsServerNameProblem(tlsServerName) == nil &&
+            EmailAccount.passwordCommandProblem(passwordCommand) == nil
     }
 
     func testConnection() {
@@ -247,9 +423,16 @@ struct EditAccountView: View {
             do {
                 // Get password: use typed password if available, otherwise try Keychain
                 let testPassword: String
+                let command = passwordCommand.trimmingCharacters(in: .whitespaces)
                 if !password.isEmpty {
                     testPassword = password
-                } else if let keychainPassword = try? await KeychainService.shared.getPassword(for: account.id) {
+                } else if !command.isEmpty {
+                    testPassword = try await PasswordCommandService.run(command)
+                } else if let keychainPassword = try? await KeychainService.shared.getPassword(trying: KeychainService.passwordLookups(
+                    accountId: account.id,
+                    username: email,
+                    customService: EmailAccount.normalizedKeychainService(keychainService)
+                )) {
                     testPassword = keychainPassword
                 } else {
                     await MainActor.run {
@@ -266,7 +449,9 @@ struct EditAccountView: View {
                     port: Int(port) ?? 993,
                     password: testPassword,
                     useSSL: useSSL,
-                    authType: .password
+                    authType: .password,
+                    addressFamily: addressFamily,
+                    tlsServerName: EmailAccount.normalizedTLSServerName(tlsServerName)
                 )
 
                 let service = IMAPService(account: testAccount)
@@ -303,6 +488,20 @@ struct EditAccountView: View {
         updatedAccount.imapServer = imapServer
         updatedAccount.port = Int(port) ?? 993
         updatedAccount.useSSL = useSSL
+        updatedAccount.folderRemap = EmailAccount.parseFolderRemap(folderRemapText)
+        updatedAccount.flatFolderSeparator = flattenFolders
+            ? EmailAccount.normalizedFlatFolderSeparator(flatFolderSeparator)
+            : nil
+        updatedAccount.sendClientID = sendClientID
+        updatedAccount.followReferrals = followReferrals
+        updatedAccount.fetchStrategy = fetchStrategy
+        updatedAccount.addressFamily = addressFamily
+        updatedAccount.tlsServerName = EmailAccount.normalizedTLSServerName(tlsServerName)
+        updatedAccount.backupSharedFolders = backupSharedFolders
+        updatedAccount.sharedFolderFilters = EmailAccount.parseSharedFolderFilters(sharedFolderFiltersText)
+        updatedAccount.keychainService = EmailAccount.normalizedKeychainService(keychainService)
+        let command = passwordCommand.trimmingCharacters(in: .whitespaces)
+        updatedAccount.passwordCommand = command.isEmpty ? nil : command
 
         // Update password only if a new one was provided
         let newPassword = password.isEmpty ? nil : password
@@ -311,3 +510,123 @@ struct EditAccountView: View {
         dismiss()
     }
 }
+
+/// Where accounts are imported from
+enum AccountImportSource: String, CaseIterable, Identifiable {
+    case internetAccounts
+    case thunderbird
+
+    var id: String { rawValue }
+
+    var displayName: String {
+        switch self {
+        case .internetAccounts: return "Internet Accounts"
+        case .thunderbird: return "Thunderbird"
+        }
+    }
+
+    func discoverAccounts() throws -> [DiscoveredMailAccount] {
+        switch self {
+        case .internetAccounts: return try MacAccountImportService.discoverAccounts()
+        case .thunderbird: return ThunderbirdImportService.discoverAccounts()
+        }
+    }
+}
+
+struct ImportMacAccountsView: View {
+    @EnvironmentObject var backupManager: BackupManager
+    @Environment(\.dismiss) private var dismiss
+
+    var source: AccountImportSource = .internetAccounts
+
+    @State private var candidates: [EmailAccount] = []
+    @State private var selected: Set<UUID> = []
+    @State private var errorMessage: String?
+    @State private var hasLoaded = false
+
+    var body: some View {
+        VStack(spacing: 0) {
+            HStack {
+                Text("Import from \(source.displayName)")
+                    .font(.headline)
+                Spacer()
+                Button("Cancel") {
+                    dismiss()
+                }
+                .buttonStyle(.plain)
+            }
+            .padding()
+
+            Divider()
+
+            Form {
+                if let errorMessage = errorMessage {
+                    Label(errorMessage, systemImage: "exclamationmark.triangle.fill")
+                        .foregroundStyle(.orange)
+                        .font(.caption)
+                } else if hasLoaded && candidates.isEmpty {
+                    Text(source == .thunderbird
+                         ? "No new IMAP accounts found in Thunderbird profiles."
+                         : "No new email accounts found in macOS Internet Accounts.")
+                        .foregroundStyle(.secondary)
+                }
+
+                ForEach(candidates) { account in
+                    Toggle(isOn: Binding(
+                        get: { selected.contains(account.id) },
+                        set: { isOn in
+                            if isOn { selected.insert(account.id) } else { selected.remove(account.id) }
+                        }
+                    )) {
+                        VStack(alignment: .leading, spacing: 2) {
+                            Text(account.email)
+                            Text(account.authType == .oauth2 ? "Google (sign in required)" : "\(account.imapServer):\(account.port)")
+                                .font(.caption)
+                                .foregroundStyle(.secondary)
+                        }
+                    }
+                }
+
+                if !candidates.isEmpty {
+                    Text("Passwords are not copied from \(source == .thunderbird ? "Thunderbird" : "macOS"). Edit each imported account to enter its password.")
+                        .font(.caption)
+                        .foregroundStyle(.secondary)
+                }
+            }
+            .formStyle(.grouped)
+
+            Divider()
+
+            HStack {
+                Spacer()
+                Button("Import \(selected.count) Account\(selected.count == 1 ? "" : "s")") {
+                    importSelected()
+                }
+                .buttonStyle(.borderedProminent)
+                .disabled(selected.isEmpty)
+            }
+            .padding()
+        }
+        .frame(width: 450, height: 400)
+        .onAppear(perform: loadCandidates)
+    }
+
+    func loadCandidates() {
+        do {
+            let discovered = try source.discoverAccounts()
+            candidates = MacAccountImportService.importableAccounts(from: discovered, existing: backupManager.accounts)
+            selected = Set(candidates.map { $0.id })
+        } catch {
+            errorMessage = error.localizedDescription
+        }
+        hasLoaded = true
+    }
+
+    func importSelected() {
+        for account in candidates where selected.contains(account.id) {
+            backupManager.addAccount(account, password: nil)
+        }
+        logInfo("Imported \(selected.count) accounts from \(source.displayName)")
+        dismiss()
+    }
+}
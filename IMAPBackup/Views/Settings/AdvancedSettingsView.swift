@@ -1,17 +1,36 @@
 import SwiftUI
+import UniformTypeIdentifiers
 
 struct AdvancedSettingsView: View {
+    @EnvironmentObject var backupManager: BackupManager
+    @StateObject private var diagnosticsService = DiagnosticsService.shared
     @AppStorage("googleOAuthClientId") private var customClientId = ""
+    @AppStorage("googleOAuthClientSecretFile") private var clientSecretFile = ""
     @State private var showCustomClientId = false
+    @State private var restoreAccountId: UUID?
+    @State private var restoreTargetFolder = "INBOX"
+    @State private var stripAttachmentsToFit = false
+    @State private var restoreAddedHeaders = ""
+    @State private var isRestoring = false
+    @State private var restoreResult: String?
 
     var body: some View {
         Form {
             Section("Google OAuth") {
-                HStack {
-                    Image(systemName: "checkmark.circle.fill")
-                        .foregroundStyle(.green)
-                    Text("Sign in with Google is ready to use")
-                        .fontWeight(.medium)
+                if let problem = oauthConfigurationProblem {
+                    HStack {
+                        Image(systemName: "exclamationmark.triangle.fill")
+                            .foregroundStyle(.orange)
+                        Text(problem)
+                            .fontWeight(.medium)
+                    }
+                } else {
+                    HStack {
+                        Image(systemName: "checkmark.circle.fill")
+                            .foregroundStyle(.green)
+                        Text("Sign in with Google is ready to use")
+                            .fontWeight(.medium)
+                    }
                 }
 
                 Text("Gmail accounts use secure OAuth authentication. Just click 'Sign in with Google' when adding a Gmail account.")
@@ -29,15 +48,28 @@ struct AdvancedSettingsView: View {
                         TextField("Custom Client ID (optional)", text: $customClientId)
                             .textFieldStyle(.roundedBorder)
 
-                        if !customClientId.isEmpty {
+                        HStack {
+                            TextField("Client secret file (client_secret_*.json)", text: $clientSecretFile)
+                                .textFieldStyle(.roundedBorder)
+                            Button("Choose...") {
+                                chooseClientSecretFile()
+                            }
+                        }
+
+                        Text("The client ID and secret in the file take precedence over the Client ID above. MAILKEEP_GOOGLE_CLIENT_ID and MAILKEEP_GOOGLE_CLIENT_SECRET in the environment override both.")
+                            .font(.caption)
+                            .foregroundStyle(.secondary)
+
+                        if !customClientId.isEmpty || !clientSecretFile.isEmpty {
                             HStack {
                                 Image(systemName: "checkmark.circle.fill")
                                     .foregroundStyle(.green)
-                                Text("Using custom Client ID")
+                                Text("Using custom credentials")
                                     .foregroundStyle(.green)
                                 Spacer()
                                 Button("Reset to Default") {
                                     customClientId = ""
+                                    clientSecretFile = ""
                                 }
                                 .buttonStyle(.link)
                             }
@@ -52,6 +84,94 @@ struct AdvancedSettingsView: View {
                 }
             }
 
+            Section("Diagnostics") {
+                Text("Checks the backup location, Keychain, notifications and connectivity of each account.")
+                    .font(.caption)
+                    .foregroundStyle(.secondary)
+
+                Button(action: {
+                    Task {
+                        await diagnosticsService.runAll(
+                            accounts: backupManager.accounts,
+                            backupLocation: backupManager.backupLocation,
+                            mirrorLocations: backupManager.mirrorLocations,
+                            minimumFreeInodes: backupManager.minimumFreeInodes
+                        )
+                    }
+                }) {
+                    HStack {
+                        if diagnosticsService.isRunning {
+                            ProgressView()
+                                .scaleEffect(0.7)
+                            Text("Running...")
+                        } else {
+                            Image(systemName: "stethoscope")
+                            Text("Run Diagnostics")
+                        }
+                    }
+                }
+                .disabled(diagnosticsService.isRunning)
+
+                Button("Copy Build Info") {
+                    NSPasteboard.general.clearContents()
+                    NSPasteboard.general.setString(BuildInfo.current.report, forType: .string)
+                }
+                .help("Copies version, commit, macOS version, architecture and available integrations for a bug report")
+
+                ForEach(diagnosticsService.results) { check in
+                    DiagnosticCheckRow(check: check)
+                }
+            }
+
+            Section("Restore") {
+                Text("Uploads the emails of a backed-up folder to a folder on the server. Emails larger than the server accepts are skipped and listed.")
+                    .font(.caption)
+                    .foregroundStyle(.secondary)
+
+                Picker("Account", selection: $restoreAccountId) {
+                    Text("Choose...").tag(UUID?.none)
+                    ForEach(backupManager.accounts) { account in
+                        Text(account.email).tag(UUID?.some(account.id))
+                    }
+                }
+
+                TextField("Server folder", text: $restoreTargetFolder)
+                    .textFieldStyle(.roundedBorder)
+
+                Toggle("Remove attachments from emails that are too large", isOn: $stripAttachmentsToFit)
+
+                VStack(alignment: .leading, spacing: 4) {
+                    Text("Headers to add to restored emails")
+                    TextEditor(text: $restoreAddedHeaders)
+                        .font(.system(.caption, design: .monospaced))
+                        .frame(height: 48)
+                    Text("One \"Name: value\" per line, e.g. X-Archived-From: {folder}. {folder} is the backed-up folder, {date} the time of the restore. Message-ID is never changed.")
+                        .font(.caption)
+                        .foregroundStyle(.secondary)
+                }
+
+                Button(action: restoreFolder) {
+                    HStack {
+                        if isRestoring {
+                            ProgressView()
+                                .scaleEffect(0.7)
+                            Text("Restoring...")
+                        } else {
+                            Image(systemName: "arrow.up.doc")
+                            Text("Restore Folder...")
+                        }
+                    }
+                }
+                .disabled(isRestoring || restoreAccountId == nil || restoreTargetFolder.isEmpty)
+
+                if let restoreResult = restoreResult {
+                    Text(restoreResult)
+                        .font(.caption)
+                        .foregroundStyle(.secondary)
+                        .textSelection(.enabled)
+                }
+            }
+
             Section {
                 HStack {
                     Image(systemName: "lock.shield.fill")
@@ -65,4 +185,101 @@ struct AdvancedSettingsView: View {
         .formStyle(.grouped)
         .padding()
     }
+
+    /// Why Sign in with Google cannot be used with the current credentials, if it cannot
+    private var oauthConfigurationProblem: String? {
+        do {
+            _ = try GoogleOAuthService.Configuration.resolve(clientSecretFile: clientSecretFile, customClientId: customClientId)
+            return nil
+        } catch {
+            return error.localizedDescription
+        }
+    }
+
+    private func chooseClientSecretFile() {
+        let panel = NSOpenPanel()
+        panel.canChooseFiles = true
+        panel.canChooseDirectories = false
+        panel.allowsMultipleSelection = false
+        panel.allowedContentTypes = [.json]
+        panel.message = "Choose the client secret file downloaded from the Google Cloud Console"
+
+        guard panel.runModal() == .OK, let fileURL = panel.url else { return }
+        GoogleOAuthService.Configuration.forgetClientSecretFile(at: fileURL.path)
+        clientSecretFile = fileURL.path
+    }
+
+    private func restoreFolder() {
+        guard let account = backupManager.accounts.first(where: { $0.id == restoreAccountId }) else { return }
+
+        let panel = NSOpenPanel()
+        panel.canChooseFiles = false
+        panel.canChooseDirectories = true
+        panel.allowsMultipleSelection = false
+        panel.directoryURL = backupManager.backupLocation
+        panel.message = "Choose the backed-up folder to restore"
+
+        guard panel.runModal() == .OK, let folderURL = panel.url else { return }
+
+        let addedHeaders = restoreAddedHeaders
+            .components(separatedBy: .newlines)
+            .map { $0.trimmingCharacters(in: .whitespaces) }
+            .filter { !$0.isEmpty }
+        let options = RestoreOptions(stripAttachmentsToFit: stripAttachmentsToFit, addedHeaders: addedHeaders)
+        let target = restoreTargetFolder
+        isRestoring = true
+        restoreResult = nil
+
+        Task {
+            do {
+                let report = try await RestoreService.restore(folderURL: folderURL, account: account, to: target, options: options)
+                let details = (report.skipped + report.failed).map { "\($0.file): \($0.reason)" }
+                restoreResult = ([report.summary + "."] + details).joined(separator: "\n")
+            } catch {
+                restoreResult = "Restore failed: \(error.localizedDescription)"
+            }
+            isRestoring = false
+        }
+    }
+}
+
+struct DiagnosticCheckRow: View {
+    let check: DiagnosticCheck
+
+    var body: some View {
+        HStack(alignment: .top) {
+            Image(systemName: iconName)
+                .foregroundStyle(iconColor)
+
+            VStack(alignment: .leading, spacing: 2) {
+                Text(check.name)
+                    .fontWeight(.medium)
+                Text(check.detail)
+                    .font(.caption)
+                    .foregroundStyle(.secondary)
+                if let remediation = check.remediation {
+                    Text(remediation)
+                        .font(.caption)
+                        .foregroundStyle(iconColor)
+                }
+            }
+        }
+        .padding(.vertical, 2)
+    }
+
+    private var iconName: String {
+        switch check.status {
+        case .pass: return "checkmark.circle.fill"
+        case .warning: return "exclamationmark.triangle.fill"
+        case .fail: return "xmark.circle.fill"
+        }
+    }
+
+    private var iconColor: Color {
+        switch check.status {
+        case .pass: return .green
+        case .warning: return .orange
+        case .fail: return .red
+        }
+    }
 }
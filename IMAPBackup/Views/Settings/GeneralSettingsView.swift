@@ -5,6 +5,12 @@ struct GeneralSettingsView: View {
     @StateObject private var launchService = LaunchAtLoginService.shared
     @AppStorage("hideDockIcon") private var hideDockIcon = false
     @AppStorage("LogLevel") private var logLevel = 1  // Default: info
+    @StateObject private var cleanupService = ServerCleanupService.shared
+    @State private var pendingCleanupAction: ServerCleanupAction = .moveToTrash
+    @State private var showCleanupConfirmation = false
+    @State private var showCleanupDeleteConfirmation = false
+    @State private var isExtractingAttachments = false
+    @State private var extractionResult: String?
 
     var body: some View {
         Form {
@@ -66,6 +72,97 @@ struct GeneralSettingsView: View {
                 }
             }
 
+            Section("Mirror Locations") {
+                ForEach(backupManager.mirrorLocations, id: \.self) { url in
+                    HStack {
+                        Image(systemName: "externaldrive.fill")
+                            .foregroundStyle(.secondary)
+                        Text(url.path)
+                            .font(.caption)
+                            .lineLimit(1)
+                            .truncationMode(.middle)
+                        Spacer()
+                        Button("Remove") {
+                            backupManager.removeMirrorLocation(url)
+                        }
+                        .buttonStyle(.link)
+                    }
+                }
+
+                Button("Add Mirror Location...") {
+                    backupManager.addMirrorLocation()
+                }
+
+                Text("Each downloaded email is also written to these locations, so one run keeps several copies without fetching twice. An email missing from any location is downloaded again.")
+                    .font(.caption)
+                    .foregroundStyle(.secondary)
+            }
+
+            Section("Folder Layout") {
+                Picker("Arrange emails", selection: Binding(
+                    get: { backupManager.storageLayout },
+                    set: { backupManager.setStorageLayout($0) }
+                )) {
+                    ForEach(StorageLayout.allCases, id: \.self) { layout in
+                        Text(layout.displayName).tag(layout)
+                    }
+                }
+                .pickerStyle(.menu)
+                .help("Where new emails are saved inside each folder")
+
+                Text("By Year and Month stores emails in YYYY/MM subfolders by message date, which keeps very large folders fast to browse. Existing emails are found in either layout and are not moved.")
+                    .font(.caption)
+                    .foregroundStyle(.secondary)
+
+                TextField("Back up only", text: Binding(
+                    get: { backupManager.defaultFolders.joined(separator: ", ") },
+                    set: { backupManager.setDefaultFolders(FolderSelection.parseNames($0)) }
+                ), prompt: Text("All folders"))
+                .help("Folders to back up, e.g. INBOX, Sent. Sent, Drafts, Trash, Junk and Archive find the provider's folder for that use. Launch with --all-folders to back up everything once")
+
+                Picker("Recognize saved emails by", selection: Binding(
+                    get: { backupManager.incrementalStrategy },
+                    set: { backupManager.setIncrementalStrategy($0) }
+                )) {
+                    ForEach(IncrementalStrategy.allCases, id: \.self) { strategy in
+                        Text(strategy.displayName).tag(strategy)
+                    }
+                }
+                .pickerStyle(.menu)
+                .help("How a backup decides which emails it already has")
+
+                Text("Message-ID keeps emails from being downloaded again after the server renumbers them, e.g. after a migration, but reads the headers of every email on each backup.")
+                    .font(.caption)
+                    .foregroundStyle(.secondary)
+
+                Toggle("Keep backup state in one file per account", isOn: Binding(
+                    get: { backupManager.useStateIndex },
+                    set: { backupManager.setUseStateIndex($0) }
+                ))
+                .help("Reads .backup_state.json once per backup instead of every folder's UID cache. Folders it is unsure about are read from disk as before.")
+
+                Picker("Save new emails", selection: Binding(
+                    get: { backupManager.fetchOrder },
+                    set: { backupManager.setFetchOrder($0) }
+                )) {
+                    ForEach(FetchOrder.allCases, id: \.self) { order in
+                        Text(order.displayName).tag(order)
+                    }
+                }
+                .pickerStyle(.menu)
+                .help("Newest First backs up recent mail before older mail, so it is saved even if a backup is interrupted")
+
+                Toggle("Only look for emails since the last successful backup", isOn: Binding(
+                    get: { backupManager.backupSince == .lastRun },
+                    set: { backupManager.setBackupSince($0 ? .lastRun : .all) }
+                ))
+                .help("Searches each folder with SINCE the day of the account's last successful backup instead of listing every email")
+
+                Text("Speeds up backups of very large folders. Emails moved into a folder with an older date are not picked up while this is on.")
+                    .font(.caption)
+                    .foregroundStyle(.secondary)
+            }
+
             Section("Startup") {
                 Toggle("Start at login", isOn: $launchService.isEnabled)
                     .help("Automatically launch MailKeep when you log in")
@@ -77,6 +174,95 @@ struct GeneralSettingsView: View {
                     }
             }
 
+            Section("Sampling") {
+                HStack {
+                    Text("Newest emails per folder")
+                    Spacer()
+                    TextField("All", value: Binding(
+                        get: { backupManager.maxMessagesPerFolder },
+                        set: { backupManager.setMaxMessagesPerFolder($0) }
+                    ), format: .number)
+                    .textFieldStyle(.roundedBorder)
+                    .frame(width: 80)
+                    .multilineTextAlignment(.trailing)
+                }
+                .help("Stop each folder after this many new emails were saved; 0 saves all")
+
+                Text("For trying settings on a large mailbox: each backup saves at most this many new emails per folder, newest first. Set to 0 for normal backups.")
+                    .font(.caption)
+                    .foregroundStyle(.secondary)
+            }
+
+            Section("Performance") {
+                Stepper(value: Binding(
+                    get: { backupManager.maxConcurrentMessagesPerFolder },
+                    set: { backupManager.setMaxConcurrentMessagesPerFolder($0) }
+                ), in: 1...8) {
+                    Text("Connections per folder: \(backupManager.maxConcurrentMessagesPerFolder)")
+                }
+                .help("Download large folders over several connections at once; limited by the account's rate limit settings")
+
+                Text("Speeds up backups from distant or slow servers. Each extra connection logs in separately and shares the account's request rate limit.")
+                    .font(.caption)
+                    .foregroundStyle(.secondary)
+
+                HStack {
+                    Text("Pause after each email")
+                    Spacer()
+                    TextField("None", value: Binding(
+                        get: { backupManager.messageDelayMs },
+                        set: { backupManager.setMessageDelay(milliseconds: $0) }
+                    ), format: .number)
+                    .textFieldStyle(.roundedBorder)
+                    .frame(width: 70)
+                    .multilineTextAlignment(.trailing)
+                    Text("ms")
+                }
+                .help("A fixed wait after every email, in addition to the rate limit; 0 does not wait")
+
+                Text("For shared servers: unlike the rate limit, this pause never adapts and is easy to reason about.")
+                    .font(.caption)
+                    .foregroundStyle(.secondary)
+            }
+
+            Section("Errors") {
+                HStack {
+                    Text("Give up on a folder above")
+                    Spacer()
+                    TextField("Never", value: Binding(
+                        get: { backupManager.maxErrorPercent },
+                        set: { backupManager.setMaxErrorPercent($0) }
+                    ), format: .number)
+                    .textFieldStyle(.roundedBorder)
+                    .frame(width: 60)
+                    .multilineTextAlignment(.trailing)
+                    Text("% failed")
+                }
+                .help("Stop a folder once more than this share of its emails could not be saved; 0 never stops")
+
+                Text("Emails that cannot be saved are logged, listed by UID in the backup report and skipped. A folder is only abandoned when failures exceed this share, judged after the first 10 emails.")
+                    .font(.caption)
+                    .foregroundStyle(.secondary)
+
+                HStack {
+                    Text("Stop below")
+                    Spacer()
+                    TextField("Never", value: Binding(
+                        get: { backupManager.minimumFreeInodes },
+                        set: { backupManager.setMinimumFreeInodes($0) }
+                    ), format: .number)
+                    .textFieldStyle(.roundedBorder)
+                    .frame(width: 90)
+                    .multilineTextAlignment(.trailing)
+                    Text("free inodes")
+                }
+                .help("Stop a backup before it starts, or between folders, once a backup or mirror volume can hold fewer new files than this; 0 never stops")
+
+                Text("Every email takes its own files, so a volume can run out of inodes while space is left. Below twice this number the log warns. If inodes are the limit, move backups to a volume with more inodes, or export old emails to mbox, which keeps a folder in one file.")
+                    .font(.caption)
+                    .foregroundStyle(.secondary)
+            }
+
             Section("Logging") {
                 Picker("Log Level", selection: $logLevel) {
                     Text("Debug").tag(0)
@@ -129,9 +315,167 @@ struct GeneralSettingsView: View {
                 ))
                 .help("When enabled, attachments are extracted from emails and saved to separate folders")
 
+                Picker("Duplicate filenames", selection: Binding(
+                    get: { AttachmentExtractionManager.shared.settings.dedupStrategy },
+                    set: { AttachmentExtractionManager.shared.settings.dedupStrategy = $0 }
+                )) {
+                    ForEach(AttachmentDedupStrategy.allCases, id: \.self) { strategy in
+                        Text(strategy.displayName).tag(strategy)
+                    }
+                }
+                .help("What to do when an email has several attachments with the same name")
+
+                Stepper(value: Binding(
+                    get: { AttachmentExtractionManager.shared.settings.maxConcurrentWrites },
+                    set: { AttachmentExtractionManager.shared.settings.maxConcurrentWrites = $0 }
+                ), in: 1...16) {
+                    Text("Write \(AttachmentExtractionManager.shared.settings.maxConcurrentWrites) attachment\(AttachmentExtractionManager.shared.settings.maxConcurrentWrites == 1 ? "" : "s") at a time")
+                }
+                .help("Attachment files of one email written in parallel. Higher values help emails with many large attachments on fast disks")
+
+                TextField("Skip content types", text: Binding(
+                    get: { AttachmentExtractionManager.shared.settings.skipRules.contentTypes.joined(separator: ", ") },
+                    set: { AttachmentExtractionManager.shared.settings.skipRules.contentTypes = AttachmentSkipRules.parsePatterns($0) }
+                ), prompt: Text("image/gif, application/pkcs7-signature"))
+                .help("MIME type patterns of attachments not to save, e.g. image/*")
+
+                TextField("Skip filenames", text: Binding(
+                    get: { AttachmentExtractionManager.shared.settings.skipRules.filenames.joined(separator: ", ") },
+                    set: { AttachmentExtractionManager.shared.settings.skipRules.filenames = AttachmentSkipRules.parsePatterns($0) }
+                ), prompt: Text("*.p7s, smime.p7s"))
+                .help("Filename patterns of attachments not to save. Skipped attachments are still listed in the email's .attachments.json")
+
+                Stepper(value: Binding(
+                    get: { AttachmentExtractionManager.shared.settings.skipRules.maxSizeBytes / (1024 * 1024) },
+                    set: { AttachmentExtractionManager.shared.settings.skipRules.maxSizeBytes = $0 * 1024 * 1024 }
+                ), in: 0...1024) {
+                    let limitMB = AttachmentExtractionManager.shared.settings.skipRules.maxSizeBytes / (1024 * 1024)
+                    Text(limitMB > 0 ? "Skip attachments over \(limitMB) MB" : "No attachment size limit")
+                }
+                .help("Attachments larger than this are not downloaded where the server describes the email's parts, and are listed as skipped with their size")
+
+                if let launchLimit = AttachmentExtractionManager.shared.launchSizeLimit {
+                    Text("This run uses \(ByteCountFormatter.string(fromByteCount: Int64(launchLimit), countStyle: .file)) from -NoAttachmentsOver instead")
+                        .font(.caption)
+                        .foregroundStyle(.secondary)
+                }
+
                 Text("When enabled, attachments (PDFs, images, documents, etc.) are extracted from .eml files and saved to a subfolder next to each email. The original .eml file is preserved with embedded attachments.")
                     .font(.caption)
                     .foregroundStyle(.secondary)
+
+                HStack {
+                    Button("Extract from Existing Backup...") {
+                        extractAttachmentsFromBackup()
+                    }
+                    .disabled(isExtractingAttachments)
+                    .help("Pull attachments out of all backed-up emails into a separate folder with a manifest.json")
+
+                    if isExtractingAttachments {
+                        ProgressView()
+                            .scaleEffect(0.7)
+                    }
+                }
+
+                if let extractionResult = extractionResult {
+                    Text(extractionResult)
+                        .font(.caption)
+                        .foregroundStyle(.secondary)
+                }
+            }
+
+            Section("Forensics") {
+                Toggle("Save server envelope with each email", isOn: Binding(
+                    get: { backupManager.saveEnvelopeSidecars },
+                    set: { backupManager.setSaveEnvelopeSidecars($0) }
+                ))
+                .help("Stores the server-reported ENVELOPE and BODYSTRUCTURE as a .envelope.json file next to each email")
+
+                Text("Preserves the exact envelope and MIME structure reported by the server, e.g. for e-discovery. Adds one small file per email and one extra request per download.")
+                    .font(.caption)
+                    .foregroundStyle(.secondary)
+
+                Picker("Read state in metadata", selection: Binding(
+                    get: { backupManager.localFlagPolicy },
+                    set: { backupManager.setLocalFlagPolicy($0) }
+                )) {
+                    ForEach(LocalFlagPolicy.allCases, id: \.self) { policy in
+                        Text(policy.displayName).tag(policy)
+                    }
+                }
+                .help("How the read flag is recorded in saved envelopes; the emails and the server are not changed")
+
+                Toggle("Write a backup report per folder", isOn: Binding(
+                    get: { backupManager.writeBackupReports },
+                    set: { backupManager.setWriteBackupReports($0) }
+                ))
+                .help("Appends a JSON line to backup_report.jsonl in the account folder as each folder finishes, plus a summary at the end")
+
+                Text("Lets monitoring follow long backups. If the app is killed, the folders that finished are still on record.")
+                    .font(.caption)
+                    .foregroundStyle(.secondary)
+
+                Toggle("Write a summary into each folder", isOn: Binding(
+                    get: { backupManager.writeFolderSummaries },
+                    set: { backupManager.setWriteFolderSummaries($0) }
+                ))
+                .help("Keeps _folder.json with the message count, date range, UIDVALIDITY, last sync and total size up to date")
+
+                Toggle("Name future-dated emails by their arrival date", isOn: Binding(
+                    get: { backupManager.clampFutureDates },
+                    set: { backupManager.setClampFutureDates($0) }
+                ))
+                .help("Emails dated more than two days ahead, often spam, are always logged and recorded. With this on, their file is named by when the server received them so they do not sort ahead of real mail.")
+
+                Toggle("Index headers only, without message bodies", isOn: Binding(
+                    get: { backupManager.headersOnly },
+                    set: { backupManager.setHeadersOnly($0) }
+                ))
+                .help("Saves only a .envelope.json per message with envelope, flags and MIME structure; no .eml files are written")
+
+                Text("A fast, small inventory of what is on the server. Messages indexed this way are still downloaded in full once the option is turned off.")
+                    .font(.caption)
+                    .foregroundStyle(.secondary)
+            }
+
+            Section("Server Cleanup") {
+                Toggle("Remove emails from server after backup", isOn: Binding(
+                    get: { cleanupService.settings.isActive },
+                    set: { newValue in
+                        if newValue {
+                            showCleanupConfirmation = true
+                        } else {
+                            cleanupService.disable()
+                        }
+                    }
+                ))
+                .help("Only emails that were saved and verified on disk are removed")
+
+                Picker("Action", selection: $pendingCleanupAction) {
+                    ForEach(ServerCleanupAction.allCases, id: \.self) { action in
+                        Text(action.rawValue).tag(action)
+                    }
+                }
+                .pickerStyle(.menu)
+                .disabled(cleanupService.settings.isActive)
+
+                if cleanupService.settings.isActive && cleanupService.settings.action == .delete {
+                    Toggle("Delete without asking after each backup", isOn: Binding(
+                        get: { cleanupService.deletesAutomatically },
+                        set: { newValue in
+                            if newValue {
+                                showCleanupDeleteConfirmation = true
+                            } else {
+                                cleanupService.deletesAutomatically = false
+                            }
+                        }
+                    ))
+                    .help("When off, backup runs only log what they would delete from the server. Launch with --yes to delete in a single run.")
+                }
+
+                Text("Frees quota on the server. Each email is only moved or deleted after its backup copy was written and checksum-verified.")
+                    .font(.caption)
+                    .foregroundStyle(.secondary)
             }
         }
         .formStyle(.grouped)
@@ -139,6 +483,50 @@ struct GeneralSettingsView: View {
         .onAppear {
             // Apply saved dock icon preference on app start
             setDockIconVisibility(hidden: hideDockIcon)
+            pendingCleanupAction = cleanupService.settings.action
+        }
+        .alert("Remove emails from server?", isPresented: $showCleanupConfirmation) {
+            Button("Cancel", role: .cancel) {}
+            Button(pendingCleanupAction == .delete ? "Delete After Backup" : "Move to Trash After Backup", role: .destructive) {
+                cleanupService.enable(action: pendingCleanupAction)
+            }
+        } message: {
+            Text(pendingCleanupAction == .delete
+                 ? "Backed-up emails will be permanently deleted from the server. This cannot be undone."
+                 : "Backed-up emails will be moved to the server's Trash folder.")
+        }
+        .alert("Delete from the server after each backup?", isPresented: $showCleanupDeleteConfirmation) {
+            Button("Cancel", role: .cancel) {}
+            Button("Delete Automatically", role: .destructive) {
+                cleanupService.deletesAutomatically = true
+            }
+        } message: {
+            Text("Every backup run will permanently delete the backed-up emails from the server. Deleted emails cannot be recovered.")
+        }
+    }
+
+    private func extractAttachmentsFromBackup() {
+        let panel = NSOpenPanel()
+        panel.canChooseFiles = false
+        panel.canChooseDirectories = true
+        panel.canCreateDirectories = true
+        panel.allowsMultipleSelection = false
+        panel.message = "Choose a folder for the extracted attachments"
+
+        guard panel.runModal() == .OK, let outputURL = panel.url else { return }
+
+        let backupURL = backupManager.backupLocation
+        isExtractingAttachments = true
+        extractionResult = nil
+
+        Task {
+            do {
+                let manifest = try await AttachmentService().extractAttachments(inBackup: backupURL, to: outputURL)
+                extractionResult = "Extracted \(manifest.attachments.count) attachments from \(manifest.emailsScanned) emails."
+            } catch {
+                extractionResult = "Extraction failed: \(error.localizedDescription)"
+            }
+            isExtractingAttachments = false
         }
     }
 
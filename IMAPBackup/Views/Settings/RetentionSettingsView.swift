@@ -5,6 +5,14 @@ struct RetentionSettingsView: View {
     @StateObject private var retentionService = RetentionService.shared
     @State private var previewResult: RetentionResult?
     @State private var isApplying = false
+    @State private var compactRemovesDuplicates = false
+    @State private var compactAppliesRetention = false
+    @State private var compactPreview: CompactReport?
+    @State private var compactResult: String?
+    @State private var isCompacting = false
+    @State private var showApplyConfirmation = false
+    @State private var showAutomaticConfirmation = false
+    @State private var showCompactConfirmation = false
 
     var body: some View {
         Form {
@@ -41,23 +49,33 @@ struct RetentionSettingsView: View {
                         .font(.caption)
                         .foregroundStyle(.secondary)
                 }
+
+                if retentionService.globalSettings.policy != .keepAll {
+                    Toggle("Delete automatically after each backup", isOn: Binding(
+                        get: { retentionService.deletesAutomatically },
+                        set: { newValue in
+                            if newValue {
+                                showAutomaticConfirmation = true
+                            } else {
+                                retentionService.deletesAutomatically = false
+                            }
+                        }
+                    ))
+                    .help("When off, backup runs only log what the policy would delete. Launch with --yes to delete in a single run.")
+                }
             }
 
             Section("Manual Actions") {
                 HStack {
                     Button("Preview") {
-                        previewResult = retentionService.previewRetention(at: backupManager.backupLocation)
+                        Task { await previewRetention() }
                     }
                     .disabled(retentionService.globalSettings.policy == .keepAll)
 
                     Button("Apply Now") {
-                        isApplying = true
                         Task {
-                            _ = await retentionService.applyRetentionToAll(backupLocation: backupManager.backupLocation)
-                            await MainActor.run {
-                                isApplying = false
-                                previewResult = nil
-                            }
+                            await previewRetention()
+                            showApplyConfirmation = true
                         }
                     }
                     .disabled(retentionService.globalSettings.policy == .keepAll || isApplying)
@@ -82,6 +100,43 @@ struct RetentionSettingsView: View {
                 }
             }
 
+            Section("Compact") {
+                Text("Removes attachment files and metadata left behind by deleted emails, interrupted writes and quarantined downloads, then rebuilds the duplicate detection indexes.")
+                    .font(.caption)
+                    .foregroundStyle(.secondary)
+
+                Toggle("Also remove duplicate emails within a folder", isOn: $compactRemovesDuplicates)
+                Toggle("Also apply the retention policy", isOn: $compactAppliesRetention)
+                    .disabled(retentionService.globalSettings.policy == .keepAll)
+
+                HStack {
+                    Button("Preview") {
+                        runCompact(dryRun: true)
+                    }
+
+                    Button("Compact Now") {
+                        showCompactConfirmation = true
+                    }
+                    .disabled(compactPreview == nil)
+                    .help("Preview first to see what will be removed")
+
+                    if isCompacting {
+                        ProgressView()
+                            .scaleEffect(0.7)
+                    }
+                }
+                .disabled(isCompacting || backupManager.isBackingUp)
+
+                if let compactResult = compactResult {
+                    Text(compactResult)
+                        .font(.caption)
+                        .foregroundStyle(.secondary)
+                        .textSelection(.enabled)
+                }
+            }
+            .onChange(of: compactRemovesDuplicates) { _, _ in compactPreview = nil }
+            .onChange(of: compactAppliesRetention) { _, _ in compactPreview = nil }
+
             Section {
                 HStack {
                     Image(systemName: "exclamationmark.triangle.fill")
@@ -94,5 +149,74 @@ struct RetentionSettingsView: View {
         }
         .formStyle(.grouped)
         .padding()
+        .alert("Delete old backups?", isPresented: $showApplyConfirmation) {
+            Button("Cancel", role: .cancel) {}
+            Button("Delete", role: .destructive) {
+                isApplying = true
+                Task {
+                    _ = await retentionService.applyRetentionToAll(backupLocation: backupManager.backupLocation, mode: .confirmed)
+                    await MainActor.run {
+                        isApplying = false
+                        previewResult = nil
+                    }
+                }
+            }
+            .disabled(previewResult?.filesDeleted == 0)
+        } message: {
+            Text(retentionConfirmationMessage)
+        }
+        .alert("Delete old backups after each backup?", isPresented: $showAutomaticConfirmation) {
+            Button("Cancel", role: .cancel) {}
+            Button("Delete Automatically", role: .destructive) {
+                retentionService.deletesAutomatically = true
+            }
+        } message: {
+            Text("Every backup run will permanently delete the email backups this policy no longer keeps. Deleted emails cannot be recovered.")
+        }
+        .alert("Compact the backup?", isPresented: $showCompactConfirmation) {
+            Button("Cancel", role: .cancel) {}
+            Button("Compact", role: .destructive) {
+                runCompact(dryRun: false)
+            }
+        } message: {
+            Text((compactPreview?.summary ?? "Nothing was previewed") + ". Removed files cannot be recovered.")
+        }
+    }
+
+    /// Dry run of the policy over the whole backup location, the same pass Apply Now confirms
+    private func previewRetention() async {
+        previewResult = await retentionService.applyRetentionToAll(backupLocation: backupManager.backupLocation, mode: .dryRun)
+    }
+
+    /// What Apply Now deletes, from the preview taken when it was clicked
+    private var retentionConfirmationMessage: String {
+        guard let preview = previewResult, preview.filesDeleted > 0 else {
+            return "The policy would delete nothing."
+        }
+        var plan = DeletionPlan(operation: "Retention", mode: .dryRun)
+        plan.add("email", count: preview.filesDeleted, bytes: preview.bytesFreed)
+        return plan.summary + ". Deleted emails cannot be recovered."
+    }
+
+    private func runCompact(dryRun: Bool) {
+        var options = CompactOptions()
+        options.dryRun = dryRun
+        options.removeDuplicates = compactRemovesDuplicates
+        if compactAppliesRetention && retentionService.globalSettings.policy != .keepAll {
+            options.retention = retentionService.globalSettings
+        }
+        let backupLocation = backupManager.backupLocation
+        isCompacting = true
+
+        Task {
+            do {
+                let report = try await CompactService.compact(backupLocation: backupLocation, options: options)
+                compactPreview = dryRun ? report : nil
+                compactResult = ([report.summary + "."] + report.errors).joined(separator: "\n")
+            } catch {
+                compactResult = "Compact failed: \(error.localizedDescription)"
+            }
+            isCompacting = false
+        }
     }
 }
@@ -122,6 +122,59 @@ struct ScheduleSettingsView: View {
                 }
             }
 
+            Section {
+                Picker("Refresh flags", selection: Binding(
+                    get: { backupManager.flagRefreshIntervalHours },
+                    set: { backupManager.setFlagRefreshInterval(hours: $0) }
+                )) {
+                    Text("Never").tag(0)
+                    Text("Every Hour").tag(1)
+                    Text("Every 6 Hours").tag(6)
+                    Text("Daily").tag(24)
+                    if ![0, 1, 6, 24].contains(backupManager.flagRefreshIntervalHours) {
+                        Text("Every \(backupManager.flagRefreshIntervalHours) Hours").tag(backupManager.flagRefreshIntervalHours)
+                    }
+                }
+                .pickerStyle(.menu)
+                .help("Updates read and flag state in saved envelopes between backups without downloading any email")
+
+                HStack {
+                    Button("Refresh Flags Now") {
+                        Task {
+                            await backupManager.refreshFlags()
+                        }
+                    }
+                    .disabled(backupManager.isRefreshingFlags || backupManager.isBackingUp)
+
+                    if backupManager.isRefreshingFlags {
+                        ProgressView()
+                            .controlSize(.small)
+                    }
+
+                    Spacer()
+
+                    if let nextRefresh = backupManager.nextFlagRefresh {
+                        Text(nextRefresh, style: .relative)
+                            .font(.caption)
+                            .foregroundStyle(.secondary)
+                    }
+                }
+
+                ForEach(backupManager.lastFlagRefreshResults, id: \.accountEmail) { result in
+                    VStack(alignment: .leading, spacing: 2) {
+                        Text(result.accountEmail)
+                            .font(.caption)
+                        Text(result.summary)
+                            .font(.caption)
+                            .foregroundStyle(result.errors.isEmpty ? Color.secondary : Color.orange)
+                    }
+                }
+            } header: {
+                Text("Flag Refresh")
+            } footer: {
+                Text("Only emails saved with their server envelope have flags to refresh. Servers with CONDSTORE only send what changed.")
+            }
+
             // Last Backup Section
             Section("Last Backup") {
                 if let lastAccount = backupManager.accounts.first(where: { $0.lastBackupDate != nil }),
@@ -45,6 +45,13 @@ struct VerificationResultsListView: View {
 struct VerificationSettingsView: View {
     @EnvironmentObject var backupManager: BackupManager
     @StateObject private var verificationService = VerificationService.shared
+    @State private var fullVerification = false
+    @State private var searchCriteria = IMAPSearchCriteria()
+    @State private var searchFolders = ""
+    @State private var useSearchSince = false
+    @State private var searchSince = Calendar.current.date(byAdding: .day, value: -7, to: Date()) ?? Date()
+    @State private var useSearchBefore = false
+    @State private var searchBefore = Date()
 
     private var verificationResults: [AccountVerificationResult] {
         verificationService.lastResults
@@ -62,12 +69,11 @@ struct VerificationSettingsView: View {
                 }
 
                 Button(action: {
-                    Task {
-                        _ = await verificationService.verifyAll(
-                            accounts: backupManager.accounts,
-                            backupLocation: backupManager.backupLocation
-                        )
-                    }
+                    verificationService.startVerifyAll(
+                        accounts: backupManager.accounts,
+                        backupLocation: backupManager.backupLocation,
+                        full: fullVerification
+                    )
                 }) {
                     HStack {
                         if verificationService.isVerifying {
@@ -82,6 +88,17 @@ struct VerificationSettingsView: View {
                 }
                 .disabled(verificationService.isVerifying || backupManager.accounts.isEmpty)
 
+                if verificationService.isVerifying {
+                    Button("Stop Verification") {
+                        verificationService.cancelVerification()
+                    }
+                    .help("Stops after the current file; folders already checked are kept in the results")
+                }
+
+                Toggle("Full check", isOn: $fullVerification)
+                    .help("Recompute the checksum of every attachment. Otherwise only attachments saved since the last verification are checked.")
+                    .disabled(verificationService.isVerifying)
+
                 if verificationService.isVerifying {
                     if let account = verificationService.currentAccount {
                         HStack {
@@ -102,6 +119,115 @@ struct VerificationSettingsView: View {
                 }
             }
 
+            Section {
+                HStack {
+                    Button("Compare with Server") {
+                        Task {
+                            await backupManager.compareWithServer()
+                        }
+                    }
+                    .disabled(backupManager.isComparing || backupManager.isBackingUp || backupManager.accounts.isEmpty)
+
+                    if backupManager.isComparing {
+                        ProgressView()
+                            .controlSize(.small)
+                    }
+
+                    Spacer()
+
+                    if !backupManager.lastDiffs.isEmpty {
+                        Button("Save as JSON...") {
+                            saveDiffs()
+                        }
+                        .buttonStyle(.borderless)
+                    }
+                }
+
+                ForEach(backupManager.lastDiffs, id: \.accountEmail) { diff in
+                    VStack(alignment: .leading, spacing: 2) {
+                        Text(diff.accountEmail)
+                            .font(.caption)
+                        Text(diff.summary)
+                            .font(.caption)
+                            .foregroundStyle(diff.errors.isEmpty ? Color.secondary : Color.orange)
+                        ForEach(diff.folders.filter { !$0.isUnchanged }, id: \.folder) { folder in
+                            Text("\(folder.folder): +\(folder.newOnServer) new, -\(folder.missingOnServer) gone\(folder.flagChanges.map { ", \($0) flag change(s)" } ?? "")")
+                                .font(.caption2)
+                                .foregroundStyle(.secondary)
+                        }
+                    }
+                }
+            } header: {
+                Text("Dry Run")
+            } footer: {
+                Text("Shows per folder what the next backup would download and what the server no longer has, without downloading or writing anything. Flag changes are counted on servers with CONDSTORE for folders whose flags were refreshed before.")
+            }
+
+            Section {
+                TextField("From", text: searchText(\.from))
+                TextField("Subject", text: searchText(\.subject))
+                TextField("Body text", text: searchText(\.body))
+                HStack {
+                    Toggle("Since", isOn: $useSearchSince)
+                    DatePicker("", selection: $searchSince, displayedComponents: .date)
+                        .labelsHidden()
+                        .disabled(!useSearchSince)
+                    Toggle("Before", isOn: $useSearchBefore)
+                    DatePicker("", selection: $searchBefore, displayedComponents: .date)
+                        .labelsHidden()
+                        .disabled(!useSearchBefore)
+                }
+                TextField("Folders", text: $searchFolders, prompt: Text("All folders"))
+
+                HStack {
+                    Button("Search Server") {
+                        let criteria = serverSearchCriteria
+                        Task {
+                            await backupManager.searchServer(criteria, folderNames: FolderSelection.parseNames(searchFolders))
+                        }
+                    }
+                    .disabled(backupManager.isSearchingServer || backupManager.accounts.isEmpty || serverSearchCriteria.isEmpty)
+
+                    if backupManager.isSearchingServer {
+                        ProgressView()
+                            .controlSize(.small)
+                    }
+
+                    Spacer()
+
+                    if backupManager.lastServerSearch.contains(where: { !$0.matches.isEmpty }) {
+                        Button("Copy Results") {
+                            NSPasteboard.general.clearContents()
+                            NSPasteboard.general.setString(
+                                backupManager.lastServerSearch.map(\.report).filter { !$0.isEmpty }.joined(separator: "\n"),
+                                forType: .string
+                            )
+                        }
+                        .buttonStyle(.borderless)
+                    }
+                }
+
+                ForEach(backupManager.lastServerSearch, id: \.accountEmail) { result in
+                    VStack(alignment: .leading, spacing: 2) {
+                        Text(result.accountEmail)
+                            .font(.caption)
+                        Text(result.summary)
+                            .font(.caption)
+                            .foregroundStyle(result.errors.isEmpty ? Color.secondary : Color.orange)
+                        ForEach(result.matches) { match in
+                            Text("\(match.folder) \(match.uid): \(match.subject)")
+                                .font(.caption2)
+                                .foregroundStyle(.secondary)
+                                .textSelection(.enabled)
+                        }
+                    }
+                }
+            } header: {
+                Text("Server Search")
+            } footer: {
+                Text("Finds messages on the server without downloading them, to decide what to back up. Folders are comma-separated, e.g. INBOX, Sent. Not every server searches message bodies.")
+            }
+
             if !verificationResults.isEmpty {
                 Section("Last Verification Results") {
                     VerificationResultsListView(results: verificationResults)
@@ -228,4 +354,34 @@ struct VerificationSettingsView: View {
         .formStyle(.grouped)
         .padding()
     }
+
+    /// The entered criteria with the dates that are turned on
+    private var serverSearchCriteria: IMAPSearchCriteria {
+        var criteria = searchCriteria
+        criteria.since = useSearchSince ? searchSince : nil
+        criteria.before = useSearchBefore ? searchBefore : nil
+        return criteria
+    }
+
+    /// Binding to a text criterion, empty text leaving it unset
+    private func searchText(_ keyPath: WritableKeyPath<IMAPSearchCriteria, String?>) -> Binding<String> {
+        Binding(
+            get: { searchCriteria[keyPath: keyPath] ?? "" },
+            set: { searchCriteria[keyPath: keyPath] = $0.isEmpty ? nil : $0 }
+        )
+    }
+
+    private func saveDiffs() {
+        let panel = NSSavePanel()
+        panel.nameFieldStringValue = "MailKeep Dry Run.json"
+        panel.canCreateDirectories = true
+
+        guard panel.runModal() == .OK, let url = panel.url else { return }
+
+        do {
+            try BackupDiff.jsonData(backupManager.lastDiffs).write(to: url, options: .atomic)
+        } catch {
+            logError("Failed to save the dry run: \(error.localizedDescription)")
+        }
+    }
 }
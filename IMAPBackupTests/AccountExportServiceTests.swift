@@ -0,0 +1,66 @@
+import XCTest
+@testable import IMAPBackup
+
+final class AccountExportServiceTests: XCTestCase {
+
+    let accounts = [
+        EmailAccount(email: "user@example.com", imapServer: "imap.example.com", username: "user", password: "secret-password"),
+        EmailAccount(email: "me@gmail.com", imapServer: "imap.gmail.com", isEnabled: false, authType: .oauth2)
+    ]
+
+    // MARK: - Text
+
+    func testTextOutput() throws {
+        let output = try AccountExportService.render(accounts, format: .text)
+
+        XCTAssertTrue(output.contains("user@example.com\n"))
+        XCTAssertTrue(output.contains("Server:      imap.example.com:993 (SSL/TLS)"))
+        XCTAssertTrue(output.contains("Auth:        OAuth2"))
+        XCTAssertTrue(output.contains("Enabled:     No"))
+        XCTAssertTrue(output.contains("Last backup: Never"))
+    }
+
+    func testWriteAccountInfoToStream() {
+        var output = ""
+        AccountExportService.writeAccountInfo(accounts[0], to: &output)
+
+        XCTAssertTrue(output.hasPrefix("user@example.com\n"))
+        XCTAssertTrue(output.contains("Username:    user\n"))
+        XCTAssertTrue(output.hasSuffix("Last backup: Never\n"))
+    }
+
+    func testWriteAppendsToExistingOutput() throws {
+        var output = "# accounts\n"
+        try AccountExportService.write(accounts, format: .text, to: &output)
+
+        XCTAssertTrue(output.hasPrefix("# accounts\nuser@example.com\n"))
+        XCTAssertEqual(output, "# accounts\n" + (try AccountExportService.render(accounts, format: .text)))
+    }
+
+    // MARK: - JSON
+
+    func testJSONOutputRoundTrips() throws {
+        let output = try AccountExportService.render(accounts, format: .json)
+
+        let decoder = JSONDecoder()
+        decoder.dateDecodingStrategy = .iso8601
+        let summaries = try decoder.decode([AccountSummary].self, from: Data(output.utf8))
+
+        XCTAssertEqual(summaries, accounts.map(AccountSummary.init))
+        XCTAssertEqual(summaries.map { $0.authType }, [.password, .oauth2])
+    }
+
+    func testPasswordsAreNeverIncluded() throws {
+        for format in AccountListFormat.allCases {
+            let output = try AccountExportService.render(accounts, format: format)
+            XCTAssertFalse(output.contains("secret-password"), "\(format) output leaked a password")
+            XCTAssertFalse(output.lowercased().contains("password\""), "\(format) output has a password field")
+        }
+    }
+
+    func testEmptyList() throws {
+        XCTAssertEqual(try AccountExportService.render([], format: .text), "")
+        let json = try AccountExportService.render([], format: .json)
+        XCTAssertEqual(try JSONDecoder().decode([AccountSummary].self, from: Data(json.utf8)), [])
+    }
+}
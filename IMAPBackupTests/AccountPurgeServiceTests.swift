@@ -0,0 +1,121 @@
+import XCTest
+@testable import IMAPBackup
+
+/// Records deletions instead of touching the Keychain
+actor MockSecretStore: AccountSecretStore {
+    var deletedPasswords: [UUID] = []
+    var deletedOAuthTokens: [UUID] = []
+    var failOAuthDeletion = false
+
+    func removePassword(for accountId: UUID) async throws {
+        deletedPasswords.append(accountId)
+    }
+
+    func removeOAuthTokens(for accountId: UUID) async throws {
+        if failOAuthDeletion {
+            throw KeychainError.deleteFailed(-25300)
+        }
+        deletedOAuthTokens.append(accountId)
+    }
+
+    func setFailOAuthDeletion(_ fail: Bool) {
+        failOAuthDeletion = fail
+    }
+}
+
+final class AccountPurgeServiceTests: XCTestCase {
+
+    var tempDirectory: URL!
+    let account = EmailAccount(email: "user@example.com", imapServer: "imap.example.com")
+
+    override func setUp() async throws {
+        try await super.setUp()
+        tempDirectory = FileManager.default.temporaryDirectory
+            .appendingPathComponent("AccountPurgeServiceTests_\(UUID().uuidString)")
+        try FileManager.default.createDirectory(at: tempDirectory, withIntermediateDirectories: true)
+    }
+
+    override func tearDown() async throws {
+        try? FileManager.default.removeItem(at: tempDirectory)
+        try await super.tearDown()
+    }
+
+    // MARK: - Secrets
+
+    func testPurgeDeletesPasswordAndTokens() async {
+        let store = MockSecretStore()
+        let result = await AccountPurgeService.purgeSecrets(of: account, store: store)
+
+        XCTAssertTrue(result.removedPassword)
+        XCTAssertTrue(result.removedOAuthTokens)
+        XCTAssertTrue(result.errors.isEmpty)
+
+        let passwords = await store.deletedPasswords
+        let tokens = await store.deletedOAuthTokens
+        XCTAssertEqual(passwords, [account.id])
+        XCTAssertEqual(tokens, [account.id])
+    }
+
+    func testPurgeContinuesWhenTokenDeletionFails() async {
+        let store = MockSecretStore()
+        await store.setFailOAuthDeletion(true)
+
+        let result = await AccountPurgeService.purgeSecrets(of: account, store: store)
+
+        XCTAssertTrue(result.removedPassword)
+        XCTAssertFalse(result.removedOAuthTokens)
+        XCTAssertEqual(result.errors.count, 1)
+        XCTAssertTrue(result.errors[0].hasPrefix("OAuth tokens:"))
+    }
+
+    // MARK: - Backup Directory
+
+    func testRemovesBackupDirectoryInsideLocation() throws {
+        let accountURL = tempDirectory.appendingPathComponent("user_example.com")
+        try FileManager.default.createDirectory(at: accountURL.appendingPathComponent("INBOX"), withIntermediateDirectories: true)
+        let otherURL = tempDirectory.appendingPathComponent("other_example.com")
+        try FileManager.default.createDirectory(at: otherURL, withIntermediateDirectories: true)
+
+        let removed = try AccountPurgeService.removeBackupDirectory(for: account, in: tempDirectory, mode: .confirmed)
+
+        XCTAssertEqual(removed?.lastPathComponent, "user_example.com")
+        XCTAssertFalse(FileManager.default.fileExists(atPath: accountURL.path))
+        XCTAssertTrue(FileManager.default.fileExists(atPath: otherURL.path))
+    }
+
+    func testRemovingBackupDirectoryIsDryRunByDefault() throws {
+        let accountURL = tempDirectory.appendingPathComponent("user_example.com")
+        try FileManager.default.createDirectory(at: accountURL.appendingPathComponent("INBOX"), withIntermediateDirectories: true)
+        try Data("Subject: Hi\r\n\r\nBody".utf8).write(to: accountURL.appendingPathComponent("INBOX/1_hi.eml"))
+
+        let plan = try AccountPurgeService.backupDeletionPlan(for: account, in: tempDirectory)
+        XCTAssertEqual(plan.counts, ["file": 1])
+        XCTAssertGreaterThan(plan.bytes, 0)
+
+        XCTAssertNotNil(try AccountPurgeService.removeBackupDirectory(for: account, in: tempDirectory))
+        XCTAssertTrue(FileManager.default.fileExists(atPath: accountURL.appendingPathComponent("INBOX/1_hi.eml").path))
+    }
+
+    func testMissingBackupDirectoryIsNotAnError() throws {
+        XCTAssertNil(try AccountPurgeService.removeBackupDirectory(for: account, in: tempDirectory))
+    }
+
+    func testRefusesDirectorySymlinkedOutsideLocation() throws {
+        let outsideURL = FileManager.default.temporaryDirectory
+            .appendingPathComponent("AccountPurgeServiceTests_outside_\(UUID().uuidString)")
+        try FileManager.default.createDirectory(at: outsideURL, withIntermediateDirectories: true)
+        defer { try? FileManager.default.removeItem(at: outsideURL) }
+
+        try FileManager.default.createSymbolicLink(
+            at: tempDirectory.appendingPathComponent("user_example.com"),
+            withDestinationURL: outsideURL
+        )
+
+        XCTAssertThrowsError(try AccountPurgeService.removeBackupDirectory(for: account, in: tempDirectory, mode: .confirmed)) { error in
+            guard case DeletionError.outsideBackupLocation = error else {
+                return XCTFail("Unexpected error: \(error)")
+            }
+        }
+        XCTAssertTrue(FileManager.default.fileExists(atPath: outsideURL.path))
+    }
+}
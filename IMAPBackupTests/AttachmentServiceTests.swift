@@ -261,6 +261,84 @@ final class AttachmentServiceTests: XCTestCase {
         XCTAssertTrue(attachments[0].filename.contains("ber") || attachments[0].filename.contains("Über"))
     }
 
+    /// Filename of the one attachment of an email whose attachment part has `partHeaders`
+    private func extractedFilename(partHeaders: String) async -> String? {
+        let email = [
+            "From: sender@example.com",
+            "Subject: Encoded filename",
+            "MIME-Version: 1.0",
+            "Content-Type: multipart/mixed; boundary=\"XYZ\"",
+            "",
+            "--XYZ",
+            partHeaders,
+            "Content-Transfer-Encoding: base64",
+            "",
+            Data("content".utf8).base64EncodedString(),
+            "--XYZ--"
+        ].joined(separator: "\r\n")
+
+        return await attachmentService.extractAttachments(from: Data(email.utf8)).first?.filename
+    }
+
+    func testRFC2047FilenamesInGermanAndJapanese() async {
+        let german = await extractedFilename(partHeaders: "Content-Disposition: attachment; filename=\"=?ISO-8859-1?Q?Gr=FC=DFe.txt?=\"")
+        XCTAssertEqual(german, "Grüße.txt")
+
+        // A long name split over two encoded words, on a folded line; the whitespace between them is dropped
+        let japanese = await extractedFilename(partHeaders: "Content-Disposition: attachment;\r\n filename=\"=?UTF-8?B?5aCx5ZGK?=\r\n =?UTF-8?B?5pu4LnBkZg==?=\"")
+        XCTAssertEqual(japanese, "報告書.pdf")
+
+        let iso2022 = await extractedFilename(partHeaders: "Content-Type: application/vnd.ms-excel; name=\"=?ISO-2022-JP?B?GyRCMnE1RDtxTkEbKEIueGxzeA==?=\"\r\nContent-Disposition: attachment")
+        XCTAssertEqual(iso2022, "会議資料.xlsx")
+    }
+
+    // MARK: - RFC 2231 Filename Tests
+
+    func testRFC2231ExtendedFilenamesInGermanAndJapanese() async {
+        let utf8 = await extractedFilename(partHeaders: "Content-Disposition: attachment; filename*=UTF-8''%C3%9Cbersicht%20M%C3%A4rz.pdf")
+        XCTAssertEqual(utf8, "Übersicht März.pdf")
+
+        let latin1 = await extractedFilename(partHeaders: "Content-Disposition: attachment; filename*=iso-8859-1'de'%DCbersicht.pdf")
+        XCTAssertEqual(latin1, "Übersicht.pdf")
+
+        let shiftJIS = await extractedFilename(partHeaders: "Content-Disposition: attachment; filename*=Shift_JIS'ja'%95%F1%8D%90%8F%91.pdf")
+        XCTAssertEqual(shiftJIS, "報告書.pdf")
+    }
+
+    func testRFC2231ContinuationsOnFoldedLines() async {
+        // Sections may mix encoded and plain parts and arrive out of order; only section 0 names the charset
+        let headers = [
+            "Content-Type: application/pdf",
+            "Content-Disposition: attachment;",
+            " filename*1*=%E6%9B%B8;",
+            " filename*0*=UTF-8''%E5%A0%B1%E5%91%8A;",
+            " filename*2=\".pdf\";",
+            " size=7"
+        ].joined(separator: "\r\n")
+
+        let filename = await extractedFilename(partHeaders: headers)
+
+        XCTAssertEqual(filename, "報告書.pdf")
+    }
+
+    func testExtendedFilenameWinsOverPlainFallback() async {
+        let filename = await extractedFilename(
+            partHeaders: "Content-Disposition: attachment; filename=\"Ubersicht.pdf\"; filename*=UTF-8''%C3%9Cbersicht.pdf"
+        )
+
+        XCTAssertEqual(filename, "Übersicht.pdf")
+    }
+
+    func testHeaderParameterParsing() {
+        let header = #"attachment; filename="a; \"b\".txt"; creation-date="Mon, 20 Jan 2026""#
+        XCTAssertEqual(MIMEDecoding.headerParameter("filename", in: header), #"a; "b".txt"#)
+        XCTAssertEqual(MIMEDecoding.headerParameter("FILENAME", in: "attachment; FileName=plain.txt"), "plain.txt")
+        XCTAssertNil(MIMEDecoding.headerParameter("name", in: header))
+        // A gap in the sections ends the name; bytes that fit no charset keep their readable part
+        XCTAssertEqual(MIMEDecoding.headerParameter("filename", in: "x; filename*0=abc; filename*2=def"), "abc")
+        XCTAssertEqual(MIMEDecoding.headerParameter("filename", in: "x; filename*=utf-8''caf%FF.txt"), "caf\u{FFFD}.txt")
+    }
+
     // MARK: - Save Attachments Tests
 
     func testSaveAttachments() async throws {
@@ -315,6 +393,419 @@ final class AttachmentServiceTests: XCTestCase {
         }
     }
 
+    func testSaveAttachmentsRecordsChecksums() async throws {
+        let emailURL = tempDirectory.appendingPathComponent("7_20260120_100000_Sender.eml")
+        let attachments = [
+            AttachmentService.Attachment(filename: "doc.pdf", contentType: "application/pdf", data: Data("PDF content".utf8)),
+            AttachmentService.Attachment(filename: "doc.pdf", contentType: "application/pdf", data: Data("Other".utf8))
+        ]
+
+        let metadata = try await attachmentService.saveAttachments(attachments, for: emailURL)
+
+        XCTAssertEqual(metadata.map(\.filename), ["doc.pdf", "doc_1.pdf"])
+        XCTAssertEqual(metadata[0].size, 11)
+        XCTAssertEqual(metadata[0].sha256, AttachmentMetadata.checksum(of: Data("PDF content".utf8)))
+        XCTAssertEqual(metadata[0].sha256.count, 64)
+
+        let data = try Data(contentsOf: tempDirectory.appendingPathComponent("7_20260120_100000_Sender.attachments.json"))
+        XCTAssertEqual(try JSONDecoder().decode([AttachmentMetadata].self, from: data), metadata)
+        XCTAssertEqual(AttachmentService.verifyAttachments(for: emailURL), [])
+    }
+
+    func testOverwrittenAttachmentIsRecordedOnceWithItsFileContents() async throws {
+        let emailURL = tempDirectory.appendingPathComponent("10_20260120_100000_Sender.eml")
+        let attachments = [
+            AttachmentService.Attachment(filename: "doc.pdf", contentType: "application/pdf", data: Data("First".utf8)),
+            AttachmentService.Attachment(filename: "doc.pdf", contentType: "application/pdf", data: Data("Second".utf8))
+        ]
+
+        let metadata = try await attachmentService.saveAttachments(attachments, for: emailURL, strategy: .overwrite)
+
+        XCTAssertEqual(metadata.map(\.filename), ["doc.pdf"])
+        XCTAssertEqual(metadata.first?.sha256, AttachmentMetadata.checksum(of: Data("Second".utf8)))
+        XCTAssertEqual(AttachmentService.verifyAttachments(for: emailURL), [])
+    }
+
+    func testKeptAttachmentIsRecordedWithTheFileOnDisk() async throws {
+        let emailURL = tempDirectory.appendingPathComponent("11_20260120_100000_Sender.eml")
+        let content = Data("Same".utf8)
+        let folderURL = AttachmentMetadata.folderURL(for: emailURL)
+        try FileManager.default.createDirectory(at: folderURL, withIntermediateDirectories: true)
+        try content.write(to: folderURL.appendingPathComponent("kept.txt"))
+
+        // Both are identical to the file already there
+        let attachments = [
+            AttachmentService.Attachment(filename: "copy.txt", contentType: "text/plain", data: content),
+            AttachmentService.Attachment(filename: "again.txt", contentType: "text/plain", data: content)
+        ]
+        let metadata = try await attachmentService.saveAttachments(attachments, for: emailURL, strategy: .contentHash)
+
+        XCTAssertEqual(metadata.map(\.filename), ["kept.txt"])
+        XCTAssertEqual(metadata.first?.size, content.count)
+        XCTAssertEqual(AttachmentService.verifyAttachments(for: emailURL), [])
+    }
+
+    func testVerifyAttachmentsDetectsTamperedByte() async throws {
+        let emailURL = tempDirectory.appendingPathComponent("8_20260120_100000_Sender.eml")
+        let attachments = [
+            AttachmentService.Attachment(filename: "a.txt", contentType: "text/plain", data: Data("abcdef".utf8)),
+            AttachmentService.Attachment(filename: "b.txt", contentType: "text/plain", data: Data("123456".utf8))
+        ]
+        try await attachmentService.saveAttachments(attachments, for: emailURL)
+
+        // Flip one byte without changing the size
+        let folderURL = AttachmentMetadata.folderURL(for: emailURL)
+        let tamperedURL = folderURL.appendingPathComponent("a.txt")
+        var bytes = try Data(contentsOf: tamperedURL)
+        bytes[2] ^= 0x01
+        try bytes.write(to: tamperedURL)
+
+        try FileManager.default.removeItem(at: folderURL.appendingPathComponent("b.txt"))
+
+        let issues = AttachmentService.verifyAttachments(for: emailURL)
+        XCTAssertEqual(issues.map(\.kind), [.checksumMismatch, .missing])
+        XCTAssertEqual(issues.first?.fileURL.lastPathComponent, "a.txt")
+    }
+
+    func testVerifyAttachmentsWithoutMetadata() {
+        let emailURL = tempDirectory.appendingPathComponent("9_20260120_100000_Sender.eml")
+        XCTAssertEqual(AttachmentService.verifyAttachments(for: emailURL), [])
+    }
+
+    // MARK: - Skip Rules Tests
+
+    func testSkipRulesDropTrackingImagesAndSignatures() async throws {
+        let emailURL = tempDirectory.appendingPathComponent("10_20260120_100000_Sender.eml")
+        let attachments = [
+            AttachmentService.Attachment(filename: "pixel.gif", contentType: "image/gif", data: Data("GIF89a".utf8)),
+            AttachmentService.Attachment(filename: "report.pdf", contentType: "application/pdf", data: Data("PDF content".utf8)),
+            AttachmentService.Attachment(filename: "smime.p7s", contentType: "application/pkcs7-signature", data: Data("sig".utf8))
+        ]
+        let rules = AttachmentSkipRules(contentTypes: ["image/*"], filenames: ["*.P7S"])
+
+        let metadata = try await attachmentService.saveAttachments(attachments, for: emailURL, skipRules: rules)
+
+        let folderURL = AttachmentMetadata.folderURL(for: emailURL)
+        XCTAssertEqual(try FileManager.default.contentsOfDirectory(atPath: folderURL.path), ["report.pdf"])
+
+        // Skipped parts are still recorded, with the rule that matched
+        XCTAssertEqual(metadata.map(\.filename), ["pixel.gif", "report.pdf", "smime.p7s"])
+        XCTAssertEqual(metadata.map(\.skipReason), ["content type matches image/*", nil, "filename matches *.P7S"])
+        XCTAssertEqual(metadata[0].size, 6)
+
+        // Verification does not report skipped parts as missing
+        XCTAssertEqual(AttachmentService.verifyAttachments(for: emailURL), [])
+    }
+
+    func testMetadataWithoutSkipReasonStillDecodes() throws {
+        let data = Data(#"[{"filename":"a.txt","size":3,"sha256":"abc"}]"#.utf8)
+        let metadata = try JSONDecoder().decode([AttachmentMetadata].self, from: data)
+
+        XCTAssertEqual(metadata, [AttachmentMetadata(filename: "a.txt", size: 3, sha256: "abc")])
+        XCTAssertNil(metadata[0].skipReason)
+        XCTAssertNil(metadata[0].contentType)
+    }
+
+    func testFilenameOnlyMetadataStillDecodes() throws {
+        let emailURL = tempDirectory.appendingPathComponent("11_20260120_100000_Sender.eml")
+        let folderURL = AttachmentMetadata.folderURL(for: emailURL)
+        try FileManager.default.createDirectory(at: folderURL, withIntermediateDirectories: true)
+        try Data("abc".utf8).write(to: folderURL.appendingPathComponent("a.txt"))
+        try Data(#"["a.txt","b.txt"]"#.utf8).write(to: AttachmentMetadata.sidecarURL(for: emailURL))
+
+        let data = try Data(contentsOf: AttachmentMetadata.sidecarURL(for: emailURL))
+        let metadata = try JSONDecoder().decode([AttachmentMetadata].self, from: data)
+        XCTAssertEqual(metadata.map(\.filename), ["a.txt", "b.txt"])
+        XCTAssertFalse(metadata[0].hasChecksum)
+        XCTAssertNil(metadata[0].contentType)
+
+        // Only existence can be checked for these
+        let issues = AttachmentService.verifyAttachments(for: emailURL)
+        XCTAssertEqual(issues.map(\.kind), [.missing])
+        XCTAssertEqual(issues.first?.fileURL.lastPathComponent, "b.txt")
+    }
+
+    func testMetadataRoundTripsAllFields() throws {
+        let metadata = [AttachmentMetadata(filename: "a.pdf", data: Data("PDF".utf8), contentType: "application/pdf")]
+
+        let decoded = try JSONDecoder().decode([AttachmentMetadata].self, from: JSONEncoder().encode(metadata))
+
+        XCTAssertEqual(decoded, metadata)
+        XCTAssertEqual(decoded[0].contentType, "application/pdf")
+        XCTAssertEqual(decoded[0].size, 3)
+        XCTAssertTrue(decoded[0].hasChecksum)
+        XCTAssertEqual(decoded[0].risk, .safe)
+    }
+
+    // MARK: - Risk Classification
+
+    func testSafeAttachmentTypes() {
+        XCTAssertEqual(AttachmentRisk.classify(filename: "invoice.pdf", contentType: "application/pdf"), .safe)
+        XCTAssertEqual(AttachmentRisk.classify(filename: "Photo.JPG", contentType: "image/jpeg"), .safe)
+        XCTAssertEqual(AttachmentRisk.classify(filename: "notes.txt", contentType: "text/plain; charset=utf-8"), .safe)
+        XCTAssertEqual(AttachmentRisk.classify(filename: "report.docx", contentType: "application/octet-stream"), .safe)
+        XCTAssertEqual(AttachmentRisk.classify(filename: "budget.xlsx", contentType: nil), .safe)
+    }
+
+    func testDangerousAttachmentTypes() {
+        XCTAssertEqual(AttachmentRisk.classify(filename: "setup.exe", contentType: "application/octet-stream"), .dangerous)
+        XCTAssertEqual(AttachmentRisk.classify(filename: "screensaver.scr", contentType: nil), .dangerous)
+        XCTAssertEqual(AttachmentRisk.classify(filename: "update.js", contentType: "application/javascript"), .dangerous)
+        XCTAssertEqual(AttachmentRisk.classify(filename: "invoice.xlsm", contentType: nil), .dangerous)
+        XCTAssertEqual(
+            AttachmentRisk.classify(filename: "invoice.docx", contentType: "application/vnd.ms-word.document.macroEnabled.12"),
+            .dangerous
+        )
+    }
+
+    func testDisguisedAttachmentsAreDangerous() {
+        // Only the last extension counts, and a dangerous content type overrides a harmless name
+        XCTAssertEqual(AttachmentRisk.classify(filename: "invoice.pdf.exe", contentType: "application/pdf"), .dangerous)
+        XCTAssertEqual(AttachmentRisk.classify(filename: "invoice.pdf", contentType: "application/x-msdownload"), .dangerous)
+    }
+
+    func testUnknownAndContainerTypesNeedCaution() {
+        XCTAssertEqual(AttachmentRisk.classify(filename: "archive.zip", contentType: "application/zip"), .caution)
+        XCTAssertEqual(AttachmentRisk.classify(filename: "drawing.svg", contentType: "image/svg+xml"), .caution)
+        XCTAssertEqual(AttachmentRisk.classify(filename: "photo.jpg", contentType: "text/html"), .caution)
+        XCTAssertEqual(AttachmentRisk.classify(filename: "noextension", contentType: nil), .caution)
+    }
+
+    func testMetadataRecordsRisk() throws {
+        let metadata = AttachmentMetadata(filename: "tool.exe", data: Data("MZ".utf8), contentType: "application/octet-stream")
+        XCTAssertEqual(metadata.risk, .dangerous)
+
+        let json = String(decoding: try JSONEncoder().encode(metadata), as: UTF8.self)
+        XCTAssertTrue(json.contains(#""risk":"dangerous""#))
+
+        // Metadata from before risks were recorded is classified when read
+        let old = Data(#"{"filename":"run.bat","size":3,"sha256":"abc"}"#.utf8)
+        XCTAssertEqual(try JSONDecoder().decode(AttachmentMetadata.self, from: old).risk, .dangerous)
+    }
+
+    // MARK: - Content Type Statistics
+
+    func testStatsBreakDownAttachmentsByContentType() async throws {
+        let folderURL = tempDirectory.appendingPathComponent("INBOX")
+        try FileManager.default.createDirectory(at: folderURL, withIntermediateDirectories: true)
+
+        let first = folderURL.appendingPathComponent("1_20260120_100000_Sender.eml")
+        let second = folderURL.appendingPathComponent("2_20260121_100000_Sender.eml")
+        try Data("Subject: One".utf8).write(to: first)
+        try Data("Subject: Two".utf8).write(to: second)
+
+        try await attachmentService.saveAttachments([
+            AttachmentService.Attachment(filename: "a.pdf", contentType: "application/pdf", data: Data(count: 100)),
+            AttachmentService.Attachment(filename: "photo.jpg", contentType: "image/jpeg", data: Data(count: 40))
+        ], for: first)
+        try await attachmentService.saveAttachments([
+            AttachmentService.Attachment(filename: "b.pdf", contentType: "Application/PDF", data: Data(count: 50)),
+            AttachmentService.Attachment(filename: "archive.zip", contentType: "application/zip", data: Data(count: 10)),
+            AttachmentService.Attachment(filename: "pixel.gif", contentType: "image/gif", data: Data(count: 5))
+        ], for: second, skipRules: AttachmentSkipRules(contentTypes: ["image/gif"]))
+
+        let stats = BackupManager.calculateStatsAtDirectory(tempDirectory)
+
+        XCTAssertEqual(stats.totalEmails, 2)
+        XCTAssertEqual(stats.attachmentTypes["application/pdf"], BackupManager.AttachmentTypeTotals(count: 2, size: 150))
+        XCTAssertEqual(stats.attachmentTypes["image/jpeg"], BackupManager.AttachmentTypeTotals(count: 1, size: 40))
+        XCTAssertEqual(stats.attachmentTypes["application/zip"], BackupManager.AttachmentTypeTotals(count: 1, size: 10))
+        // Skipped attachments are not in the archive
+        XCTAssertNil(stats.attachmentTypes["image/gif"])
+        XCTAssertEqual(stats.attachmentTypesBySize.map(\.contentType), ["application/pdf", "image/jpeg", "application/zip"])
+    }
+
+    func testStatsCountMetadataWithoutContentTypeAsUnknown() throws {
+        let emailURL = tempDirectory.appendingPathComponent("3_20260122_100000_Sender.eml")
+        try Data("Subject: Old".utf8).write(to: emailURL)
+        try Data(#"[{"filename":"a.txt","size":3,"sha256":"abc"}]"#.utf8)
+            .write(to: AttachmentMetadata.sidecarURL(for: emailURL))
+
+        let stats = BackupManager.calculateStatsAtDirectory(tempDirectory)
+
+        XCTAssertEqual(stats.attachmentTypes, ["unknown": BackupManager.AttachmentTypeTotals(count: 1, size: 3)])
+    }
+
+    func testStatsStopWhenCancelled() async throws {
+        for uid in 1...20 {
+            try Data("Subject: \(uid)".utf8)
+                .write(to: tempDirectory.appendingPathComponent("\(uid)_20260120_100000_Sender.eml"))
+        }
+        let directory = tempDirectory!
+
+        let cancelled = await Task {
+            withUnsafeCurrentTask { $0?.cancel() }
+            return BackupManager.calculateStatsAtDirectory(directory)
+        }.value
+
+        XCTAssertEqual(cancelled.totalEmails, 0)
+        XCTAssertEqual(BackupManager.calculateStatsAtDirectory(directory).totalEmails, 20)
+    }
+
+    func testParseSkipPatterns() {
+        XCTAssertEqual(AttachmentSkipRules.parsePatterns(" image/*, ,*.p7s\nsmime.p7m "), ["image/*", "*.p7s", "smime.p7m"])
+        XCTAssertTrue(AttachmentSkipRules().isEmpty)
+    }
+
+    func testSizeLimitSkipsOnlyLargeAttachments() async throws {
+        let emailURL = tempDirectory.appendingPathComponent("12_20260120_100000_Sender.eml")
+        let attachments = [
+            AttachmentService.Attachment(filename: "small.pdf", contentType: "application/pdf", data: Data(count: 1000)),
+            AttachmentService.Attachment(filename: "video.mov", contentType: "video/quicktime", data: Data(count: 5000)),
+            AttachmentService.Attachment(filename: "exact.txt", contentType: "text/plain", data: Data(count: 2048))
+        ]
+        let rules = AttachmentSkipRules(maxSizeBytes: try XCTUnwrap(AttachmentSkipRules.parseSize("2KB")))
+        XCTAssertFalse(rules.isEmpty)
+
+        let metadata = try await attachmentService.saveAttachments(attachments, for: emailURL, skipRules: rules)
+
+        let folderURL = AttachmentMetadata.folderURL(for: emailURL)
+        XCTAssertEqual(try FileManager.default.contentsOfDirectory(atPath: folderURL.path).sorted(), ["exact.txt", "small.pdf"])
+        XCTAssertEqual(metadata.map(\.skipped), [false, true, false])
+        XCTAssertEqual(metadata[1].size, 5000)
+        XCTAssertEqual(metadata[1].skipReason?.hasPrefix("larger than"), true)
+
+        // The sidecar marks the skipped attachment and keeps its size
+        let sidecar = try JSONSerialization.jsonObject(with: Data(contentsOf: AttachmentMetadata.sidecarURL(for: emailURL))) as? [[String: Any]]
+        XCTAssertEqual(sidecar?[1]["skipped"] as? Bool, true)
+        XCTAssertEqual(sidecar?[1]["size"] as? Int, 5000)
+        XCTAssertNil(sidecar?[0]["skipped"])
+
+        let decoded = try JSONDecoder().decode([AttachmentMetadata].self, from: Data(contentsOf: AttachmentMetadata.sidecarURL(for: emailURL)))
+        XCTAssertEqual(decoded, metadata)
+        XCTAssertEqual(AttachmentService.verifyAttachments(for: emailURL), [])
+    }
+
+    func testParseSize() {
+        XCTAssertEqual(AttachmentSkipRules.parseSize("10MB"), 10 * 1024 * 1024)
+        XCTAssertEqual(AttachmentSkipRules.parseSize("500 kb"), 500 * 1024)
+        XCTAssertEqual(AttachmentSkipRules.parseSize("1.5G"), 1536 * 1024 * 1024)
+        XCTAssertEqual(AttachmentSkipRules.parseSize("2048"), 2048)
+        XCTAssertNil(AttachmentSkipRules.parseSize("ten MB"))
+        XCTAssertNil(AttachmentSkipRules.parseSize("10 XB"))
+    }
+
+    func testSkipRulesSavedBeforeSizeLimitStillDecode() throws {
+        let data = Data(#"{"contentTypes":["image/*"],"filenames":[]}"#.utf8)
+        let rules = try JSONDecoder().decode(AttachmentSkipRules.self, from: data)
+
+        XCTAssertEqual(rules, AttachmentSkipRules(contentTypes: ["image/*"]))
+    }
+
+    // MARK: - Dedup Strategy Tests
+
+    private func attachment(_ filename: String, _ content: String) -> AttachmentService.Attachment {
+        AttachmentService.Attachment(filename: filename, contentType: "text/plain", data: Data(content.utf8))
+    }
+
+    private func visibleFiles() throws -> [String] {
+        try FileManager.default.contentsOfDirectory(atPath: tempDirectory.path).filter { !$0.hasPrefix(".") }.sorted()
+    }
+
+    func testRenameStrategyKeepsBothCopies() async throws {
+        let urls = try await attachmentService.saveAttachments(
+            [attachment("a.txt", "same"), attachment("a.txt", "same"), attachment("a.txt", "other")],
+            to: tempDirectory,
+            strategy: .rename
+        )
+
+        XCTAssertEqual(urls.map(\.lastPathComponent), ["a.txt", "a_1.txt", "a_2.txt"])
+        XCTAssertEqual(try visibleFiles(), ["a.txt", "a_1.txt", "a_2.txt"])
+    }
+
+    func testSkipIdenticalStrategy() async throws {
+        let urls = try await attachmentService.saveAttachments(
+            [attachment("a.txt", "same"), attachment("a.txt", "same"), attachment("a.txt", "other")],
+            to: tempDirectory,
+            strategy: .skipIdentical
+        )
+
+        // Identical content reuses the file, differing content is renamed
+        XCTAssertEqual(urls.map(\.lastPathComponent), ["a.txt", "a.txt", "a_1.txt"])
+        XCTAssertEqual(try visibleFiles(), ["a.txt", "a_1.txt"])
+        XCTAssertEqual(try String(contentsOf: urls[2], encoding: .utf8), "other")
+    }
+
+    func testOverwriteStrategy() async throws {
+        let urls = try await attachmentService.saveAttachments(
+            [attachment("a.txt", "first"), attachment("a.txt", "first"), attachment("a.txt", "second")],
+            to: tempDirectory,
+            strategy: .overwrite
+        )
+
+        XCTAssertEqual(Set(urls.map(\.lastPathComponent)), ["a.txt"])
+        XCTAssertEqual(try visibleFiles(), ["a.txt"])
+        XCTAssertEqual(try String(contentsOf: urls[0], encoding: .utf8), "second")
+    }
+
+    func testContentHashStrategy() async throws {
+        let urls = try await attachmentService.saveAttachments(
+            [attachment("a.txt", "same"), attachment("b.txt", "same"), attachment("a.txt", "other")],
+            to: tempDirectory,
+            strategy: .contentHash
+        )
+
+        // Same content under another name is not stored again; a name clash with new content is renamed
+        XCTAssertEqual(urls.map(\.lastPathComponent), ["a.txt", "a.txt", "a_1.txt"])
+        XCTAssertEqual(try visibleFiles(), ["a.txt", "a_1.txt"])
+    }
+
+    // MARK: - Concurrent Writes
+
+    func testConcurrentWritesLandWithoutCollisions() async throws {
+        // Many same-named attachments, some repeated, written 8 at a time
+        let attachments = (0..<60).map { index in
+            AttachmentService.Attachment(
+                filename: index % 3 == 0 ? "scan.pdf" : "photo \(index % 10).jpg",
+                contentType: "application/octet-stream",
+                data: Data(repeating: UInt8(index % 20), count: 64 * 1024)
+            )
+        }
+
+        let urls = try await attachmentService.saveAttachments(attachments, to: tempDirectory, strategy: .rename, maxConcurrentWrites: 8)
+
+        XCTAssertEqual(urls.count, 60)
+        XCTAssertEqual(Set(urls).count, 60)
+        XCTAssertEqual(try visibleFiles().count, 60)
+        XCTAssertFalse(try visibleFiles().contains { $0.hasSuffix(".tmp") })
+        for (attachment, url) in zip(attachments, urls) {
+            XCTAssertEqual(try Data(contentsOf: url), attachment.data)
+        }
+    }
+
+    func testConcurrentContentHashWritesEachContentOnce() async throws {
+        let attachments = (0..<40).map { index in
+            attachment("file\(index).txt", "content \(index % 5)")
+        }
+
+        let urls = try await attachmentService.saveAttachments(attachments, to: tempDirectory, strategy: .contentHash, maxConcurrentWrites: 8)
+
+        // Only the first attachment with each content is written, the rest point at it
+        XCTAssertEqual(try visibleFiles(), ["file0.txt", "file1.txt", "file2.txt", "file3.txt", "file4.txt"])
+        XCTAssertEqual(urls.map(\.lastPathComponent), (0..<40).map { "file\($0 % 5).txt" })
+    }
+
+    func testConcurrentOverwriteKeepsLastAttachment() async throws {
+        let attachments = (0..<20).map { attachment("a.txt", "version \($0)") }
+
+        let urls = try await attachmentService.saveAttachments(attachments, to: tempDirectory, strategy: .overwrite, maxConcurrentWrites: 8)
+
+        XCTAssertEqual(Set(urls.map(\.lastPathComponent)), ["a.txt"])
+        XCTAssertEqual(try visibleFiles(), ["a.txt"])
+        XCTAssertEqual(try String(contentsOf: urls[0], encoding: .utf8), "version 19")
+    }
+
+    func testDedupStrategyDefaultsToRenameForOldSettings() throws {
+        let data = Data(#"{"isEnabled":true,"createSubfolderPerEmail":false}"#.utf8)
+        let settings = try JSONDecoder().decode(AttachmentExtractionSettings.self, from: data)
+
+        XCTAssertTrue(settings.isEnabled)
+        XCTAssertFalse(settings.createSubfolderPerEmail)
+        XCTAssertEqual(settings.dedupStrategy, .rename)
+        XCTAssertEqual(AttachmentExtractionSettings().dedupStrategy, .rename)
+        XCTAssertTrue(settings.skipRules.isEmpty)
+    }
+
     func testSaveAttachmentsCreatesDirectory() async throws {
         let nonExistentDir = tempDirectory.appendingPathComponent("newdir")
 
@@ -333,6 +824,96 @@ final class AttachmentServiceTests: XCTestCase {
         XCTAssertTrue(FileManager.default.fileExists(atPath: savedURLs[0].path))
     }
 
+    // MARK: - Backup Extraction Tests
+
+    private func createMultiAttachmentEmail(filenames: [String]) -> Data {
+        let boundary = "----=_Part_1_24680"
+        var email = """
+        From: sender@example.com
+        Subject: Fixtures
+        MIME-Version: 1.0
+        Content-Type: multipart/mixed; boundary="\(boundary)"
+
+        --\(boundary)
+        Content-Type: text/plain; charset=utf-8
+
+        Body text.
+
+        """
+        for (index, filename) in filenames.enumerated() {
+            email += """
+            --\(boundary)
+            Content-Type: application/octet-stream; name="\(filename)"
+            Content-Disposition: attachment; filename="\(filename)"
+            Content-Transfer-Encoding: base64
+
+            \(Data("content\(index)".utf8).base64EncodedString())
+
+            """
+        }
+        email += "--\(boundary)--\n"
+        return email.data(using: .utf8)!
+    }
+
+    func testExtractAttachmentsInBackup() async throws {
+        let backupURL = tempDirectory.appendingPathComponent("backup")
+        let inboxURL = backupURL.appendingPathComponent("user_example.com/INBOX")
+        let workURL = backupURL.appendingPathComponent("user_example.com/Work")
+        try FileManager.default.createDirectory(at: inboxURL, withIntermediateDirectories: true)
+        try FileManager.default.createDirectory(at: workURL, withIntermediateDirectories: true)
+
+        try createMultiAttachmentEmail(filenames: ["a.pdf", "b.png"])
+            .write(to: inboxURL.appendingPathComponent("1_20260120_100000_Sender.eml"))
+        // Same name twice plus a name needing sanitization
+        try createMultiAttachmentEmail(filenames: ["report.pdf", "report.pdf", "my: file?.txt"])
+            .write(to: workURL.appendingPathComponent("2_20260120_110000_Sender.eml"))
+        try "From: a@example.com\nSubject: plain\n\nNo attachments".data(using: .utf8)!
+            .write(to: workURL.appendingPathComponent("3_20260120_120000_Sender.eml"))
+
+        let outputURL = tempDirectory.appendingPathComponent("attachments")
+        let manifest = try await attachmentService.extractAttachments(inBackup: backupURL, to: outputURL)
+
+        XCTAssertEqual(manifest.emailsScanned, 3)
+        XCTAssertEqual(manifest.attachments.count, 5)
+
+        let workEntries = manifest.attachments.filter { $0.emailPath == "user_example.com/Work/2_20260120_110000_Sender.eml" }
+        XCTAssertEqual(workEntries.map { $0.filename }, ["report.pdf", "report.pdf", "my: file?.txt"])
+        XCTAssertEqual(Set(workEntries.map { $0.attachmentPath }).count, 3)
+        for entry in manifest.attachments {
+            XCTAssertTrue(entry.attachmentPath.hasPrefix("user_example.com/"))
+            XCTAssertTrue(FileManager.default.fileExists(atPath: outputURL.appendingPathComponent(entry.attachmentPath).path))
+            XCTAssertFalse(entry.attachmentPath.contains(" "))
+        }
+
+        // Manifest is written and decodable
+        let manifestData = try Data(contentsOf: outputURL.appendingPathComponent("manifest.json"))
+        let decoder = JSONDecoder()
+        decoder.dateDecodingStrategy = .iso8601
+        let decoded = try decoder.decode(AttachmentManifest.self, from: manifestData)
+        XCTAssertEqual(decoded.attachments, manifest.attachments)
+        XCTAssertTrue(decoded.attachments.allSatisfy { $0.risk == .safe })
+    }
+
+    func testExtractAttachmentsInBackupIsIdempotent() async throws {
+        let backupURL = tempDirectory.appendingPathComponent("backup")
+        let inboxURL = backupURL.appendingPathComponent("user_example.com/INBOX")
+        try FileManager.default.createDirectory(at: inboxURL, withIntermediateDirectories: true)
+        try createMultiAttachmentEmail(filenames: ["a.pdf", "b.png"])
+            .write(to: inboxURL.appendingPathComponent("1_20260120_100000_Sender.eml"))
+
+        // Output inside the backup must not be scanned
+        let outputURL = backupURL.appendingPathComponent("extracted")
+        let first = try await attachmentService.extractAttachments(inBackup: backupURL, to: outputURL)
+        let second = try await attachmentService.extractAttachments(inBackup: backupURL, to: outputURL)
+
+        XCTAssertEqual(first.attachments, second.attachments)
+        XCTAssertEqual(second.emailsScanned, 1)
+
+        let folderURL = outputURL.appendingPathComponent("user_example.com/INBOX/1_20260120_100000_Sender_attachments")
+        let files = try FileManager.default.contentsOfDirectory(atPath: folderURL.path)
+        XCTAssertEqual(files.count, 2)
+    }
+
     // MARK: - AttachmentExtractionSettings Tests
 
     func testAttachmentExtractionSettingsDefaults() {
@@ -355,5 +936,6 @@ final class AttachmentServiceTests: XCTestCase {
 
         XCTAssertEqual(decoded.isEnabled, settings.isEnabled)
         XCTAssertEqual(decoded.createSubfolderPerEmail, settings.createSubfolderPerEmail)
+        XCTAssertEqual(decoded.maxConcurrentWrites, 4)
     }
 }
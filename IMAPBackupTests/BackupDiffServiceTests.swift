@@ -0,0 +1,136 @@
+import XCTest
+@testable import IMAPBackup
+
+final class BackupDiffServiceTests: XCTestCase {
+
+    var tempDirectory: URL!
+    var storageService: StorageService!
+    var mockService: MockIMAPService!
+
+    let accountEmail = "test@example.com"
+
+    override func setUp() async throws {
+        try await super.setUp()
+
+        tempDirectory = FileManager.default.temporaryDirectory
+            .appendingPathComponent(UUID().uuidString)
+        try FileManager.default.createDirectory(at: tempDirectory, withIntermediateDirectories: true)
+        storageService = StorageService(baseURL: tempDirectory)
+
+        mockService = MockIMAPService()
+        for number in 1...3 {
+            var spec = MockMessageSpec()
+            spec.messageId = "msg-\(number)@example.com"
+            await mockService.injectMessage(into: "INBOX", spec: spec)
+        }
+        try await mockService.connect()
+        try await mockService.login(password: "secret")
+    }
+
+    override func tearDown() async throws {
+        try? FileManager.default.removeItem(at: tempDirectory)
+        mockService = nil
+
+        try await super.tearDown()
+    }
+
+    /// Save `uids` of INBOX to disk as a backup would
+    private func backUp(_ uids: [UInt32]) async throws {
+        for uid in uids {
+            let email = Email(messageId: "msg-\(uid)@example.com", uid: uid, folder: "INBOX", subject: "Message \(uid)",
+                              sender: "Sender", senderEmail: "sender@example.com", date: Date())
+            _ = try await storageService.saveEmail(Data("Subject: Message \(uid)\r\n\r\nBody\r\n".utf8), email: email,
+                                                   accountEmail: accountEmail, folderPath: "INBOX")
+        }
+    }
+
+    /// Every file under the backup location with its contents
+    private func snapshot() throws -> [String: Data] {
+        var files: [String: Data] = [:]
+        let enumerator = FileManager.default.enumerator(at: tempDirectory, includingPropertiesForKeys: [.isRegularFileKey])
+        while let url = enumerator?.nextObject() as? URL {
+            guard (try url.resourceValues(forKeys: [.isRegularFileKey])).isRegularFile == true else { continue }
+            files[url.path] = try Data(contentsOf: url)
+        }
+        return files
+    }
+
+    private func diff() async throws -> BackupDiff {
+        try await BackupDiffService.diffAccount(accountEmail: accountEmail, service: mockService, storageService: storageService)
+    }
+
+    // MARK: - Drift
+
+    func testUpToDateBackupShowsNoChanges() async throws {
+        try await backUp([1, 2, 3])
+
+        let result = try await diff()
+
+        XCTAssertEqual(result.folders.map(\.folder), ["INBOX", "Sent", "Drafts", "Trash"])
+        XCTAssertTrue(result.folders.allSatisfy { $0.isUnchanged })
+        XCTAssertNil(result.flagChanges)
+        XCTAssertTrue(result.errors.isEmpty)
+    }
+
+    func testNewAndDeletedMessagesAreCountedWithoutWriting() async throws {
+        try await backUp([1, 2, 3])
+        // The UID cache is gone, so reading the backup has to scan the files
+        for path in try snapshot().keys where !path.hasSuffix(".eml") {
+            try FileManager.default.removeItem(atPath: path)
+        }
+        await mockService.injectMessage(into: "INBOX", spec: MockMessageSpec())
+        await mockService.injectMessage(into: "Sent", spec: MockMessageSpec())
+        _ = try await mockService.selectFolder("INBOX")
+        try await mockService.deleteEmails(uids: [2])
+        let before = try snapshot()
+
+        let result = try await diff()
+
+        let inbox = try XCTUnwrap(result.folders.first { $0.folder == "INBOX" })
+        XCTAssertEqual(inbox.newOnServer, 1)
+        XCTAssertEqual(inbox.missingOnServer, 1)
+        let sent = try XCTUnwrap(result.folders.first { $0.folder == "Sent" })
+        XCTAssertEqual(sent.newOnServer, 1)
+        XCTAssertEqual(result.newOnServer, 2)
+        XCTAssertEqual(result.missingOnServer, 1)
+        XCTAssertEqual(result.summary, "2 new on server, 1 missing on server in 2 of 4 folder(s)")
+
+        XCTAssertEqual(try snapshot(), before)
+        let opened = await mockService.openFolderCommands
+        XCTAssertTrue(opened.suffix(4).allSatisfy { $0.hasPrefix("EXAMINE") })
+    }
+
+    func testFlagChangesCountedOnlyWithCondStore() async throws {
+        try await backUp([1, 2, 3])
+        let status = try await mockService.examineFolder("INBOX")
+        try await storageService.recordFlagsModSeq(1, uidValidity: status.uidValidity, accountEmail: accountEmail, folderPath: "INBOX")
+        await mockService.setFlags(["\\Seen"], for: 1)
+        await mockService.setFlags(["\\Flagged"], for: 3)
+
+        // A full FLAGS fetch cannot tell what changed
+        let withoutCondStore = try await diff()
+        XCTAssertNil(withoutCondStore.folders.first?.flagChanges)
+
+        await mockService.setAdvertisedCapabilities(["IMAP4REV1", "CONDSTORE"])
+        let withCondStore = try await diff()
+        XCTAssertEqual(withCondStore.folders.first?.flagChanges, 2)
+        XCTAssertEqual(withCondStore.flagChanges, 2)
+        XCTAssertEqual(withCondStore.newOnServer, 0)
+    }
+
+    func testDiffRoundTripsThroughJSON() throws {
+        var diff = BackupDiff(accountEmail: accountEmail, comparedAt: Date(timeIntervalSince1970: 1_700_000_000))
+        diff.folders = [FolderDiff(folder: "INBOX", newOnServer: 4, missingOnServer: 1, flagChanges: nil)]
+
+        let data = try BackupDiff.jsonData([diff])
+        let text = try XCTUnwrap(String(data: data, encoding: .utf8))
+        XCTAssertTrue(text.contains("\"comparedAt\" : \"2023-11-14T22:13:20Z\""))
+        XCTAssertTrue(text.contains("\"newOnServer\" : 4"))
+
+        let decoder = JSONDecoder()
+        decoder.dateDecodingStrategy = .iso8601
+        let decoded = try decoder.decode([BackupDiff].self, from: data)
+        XCTAssertEqual(decoded.first?.folders, diff.folders)
+        XCTAssertEqual(decoded.first?.comparedAt, diff.comparedAt)
+    }
+}
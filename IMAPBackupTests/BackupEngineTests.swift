@@ -0,0 +1,495 @@
+import XCTest
+@testable import IMAPBackup
+
+final class BackupEngineTests: XCTestCase {
+
+    var tempDirectory: URL!
+    var storageService: StorageService!
+    var mockService: MockIMAPService!
+
+    let account = EmailAccount(email: "test@example.com", imapServer: "imap.example.com", username: "test")
+
+    override func setUp() async throws {
+        try await super.setUp()
+
+        tempDirectory = FileManager.default.temporaryDirectory
+            .appendingPathComponent(UUID().uuidString)
+        try FileManager.default.createDirectory(at: tempDirectory, withIntermediateDirectories: true)
+        storageService = StorageService(baseURL: tempDirectory)
+
+        mockService = MockIMAPService()
+        for uid in UInt32(1)...3 {
+            await mockService.addTestEmail(to: "INBOX", uid: uid, from: "sender@example.com", subject: "Message \(uid)", body: "Body")
+        }
+    }
+
+    override func tearDown() async throws {
+        try? FileManager.default.removeItem(at: tempDirectory)
+        mockService = nil
+
+        try await super.tearDown()
+    }
+
+    // MARK: - Embedding
+
+    /// How another tool embeds the backup: its own storage, logger, notifier and progress handler
+    func testEmbeddedBackupUsesOnlyWhatItIsGiven() async throws {
+        let logger = RecordingLogger()
+        let notifier = RecordingNotifier()
+        var updates: [BackupProgress] = []
+        let service = mockService!
+
+        let engine = BackupEngine(
+            storage: storageService,
+            logger: logger,
+            notifier: notifier,
+            progress: { updates.append($0) },
+            makeService: { _ in service }
+        )
+
+        let progress = try await engine.backUp(account, password: "secret")
+
+        XCTAssertEqual(progress.status, .completed)
+        XCTAssertEqual(progress.downloadedEmails, 3)
+        XCTAssertEqual(progress.totalEmails, 3)
+        XCTAssertTrue(progress.errors.isEmpty)
+        let saved = try await storageService.getExistingUIDs(accountEmail: account.email, folderPath: "INBOX")
+        XCTAssertEqual(saved, [1, 2, 3])
+
+        XCTAssertEqual(updates.first?.status, .connecting)
+        XCTAssertEqual(updates.map(\.downloadedEmails).max(), 3)
+        XCTAssertEqual(notifier.completed.map(\.downloaded), [3])
+        XCTAssertTrue(logger.messages.contains { $0.level == .info && $0.message.contains("3 emails downloaded") })
+
+        // A second run finds nothing new
+        let again = try await engine.backUp(account, password: "secret")
+        XCTAssertEqual(again.downloadedEmails, 0)
+        XCTAssertEqual(notifier.completed.map(\.downloaded), [3, 0])
+    }
+
+    // MARK: - Finding New Emails
+
+    func testUIDsSavedUnderTheIndexCostNoHeaders() async throws {
+        await storageService.loadStateIndex(accountEmail: account.email)
+        var options = BackupEngine.Options()
+        options.incrementalStrategy = .messageId
+        let service = mockService!
+        let engine = BackupEngine(storage: storageService, logger: RecordingLogger(), options: options, makeService: { _ in service })
+        try await engine.backUp(account, password: "secret")
+
+        await mockService.addTestEmail(to: "INBOX", uid: 4, from: "sender@example.com", subject: "Message 4", body: "Body")
+        await mockService.reset()
+        try await mockService.connect()
+        try await mockService.login(password: "secret")
+
+        let inbox = IMAPFolder(name: "INBOX", delimiter: "/", flags: [], path: "INBOX")
+        let found = try await engine.newUIDs(in: inbox, account: account, service: mockService)
+
+        XCTAssertEqual(found.uids, [4])
+        // The three messages the index saw saved are skipped on their UID alone
+        let headers = await mockService.fetchMessageIDsCalls
+        XCTAssertEqual(headers, [4...4])
+    }
+
+    func testUIDsFoundOnDiskAreCheckedByMessageID() async throws {
+        let service = mockService!
+        try await BackupEngine(storage: storageService, logger: RecordingLogger(), makeService: { _ in service })
+            .backUp(account, password: "secret")
+
+        // The index starts from the files on disk, which may predate a UIDVALIDITY change
+        let storage = StorageService(baseURL: tempDirectory)
+        await storage.loadStateIndex(accountEmail: account.email)
+        var options = BackupEngine.Options()
+        options.incrementalStrategy = .messageId
+        let engine = BackupEngine(storage: storage, logger: RecordingLogger(), options: options, makeService: { _ in service })
+        try await engine.backUp(account, password: "secret")
+
+        await mockService.addTestEmail(to: "INBOX", uid: 4, from: "sender@example.com", subject: "Message 4", body: "Body")
+        await mockService.reset()
+        try await mockService.connect()
+        try await mockService.login(password: "secret")
+
+        let inbox = IMAPFolder(name: "INBOX", delimiter: "/", flags: [], path: "INBOX")
+        let found = try await engine.newUIDs(in: inbox, account: account, service: mockService)
+
+        XCTAssertEqual(found.uids, [4])
+        let headers = await mockService.fetchMessageIDsCalls
+        XCTAssertEqual(headers, [1...4])
+        let verified = await storage.indexedUIDsAreVerified(accountEmail: account.email, folderPath: "INBOX")
+        XCTAssertFalse(verified)
+    }
+
+    func testEmbeddedBackupFailureIsThrownAndNotified() async throws {
+        await mockService.setShouldFailConnect(true)
+        let notifier = RecordingNotifier()
+        var lastStatus: BackupStatus?
+        let service = mockService!
+
+        let engine = BackupEngine(
+            storage: storageService,
+            logger: RecordingLogger(),
+            notifier: notifier,
+            progress: { lastStatus = $0.status },
+            makeService: { _ in service }
+        )
+
+        do {
+            try await engine.backUp(account, password: "secret")
+            XCTFail("A connection failure should throw")
+        } catch {
+            XCTAssertEqual(notifier.failed.count, 1)
+            XCTAssertEqual(notifier.failed.first?.kind, .network)
+            XCTAssertEqual(lastStatus, .failed)
+        }
+        XCTAssertTrue(notifier.completed.isEmpty)
+    }
+
+    func testEmbeddedBackupHonoursMaxMessagesPerFolder() async throws {
+        let service = mockService!
+        let engine = BackupEngine(
+            storage: storageService,
+            logger: RecordingLogger(),
+            options: BackupEngine.Options(maxMessagesPerFolder: 2),
+            makeService: { _ in service }
+        )
+
+        let progress = try await engine.backUp(account, password: "secret")
+
+        XCTAssertEqual(progress.downloadedEmails, 2)
+        let saved = try await storageService.getExistingUIDs(accountEmail: account.email, folderPath: "INBOX")
+        XCTAssertEqual(saved, [2, 3])
+    }
+
+    func testMessageDelaySpacesOutSaves() async throws {
+        let service = mockService!
+        var saveTimes: [Date] = []
+        var lastCount = 0
+        let engine = BackupEngine(
+            storage: storageService,
+            logger: RecordingLogger(),
+            options: BackupEngine.Options(messageDelayMs: 50),
+            progress: { progress in
+                if progress.downloadedEmails > lastCount {
+                    lastCount = progress.downloadedEmails
+                    saveTimes.append(Date())
+                }
+            },
+            makeService: { _ in service }
+        )
+
+        try await engine.backUp(account, password: "secret")
+
+        XCTAssertEqual(saveTimes.count, 3)
+        for (earlier, later) in zip(saveTimes, saveTimes.dropFirst()) {
+            XCTAssertGreaterThanOrEqual(later.timeIntervalSince(earlier), 0.045)
+        }
+    }
+
+    func testSavedEmailsAreRecordedInTheIndex() async throws {
+        let index = DatabaseService(backupLocation: tempDirectory)
+        try await index.open()
+        let engine = BackupEngine(
+            storage: storageService,
+            logger: RecordingLogger(),
+            options: BackupEngine.Options(retryDelayMs: 0),
+            index: index
+        )
+        let inbox = IMAPFolder(name: "INBOX", delimiter: "/", flags: [], path: "INBOX")
+
+        let result = try await engine.downloadFolder([1, 2, 3], from: inbox, account: account, service: mockService)
+
+        XCTAssertEqual(result.downloaded, 3)
+        let indexed = try await index.getBackedUpUIDs(accountId: account.email, mailbox: "INBOX")
+        XCTAssertEqual(indexed, [1, 2, 3])
+        await index.close()
+    }
+
+    func testStorageCheckStopsTheFolderBetweenSaves() async throws {
+        var checks = 0
+        var options = BackupEngine.Options(retryDelayMs: 0)
+        options.storageCheckInterval = 2
+        let engine = BackupEngine(storage: storageService, logger: RecordingLogger(), options: options, storageCheck: {
+            checks += 1
+            throw InodeCheckError.tooFewInodes(path: "/", free: 0, minimum: 1)
+        })
+        let inbox = IMAPFolder(name: "INBOX", delimiter: "/", flags: [], path: "INBOX")
+
+        do {
+            _ = try await engine.downloadFolder([1, 2, 3], from: inbox, account: account, service: mockService)
+            XCTFail("Expected the storage check to stop the folder")
+        } catch InodeCheckError.tooFewInodes {
+            // Expected
+        }
+
+        // Checked once, after the second save, and not retried as a failure of that email
+        XCTAssertEqual(checks, 1)
+        let saved = try await storageService.getExistingUIDs(accountEmail: account.email, folderPath: "INBOX")
+        XCTAssertEqual(saved, [1, 2])
+    }
+
+    /// The delay set on the manager reaches the engine a backup run downloads with
+    @MainActor
+    func testBackupManagerEngineSpacesOutSaves() async throws {
+        let manager = BackupManager(logger: RecordingLogger())
+        manager.messageDelayMs = 50
+        let engine = manager.makeEngine(storage: storageService, rateLimitSettings: .default, quirks: nil)
+        XCTAssertEqual(engine.options.messageDelayMs, 50)
+
+        var saveTimes: [Date] = []
+        let inbox = IMAPFolder(name: "INBOX", delimiter: "/", flags: [], path: "INBOX")
+        let result = try await engine.downloadFolder([1, 2, 3], from: inbox, account: account, service: mockService) { event in
+            if case .saved = event {
+                saveTimes.append(Date())
+            }
+        }
+
+        XCTAssertEqual(result.downloaded, 3)
+        XCTAssertEqual(saveTimes.count, 3)
+        for (earlier, later) in zip(saveTimes, saveTimes.dropFirst()) {
+            XCTAssertGreaterThanOrEqual(later.timeIntervalSince(earlier), 0.045)
+        }
+    }
+
+    func testMessageDelayEndsEarlyWhenCancelled() async {
+        let started = Date()
+        let task = Task {
+            await BackupEngine.pauseBetweenMessages(milliseconds: 10_000)
+        }
+        task.cancel()
+        await task.value
+
+        XCTAssertLessThan(Date().timeIntervalSince(started), 1)
+    }
+
+    // MARK: - Size Check
+
+    func testStreamedDownloadOfTheWrongSizeIsQuarantinedOnce() async throws {
+        // Every email is streamed, and the server claims one is larger than what it sends
+        await mockService.setReportedSize(5_000, for: 2)
+        let service = mockService!
+        let engine = BackupEngine(
+            storage: storageService,
+            logger: RecordingLogger(),
+            options: BackupEngine.Options(streamingThresholdBytes: 10),
+            makeService: { _ in service }
+        )
+
+        let first = try await engine.backUp(account, password: "secret")
+        let second = try await engine.backUp(account, password: "secret")
+
+        XCTAssertEqual(first.downloadedEmails, 2)
+        XCTAssertEqual(first.errors.count, 1)
+        XCTAssertEqual(second.downloadedEmails, 0)
+        let saved = try await storageService.getExistingUIDs(accountEmail: account.email, folderPath: "INBOX")
+        XCTAssertEqual(saved, [1, 3])
+
+        // Streamed twice per run, kept once however many runs there are
+        let fetches = await mockService.fetchEmailCalls.filter { $0 == 2 }
+        XCTAssertEqual(fetches.count, 4)
+        let quarantine = tempDirectory
+            .appendingPathComponent(account.email.sanitizedForFilename())
+            .appendingPathComponent(StorageService.quarantineDirectory)
+            .appendingPathComponent("INBOX")
+        let quarantined = try FileManager.default.contentsOfDirectory(atPath: quarantine.path)
+        XCTAssertEqual(quarantined.count, 1)
+        XCTAssertTrue(quarantined.first?.hasPrefix("2_") ?? false)
+    }
+
+    func testStreamedDownloadWithinTheSizeToleranceIsVerified() async throws {
+        // Servers count line endings differently, or do not report a size at all
+        let size = await mockService.emails["INBOX"]?[1]?.count ?? 0
+        await mockService.setReportedSize(size + 4, for: 1)
+        await mockService.setReportedSize(0, for: 2)
+        let engine = BackupEngine(
+            storage: storageService,
+            logger: RecordingLogger(),
+            options: BackupEngine.Options(streamingThresholdBytes: 10)
+        )
+        let inbox = IMAPFolder(name: "INBOX", delimiter: "/", flags: [], path: "INBOX")
+
+        let result = try await engine.downloadFolder([1, 2, 3], from: inbox, account: account, service: mockService)
+
+        XCTAssertEqual(result.downloaded, 3)
+        XCTAssertEqual(result.verifiedUIDs.sorted(), [1, 2, 3])
+    }
+
+    func testInvalidEmailDataGoesToTheDebugLog() async throws {
+        let garbage = Data("no headers at all".utf8)
+        await mockService.addEmail(to: "INBOX", uid: 4, data: garbage)
+        let logger = RecordingLogger()
+        let engine = BackupEngine(storage: storageService, logger: logger, options: BackupEngine.Options(retryDelayMs: 0))
+        let inbox = IMAPFolder(name: "INBOX", delimiter: "/", flags: [], path: "INBOX")
+
+        let result = try await engine.downloadFolder([4], from: inbox, account: account, service: mockService)
+
+        XCTAssertEqual(result.failedUIDs, [4])
+        let hex = garbage.map { String(format: "%02x", $0) }.joined(separator: " ")
+        XCTAssertTrue(logger.messages.contains { $0.level == .debug && $0.message.contains(hex) })
+        XCTAssertTrue(logger.messages.contains { $0.level == .error && $0.message.contains("Invalid email data for UID 4") })
+    }
+
+    // MARK: - Attachment Size Limit
+
+    func testAttachmentsOverTheLimitAreLeftOnTheServer() async throws {
+        let header = "From: sender@example.com\r\nDate: Mon, 1 Jan 2024 10:00:00 +0000\r\nSubject: Mixed sizes\r\n"
+            + "MIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=\"b1\"\r\n\r\n"
+        let text = "See attached\r\n"
+        let small = Data(repeating: 1, count: 1_000).base64EncodedString(options: .lineLength76Characters) + "\r\n"
+        let large = Data(repeating: 2, count: 30_000).base64EncodedString(options: .lineLength76Characters) + "\r\n"
+        func attachmentHeader(_ type: String, _ name: String) -> String {
+            "Content-Type: \(type); name=\"\(name)\"\r\nContent-Disposition: attachment; filename=\"\(name)\"\r\n"
+                + "Content-Transfer-Encoding: base64\r\n\r\n"
+        }
+        let sections = [
+            "HEADER": header,
+            "1.MIME": "Content-Type: text/plain; charset=utf-8\r\n\r\n", "1": text,
+            "2.MIME": attachmentHeader("application/pdf", "small.pdf"), "2": small,
+            "3.MIME": attachmentHeader("video/quicktime", "video.mov"), "3": large
+        ]
+        let message = sections["HEADER"]! + ["1", "2", "3"].map { "--b1\r\n" + sections["\($0).MIME"]! + sections[$0]! + "\r\n" }.joined() + "--b1--\r\n"
+        let structure = "* 1 FETCH (UID 4 BODYSTRUCTURE ("
+            + "(\"TEXT\" \"PLAIN\" (\"CHARSET\" \"utf-8\") NIL NIL \"7BIT\" \(text.utf8.count) 1 NIL NIL NIL NIL)"
+            + "(\"APPLICATION\" \"PDF\" (\"NAME\" \"small.pdf\") NIL NIL \"BASE64\" \(small.utf8.count) NIL (\"ATTACHMENT\" (\"FILENAME\" \"small.pdf\")) NIL NIL)"
+            + "(\"VIDEO\" \"QUICKTIME\" (\"NAME\" \"video.mov\") NIL NIL \"BASE64\" \(large.utf8.count) NIL (\"ATTACHMENT\" (\"FILENAME\" \"video.mov\")) NIL NIL)"
+            + " \"MIXED\" (\"BOUNDARY\" \"b1\") NIL NIL NIL))\r\n"
+        await mockService.addEmail(to: "INBOX", uid: 4, content: message)
+        await mockService.setBodyParts(sections.mapValues { Data($0.utf8) }, structure: structure, for: 4)
+        try await mockService.connect()
+        try await mockService.login(password: "secret")
+
+        var extraction = AttachmentExtractionSettings()
+        extraction.isEnabled = true
+        let engine = BackupEngine(
+            storage: storageService,
+            logger: RecordingLogger(),
+            options: BackupEngine.Options(retryDelayMs: 0, attachments: extraction, skipAttachmentsOverBytes: 10 * 1024)
+        )
+        let inbox = IMAPFolder(name: "INBOX", delimiter: "/", flags: [], path: "INBOX")
+        var savedURL: URL?
+
+        let result = try await engine.downloadFolder([1, 4], from: inbox, account: account, service: mockService) { event in
+            if case .saved(_, 4, _, let url, _) = event {
+                savedURL = url
+            }
+        }
+
+        // The small email is fetched whole; the large one part by part, without the video
+        XCTAssertEqual(result.downloaded, 2)
+        XCTAssertTrue(result.failedUIDs.isEmpty)
+        let wholeFetches = await mockService.fetchEmailCalls
+        let sectionFetches = await mockService.fetchBodySectionCalls
+        XCTAssertEqual(wholeFetches, [1])
+        XCTAssertEqual(sectionFetches, ["4:HEADER", "4:1.MIME", "4:1", "4:2.MIME", "4:2"])
+        // Incomplete, so server cleanup must never remove the original
+        XCTAssertEqual(result.verifiedUIDs, [1])
+
+        let emailURL = try XCTUnwrap(savedURL)
+        let saved = try String(contentsOf: emailURL, encoding: .utf8)
+        XCTAssertTrue(saved.contains(small))
+        XCTAssertFalse(saved.contains(large))
+        XCTAssertTrue(saved.contains("\"video.mov\""))
+        XCTAssertEqual(EmailParser.parseMetadata(from: Data(saved.utf8))?.subject, "Mixed sizes")
+
+        // Both attachments are listed; only the small one was saved as a file
+        let metadata = try JSONDecoder().decode([AttachmentMetadata].self, from: Data(contentsOf: AttachmentMetadata.sidecarURL(for: emailURL)))
+        XCTAssertEqual(metadata.map(\.filename), ["small.pdf", "video.mov"])
+        XCTAssertEqual(metadata.map(\.skipped), [false, true])
+        XCTAssertGreaterThan(metadata[1].size, 10 * 1024)
+        XCTAssertEqual(try FileManager.default.contentsOfDirectory(atPath: AttachmentMetadata.folderURL(for: emailURL).path), ["small.pdf"])
+    }
+
+    func testLaunchSizeLimitIsAppliedWithoutChangingSettings() throws {
+        let defaults = try XCTUnwrap(UserDefaults(suiteName: UUID().uuidString))
+        defaults.set("10MB", forKey: "NoAttachmentsOver")
+        var settings = AttachmentExtractionSettings()
+        settings.skipRules.maxSizeBytes = 1024
+
+        let limit = AttachmentExtractionManager.launchSizeLimit(in: defaults)
+        let effective = AttachmentExtractionManager.applying(launchSizeLimit: limit, to: settings)
+
+        XCTAssertEqual(effective.skipRules.maxSizeBytes, 10 * 1024 * 1024)
+        XCTAssertEqual(settings.skipRules.maxSizeBytes, 1024)
+        XCTAssertEqual(AttachmentExtractionManager.applying(launchSizeLimit: nil, to: settings).skipRules.maxSizeBytes, 1024)
+    }
+
+    // MARK: - Dates
+
+    func testMessageDated2099IsFlaggedAndNamedByInternalDate() async throws {
+        let received = Date(timeIntervalSince1970: 1_700_000_000)
+        var spec = MockMessageSpec()
+        spec.date = "Thu, 01 Jan 2099 00:00:00 +0000"
+        spec.internalDate = received
+        let uid = await mockService.injectMessage(into: "INBOX", spec: spec)
+        let logger = RecordingLogger()
+        let service = mockService!
+
+        let engine = BackupEngine(
+            storage: storageService,
+            logger: logger,
+            options: BackupEngine.Options(clampFutureDates: true),
+            makeService: { _ in service }
+        )
+        try await engine.backUp(account, password: "secret")
+
+        let files = FileManager.default.enumerator(at: tempDirectory, includingPropertiesForKeys: nil)?
+            .compactMap { ($0 as? URL)?.lastPathComponent } ?? []
+        let saved = try XCTUnwrap(files.first { $0.hasPrefix("\(uid)_") && $0.hasSuffix(".eml") })
+        XCTAssertEqual(StorageService.messageDate(fromFilename: saved), received)
+
+        // Only the 2099 email is reported
+        let warnings = logger.messages.filter { $0.level == .warning }.map(\.message)
+        XCTAssertEqual(warnings.count, 1)
+        XCTAssertTrue(warnings.first?.contains("UID \(uid) is dated far in the future (2099-01-01") ?? false)
+    }
+
+    func testFarFutureDateIsKeptWithoutClamping() async throws {
+        let now = Date(timeIntervalSince1970: 1_700_000_000)
+        let header = Date(timeIntervalSince1970: 4_070_908_800) // 2099-01-01
+        var asked = false
+
+        let kept = await BackupEngine.filenameDate(headerDate: header, clamp: false, now: now) {
+            asked = true
+            return now
+        }
+        XCTAssertEqual(kept.date, header)
+        XCTAssertTrue(kept.futureDated)
+        XCTAssertFalse(asked)
+
+        // A day of clock skew is not an anomaly
+        let skewed = await BackupEngine.filenameDate(headerDate: now.addingTimeInterval(86_400), clamp: true, now: now) { nil }
+        XCTAssertFalse(skewed.futureDated)
+
+        // Without an INTERNALDATE the header date stays
+        let unknown = await BackupEngine.filenameDate(headerDate: header, clamp: true, now: now) { nil }
+        XCTAssertEqual(unknown.date, header)
+        XCTAssertTrue(unknown.futureDated)
+    }
+
+    func testParseInternalDate() {
+        let response = "* 1 FETCH (UID 5 INTERNALDATE \" 7-Jul-2024 02:44:25 -0700\")\r\nA0001 OK FETCH completed\r\n"
+
+        XCTAssertEqual(IMAPService.parseInternalDate(response), Date(timeIntervalSince1970: 1_720_345_465))
+        XCTAssertNil(IMAPService.parseInternalDate("A0001 OK FETCH completed\r\n"))
+    }
+}
+
+private final class RecordingLogger: BackupLogger {
+    private(set) var messages: [(message: String, level: LogLevel)] = []
+
+    func log(_ message: String, level: LogLevel) {
+        messages.append((message, level))
+    }
+}
+
+private final class RecordingNotifier: BackupNotifier {
+    private(set) var completed: [(account: String, downloaded: Int)] = []
+    private(set) var failed: [(account: String, error: String, kind: FailureKind)] = []
+
+    func notifyBackupCompleted(account: String, emailsDownloaded: Int, totalEmails: Int, errors: Int) {
+        completed.append((account, emailsDownloaded))
+    }
+
+    func notifyBackupFailed(account: String, error: String, kind: FailureKind) {
+        failed.append((account, error, kind))
+    }
+}
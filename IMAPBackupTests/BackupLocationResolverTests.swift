@@ -0,0 +1,95 @@
+import XCTest
+@testable import IMAPBackup
+
+final class BackupLocationResolverTests: XCTestCase {
+
+    // MARK: - Platform Defaults
+
+    func testMacOSDefaultIsApplicationSupport() {
+        XCTAssertEqual(
+            BackupLocationResolver.resolve(configured: nil, platform: .macOS, environment: [:], home: "/Users/alex"),
+            "/Users/alex/Library/Application Support/IMAPBackup"
+        )
+    }
+
+    func testLinuxDefaultFollowsXDGDataHome() {
+        XCTAssertEqual(
+            BackupLocationResolver.resolve(configured: "", platform: .linux, environment: ["XDG_DATA_HOME": "/data/alex"], home: "/home/alex"),
+            "/data/alex/IMAPBackup"
+        )
+        // Unset or relative XDG_DATA_HOME falls back to ~/.local/share
+        XCTAssertEqual(
+            BackupLocationResolver.resolve(configured: nil, platform: .linux, environment: [:], home: "/home/alex"),
+            "/home/alex/.local/share/IMAPBackup"
+        )
+        XCTAssertEqual(
+            BackupLocationResolver.resolve(configured: nil, platform: .linux, environment: ["XDG_DATA_HOME": "data"], home: "/home/alex"),
+            "/home/alex/.local/share/IMAPBackup"
+        )
+    }
+
+    func testWindowsDefaultIsLocalAppData() {
+        XCTAssertEqual(
+            BackupLocationResolver.resolve(configured: nil, platform: .windows,
+                                           environment: ["LOCALAPPDATA": #"C:\Users\alex\AppData\Local"#], home: #"C:\Users\alex"#),
+            #"C:\Users\alex\AppData\Local\IMAPBackup"#
+        )
+        XCTAssertEqual(
+            BackupLocationResolver.resolve(configured: nil, platform: .windows, environment: [:], home: #"C:\Users\alex"#),
+            #"C:\Users\alex\AppData\Local\IMAPBackup"#
+        )
+    }
+
+    // MARK: - Expansion
+
+    func testConfiguredPathExpandsTildeAndVariables() {
+        let environment = ["BACKUP_ROOT": "/Volumes/Archive", "USER": "alex"]
+
+        XCTAssertEqual(BackupLocationResolver.resolve(configured: "~/Mail", platform: .macOS, environment: environment, home: "/Users/alex"),
+                       "/Users/alex/Mail")
+        XCTAssertEqual(BackupLocationResolver.resolve(configured: "$BACKUP_ROOT/${USER}/mail", platform: .linux, environment: environment, home: "/home/alex"),
+                       "/Volumes/Archive/alex/mail")
+        // Unset variables and a ~ inside the path are left as written
+        XCTAssertEqual(BackupLocationResolver.resolve(configured: "/srv/$MISSING/a~b", platform: .linux, environment: environment, home: "/home/alex"),
+                       "/srv/$MISSING/a~b")
+    }
+
+    func testWindowsPercentVariablesAreCaseInsensitive() {
+        XCTAssertEqual(
+            BackupLocationResolver.resolve(configured: #"%userprofile%\Mail"#, platform: .windows,
+                                           environment: ["USERPROFILE": #"C:\Users\alex"#], home: #"C:\Users\alex"#),
+            #"C:\Users\alex\Mail"#
+        )
+        // %NAME% means nothing outside Windows
+        XCTAssertEqual(
+            BackupLocationResolver.resolve(configured: "/srv/%USER%", platform: .linux, environment: ["USER": "alex"], home: "/home/alex"),
+            "/srv/%USER%"
+        )
+    }
+
+    // MARK: - Writability
+
+    func testCheckWritableCreatesDirectory() throws {
+        let url = FileManager.default.temporaryDirectory.appendingPathComponent(UUID().uuidString).appendingPathComponent("nested")
+        defer { try? FileManager.default.removeItem(at: url.deletingLastPathComponent()) }
+
+        XCTAssertNoThrow(try BackupLocationResolver.checkWritable(url))
+        XCTAssertEqual(try FileManager.default.contentsOfDirectory(atPath: url.path), [])
+    }
+
+    func testCheckWritableRejectsReadOnlyDirectory() throws {
+        let url = FileManager.default.temporaryDirectory.appendingPathComponent(UUID().uuidString)
+        try FileManager.default.createDirectory(at: url, withIntermediateDirectories: true)
+        try FileManager.default.setAttributes([.posixPermissions: 0o555], ofItemAtPath: url.path)
+        defer {
+            try? FileManager.default.setAttributes([.posixPermissions: 0o755], ofItemAtPath: url.path)
+            try? FileManager.default.removeItem(at: url)
+        }
+
+        XCTAssertThrowsError(try BackupLocationResolver.checkWritable(url)) { error in
+            guard case BackupLocationError.notWritable = error else {
+                return XCTFail("Unexpected error \(error)")
+            }
+        }
+    }
+}
@@ -0,0 +1,82 @@
+import XCTest
+@testable import IMAPBackup
+
+final class BackupProfileTests: XCTestCase {
+
+    let accounts = [
+        EmailAccount(email: "me@work.example", imapServer: "imap.work.example"),
+        EmailAccount(email: "me@home.example", imapServer: "imap.home.example"),
+        EmailAccount(email: "shared@work.example", imapServer: "imap.work.example")
+    ]
+
+    func testLoadFromAlternateFile() throws {
+        let fileURL = FileManager.default.temporaryDirectory
+            .appendingPathComponent("BackupProfileTests_\(UUID().uuidString).json")
+        defer { try? FileManager.default.removeItem(at: fileURL) }
+
+        try Data(#"{"profiles": {"work": ["me@work.example", "shared@work.example"], "personal": ["me@home.example"]}}"#.utf8)
+            .write(to: fileURL)
+
+        let profiles = try BackupProfiles.load(from: fileURL)
+        XCTAssertEqual(profiles.names, ["personal", "work"])
+
+        // Round trip
+        try profiles.write(to: fileURL)
+        XCTAssertEqual(try BackupProfiles.load(from: fileURL), profiles)
+    }
+
+    func testFilterAccountsByProfile() throws {
+        let profiles = BackupProfiles(profiles: ["work": ["shared@work.example", "ME@work.example"]])
+
+        let selected = try profiles.accounts(for: "work", in: accounts)
+
+        // Configured order, case-insensitive match
+        XCTAssertEqual(selected.map(\.email), ["me@work.example", "shared@work.example"])
+    }
+
+    func testUnknownProfile() {
+        XCTAssertThrowsError(try BackupProfiles().accounts(for: "work", in: accounts)) { error in
+            XCTAssertEqual(error as? BackupProfileError, .unknownProfile("work"))
+        }
+    }
+
+    func testProfileWithUnknownAccount() {
+        let profiles = BackupProfiles(profiles: [
+            "work": ["me@work.example", "old@work.example"],
+            "personal": ["me@home.example"]
+        ])
+
+        XCTAssertThrowsError(try profiles.accounts(for: "work", in: accounts)) { error in
+            XCTAssertEqual(error as? BackupProfileError, .unknownAccounts(profile: "work", emails: ["old@work.example"]))
+        }
+        XCTAssertEqual(profiles.validate(against: accounts), [.unknownAccounts(profile: "work", emails: ["old@work.example"])])
+        XCTAssertNoThrow(try profiles.accounts(for: "personal", in: accounts))
+    }
+
+    // MARK: - Selected Accounts
+
+    func testSelectAccountsByEmail() throws {
+        let selected = try BackupProfiles.accounts(named: ["SHARED@work.example", "me@home.example"], in: accounts)
+
+        XCTAssertEqual(selected.map(\.email), ["me@home.example", "shared@work.example"])
+    }
+
+    func testNoSelectionKeepsAllAccounts() throws {
+        XCTAssertEqual(try BackupProfiles.accounts(named: [], in: accounts).map(\.email), accounts.map(\.email))
+    }
+
+    func testSelectingUnknownAccount() {
+        XCTAssertThrowsError(try BackupProfiles.accounts(named: ["me@work.example", "typo@work.example"], in: accounts)) { error in
+            XCTAssertEqual(error as? BackupProfileError, .unknownSelectedAccounts(["typo@work.example"]))
+        }
+    }
+
+    func testRepeatedLaunchArgument() {
+        let arguments = ["/Applications/MailKeep.app/Contents/MacOS/MailKeep",
+                         "-BackupAccount", "me@work.example", "-FetchOrder", "newest-first",
+                         "-BackupAccount", "me@home.example", "-BackupAccount"]
+
+        XCTAssertEqual(BackupManager.repeatedArgument("BackupAccount", in: arguments), ["me@work.example", "me@home.example"])
+        XCTAssertEqual(BackupManager.repeatedArgument("BackupProfile", in: arguments), [])
+    }
+}
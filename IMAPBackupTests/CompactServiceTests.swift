@@ -0,0 +1,128 @@
+import XCTest
+@testable import IMAPBackup
+
+final class CompactServiceTests: XCTestCase {
+
+    var tempDirectory: URL!
+    var backupURL: URL!
+    var inboxURL: URL!
+
+    override func setUp() async throws {
+        try await super.setUp()
+
+        tempDirectory = FileManager.default.temporaryDirectory
+            .appendingPathComponent(UUID().uuidString)
+            .standardizedFileURL
+            .resolvingSymlinksInPath()
+        backupURL = tempDirectory.appendingPathComponent("backup")
+        inboxURL = backupURL.appendingPathComponent("user_example.com/INBOX")
+        try FileManager.default.createDirectory(at: inboxURL, withIntermediateDirectories: true)
+    }
+
+    override func tearDown() async throws {
+        try? FileManager.default.removeItem(at: tempDirectory)
+        try await super.tearDown()
+    }
+
+    @discardableResult
+    private func write(_ content: String, to url: URL) throws -> Int64 {
+        try FileManager.default.createDirectory(at: url.deletingLastPathComponent(), withIntermediateDirectories: true)
+        try Data(content.utf8).write(to: url)
+        return Int64(content.utf8.count)
+    }
+
+    private func exists(_ url: URL) -> Bool {
+        FileManager.default.fileExists(atPath: url.path)
+    }
+
+    // MARK: - Compact
+
+    func testCompactComposesCleanupsAndReportsReclaimedBytes() async throws {
+        let email = "From: a@example.com\r\nSubject: Same\r\n\r\nBody\r\n"
+        try write(email, to: inboxURL.appendingPathComponent("1_20260120_100000_a.eml"))
+        let duplicateBytes = try write(email, to: inboxURL.appendingPathComponent("2_20260120_100000_a.eml"))
+        try write("From: b@example.com\r\n\r\nOther\r\n", to: inboxURL.appendingPathComponent("3_20260120_110000_b.eml"))
+        // Headers-only backup: an envelope without its email is kept
+        let headersOnlyURL = inboxURL.appendingPathComponent("4_20260120_120000_c.envelope.json")
+        try write("{}", to: headersOnlyURL)
+
+        // Leftovers of an email that was deleted, and of an interrupted write
+        var orphanBytes = try write("[]", to: inboxURL.appendingPathComponent("9_20260120_130000_d.attachments.json"))
+        orphanBytes += try write("PDF", to: inboxURL.appendingPathComponent("9_20260120_130000_d_attachments/report.pdf"))
+        orphanBytes += try write("partial", to: inboxURL.appendingPathComponent("5_20260120_140000_e.eml.tmp"))
+
+        let quarantineURL = backupURL.appendingPathComponent("user_example.com/.quarantine/INBOX/6_20260120_150000_f.eml")
+        let quarantinedBytes = try write("truncated", to: quarantineURL)
+
+        // A mail folder that merely ends in _attachments is not an attachments folder
+        let mailFolderEmail = backupURL.appendingPathComponent("user_example.com/Project_attachments/7_20260120_160000_g.eml")
+        try write("From: g@example.com\r\n\r\nKeep\r\n", to: mailFolderEmail)
+
+        var options = CompactOptions()
+        options.removeDuplicates = true
+
+        // Dry run by default: everything is measured, nothing removed
+        let preview = try await CompactService.compact(backupLocation: backupURL, options: options)
+        XCTAssertTrue(preview.dryRun)
+        XCTAssertEqual(preview.duplicates, CompactReport.Tally(items: 1, bytes: duplicateBytes))
+        XCTAssertEqual(preview.orphans, CompactReport.Tally(items: 3, bytes: orphanBytes))
+        XCTAssertEqual(preview.quarantined, CompactReport.Tally(items: 1, bytes: quarantinedBytes))
+        XCTAssertEqual(preview.bytesReclaimed, duplicateBytes + orphanBytes + quarantinedBytes)
+        XCTAssertEqual(preview.reindexedDirectories, 0)
+        XCTAssertTrue(preview.summary.hasPrefix("Would reclaim"))
+        XCTAssertTrue(exists(inboxURL.appendingPathComponent("2_20260120_100000_a.eml")))
+        XCTAssertTrue(exists(quarantineURL))
+
+        options.dryRun = false
+        let report = try await CompactService.compact(backupLocation: backupURL, options: options)
+        XCTAssertEqual(report.bytesReclaimed, preview.bytesReclaimed)
+        XCTAssertTrue(report.errors.isEmpty)
+
+        let remaining = try FileManager.default.contentsOfDirectory(atPath: inboxURL.path).sorted()
+        XCTAssertEqual(remaining, [".hash_index", "1_20260120_100000_a.eml", "3_20260120_110000_b.eml", "4_20260120_120000_c.envelope.json"])
+        XCTAssertFalse(exists(backupURL.appendingPathComponent("user_example.com/.quarantine")))
+        XCTAssertTrue(exists(mailFolderEmail))
+
+        // Indexes are rebuilt from what is left
+        let index = try String(contentsOf: inboxURL.appendingPathComponent(".hash_index"), encoding: .utf8)
+        XCTAssertEqual(index.split(separator: "\n").count, 2)
+        XCTAssertEqual(report.reindexedDirectories, 2)
+    }
+
+    func testCompactAppliesRetention() async throws {
+        let old = inboxURL.appendingPathComponent("1_20200101_100000_a.eml")
+        let oldBytes = try write("From: a@example.com\r\n\r\nOld\r\n", to: old)
+        try FileManager.default.setAttributes([.modificationDate: Date(timeIntervalSinceNow: -400 * 86400)], ofItemAtPath: old.path)
+        try write("From: b@example.com\r\n\r\nNew\r\n", to: inboxURL.appendingPathComponent("2_20260120_100000_b.eml"))
+
+        var options = CompactOptions()
+        options.retention = RetentionSettings(policy: .byAge, maxAgeDays: 365, maxCount: 1000)
+
+        let preview = try await CompactService.compact(backupLocation: backupURL, options: options)
+        XCTAssertEqual(preview.retention, CompactReport.Tally(items: 1, bytes: oldBytes))
+        XCTAssertTrue(exists(old))
+
+        options.dryRun = false
+        let report = try await CompactService.compact(backupLocation: backupURL, options: options)
+        XCTAssertEqual(report.retention.items, 1)
+        XCTAssertFalse(exists(old))
+    }
+
+    func testCompactNeverRemovesFilesOutsideTheBackup() async throws {
+        let outsideURL = tempDirectory.appendingPathComponent("outside.json")
+        try write("keep me", to: outsideURL)
+        // A symlinked leftover pointing out of the backup
+        try FileManager.default.createSymbolicLink(
+            at: inboxURL.appendingPathComponent("8_20260120_100000_h.attachments.json"),
+            withDestinationURL: outsideURL
+        )
+
+        var options = CompactOptions()
+        options.dryRun = false
+        let report = try await CompactService.compact(backupLocation: backupURL, options: options)
+
+        XCTAssertEqual(report.orphans.items, 0)
+        XCTAssertEqual(report.errors.count, 1)
+        XCTAssertEqual(try String(contentsOf: outsideURL, encoding: .utf8), "keep me")
+    }
+}
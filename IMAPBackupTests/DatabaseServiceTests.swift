@@ -41,6 +41,25 @@ final class DatabaseServiceTests: XCTestCase {
         XCTAssertTrue(FileManager.default.fileExists(atPath: dbPath.path))
     }
 
+    func testOpenSucceedsAfterAFailedOpen() async throws {
+        // The backup location is not there yet, as when its volume is not mounted
+        let location = tempDirectory.appendingPathComponent("NotMounted")
+        let service = DatabaseService(backupLocation: location)
+
+        do {
+            try await service.open()
+            XCTFail("Opening a database in a missing directory should fail")
+        } catch {
+            XCTAssertTrue(error is DatabaseError)
+        }
+
+        try FileManager.default.createDirectory(at: location, withIntermediateDirectories: true)
+        try await service.open()
+        let count = try await service.getEmailCount(accountId: "test@example.com")
+        XCTAssertEqual(count, 0)
+        await service.close()
+    }
+
     // MARK: - Email Recording Tests
 
     func testRecordEmail() async throws {
@@ -450,4 +469,79 @@ final class DatabaseServiceTests: XCTestCase {
         let count = try await databaseService.getEmailCount(accountId: "test@example.com")
         XCTAssertEqual(count, 100)
     }
+
+    func testSharedServiceIsOnePerDatabase() {
+        let first = DatabaseService.shared(backupLocation: tempDirectory)
+        let second = DatabaseService.shared(backupLocation: tempDirectory.appendingPathComponent("."))
+        let other = DatabaseService.shared(backupLocation: tempDirectory.appendingPathComponent("other"))
+
+        XCTAssertTrue(first === second)
+        XCTAssertFalse(first === other)
+    }
+
+    /// Folders backed up in parallel, each writing its UIDs in batches through the shared
+    /// service, while a second connection to the same file writes another account. Every write
+    /// has to land without a "database is locked" error. Run with the Thread Sanitizer to also
+    /// catch data races.
+    func testParallelBatchesFromManyWritersAllLand() async throws {
+        let shared = DatabaseService.shared(backupLocation: tempDirectory)
+        try await shared.open()
+        let otherConnection = DatabaseService(backupLocation: tempDirectory)
+        try await otherConnection.open()
+
+        let folders = 16
+        let emailsPerFolder = 200
+        let batchSize = 25
+
+        func batch(account: String, folder: Int, from start: Int) -> [IndexedEmail] {
+            (start..<start + batchSize).map { uid in
+                IndexedEmail(
+                    accountId: account,
+                    messageId: "<\(folder).\(uid)@example.com>",
+                    uid: UInt32(uid),
+                    mailbox: "Folder\(folder)",
+                    filePath: "/backup/\(account)/Folder\(folder)/\(uid).eml"
+                )
+            }
+        }
+
+        try await withThrowingTaskGroup(of: Void.self) { group in
+            for folder in 0..<folders {
+                for start in stride(from: 1, through: emailsPerFolder, by: batchSize) {
+                    group.addTask {
+                        try await shared.recordEmails(batch(account: "shared@example.com", folder: folder, from: start))
+                    }
+                    group.addTask {
+                        try await otherConnection.recordEmails(batch(account: "other@example.com", folder: folder, from: start))
+                    }
+                }
+            }
+            try await group.waitForAll()
+        }
+
+        let sharedCount = try await shared.getEmailCount(accountId: "shared@example.com")
+        let otherCount = try await otherConnection.getEmailCount(accountId: "other@example.com")
+        XCTAssertEqual(sharedCount, folders * emailsPerFolder)
+        XCTAssertEqual(otherCount, folders * emailsPerFolder)
+
+        await shared.close()
+        await otherConnection.close()
+    }
+
+    func testFailedBatchLeavesNothingBehind() async throws {
+        await databaseService.close()
+
+        // A closed database fails the batch before anything is written
+        let email = IndexedEmail(accountId: "test@example.com", messageId: "<1@example.com>", uid: 1, mailbox: "INBOX", filePath: "/1.eml")
+        do {
+            try await databaseService.recordEmails([email])
+            XCTFail("Expected an error on a closed database")
+        } catch {
+            XCTAssertTrue(error is DatabaseError)
+        }
+
+        try await databaseService.open()
+        let count = try await databaseService.getEmailCount(accountId: "test@example.com")
+        XCTAssertEqual(count, 0)
+    }
 }
@@ -0,0 +1,94 @@
+import XCTest
+@testable import IMAPBackup
+
+final class DeletionGuardTests: XCTestCase {
+
+    var tempDirectory: URL!
+
+    override func setUp() async throws {
+        try await super.setUp()
+
+        tempDirectory = FileManager.default.temporaryDirectory
+            .appendingPathComponent(UUID().uuidString)
+        try FileManager.default.createDirectory(at: tempDirectory, withIntermediateDirectories: true)
+    }
+
+    override func tearDown() async throws {
+        try? FileManager.default.removeItem(at: tempDirectory)
+
+        try await super.tearDown()
+    }
+
+    // MARK: - Confirmation
+
+    func testDryRunUnlessConfirmedAtLaunch() {
+        XCTAssertEqual(DeletionMode.fromLaunchArguments(["MailKeep"]), .dryRun)
+        XCTAssertEqual(DeletionMode.fromLaunchArguments(["MailKeep", "-BackupAccount", "--yes"]), .confirmed)
+        XCTAssertEqual(DeletionMode.fromLaunchArguments(["MailKeep", "--force"]), .confirmed)
+        XCTAssertEqual(DeletionMode.fromLaunchArguments(["MailKeep", "-yes"]), .dryRun)
+    }
+
+    func testLaunchConfirmationCoversOneOperation() {
+        let confirmation = LaunchConfirmation(arguments: ["MailKeep", "--yes"])
+        XCTAssertEqual(confirmation.take(), .confirmed)
+        XCTAssertEqual(confirmation.take(), .dryRun)
+
+        XCTAssertEqual(LaunchConfirmation(arguments: ["MailKeep"]).take(), .dryRun)
+    }
+
+    func testDryRunMeasuresWithoutRemoving() throws {
+        let file = tempDirectory.appendingPathComponent("account/INBOX/1_hello.eml")
+        try FileManager.default.createDirectory(at: file.deletingLastPathComponent(), withIntermediateDirectories: true)
+        try Data("12345".utf8).write(to: file)
+
+        let size = try DeletionGuard.remove(file, within: tempDirectory, mode: .dryRun)
+
+        XCTAssertEqual(size, 5)
+        XCTAssertTrue(FileManager.default.fileExists(atPath: file.path))
+
+        try DeletionGuard.remove(file, within: tempDirectory, mode: .confirmed)
+        XCTAssertFalse(FileManager.default.fileExists(atPath: file.path))
+    }
+
+    // MARK: - Path Interlock
+
+    func testRefusesPathsOutsideTheBackupLocation() throws {
+        let outsideURL = FileManager.default.temporaryDirectory
+            .appendingPathComponent("DeletionGuardTests_outside_\(UUID().uuidString)")
+        try FileManager.default.createDirectory(at: outsideURL, withIntermediateDirectories: true)
+        defer { try? FileManager.default.removeItem(at: outsideURL) }
+        try FileManager.default.createSymbolicLink(at: tempDirectory.appendingPathComponent("link"), withDestinationURL: outsideURL)
+
+        let targets = [
+            tempDirectory,
+            tempDirectory.appendingPathComponent("../\(outsideURL.lastPathComponent)"),
+            tempDirectory.appendingPathComponent("link"),
+            URL(fileURLWithPath: tempDirectory.path + "-sibling/file.eml")
+        ]
+        for target in targets {
+            XCTAssertThrowsError(try DeletionGuard.remove(target, within: tempDirectory, mode: .confirmed), target.path) { error in
+                guard case DeletionError.outsideBackupLocation = error else {
+                    return XCTFail("Unexpected error: \(error)")
+                }
+            }
+        }
+        XCTAssertTrue(FileManager.default.fileExists(atPath: outsideURL.path))
+        XCTAssertTrue(FileManager.default.fileExists(atPath: tempDirectory.path))
+    }
+
+    // MARK: - Plans
+
+    func testPlanSummaryCountsByKind() {
+        var plan = DeletionPlan(operation: "Compact", mode: .dryRun)
+        XCTAssertEqual(plan.summary, "Compact: nothing to delete")
+
+        plan.add("email", count: 2, bytes: 0)
+        plan.add("attachment folder")
+        XCTAssertEqual(plan.counts, ["email": 2, "attachment folder": 1])
+        XCTAssertEqual(plan.summary, "Compact would delete 1 attachment folder(s), 2 email(s)")
+
+        var done = DeletionPlan(operation: "Server cleanup of INBOX", mode: .confirmed)
+        done.add("backed-up email", count: 3)
+        XCTAssertEqual(done.summary, "Server cleanup of INBOX deleted 3 backed-up email(s)")
+    }
+}
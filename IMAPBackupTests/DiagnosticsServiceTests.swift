@@ -0,0 +1,158 @@
+import XCTest
+@testable import IMAPBackup
+
+final class DiagnosticsServiceTests: XCTestCase {
+
+    var tempDirectory: URL!
+
+    override func setUp() async throws {
+        try await super.setUp()
+        tempDirectory = FileManager.default.temporaryDirectory
+            .appendingPathComponent("DiagnosticsServiceTests_\(UUID().uuidString)")
+        try FileManager.default.createDirectory(at: tempDirectory, withIntermediateDirectories: true)
+    }
+
+    override func tearDown() async throws {
+        try? FileManager.default.removeItem(at: tempDirectory)
+        try await super.tearDown()
+    }
+
+    // MARK: - Operating System
+
+    func testOperatingSystemCheckPasses() {
+        let check = DiagnosticsService.checkOperatingSystem()
+        XCTAssertEqual(check.status, .pass)
+        XCTAssertTrue(check.detail.hasPrefix("macOS"))
+    }
+
+    // MARK: - Build Info
+
+    func testBuildInfoReadsInfoDictionary() {
+        let info = BuildInfo(
+            infoDictionary: ["CFBundleShortVersionString": "0.5.0", "CFBundleVersion": "42", "MailKeepGitCommit": "abc1234"],
+            operatingSystem: "macOS 14.5.0",
+            integrations: ["keychain": "Security.framework", "notifier": "UserNotifications"]
+        )
+
+        XCTAssertEqual(info.version, "0.5.0")
+        XCTAssertEqual(info.build, "42")
+        XCTAssertEqual(info.commit, "abc1234")
+
+        let lines = info.report.components(separatedBy: "\n")
+        XCTAssertEqual(lines.first, "MailKeep 0.5.0 (42)")
+        XCTAssertTrue(lines.contains("commit: abc1234"))
+        XCTAssertTrue(lines.contains("os: macOS 14.5.0"))
+        XCTAssertTrue(lines.contains("arch: \(BuildInfo.compiledArchitecture)"))
+        XCTAssertTrue(lines.contains { $0.hasPrefix("swift: ") })
+        XCTAssertTrue(lines.contains("keychain: Security.framework"))
+        XCTAssertTrue(lines.contains("notifier: UserNotifications"))
+    }
+
+    func testUnstampedBuildReportsUnknownCommit() {
+        // An unset MAILKEEP_GIT_COMMIT leaves an empty string in the plist
+        let info = BuildInfo(infoDictionary: ["CFBundleShortVersionString": "0.5.0", "MailKeepGitCommit": ""])
+
+        XCTAssertEqual(info.commit, "unknown")
+        XCTAssertEqual(info.build, "unknown")
+        XCTAssertEqual(DiagnosticsService.checkBuild(info).status, .warning)
+        XCTAssertFalse(info.integrations.isEmpty)
+    }
+
+    func testTestBundleHostReportsVersion() {
+        let info = BuildInfo.current
+
+        // MARKETING_VERSION and CURRENT_PROJECT_VERSION of the app target
+        XCTAssertEqual(info.version, "0.5.7")
+        XCTAssertEqual(info.build, "1")
+        XCTAssertTrue(info.report.hasPrefix("MailKeep 0.5.7 (1)\n"))
+        XCTAssertFalse(info.operatingSystem.isEmpty)
+        XCTAssertEqual(info.integrations["keychain"], "Security.framework")
+    }
+
+    // MARK: - Backup Location
+
+    func testBackupLocationWritable() {
+        let check = DiagnosticsService.checkBackupLocation(tempDirectory, minimumFreeSpace: 0)
+
+        XCTAssertEqual(check.status, .pass)
+        XCTAssertNil(check.remediation)
+
+        // Write probe is cleaned up
+        let contents = try? FileManager.default.contentsOfDirectory(atPath: tempDirectory.path)
+        XCTAssertEqual(contents, [])
+    }
+
+    func testBackupLocationMissing() {
+        let missing = tempDirectory.appendingPathComponent("does-not-exist")
+        let check = DiagnosticsService.checkBackupLocation(missing)
+
+        XCTAssertEqual(check.status, .fail)
+        XCTAssertNotNil(check.remediation)
+    }
+
+    func testBackupLocationLowFreeSpace() {
+        let check = DiagnosticsService.checkBackupLocation(tempDirectory, minimumFreeSpace: Int64.max)
+
+        XCTAssertEqual(check.status, .warning)
+        XCTAssertNotNil(check.remediation)
+    }
+
+    // MARK: - Account Configuration
+
+    func testAccountConfigurationValid() {
+        let account = EmailAccount(email: "test@example.com", imapServer: "imap.example.com")
+        XCTAssertEqual(DiagnosticsService.checkAccountConfiguration(account).status, .pass)
+    }
+
+    func testAccountConfigurationInvalid() {
+        let account = EmailAccount(email: "test@example.com", imapServer: " ", port: 0)
+        let check = DiagnosticsService.checkAccountConfiguration(account)
+
+        XCTAssertEqual(check.status, .fail)
+        XCTAssertTrue(check.detail.contains("IMAP server is empty"))
+        XCTAssertTrue(check.detail.contains("port 0"))
+    }
+
+    func testAccountConfigurationWithoutSSLWarns() {
+        let account = EmailAccount(email: "test@example.com", imapServer: "imap.example.com", port: 143, useSSL: false)
+        XCTAssertEqual(DiagnosticsService.checkAccountConfiguration(account).status, .warning)
+    }
+
+    // MARK: - Connectivity
+
+    @MainActor
+    func testConnectivitySuccess() async {
+        let account = EmailAccount(email: "test@example.com", imapServer: "imap.example.com")
+        let mock = MockIMAPService()
+
+        let check = await DiagnosticsService.checkConnectivity(account: account, imapService: mock)
+
+        XCTAssertEqual(check.status, .pass)
+        let logoutCount = await mock.logoutCallCount
+        XCTAssertEqual(logoutCount, 1)
+    }
+
+    @MainActor
+    func testConnectivityConnectFailure() async {
+        let account = EmailAccount(email: "test@example.com", imapServer: "imap.example.com")
+        let mock = MockIMAPService()
+        await mock.setShouldFailConnect(true)
+
+        let check = await DiagnosticsService.checkConnectivity(account: account, imapService: mock)
+
+        XCTAssertEqual(check.status, .fail)
+        XCTAssertNotNil(check.remediation)
+    }
+
+    @MainActor
+    func testConnectivityLoginFailure() async {
+        let account = EmailAccount(email: "test@example.com", imapServer: "imap.example.com")
+        let mock = MockIMAPService()
+        await mock.setShouldFailLogin(true)
+
+        let check = await DiagnosticsService.checkConnectivity(account: account, imapService: mock)
+
+        XCTAssertEqual(check.status, .fail)
+        XCTAssertTrue(check.remediation?.contains("password") ?? false)
+    }
+}
@@ -0,0 +1,286 @@
+import XCTest
+@testable import IMAPBackup
+
+final class DownloadOrderTests: XCTestCase {
+
+    var tempDirectory: URL!
+    var storageService: StorageService!
+    var mockService: MockIMAPService!
+
+    let accountEmail = "test@example.com"
+
+    override func setUp() async throws {
+        try await super.setUp()
+
+        tempDirectory = FileManager.default.temporaryDirectory
+            .appendingPathComponent(UUID().uuidString)
+        try FileManager.default.createDirectory(at: tempDirectory, withIntermediateDirectories: true)
+        storageService = StorageService(baseURL: tempDirectory)
+
+        mockService = MockIMAPService()
+        for uid in UInt32(1)...10 {
+            await mockService.addTestEmail(to: "INBOX", uid: uid, from: "sender@example.com", subject: "Message \(uid)", body: "Body")
+        }
+        try await mockService.connect()
+        try await mockService.login(password: "secret")
+        _ = try await mockService.selectFolder("INBOX")
+    }
+
+    override func tearDown() async throws {
+        try? FileManager.default.removeItem(at: tempDirectory)
+        mockService = nil
+
+        try await super.tearDown()
+    }
+
+    /// Download the whole test folder through the backup's download loop, returning the UIDs in the order they were saved
+    private func backUp(order: FetchOrder = .oldestFirst, maxMessages: Int?) async throws -> [UInt32] {
+        let engine = BackupEngine(
+            storage: storageService,
+            options: BackupEngine.Options(fetchOrder: order, maxMessagesPerFolder: maxMessages ?? 0, retryDelayMs: 0)
+        )
+        let account = EmailAccount(email: accountEmail, imapServer: "imap.example.com", username: "test")
+        let folder = IMAPFolder(name: "INBOX", delimiter: "/", flags: [], path: "INBOX")
+        let uids = try await mockService.searchAll()
+        var saved: [UInt32] = []
+
+        try await engine.downloadFolder(uids, from: folder, account: account, service: mockService) { event in
+            if case .saved(_, let uid, _, _, _) = event {
+                saved.append(uid)
+            }
+        }
+        return saved
+    }
+
+    private func savedFiles() throws -> [URL] {
+        let folderURL = tempDirectory
+            .appendingPathComponent(accountEmail.sanitizedForFilename())
+            .appendingPathComponent("INBOX")
+        return try StorageService.messageFiles(in: folderURL).filter { $0.pathExtension == "eml" }
+    }
+
+    func testMaxMessagesSavesExactlyNNewest() async throws {
+        let saved = try await backUp(maxMessages: 4)
+
+        XCTAssertEqual(saved, [10, 9, 8, 7])
+        XCTAssertEqual(try savedFiles().count, 4)
+    }
+
+    func testMaxMessagesSkipsPastFailures() async throws {
+        await mockService.setShouldFailOnUID(9)
+
+        let saved = try await backUp(maxMessages: 4)
+
+        XCTAssertEqual(saved, [10, 8, 7, 6])
+        XCTAssertEqual(try savedFiles().count, 4)
+    }
+
+    func testNoLimitKeepsOrder() async throws {
+        XCTAssertEqual(BackupEngine.downloadOrder([3, 1, 2], maxMessages: nil), [3, 1, 2])
+
+        let saved = try await backUp(maxMessages: nil)
+        XCTAssertEqual(saved.count, 10)
+        XCTAssertEqual(try savedFiles().count, 10)
+    }
+
+    // MARK: - Fetch Order
+
+    func testNewestFirstSavesNewestUIDsFirst() async throws {
+        let saved = try await backUp(order: .newestFirst, maxMessages: nil)
+
+        XCTAssertEqual(saved, [10, 9, 8, 7, 6, 5, 4, 3, 2, 1])
+        XCTAssertEqual(try savedFiles().count, 10)
+    }
+
+    func testOldestFirstKeepsServerOrder() async throws {
+        let saved = try await backUp(order: .oldestFirst, maxMessages: nil)
+
+        XCTAssertEqual(saved, Array(1...10))
+    }
+
+    func testCapKeepsNewestWhateverTheOrder() {
+        XCTAssertEqual(BackupEngine.downloadOrder([1, 2, 3, 4], order: .oldestFirst, maxMessages: 2), [4, 3, 2, 1])
+        XCTAssertEqual(BackupEngine.downloadOrder([1, 2, 3, 4], order: .newestFirst, maxMessages: 2), [4, 3, 2, 1])
+    }
+
+    // MARK: - Parallel Batches
+
+    func testFetchBatchesSplitEvenlyAndKeepOrder() {
+        let uids = Array(UInt32(1)...200)
+
+        let batches = BackupEngine.fetchBatches(uids, connections: 3)
+        XCTAssertEqual(batches.map(\.count), [67, 67, 66])
+        XCTAssertEqual(batches.flatMap { $0 }, uids)
+
+        // Small folders stay on one connection
+        XCTAssertEqual(BackupEngine.fetchBatches(Array(uids.prefix(60)), connections: 4).count, 1)
+        XCTAssertEqual(BackupEngine.fetchBatches(uids, connections: 1), [uids])
+        XCTAssertEqual(BackupEngine.fetchBatches([], connections: 4), [])
+    }
+
+    func testBatchesOverSeparateConnectionsFetchEverythingOnce() async throws {
+        let uids = Array(UInt32(1)...200)
+        let delay = 0.01
+        let main = try await openConnection(uids: uids, delay: delay)
+        var extras: [MockIMAPService] = []
+        for _ in 0..<3 {
+            extras.append(try await openConnection(uids: uids, delay: delay))
+        }
+        var unopened = extras
+
+        let engine = BackupEngine(
+            storage: storageService,
+            options: BackupEngine.Options(maxConcurrentMessagesPerFolder: 4, retryDelayMs: 0)
+        )
+        let account = EmailAccount(email: accountEmail, imapServer: "imap.example.com", username: "test")
+        let folder = IMAPFolder(name: "INBOX", delimiter: "/", flags: [], path: "INBOX")
+
+        let started = Date()
+        let result = try await engine.downloadFolder(uids, from: folder, account: account, service: main, openConnection: {
+            unopened.removeFirst()
+        })
+        let elapsed = Date().timeIntervalSince(started)
+
+        XCTAssertEqual(result.downloaded, uids.count)
+        XCTAssertEqual(result.verifiedUIDs.sorted(), uids)
+        XCTAssertTrue(unopened.isEmpty)
+
+        // The main connection takes the first batch, each extra one the next
+        let batches = BackupEngine.fetchBatches(uids, connections: 4)
+        XCTAssertEqual(batches.count, 4)
+        for (batch, connection) in zip(batches, [main] + extras) {
+            let calls = await connection.fetchEmailCalls
+            XCTAssertEqual(calls, batch)
+        }
+        for extra in extras {
+            let loggedOut = await extra.logoutCallCount
+            XCTAssertEqual(loggedOut, 1)
+        }
+        // One connection would need 200 fetch delays
+        XCTAssertLessThan(elapsed, Double(uids.count) * delay)
+    }
+
+    /// A logged-in connection to a copy of the test mailbox, each fetch taking `delay`
+    private func openConnection(uids: [UInt32], delay: TimeInterval) async throws -> MockIMAPService {
+        let connection = MockIMAPService()
+        for uid in uids {
+            await connection.addTestEmail(to: "INBOX", uid: uid, from: "sender@example.com", subject: "Message \(uid)", body: "Body")
+        }
+        await connection.setFetchDelay(delay)
+        try await connection.connect()
+        try await connection.login(password: "secret")
+        _ = try await connection.selectFolder("INBOX")
+        return connection
+    }
+
+    func testRunBatchesLogsOutExtraConnectionsAndReturnsUnopenedBatches() async throws {
+        let uids = Array(UInt32(1)...40)
+        let batches = BackupEngine.fetchBatches(uids, connections: 4, minimumBatch: 10)
+        var opened: [MockIMAPService] = []
+        var attempts = 0
+
+        let (results, unopened) = try await BackupEngine.runBatches(batches, main: mockService) {
+            attempts += 1
+            // The third connection cannot be opened
+            guard attempts != 2 else { throw IMAPError.connectionFailed("refused") }
+            let connection = try await self.openConnection(uids: uids, delay: 0)
+            opened.append(connection)
+            return connection
+        } run: { batch, connection in
+            for uid in batch {
+                _ = try await connection.fetchEmail(uid: uid)
+            }
+            return batch
+        }
+
+        XCTAssertEqual(results.flatMap { $0 }.sorted(), (batches[0] + batches[1] + batches[3]).sorted())
+        XCTAssertEqual(unopened, batches[2])
+        XCTAssertEqual(opened.count, 2)
+        for connection in opened {
+            let logouts = await connection.logoutCallCount
+            let isOpen = await connection.connectionIsOpen
+            XCTAssertEqual(logouts, 1)
+            XCTAssertFalse(isOpen)
+        }
+        // The main connection belongs to the caller
+        let mainIsOpen = await mockService.connectionIsOpen
+        XCTAssertTrue(mainIsOpen)
+    }
+
+    func testCancellingRunBatchesMidFetchLeavesNothingRunningOrOpen() async throws {
+        let uids = Array(UInt32(1)...40)
+        let batches = BackupEngine.fetchBatches(uids, connections: 4, minimumBatch: 10)
+        await mockService.setFetchDelay(0.05)
+        let inFlight = InFlightCounter()
+        let openedConnections = OpenedConnections()
+
+        let task = Task {
+            try await BackupEngine.runBatches(batches, main: self.mockService) {
+                let connection = try await self.openConnection(uids: uids, delay: 0.05)
+                await openedConnections.append(connection)
+                return connection
+            } run: { batch, connection in
+                await inFlight.enter()
+                do {
+                    for uid in batch {
+                        _ = try await connection.fetchEmail(uid: uid)
+                    }
+                    await inFlight.leave()
+                    return batch
+                } catch {
+                    await inFlight.leave()
+                    throw error
+                }
+            }
+        }
+
+        // Let every batch get into its first fetch, then cancel
+        try await Task.sleep(nanoseconds: 80_000_000)
+        task.cancel()
+
+        do {
+            _ = try await task.value
+            XCTFail("A cancelled run should throw")
+        } catch {
+            XCTAssertTrue(error is CancellationError)
+        }
+
+        // Every batch was joined before the error came out...
+        let running = await inFlight.current
+        let started = await inFlight.started
+        XCTAssertEqual(running, 0)
+        XCTAssertEqual(started, batches.count)
+
+        // ...and no extra connection was left open or sent a LOGOUT mid-fetch
+        let opened = await openedConnections.all
+        XCTAssertEqual(opened.count, batches.count - 1)
+        for connection in opened {
+            let isOpen = await connection.connectionIsOpen
+            let logouts = await connection.logoutCallCount
+            XCTAssertFalse(isOpen)
+            XCTAssertEqual(logouts, 0)
+        }
+    }
+}
+
+private actor InFlightCounter {
+    private(set) var current = 0
+    private(set) var started = 0
+
+    func enter() {
+        current += 1
+        started += 1
+    }
+
+    func leave() {
+        current -= 1
+    }
+}
+
+private actor OpenedConnections {
+    private(set) var all: [MockIMAPService] = []
+
+    func append(_ connection: MockIMAPService) {
+        all.append(connection)
+    }
+}
@@ -186,6 +186,15 @@ final class EmailParserTests: XCTestCase {
         XCTAssertEqual(parsed?.subject, "(No Subject)")
     }
 
+    func testParseSubjectStripsControlCharacters() {
+        let encoded = Data("Hello\u{0}\u{7}World".utf8).base64EncodedString()
+        let emailData = "From: test@example.com\r\nSubject: =?UTF-8?B?\(encoded)?=\r\n\r\nBody.".data(using: .utf8)!
+
+        let parsed = EmailParser.parseMetadata(from: emailData)
+
+        XCTAssertEqual(parsed?.subject, "HelloWorld")
+    }
+
     func testParseEmailWithMissingMessageId() {
         let emailData = """
         From: test@example.com
@@ -224,9 +233,44 @@ final class EmailParserTests: XCTestCase {
         let parsed = EmailParser.parseMetadata(from: emailData)
 
         XCTAssertNotNil(parsed)
-        // Folded headers may or may not be properly joined depending on regex behavior
-        // At minimum, we should get the first part of the subject
-        XCTAssertTrue(parsed!.subject.contains("long subject"))
+        XCTAssertEqual(parsed?.subject, "This is a very long subject line that continues on the next line")
+    }
+
+    func testParseMultiHopReceivedChain() throws {
+        let emailData = Data(("Delivered-To: user@example.com\r\n"
+            + "Received: from mx.example.com (mx.example.com [192.0.2.10])\r\n"
+            + "\tby imap.example.com with LMTP id abc123\r\n"
+            + "\tfor <user@example.com>; Mon, 15 Jan 2024 10:30:05 +0000\r\n"
+            + "Delivered-To: alias@example.org\r\n"
+            + "Received: from relay.example.net (relay.example.net [198.51.100.7])\r\n"
+            + " by mx.example.com with ESMTPS id def456; Mon, 15 Jan 2024 10:30:03 +0000\r\n"
+            + "Received: from sender.example.net ([203.0.113.5]) by relay.example.net; Mon, 15 Jan 2024 10:30:01 +0000\r\n"
+            + "From: sender@example.net\r\n"
+            + "Subject: Routed\r\n"
+            + "Message-ID: <routed@example.net>\r\n"
+            + "\r\n"
+            + "Received: this is body text, not a header\r\n").utf8)
+
+        let parsed = try XCTUnwrap(EmailParser.parseMetadata(from: emailData))
+
+        // Most recent hop first, folded lines joined, nothing from the body
+        XCTAssertEqual(parsed.received, [
+            "from mx.example.com (mx.example.com [192.0.2.10]) by imap.example.com with LMTP id abc123 for <user@example.com>; Mon, 15 Jan 2024 10:30:05 +0000",
+            "from relay.example.net (relay.example.net [198.51.100.7]) by mx.example.com with ESMTPS id def456; Mon, 15 Jan 2024 10:30:03 +0000",
+            "from sender.example.net ([203.0.113.5]) by relay.example.net; Mon, 15 Jan 2024 10:30:01 +0000",
+        ])
+        // The topmost Delivered-To is the final mailbox
+        XCTAssertEqual(parsed.deliveredTo, "user@example.com")
+        XCTAssertEqual(parsed.subject, "Routed")
+    }
+
+    func testParseEmailWithoutRoutingHeaders() throws {
+        let emailData = Data("From: a@example.com\r\nSubject: Local\r\n\r\nBody\r\n".utf8)
+
+        let parsed = try XCTUnwrap(EmailParser.parseMetadata(from: emailData))
+
+        XCTAssertTrue(parsed.received.isEmpty)
+        XCTAssertNil(parsed.deliveredTo)
     }
 
     func testParseEmailWithSpecialCharactersInFrom() {
@@ -257,4 +301,131 @@ final class EmailParserTests: XCTestCase {
             XCTAssertNotNil(parsed)
         }
     }
+
+    // MARK: - Concurrent Parsing
+
+    func testConcurrentParsingWithDifferentCharsets() async {
+        let subjects: [(encoded: String, decoded: String)] = [
+            ("=?ISO-8859-1?Q?Gr=FC=DFe?=", "Grüße"),
+            ("=?KOI8-R?B?8NLJ18XU?=", "Привет"),
+            ("=?windows-1252?Q?=80uro?=", "€uro"),
+            ("=?Shift_JIS?B?k/qWew==?=", "日本"),
+            ("=?UTF-8?B?w5xuw69jb2Rl?=", "Ünïcode")
+        ]
+        let attachmentName = "=?ISO-8859-7?B?xevr3OThLnBkZg==?="
+
+        let results = await withTaskGroup(of: (Int, String?, String?).self) { group in
+            for index in 0..<200 {
+                let subject = subjects[index % subjects.count].encoded
+                group.addTask {
+                    let email = """
+                    From: sender@example.com\r
+                    Subject: \(subject)\r
+                    MIME-Version: 1.0\r
+                    Content-Type: multipart/mixed; boundary="b"\r
+                    \r
+                    --b\r
+                    Content-Type: application/pdf; name="\(attachmentName)"\r
+                    Content-Disposition: attachment; filename="\(attachmentName)"\r
+                    Content-Transfer-Encoding: base64\r
+                    \r
+                    UERG\r
+                    --b--\r
+
+                    """
+                    let data = Data(email.utf8)
+                    return (
+                        index,
+                        EmailParser.parseMetadata(from: data)?.subject,
+                        AttachmentService.attachments(in: data).first?.filename
+                    )
+                }
+            }
+
+            var collected: [(Int, String?, String?)] = []
+            for await result in group {
+                collected.append(result)
+            }
+            return collected
+        }
+
+        XCTAssertEqual(results.count, 200)
+        for (index, subject, filename) in results {
+            XCTAssertEqual(subject, subjects[index % subjects.count].decoded)
+            XCTAssertEqual(filename, "Ελλάδα.pdf")
+        }
+    }
+
+    func testConcurrentParsingOfNonUTF8Emails() async {
+        let emails: [(charset: String, encoding: String.Encoding, subject: String, date: String)] = [
+            ("koi8-r", String.Encoding(rawValue: CFStringConvertEncodingToNSStringEncoding(CFStringConvertIANACharSetNameToEncoding("koi8-r" as CFString))),
+             "Привет из Москвы", "Mon, 15 Jan 2024 10:30:00 +0300"),
+            ("windows-1251", .windowsCP1251, "Отчёт за январь", "Tue, 16 Jan 2024 11:00:00 +0300"),
+            ("iso-8859-1", .isoLatin1, "Grüße aus Köln", "Wed, 17 Jan 2024 12:00:00 +0100"),
+            ("\"Shift_JIS\"", .shiftJIS, "会議の議事録", "Thu, 18 Jan 2024 09:00:00 +0900")
+        ]
+        let raw = emails.map { email in
+            "From: sender@example.com\r\nSubject: \(email.subject)\r\nDate: \(email.date)\r\n"
+                + "Content-Type: text/plain; charset=\(email.charset)\r\n\r\n\(email.subject)\r\n"
+        }.enumerated().map { index, text in
+            text.data(using: emails[index].encoding)!
+        }
+
+        let results = await withTaskGroup(of: (Int, ParsedEmail?).self) { group in
+            for index in 0..<400 {
+                group.addTask {
+                    (index, EmailParser.parseMetadata(from: raw[index % raw.count]))
+                }
+            }
+
+            var collected: [(Int, ParsedEmail?)] = []
+            for await result in group {
+                collected.append(result)
+            }
+            return collected
+        }
+
+        XCTAssertEqual(results.count, 400)
+        for (index, parsed) in results {
+            XCTAssertEqual(parsed?.subject, emails[index % emails.count].subject)
+        }
+        let firstDate = results.first { $0.0 == 0 }?.1?.date
+        XCTAssertEqual(firstDate, Date(timeIntervalSince1970: 1_705_303_800))
+    }
+
+    func testDecodeWithUnknownCharsetFallsBackToUTF8() {
+        XCTAssertEqual(MIMEDecoding.decodeEncodedWords("=?x-unknown?Q?caf=C3=A9?="), "café")
+        XCTAssertEqual(MIMEDecoding.string(from: Data([0xE9]), charset: "ISO-8859-1"), "é")
+    }
+
+    // MARK: - Empty Bodies
+
+    func testHeaderOnlyMessageHasEmptyBody() throws {
+        let headerOnly = Data("From: sender@example.com\r\nSubject: Truncated\r\nMessage-ID: <cut@example.com>\r\n".utf8)
+
+        XCTAssertTrue(EmailParser.hasEmptyBody(headerOnly))
+        // Still parses, so it is saved and named like any other email rather than reported as a failure
+        let parsed = try XCTUnwrap(EmailParser.parseMetadata(from: headerOnly))
+        XCTAssertEqual(parsed.subject, "Truncated")
+
+        XCTAssertTrue(EmailParser.hasEmptyBody(Data("Subject: Blank\r\n\r\n \r\n".utf8)))
+        XCTAssertTrue(EmailParser.hasEmptyBody(Data()))
+        XCTAssertFalse(EmailParser.hasEmptyBody(Data("Subject: Hi\r\n\r\nBody\r\n".utf8)))
+        XCTAssertFalse(EmailParser.hasEmptyBody(Data("Subject: Hi\n\nBody\n".utf8)))
+    }
+
+    func testEmptyBodyIsRecordedInSidecarAndReport() throws {
+        var sidecar = EnvelopeSidecar(uid: 7, folder: "INBOX", response: "* 1 FETCH (UID 7 FLAGS ())\r\n")
+        XCTAssertNil(sidecar.emptyBody)
+        sidecar.emptyBody = true
+        let json = String(decoding: try JSONEncoder().encode(sidecar), as: UTF8.self)
+        XCTAssertTrue(json.contains(#""emptyBody":true"#))
+
+        let record = BackupReportRecord(kind: .folder, runId: UUID(), accountEmail: "test@example.com", folder: "INBOX",
+                                        startedAt: Date(), finishedAt: Date(), downloaded: 2, failed: 0, bytes: 80,
+                                        errors: [], emptyBodyUIDs: [7])
+        XCTAssertEqual(record.failed, 0)
+        let decoded = try JSONDecoder().decode(BackupReportRecord.self, from: JSONEncoder().encode(record))
+        XCTAssertEqual(decoded.emptyBodyUIDs, [7])
+    }
 }
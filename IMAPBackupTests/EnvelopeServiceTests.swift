@@ -0,0 +1,258 @@
+import XCTest
+@testable import IMAPBackup
+
+final class EnvelopeServiceTests: XCTestCase {
+
+    let fetchResponse = """
+    * 12 FETCH (UID 42 ENVELOPE ("Mon, 20 Jan 2026 10:00:00 +0000" "Quarterly \\"Report\\"" \
+    (("Alice" NIL "alice" "example.com")) NIL NIL ((NIL NIL "bob" "example.com")) NIL NIL NIL "<q1@example.com>") \
+    BODYSTRUCTURE (("TEXT" "PLAIN" ("CHARSET" "utf-8") NIL NIL "7BIT" 120 4 NIL NIL NIL) \
+    ("APPLICATION" "PDF" ("NAME" "report.pdf") NIL NIL "BASE64" 5000 NIL ("ATTACHMENT" ("FILENAME" "report.pdf")) NIL NIL) "MIXED"))\r
+    A0007 OK FETCH completed\r
+
+    """
+
+    // MARK: - Parser Tests
+
+    func testParseFetchAttributes() {
+        let attributes = EnvelopeParser.parseFetchAttributes(fetchResponse)
+
+        XCTAssertEqual(attributes["UID"], .string("42"))
+
+        guard case .list(let envelope)? = attributes["ENVELOPE"] else {
+            return XCTFail("Expected envelope list")
+        }
+        XCTAssertEqual(envelope.count, 10)
+        XCTAssertEqual(envelope[1], .string("Quarterly \"Report\""))
+        XCTAssertEqual(envelope[3], .null)
+        XCTAssertEqual(envelope[2], .list([.list([.string("Alice"), .null, .string("alice"), .string("example.com")])]))
+        XCTAssertEqual(envelope[9], .string("<q1@example.com>"))
+
+        guard case .list(let structure)? = attributes["BODYSTRUCTURE"] else {
+            return XCTFail("Expected body structure list")
+        }
+        XCTAssertEqual(structure.last, .string("MIXED"))
+    }
+
+    func testParseLiteral() {
+        let response = "* 1 FETCH (UID 7 ENVELOPE (NIL {11}\r\nHello (you) NIL))\r\nA0001 OK\r\n"
+        let attributes = EnvelopeParser.parseFetchAttributes(response)
+
+        XCTAssertEqual(attributes["ENVELOPE"], .list([.null, .string("Hello (you)"), .null]))
+    }
+
+    func testParseWithoutFetch() {
+        XCTAssertTrue(EnvelopeParser.parseFetchAttributes("A0001 NO failed\r\n").isEmpty)
+    }
+
+    func testParseInvalidUTF8IsSanitized() throws {
+        // "Caf\xE9" is Latin-1, not UTF-8; BEL is a control character
+        let bytes = Array("(\"Caf".utf8) + [0xE9] + Array("\" \"Ring\u{07}\")".utf8)
+        var index = 0
+        let value = EnvelopeParser.parseValue(bytes, &index)
+
+        XCTAssertEqual(value, .list([.string("Caf\u{FFFD}"), .string("Ring")]))
+
+        // Encodes to clean JSON
+        let data = try JSONEncoder().encode(value)
+        XCTAssertNotNil(String(data: data, encoding: .utf8))
+    }
+
+    // MARK: - Sidecar Tests
+
+    func testSidecarWrittenAndParseable() async throws {
+        let tempDirectory = FileManager.default.temporaryDirectory
+            .appendingPathComponent("EnvelopeServiceTests_\(UUID().uuidString)")
+        try FileManager.default.createDirectory(at: tempDirectory, withIntermediateDirectories: true)
+        defer { try? FileManager.default.removeItem(at: tempDirectory) }
+
+        let storageService = StorageService(baseURL: tempDirectory)
+        let emailURL = tempDirectory.appendingPathComponent("42_20260120_100000_Alice.eml")
+        let sidecar = EnvelopeSidecar(uid: 42, folder: "INBOX", response: fetchResponse)
+
+        let sidecarURL = try await storageService.saveEnvelopeSidecar(sidecar, for: emailURL)
+        XCTAssertEqual(sidecarURL.lastPathComponent, "42_20260120_100000_Alice.envelope.json")
+
+        // Plain JSON for external tools
+        let data = try Data(contentsOf: sidecarURL)
+        let json = try JSONSerialization.jsonObject(with: data) as? [String: Any]
+        XCTAssertEqual(json?["uid"] as? Int, 42)
+        XCTAssertNotNil(json?["envelope"] as? [Any])
+        XCTAssertNotNil(json?["bodyStructure"] as? [Any])
+
+        let decoder = JSONDecoder()
+        decoder.dateDecodingStrategy = .iso8601
+        let decoded = try decoder.decode(EnvelopeSidecar.self, from: data)
+        XCTAssertEqual(decoded.envelope, sidecar.envelope)
+        XCTAssertEqual(decoded.bodyStructure, sidecar.bodyStructure)
+        XCTAssertEqual(decoded.rawResponse, fetchResponse)
+    }
+
+    func testSidecarFromMockServer() async throws {
+        let mock = MockIMAPService()
+        await mock.addTestEmail(to: "INBOX", uid: 3, from: "a@example.com", subject: "Hello", body: "Body")
+        try await mock.connect()
+        try await mock.login(password: "test")
+        _ = try await mock.selectFolder("INBOX")
+
+        let response = try await mock.fetchEnvelope(uid: 3)
+        let sidecar = EnvelopeSidecar(uid: 3, folder: "INBOX", response: response)
+
+        guard case .list(let envelope)? = sidecar.envelope else {
+            return XCTFail("Expected envelope list")
+        }
+        XCTAssertEqual(envelope[1], .string("Hello"))
+        XCTAssertEqual(envelope[9], .string("<test-3@example.com>"))
+    }
+
+    // MARK: - Headers-Only Tests
+
+    func testHeaderBlockFromEnvelope() {
+        let sidecar = EnvelopeSidecar(uid: 42, folder: "INBOX", response: fetchResponse)
+        let parsed = EmailParser.parseMetadata(from: Data(sidecar.headerBlock.utf8))
+
+        XCTAssertEqual(parsed?.subject, "Quarterly \"Report\"")
+        XCTAssertEqual(parsed?.senderName, "Alice")
+        XCTAssertEqual(parsed?.senderEmail, "alice@example.com")
+        XCTAssertEqual(parsed?.messageId, "<q1@example.com>")
+        XCTAssertEqual(parsed?.date, Date(timeIntervalSince1970: 1_768_903_200))
+    }
+
+    func testHeadersOnlyWritesMetadataWithoutEmail() async throws {
+        let tempDirectory = FileManager.default.temporaryDirectory
+            .appendingPathComponent("EnvelopeServiceTests_\(UUID().uuidString)")
+        try FileManager.default.createDirectory(at: tempDirectory, withIntermediateDirectories: true)
+        defer { try? FileManager.default.removeItem(at: tempDirectory) }
+
+        let storageService = StorageService(baseURL: tempDirectory)
+        let sidecar = EnvelopeSidecar(uid: 42, folder: "INBOX", response: fetchResponse)
+        let email = Email(
+            messageId: "<q1@example.com>",
+            uid: 42,
+            folder: "INBOX",
+            subject: "Quarterly",
+            sender: "Alice",
+            senderEmail: "alice@example.com",
+            date: Date()
+        )
+
+        let sidecarURL = try await storageService.saveHeadersOnly(sidecar, email: email, accountEmail: "me@example.com", folderPath: "INBOX")
+
+        let files = try FileManager.default.contentsOfDirectory(atPath: sidecarURL.deletingLastPathComponent().path)
+        XCTAssertEqual(files.filter { $0.hasSuffix(".envelope.json") }.count, 1)
+        XCTAssertTrue(files.filter { $0.hasSuffix(".eml") }.isEmpty)
+
+        // Indexed but not backed up: a full backup still fetches the body
+        let existing = try await storageService.getExistingUIDs(accountEmail: "me@example.com", folderPath: "INBOX")
+        let indexed = try await storageService.getEnvelopeUIDs(accountEmail: "me@example.com", folderPath: "INBOX")
+        XCTAssertTrue(existing.isEmpty)
+        XCTAssertEqual(indexed, [42])
+    }
+
+    // MARK: - Flag Tests
+
+    func testStandardFlagLabels() {
+        XCTAssertEqual(
+            MessageFlags.labels(for: ["\\Seen", "\\Flagged", "\\Answered", "\\Draft", "\\Deleted"]),
+            ["read", "starred", "answered", "draft", "deleted"]
+        )
+        XCTAssertEqual(MessageFlags.label(for: "\\SEEN"), "read")
+    }
+
+    func testKeywordFlagLabels() {
+        XCTAssertEqual(MessageFlags.label(for: "$Forwarded"), "forwarded")
+        XCTAssertEqual(MessageFlags.label(for: "$Label1"), "Label1")
+        XCTAssertEqual(MessageFlags.label(for: "Work"), "Work")
+        XCTAssertEqual(MessageFlags.labels(for: ["$Junk", "Junk", "\\Seen"]), ["junk", "Junk", "read"])
+        XCTAssertEqual(MessageFlags.labels(for: ["\\Seen", "\\seen"]), ["read"])
+    }
+
+    func testSidecarKeepsRawFlagsAndLabels() async throws {
+        let mock = MockIMAPService()
+        await mock.addTestEmail(to: "INBOX", uid: 4, from: "a@example.com", subject: "Hi", body: "Body")
+        await mock.setMessageFlags(["\\Seen", "\\Flagged", "$Work"], for: 4)
+        try await mock.connect()
+        try await mock.login(password: "test")
+        _ = try await mock.selectFolder("INBOX")
+
+        let sidecar = EnvelopeSidecar(uid: 4, folder: "INBOX", response: try await mock.fetchEnvelope(uid: 4))
+        XCTAssertEqual(sidecar.flags, ["\\Seen", "\\Flagged", "$Work"])
+        XCTAssertEqual(sidecar.flagLabels, ["read", "starred", "Work"])
+    }
+
+    func testLocalFlagPolicies() async throws {
+        let mock = MockIMAPService()
+        await mock.addTestEmail(to: "INBOX", uid: 5, from: "a@example.com", subject: "Unread", body: "Body")
+        await mock.addTestEmail(to: "INBOX", uid: 6, from: "a@example.com", subject: "Read", body: "Body")
+        await mock.setMessageFlags(["\\Flagged"], for: 5)
+        await mock.setMessageFlags(["\\Seen", "\\Flagged"], for: 6)
+        try await mock.connect()
+        try await mock.login(password: "test")
+        _ = try await mock.selectFolder("INBOX")
+
+        let unread = EnvelopeSidecar(uid: 5, folder: "INBOX", response: try await mock.fetchEnvelope(uid: 5))
+        let read = EnvelopeSidecar(uid: 6, folder: "INBOX", response: try await mock.fetchEnvelope(uid: 6))
+
+        // Preserve keeps the server's flags
+        XCTAssertEqual(unread.applying(.preserve).flags, ["\\Flagged"])
+        XCTAssertEqual(read.applying(.preserve).flags, ["\\Seen", "\\Flagged"])
+
+        // Mark read
+        XCTAssertEqual(unread.applying(.markRead).flags, ["\\Flagged", "\\Seen"])
+        XCTAssertEqual(unread.applying(.markRead).flagLabels, ["starred", "read"])
+        XCTAssertEqual(read.applying(.markRead).flags, ["\\Flagged", "\\Seen"])
+
+        // Mark unread
+        XCTAssertEqual(read.applying(.markUnread).flags, ["\\Flagged"])
+        XCTAssertEqual(read.applying(.markUnread).flagLabels, ["starred"])
+        XCTAssertEqual(unread.applying(.markUnread).flags, ["\\Flagged"])
+
+        // The raw response is what the server said
+        XCTAssertEqual(read.applying(.markUnread).rawResponse, read.rawResponse)
+    }
+
+    func testSidecarWithoutFlagsDecodes() throws {
+        let json = #"{"uid":1,"folder":"INBOX","fetchedAt":"2026-01-20T10:00:00Z","rawResponse":""}"#
+        let decoder = JSONDecoder()
+        decoder.dateDecodingStrategy = .iso8601
+        let sidecar = try decoder.decode(EnvelopeSidecar.self, from: Data(json.utf8))
+        XCTAssertNil(sidecar.flags)
+        XCTAssertNil(sidecar.flagLabels)
+    }
+
+    // MARK: - Repair Tests
+
+    func testRepairEnvelopeSidecars() async throws {
+        let tempDirectory = FileManager.default.temporaryDirectory
+            .appendingPathComponent("EnvelopeServiceTests_\(UUID().uuidString)")
+        defer { try? FileManager.default.removeItem(at: tempDirectory) }
+
+        let storageService = StorageService(baseURL: tempDirectory)
+        let folderURL = try await storageService.createFolderDirectory(accountEmail: "test@example.com", folderPath: "INBOX")
+
+        // Written by an older version: invalid byte and an escaped control character
+        var broken = Data(#"{"uid":1,"folder":"INBOX","fetchedAt":"2026-01-20T10:00:00Z","envelope":[null,"Bad "#.utf8)
+        broken.append(0xFF)
+        broken.append(Data(#" subject\u0007"],"rawResponse":"raw"}"#.utf8))
+        let brokenURL = folderURL.appendingPathComponent("1_20260120_100000_Sender.envelope.json")
+        try broken.write(to: brokenURL)
+
+        let clean = EnvelopeSidecar(uid: 2, folder: "INBOX", response: "* 2 FETCH (UID 2 ENVELOPE (NIL \"Fine\"))")
+        try await storageService.saveEnvelopeSidecar(clean, for: folderURL.appendingPathComponent("2_20260120_100000_Sender.eml"))
+
+        let repaired = try await storageService.repairEnvelopeSidecars(accountEmail: "test@example.com", folderPath: "INBOX")
+        XCTAssertEqual(repaired, 1)
+
+        let data = try Data(contentsOf: brokenURL)
+        XCTAssertNotNil(String(data: data, encoding: .utf8))
+
+        let decoder = JSONDecoder()
+        decoder.dateDecodingStrategy = .iso8601
+        let decoded = try decoder.decode(EnvelopeSidecar.self, from: data)
+        XCTAssertEqual(decoded.envelope, .list([.null, .string("Bad \u{FFFD} subject")]))
+
+        // Nothing left to repair
+        let again = try await storageService.repairEnvelopeSidecars(accountEmail: "test@example.com", folderPath: "INBOX")
+        XCTAssertEqual(again, 0)
+    }
+}
@@ -0,0 +1,105 @@
+import XCTest
+@testable import IMAPBackup
+
+final class ErrorBudgetTests: XCTestCase {
+
+    let account = EmailAccount(email: "test@example.com", imapServer: "imap.example.com", username: "test")
+    let inbox = IMAPFolder(name: "INBOX", delimiter: "/", flags: [], path: "INBOX")
+
+    /// Download UIDs 1...20 into `backend` through the backup's download loop
+    private func backUp(to backend: StorageBackend, maxErrorPercent: Int) async throws -> FolderDownloadResult {
+        let service = MockIMAPService()
+        for uid in UInt32(1)...20 {
+            await service.addTestEmail(to: "INBOX", uid: uid, from: "sender@example.com", subject: "Message \(uid)", body: "Body")
+        }
+        try await service.connect()
+        try await service.login(password: "secret")
+
+        let engine = BackupEngine(
+            storage: backend,
+            options: BackupEngine.Options(maxErrorPercent: maxErrorPercent, retryDelayMs: 0)
+        )
+        return try await engine.downloadFolder(Array(1...20), from: inbox, account: account, service: service)
+    }
+
+    func testOneFailingEmailIsSkipped() async throws {
+        let backend = MockStorageBackend(name: "local")
+        backend.failingUIDs = [7]
+
+        let result = try await backUp(to: backend, maxErrorPercent: 10)
+
+        XCTAssertEqual(result.failedUIDs, [7])
+        XCTAssertEqual(result.downloaded, 19)
+        XCTAssertEqual(Set(backend.saved["INBOX"]?.keys.map { $0 } ?? []), Set(UInt32(1)...20).subtracting([7]))
+        XCTAssertFalse(result.gaveUp)
+    }
+
+    func testFolderIsAbandonedAboveThreshold() async throws {
+        let backend = MockStorageBackend(name: "local")
+        backend.failingUIDs = Set(UInt32(1)...20).filter { $0 % 2 == 0 }
+
+        let result = try await backUp(to: backend, maxErrorPercent: 25)
+
+        // Judged after the first 10 emails, where half had failed
+        XCTAssertTrue(result.gaveUp)
+        XCTAssertEqual(result.failedUIDs, [2, 4, 6, 8, 10])
+        XCTAssertEqual(result.downloaded, 5)
+        XCTAssertEqual(result.errors.last, "Gave up on INBOX: 5 of 10 emails failed, more than the allowed 25%")
+    }
+
+    func testBatchesOfAFolderShareOneBudget() async throws {
+        let uids = Array(UInt32(1)...200)
+        var connections: [MockIMAPService] = []
+        for _ in 0..<4 {
+            let connection = MockIMAPService()
+            for uid in uids {
+                await connection.addTestEmail(to: "INBOX", uid: uid, from: "sender@example.com", subject: "Message \(uid)", body: "Body")
+            }
+            // Every fourth email fails, a quarter of each batch
+            await connection.setFailingUIDs(Set(uids.filter { $0 % 4 == 0 }))
+            try await connection.connect()
+            try await connection.login(password: "secret")
+            connections.append(connection)
+        }
+        var unopened = Array(connections.dropFirst())
+
+        let directory = FileManager.default.temporaryDirectory.appendingPathComponent(UUID().uuidString)
+        defer { try? FileManager.default.removeItem(at: directory) }
+        let engine = BackupEngine(
+            storage: StorageService(baseURL: directory),
+            options: BackupEngine.Options(maxErrorPercent: 20, maxConcurrentMessagesPerFolder: 4, retryDelayMs: 0)
+        )
+
+        let result = try await engine.downloadFolder(uids, from: inbox, account: account, service: connections[0], openConnection: {
+            unopened.removeFirst()
+        })
+
+        // Four budgets would each wait for 10 emails of their own and each report giving up
+        XCTAssertTrue(result.gaveUp)
+        XCTAssertEqual(result.errors.filter { $0.hasPrefix("Gave up on INBOX") }.count, 1)
+        XCTAssertLessThan(result.downloaded + result.failedUIDs.count, 40)
+    }
+
+    func testNoLimitNeverGivesUp() {
+        var budget = ErrorBudget(maxErrorPercent: 0)
+        for _ in 0..<50 {
+            budget.record(succeeded: false)
+        }
+
+        XCTAssertNil(budget.maxErrorRate)
+        XCTAssertFalse(budget.isExceeded)
+        XCTAssertEqual(budget.errorRate, 1)
+    }
+
+    func testEarlyFailuresWaitForMinimumAttempts() {
+        var budget = ErrorBudget(maxErrorRate: 0.1, minimumAttempts: 5)
+        budget.record(succeeded: false)
+        XCTAssertFalse(budget.isExceeded)
+
+        for _ in 0..<4 {
+            budget.record(succeeded: true)
+        }
+        // 1 of 5 is above 10%
+        XCTAssertTrue(budget.isExceeded)
+    }
+}
@@ -0,0 +1,131 @@
+import XCTest
+@testable import IMAPBackup
+
+final class FetchStrategyTests: XCTestCase {
+
+    var tempDirectory: URL!
+    var storageService: StorageService!
+    var mockService: MockIMAPService!
+
+    let accountEmail = "test@example.com"
+
+    override func setUp() async throws {
+        try await super.setUp()
+
+        tempDirectory = FileManager.default.temporaryDirectory
+            .appendingPathComponent(UUID().uuidString)
+        try FileManager.default.createDirectory(at: tempDirectory, withIntermediateDirectories: true)
+        storageService = StorageService(baseURL: tempDirectory)
+
+        mockService = MockIMAPService()
+        for number in 1...3 {
+            var spec = MockMessageSpec()
+            spec.messageId = "msg-\(number)@example.com"
+            spec.subject = "Message \(number)"
+            spec.flags = number == 2 ? ["\\Seen", "\\Flagged"] : []
+            await mockService.injectMessage(into: "INBOX", spec: spec)
+        }
+        try await mockService.connect()
+        try await mockService.login(password: "secret")
+        _ = try await mockService.selectFolder("INBOX")
+    }
+
+    override func tearDown() async throws {
+        try? FileManager.default.removeItem(at: tempDirectory)
+        mockService = nil
+
+        try await super.tearDown()
+    }
+
+    // MARK: - Two-Phase
+
+    func testTwoPhaseFetchesEnvelopesBeforeBodies() async throws {
+        let uids = try await mockService.searchAll()
+
+        // Phase one: one batched envelope fetch and no bodies yet
+        let envelopes = try await FetchStrategy.twoPhase.prefetchEnvelopes(for: uids, using: mockService)
+        let envelopeCalls = await mockService.fetchEnvelopesCalls
+        let bodiesAfterPhaseOne = await mockService.fetchEmailCalls
+        XCTAssertEqual(envelopeCalls, [[1, 2, 3]])
+        XCTAssertTrue(bodiesAfterPhaseOne.isEmpty)
+        XCTAssertEqual(Set(envelopes.keys), [1, 2, 3])
+        XCTAssertNotNil(FetchStrategy.reportedSize(in: try XCTUnwrap(envelopes[1])))
+    }
+
+    func testTwoPhaseBackupFetchesBodiesAfterEnvelopes() async throws {
+        let account = EmailAccount(email: accountEmail, imapServer: "imap.example.com", username: "test", fetchStrategy: .twoPhase)
+        let inbox = IMAPFolder(name: "INBOX", delimiter: "/", flags: [], path: "INBOX")
+        let engine = BackupEngine(
+            storage: storageService,
+            options: BackupEngine.Options(saveEnvelopeSidecars: true, retryDelayMs: 0)
+        )
+
+        let result = try await engine.downloadFolder([1, 2, 3], from: inbox, account: account, service: mockService)
+
+        XCTAssertEqual(result.downloaded, 3)
+        XCTAssertEqual(result.verifiedUIDs, [1, 2, 3])
+        // Envelopes and sizes once for the batch, then only bodies; nothing is fetched per email besides
+        let envelopeCalls = await mockService.fetchEnvelopesCalls
+        let bodyCalls = await mockService.fetchEmailCalls
+        XCTAssertEqual(envelopeCalls, [[1, 2, 3]])
+        XCTAssertEqual(bodyCalls, [1, 2, 3])
+
+        // The sidecars come from the first phase
+        let folderURL = tempDirectory.appendingPathComponent(accountEmail.sanitizedForFilename()).appendingPathComponent("INBOX")
+        let sidecarURLs = try StorageService.messageFiles(in: folderURL).filter { $0.lastPathComponent.hasSuffix(".envelope.json") }
+        XCTAssertEqual(sidecarURLs.count, 3)
+        let decoder = JSONDecoder()
+        decoder.dateDecodingStrategy = .iso8601
+        let sidecars = try sidecarURLs.map { try decoder.decode(EnvelopeSidecar.self, from: Data(contentsOf: $0)) }
+        XCTAssertEqual(sidecars.first { $0.uid == 2 }?.flags, ["\\Seen", "\\Flagged"])
+        XCTAssertTrue(sidecars.allSatisfy { $0.bodyStructure == nil })
+    }
+
+    func testTwoPhaseBatchesLargeFolders() async throws {
+        for _ in 0..<FetchStrategy.envelopeBatchSize {
+            await mockService.injectMessage(into: "INBOX", spec: MockMessageSpec())
+        }
+        let uids = try await mockService.searchAll()
+
+        let envelopes = try await FetchStrategy.twoPhase.prefetchEnvelopes(for: uids, using: mockService)
+
+        let calls = await mockService.fetchEnvelopesCalls
+        XCTAssertEqual(calls.map(\.count), [FetchStrategy.envelopeBatchSize, 3])
+        XCTAssertEqual(envelopes.count, uids.count)
+    }
+
+    func testCombinedPrefetchesNothing() async throws {
+        let uids = try await mockService.searchAll()
+
+        let envelopes = try await FetchStrategy.combined.prefetchEnvelopes(for: uids, using: mockService)
+
+        let calls = await mockService.fetchEnvelopesCalls
+        XCTAssertTrue(envelopes.isEmpty)
+        XCTAssertTrue(calls.isEmpty)
+    }
+
+    // MARK: - Response Splitting
+
+    func testFetchResponsesByUIDSplitsBatchedResponse() {
+        let response = "* 1 FETCH (UID 10 FLAGS (\\Seen) ENVELOPE (\"date\" \"One\" NIL NIL NIL NIL NIL NIL NIL \"<a@x>\"))\r\n"
+            + "* 2 FETCH (FLAGS () UID 12 ENVELOPE (\"date\" \"Two\" NIL NIL NIL NIL NIL NIL NIL \"<b@x>\"))\r\n"
+            + "* 2 FETCH (UID 12 FLAGS (\\Deleted))\r\n"
+            + "A0001 OK FETCH completed\r\n"
+
+        let split = IMAPService.fetchResponsesByUID(response)
+
+        XCTAssertEqual(Set(split.keys), [10, 12])
+        XCTAssertTrue(split[10]?.contains("\"One\"") == true)
+        // The first answer for a UID wins
+        XCTAssertTrue(split[12]?.contains("\"Two\"") == true)
+    }
+
+    func testAccountDecodesWithoutFetchStrategy() throws {
+        let json = """
+        {"id":"\(UUID().uuidString)","email":"a@example.com","imapServer":"imap.example.com","port":993,
+         "username":"a@example.com","useSSL":true,"isEnabled":true}
+        """
+        let account = try JSONDecoder().decode(EmailAccount.self, from: Data(json.utf8))
+        XCTAssertEqual(account.fetchStrategy, .combined)
+    }
+}
@@ -0,0 +1,174 @@
+import XCTest
+@testable import IMAPBackup
+
+final class FlagRefreshServiceTests: XCTestCase {
+
+    var tempDirectory: URL!
+    var storageService: StorageService!
+    var mockService: MockIMAPService!
+
+    let accountEmail = "test@example.com"
+
+    override func setUp() async throws {
+        try await super.setUp()
+
+        tempDirectory = FileManager.default.temporaryDirectory
+            .appendingPathComponent(UUID().uuidString)
+        try FileManager.default.createDirectory(at: tempDirectory, withIntermediateDirectories: true)
+        storageService = StorageService(baseURL: tempDirectory)
+
+        mockService = MockIMAPService()
+        for number in 1...3 {
+            var spec = MockMessageSpec()
+            spec.messageId = "msg-\(number)@example.com"
+            spec.subject = "Message \(number)"
+            await mockService.injectMessage(into: "INBOX", spec: spec)
+        }
+        try await mockService.connect()
+        try await mockService.login(password: "secret")
+    }
+
+    override func tearDown() async throws {
+        try? FileManager.default.removeItem(at: tempDirectory)
+        mockService = nil
+
+        try await super.tearDown()
+    }
+
+    /// Back up UIDs 1 and 2 with envelope sidecars and UID 3 without, returning the sidecar URLs
+    private func backUpInbox() async throws -> [UInt32: URL] {
+        _ = try await mockService.selectFolder("INBOX")
+        var sidecarURLs: [UInt32: URL] = [:]
+        for uid: UInt32 in 1...3 {
+            let data = try await mockService.fetchEmail(uid: uid)
+            let email = Email(messageId: "msg-\(uid)@example.com", uid: uid, folder: "INBOX", subject: "Message \(uid)",
+                              sender: "Sender", senderEmail: "sender@example.com", date: Date())
+            let url = try await storageService.saveEmail(data, email: email, accountEmail: accountEmail, folderPath: "INBOX")
+            guard uid < 3 else { continue }
+            let sidecar = EnvelopeSidecar(uid: uid, folder: "INBOX", response: try await mockService.fetchEnvelope(uid: uid))
+            sidecarURLs[uid] = try await storageService.saveEnvelopeSidecar(sidecar, for: url)
+        }
+        return sidecarURLs
+    }
+
+    private func readSidecar(_ url: URL) throws -> EnvelopeSidecar {
+        let decoder = JSONDecoder()
+        decoder.dateDecodingStrategy = .iso8601
+        return try decoder.decode(EnvelopeSidecar.self, from: Data(contentsOf: url))
+    }
+
+    // MARK: - Refresh
+
+    func testServerFlagChangesPropagateToMetadata() async throws {
+        await mockService.setAdvertisedCapabilities(["IMAP4REV1", "CONDSTORE"])
+        let sidecarURLs = try await backUpInbox()
+        let bodyCallsAfterBackup = await mockService.fetchEmailCalls
+        let before = try readSidecar(try XCTUnwrap(sidecarURLs[1]))
+        XCTAssertEqual(before.flags, [])
+        XCTAssertNil(before.flagsRefreshedAt)
+
+        // First refresh has nothing to start from and fetches all flags
+        let first = try await FlagRefreshService.refreshAccount(accountEmail: accountEmail, service: mockService, storageService: storageService)
+        XCTAssertEqual(first.foldersChecked, 1)
+        XCTAssertEqual(first.incrementalFolders, 0)
+        XCTAssertEqual(first.sidecarsUpdated, 0)
+
+        // Another client reads and stars UID 1
+        await mockService.setFlags(["\\Seen", "\\Flagged"], for: 1)
+
+        let second = try await FlagRefreshService.refreshAccount(accountEmail: accountEmail, service: mockService, storageService: storageService)
+        XCTAssertEqual(second.incrementalFolders, 1)
+        XCTAssertEqual(second.messagesReported, 1)
+        XCTAssertEqual(second.sidecarsUpdated, 1)
+
+        let after = try readSidecar(try XCTUnwrap(sidecarURLs[1]))
+        XCTAssertEqual(after.flags, ["\\Seen", "\\Flagged"])
+        XCTAssertEqual(after.flagLabels, ["read", "starred"])
+        XCTAssertNotNil(after.flagsRefreshedAt)
+        XCTAssertEqual(after.rawResponse, before.rawResponse)
+        XCTAssertEqual(try readSidecar(try XCTUnwrap(sidecarURLs[2])).flags, [])
+
+        // Only flags were fetched; the second refresh asked for changes since the first
+        let flagCalls = await mockService.fetchFlagsCalls
+        let bodyCalls = await mockService.fetchEmailCalls
+        XCTAssertEqual(flagCalls.count, 2)
+        XCTAssertNil(flagCalls[0])
+        XCTAssertNotNil(flagCalls[1])
+        XCTAssertEqual(bodyCalls, bodyCallsAfterBackup)
+    }
+
+    func testFullFlagFetchWithoutCondStore() async throws {
+        let sidecarURLs = try await backUpInbox()
+        await mockService.setFlags(["\\Answered"], for: 2)
+        await mockService.setFlags(["$Important"], for: 3)
+
+        let result = try await FlagRefreshService.refreshAccount(
+            accountEmail: accountEmail,
+            service: mockService,
+            storageService: storageService,
+            policy: .markRead
+        )
+
+        XCTAssertEqual(result.incrementalFolders, 0)
+        // UID 3 has no sidecar, so there is nothing to update for it
+        XCTAssertEqual(result.sidecarsUpdated, 2)
+        XCTAssertEqual(try readSidecar(try XCTUnwrap(sidecarURLs[1])).flags, ["\\Seen"])
+        XCTAssertEqual(try readSidecar(try XCTUnwrap(sidecarURLs[2])).flags, ["\\Answered", "\\Seen"])
+
+        let flagCalls = await mockService.fetchFlagsCalls
+        XCTAssertEqual(flagCalls, [nil])
+    }
+
+    func testFoldersWithoutSidecarsAreSkipped() async throws {
+        let result = try await FlagRefreshService.refreshAccount(accountEmail: accountEmail, service: mockService, storageService: storageService)
+
+        let flagCalls = await mockService.fetchFlagsCalls
+        XCTAssertEqual(result.foldersChecked, 0)
+        XCTAssertTrue(flagCalls.isEmpty)
+    }
+
+    func testRefreshAllLimitsConcurrentAccounts() async throws {
+        let accounts = (1...5).map { EmailAccount(email: "user\($0)@example.com", imapServer: "imap.example.com", username: "user\($0)") }
+        let counter = ConcurrencyCounter()
+
+        let results = await FlagRefreshService.refreshAll(accounts: accounts, maxConcurrentAccounts: 2) { account in
+            await counter.enter()
+            try? await Task.sleep(nanoseconds: 20_000_000)
+            await counter.leave()
+            return FlagRefreshResult(accountEmail: account.email)
+        }
+
+        let peak = await counter.peak
+        XCTAssertEqual(results.map(\.accountEmail), accounts.map(\.email))
+        XCTAssertEqual(peak, 2)
+    }
+
+    // MARK: - Parsing
+
+    func testParseFlagFetchReadsFlagsAndHighestModSeq() {
+        let response = "* 1 FETCH (UID 4 FLAGS (\\Seen $Label1) MODSEQ (120))\r\n"
+            + "* 2 FETCH (MODSEQ (98) UID 7 FLAGS ())\r\n"
+            + "A0001 OK FETCH completed\r\n"
+
+        let result = IMAPService.parseFlagFetch(response, isIncremental: true)
+
+        XCTAssertEqual(result.flags[4], ["\\Seen", "$Label1"])
+        XCTAssertEqual(result.flags[7], [])
+        XCTAssertEqual(result.highestModSeq, 120)
+        XCTAssertTrue(result.isIncremental)
+    }
+}
+
+private actor ConcurrencyCounter {
+    private var current = 0
+    private(set) var peak = 0
+
+    func enter() {
+        current += 1
+        peak = max(peak, current)
+    }
+
+    func leave() {
+        current -= 1
+    }
+}
@@ -0,0 +1,65 @@
+import XCTest
+@testable import IMAPBackup
+
+final class FolderSelectionTests: XCTestCase {
+
+    /// A provider that names its special-use folders its own way and flags them
+    let gmailFolders = [
+        IMAPFolder(name: "INBOX", delimiter: "/", flags: [], path: "INBOX"),
+        IMAPFolder(name: "[Gmail]/Sent Mail", delimiter: "/", flags: ["\\HasNoChildren", "\\Sent"], path: "[Gmail]/Sent Mail"),
+        IMAPFolder(name: "[Gmail]/Drafts", delimiter: "/", flags: ["\\Drafts"], path: "[Gmail]/Drafts"),
+        IMAPFolder(name: "Work/Projects", delimiter: "/", flags: [], path: "Work/Projects")
+    ]
+
+    func testSpecialUseNameResolvesToFlaggedFolder() {
+        let resolved = FolderSelection.resolve(["INBOX", "Sent"], in: gmailFolders)
+
+        XCTAssertEqual(resolved.folders.map(\.path), ["INBOX", "[Gmail]/Sent Mail"])
+        XCTAssertTrue(resolved.unmatched.isEmpty)
+    }
+
+    func testUnflaggedSpecialUseFallsBackToCommonNames() {
+        let folders = [
+            IMAPFolder(name: "inbox", delimiter: ".", flags: [], path: "inbox"),
+            IMAPFolder(name: "INBOX.Sent", delimiter: ".", flags: [], path: "INBOX/Sent"),
+            IMAPFolder(name: "Sent Items", delimiter: ".", flags: [], path: "Sent Items")
+        ]
+
+        // Matching ignores case and tries the raw name as well as the path
+        XCTAssertEqual(FolderSelection.folder(named: "INBOX", in: folders)?.path, "inbox")
+        XCTAssertEqual(FolderSelection.folder(named: "sent", in: folders)?.path, "Sent Items")
+        XCTAssertNil(FolderSelection.folder(named: "Spam", in: folders))
+    }
+
+    func testUnknownNamesAreReported() {
+        let resolved = FolderSelection.resolve(["work/projects", "Archive", "Missing"], in: gmailFolders)
+
+        XCTAssertEqual(resolved.folders.map(\.path), ["Work/Projects"])
+        XCTAssertEqual(resolved.unmatched, ["Archive", "Missing"])
+    }
+
+    func testAllFoldersOverridesDefaultFolders() {
+        let everything = FolderSelection.foldersToBackUp(gmailFolders, defaultFolders: ["INBOX"], allFolders: true)
+        XCTAssertEqual(everything.count, gmailFolders.count)
+
+        let unset = FolderSelection.foldersToBackUp(gmailFolders, defaultFolders: [], allFolders: false)
+        XCTAssertEqual(unset.count, gmailFolders.count)
+
+        let defaults = FolderSelection.foldersToBackUp(gmailFolders, defaultFolders: ["INBOX", "Sent"], allFolders: false)
+        XCTAssertEqual(defaults.map(\.path), ["INBOX", "[Gmail]/Sent Mail"])
+    }
+
+    func testSharedFoldersAreKeptWithDefaultFolders() {
+        var shared = IMAPFolder(name: "Other Users/alice/INBOX", delimiter: "/", flags: [], path: "shared/alice/INBOX")
+        shared.namespacePrefix = "Other Users/"
+
+        let folders = FolderSelection.foldersToBackUp(gmailFolders + [shared], defaultFolders: ["INBOX"], allFolders: false)
+
+        XCTAssertEqual(folders.map(\.path), ["INBOX", "shared/alice/INBOX"])
+    }
+
+    func testParseNames() {
+        XCTAssertEqual(FolderSelection.parseNames(" INBOX, Sent ,\nWork/Projects,, "), ["INBOX", "Sent", "Work/Projects"])
+        XCTAssertTrue(FolderSelection.parseNames("").isEmpty)
+    }
+}
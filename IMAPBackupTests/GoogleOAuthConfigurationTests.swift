@@ -0,0 +1,139 @@
+import XCTest
+@testable import IMAPBackup
+
+final class GoogleOAuthConfigurationTests: XCTestCase {
+
+    typealias Configuration = GoogleOAuthService.Configuration
+
+    var tempDirectory: URL!
+
+    override func setUp() async throws {
+        try await super.setUp()
+
+        tempDirectory = FileManager.default.temporaryDirectory
+            .appendingPathComponent(UUID().uuidString)
+        try FileManager.default.createDirectory(at: tempDirectory, withIntermediateDirectories: true)
+    }
+
+    override func tearDown() async throws {
+        try? FileManager.default.removeItem(at: tempDirectory)
+        try await super.tearDown()
+    }
+
+    private func writeClientSecretFile(_ json: String) throws -> String {
+        let url = tempDirectory.appendingPathComponent("client_secret_123.apps.googleusercontent.com.json")
+        try Data(json.utf8).write(to: url)
+        return url.path
+    }
+
+    private func resolve(
+        environment: [String: String] = [:],
+        clientSecretFile: String? = nil,
+        customClientId: String? = nil,
+        bundledClientId: String = "bundled.apps.googleusercontent.com",
+        bundledClientSecret: String = "bundled-secret"
+    ) throws -> Configuration {
+        try Configuration.resolve(
+            environment: environment,
+            clientSecretFile: clientSecretFile,
+            customClientId: customClientId,
+            bundledClientId: bundledClientId,
+            bundledClientSecret: bundledClientSecret
+        )
+    }
+
+    // MARK: - Sources
+
+    func testClientSecretFileFlowsIntoConfiguration() throws {
+        let path = try writeClientSecretFile("""
+        {"installed":{"client_id":"123-abc.apps.googleusercontent.com","client_secret":"file-secret",
+         "auth_uri":"https://accounts.google.com/o/oauth2/auth","redirect_uris":["http://localhost"]}}
+        """)
+
+        let config = try resolve(clientSecretFile: path, customClientId: "ignored.apps.googleusercontent.com")
+
+        XCTAssertEqual(config.clientId, "123-abc.apps.googleusercontent.com")
+        XCTAssertEqual(config.clientSecret, "file-secret")
+        XCTAssertEqual(config.redirectUri, "http://localhost")
+        XCTAssertTrue(config.usesLoopbackRedirect)
+    }
+
+    func testClientSecretFileWithoutLoopbackRedirectUsesReversedClientId() throws {
+        let path = try writeClientSecretFile("""
+        {"installed":{"client_id":"123-abc.apps.googleusercontent.com","client_secret":"file-secret",
+         "redirect_uris":["urn:ietf:wg:oauth:2.0:oob"]}}
+        """)
+
+        let config = try resolve(clientSecretFile: path)
+
+        XCTAssertEqual(config.redirectUri, "com.googleusercontent.apps.123-abc:/oauth2callback")
+        XCTAssertFalse(config.usesLoopbackRedirect)
+    }
+
+    func testClientSecretFileIsReadOnceUntilChosenAgain() throws {
+        let path = try writeClientSecretFile(#"{"installed":{"client_id":"first-id","client_secret":"first-secret"}}"#)
+        XCTAssertEqual(try resolve(clientSecretFile: path).clientId, "first-id")
+
+        _ = try writeClientSecretFile(#"{"installed":{"client_id":"second-id","client_secret":"second-secret"}}"#)
+        XCTAssertEqual(try resolve(clientSecretFile: path).clientId, "first-id")
+
+        Configuration.forgetClientSecretFile(at: path)
+        XCTAssertEqual(try resolve(clientSecretFile: path).clientId, "second-id")
+    }
+
+    func testEnvironmentOverridesFileAndBundledCredentials() throws {
+        let path = try writeClientSecretFile(#"{"web":{"client_id":"file-id","client_secret":"file-secret"}}"#)
+        let environment = [
+            Configuration.clientIdEnvironmentKey: " env-id.apps.googleusercontent.com\n",
+            Configuration.clientSecretEnvironmentKey: "env-secret"
+        ]
+
+        let config = try resolve(environment: environment, clientSecretFile: path)
+
+        XCTAssertEqual(config, Configuration(clientId: "env-id.apps.googleusercontent.com", clientSecret: "env-secret"))
+    }
+
+    func testBundledCredentialsUsedWhenNothingIsConfigured() throws {
+        let config = try resolve(customClientId: "")
+
+        XCTAssertEqual(config.clientId, "bundled.apps.googleusercontent.com")
+        XCTAssertEqual(config.clientSecret, "bundled-secret")
+    }
+
+    // MARK: - Validation
+
+    func testCustomClientIdIsNotPairedWithBundledSecret() {
+        XCTAssertThrowsError(try resolve(customClientId: "custom.apps.googleusercontent.com")) { error in
+            guard case GoogleOAuthError.missingClientSecret = error else {
+                return XCTFail("Expected missingClientSecret, got \(error)")
+            }
+        }
+    }
+
+    func testEmptyBundledCredentialsAreRejected() {
+        XCTAssertThrowsError(try resolve(bundledClientId: "", bundledClientSecret: "")) { error in
+            guard case GoogleOAuthError.notConfigured = error else {
+                return XCTFail("Expected notConfigured, got \(error)")
+            }
+        }
+        XCTAssertThrowsError(try resolve(bundledClientSecret: " ")) { error in
+            guard case GoogleOAuthError.missingClientSecret = error else {
+                return XCTFail("Expected missingClientSecret, got \(error)")
+            }
+        }
+        // Half an environment override is an error, not a fallback to the bundled pair
+        XCTAssertThrowsError(try resolve(environment: [Configuration.clientIdEnvironmentKey: "env-id"]))
+    }
+
+    func testMalformedClientSecretFileIsReported() throws {
+        let path = try writeClientSecretFile(#"{"client_id":"not-nested"}"#)
+
+        XCTAssertThrowsError(try resolve(clientSecretFile: path)) { error in
+            guard case GoogleOAuthError.invalidClientSecretFile(let reported) = error else {
+                return XCTFail("Expected invalidClientSecretFile, got \(error)")
+            }
+            XCTAssertEqual(reported, path)
+        }
+        XCTAssertThrowsError(try resolve(clientSecretFile: tempDirectory.appendingPathComponent("missing.json").path))
+    }
+}
@@ -1,4 +1,6 @@
 import XCTest
+import Network
+import Security
 @testable import IMAPBackup
 
 /// Unit tests for IMAP operations using MockIMAPService
@@ -58,6 +60,44 @@ final class IMAPServiceTests: XCTestCase {
         }
     }
 
+    func testLogoutAfterServerClosedConnectionSucceeds() async throws {
+        try await mockService.connect()
+        try await mockService.login(password: "test")
+        await mockService.setLogoutError(.connectionClosed)
+
+        try await mockService.logout()
+
+        let isOpen = await mockService.connectionIsOpen
+        XCTAssertFalse(isOpen)
+    }
+
+    func testLogoutSurfacesGenuineErrors() async throws {
+        try await mockService.connect()
+        try await mockService.login(password: "test")
+        await mockService.setLogoutError(.commandFailed("LOGOUT"))
+
+        do {
+            try await mockService.logout()
+            XCTFail("A refused LOGOUT should throw")
+        } catch IMAPError.commandFailed {
+            // Expected
+        }
+        let isOpen = await mockService.connectionIsOpen
+        XCTAssertFalse(isOpen)
+    }
+
+    func testClosedConnectionErrors() {
+        XCTAssertTrue(IMAPService.isClosedConnectionError(IMAPError.connectionClosed))
+        XCTAssertTrue(IMAPService.isClosedConnectionError(IMAPError.notConnected))
+        XCTAssertFalse(IMAPService.isClosedConnectionError(IMAPError.receiveFailed("timed out")))
+        XCTAssertFalse(IMAPService.isClosedConnectionError(IMAPError.authenticationFailed))
+
+        XCTAssertTrue(IMAPService.isClosedByPeer(.posix(.ECONNRESET)))
+        XCTAssertTrue(IMAPService.isClosedByPeer(.posix(.EPIPE)))
+        XCTAssertFalse(IMAPService.isClosedByPeer(.posix(.ETIMEDOUT)))
+        XCTAssertTrue(IMAPService.isRecoverableError(IMAPError.connectionClosed))
+    }
+
     func testLoginRequiresConnection() async {
         do {
             try await mockService.login(password: "test")
@@ -91,6 +131,419 @@ final class IMAPServiceTests: XCTestCase {
         }
     }
 
+    func testLoginDisabledRefusesPlaintextMechanisms() {
+        XCTAssertThrowsError(try IMAPService.passwordMechanisms(for: ["IMAP4REV1", "LOGINDISABLED"]))
+        XCTAssertThrowsError(try IMAPService.passwordMechanisms(for: ["IMAP4REV1", "AUTH=PLAIN", "LOGINDISABLED"])) { error in
+            XCTAssertTrue(error.localizedDescription.contains("SSL/TLS"))
+        }
+    }
+
+    // MARK: - TLS Certificate Tests
+
+    /// Self-signed server certificate for localhost, valid 2026-10-16 to 2027-11-17
+    private let selfSignedCertificate = "MIIBpTCCAUugAwIBAgIUBnBtDyg8pDzX3/Jhxu/Nchfa7ccwCgYIKoZIzj0EAwIwFDESMBAGA1UEAwwJbG9jYWxob3N0MB4XDTI2MTAxNjEzMjIxNFoXDTI3MTExNzEzMjIxNFowFDESMBAGA1UEAwwJbG9jYWxob3N0MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAEIeEs6l2ul4uSMtxhJIpB01kqYPHl/IkQmbEj3NiHDLGGEgOW4KuYdkDTvInNmDa5nEOjYrlKNoP54IMH0kDbC6N7MHkwHQYDVR0OBBYEFC2CDNRVB8DUJGYhytFRTGOklpvRMB8GA1UdIwQYMBaAFC2CDNRVB8DUJGYhytFRTGOklpvRMBQGA1UdEQQNMAuCCWxvY2FsaG9zdDATBgNVHSUEDDAKBggrBgEFBQcDATAMBgNVHRMBAf8EAjAAMAoGCCqGSM49BAMCA0gAMEUCIEIaFCfK6lDh6ekKXKcM+glq/Br3UU6Bq+rqsPbMCfi/AiEA3gbWDxpoVthHEIs5vMZ9/eJdAaBAI8MukSw6ke5PDgM="
+
+    /// Evaluate the test certificate as a TLS server certificate for `host` and record why it is refused
+    private func refusal(host: String, at date: Date, trustingCertificate: Bool) throws -> TLSFailure.Reason? {
+        let data = try XCTUnwrap(Data(base64Encoded: selfSignedCertificate))
+        let certificate = try XCTUnwrap(SecCertificateCreateWithData(nil, data as CFData))
+
+        var trust: SecTrust?
+        XCTAssertEqual(SecTrustCreateWithCertificates(certificate, SecPolicyCreateSSL(true, host as CFString), &trust), errSecSuccess)
+        let secTrust = try XCTUnwrap(trust)
+        SecTrustSetVerifyDate(secTrust, date as CFDate)
+        SecTrustSetNetworkFetchAllowed(secTrust, false)
+        if trustingCertificate {
+            SecTrustSetAnchorCertificates(secTrust, [certificate] as CFArray)
+            SecTrustSetAnchorCertificatesOnly(secTrust, true)
+        }
+
+        var error: CFError?
+        guard !SecTrustEvaluateWithError(secTrust, &error) else { return nil }
+        let recorder = TLSTrustRecorder()
+        recorder.record(error)
+        return recorder.failure?.reason
+    }
+
+    func testSelfSignedCertificateRefusalsAreClassified() throws {
+        let valid = Date(timeIntervalSince1970: 1_795_000_000) // 2026-11-18
+        let expired = Date(timeIntervalSince1970: 1_830_000_000) // 2027-12-28
+
+        XCTAssertEqual(try refusal(host: "localhost", at: valid, trustingCertificate: false), .unknownAuthority)
+        XCTAssertNil(try refusal(host: "localhost", at: valid, trustingCertificate: true))
+        XCTAssertEqual(try refusal(host: "imap.example.com", at: valid, trustingCertificate: true), .hostnameMismatch)
+        XCTAssertEqual(try refusal(host: "localhost", at: expired, trustingCertificate: true), .expired)
+    }
+
+    func testTLSConnectionErrorsAreReportedAsCertificateProblems() {
+        let recorded = IMAPService.connectionError(
+            .tls(errSSLBadCert),
+            host: "imap.example.com",
+            trustFailure: (.hostnameMismatch, "Host name mismatch")
+        )
+        guard case .tlsFailed(let failure) = recorded else {
+            return XCTFail("Expected a TLS failure, got \(recorded)")
+        }
+        XCTAssertEqual(failure.reason, .hostnameMismatch)
+        XCTAssertTrue(recorded.localizedDescription.contains("TLS Server Name"))
+        XCTAssertEqual(FailureKind.classify(recorded), .tls)
+        XCTAssertFalse(IMAPService.isRecoverableError(recorded))
+
+        // Without a trust evaluation the status still tells
+        guard case .tlsFailed(let expired) = IMAPService.connectionError(.tls(errSSLCertExpired), host: "imap.example.com", trustFailure: nil) else {
+            return XCTFail("Expected a TLS failure")
+        }
+        XCTAssertEqual(expired.reason, .expired)
+        XCTAssertEqual(TLSFailure.reason(forStatus: errSSLProtocol), .handshake)
+
+        guard case .connectionFailed = IMAPService.connectionError(.posix(.ECONNREFUSED), host: "imap.example.com", trustFailure: nil) else {
+            return XCTFail("A refused connection is not a TLS problem")
+        }
+    }
+
+    // MARK: - Password Mechanism Tests
+
+    func testPasswordMechanismPrefersPlain() throws {
+        let mechanisms = try IMAPService.passwordMechanisms(for: ["IMAP4REV1", "AUTH=CRAM-MD5", "AUTH=PLAIN"])
+        XCTAssertEqual(mechanisms, [.plain, .cramMD5, .login])
+    }
+
+    func testPasswordMechanismCramMD5() throws {
+        XCTAssertEqual(try IMAPService.passwordMechanisms(for: ["IMAP4REV1", "AUTH=CRAM-MD5"]), [.cramMD5, .login])
+
+        // CRAM-MD5 never exposes the password, so LOGINDISABLED still allows it
+        XCTAssertEqual(try IMAPService.passwordMechanisms(for: ["AUTH=CRAM-MD5", "LOGINDISABLED"]), [.cramMD5])
+    }
+
+    func testPasswordMechanismFallsBackToLogin() throws {
+        XCTAssertEqual(try IMAPService.passwordMechanisms(for: ["IMAP4REV1"]), [.login])
+    }
+
+    func testPlainResponse() {
+        let response = IMAPService.plainResponse(username: "user", password: "pass")
+        XCTAssertEqual(Data(base64Encoded: response), Data("\0user\0pass".utf8))
+    }
+
+    func testCramMD5Response() {
+        // Example from RFC 2195
+        let challenge = Data("<1896.697170952@postoffice.reston.mci.net>".utf8).base64EncodedString()
+        let response = IMAPService.cramMD5Response(username: "tim", password: "tanstaaftanstaaf", challenge: challenge)
+
+        XCTAssertEqual(
+            String(data: Data(base64Encoded: response)!, encoding: .utf8),
+            "tim b913a602c7eda7a495b4e6e7334d3890"
+        )
+    }
+
+    // MARK: - Client Identification Tests
+
+    func testIDCommandFormat() {
+        XCTAssertEqual(
+            IMAPService.idCommand(["version": "1.0", "name": "MailKeep"]),
+            #"ID ("name" "MailKeep" "version" "1.0")"#
+        )
+        XCTAssertEqual(IMAPService.idCommand(["name": #"Say "hi""#]), #"ID ("name" "Say \"hi\"")"#)
+        XCTAssertEqual(IMAPService.idCommand([:]), "ID NIL")
+    }
+
+    func testParseIDResponse() {
+        let response = "* ID (\"name\" \"Dovecot\" \"version\" NIL)\r\nA0003 OK ID completed\r\n"
+        XCTAssertEqual(IMAPService.parseIDResponse(response), ["name": "Dovecot"])
+        XCTAssertEqual(IMAPService.parseIDResponse("* ID NIL\r\nA0003 OK\r\n"), [:])
+    }
+
+    func testClientIdentificationFields() {
+        let fields = IMAPService.clientIdentification
+        XCTAssertEqual(fields["name"], "MailKeep")
+        XCTAssertNotNil(fields["version"])
+    }
+
+    func testSendClientIDRequiresCapability() async throws {
+        try await mockService.connect()
+        try await mockService.login(password: "test")
+
+        do {
+            _ = try await mockService.sendClientID(IMAPService.clientIdentification)
+            XCTFail("Expected ID to be rejected without the capability")
+        } catch {
+            // Expected
+        }
+
+        await mockService.setSupportsID(true)
+        let server = try await mockService.sendClientID(IMAPService.clientIdentification)
+        XCTAssertEqual(server, ["name": "MockIMAP", "version": "1.0"])
+    }
+
+    func testMockServerReceivesClientID() async throws {
+        await mockService.setSupportsID(true)
+        try await mockService.connect()
+        try await mockService.login(password: "test")
+
+        let capabilities = try await mockService.capabilities()
+        XCTAssertTrue(capabilities.contains("ID"))
+
+        _ = try await mockService.sendClientID(["name": "MailKeep", "version": "2.0"])
+
+        let received = await mockService.receivedClientID
+        XCTAssertEqual(received, ["name": "MailKeep", "version": "2.0"])
+        let commands = await mockService.idCommands
+        XCTAssertEqual(commands, [#"ID ("name" "MailKeep" "version" "2.0")"#])
+    }
+
+    func testMockServerHandlesRawIDCommand() async {
+        await mockService.setSupportsID(true)
+
+        let response = await mockService.handleIDCommand("A0005", #"ID ("name" "Client \"X\"" "os" NIL)"#)
+        XCTAssertEqual(response, "* ID (\"name\" \"MockIMAP\" \"version\" \"1.0\")\r\nA0005 OK ID completed\r\n")
+
+        let received = await mockService.receivedClientID
+        XCTAssertEqual(received, ["name": #"Client "X""#])
+
+        let nilResponse = await mockService.handleIDCommand("A0006", "ID NIL")
+        XCTAssertTrue(nilResponse.hasSuffix("A0006 OK ID completed\r\n"))
+        let cleared = await mockService.receivedClientID
+        XCTAssertEqual(cleared, [:])
+    }
+
+    func testMockServerRejectsIDWhenDisabled() async {
+        let response = await mockService.handleIDCommand("A0007", "ID NIL")
+        XCTAssertEqual(response, "A0007 BAD Unknown command\r\n")
+    }
+
+    func testEmailAccountSendsClientIDByDefault() {
+        XCTAssertTrue(EmailAccount(email: "test@example.com", imapServer: "imap.example.com").sendClientID)
+    }
+
+    // MARK: - Referral Tests
+
+    func testParseReferralURL() {
+        let referral = IMAPReferral(url: "imap://user;AUTH=*@imap2.example.com:1993/Shared%20Box")
+        XCTAssertEqual(referral?.host, "imap2.example.com")
+        XCTAssertEqual(referral?.port, 1993)
+        XCTAssertEqual(referral?.mailbox, "Shared Box")
+
+        let bare = IMAPReferral(url: "imap://imap2.example.com/")
+        XCTAssertEqual(bare?.host, "imap2.example.com")
+        XCTAssertNil(bare?.port)
+        XCTAssertNil(bare?.mailbox)
+
+        XCTAssertNil(IMAPReferral(url: "https://example.com"))
+    }
+
+    func testParseReferralFromResponse() {
+        let response = "A0002 NO [REFERRAL IMAP://imap2.example.com/] Account moved\r\n"
+        XCTAssertEqual(IMAPReferral(response: response)?.host, "imap2.example.com")
+        XCTAssertNil(IMAPReferral(response: "A0002 NO [AUTHENTICATIONFAILED] Invalid credentials\r\n"))
+    }
+
+    func testReferralErrorNamesServer() {
+        let message = IMAPError.referral("imap://imap2.example.com/").errorDescription ?? ""
+        XCTAssertTrue(message.contains("imap://imap2.example.com/"))
+        XCTAssertTrue(message.contains("change the account's IMAP server to imap2.example.com"))
+    }
+
+    func testReferralsOnlyFollowedWithinDomain() {
+        let account = EmailAccount(email: "test@example.com", imapServer: "imap.example.com")
+        XCTAssertTrue(IMAPService.isReferralAllowed(to: "imap2.Example.com", for: account))
+        XCTAssertTrue(IMAPService.isReferralAllowed(to: "imap.example.com.", for: account))
+        XCTAssertFalse(IMAPService.isReferralAllowed(to: "imap.attacker.net", for: account))
+        XCTAssertFalse(IMAPService.isReferralAllowed(to: "notexample.com", for: account))
+        XCTAssertFalse(account.followReferrals)
+
+        // Sharing a public suffix is not sharing a domain
+        let uk = EmailAccount(email: "me@foo.co.uk", imapServer: "imap.foo.co.uk")
+        XCTAssertTrue(IMAPService.isReferralAllowed(to: "imap2.foo.co.uk", for: uk))
+        XCTAssertFalse(IMAPService.isReferralAllowed(to: "evil.co.uk", for: uk))
+        XCTAssertFalse(IMAPService.isReferralAllowed(to: "imap.evil.co.uk", for: uk))
+    }
+
+    func testMockServerLoginReferralIsReported() async throws {
+        await mockService.setLoginReferral("imap://imap2.example.com/")
+        try await mockService.connect()
+
+        do {
+            try await mockService.login(password: "test")
+            XCTFail("Expected referral error")
+        } catch IMAPError.referral(let url) {
+            XCTAssertEqual(url, "imap://imap2.example.com/")
+        }
+
+        do {
+            _ = try await mockService.listFolders()
+            XCTFail("Should not be logged in after a referral")
+        } catch IMAPError.notConnected {
+            // Expected
+        }
+    }
+
+    func testMockServerSelectReferralIsReported() async throws {
+        await mockService.setFolderReferral("Sent", to: "imap://archive.example.com/Sent")
+        try await mockService.connect()
+        try await mockService.login(password: "test")
+
+        do {
+            _ = try await mockService.selectFolder("Sent")
+            XCTFail("Expected referral error")
+        } catch IMAPError.referral(let url) {
+            XCTAssertEqual(IMAPReferral(url: url)?.mailbox, "Sent")
+        }
+
+        _ = try await mockService.selectFolder("INBOX")
+    }
+
+    // MARK: - Server Info Tests
+
+    func testParseServerGreetings() {
+        let gmail = IMAPServerInfo.parse(greeting: "* OK Gimap ready for requests from 203.0.113.5 a1mb12345678qkb\r\n")
+        XCTAssertEqual(gmail.software, "Gmail")
+        XCTAssertEqual(gmail.quirks.maxConnections, 15)
+
+        let dovecot = IMAPServerInfo.parse(
+            greeting: "* OK [CAPABILITY IMAP4rev1 SASL-IR LOGIN-REFERRALS ID ENABLE IDLE LITERAL+ AUTH=PLAIN] Dovecot (Ubuntu) ready.\r\n"
+        )
+        XCTAssertEqual(dovecot.software, "Dovecot")
+        XCTAssertNil(dovecot.version)
+        XCTAssertEqual(dovecot.greeting, "[CAPABILITY IMAP4rev1 SASL-IR LOGIN-REFERRALS ID ENABLE IDLE LITERAL+ AUTH=PLAIN] Dovecot (Ubuntu) ready.")
+
+        let cyrus = IMAPServerInfo.parse(greeting: "* OK mail.example.com Cyrus IMAP v2.4.17-Debian-2.4.17 server ready")
+        XCTAssertEqual(cyrus.software, "Cyrus IMAP")
+        XCTAssertEqual(cyrus.version, "2.4.17-Debian-2.4.17")
+        XCTAssertEqual(cyrus.description, "Cyrus IMAP 2.4.17-Debian-2.4.17")
+
+        let exchange = IMAPServerInfo.parse(greeting: "* OK The Microsoft Exchange IMAP4 service is ready. [TQBOADIAUABSADEAMAA=]")
+        XCTAssertEqual(exchange.software, "Microsoft Exchange")
+        XCTAssertNil(exchange.quirks.maxConnections)
+
+        let uw = IMAPServerInfo.parse(greeting: "* OK [CAPABILITY IMAP4REV1 LITERAL+] localhost IMAP4rev1 2007f.404 at Mon, 1 Jan 2024")
+        XCTAssertEqual(uw.software, "UW IMAP")
+        XCTAssertEqual(uw.version, "2007f.404")
+
+        let unknown = IMAPServerInfo.parse(greeting: "* OK IMAP4rev1 Service Ready")
+        XCTAssertNil(unknown.software)
+        XCTAssertEqual(unknown.description, "Unknown server")
+        XCTAssertEqual(unknown.quirks, IMAPServerQuirks())
+    }
+
+    func testServerInfoAfterConnect() async throws {
+        let before = await mockService.serverInfo()
+        XCTAssertNil(before)
+
+        try await mockService.connect()
+        let info = await mockService.serverInfo()
+        XCTAssertEqual(info?.greeting, "[CAPABILITY IMAP4rev1] MockIMAP ready")
+        XCTAssertNil(info?.software)
+    }
+
+    // MARK: - Namespace Tests
+
+    func testParseNamespaceResponse() {
+        let cyrus = #"* NAMESPACE (("INBOX." ".")) (("user." ".")) (("" "." "X-PARAM" ("flag1")))"# + "\r\nA0003 OK\r\n"
+        let namespaces = IMAPNamespaces.parse(cyrus)
+        XCTAssertEqual(namespaces?.personal, [IMAPNamespace(prefix: "INBOX.", delimiter: ".")])
+        XCTAssertEqual(namespaces?.otherUsers, [IMAPNamespace(prefix: "user.", delimiter: ".")])
+        XCTAssertEqual(namespaces?.shared, [IMAPNamespace(prefix: "", delimiter: ".")])
+
+        let flat = IMAPNamespaces.parse(#"* NAMESPACE (("" NIL)) NIL NIL"#)
+        XCTAssertEqual(flat?.personal, [IMAPNamespace(prefix: "", delimiter: "")])
+        XCTAssertEqual(flat?.otherUsers, [])
+
+        XCTAssertNil(IMAPNamespaces.parse("A0003 BAD Unknown command"))
+    }
+
+    func testListUsesNamespaceDelimiterForNilDelimiter() {
+        let response = #"* LIST (\HasNoChildren) NIL "Archive""# + "\r\n"
+            + #"* LIST (\HasNoChildren) "." "INBOX.Sent""# + "\r\n"
+        let folders = IMAPService.parseListResponse(response, defaultDelimiter: ".")
+
+        XCTAssertEqual(folders.map(\.path), ["Archive", "INBOX/Sent"])
+        XCTAssertEqual(folders.first?.delimiter, ".")
+    }
+
+    // MARK: - Folder Name Encoding
+
+    func testListDecodesModifiedUTF7Names() {
+        let response = #"* LIST (\HasNoChildren) "/" "Gel&APY-scht""# + "\r\n"
+            + #"* LIST (\HasNoChildren) "/" "Archiv/&AMQ-rger &- Co""# + "\r\n"
+            + "A0004 OK LIST completed\r\n"
+        let folders = IMAPService.parseListResponse(response)
+
+        XCTAssertEqual(folders.map(\.name), ["Gelöscht", "Archiv/Ärger & Co"])
+        XCTAssertEqual(folders.map(\.path), ["Gelöscht", "Archiv/Ärger & Co"])
+
+        // Re-encoded the same way for SELECT and APPEND
+        XCTAssertEqual("Gelöscht".imapQuotedMailbox, "Gel&APY-scht")
+        XCTAssertEqual("Archiv/Ärger & Co".imapQuotedMailbox, "Archiv/&AMQ-rger &- Co")
+    }
+
+    func testListParsesLiteralAndEscapedNames() {
+        let response = "* LIST (\\HasNoChildren) \"/\" {12}\r\nGel&APY-scht\r\n"
+            + #"* LIST (\HasNoChildren) "/" "Say \"hi\"""# + "\r\n"
+            + #"* LIST (\Noselect) "\\" Projects"# + "\r\n"
+            + "A0004 OK LIST completed\r\n"
+        let folders = IMAPService.parseListResponse(response)
+
+        XCTAssertEqual(folders.map(\.name), ["Gelöscht", "Say \"hi\"", "Projects"])
+        XCTAssertEqual(folders.last?.delimiter, "\\")
+        XCTAssertEqual("Say \"hi\"".imapQuotedMailbox, #"Say \"hi\""#)
+    }
+
+    func testMockServerReturnsNamespaces() async throws {
+        try await mockService.connect()
+        try await mockService.login(password: "test")
+
+        let unsupported = try await mockService.namespaces()
+        XCTAssertNil(unsupported)
+
+        await mockService.setNamespaceResponse(#"* NAMESPACE (("INBOX." ".")) NIL (("Public." "."))"#)
+        let namespaces = try await mockService.namespaces()
+        XCTAssertEqual(namespaces?.personal.first, IMAPNamespace(prefix: "INBOX.", delimiter: "."))
+        XCTAssertEqual(namespaces?.shared.first?.prefix, "Public.")
+    }
+
+    func testSharedLocalPaths() {
+        let otherUsers = IMAPNamespace(prefix: "user.", delimiter: ".")
+        XCTAssertEqual(IMAPService.sharedLocalPath(for: "user.bob.Sent", in: otherUsers, isOtherUsers: true), "shared/bob/Sent")
+        XCTAssertEqual(IMAPService.sharedLocalPath(for: "user.bob", in: otherUsers, isOtherUsers: true), "shared/bob/INBOX")
+
+        let publicFolders = IMAPNamespace(prefix: "Public/", delimiter: "/")
+        XCTAssertEqual(IMAPService.sharedLocalPath(for: "Public/Team/Docs", in: publicFolders, isOtherUsers: false), "shared/Public/Team/Docs")
+
+        let unprefixed = IMAPNamespace(prefix: "", delimiter: ".")
+        XCTAssertEqual(IMAPService.sharedLocalPath(for: "Support.Tickets", in: unprefixed, isOtherUsers: false), "shared/Support/Tickets")
+    }
+
+    func testMockServerListsMultipleNamespaces() async throws {
+        await mockService.setNamespaceResponse(#"* NAMESPACE (("INBOX." ".")) (("user." ".")) (("Public." "."))"#)
+        await mockService.setSharedFolderNames(["user.alice", "user.alice.Spam", "user.bob.Projects", "Public.Team", "Other.Folder"])
+        try await mockService.connect()
+        try await mockService.login(password: "test")
+
+        let shared = try await mockService.listSharedFolders()
+        XCTAssertEqual(shared.map(\.path), [
+            "shared/alice/INBOX", "shared/alice/Spam", "shared/bob/Projects", "shared/Public/Team"
+        ])
+        XCTAssertEqual(shared.map(\.namespacePrefix), ["user.", "user.", "user.", "Public."])
+
+        // Personal folders keep their own paths
+        let personal = try await mockService.listFolders()
+        XCTAssertTrue(personal.allSatisfy { $0.namespacePrefix == nil })
+
+        var account = EmailAccount(email: "test@example.com", imapServer: "imap.example.com")
+        account.sharedFolderFilters = EmailAccount.parseSharedFolderFilters("user. exclude *.Spam\nPublic. include Archive*")
+        XCTAssertEqual(shared.filter { account.includesSharedFolder($0) }.map(\.path), [
+            "shared/alice/INBOX", "shared/bob/Projects"
+        ])
+    }
+
+    func testSharedFolderFiltersRoundTrip() {
+        let text = "\"\" exclude Trash*\nuser. include alice*\nuser. exclude *.Spam"
+        let filters = EmailAccount.parseSharedFolderFilters(text)
+        XCTAssertEqual(filters[""], SharedFolderFilter(include: [], exclude: ["Trash*"]))
+        XCTAssertEqual(filters["user."], SharedFolderFilter(include: ["alice*"], exclude: ["*.Spam"]))
+        XCTAssertEqual(EmailAccount.formatSharedFolderFilters(filters), text)
+        XCTAssertFalse(EmailAccount(email: "test@example.com", imapServer: "imap.example.com").backupSharedFolders)
+    }
+
     // MARK: - Folder Tests
 
     func testListFolders() async throws {
@@ -105,6 +558,55 @@ final class IMAPServiceTests: XCTestCase {
         XCTAssertTrue(folders.contains { $0.name == "Trash" })
     }
 
+    func testListFoldersRetriesOnFreshConnectionAfterFailure() async throws {
+        try await mockService.connect()
+        try await mockService.login(password: "test")
+        await mockService.setListFailures(1)
+
+        let folders = try await mockService.listFolders()
+
+        let listCount = await mockService.listFoldersCallCount
+        let reconnects = await mockService.reconnectCount
+        let connectCount = await mockService.connectCallCount
+        XCTAssertEqual(folders.map(\.name), ["INBOX", "Sent", "Drafts", "Trash"])
+        XCTAssertEqual(listCount, 2)
+        XCTAssertEqual(reconnects, 1)
+        XCTAssertEqual(connectCount, 2)
+    }
+
+    func testListFoldersGivesUpAfterMaxAttempts() async throws {
+        try await mockService.connect()
+        try await mockService.login(password: "test")
+        await mockService.setListFailures(Constants.maxRetryAttempts)
+
+        do {
+            _ = try await mockService.listFolders()
+            XCTFail("Expected the last failure to be thrown")
+        } catch IMAPError.receiveFailed {
+            // Expected
+        }
+
+        let listCount = await mockService.listFoldersCallCount
+        XCTAssertEqual(listCount, Constants.maxRetryAttempts)
+    }
+
+    func testRetryOnlyRetriesConnectionFailures() async throws {
+        var attempts = 0
+        do {
+            _ = try await IMAPService.withRetry("LIST", baseDelay: 0) { () async throws -> Int in
+                attempts += 1
+                throw IMAPError.authenticationFailed
+            } beforeRetry: {}
+            XCTFail("Expected authentication error")
+        } catch IMAPError.authenticationFailed {
+            // Expected
+        }
+        XCTAssertEqual(attempts, 1)
+
+        XCTAssertTrue(IMAPService.isTransientError(IMAPError.receiveFailed("reset")))
+        XCTAssertFalse(IMAPService.isTransientError(IMAPError.notConnected))
+    }
+
     func testSelectFolder() async throws {
         try await mockService.connect()
         try await mockService.login(password: "test")
@@ -204,6 +706,310 @@ final class IMAPServiceTests: XCTestCase {
         XCTAssertEqual(size, data.count)
     }
 
+    func testFetchFallsBackWhenPeekIsRefused() async throws {
+        let message = Data("Subject: Fallback\r\n\r\nBody".utf8)
+        var requested: [BodyFetchItem] = []
+
+        // Server that refuses BODY.PEEK[] for this message but answers RFC822.PEEK
+        let data = try await IMAPService.fetchFirstNonEmpty(uid: 7, items: BodyFetchItem.fallbackOrder) { item in
+            requested.append(item)
+            guard item == .rfc822Peek else {
+                throw IMAPError.fetchFailed("UID 7: A0002 NO [SERVERBUG] BODY[] not available")
+            }
+            return message
+        }
+
+        XCTAssertEqual(data, message)
+        XCTAssertEqual(requested, [.peek, .rfc822Peek])
+    }
+
+    func testFetchFallsBackWhenFetchReturnsNoData() async throws {
+        let message = Data("Subject: Fallback\r\n\r\nBody".utf8)
+
+        let data = try await IMAPService.fetchFirstNonEmpty(uid: 7, items: BodyFetchItem.fallbackOrder) { item in
+            item == .rfc822Peek ? message : Data()
+        }
+
+        XCTAssertEqual(data, message)
+    }
+
+    func testFetchFailsWhenEveryItemIsRefused() async {
+        var requested: [BodyFetchItem] = []
+
+        do {
+            _ = try await IMAPService.fetchFirstNonEmpty(uid: 7, items: BodyFetchItem.fallbackOrder) { item in
+                requested.append(item)
+                throw IMAPError.fetchFailed("UID 7: A0002 NO \(item.rawValue) not available")
+            }
+            XCTFail("Expected the fetch to fail")
+        } catch {
+            XCTAssertTrue(error.localizedDescription.contains("RFC822.PEEK"))
+        }
+        XCTAssertEqual(requested, BodyFetchItem.fallbackOrder)
+    }
+
+    func testFetchPrefersPeek() async throws {
+        var requested: [BodyFetchItem] = []
+
+        _ = try await IMAPService.fetchFirstNonEmpty(uid: 7, items: BodyFetchItem.fallbackOrder) { item in
+            requested.append(item)
+            return Data("Subject: x\r\n\r\n".utf8)
+        }
+
+        XCTAssertEqual(requested, [.peek])
+    }
+
+    func testPeekFetchLeavesSeenUntouched() async throws {
+        try await mockService.connect()
+        try await mockService.login(password: "test")
+        _ = try await mockService.selectFolder("INBOX")
+        await mockService.setMessageFlags(["\\Flagged"], for: 1)
+
+        _ = try await mockService.fetchEmail(uid: 1)
+
+        let envelope = try await mockService.fetchEnvelope(uid: 1)
+        XCTAssertTrue(envelope.contains("FLAGS (\\Flagged)"))
+        XCTAssertFalse(envelope.contains("\\Seen"))
+    }
+
+    func testRFC822FallbackWhenPeekIsRefused() async throws {
+        try await mockService.connect()
+        try await mockService.login(password: "test")
+        _ = try await mockService.selectFolder("INBOX")
+        await mockService.setPeekRefusedUIDs([2])
+
+        let data = try await mockService.fetchEmail(uid: 2)
+        XCTAssertTrue(String(decoding: data, as: UTF8.self).contains("Test Email 2"))
+
+        // The fallback is a peek too, so the message stays unread
+        let envelope = try await mockService.fetchEnvelope(uid: 2)
+        XCTAssertFalse(envelope.contains("\\Seen"))
+    }
+
+    func testExamineRefusedFallsBackToSelectWithoutMarkingRead() async throws {
+        try await mockService.connect()
+        try await mockService.login(password: "test")
+        await mockService.setExamineRefusedFolders(["INBOX"])
+        await mockService.setPeekRefusedUIDs([2])
+
+        let status = try await mockService.examineFolder("INBOX")
+        XCTAssertEqual(status.exists, 3)
+        let commands = await mockService.openFolderCommands
+        XCTAssertEqual(commands, ["EXAMINE INBOX", "SELECT INBOX"])
+
+        // Read-write now, but every body item is a peek, the fallback for UID 2 included
+        let data = try await mockService.fetchEmail(uid: 1)
+        XCTAssertTrue(String(decoding: data, as: UTF8.self).contains("Test Email 1"))
+        _ = try await mockService.fetchEmail(uid: 2)
+        for uid: UInt32 in [1, 2] {
+            let envelope = try await mockService.fetchEnvelope(uid: uid)
+            XCTAssertFalse(envelope.contains("\\Seen"))
+        }
+    }
+
+    func testExamineKeepsReadOnlySelectionWhenAccepted() async throws {
+        var commands: [String] = []
+        let result = try await IMAPService.examineWithFallback("INBOX") { command in
+            commands.append(command)
+            return "A0003 OK [READ-ONLY] EXAMINE completed\r\n"
+        }
+        XCTAssertTrue(result.readOnly)
+        XCTAssertEqual(commands, ["EXAMINE"])
+
+        // BAD is a refusal too; the SELECT answer is what the caller gets
+        commands = []
+        let downgraded = try await IMAPService.examineWithFallback("Shared") { command in
+            commands.append(command)
+            return command == "EXAMINE" ? "A0003 BAD Command not allowed\r\n" : "* 4 EXISTS\r\nA0004 OK [READ-WRITE] SELECT completed\r\n"
+        }
+        XCTAssertFalse(downgraded.readOnly)
+        XCTAssertEqual(commands, ["EXAMINE", "SELECT"])
+        XCTAssertTrue(downgraded.response.contains("4 EXISTS"))
+
+        XCTAssertEqual(BodyFetchItem.fallbackOrder.map(\.rawValue), ["BODY.PEEK[]", "RFC822.PEEK"])
+    }
+
+    func testFetchFallbackDoesNotRetryBandwidthErrors() async {
+        var requested: [BodyFetchItem] = []
+
+        do {
+            _ = try await IMAPService.fetchFirstNonEmpty(uid: 7, items: BodyFetchItem.fallbackOrder) { item in
+                requested.append(item)
+                throw IMAPError.bandwidthLimitExceeded("NO [OVERQUOTA]")
+            }
+            XCTFail("Expected bandwidth error")
+        } catch IMAPError.bandwidthLimitExceeded {
+            XCTAssertEqual(requested, [.peek])
+        } catch {
+            XCTFail("Unexpected error: \(error)")
+        }
+    }
+
+    // MARK: - Size Verification Tests
+
+    func testDownloadShorterThanReportedSizeIsSuspect() async throws {
+        try await mockService.connect()
+        try await mockService.login(password: "test")
+        _ = try await mockService.selectFolder("INBOX")
+        await mockService.addEmail(to: "INBOX", uid: 7, content: "Subject: Cut off\r\n\r\nThe first part")
+        // The server says there is much more than it sends
+        await mockService.setReportedSize(5000, for: 7)
+
+        let reportedSize = try await mockService.fetchEmailSize(uid: 7)
+        let result = try await IMAPService.fetchVerifyingSize(uid: 7, reportedSize: reportedSize) {
+            try await self.mockService.fetchEmail(uid: 7)
+        }
+
+        XCTAssertFalse(result.sizeMatches)
+        // Fetched once more before giving up
+        let calls = await mockService.fetchEmailCalls
+        XCTAssertEqual(calls, [7, 7])
+    }
+
+    func testDownloadMatchingReportedSizeIsFetchedOnce() async throws {
+        try await mockService.connect()
+        try await mockService.login(password: "test")
+        _ = try await mockService.selectFolder("INBOX")
+        await mockService.addEmail(to: "INBOX", uid: 8, content: "Subject: Complete\r\n\r\nAll of it")
+
+        let reportedSize = try await mockService.fetchEmailSize(uid: 8)
+        let result = try await IMAPService.fetchVerifyingSize(uid: 8, reportedSize: reportedSize) {
+            try await self.mockService.fetchEmail(uid: 8)
+        }
+
+        XCTAssertTrue(result.sizeMatches)
+        let calls = await mockService.fetchEmailCalls
+        XCTAssertEqual(calls, [8])
+    }
+
+    func testSizeToleranceAllowsLineEndingDifferences() {
+        XCTAssertTrue(IMAPService.sizeMatches(reported: 1000, actual: 990))
+        XCTAssertTrue(IMAPService.sizeMatches(reported: 0, actual: 1234))
+        XCTAssertTrue(IMAPService.sizeMatches(reported: 1_000_000, actual: 999_200))
+        XCTAssertFalse(IMAPService.sizeMatches(reported: 1000, actual: 900))
+        XCTAssertFalse(IMAPService.sizeMatches(reported: 1_000_000, actual: 998_000))
+    }
+
+    // MARK: - FETCH Item Downgrade Tests
+
+    func testFetchDowngradesRefusedItemList() async throws {
+        var commands: [String] = []
+
+        // Server that will not combine BODYSTRUCTURE with other items
+        let result = try await IMAPService.firstAcceptedFetch(uidSet: "42", itemLists: IMAPService.envelopeFetchItems) { command in
+            commands.append(command)
+            if command.contains("BODYSTRUCTURE") {
+                return "A0007 BAD Invalid FETCH item combination\r\n"
+            }
+            return "* 1 FETCH (UID 42 FLAGS () ENVELOPE (NIL NIL NIL NIL NIL NIL NIL NIL NIL NIL))\r\nA0008 OK done\r\n"
+        }
+
+        XCTAssertEqual(result.items, "(UID FLAGS ENVELOPE)")
+        XCTAssertTrue(result.response.contains("ENVELOPE"))
+        XCTAssertEqual(commands, [
+            "UID FETCH 42 (UID FLAGS ENVELOPE BODYSTRUCTURE)",
+            "UID FETCH 42 (UID FLAGS ENVELOPE)"
+        ])
+    }
+
+    func testFetchFailsWhenEveryItemListIsRefused() async {
+        do {
+            _ = try await IMAPService.firstAcceptedFetch(uidSet: "42", itemLists: IMAPService.headerFetchItems) { _ in
+                "A0007 NO Not today\r\n"
+            }
+            XCTFail("Expected fetch error")
+        } catch IMAPError.fetchFailed(let reason) {
+            XCTAssertTrue(reason.contains("NO"))
+        } catch {
+            XCTFail("Unexpected error: \(error)")
+        }
+    }
+
+    func testEnvelopeFetchRecoversWhenServerRefusesBodyStructure() async throws {
+        try await mockService.connect()
+        try await mockService.login(password: "test")
+        _ = try await mockService.selectFolder("INBOX")
+        await mockService.setRefusedFetchItems(["BODYSTRUCTURE"])
+
+        let response = try await mockService.fetchEnvelope(uid: 1)
+        let sidecar = EnvelopeSidecar(uid: 1, folder: "INBOX", response: response)
+
+        XCTAssertNotNil(sidecar.envelope)
+        XCTAssertNil(sidecar.bodyStructure)
+    }
+
+    // MARK: - Move / Delete Tests
+
+    func testMoveEmailsToTrash() async throws {
+        try await mockService.connect()
+        try await mockService.login(password: "test")
+        _ = try await mockService.selectFolder("INBOX")
+
+        try await mockService.moveEmails(uids: [1, 3], to: "Trash")
+
+        let remaining = try await mockService.searchAll()
+        XCTAssertEqual(remaining, [2])
+
+        _ = try await mockService.selectFolder("Trash")
+        let trashUIDs = try await mockService.searchAll()
+        XCTAssertEqual(trashUIDs, [1, 2])
+
+        // COPYUID mapping assigns fresh UIDs in the destination
+        let copyUIDs = await mockService.lastCopyUIDs
+        XCTAssertEqual(copyUIDs, [1: 1, 3: 2])
+
+        let data = try await mockService.fetchEmail(uid: 2)
+        XCTAssertTrue(String(data: data, encoding: .utf8)!.contains("Important: Action Required"))
+    }
+
+    func testMoveEmailsToNonexistentFolder() async throws {
+        try await mockService.connect()
+        try await mockService.login(password: "test")
+        _ = try await mockService.selectFolder("INBOX")
+
+        do {
+            try await mockService.moveEmails(uids: [1], to: "Archive")
+            XCTFail("Expected folder not found error")
+        } catch let error as IMAPError {
+            if case .folderNotFound(let name) = error {
+                XCTAssertEqual(name, "Archive")
+            } else {
+                XCTFail("Expected folderNotFound error")
+            }
+        }
+
+        let uids = try await mockService.searchAll()
+        XCTAssertEqual(uids, [1, 2, 3])
+    }
+
+    func testMoveRequiresMoveCapability() async throws {
+        try await mockService.connect()
+        try await mockService.login(password: "test")
+        _ = try await mockService.selectFolder("INBOX")
+        await mockService.setAdvertisedCapabilities(["IMAP4REV1"])
+
+        do {
+            try await mockService.moveEmails(uids: [1], to: "Trash")
+            XCTFail("Expected MOVE to be rejected")
+        } catch {
+            XCTAssertTrue(error is IMAPError)
+        }
+    }
+
+    func testDeleteEmails() async throws {
+        try await mockService.connect()
+        try await mockService.login(password: "test")
+        _ = try await mockService.selectFolder("INBOX")
+
+        try await mockService.deleteEmails(uids: [2])
+
+        let uids = try await mockService.searchAll()
+        XCTAssertEqual(uids, [1, 3])
+
+        let deleteCalls = await mockService.deleteCalls
+        XCTAssertEqual(deleteCalls, [[2]])
+    }
+
     // MARK: - Full Workflow Test
 
     func testFullBackupWorkflow() async throws {
@@ -263,6 +1069,53 @@ final class IMAPServiceTests: XCTestCase {
         XCTAssertEqual(logoutCount, 1)
     }
 
+    // MARK: - Injected Messages
+
+    func testInjectedMessageSurvivesBackupRoundTrip() async throws {
+        let pdf = Data("%PDF-1.4 fixture".utf8)
+        let binary = Data((0...255).map { UInt8($0) })
+        let spec = MockMessageSpec(
+            messageId: "round-trip-1@example.com",
+            subject: "=?iso-8859-1?Q?Gr=FC=DFe?=",
+            charset: "iso-8859-1",
+            body: "Schöne Grüße\nzweite Zeile",
+            attachments: [
+                MockMessageSpec.Attachment(filename: "report.pdf", contentType: "application/pdf", data: pdf),
+                MockMessageSpec.Attachment(filename: "blob.bin", contentType: "application/octet-stream", data: binary),
+            ],
+            flags: ["\\Seen", "\\Flagged"]
+        )
+        let uid = await mockService.injectMessage(into: "INBOX", spec: spec)
+        XCTAssertEqual(uid, 4)
+
+        // Back it up the way a backup run does
+        try await mockService.connect()
+        try await mockService.login(password: "test")
+        _ = try await mockService.selectFolder("INBOX")
+        let data = try await mockService.fetchEmail(uid: uid)
+        let sidecar = EnvelopeSidecar(uid: uid, folder: "INBOX", response: try await mockService.fetchEnvelope(uid: uid))
+
+        let tempDirectory = FileManager.default.temporaryDirectory.appendingPathComponent(UUID().uuidString)
+        defer { try? FileManager.default.removeItem(at: tempDirectory) }
+        let parsed = try XCTUnwrap(EmailParser.parseMetadata(from: data))
+        let email = Email(messageId: parsed.messageId, uid: uid, folder: "INBOX", subject: parsed.subject,
+                          sender: parsed.senderName, senderEmail: parsed.senderEmail, date: parsed.date)
+        let savedURL = try await StorageService(baseURL: tempDirectory)
+            .saveEmail(data, email: email, accountEmail: "test@example.com", folderPath: "INBOX")
+
+        // The saved file is the injected message byte for byte
+        let saved = try Data(contentsOf: savedURL)
+        XCTAssertEqual(saved, spec.rfc822Data())
+        XCTAssertEqual(EmailParser.messageId(from: saved), "round-trip-1@example.com")
+        XCTAssertEqual(EmailParser.parseMetadata(from: saved)?.subject, "Grüße")
+        XCTAssertNotNil(saved.range(of: try XCTUnwrap("Schöne Grüße\r\nzweite Zeile".data(using: .isoLatin1))))
+
+        let attachments = AttachmentService.attachments(in: saved)
+        XCTAssertEqual(attachments.map(\.filename), ["report.pdf", "blob.bin"])
+        XCTAssertEqual(attachments.map(\.data), [pdf, binary])
+        XCTAssertEqual(sidecar.flags, ["\\Seen", "\\Flagged"])
+    }
+
     // MARK: - Helpers
 
     private func setMockShouldFailConnect(_ value: Bool) async {
@@ -308,4 +1161,82 @@ extension MockIMAPService {
     func setShouldFailOnUID(_ uid: UInt32?) {
         shouldFailOnUID = uid
     }
+
+    func setFailingUIDs(_ uids: Set<UInt32>) {
+        failingUIDs = uids
+    }
+
+    func setAdvertisedCapabilities(_ capabilities: Set<String>) {
+        advertisedCapabilities = capabilities
+    }
+
+    func setListFailures(_ count: Int) {
+        listFailures = count
+    }
+
+    func setLogoutError(_ error: IMAPError?) {
+        logoutError = error
+    }
+
+    func setRefusedSearchKeys(_ keys: Set<String>) {
+        refusedSearchKeys = keys
+    }
+
+    func setBandwidthCapAfterFetches(_ count: Int?) {
+        bandwidthCapAfterFetches = count
+    }
+
+    func setSupportsID(_ enabled: Bool) {
+        if enabled {
+            advertisedCapabilities.insert("ID")
+        } else {
+            advertisedCapabilities.remove("ID")
+        }
+    }
+
+    func setLoginReferral(_ url: String?) {
+        loginReferral = url
+    }
+
+    func setFolderReferral(_ folder: String, to url: String) {
+        folderReferrals[folder] = url
+    }
+
+    func setMessageFlags(_ flags: [String], for uid: UInt32) {
+        messageFlags[uid] = flags
+    }
+
+    func setFetchDelay(_ delay: TimeInterval) {
+        fetchDelay = delay
+    }
+
+    func setPeekRefusedUIDs(_ uids: Set<UInt32>) {
+        peekRefusedUIDs = uids
+    }
+
+    func setExamineRefusedFolders(_ folders: Set<String>) {
+        examineRefusedFolders = folders
+    }
+
+    func setRefusedFetchItems(_ items: Set<String>) {
+        refusedFetchItems = items
+    }
+
+    func setReportedSize(_ size: Int, for uid: UInt32) {
+        reportedSizes[uid] = size
+    }
+
+    func setBodyParts(_ sections: [String: Data], structure: String, for uid: UInt32) {
+        bodySections[uid] = sections
+        bodyStructures[uid] = structure
+    }
+
+    func setNamespaceResponse(_ response: String) {
+        advertisedCapabilities.insert("NAMESPACE")
+        namespaceResponse = response
+    }
+
+    func setSharedFolderNames(_ names: [String]) {
+        sharedFolderNames = names
+    }
 }
@@ -0,0 +1,486 @@
+import XCTest
+@testable import IMAPBackup
+
+/// Tests of the real IMAPService against a scripted server on a loopback socket
+final class IMAPSessionTests: XCTestCase {
+
+    var server: FakeIMAPServer!
+
+    override func tearDown() async throws {
+        server?.stop()
+        server = nil
+
+        try await super.tearDown()
+    }
+
+    /// Start a server advertising `capabilities`. `handle` answers a command first; what it leaves
+    /// to the server (nil) gets the usual answer: capabilities, any login accepted, OK for the rest.
+    private func startServer(
+        greeting: String = "* OK IMAP4rev1 fake server ready",
+        capabilities: String = "IMAP4rev1 AUTH=PLAIN UIDPLUS",
+        handle: @escaping (FakeIMAPServer.Command) -> FakeIMAPServer.Reply? = { _ in nil }
+    ) async throws {
+        server = try FakeIMAPServer(greeting: greeting) { command in
+            if let reply = handle(command) {
+                return reply
+            }
+            if command.isContinuation {
+                return .lines(["\(command.tag) OK Authenticated"])
+            }
+            switch command.name {
+            case "CAPABILITY":
+                return .lines(["* CAPABILITY \(capabilities)", "\(command.tag) OK CAPABILITY completed"])
+            case "AUTHENTICATE":
+                return .lines(["+ "])
+            case "LOGOUT":
+                return .lines(["* BYE Logging out", "\(command.tag) OK LOGOUT completed"])
+            default:
+                return command.ok
+            }
+        }
+        try await server.start()
+    }
+
+    /// A service connected and logged in to the server
+    private func loggedInService() async throws -> IMAPService {
+        let service = IMAPService(account: server.account())
+        try await service.connect()
+        try await service.login()
+        return service
+    }
+
+    // MARK: - Login
+
+    func testLoginRefusedWhenLoginDisabled() async throws {
+        try await startServer(capabilities: "IMAP4rev1 STARTTLS AUTH=PLAIN LOGINDISABLED")
+        let service = IMAPService(account: server.account())
+        try await service.connect()
+
+        do {
+            try await service.login()
+            XCTFail("Expected login to be refused")
+        } catch IMAPError.loginDisabled {
+            // Expected
+        }
+
+        // Capabilities were asked for, the password never left the client
+        XCTAssertEqual(server.commandNames, ["CAPABILITY"])
+        XCTAssertFalse(server.received.contains { $0.isContinuation })
+    }
+
+    func testLoginDisabledInGreetingSkipsCapabilityCommand() async throws {
+        try await startServer(greeting: "* OK [CAPABILITY IMAP4rev1 STARTTLS LOGINDISABLED] ready")
+        let service = IMAPService(account: server.account())
+        try await service.connect()
+
+        do {
+            try await service.login()
+            XCTFail("Expected login to be refused")
+        } catch IMAPError.loginDisabled {
+            // Expected
+        }
+
+        XCTAssertTrue(server.received.isEmpty)
+    }
+
+    func testLoginUsesAdvertisedPlain() async throws {
+        try await startServer(capabilities: "IMAP4rev1 AUTH=PLAIN")
+
+        _ = try await loggedInService()
+
+        let received = server.received
+        XCTAssertEqual(received.map(\.text).prefix(2), ["CAPABILITY", "AUTHENTICATE PLAIN"])
+        XCTAssertEqual(received.first { $0.isContinuation }?.text,
+                       IMAPService.plainResponse(username: "me@example.com", password: "secret"))
+    }
+
+    func testLoginAnswersCramMD5Challenge() async throws {
+        let challenge = Data("<1896.697170952@postoffice.reston.mci.net>".utf8).base64EncodedString()
+        try await startServer(capabilities: "IMAP4rev1 AUTH=CRAM-MD5") { command in
+            command.text == "AUTHENTICATE CRAM-MD5" ? .lines(["+ \(challenge)"]) : nil
+        }
+
+        _ = try await loggedInService()
+
+        let received = server.received
+        XCTAssertEqual(received.map(\.text).prefix(2), ["CAPABILITY", "AUTHENTICATE CRAM-MD5"])
+        XCTAssertEqual(received.first { $0.isContinuation }?.text,
+                       IMAPService.cramMD5Response(username: "me@example.com", password: "secret", challenge: challenge))
+        XCTAssertFalse(server.commandNames.contains("LOGIN"))
+    }
+
+    func testLoginFallsBackWhenMechanismIsRejected() async throws {
+        try await startServer(capabilities: "IMAP4rev1 AUTH=PLAIN") { command in
+            command.name == "AUTHENTICATE" ? .lines(["\(command.tag) BAD Unsupported mechanism"]) : nil
+        }
+
+        _ = try await loggedInService()
+
+        XCTAssertEqual(server.received.map(\.text), [
+            "CAPABILITY",
+            "AUTHENTICATE PLAIN",
+            "LOGIN \"me@example.com\" \"secret\""
+        ])
+    }
+
+    func testWrongPasswordDoesNotTryOtherMechanisms() async throws {
+        try await startServer(capabilities: "IMAP4rev1 AUTH=PLAIN AUTH=CRAM-MD5") { command in
+            command.isContinuation ? .lines(["\(command.tag) NO [AUTHENTICATIONFAILED] Invalid credentials"]) : nil
+        }
+        let service = IMAPService(account: server.account())
+        try await service.connect()
+
+        do {
+            try await service.login()
+            XCTFail("Expected authentication to fail")
+        } catch IMAPError.authenticationFailed {
+            // Expected
+        }
+
+        XCTAssertEqual(server.commandNames, ["CAPABILITY", "AUTHENTICATE"])
+    }
+
+    // MARK: - Logout
+
+    func testLogoutAfterServerClosedTheConnectionSucceeds() async throws {
+        try await startServer()
+        let service = try await loggedInService()
+
+        // An idle timeout on the server side while the last folder was being saved
+        server.dropConnections()
+        try await Task.sleep(nanoseconds: 100_000_000)
+
+        try await service.logout()
+        XCTAssertEqual(server.connectionCount, 1)
+    }
+
+    func testLogoutAnsweredByClosingTheConnectionSucceeds() async throws {
+        try await startServer { command in
+            command.name == "LOGOUT" ? .close : nil
+        }
+        let service = try await loggedInService()
+
+        try await service.logout()
+        XCTAssertEqual(server.commandNames.last, "LOGOUT")
+    }
+
+    // MARK: - Retry
+
+    func testListRetriesOnAFreshConnectionWithTheLoginPassword() async throws {
+        var lists = 0
+        try await startServer { command in
+            guard command.name == "LIST" else { return nil }
+            lists += 1
+            if lists == 1 {
+                return .close
+            }
+            return .lines(["* LIST (\\HasNoChildren) \"/\" \"INBOX\"", "\(command.tag) OK LIST completed"])
+        }
+        // The password is only given to login, as an embedded backup does; the account has none to fall back on
+        let service = IMAPService(account: server.account(password: ""))
+        try await service.connect()
+        try await service.login(password: "given")
+
+        let folders = try await service.listFolders()
+
+        XCTAssertEqual(folders.map(\.name), ["INBOX"])
+        XCTAssertEqual(server.connectionCount, 2)
+        let credentials = server.received.filter { $0.isContinuation }.map(\.text)
+        let expected = IMAPService.plainResponse(username: "me@example.com", password: "given")
+        XCTAssertEqual(credentials, [expected, expected])
+        let retried = server.received.filter { $0.connection == 1 && !$0.isContinuation }.map(\.name)
+        XCTAssertEqual(retried.filter { $0 != "CAPABILITY" }, ["AUTHENTICATE", "LIST"])
+    }
+
+    // MARK: - Downloads
+
+    func testStreamedDownloadIsWrittenToFile() async throws {
+        let message = "Subject: Streamed\r\n\r\nBody\r\n"
+        try await startServer { command in
+            guard command.name == "UID FETCH" else { return nil }
+            return .lines(["* 1 FETCH (UID 5 BODY[] {\(message.utf8.count)}", message + ")", "\(command.tag) OK FETCH completed"])
+        }
+        let service = try await loggedInService()
+        let destination = FileManager.default.temporaryDirectory.appendingPathComponent(UUID().uuidString)
+        defer { try? FileManager.default.removeItem(at: destination) }
+
+        let written = try await service.streamEmailToFile(uid: 5, destinationURL: destination)
+
+        XCTAssertEqual(written, Int64(message.utf8.count))
+        XCTAssertEqual(try String(contentsOf: destination, encoding: .utf8), message)
+        XCTAssertTrue(server.received.contains { $0.text == "UID FETCH 5 BODY.PEEK[]" })
+    }
+
+    func testBodyFetchFallbackNeverMarksRead() async throws {
+        let message = "Subject: Fallback\r\n\r\nBody\r\n"
+        var seen = false
+        try await startServer { command in
+            guard command.name == "UID FETCH" else { return nil }
+            // A server that sends nothing for BODY.PEEK[] and marks anything but a peek read
+            if command.text.hasSuffix("BODY.PEEK[]") {
+                return .lines(["\(command.tag) OK FETCH completed"])
+            }
+            if !command.text.contains(".PEEK") {
+                seen = true
+            }
+            return .lines(["* 1 FETCH (UID 5 RFC822 {\(message.utf8.count)}", message + ")", "\(command.tag) OK FETCH completed"])
+        }
+        let service = try await loggedInService()
+
+        let data = try await service.fetchEmail(uid: 5)
+
+        XCTAssertEqual(String(decoding: data, as: UTF8.self), message)
+        XCTAssertFalse(seen)
+        XCTAssertEqual(server.received.filter { $0.name == "UID FETCH" }.map(\.text),
+                       ["UID FETCH 5 BODY.PEEK[]", "UID FETCH 5 RFC822.PEEK"])
+    }
+
+    func testRefusedBodyItemIsNotAskedForAgain() async throws {
+        let message = "Subject: Downgraded\r\n\r\nBody\r\n"
+        try await startServer { command in
+            guard command.name == "UID FETCH" else { return nil }
+            if command.text.hasSuffix("BODY.PEEK[]") {
+                return .lines(["\(command.tag) BAD Unknown fetch attribute"])
+            }
+            let uid = command.text.split(separator: " ")[2]
+            return .lines(["* 1 FETCH (UID \(uid) RFC822 {\(message.utf8.count)}", message + ")", "\(command.tag) OK FETCH completed"])
+        }
+        let service = try await loggedInService()
+        let destination = FileManager.default.temporaryDirectory.appendingPathComponent(UUID().uuidString)
+        defer { try? FileManager.default.removeItem(at: destination) }
+
+        let first = try await service.fetchEmail(uid: 5)
+        let second = try await service.fetchEmail(uid: 6)
+        let streamed = try await service.streamEmailToFile(uid: 7, destinationURL: destination)
+
+        XCTAssertEqual(String(decoding: first, as: UTF8.self), message)
+        XCTAssertEqual(String(decoding: second, as: UTF8.self), message)
+        XCTAssertEqual(streamed, Int64(message.utf8.count))
+        XCTAssertEqual(server.received.filter { $0.name == "UID FETCH" }.map(\.text), [
+            "UID FETCH 5 BODY.PEEK[]",
+            "UID FETCH 5 RFC822.PEEK",
+            "UID FETCH 6 RFC822.PEEK",
+            "UID FETCH 7 RFC822.PEEK"
+        ])
+    }
+
+    func testStreamedDownloadFallsBackWhenBodyItemIsRefused() async throws {
+        let message = "Subject: Streamed\r\n\r\nBody\r\n"
+        try await startServer { command in
+            guard command.name == "UID FETCH" else { return nil }
+            if command.text.hasSuffix("BODY.PEEK[]") {
+                return .lines(["\(command.tag) NO Cannot fetch that"])
+            }
+            return .lines(["* 1 FETCH (UID 5 RFC822 {\(message.utf8.count)}", message + ")", "\(command.tag) OK FETCH completed"])
+        }
+        let service = try await loggedInService()
+        let destination = FileManager.default.temporaryDirectory.appendingPathComponent(UUID().uuidString)
+        defer { try? FileManager.default.removeItem(at: destination) }
+
+        let written = try await service.streamEmailToFile(uid: 5, destinationURL: destination)
+
+        XCTAssertEqual(written, Int64(message.utf8.count))
+        XCTAssertEqual(try String(contentsOf: destination, encoding: .utf8), message)
+        XCTAssertEqual(server.received.filter { $0.name == "UID FETCH" }.map(\.text),
+                       ["UID FETCH 5 BODY.PEEK[]", "UID FETCH 5 RFC822.PEEK"])
+    }
+
+    func testStreamedDownloadStopsAtBandwidthCap() async throws {
+        try await startServer { command in
+            guard command.name == "UID FETCH" else { return nil }
+            return .lines(["\(command.tag) NO [OVERQUOTA] Account exceeded command or bandwidth limits"])
+        }
+        let service = try await loggedInService()
+        let destination = FileManager.default.temporaryDirectory.appendingPathComponent(UUID().uuidString)
+
+        do {
+            _ = try await service.streamEmailToFile(uid: 5, destinationURL: destination)
+            XCTFail("Expected the bandwidth cap to stop the download")
+        } catch IMAPError.bandwidthLimitExceeded {
+            // Expected
+        }
+
+        // No second item was tried and nothing was left on disk
+        XCTAssertEqual(server.commandNames.filter { $0 == "UID FETCH" }.count, 1)
+        XCTAssertFalse(FileManager.default.fileExists(atPath: destination.path))
+    }
+
+    // MARK: - Fetch Strategy
+
+    /// Start a server holding three emails with UIDs 1 to 3, answering the FETCH commands of a backup
+    private func startMailboxServer() async throws {
+        func message(_ uid: String) -> String {
+            "Date: Mon, 1 Jan 2024 10:00:00 +0000\r\nFrom: sender@example.com\r\nSubject: Message \(uid)\r\n\r\nBody\r\n"
+        }
+        func envelope(_ uid: String) -> String {
+            "ENVELOPE (\"Mon, 1 Jan 2024 10:00:00 +0000\" \"Message \(uid)\" NIL NIL NIL NIL NIL NIL NIL \"<\(uid)@example.com>\")"
+        }
+        try await startServer { command in
+            guard command.name == "UID FETCH" else { return nil }
+            let words = command.text.split(separator: " ").map(String.init)
+            let uidSet = words[2]
+            let items = words.dropFirst(3).joined(separator: " ")
+
+            switch items {
+            case "BODY.PEEK[]":
+                let body = message(uidSet)
+                return .lines(["* \(uidSet) FETCH (UID \(uidSet) BODY[] {\(body.utf8.count)}", body + ")", "\(command.tag) OK FETCH completed"])
+            case "RFC822.SIZE":
+                return .lines(["* \(uidSet) FETCH (UID \(uidSet) RFC822.SIZE \(message(uidSet).utf8.count))", "\(command.tag) OK FETCH completed"])
+            default:
+                let size = items.contains("RFC822.SIZE")
+                let lines = uidSet.split(separator: ",").map(String.init).map { uid in
+                    "* \(uid) FETCH (UID \(uid) FLAGS ()\(size ? " RFC822.SIZE \(message(uid).utf8.count)" : "") \(envelope(uid)))"
+                }
+                return .lines(lines + ["\(command.tag) OK FETCH completed"])
+            }
+        }
+    }
+
+    /// Back up UIDs 1 to 3 of INBOX with envelope sidecars through the engine's download loop,
+    /// returning the UID FETCH commands the server received
+    private func backUpMailbox(strategy: FetchStrategy, into directory: URL) async throws -> [String] {
+        var account = server.account()
+        account.fetchStrategy = strategy
+        let service = IMAPService(account: account)
+        try await service.connect()
+        try await service.login()
+
+        let engine = BackupEngine(
+            storage: StorageService(baseURL: directory),
+            options: BackupEngine.Options(saveEnvelopeSidecars: true, retryDelayMs: 0)
+        )
+        let inbox = IMAPFolder(name: "INBOX", delimiter: "/", flags: [], path: "INBOX")
+        let result = try await engine.downloadFolder([1, 2, 3], from: inbox, account: account, service: service)
+
+        XCTAssertEqual(result.downloaded, 3)
+        XCTAssertEqual(result.verifiedUIDs, [1, 2, 3])
+        XCTAssertTrue(result.failedUIDs.isEmpty)
+        return server.received.filter { $0.name == "UID FETCH" }.map(\.text)
+    }
+
+    func testTwoPhaseFetchesOnlyBodiesPerEmail() async throws {
+        try await startMailboxServer()
+        let directory = FileManager.default.temporaryDirectory.appendingPathComponent(UUID().uuidString)
+        defer { try? FileManager.default.removeItem(at: directory) }
+
+        let fetches = try await backUpMailbox(strategy: .twoPhase, into: directory)
+
+        // Sizes and envelopes in one command, then nothing but each body
+        XCTAssertEqual(fetches, [
+            "UID FETCH 1,2,3 (UID FLAGS RFC822.SIZE ENVELOPE)",
+            "UID FETCH 1 BODY.PEEK[]",
+            "UID FETCH 2 BODY.PEEK[]",
+            "UID FETCH 3 BODY.PEEK[]"
+        ])
+        let sidecars = try FileManager.default.subpathsOfDirectory(atPath: directory.path).filter { $0.hasSuffix(".envelope.json") }
+        XCTAssertEqual(sidecars.count, 3)
+    }
+
+    func testCombinedFetchesSizeAndEnvelopePerEmail() async throws {
+        try await startMailboxServer()
+        let directory = FileManager.default.temporaryDirectory.appendingPathComponent(UUID().uuidString)
+        defer { try? FileManager.default.removeItem(at: directory) }
+
+        let fetches = try await backUpMailbox(strategy: .combined, into: directory)
+
+        XCTAssertEqual(Array(fetches.prefix(3)), [
+            "UID FETCH 1 RFC822.SIZE",
+            "UID FETCH 1 BODY.PEEK[]",
+            "UID FETCH 1 (UID FLAGS ENVELOPE BODYSTRUCTURE)"
+        ])
+        XCTAssertEqual(fetches.count, 9)
+    }
+
+    // MARK: - Search
+
+    func testSearchForTextOutsideASCIISendsLiterals() async throws {
+        try await startServer { command in
+            if command.name == "UID SEARCH" {
+                return .lines(["+ Ready for literal"])
+            }
+            if command.isContinuation && command.text == "Grüße" {
+                return .lines(["* SEARCH 3 4", "\(command.tag) OK SEARCH completed"])
+            }
+            return nil
+        }
+        let service = try await loggedInService()
+
+        let uids = try await service.search(IMAPSearchCriteria(subject: "Grüße"))
+
+        XCTAssertEqual(uids, [3, 4])
+        // A quoted string may only hold 7-bit text
+        let search = server.received.first { $0.name == "UID SEARCH" }
+        XCTAssertEqual(search?.text, "UID SEARCH CHARSET UTF-8 SUBJECT {\("Grüße".utf8.count)}")
+    }
+
+    // MARK: - Server Cleanup
+
+    func testDeleteUsesUIDExpunge() async throws {
+        try await startServer()
+        let service = try await loggedInService()
+
+        try await service.deleteEmails(uids: [3, 1])
+
+        let texts = server.received.map(\.text)
+        XCTAssertTrue(texts.contains("UID STORE 1,3 +FLAGS.SILENT (\\Deleted)"))
+        XCTAssertTrue(texts.contains("UID EXPUNGE 1,3"))
+    }
+
+    func testDeleteWithoutUIDPLUSLeavesMessagesFlagged() async throws {
+        try await startServer(capabilities: "IMAP4rev1 AUTH=PLAIN")
+        let service = try await loggedInService()
+
+        try await service.deleteEmails(uids: [1, 3])
+
+        // A plain EXPUNGE would also remove what other clients flagged \Deleted
+        XCTAssertTrue(server.commandNames.contains("UID STORE"))
+        XCTAssertFalse(server.commandNames.contains("EXPUNGE"))
+        XCTAssertFalse(server.commandNames.contains("UID EXPUNGE"))
+    }
+
+    func testMoveWithoutMOVEOrUIDPLUSCopiesAndOnlyFlags() async throws {
+        try await startServer(capabilities: "IMAP4rev1 AUTH=PLAIN")
+        let service = try await loggedInService()
+
+        try await service.moveEmails(uids: [2], to: "Trash")
+
+        let names = server.commandNames
+        XCTAssertTrue(names.contains("UID COPY"))
+        XCTAssertTrue(names.contains("UID STORE"))
+        XCTAssertFalse(names.contains("EXPUNGE"))
+        XCTAssertFalse(names.contains("UID MOVE"))
+    }
+
+    func testUIDMoveMovesMessagesOnTheServer() async throws {
+        let mailboxes = FakeIMAPServer.Mailboxes(["INBOX": [1, 2, 3], "Trash": []])
+        try await startServer(capabilities: "IMAP4rev1 AUTH=PLAIN UIDPLUS MOVE") { command in
+            mailboxes.handleSelect(command) ?? (command.name.hasSuffix("MOVE") ? mailboxes.handleMove(command) : nil)
+        }
+        let service = try await loggedInService()
+
+        _ = try await service.selectFolder("INBOX")
+        try await service.moveEmails(uids: [2], to: "Trash")
+
+        XCTAssertTrue(server.received.map(\.text).contains("UID MOVE 2 \"Trash\""))
+        XCTAssertFalse(server.commandNames.contains("UID COPY"))
+        XCTAssertEqual(mailboxes.uids(in: "INBOX"), [1, 3])
+        XCTAssertEqual(mailboxes.uids(in: "Trash"), [1])
+    }
+
+    func testFakeServerMoveAnswersWithCOPYUIDAndExpunges() {
+        let mailboxes = FakeIMAPServer.Mailboxes(["INBOX": [4, 7, 9], "Trash": [1]])
+        _ = mailboxes.handleSelect(.init(connection: 0, tag: "A1", text: "SELECT INBOX", isContinuation: false))
+
+        let bySequence = mailboxes.handleMove(.init(connection: 0, tag: "A2", text: "MOVE 1,3 Trash", isContinuation: false))
+        guard case .lines(let lines) = bySequence else { return XCTFail("MOVE closed the connection") }
+        XCTAssertEqual(lines, ["* OK [COPYUID 1 4,9 2,3] Moved", "* 3 EXPUNGE", "* 1 EXPUNGE", "A2 OK MOVE completed"])
+
+        let byUID = mailboxes.handleMove(.init(connection: 0, tag: "A3", text: "UID MOVE 7:* \"Trash\"", isContinuation: false))
+        guard case .lines(let uidLines) = byUID else { return XCTFail("UID MOVE closed the connection") }
+        XCTAssertEqual(uidLines, ["* OK [COPYUID 1 7 4] Moved", "* 1 EXPUNGE", "A3 OK UID MOVE completed"])
+
+        XCTAssertEqual(mailboxes.uids(in: "INBOX"), [])
+        XCTAssertEqual(mailboxes.uids(in: "Trash"), [1, 2, 3, 4])
+    }
+}
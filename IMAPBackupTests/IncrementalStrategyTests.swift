@@ -0,0 +1,183 @@
+import XCTest
+@testable import IMAPBackup
+
+final class IncrementalStrategyTests: XCTestCase {
+
+    var tempDirectory: URL!
+    var storageService: StorageService!
+    var mockService: MockIMAPService!
+
+    let accountEmail = "test@example.com"
+
+    override func setUp() async throws {
+        try await super.setUp()
+
+        tempDirectory = FileManager.default.temporaryDirectory
+            .appendingPathComponent(UUID().uuidString)
+        try FileManager.default.createDirectory(at: tempDirectory, withIntermediateDirectories: true)
+        storageService = StorageService(baseURL: tempDirectory)
+
+        mockService = MockIMAPService()
+        try await mockService.connect()
+        try await mockService.login(password: "secret")
+    }
+
+    override func tearDown() async throws {
+        try? FileManager.default.removeItem(at: tempDirectory)
+        mockService = nil
+
+        try await super.tearDown()
+    }
+
+    private func message(_ number: Int) -> String {
+        "From: sender@example.com\r\nSubject: Message \(number)\r\nMessage-ID: <msg-\(number)@example.com>\r\n\r\nBody \(number)\r\n"
+    }
+
+    /// Back up messages 1...count under UIDs 1...count
+    private func backUpMessages(count: Int) async throws {
+        for number in 1...count {
+            let email = Email(
+                messageId: "msg-\(number)@example.com",
+                uid: UInt32(number),
+                folder: "INBOX",
+                subject: "Message \(number)",
+                sender: "sender",
+                senderEmail: "sender@example.com",
+                date: Date()
+            )
+            _ = try await storageService.saveEmail(Data(message(number).utf8), email: email, accountEmail: accountEmail, folderPath: "INBOX")
+        }
+    }
+
+    // MARK: - Renumbered Server
+
+    func testRenumberedMessagesAreNotDownloadedAgain() async throws {
+        try await backUpMessages(count: 3)
+
+        // After a migration the same three messages have new UIDs, plus one genuinely new message
+        for number in 1...4 {
+            await mockService.addEmail(to: "INBOX", uid: UInt32(100 + number), content: message(number))
+        }
+        _ = try await mockService.selectFolder("INBOX")
+
+        let serverUIDs = try await mockService.searchAll()
+        let backedUpUIDs = try await storageService.getExistingUIDs(accountEmail: accountEmail, folderPath: "INBOX")
+        let knownMessageIDs = try await storageService.getExistingMessageIDs(accountEmail: accountEmail, folderPath: "INBOX")
+
+        let byMessageID = try await IncrementalStrategy.messageId.newUIDs(
+            serverUIDs, backedUpUIDs: backedUpUIDs, knownMessageIDs: knownMessageIDs, using: mockService
+        )
+        XCTAssertEqual(byMessageID, [104])
+
+        // The UID strategy sees four new messages
+        let byUID = try await IncrementalStrategy.uid.newUIDs(
+            serverUIDs, backedUpUIDs: backedUpUIDs, knownMessageIDs: knownMessageIDs, using: mockService
+        )
+        XCTAssertEqual(byUID, [101, 102, 103, 104])
+    }
+
+    func testMessagesWithoutMessageIDFallBackToUID() async throws {
+        try await backUpMessages(count: 1)
+
+        await mockService.addEmail(to: "INBOX", uid: 1, content: "Subject: No ID\r\n\r\nBody\r\n")
+        await mockService.addEmail(to: "INBOX", uid: 2, content: "Subject: No ID either\r\n\r\nBody\r\n")
+        _ = try await mockService.selectFolder("INBOX")
+
+        let newUIDs = try await IncrementalStrategy.messageId.newUIDs(
+            [1, 2], backedUpUIDs: [1], knownMessageIDs: ["msg-1@example.com"], using: mockService
+        )
+        XCTAssertEqual(newUIDs, [2])
+    }
+
+    // MARK: - UID Discovery
+
+    func testCurrentUIDsAreSkippedWithoutFetchingHeaders() async throws {
+        try await backUpMessages(count: 3)
+        for uid in [1, 2, 3, 4, 5, 9] {
+            await mockService.addEmail(to: "INBOX", uid: UInt32(uid), content: message(uid))
+        }
+        _ = try await mockService.selectFolder("INBOX")
+
+        let newUIDs = try await IncrementalStrategy.messageId.newUIDs(
+            [1, 2, 3, 4, 5, 9],
+            backedUpUIDs: [1, 2, 3],
+            knownMessageIDs: ["msg-1@example.com", "msg-2@example.com", "msg-3@example.com"],
+            uidsAreCurrent: true,
+            using: mockService
+        )
+
+        XCTAssertEqual(newUIDs, [4, 5, 9])
+        // Headers of the backed-up messages, and of nothing between the new ones, are never fetched
+        let fetched = await mockService.fetchMessageIDsCalls
+        XCTAssertEqual(fetched, [4...5, 9...9])
+    }
+
+    func testAllBackedUpFetchesNoHeaders() async throws {
+        await mockService.addEmail(to: "INBOX", uid: 1, content: message(1))
+        _ = try await mockService.selectFolder("INBOX")
+
+        let newUIDs = try await IncrementalStrategy.messageId.newUIDs(
+            [1], backedUpUIDs: [1], knownMessageIDs: ["msg-1@example.com"], uidsAreCurrent: true, using: mockService
+        )
+
+        XCTAssertTrue(newUIDs.isEmpty)
+        let fetched = await mockService.fetchMessageIDsCalls
+        XCTAssertTrue(fetched.isEmpty)
+    }
+
+    func testContiguousRanges() {
+        XCTAssertEqual(IncrementalStrategy.contiguousRanges([9, 1, 2, 3, 5, 2], maxCount: 10), [1...3, 5...5, 9...9])
+        XCTAssertEqual(IncrementalStrategy.contiguousRanges(Array(1...5), maxCount: 2), [1...2, 3...4, 5...5])
+        XCTAssertTrue(IncrementalStrategy.contiguousRanges([], maxCount: 10).isEmpty)
+    }
+
+    // MARK: - Message-ID Cache
+
+    func testMessageIDCacheIsBuiltAndExtended() async throws {
+        try await backUpMessages(count: 2)
+
+        let known = try await storageService.getExistingMessageIDs(accountEmail: accountEmail, folderPath: "INBOX")
+        XCTAssertEqual(known, ["msg-1@example.com", "msg-2@example.com"])
+
+        // Saving after the cache exists adds to it
+        let email = Email(messageId: "msg-3@example.com", uid: 3, folder: "INBOX", subject: "Message 3",
+                          sender: "sender", senderEmail: "sender@example.com", date: Date())
+        _ = try await storageService.saveEmail(Data(message(3).utf8), email: email, accountEmail: accountEmail, folderPath: "INBOX")
+
+        let updated = try await storageService.getExistingMessageIDs(accountEmail: accountEmail, folderPath: "INBOX")
+        XCTAssertEqual(updated.count, 3)
+        XCTAssertTrue(updated.contains("msg-3@example.com"))
+    }
+
+    // MARK: - Parsing
+
+    func testParseMessageIDs() {
+        let response = "* 1 FETCH (UID 7 BODY[HEADER.FIELDS (MESSAGE-ID)] {36}\r\n"
+            + "Message-ID: <a@example.com>\r\n\r\n)\r\n"
+            + "* 2 FETCH (BODY[HEADER.FIELDS (MESSAGE-ID)] {40}\r\n"
+            + "Message-Id:\r\n <b@example.com>\r\n\r\n UID 9)\r\n"
+            + "* 3 FETCH (UID 12 BODY[HEADER.FIELDS (MESSAGE-ID)] {2}\r\n\r\n)\r\n"
+            + "A0005 OK FETCH completed\r\n"
+
+        XCTAssertEqual(IMAPService.parseMessageIDs(response), [7: "a@example.com", 9: "b@example.com"])
+    }
+
+    func testDuplicateUIDInFetchResponseKeepsFirst() {
+        let response = "* 1 FETCH (UID 7 BODY[HEADER.FIELDS (MESSAGE-ID)] {28}\r\n"
+            + "Message-ID: <a@example.com>\r\n)\r\n"
+            + "* 2 FETCH (UID 7 BODY[HEADER.FIELDS (MESSAGE-ID)] {28}\r\n"
+            + "Message-ID: <b@example.com>\r\n)\r\n"
+            + "* 3 FETCH (UID 8 BODY[HEADER.FIELDS (MESSAGE-ID)] {28}\r\n"
+            + "Message-ID: <c@example.com>\r\n)\r\n"
+            + "A0005 OK FETCH completed\r\n"
+
+        XCTAssertEqual(IMAPService.parseMessageIDs(response), [7: "a@example.com", 8: "c@example.com"])
+    }
+
+    func testDuplicateUIDsInSearchResponseAreDropped() {
+        let response = "* SEARCH 3 5 3 9\r\n* SEARCH 5 11\r\nA0006 OK SEARCH completed\r\n"
+
+        XCTAssertEqual(IMAPService.parseSearchResponse(response), [3, 5, 9, 11])
+        XCTAssertEqual(IMAPService.uniqueUIDs([1, 2, 3], in: "SEARCH"), [1, 2, 3])
+    }
+}
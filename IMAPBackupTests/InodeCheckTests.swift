@@ -0,0 +1,87 @@
+import XCTest
+@testable import IMAPBackup
+
+final class InodeCheckTests: XCTestCase {
+
+    var tempDirectory: URL!
+
+    override func setUp() async throws {
+        try await super.setUp()
+        tempDirectory = FileManager.default.temporaryDirectory
+            .appendingPathComponent("InodeCheckTests_\(UUID().uuidString)")
+        try FileManager.default.createDirectory(at: tempDirectory, withIntermediateDirectories: true)
+    }
+
+    override func tearDown() async throws {
+        try? FileManager.default.removeItem(at: tempDirectory)
+        try await super.tearDown()
+    }
+
+    // MARK: - Usage
+
+    func testUsageComesFromStatfs() throws {
+        let usage = try XCTUnwrap(InodeUsage.of(tempDirectory), "The temporary volume should report its inodes")
+
+        var stats = statfs()
+        XCTAssertEqual(statfs(tempDirectory.path, &stats), 0)
+        XCTAssertEqual(usage.total, UInt64(stats.f_files))
+        XCTAssertLessThanOrEqual(usage.free, usage.total)
+        XCTAssertEqual(usage.used, usage.total - usage.free)
+    }
+
+    func testUnreadableVolumeHasNoUsage() {
+        XCTAssertNil(InodeUsage.of(tempDirectory.appendingPathComponent("missing/deeper")))
+        XCTAssertEqual(try InodeCheck.check(tempDirectory.appendingPathComponent("missing"), minimum: Int.max), .ok)
+    }
+
+    func testUsedNeverUnderflows() {
+        XCTAssertEqual(InodeUsage(total: 10, free: 12).used, 0)
+    }
+
+    // MARK: - Levels
+
+    func testLevelsAgainstMinimum() {
+        XCTAssertEqual(InodeCheck.level(of: InodeUsage(total: 1_000, free: 500), minimum: 100), .ok)
+        XCTAssertEqual(InodeCheck.level(of: InodeUsage(total: 1_000, free: 150), minimum: 100), .low)
+        XCTAssertEqual(InodeCheck.level(of: InodeUsage(total: 1_000, free: 99), minimum: 100), .exhausted)
+        XCTAssertEqual(InodeCheck.level(of: InodeUsage(total: 1_000, free: 0), minimum: 0), .ok)
+    }
+
+    func testCheckThrowsBelowMinimum() throws {
+        try XCTSkipIf(InodeUsage.of(tempDirectory) == nil, "The temporary volume has no fixed number of inodes")
+
+        XCTAssertEqual(try InodeCheck.check(tempDirectory, minimum: 0), .ok)
+        XCTAssertThrowsError(try InodeCheck.check(tempDirectory, minimum: Int.max)) { error in
+            guard case InodeCheckError.tooFewInodes(let path, _, let minimum) = error else {
+                return XCTFail("Unexpected error: \(error)")
+            }
+            XCTAssertEqual(path, self.tempDirectory.path)
+            XCTAssertEqual(minimum, Int.max)
+            XCTAssertTrue(error.localizedDescription.contains("move backups to a volume with more inodes"))
+        }
+        XCTAssertEqual(FailureKind.classify(InodeCheckError.tooFewInodes(path: "/", free: 0, minimum: 1)), .tooManyFiles)
+        XCTAssertTrue(FailureKind.tooManyFiles.advice?.contains("Free up files") == true)
+        XCTAssertFalse(FailureKind.tooManyFiles.advice?.contains("tar storage") == true)
+    }
+
+    // MARK: - Diagnostics
+
+    func testDiagnosticSuggestsFewerFiles() {
+        let url = tempDirectory!
+        let ok = DiagnosticsService.checkFreeInodes(url, minimumFreeInodes: 100, usage: InodeUsage(total: 1_000, free: 900))
+        let low = DiagnosticsService.checkFreeInodes(url, minimumFreeInodes: 100, usage: InodeUsage(total: 1_000, free: 150))
+        let exhausted = DiagnosticsService.checkFreeInodes(url, minimumFreeInodes: 100, usage: InodeUsage(total: 1_000, free: 10))
+
+        XCTAssertEqual(ok.status, .pass)
+        XCTAssertEqual(ok.detail, "900 of 1000 free")
+        XCTAssertEqual(low.status, .warning)
+        XCTAssertEqual(exhausted.status, .fail)
+        XCTAssertEqual(exhausted.remediation, InodeCheck.remedy)
+
+        let mirror = DiagnosticsService.checkFreeInodes(
+            url.appendingPathComponent("Backups2"), minimumFreeInodes: 100, isMirror: true, usage: InodeUsage(total: 1_000, free: 10)
+        )
+        XCTAssertEqual(mirror.name, "Mirror Backups2: Free Inodes")
+        XCTAssertEqual(mirror.status, .fail)
+    }
+}
@@ -0,0 +1,67 @@
+import XCTest
+@testable import IMAPBackup
+
+final class LoggingServiceTests: XCTestCase {
+
+    let accessToken = "ya29.a0AfH6SMBx-example_access.token"
+    let refreshToken = "1//0gExampleRefresh-Token_value"
+
+    // MARK: - Redaction Tests
+
+    func testRedactsLoginPassword() {
+        let redacted = redactSensitiveData(#"A0001 LOGIN "user@example.com" "hunter2""#)
+        XCTAssertFalse(redacted.contains("hunter2"))
+        XCTAssertTrue(redacted.contains("user@example.com"))
+    }
+
+    func testRedactsGoogleTokens() {
+        let redacted = redactSensitiveData("Refreshed tokens \(accessToken) and \(refreshToken)")
+
+        XCTAssertFalse(redacted.contains("a0AfH6SMBx"))
+        XCTAssertFalse(redacted.contains("ExampleRefresh"))
+        XCTAssertTrue(redacted.hasPrefix("Refreshed tokens [REDACTED_TOKEN]"))
+    }
+
+    func testRedactsTokenFields() {
+        let json = #"{"access_token": "short-token", "expires_in": 3599, "refresh_token":"abc"}"#
+        let redacted = redactSensitiveData(json)
+
+        XCTAssertFalse(redacted.contains("short-token"))
+        XCTAssertFalse(redacted.contains("\"abc\""))
+        XCTAssertTrue(redacted.contains("\"expires_in\": 3599"))
+
+        XCTAssertEqual(redactSensitiveData("Authorization: Bearer abc.def"), "Authorization: Bearer [REDACTED]")
+        XCTAssertEqual(redactSensitiveData("AUTHENTICATE PLAIN AHVzZXIAcGFzcw=="), "AUTHENTICATE PLAIN [REDACTED]")
+    }
+
+    func testLeavesOrdinaryMessagesAlone() {
+        let message = "Backup completed for user@example.com: 12 emails downloaded, 0 errors"
+        XCTAssertEqual(redactSensitiveData(message), message)
+    }
+
+    // MARK: - Token Display Tests
+
+    func testOAuthTokensAreMaskedWhenPrinted() {
+        let tokens = GoogleOAuthTokens(
+            accessToken: accessToken,
+            refreshToken: refreshToken,
+            expiresAt: Date(),
+            tokenType: "Bearer",
+            scope: "https://mail.google.com/"
+        )
+
+        for output in ["\(tokens)", String(describing: tokens), String(reflecting: tokens)] {
+            XCTAssertFalse(output.contains(accessToken))
+            XCTAssertFalse(output.contains(refreshToken))
+            XCTAssertTrue(output.contains("ya29****"))
+        }
+    }
+
+    func testOAuthAccountListingHasNoTokens() throws {
+        let account = EmailAccount.gmailOAuth(email: "me@gmail.com")
+        for format in AccountListFormat.allCases {
+            let output = try AccountExportService.render([account], format: format)
+            XCTAssertFalse(output.lowercased().contains("token"))
+        }
+    }
+}
@@ -0,0 +1,132 @@
+import XCTest
+@testable import IMAPBackup
+
+final class MacAccountImportServiceTests: XCTestCase {
+
+    private func discovered(
+        username: String,
+        hostname: String? = "imap.example.com",
+        port: Int? = nil,
+        useSSL: Bool = true,
+        isGoogle: Bool = false
+    ) -> DiscoveredMailAccount {
+        DiscoveredMailAccount(
+            id: UUID().uuidString,
+            accountDescription: username,
+            username: username,
+            hostname: hostname,
+            port: port,
+            useSSL: useSSL,
+            isGoogle: isGoogle
+        )
+    }
+
+    // MARK: - Conversion Tests
+
+    func testConvertIMAPAccount() {
+        let account = MacAccountImportService.convert(discovered(username: "user@example.com", port: 993))
+
+        XCTAssertEqual(account?.email, "user@example.com")
+        XCTAssertEqual(account?.username, "user@example.com")
+        XCTAssertEqual(account?.imapServer, "imap.example.com")
+        XCTAssertEqual(account?.port, 993)
+        XCTAssertEqual(account?.authType, .password)
+        XCTAssertEqual(account?.hasTemporaryPassword, false)
+    }
+
+    func testConvertDefaultsPortFromSSL() {
+        let plain = MacAccountImportService.convert(discovered(username: "user@example.com", useSSL: false))
+        XCTAssertEqual(plain?.port, 143)
+        XCTAssertEqual(plain?.useSSL, false)
+
+        let secure = MacAccountImportService.convert(discovered(username: "user@example.com"))
+        XCTAssertEqual(secure?.port, 993)
+    }
+
+    func testConvertGoogleAccountUsesOAuth() {
+        let account = MacAccountImportService.convert(discovered(username: "user@gmail.com", hostname: nil, isGoogle: true))
+
+        XCTAssertEqual(account?.imapServer, "imap.gmail.com")
+        XCTAssertEqual(account?.authType, .oauth2)
+    }
+
+    func testConvertWithoutHostnameFails() {
+        XCTAssertNil(MacAccountImportService.convert(discovered(username: "user@example.com", hostname: nil)))
+        XCTAssertNil(MacAccountImportService.convert(discovered(username: "user@example.com", hostname: "")))
+        XCTAssertNil(MacAccountImportService.convert(discovered(username: "user@example.com", hostname: "  ")))
+    }
+
+    func testConvertCompletesMissingHostFromProviderTable() {
+        // A bundled iCloud account whose mail part came without server settings
+        let account = MacAccountImportService.convert(discovered(username: "User@iCloud.com", hostname: nil, port: 143, useSSL: false))
+
+        XCTAssertEqual(account?.imapServer, "imap.mail.me.com")
+        XCTAssertEqual(account?.port, 993)
+        XCTAssertEqual(account?.useSSL, true)
+        XCTAssertEqual(account?.username, "User@iCloud.com")
+        XCTAssertEqual(account?.authType, .password)
+
+        XCTAssertEqual(MacAccountImportService.convert(discovered(username: "user@hotmail.com", hostname: ""))?.imapServer, "outlook.office365.com")
+    }
+
+    func testConvertReplacesInvalidPort() {
+        let account = MacAccountImportService.convert(discovered(username: "user@example.com", port: 0))
+
+        XCTAssertEqual(account?.imapServer, "imap.example.com")
+        XCTAssertEqual(account?.port, 993)
+    }
+
+    func testImportableAccountsIncludeCompletedAccounts() {
+        let found = [
+            discovered(username: "user@gmx.de", hostname: nil),
+            discovered(username: "user@example.com", hostname: nil)
+        ]
+
+        let importable = MacAccountImportService.importableAccounts(from: found, existing: [])
+
+        XCTAssertEqual(importable.map { "\($0.username)|\($0.imapServer):\($0.port)" }, ["user@gmx.de|imap.gmx.net:993"])
+    }
+
+    func testProviderLookupByDomain() {
+        XCTAssertEqual(MailProvider.forEmail("someone@googlemail.com")?.host, "imap.gmail.com")
+        XCTAssertEqual(MailProvider.forEmail("someone@Web.DE")?.name, "WEB.DE")
+        XCTAssertNil(MailProvider.forEmail("someone@example.com"))
+        XCTAssertNil(MailProvider.forEmail("not-an-address"))
+    }
+
+    // MARK: - Dedup Tests
+
+    func testImportableAccountsSkipsExistingByUsernameAndHost() {
+        let existing = [EmailAccount(email: "user@example.com", imapServer: "IMAP.example.com")]
+        let found = [
+            discovered(username: "User@Example.com"),
+            discovered(username: "user@example.com", hostname: "mail.other.com"),
+            discovered(username: "new@example.com")
+        ]
+
+        let importable = MacAccountImportService.importableAccounts(from: found, existing: existing)
+
+        XCTAssertEqual(importable.map { "\($0.username)|\($0.imapServer)" }, [
+            "user@example.com|mail.other.com",
+            "new@example.com|imap.example.com"
+        ])
+    }
+
+    func testImportableAccountsSkipsDuplicatesWithinDiscovery() {
+        let found = [
+            discovered(username: "user@example.com"),
+            discovered(username: "user@example.com"),
+            discovered(username: "nohost@example.com", hostname: nil)
+        ]
+
+        let importable = MacAccountImportService.importableAccounts(from: found, existing: [])
+
+        XCTAssertEqual(importable.count, 1)
+        XCTAssertEqual(importable.first?.email, "user@example.com")
+    }
+
+    func testDiscoverAccountsWithoutDatabase() throws {
+        let missing = FileManager.default.temporaryDirectory.appendingPathComponent("missing-\(UUID().uuidString).sqlite")
+        XCTAssertEqual(try MacAccountImportService.discoverAccounts(databaseURL: missing), [])
+    }
+}
@@ -0,0 +1,145 @@
+import XCTest
+@testable import IMAPBackup
+
+final class MboxExportServiceTests: XCTestCase {
+
+    var tempDirectory: URL!
+    var folderURL: URL!
+    var mboxURL: URL!
+
+    override func setUpWithError() throws {
+        try super.setUpWithError()
+        tempDirectory = FileManager.default.temporaryDirectory.appendingPathComponent(UUID().uuidString)
+        folderURL = tempDirectory.appendingPathComponent("test@example.com/INBOX")
+        try FileManager.default.createDirectory(at: folderURL, withIntermediateDirectories: true)
+        mboxURL = tempDirectory.appendingPathComponent("INBOX.mbox")
+    }
+
+    override func tearDownWithError() throws {
+        try? FileManager.default.removeItem(at: tempDirectory)
+        try super.tearDownWithError()
+    }
+
+    private func addEmail(uid: UInt32, body: String = "Body") throws {
+        let content = "From: sender@example.com\r\nSubject: Message \(uid)\r\n\r\n\(body)\r\n"
+        try Data(content.utf8).write(to: folderURL.appendingPathComponent("\(uid)_20250101_000000_sender.eml"))
+    }
+
+    private func subjects() throws -> [String] {
+        try String(contentsOf: mboxURL, encoding: .utf8)
+            .components(separatedBy: "\n")
+            .filter { $0.hasPrefix("Subject: ") }
+    }
+
+    func testInitialExportWritesAllInUIDOrder() throws {
+        try addEmail(uid: 10)
+        try addEmail(uid: 2)
+
+        let result = try MboxExportService.exportFolder(at: folderURL, to: mboxURL)
+
+        XCTAssertEqual(result, MboxExportResult(appended: 2, alreadyExported: 0))
+        XCTAssertEqual(try subjects(), ["Subject: Message 2", "Subject: Message 10"])
+        XCTAssertEqual(MboxExportService.loadManifest(for: mboxURL)?.exportedUIDs, [2, 10])
+    }
+
+    func testIncrementalExportAppendsOnlyNewEmails() throws {
+        try addEmail(uid: 5)
+        try MboxExportService.exportFolder(at: folderURL, to: mboxURL, now: Date(timeIntervalSince1970: 1_760_000_000))
+
+        // A late arrival with a lower UID, and one newer email
+        try addEmail(uid: 3)
+        try addEmail(uid: 8)
+        let later = Date(timeIntervalSince1970: 1_760_086_400)
+        let result = try MboxExportService.exportFolder(at: folderURL, to: mboxURL, now: later)
+
+        XCTAssertEqual(result, MboxExportResult(appended: 2, alreadyExported: 1))
+        // Appended in arrival order after what was already there
+        XCTAssertEqual(try subjects(), ["Subject: Message 5", "Subject: Message 3", "Subject: Message 8"])
+
+        let manifest = MboxExportService.loadManifest(for: mboxURL)
+        XCTAssertEqual(manifest?.entries.map(\.uid), [5, 3, 8])
+        XCTAssertEqual(manifest?.lastExportedAt, later)
+
+        // Nothing new, nothing appended
+        XCTAssertEqual(try MboxExportService.exportFolder(at: folderURL, to: mboxURL),
+                       MboxExportResult(appended: 0, alreadyExported: 3))
+        XCTAssertEqual(try subjects().count, 3)
+    }
+
+    func testMissingManifestStartsOver() throws {
+        try addEmail(uid: 1)
+        try MboxExportService.exportFolder(at: folderURL, to: mboxURL)
+        try FileManager.default.removeItem(at: MboxExportService.manifestURL(for: mboxURL))
+
+        let result = try MboxExportService.exportFolder(at: folderURL, to: mboxURL)
+
+        XCTAssertEqual(result.appended, 1)
+        XCTAssertEqual(try subjects(), ["Subject: Message 1"])
+    }
+
+    func testCancelledExportKeepsWhatWasWritten() async throws {
+        for uid in UInt32(1)...20 {
+            try addEmail(uid: uid)
+        }
+        let folderURL = folderURL!, mboxURL = mboxURL!
+
+        // Cancel the export from inside, after the fifth email
+        let result = await Task {
+            try MboxExportService.exportFolder(at: folderURL, to: mboxURL) { exported, _ in
+                if exported == 5 {
+                    withUnsafeCurrentTask { $0?.cancel() }
+                }
+            }
+        }.result
+
+        XCTAssertThrowsError(try result.get()) { error in
+            XCTAssertTrue(error is CancellationError)
+        }
+        XCTAssertEqual(try subjects().count, 5)
+        XCTAssertEqual(MboxExportService.loadManifest(for: mboxURL)?.exportedUIDs, Set(UInt32(1)...5))
+
+        // The next run carries on where it stopped
+        let resumed = try MboxExportService.exportFolder(at: folderURL, to: mboxURL)
+        XCTAssertEqual(resumed, MboxExportResult(appended: 15, alreadyExported: 5))
+        XCTAssertEqual(try subjects().count, 20)
+    }
+
+    func testEmailsWrittenWithoutManifestAreNotExportedTwice() throws {
+        try addEmail(uid: 1)
+        try MboxExportService.exportFolder(at: folderURL, to: mboxURL)
+        let manifestBefore = try Data(contentsOf: MboxExportService.manifestURL(for: mboxURL))
+
+        // As after a crash between appending email 2 to the mbox and saving the manifest
+        try addEmail(uid: 2)
+        try MboxExportService.exportFolder(at: folderURL, to: mboxURL)
+        try manifestBefore.write(to: MboxExportService.manifestURL(for: mboxURL))
+
+        let result = try MboxExportService.exportFolder(at: folderURL, to: mboxURL)
+
+        XCTAssertEqual(result, MboxExportResult(appended: 1, alreadyExported: 1))
+        XCTAssertEqual(try subjects(), ["Subject: Message 1", "Subject: Message 2"])
+        XCTAssertEqual(MboxExportService.loadManifest(for: mboxURL)?.entries.map(\.uid), [1, 2])
+    }
+
+    func testUIDWithTwoFilesIsExportedOnce() throws {
+        try addEmail(uid: 4)
+        try Data("From: sender@example.com\r\nSubject: Message 4\r\n\r\nCopy\r\n".utf8)
+            .write(to: folderURL.appendingPathComponent("4_20250101_000000_sender_1.eml"))
+
+        let result = try MboxExportService.exportFolder(at: folderURL, to: mboxURL)
+
+        XCTAssertEqual(result.appended, 1)
+        XCTAssertEqual(try subjects(), ["Subject: Message 4"])
+        XCTAssertEqual(MboxExportService.loadManifest(for: mboxURL)?.entries.map(\.uid), [4])
+    }
+
+    func testFromLinesAreQuoted() throws {
+        let entry = MboxExportService.mboxEntry(
+            for: Data("Subject: Hi\r\n\r\nFrom here\r\n>From there\r\nFromage\r\n".utf8),
+            date: Date(timeIntervalSince1970: 0)
+        )
+
+        XCTAssertEqual(String(decoding: entry, as: UTF8.self),
+                       "From MAILER-DAEMON Thu Jan 1 00:00:00 1970\nSubject: Hi\n\n>From here\n>>From there\nFromage\n\n")
+    }
+}
@@ -0,0 +1,286 @@
+import Foundation
+import Network
+@testable import IMAPBackup
+
+/// An IMAP server on a loopback port that answers every line the client sends with what `respond`
+/// returns. Unlike `MockIMAPService` it lets tests run the real `IMAPService` over a real socket.
+final class FakeIMAPServer {
+
+    /// One line received from the client
+    struct Command {
+        /// Index of the connection it arrived on, counting from 0
+        let connection: Int
+        let tag: String
+        /// The line without its tag; for a continuation, the whole line
+        let text: String
+        /// Answer to a "+" continuation request of the command tagged `tag`
+        let isContinuation: Bool
+
+        /// Upper-cased command name, "UID FETCH" rather than "UID" for UID commands
+        var name: String {
+            let words = text.split(separator: " ").map { $0.uppercased() }
+            guard let first = words.first else { return "" }
+            return first == "UID" && words.count > 1 ? "UID \(words[1])" : first
+        }
+
+        /// Tagged OK completing this command
+        var ok: Reply {
+            .lines(["\(tag) OK \(name) completed"])
+        }
+    }
+
+    /// What the server does with one line
+    enum Reply {
+        /// Send these lines, each ended with CRLF; a last line starting with "+" asks for a continuation
+        case lines([String])
+        /// Close the connection without answering
+        case close
+    }
+
+    private let queue = DispatchQueue(label: "FakeIMAPServer")
+    private let listener: NWListener
+    private let greeting: String
+    private let respond: (Command) -> Reply
+    private var connections: [NWConnection] = []
+    private var commands: [Command] = []
+
+    /// `greeting` is sent without a tag when a client connects
+    init(greeting: String = "* OK IMAP4rev1 fake server ready", respond: @escaping (Command) -> Reply) throws {
+        let parameters = NWParameters.tcp
+        parameters.requiredLocalEndpoint = .hostPort(host: "127.0.0.1", port: .any)
+        listener = try NWListener(using: parameters)
+        self.greeting = greeting
+        self.respond = respond
+    }
+
+    /// Start listening, returning once the port is known
+    func start() async throws {
+        try await withCheckedThrowingContinuation { (continuation: CheckedContinuation<Void, Error>) in
+            var resumed = false
+            listener.stateUpdateHandler = { state in
+                guard !resumed else { return }
+                switch state {
+                case .ready:
+                    resumed = true
+                    continuation.resume()
+                case .failed(let error):
+                    resumed = true
+                    continuation.resume(throwing: error)
+                default:
+                    break
+                }
+            }
+            listener.newConnectionHandler = { [weak self] connection in
+                self?.accept(connection)
+            }
+            listener.start(queue: queue)
+        }
+    }
+
+    func stop() {
+        listener.cancel()
+        queue.sync {
+            connections.forEach { $0.cancel() }
+        }
+    }
+
+    /// Close every open connection, as a server does after an idle timeout
+    func dropConnections() {
+        queue.sync {
+            connections.forEach { $0.cancel() }
+        }
+    }
+
+    var port: Int {
+        Int(listener.port?.rawValue ?? 0)
+    }
+
+    /// Every line received so far, in order
+    var received: [Command] {
+        queue.sync { commands }
+    }
+
+    /// Names of the tagged commands received so far
+    var commandNames: [String] {
+        received.filter { !$0.isContinuation }.map(\.name)
+    }
+
+    var connectionCount: Int {
+        queue.sync { connections.count }
+    }
+
+    /// A plain-text account pointing at this server
+    func account(password: String = "secret") -> EmailAccount {
+        EmailAccount(email: "me@example.com", imapServer: "127.0.0.1", port: port,
+                     password: password, useSSL: false, sendClientID: false)
+    }
+
+    // MARK: - Connections
+
+    private func accept(_ connection: NWConnection) {
+        let index = connections.count
+        connections.append(connection)
+        connection.start(queue: queue)
+        send(["\(greeting)"], on: connection)
+        receive(on: connection, index: index, buffer: Data(), continuationTag: nil)
+    }
+
+    private func receive(on connection: NWConnection, index: Int, buffer: Data, continuationTag: String?) {
+        connection.receive(minimumIncompleteLength: 1, maximumLength: 65536) { [weak self] data, _, isComplete, error in
+            guard let self = self else { return }
+            var buffer = buffer + (data ?? Data())
+            var continuationTag = continuationTag
+
+            while let end = buffer.range(of: Data("\r\n".utf8)) {
+                let line = String(decoding: buffer[buffer.startIndex..<end.lowerBound], as: UTF8.self)
+                buffer = Data(buffer[end.upperBound...])
+
+                let command: Command
+                if let tag = continuationTag {
+                    command = Command(connection: index, tag: tag, text: line, isContinuation: true)
+                } else {
+                    let parts = line.split(separator: " ", maxSplits: 1)
+                    command = Command(connection: index, tag: parts.first.map(String.init) ?? "",
+                                      text: parts.count > 1 ? String(parts[1]) : "", isContinuation: false)
+                }
+                self.commands.append(command)
+
+                switch self.respond(command) {
+                case .lines(let lines):
+                    continuationTag = lines.last?.hasPrefix("+") == true ? command.tag : nil
+                    self.send(lines, on: connection)
+                case .close:
+                    connection.cancel()
+                    return
+                }
+            }
+
+            guard error == nil, !isComplete else {
+                connection.cancel()
+                return
+            }
+            self.receive(on: connection, index: index, buffer: buffer, continuationTag: continuationTag)
+        }
+    }
+
+    private func send(_ lines: [String], on connection: NWConnection) {
+        let data = Data(lines.map { "\($0)\r\n" }.joined().utf8)
+        connection.send(content: data, completion: .contentProcessed { _ in })
+    }
+}
+
+// MARK: - Mailboxes
+
+extension FakeIMAPServer {
+
+    /// Folders of messages known only by UID, for answering SELECT and MOVE from a `respond` closure.
+    /// Sequence numbers follow from the order of the UIDs, so the first message is 1.
+    final class Mailboxes {
+        private let lock = NSLock()
+        private var folders: [String: [UInt32]]
+        private var nextUIDs: [String: UInt32]
+        private var selected: [Int: String] = [:]
+
+        init(_ folders: [String: [UInt32]]) {
+            self.folders = folders.mapValues { $0.sorted() }
+            self.nextUIDs = self.folders.mapValues { ($0.last ?? 0) + 1 }
+        }
+
+        /// UIDs now in `folder`, ascending
+        func uids(in folder: String) -> [UInt32] {
+            lock.lock()
+            defer { lock.unlock() }
+            return folders[folder] ?? []
+        }
+
+        /// Answer SELECT or EXAMINE; nil for any other command
+        func handleSelect(_ command: Command) -> Reply? {
+            guard !command.isContinuation, command.name == "SELECT" || command.name == "EXAMINE" else { return nil }
+            let folder = Self.mailbox(in: command.text.dropFirst(command.name.count + 1))
+
+            lock.lock()
+            defer { lock.unlock() }
+            guard let uids = folders[folder] else {
+                selected[command.connection] = nil
+                return .lines(["\(command.tag) NO [NONEXISTENT] No such mailbox"])
+            }
+            selected[command.connection] = folder
+            return .lines([
+                "* \(uids.count) EXISTS",
+                "* OK [UIDVALIDITY 1] UIDs valid",
+                "* OK [UIDNEXT \(nextUIDs[folder] ?? 1)] Predicted next UID",
+                "\(command.tag) OK [\(command.name == "EXAMINE" ? "READ-ONLY" : "READ-WRITE")] \(command.name) completed"
+            ])
+        }
+
+        /// Answer MOVE, whose set holds sequence numbers, or UID MOVE, whose set holds UIDs (RFC 6851):
+        /// the COPYUID of the moved messages, then an EXPUNGE for each, highest sequence number first
+        func handleMove(_ command: Command) -> Reply {
+            let isUID = command.name == "UID MOVE"
+            let arguments = command.text.dropFirst(command.name.count + 1)
+            let parts = arguments.split(separator: " ", maxSplits: 1)
+            guard parts.count == 2 else {
+                return .lines(["\(command.tag) BAD Missing arguments"])
+            }
+            let target = Self.mailbox(in: parts[1])
+
+            lock.lock()
+            defer { lock.unlock() }
+            guard let source = selected[command.connection], let uids = folders[source] else {
+                return .lines(["\(command.tag) BAD No mailbox selected"])
+            }
+            guard folders[target] != nil else {
+                return .lines(["\(command.tag) NO [TRYCREATE] No such mailbox"])
+            }
+
+            let largest = isUID ? (uids.last ?? 0) : UInt32(uids.count)
+            let wanted = Self.numbers(in: parts[0], largest: largest)
+            let moved = uids.enumerated().filter { index, uid in
+                wanted.contains(isUID ? uid : UInt32(index + 1))
+            }
+            guard !moved.isEmpty else {
+                return .lines(["\(command.tag) OK No messages moved"])
+            }
+
+            let first = nextUIDs[target] ?? 1
+            let newUIDs = (0..<UInt32(moved.count)).map { first + $0 }
+            nextUIDs[target] = first + UInt32(moved.count)
+            folders[target, default: []].append(contentsOf: newUIDs)
+            folders[source] = uids.filter { uid in !moved.contains { $0.element == uid } }
+
+            let sourceSet = moved.map { String($0.element) }.joined(separator: ",")
+            let targetSet = newUIDs.map(String.init).joined(separator: ",")
+            return .lines(
+                ["* OK [COPYUID 1 \(sourceSet) \(targetSet)] Moved"]
+                + moved.reversed().map { "* \($0.offset + 1) EXPUNGE" }
+                + ["\(command.tag) OK \(command.name) completed"]
+            )
+        }
+
+        /// A mailbox argument without its quotes
+        private static func mailbox(in argument: Substring) -> String {
+            let trimmed = argument.trimmingCharacters(in: .whitespaces)
+            guard trimmed.count >= 2, trimmed.hasPrefix("\""), trimmed.hasSuffix("\"") else { return trimmed }
+            return String(trimmed.dropFirst().dropLast())
+                .replacingOccurrences(of: "\\\"", with: "\"")
+                .replacingOccurrences(of: "\\\\", with: "\\")
+        }
+
+        /// Numbers of a set such as "1,3:5,7:*", with "*" standing for `largest`
+        private static func numbers(in set: Substring, largest: UInt32) -> Set<UInt32> {
+            func number(_ text: Substring) -> UInt32? {
+                text == "*" ? largest : UInt32(text)
+            }
+            var result = Set<UInt32>()
+            for item in set.split(separator: ",") {
+                let bounds = item.split(separator: ":")
+                if bounds.count == 2, let a = number(bounds[0]), let b = number(bounds[1]) {
+                    result.formUnion(min(a, b)...max(a, b))
+                } else if let n = number(item) {
+                    result.insert(n)
+                }
+            }
+            return result
+        }
+    }
+}
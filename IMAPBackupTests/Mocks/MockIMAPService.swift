@@ -1,6 +1,70 @@
 import Foundation
 @testable import IMAPBackup
 
+/// A crafted message for seeding the mock server with a known edge case
+struct MockMessageSpec {
+    struct Attachment {
+        let filename: String
+        let contentType: String
+        let data: Data
+    }
+
+    var messageId = "injected@example.com"
+    var from = "Sender <sender@example.com>"
+    var to = "test@example.com"
+    var subject = "Injected message"
+    var date = "Mon, 20 Jan 2026 10:00:00 +0000"
+    /// IANA charset the text body is encoded in and declared as, sent as 8bit
+    var charset = "utf-8"
+    var body = "Body"
+    var attachments: [Attachment] = []
+    var flags: [String] = []
+    /// INTERNALDATE the server reports; nil reports none
+    var internalDate: Date?
+
+    /// The message as it would be sent: CRLF line endings, multipart/mixed when there are attachments,
+    /// attachments in base64
+    func rfc822Data() -> Data {
+        let textHeaders = "Content-Type: text/plain; charset=\(charset)\r\nContent-Transfer-Encoding: 8bit\r\n"
+        var headers = "From: \(from)\r\nTo: \(to)\r\nSubject: \(subject)\r\nDate: \(date)\r\n"
+            + "Message-ID: <\(messageId)>\r\nMIME-Version: 1.0\r\n"
+
+        guard !attachments.isEmpty else {
+            var data = Data((headers + textHeaders + "\r\n").utf8)
+            data.append(encodedBody())
+            data.append(Data("\r\n".utf8))
+            return data
+        }
+
+        let boundary = "----=_MockPart_0001"
+        headers += "Content-Type: multipart/mixed; boundary=\"\(boundary)\"\r\n\r\n"
+        var data = Data((headers + "--\(boundary)\r\n" + textHeaders + "\r\n").utf8)
+        data.append(encodedBody())
+        data.append(Data("\r\n".utf8))
+        for attachment in attachments {
+            let part = "--\(boundary)\r\n"
+                + "Content-Type: \(attachment.contentType); name=\"\(attachment.filename)\"\r\n"
+                + "Content-Disposition: attachment; filename=\"\(attachment.filename)\"\r\n"
+                + "Content-Transfer-Encoding: base64\r\n\r\n"
+                + attachment.data.base64EncodedString(options: [.lineLength76Characters, .endLineWithCarriageReturn, .endLineWithLineFeed])
+                + "\r\n"
+            data.append(Data(part.utf8))
+        }
+        data.append(Data("--\(boundary)--\r\n".utf8))
+        return data
+    }
+
+    private func encodedBody() -> Data {
+        let body = self.body.replacingOccurrences(of: "\n", with: "\r\n")
+        let cfEncoding = CFStringConvertIANACharSetNameToEncoding(charset as CFString)
+        if cfEncoding != kCFStringEncodingInvalidId,
+           let data = body.data(using: String.Encoding(rawValue: CFStringConvertEncodingToNSStringEncoding(cfEncoding))) {
+            return data
+        }
+        return Data(body.utf8)
+    }
+}
+
 /// Mock IMAP service for unit testing without a real server
 actor MockIMAPService: IMAPServiceProtocol {
 
@@ -17,18 +81,70 @@ actor MockIMAPService: IMAPServiceProtocol {
     /// Simulated emails per folder (folder name -> [UID: email data])
     var emails: [String: [UInt32: Data]] = [:]
 
+    /// Simulated flags per UID, reported with the envelope
+    var messageFlags: [UInt32: [String]] = [:]
+
+    /// Simulated CONDSTORE mod-sequence per UID; messages never changed have 1
+    var messageModSeqs: [UInt32: UInt64] = [:]
+    private var highestModSeq: UInt64 = 1
+
+    /// Capabilities advertised by the mock server
+    var advertisedCapabilities: Set<String> = ["IMAP4REV1", "MOVE", "UIDPLUS"]
+
+    /// Server names of folders outside the personal namespace, listed by namespace prefix
+    var sharedFolderNames: [String] = []
+
+    /// Untagged reply to NAMESPACE, sent when "NAMESPACE" is advertised
+    var namespaceResponse = "* NAMESPACE ((\"\" \"/\")) NIL NIL"
+
+    /// Identification the mock server answers the ID command with
+    var serverIdentification: [String: String] = ["name": "MockIMAP", "version": "1.0"]
+
+    /// Greeting the mock server sends on connect
+    var greeting = "* OK [CAPABILITY IMAP4rev1] MockIMAP ready"
+
     /// Currently selected folder
     private var selectedFolder: String?
 
     /// Connection state
     private var isConnected = false
+    /// Whether the connection is open, to check that none is left behind
+    var connectionIsOpen: Bool { isConnected }
     private var isLoggedIn = false
 
     // MARK: - Error simulation
 
     var shouldFailConnect = false
     var shouldFailLogin = false
+    /// LIST attempts that lose the connection before one goes through
+    var listFailures = 0
     var shouldFailOnUID: UInt32? = nil
+    /// Fail every fetch of these UIDs
+    var failingUIDs: Set<UInt32> = []
+    /// Reject fetches with a download-limit error once this many emails were served
+    var bandwidthCapAfterFetches: Int? = nil
+    /// Refuse BODY.PEEK[] for these UIDs so the RFC822 fallback is used
+    var peekRefusedUIDs: Set<UInt32> = []
+    /// Answer BAD to FETCH item lists containing any of these items, e.g. "BODYSTRUCTURE"
+    var refusedFetchItems: Set<String> = []
+    /// RFC822.SIZE to report instead of the real size, to simulate truncated downloads
+    var reportedSizes: [UInt32: Int] = [:]
+    /// BODYSTRUCTURE FETCH response per UID; messages without one report none
+    var bodyStructures: [UInt32: String] = [:]
+    /// BODY[<section>] contents per UID, e.g. "HEADER", "1.MIME" and "1"
+    var bodySections: [UInt32: [String: Data]] = [:]
+    /// INTERNALDATE per UID; messages without one report none
+    var internalDates: [UInt32: Date] = [:]
+    /// Fail LOGOUT with this error, e.g. `.connectionClosed` for a server that already dropped the connection
+    var logoutError: IMAPError? = nil
+    /// Answer LOGIN with a REFERRAL to this IMAP URL
+    var loginReferral: String? = nil
+    /// Answer SELECT of these folders with a REFERRAL to the mapped IMAP URL
+    var folderReferrals: [String: String] = [:]
+    /// Answer SEARCH with NO when it uses any of these keys, e.g. "BODY" for a server without a body index
+    var refusedSearchKeys: Set<String> = []
+    /// Answer EXAMINE of these folders with NO, as some servers do for certain mailboxes
+    var examineRefusedFolders: Set<String> = []
     var connectionDelay: TimeInterval = 0
     var fetchDelay: TimeInterval = 0
 
@@ -36,10 +152,37 @@ actor MockIMAPService: IMAPServiceProtocol {
 
     private(set) var connectCallCount = 0
     private(set) var loginCallCount = 0
+    private(set) var credentialsSentCount = 0
+    private(set) var lastAuthMechanism: PasswordAuthMechanism?
     private(set) var logoutCallCount = 0
     private(set) var listFoldersCallCount = 0
+    private(set) var reconnectCount = 0
     private(set) var selectFolderCalls: [String] = []
+    /// Commands the folders were opened with, e.g. "EXAMINE INBOX"
+    private(set) var openFolderCommands: [String] = []
     private(set) var fetchEmailCalls: [UInt32] = []
+    /// Sections fetched one by one, as "<uid>:<section>"
+    private(set) var fetchBodySectionCalls: [String] = []
+    /// UID ranges Message-IDs were fetched for, in order
+    private(set) var fetchMessageIDsCalls: [ClosedRange<UInt32>] = []
+    /// UID sets of the batched envelope fetches, in order
+    private(set) var fetchEnvelopesCalls: [[UInt32]] = []
+    /// SEARCH commands as the client would send them
+    private(set) var searchCommands: [String] = []
+    /// CHANGEDSINCE value of each flag fetch, nil for a full fetch
+    private(set) var fetchFlagsCalls: [UInt64?] = []
+    private(set) var moveCalls: [String] = []
+    private(set) var deleteCalls: [[UInt32]] = []
+    /// Folders messages were appended to, in order
+    private(set) var appendCalls: [String] = []
+
+    /// COPYUID mapping from the last move (source UID -> destination UID)
+    private(set) var lastCopyUIDs: [UInt32: UInt32] = [:]
+
+    /// Client identification received with the last ID command
+    private(set) var receivedClientID: [String: String]?
+    /// Raw ID commands as they arrived
+    private(set) var idCommands: [String] = []
 
     // MARK: - Setup helpers
 
@@ -69,19 +212,62 @@ actor MockIMAPService: IMAPServiceProtocol {
         addEmail(to: folder, uid: uid, content: email)
     }
 
+    /// Add a message built from `spec` under the next free UID, as an APPEND would, and return that UID.
+    /// Unlike `appendEmail` this needs no login, so tests can seed a mailbox before connecting.
+    @discardableResult
+    func injectMessage(into folder: String, spec: MockMessageSpec) -> UInt32 {
+        let uid = (emails[folder]?.keys.max() ?? 0) + 1
+        addEmail(to: folder, uid: uid, data: spec.rfc822Data())
+        if !spec.flags.isEmpty {
+            messageFlags[uid] = spec.flags
+        }
+        internalDates[uid] = spec.internalDate
+        return uid
+    }
+
+    /// Change a message's flags as another client would, giving it the next mod-sequence
+    func setFlags(_ flags: [String], for uid: UInt32) {
+        messageFlags[uid] = flags
+        highestModSeq += 1
+        messageModSeqs[uid] = highestModSeq
+    }
+
     func reset() {
         isConnected = false
         isLoggedIn = false
         selectedFolder = nil
         connectCallCount = 0
         loginCallCount = 0
+        credentialsSentCount = 0
+        lastAuthMechanism = nil
         logoutCallCount = 0
         listFoldersCallCount = 0
+        reconnectCount = 0
+        listFailures = 0
         selectFolderCalls = []
+        openFolderCommands = []
         fetchEmailCalls = []
+        fetchBodySectionCalls = []
+        fetchMessageIDsCalls = []
+        fetchEnvelopesCalls = []
+        searchCommands = []
+        fetchFlagsCalls = []
+        moveCalls = []
+        deleteCalls = []
+        appendCalls = []
+        lastCopyUIDs = [:]
+        receivedClientID = nil
+        idCommands = []
         shouldFailConnect = false
         shouldFailLogin = false
         shouldFailOnUID = nil
+        failingUIDs = []
+        bandwidthCapAfterFetches = nil
+        logoutError = nil
+        loginReferral = nil
+        folderReferrals = [:]
+        examineRefusedFolders = []
+        refusedSearchKeys = []
     }
 
     // MARK: - IMAPServiceProtocol
@@ -113,6 +299,14 @@ actor MockIMAPService: IMAPServiceProtocol {
             throw IMAPError.notConnected
         }
 
+        // Mirrors the client: pick a mechanism, refusing before any credentials are sent
+        lastAuthMechanism = try IMAPService.passwordMechanisms(for: advertisedCapabilities).first
+        credentialsSentCount += 1
+
+        if let url = loginReferral {
+            try rejectWithReferral("A0002 NO [REFERRAL \(url)] Account moved to another server")
+        }
+
         if shouldFailLogin {
             throw IMAPError.authenticationFailed
         }
@@ -120,23 +314,102 @@ actor MockIMAPService: IMAPServiceProtocol {
         isLoggedIn = true
     }
 
+    /// Mirrors the client: a connection that is already closed is not an error, anything else is
     func logout() async throws {
         logoutCallCount += 1
         await disconnect()
+        if let error = logoutError, !IMAPService.isClosedConnectionError(error) {
+            throw error
+        }
     }
 
+    /// Retries like the real client, without the backoff delay
     func listFolders() async throws -> [IMAPFolder] {
+        try await IMAPService.withRetry("LIST", baseDelay: 0) {
+            try await self.listFoldersOnce()
+        } beforeRetry: {
+            try await self.reconnect()
+        }
+    }
+
+    private func listFoldersOnce() throws -> [IMAPFolder] {
         listFoldersCallCount += 1
 
         guard isLoggedIn else {
             throw IMAPError.notConnected
         }
 
+        if listFailures > 0 {
+            listFailures -= 1
+            // The connection is gone with the LIST half answered
+            isConnected = false
+            isLoggedIn = false
+            throw IMAPError.receiveFailed("Connection reset by peer")
+        }
+
         return folders
     }
 
+    private func reconnect() async throws {
+        reconnectCount += 1
+        await disconnect()
+        try await connect()
+        try await login(password: nil)
+    }
+
+    func namespaces() async throws -> IMAPNamespaces? {
+        guard isLoggedIn else {
+            throw IMAPError.notConnected
+        }
+        guard advertisedCapabilities.contains("NAMESPACE") else {
+            return nil
+        }
+        return IMAPNamespaces.parse(namespaceResponse + "\r\nA0004 OK NAMESPACE completed\r\n")
+    }
+
+    /// Builds a LIST response per namespace and parses it like the client
+    func listSharedFolders() async throws -> [IMAPFolder] {
+        guard let namespaces = try await namespaces() else {
+            return []
+        }
+
+        var result: [IMAPFolder] = []
+        for (namespace, isOtherUsers) in namespaces.otherUsers.map({ ($0, true) }) + namespaces.shared.map({ ($0, false) }) {
+            let delimiter = namespace.delimiter.isEmpty ? "NIL" : "\"\(namespace.delimiter)\""
+            let response = sharedFolderNames
+                .filter { $0.hasPrefix(namespace.prefix) }
+                .map { "* LIST () \(delimiter) \"\($0)\"\r\n" }
+                .joined()
+            result += IMAPService.sharedFolders(in: response, namespace: namespace, isOtherUsers: isOtherUsers)
+        }
+        return result
+    }
+
     func selectFolder(_ folder: String) async throws -> FolderStatus {
         selectFolderCalls.append(folder)
+        return try openFolder(folder, command: "SELECT")
+    }
+
+    /// Falls back like the real client, through the same helper
+    func examineFolder(_ folder: String) async throws -> FolderStatus {
+        let refused = examineRefusedFolders.contains(folder)
+        _ = try await IMAPService.examineWithFallback(folder) { command in
+            if command == "EXAMINE" && refused {
+                await self.recordOpenFolderCommand("EXAMINE \(folder)")
+                return "A0003 NO [CANNOT] EXAMINE is not supported for this mailbox\r\n"
+            }
+            _ = try await self.openFolder(folder, command: command)
+            return "A0003 OK [READ-\(command == "EXAMINE" ? "ONLY" : "WRITE")] \(command) completed\r\n"
+        }
+        return folderStatus(folder)
+    }
+
+    private func recordOpenFolderCommand(_ command: String) {
+        openFolderCommands.append(command)
+    }
+
+    private func openFolder(_ folder: String, command: String) throws -> FolderStatus {
+        openFolderCommands.append("\(command) \(folder)")
 
         guard isLoggedIn else {
             throw IMAPError.notConnected
@@ -146,8 +419,15 @@ actor MockIMAPService: IMAPServiceProtocol {
             throw IMAPError.folderNotFound(folder)
         }
 
+        if let url = folderReferrals[folder] {
+            try rejectWithReferral("A0003 NO [REFERRAL \(url)] Mailbox lives elsewhere")
+        }
+
         selectedFolder = folder
+        return folderStatus(folder)
+    }
 
+    private func folderStatus(_ folder: String) -> FolderStatus {
         let folderEmails = emails[folder] ?? [:]
         let maxUID = folderEmails.keys.max() ?? 0
 
@@ -159,6 +439,20 @@ actor MockIMAPService: IMAPServiceProtocol {
         )
     }
 
+    func fetchMessageIDs(uids: ClosedRange<UInt32>) async throws -> [UInt32: String] {
+        fetchMessageIDsCalls.append(uids)
+
+        guard let folder = selectedFolder else {
+            throw IMAPError.notConnected
+        }
+
+        var messageIds: [UInt32: String] = [:]
+        for (uid, data) in emails[folder] ?? [:] where uids.contains(uid) {
+            messageIds[uid] = EmailParser.messageId(from: data)
+        }
+        return messageIds
+    }
+
     func fetchEmailHeaders(uids: ClosedRange<UInt32>) async throws -> [EmailHeader] {
         guard let folder = selectedFolder else {
             throw IMAPError.notConnected
@@ -197,10 +491,14 @@ actor MockIMAPService: IMAPServiceProtocol {
             try await Task.sleep(nanoseconds: UInt64(fetchDelay * 1_000_000_000))
         }
 
-        if shouldFailOnUID == uid {
+        if shouldFailOnUID == uid || failingUIDs.contains(uid) {
             throw IMAPError.fetchFailed("Mock fetch failure for UID \(uid)")
         }
 
+        if let cap = bandwidthCapAfterFetches, fetchEmailCalls.count > cap {
+            throw IMAPError.bandwidthLimitExceeded("NO [OVERQUOTA] Account exceeded command or bandwidth limits. (Failure)")
+        }
+
         guard let folder = selectedFolder else {
             throw IMAPError.notConnected
         }
@@ -209,7 +507,13 @@ actor MockIMAPService: IMAPServiceProtocol {
             throw IMAPError.fetchFailed("Email not found: UID \(uid)")
         }
 
-        return data
+        let peekRefused = peekRefusedUIDs.contains(uid)
+        return try await IMAPService.fetchFirstNonEmpty(uid: uid, items: BodyFetchItem.fallbackOrder) { item in
+            if item == .peek && peekRefused {
+                throw IMAPError.fetchFailed("UID \(uid): A0001 NO BODY.PEEK not available")
+            }
+            return data
+        }
     }
 
     func fetchEmailSize(uid: UInt32) async throws -> Int {
@@ -221,7 +525,111 @@ actor MockIMAPService: IMAPServiceProtocol {
             throw IMAPError.fetchFailed("Email not found: UID \(uid)")
         }
 
-        return data.count
+        return reportedSizes[uid] ?? data.count
+    }
+
+    func fetchBodyStructure(uid: UInt32) async throws -> BodyStructure? {
+        guard selectedFolder != nil else {
+            throw IMAPError.notConnected
+        }
+        return bodyStructures[uid].flatMap { BodyStructure(response: $0) }
+    }
+
+    func fetchBodySection(uid: UInt32, section: String) async throws -> Data {
+        fetchBodySectionCalls.append("\(uid):\(section)")
+        guard let data = bodySections[uid]?[section] else {
+            throw IMAPError.fetchFailed("UID \(uid): no section \(section)")
+        }
+        return data
+    }
+
+    func fetchInternalDate(uid: UInt32) async throws -> Date? {
+        guard let folder = selectedFolder else {
+            throw IMAPError.notConnected
+        }
+
+        guard emails[folder]?[uid] != nil else {
+            throw IMAPError.fetchFailed("Email not found: UID \(uid)")
+        }
+
+        return internalDates[uid]
+    }
+
+    func fetchEnvelope(uid: UInt32) async throws -> String {
+        let data = try await fetchEmail(uid: uid)
+        let refused = refusedFetchItems
+
+        // Goes through the same item list downgrade as the real client
+        return try await IMAPService.firstAcceptedFetch(uidSet: String(uid), itemLists: IMAPService.envelopeFetchItems) { command in
+            if refused.contains(where: { command.contains($0) }) {
+                return "A0001 BAD Invalid FETCH item combination\r\n"
+            }
+            return await self.envelopeLine(sequence: 1, uid: uid, data: data, withBodyStructure: command.contains("BODYSTRUCTURE"))
+                + "A0001 OK FETCH completed\r\n"
+        }.response
+    }
+
+    func fetchEnvelopes(uids: [UInt32]) async throws -> [UInt32: String] {
+        fetchEnvelopesCalls.append(uids)
+
+        guard let folder = selectedFolder else {
+            throw IMAPError.notConnected
+        }
+
+        let refused = refusedFetchItems
+        let items = IMAPService.twoPhaseEnvelopeItems
+        let response = try await IMAPService.firstAcceptedFetch(
+            uidSet: uids.map(String.init).joined(separator: ","),
+            itemLists: [items]
+        ) { _ in
+            if refused.contains(where: { items.contains($0) }) {
+                return "A0001 BAD Invalid FETCH item combination\r\n"
+            }
+            // Like a server, UIDs that no longer exist are silently left out
+            var lines = ""
+            for (index, uid) in uids.enumerated() {
+                guard let data = await self.emails[folder]?[uid] else { continue }
+                lines += await self.envelopeLine(sequence: index + 1, uid: uid, data: data, withBodyStructure: false, withSize: true)
+            }
+            return lines + "A0001 OK FETCH completed\r\n"
+        }.response
+        return IMAPService.fetchResponsesByUID(response)
+    }
+
+    /// Answers in the wire format so the client's parser is exercised; CHANGEDSINCE needs CONDSTORE advertised
+    func fetchFlags(changedSince modSeq: UInt64?) async throws -> FlagFetchResult {
+        fetchFlagsCalls.append(modSeq)
+
+        guard let folder = selectedFolder else {
+            throw IMAPError.notConnected
+        }
+
+        let condStore = advertisedCapabilities.contains("CONDSTORE")
+        var lines = ""
+        for (index, uid) in (emails[folder] ?? [:]).keys.sorted().enumerated() {
+            let messageModSeq = messageModSeqs[uid] ?? 1
+            if condStore, let modSeq = modSeq, messageModSeq <= modSeq {
+                continue
+            }
+            let flags = (messageFlags[uid] ?? []).joined(separator: " ")
+            lines += "* \(index + 1) FETCH (UID \(uid) FLAGS (\(flags))\(condStore ? " MODSEQ (\(messageModSeq))" : ""))\r\n"
+        }
+        return IMAPService.parseFlagFetch(lines + "A0001 OK FETCH completed\r\n", isIncremental: condStore && modSeq != nil)
+    }
+
+    /// One untagged FETCH line with the flags and envelope of a stored message
+    private func envelopeLine(sequence: Int, uid: UInt32, data: Data, withBodyStructure: Bool, withSize: Bool = false) -> String {
+        let content = String(data: data, encoding: .utf8) ?? ""
+        let date = extractHeader(named: "Date", from: content) ?? ""
+        let subject = extractHeader(named: "Subject", from: content) ?? ""
+        let messageId = extractHeader(named: "Message-ID", from: content) ?? ""
+        let flags = (messageFlags[uid] ?? []).joined(separator: " ")
+        let bodyStructure = withBodyStructure
+            ? " BODYSTRUCTURE (\"TEXT\" \"PLAIN\" (\"CHARSET\" \"utf-8\") NIL NIL \"7BIT\" \(data.count) 1)"
+            : ""
+        let size = withSize ? " RFC822.SIZE \(reportedSizes[uid] ?? data.count)" : ""
+        return "* \(sequence) FETCH (UID \(uid) FLAGS (\(flags))\(size) ENVELOPE (\"\(date)\" \"\(subject)\" NIL NIL NIL NIL NIL NIL NIL \"\(messageId)\")"
+            + "\(bodyStructure))\r\n"
     }
 
     func streamEmailToFile(uid: UInt32, destinationURL: URL) async throws -> Int64 {
@@ -239,6 +647,167 @@ actor MockIMAPService: IMAPServiceProtocol {
         return Array(folderEmails.keys).sorted()
     }
 
+    /// Uses the Date header in place of the internal date
+    func searchSince(_ date: Date) async throws -> [UInt32] {
+        guard let folder = selectedFolder else {
+            throw IMAPError.notConnected
+        }
+
+        let day = Calendar.current.startOfDay(for: date)
+        return (emails[folder] ?? [:])
+            .filter { (EmailParser.parseMetadata(from: $0.value)?.date ?? .distantPast) >= day }
+            .keys
+            .sorted()
+    }
+
+    /// Matches headers and body text ignoring case, and dates against the Date header
+    func search(_ criteria: IMAPSearchCriteria) async throws -> [UInt32] {
+        let command = "UID SEARCH \(criteria.searchKeys)"
+        searchCommands.append(command)
+
+        guard let folder = selectedFolder else {
+            throw IMAPError.notConnected
+        }
+        if refusedSearchKeys.contains(where: { command.contains(" \($0) ") }) {
+            throw IMAPError.commandFailed(command)
+        }
+
+        func contains(_ text: String?, _ needle: String?) -> Bool {
+            guard let needle = needle, !needle.isEmpty else { return true }
+            return text?.range(of: needle, options: .caseInsensitive) != nil
+        }
+
+        return (emails[folder] ?? [:]).filter { _, data in
+            let content = String(data: data, encoding: .utf8) ?? ""
+            let headerEnd = content.range(of: "\r\n\r\n") ?? content.range(of: "\n\n")
+            let body = headerEnd.map { String(content[$0.upperBound...]) } ?? ""
+            let date = EmailParser.parseMetadata(from: data)?.date ?? .distantPast
+
+            if let since = criteria.since, date < Calendar.current.startOfDay(for: since) {
+                return false
+            }
+            if let before = criteria.before, date >= Calendar.current.startOfDay(for: before) {
+                return false
+            }
+            return contains(extractHeader(named: "From", from: content), criteria.from)
+                && contains(extractHeader(named: "Subject", from: content), criteria.subject)
+                && contains(body, criteria.body)
+        }
+        .keys
+        .sorted()
+    }
+
+    func serverInfo() async -> IMAPServerInfo? {
+        isConnected ? IMAPServerInfo.parse(greeting: greeting) : nil
+    }
+
+    func capabilities() async throws -> Set<String> {
+        guard isConnected else {
+            throw IMAPError.notConnected
+        }
+        return advertisedCapabilities
+    }
+
+    /// Goes through the wire format: the command text is built by the client and parsed by the handler
+    func sendClientID(_ fields: [String: String]) async throws -> [String: String] {
+        guard isConnected else {
+            throw IMAPError.notConnected
+        }
+
+        let response = handleIDCommand("A0001", IMAPService.idCommand(fields))
+        guard response.hasSuffix("OK ID completed\r\n") else {
+            throw IMAPError.commandFailed("ID")
+        }
+        return IMAPService.parseIDResponse(response)
+    }
+
+    /// Server side of ID (RFC 2971): store the client's parameters and answer with our own
+    func handleIDCommand(_ tag: String, _ command: String) -> String {
+        guard advertisedCapabilities.contains("ID") else {
+            return "\(tag) BAD Unknown command\r\n"
+        }
+        guard command.uppercased().hasPrefix("ID ") else {
+            return "\(tag) BAD Invalid arguments\r\n"
+        }
+
+        idCommands.append(command)
+        receivedClientID = IMAPService.parseIDParameters(String(command.dropFirst(3)))
+
+        let identification = IMAPService.idCommand(serverIdentification).dropFirst(3)
+        return "* ID \(identification)\r\n\(tag) OK ID completed\r\n"
+    }
+
+    /// UID MOVE: relocate messages to the target folder, assigning new UIDs there
+    func moveEmails(uids: [UInt32], to folder: String) async throws {
+        guard let source = selectedFolder else {
+            throw IMAPError.notConnected
+        }
+
+        guard folders.contains(where: { $0.name == folder }) else {
+            throw IMAPError.folderNotFound(folder)
+        }
+
+        guard advertisedCapabilities.contains("MOVE") else {
+            throw IMAPError.commandFailed("UID MOVE")
+        }
+
+        moveCalls.append(folder)
+        lastCopyUIDs = [:]
+
+        var nextUID = (emails[folder]?.keys.max() ?? 0) + 1
+        for uid in uids.sorted() {
+            guard let data = emails[source]?.removeValue(forKey: uid) else { continue }
+            addEmail(to: folder, uid: nextUID, data: data)
+            lastCopyUIDs[uid] = nextUID
+            nextUID += 1
+        }
+    }
+
+    /// UID STORE +FLAGS (\Deleted) followed by UID EXPUNGE; without UIDPLUS the messages stay flagged
+    func deleteEmails(uids: [UInt32]) async throws {
+        guard let folder = selectedFolder else {
+            throw IMAPError.notConnected
+        }
+
+        deleteCalls.append(uids)
+        for uid in uids {
+            if advertisedCapabilities.contains("UIDPLUS") {
+                emails[folder]?.removeValue(forKey: uid)
+            } else if !(messageFlags[uid] ?? []).contains("\\Deleted") {
+                setFlags((messageFlags[uid] ?? []) + ["\\Deleted"], for: uid)
+            }
+        }
+    }
+
+    /// Enforces APPENDLIMIT=n from the advertised capabilities like a server answering [TOOBIG]
+    func appendLimit(for folder: String) async throws -> Int? {
+        guard isLoggedIn else {
+            throw IMAPError.notConnected
+        }
+        return IMAPService.appendLimit(in: advertisedCapabilities)
+    }
+
+    func appendEmail(_ data: Data, to folder: String, flags: [String]) async throws {
+        guard isLoggedIn else {
+            throw IMAPError.notConnected
+        }
+
+        guard folders.contains(where: { $0.name == folder }) else {
+            throw IMAPError.folderNotFound(folder)
+        }
+
+        if let limit = IMAPService.appendLimit(in: advertisedCapabilities), data.count > limit {
+            throw IMAPError.messageTooLarge(folder)
+        }
+
+        appendCalls.append(folder)
+        let uid = (emails[folder]?.keys.max() ?? 0) + 1
+        addEmail(to: folder, uid: uid, data: data)
+        if !flags.isEmpty {
+            messageFlags[uid] = flags
+        }
+    }
+
     // MARK: - Helper
 
     private func extractHeader(named name: String, from content: String) -> String? {
@@ -253,4 +822,12 @@ actor MockIMAPService: IMAPServiceProtocol {
         }
         return nil
     }
+
+    /// Parse a raw tagged NO the way the client does and throw the resulting referral error
+    private func rejectWithReferral(_ response: String) throws {
+        guard let referral = IMAPReferral(response: response) else {
+            throw IMAPError.commandFailed(response)
+        }
+        throw IMAPError.referral(referral.url)
+    }
 }
@@ -1,4 +1,6 @@
 import XCTest
+import Combine
+import Network
 @testable import IMAPBackup
 
 final class ModelTests: XCTestCase {
@@ -181,6 +183,16 @@ final class ModelTests: XCTestCase {
         XCTAssertFalse(result.contains("|"))
     }
 
+    func testSanitizingUTF8ReplacesInvalidBytes() {
+        let data = Data([0x4F, 0x4B, 0xFF, 0x21]) // "OK", invalid byte, "!"
+        XCTAssertEqual(String(sanitizingUTF8: data), "OK\u{FFFD}!")
+    }
+
+    func testStrippingControlCharacters() {
+        XCTAssertEqual("Tab\tand\nline\u{0}\u{1B}".strippingControlCharacters(), "Tab\tand\nline")
+        XCTAssertEqual("Grüße".strippingControlCharacters(), "Grüße")
+    }
+
     // MARK: - Attachment Tests
 
     func testAttachmentInitialization() {
@@ -307,6 +319,156 @@ final class ModelTests: XCTestCase {
         XCTAssertEqual(decoded.id, account.id)
     }
 
+    func testEmailAccountDecodesWithoutFolderRemap() throws {
+        let json = """
+        {"id":"\(UUID().uuidString)","email":"old@example.com","imapServer":"imap.example.com",
+         "port":993,"username":"old@example.com","useSSL":true,"isEnabled":true}
+        """
+
+        let decoded = try JSONDecoder().decode(EmailAccount.self, from: json.data(using: .utf8)!)
+
+        XCTAssertTrue(decoded.folderRemap.isEmpty)
+        XCTAssertEqual(decoded.authType, .password)
+        XCTAssertEqual(decoded.addressFamily, .automatic)
+    }
+
+    func testAddressFamilyFlowsIntoConnectionParameters() throws {
+        var account = EmailAccount(email: "user@example.com", imapServer: "imap.example.com", addressFamily: .ipv4)
+        let decoded = try JSONDecoder().decode(EmailAccount.self, from: JSONEncoder().encode(account))
+        XCTAssertEqual(decoded.addressFamily, .ipv4)
+
+        func ipVersion(_ params: NWParameters) -> NWProtocolIP.Options.Version? {
+            (params.defaultProtocolStack.internetProtocol as? NWProtocolIP.Options)?.version
+        }
+
+        let ipv4 = IMAPService.connectionParameters(useTLS: account.useSSL, addressFamily: account.addressFamily)
+        XCTAssertEqual(ipVersion(ipv4), .v4)
+        XCTAssertNotNil(ipv4.defaultProtocolStack.applicationProtocols.first as? NWProtocolTLS.Options)
+
+        account.addressFamily = .ipv6
+        XCTAssertEqual(ipVersion(IMAPService.connectionParameters(useTLS: false, addressFamily: account.addressFamily)), .v6)
+        XCTAssertEqual(ipVersion(IMAPService.connectionParameters(useTLS: false, addressFamily: .automatic)), .any)
+    }
+
+    func testTLSServerNameOverrideLandsInTLSOptions() throws {
+        let account = EmailAccount(email: "user@example.com", imapServer: "192.0.2.10", tlsServerName: "Mail.Example.com.")
+
+        let serverName = try XCTUnwrap(IMAPService.tlsServerName(for: account, referred: false))
+        XCTAssertEqual(serverName, "mail.example.com")
+        XCTAssertNil(IMAPService.tlsServerName(for: account, referred: true))
+
+        let params = IMAPService.connectionParameters(useTLS: true, addressFamily: .automatic, tlsServerName: serverName)
+        let tls = try XCTUnwrap(params.defaultProtocolStack.applicationProtocols.first as? NWProtocolTLS.Options)
+
+        let expected = NWProtocolTLS.Options()
+        sec_protocol_options_set_tls_server_name(expected.securityProtocolOptions, "mail.example.com")
+        let other = NWProtocolTLS.Options()
+        sec_protocol_options_set_tls_server_name(other.securityProtocolOptions, "192.0.2.10")
+        XCTAssertTrue(sec_protocol_options_are_equal(tls.securityProtocolOptions, expected.securityProtocolOptions))
+        XCTAssertFalse(sec_protocol_options_are_equal(tls.securityProtocolOptions, other.securityProtocolOptions))
+    }
+
+    func testTLSServerNameValidation() {
+        XCTAssertNil(EmailAccount.tlsServerNameProblem(""))
+        XCTAssertNil(EmailAccount.tlsServerNameProblem(" mail.example.com "))
+        XCTAssertNil(EmailAccount.tlsServerNameProblem("imap-1.example.co.uk."))
+        XCTAssertNotNil(EmailAccount.tlsServerNameProblem("192.0.2.10"))
+        XCTAssertNotNil(EmailAccount.tlsServerNameProblem("2001:db8::1"))
+        XCTAssertNotNil(EmailAccount.tlsServerNameProblem("mail..example.com"))
+        XCTAssertNotNil(EmailAccount.tlsServerNameProblem("-mail.example.com"))
+        XCTAssertNotNil(EmailAccount.tlsServerNameProblem("mail example.com"))
+        XCTAssertNotNil(EmailAccount.tlsServerNameProblem(String(repeating: "a", count: 64) + ".com"))
+
+        XCTAssertNil(EmailAccount.normalizedTLSServerName("  "))
+    }
+
+    func testLastSuccessfulRunIsStoredOnlyForCleanRuns() throws {
+        var account = EmailAccount(email: "test@example.com", imapServer: "imap.example.com")
+        let firstStart = Date(timeIntervalSince1970: 1_760_000_000)
+        let secondStart = firstStart.addingTimeInterval(86_400)
+
+        account.recordBackup(startedAt: firstStart, finishedAt: firstStart.addingTimeInterval(60), succeeded: true)
+        account.recordBackup(startedAt: secondStart, finishedAt: secondStart.addingTimeInterval(60), succeeded: false)
+
+        XCTAssertEqual(account.lastBackupDate, secondStart.addingTimeInterval(60))
+        XCTAssertEqual(account.lastSuccessfulBackupDate, firstStart)
+
+        // Survives the round trip through the account store
+        let decoded = try JSONDecoder().decode(EmailAccount.self, from: JSONEncoder().encode(account))
+        XCTAssertEqual(decoded.lastSuccessfulBackupDate, firstStart)
+    }
+
+    func testBackupSinceResolution() throws {
+        var account = EmailAccount(email: "test@example.com", imapServer: "imap.example.com")
+
+        // No successful run yet: last-run searches everything
+        XCTAssertNil(BackupSince.lastRun.resolve(for: account))
+
+        let lastRun = Date(timeIntervalSince1970: 1_760_000_000)
+        account.recordBackup(startedAt: lastRun, succeeded: true)
+        XCTAssertEqual(BackupSince.lastRun.resolve(for: account), lastRun)
+        XCTAssertNil(BackupSince.all.resolve(for: account))
+
+        XCTAssertEqual(BackupSince(argument: "last-run"), .lastRun)
+        XCTAssertEqual(BackupSince(argument: "ALL"), .all)
+        let fixed = try XCTUnwrap(BackupSince(argument: "2026-01-05"))
+        XCTAssertEqual(fixed.argument, "2026-01-05")
+        XCTAssertNil(BackupSince(argument: "yesterday"))
+
+        XCTAssertEqual(IMAPService.searchDate(try XCTUnwrap(fixed.resolve(for: account))), "5-Jan-2026")
+    }
+
+    func testKeychainServiceOverrideIsQueriedFirst() throws {
+        let account = EmailAccount(email: "me@example.com", imapServer: "imap.example.com", keychainService: "imap.example.com")
+
+        let lookups = KeychainService.passwordLookups(accountId: account.id, username: account.username, customService: account.keychainService)
+        XCTAssertEqual(lookups, [
+            KeychainLookup(service: "imap.example.com", account: "me@example.com"),
+            KeychainLookup(service: "imap.example.com", account: account.id.uuidString),
+            KeychainLookup(service: KeychainService.defaultService, account: account.id.uuidString)
+        ])
+
+        // Without an override only MailKeep's own entry is used
+        XCTAssertEqual(
+            KeychainService.passwordLookups(accountId: account.id, username: account.username, customService: nil),
+            [KeychainLookup(service: KeychainService.defaultService, account: account.id.uuidString)]
+        )
+
+        let decoded = try JSONDecoder().decode(EmailAccount.self, from: JSONEncoder().encode(account))
+        XCTAssertEqual(decoded.keychainService, "imap.example.com")
+    }
+
+    func testKeychainServiceValidation() {
+        XCTAssertNil(EmailAccount.keychainServiceProblem(""))
+        XCTAssertNil(EmailAccount.keychainServiceProblem(" mail.work "))
+        XCTAssertNotNil(EmailAccount.keychainServiceProblem("mail\nwork"))
+        XCTAssertNotNil(EmailAccount.keychainServiceProblem(String(repeating: "a", count: 256)))
+
+        XCTAssertEqual(EmailAccount.normalizedKeychainService(" mail.work "), "mail.work")
+        XCTAssertNil(EmailAccount.normalizedKeychainService("  "))
+    }
+
+    func testFolderRemapParseAndFormat() {
+        let text = """
+        Project_A = Archive/Project Underscore
+        INBOX=Inbox
+
+        invalid line
+        """
+
+        let remap = EmailAccount.parseFolderRemap(text)
+
+        XCTAssertEqual(remap, [
+            "Project_A": "Archive/Project Underscore",
+            "INBOX": "Inbox"
+        ])
+        XCTAssertEqual(
+            EmailAccount.formatFolderRemap(remap),
+            "INBOX = Inbox\nProject_A = Archive/Project Underscore"
+        )
+        XCTAssertEqual(EmailAccount.parseFolderRemap(EmailAccount.formatFolderRemap(remap)), remap)
+    }
+
     func testEmailAccountHashable() {
         let account1 = EmailAccount(
             email: "test@example.com",
@@ -471,4 +633,93 @@ final class ModelTests: XCTestCase {
 
         XCTAssertNotEqual(error1.id, error2.id)
     }
+
+    // MARK: - FailureKind Tests
+
+    func testFailureKindOfMailErrors() {
+        XCTAssertEqual(FailureKind.classify(IMAPError.authenticationFailed), .auth)
+        XCTAssertEqual(FailureKind.classify(IMAPError.loginDisabled), .auth)
+        XCTAssertEqual(FailureKind.classify(KeychainError.notFound), .auth)
+        XCTAssertEqual(FailureKind.classify(PasswordCommandError.emptyOutput), .auth)
+        XCTAssertEqual(FailureKind.classify(GoogleOAuthError.noRefreshToken), .auth)
+
+        XCTAssertEqual(FailureKind.classify(IMAPError.connectionClosed), .network)
+        XCTAssertEqual(FailureKind.classify(IMAPError.receiveFailed("reset")), .network)
+        XCTAssertEqual(FailureKind.classify(IMAPError.bandwidthLimitExceeded("[OVERQUOTA]")), .quota)
+        XCTAssertEqual(FailureKind.classify(IMAPError.messageTooLarge("Archive")), .tooLarge)
+        XCTAssertNotNil(FailureKind.tooLarge.advice)
+        XCTAssertEqual(FailureKind.classify(IMAPError.folderNotFound("Old")), .other)
+    }
+
+    func testFailureKindOfSystemErrors() {
+        XCTAssertEqual(FailureKind.classify(NWError.posix(.ECONNREFUSED)), .network)
+        XCTAssertEqual(FailureKind.classify(NWError.dns(-65554)), .network)
+        XCTAssertEqual(FailureKind.classify(NWError.tls(-9813)), .tls)
+        XCTAssertEqual(FailureKind.classify(URLError(.serverCertificateHasBadDate)), .tls)
+        XCTAssertEqual(FailureKind.classify(URLError(.timedOut)), .network)
+        XCTAssertEqual(FailureKind.classify(CocoaError(.fileWriteOutOfSpace)), .quota)
+        XCTAssertEqual(FailureKind.classify(POSIXError(.ENOSPC)), .quota)
+        XCTAssertEqual(FailureKind.classify(CocoaError(.fileReadNoSuchFile)), .other)
+
+        let corrupt = DecodingError.dataCorrupted(.init(codingPath: [], debugDescription: "Not JSON"))
+        XCTAssertEqual(FailureKind.classify(corrupt), .parse)
+    }
+
+    func testFailureKindLooksThroughWrappedErrors() {
+        let wrapped = NSError(domain: "MailKeep", code: 1, userInfo: [
+            NSUnderlyingErrorKey: NSError(domain: NSOSStatusErrorDomain, code: -9807)
+        ])
+        XCTAssertEqual(FailureKind.classify(wrapped), .tls)
+
+        let twice = NSError(domain: "MailKeep", code: 2, userInfo: [NSUnderlyingErrorKey: wrapped])
+        XCTAssertEqual(FailureKind.classify(twice), .tls)
+        XCTAssertEqual(FailureKind.classify(NSError(domain: "MailKeep", code: 3)), .other)
+    }
+
+    func testBackupErrorKindDefaultsToOther() {
+        XCTAssertEqual(BackupError(message: "Error").kind, .other)
+        XCTAssertEqual(BackupError(message: "Error", kind: .auth).kind, .auth)
+    }
+
+    // MARK: - MessageEvent Tests
+
+    @MainActor
+    func testMessageEventStreamDeliversOneEventPerMessage() async {
+        let stream = MessageEventStream()
+        let accountId = UUID()
+        var received: [MessageEvent] = []
+        let cancellable = stream.events.sink { received.append($0) }
+        defer { cancellable.cancel() }
+
+        // Concurrent workers report through the main actor
+        await withTaskGroup(of: Void.self) { group in
+            for uid in UInt32(1)...20 {
+                group.addTask {
+                    let event = uid % 5 == 0
+                        ? MessageEvent(accountId: accountId, folder: "INBOX", uid: uid, error: "Timed out")
+                        : MessageEvent(accountId: accountId, folder: "INBOX", uid: uid, subject: "Mail \(uid)",
+                                       savedURL: URL(fileURLWithPath: "/tmp/\(uid).eml"), bytes: 100)
+                    await stream.send(event)
+                }
+            }
+        }
+
+        XCTAssertEqual(received.count, 20)
+        XCTAssertEqual(Set(received.map { $0.uid }).count, 20)
+        XCTAssertEqual(received.filter { !$0.isSuccess }.count, 4)
+        XCTAssertEqual(received.map { $0.id }, stream.recentEvents.map { $0.id })
+    }
+
+    @MainActor
+    func testMessageEventStreamKeepsRecentEvents() {
+        let stream = MessageEventStream(capacity: 3)
+        for uid in UInt32(1)...5 {
+            stream.send(MessageEvent(accountId: UUID(), folder: "INBOX", uid: uid))
+        }
+
+        XCTAssertEqual(stream.recentEvents.map { $0.uid }, [3, 4, 5])
+
+        stream.clear()
+        XCTAssertTrue(stream.recentEvents.isEmpty)
+    }
 }
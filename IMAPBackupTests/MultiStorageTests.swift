@@ -0,0 +1,156 @@
+import XCTest
+@testable import IMAPBackup
+
+/// In-memory destination that can be told to fail
+final class MockStorageBackend: StorageBackend {
+    struct WriteFailed: LocalizedError {
+        var errorDescription: String? { "Disk full" }
+    }
+
+    let name: String
+    var shouldFail = false
+    /// Emails that fail to save even when the backend is otherwise healthy
+    var failingUIDs: Set<UInt32> = []
+    private(set) var saved: [String: [UInt32: Data]] = [:]
+
+    init(name: String, existing: [String: Set<UInt32>] = [:]) {
+        self.name = name
+        for (folder, uids) in existing {
+            saved[folder] = Dictionary(uniqueKeysWithValues: uids.map { ($0, Data()) })
+        }
+    }
+
+    func saveEmail(_ emailData: Data, email: Email, accountEmail: String, folderPath: String) async throws -> URL {
+        if shouldFail || failingUIDs.contains(email.uid) {
+            throw WriteFailed()
+        }
+        saved[folderPath, default: [:]][email.uid] = emailData
+        return URL(fileURLWithPath: "/\(name)/\(folderPath)/\(email.filename())")
+    }
+
+    func getExistingUIDs(accountEmail: String, folderPath: String) async throws -> Set<UInt32> {
+        Set(saved[folderPath].map { Array($0.keys) } ?? [])
+    }
+
+    func savedEmailURL(uid: UInt32, accountEmail: String, folderPath: String) async throws -> URL? {
+        saved[folderPath]?[uid] == nil ? nil : URL(fileURLWithPath: "/\(name)/\(folderPath)/\(uid).eml")
+    }
+}
+
+final class MultiStorageTests: XCTestCase {
+
+    let account = "test@example.com"
+    let data = Data("Subject: Mirrored\r\n\r\nBody".utf8)
+
+    private func email(uid: UInt32) -> Email {
+        Email(messageId: "m\(uid)@example.com", uid: uid, folder: "INBOX", subject: "Mirrored",
+              sender: "sender", senderEmail: "sender@example.com", date: Date(timeIntervalSince1970: 1_760_000_000))
+    }
+
+    func testSavesToEveryBackend() async throws {
+        let local = MockStorageBackend(name: "local")
+        let offsite = MockStorageBackend(name: "offsite")
+        let storage = MultiStorage(backends: [local, offsite])
+
+        let url = try await storage.saveEmail(data, email: email(uid: 1), accountEmail: account, folderPath: "INBOX")
+
+        XCTAssertTrue(url.path.hasPrefix("/local/"))
+        XCTAssertEqual(local.saved["INBOX"]?[1], data)
+        XCTAssertEqual(offsite.saved["INBOX"]?[1], data)
+    }
+
+    func testExistingUIDsAreTheIntersection() async throws {
+        let local = MockStorageBackend(name: "local", existing: ["INBOX": [1, 2, 3]])
+        let offsite = MockStorageBackend(name: "offsite", existing: ["INBOX": [1, 3]])
+        let storage = MultiStorage(backends: [local, offsite])
+
+        let existing = try await storage.getExistingUIDs(accountEmail: account, folderPath: "INBOX")
+        XCTAssertEqual(existing, [1, 3])
+
+        // UID 2 is downloaded again and only goes where it is missing,
+        // but the file returned is still the primary's
+        local.shouldFail = true
+        let url = try await storage.saveEmail(data, email: email(uid: 2), accountEmail: account, folderPath: "INBOX")
+        XCTAssertEqual(url.path, "/local/INBOX/2.eml")
+        XCTAssertEqual(offsite.saved["INBOX"]?[2], data)
+    }
+
+    func testPartialFailureFailsWithoutQuorum() async {
+        let local = MockStorageBackend(name: "local")
+        let offsite = MockStorageBackend(name: "offsite")
+        offsite.shouldFail = true
+        let storage = MultiStorage(backends: [local, offsite])
+
+        do {
+            _ = try await storage.saveEmail(data, email: email(uid: 1), accountEmail: account, folderPath: "INBOX")
+            XCTFail("Expected the save to fail")
+        } catch MultiStorageError.quorumNotMet(let succeeded, let required, let errors) {
+            XCTAssertEqual(succeeded, 1)
+            XCTAssertEqual(required, 2)
+            XCTAssertEqual(errors, ["offsite: Disk full"])
+        } catch {
+            XCTFail("Unexpected error: \(error)")
+        }
+
+        // The healthy destination still has it
+        XCTAssertNotNil(local.saved["INBOX"]?[1])
+    }
+
+    func testPartialFailureSucceedsWithQuorum() async throws {
+        let local = MockStorageBackend(name: "local")
+        let offsite = MockStorageBackend(name: "offsite")
+        offsite.shouldFail = true
+        let storage = MultiStorage(backends: [local, offsite], quorum: 1)
+
+        let url = try await storage.saveEmail(data, email: email(uid: 1), accountEmail: account, folderPath: "INBOX")
+
+        XCTAssertTrue(url.path.hasPrefix("/local/"))
+        XCTAssertNil(offsite.saved["INBOX"]?[1])
+    }
+
+    func testFailedPrimaryFailsEvenWithQuorum() async {
+        let local = MockStorageBackend(name: "local")
+        let offsite = MockStorageBackend(name: "offsite")
+        local.shouldFail = true
+        let storage = MultiStorage(backends: [local, offsite], quorum: 1)
+
+        do {
+            _ = try await storage.saveEmail(data, email: email(uid: 1), accountEmail: account, folderPath: "INBOX")
+            XCTFail("Expected the save to fail")
+        } catch MultiStorageError.primaryFailed(let error) {
+            XCTAssertEqual(error, "local: Disk full")
+        } catch {
+            XCTFail("Unexpected error: \(error)")
+        }
+
+        // The mirror still has it
+        XCTAssertEqual(offsite.saved["INBOX"]?[1], data)
+    }
+
+    func testMirrorSkipsPrimary() async throws {
+        let local = MockStorageBackend(name: "local")
+        let offsite = MockStorageBackend(name: "offsite")
+        let storage = MultiStorage(backends: [local, offsite])
+
+        let urls = try await storage.mirrorEmail(data, email: email(uid: 5), accountEmail: account, folderPath: "INBOX")
+
+        XCTAssertEqual(urls.count, 1)
+        XCTAssertNil(local.saved["INBOX"]?[5])
+        XCTAssertEqual(offsite.saved["INBOX"]?[5], data)
+    }
+
+    func testStorageServicesAsBackends() async throws {
+        let directories = (0..<2).map { _ in
+            FileManager.default.temporaryDirectory.appendingPathComponent(UUID().uuidString)
+        }
+        defer { directories.forEach { try? FileManager.default.removeItem(at: $0) } }
+
+        let storage = MultiStorage(backends: directories.map { StorageService(baseURL: $0) })
+        _ = try await storage.saveEmail(data, email: email(uid: 9), accountEmail: account, folderPath: "INBOX")
+
+        for directory in directories {
+            let uids = try await StorageService(baseURL: directory).getExistingUIDs(accountEmail: account, folderPath: "INBOX")
+            XCTAssertEqual(uids, [9])
+        }
+    }
+}
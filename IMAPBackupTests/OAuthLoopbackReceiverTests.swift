@@ -0,0 +1,46 @@
+import XCTest
+@testable import IMAPBackup
+
+final class OAuthLoopbackReceiverTests: XCTestCase {
+
+    func testRedirectCarriesTheListeningPort() async throws {
+        let receiver = try OAuthLoopbackReceiver()
+        try await receiver.start()
+        defer { receiver.stop() }
+
+        XCTAssertEqual(receiver.redirectUri(for: "http://localhost"), "http://localhost:\(receiver.port)")
+    }
+
+    func testBrowserRedirectIsReturnedAndAnswered() async throws {
+        let receiver = try OAuthLoopbackReceiver()
+        try await receiver.start()
+        defer { receiver.stop() }
+
+        // A favicon request is answered but is not the redirect
+        let favicon = URL(string: "http://127.0.0.1:\(receiver.port)/favicon.ico")!
+        let (_, faviconResponse) = try await URLSession.shared.data(from: favicon)
+        XCTAssertEqual((faviconResponse as? HTTPURLResponse)?.statusCode, 404)
+
+        let redirect = URL(string: "http://127.0.0.1:\(receiver.port)/?code=4%2F0abc&scope=email")!
+        let (page, response) = try await URLSession.shared.data(from: redirect)
+        let callbackURL = try await receiver.waitForCallback(timeout: 5)
+
+        XCTAssertEqual((response as? HTTPURLResponse)?.statusCode, 200)
+        XCTAssertTrue(String(decoding: page, as: UTF8.self).contains("close this window"))
+        let query = URLComponents(url: callbackURL, resolvingAgainstBaseURL: false)?.queryItems
+        XCTAssertEqual(query?.first { $0.name == "code" }?.value, "4/0abc")
+    }
+
+    func testGivesUpWhenTheBrowserNeverAnswers() async throws {
+        let receiver = try OAuthLoopbackReceiver()
+        try await receiver.start()
+        defer { receiver.stop() }
+
+        do {
+            _ = try await receiver.waitForCallback(timeout: 0.1)
+            XCTFail("Expected the wait to time out")
+        } catch GoogleOAuthError.authSessionFailed {
+            // Expected
+        }
+    }
+}
@@ -0,0 +1,121 @@
+import XCTest
+@testable import IMAPBackup
+
+final class PasswordCommandTests: XCTestCase {
+
+    var tempDirectory: URL!
+
+    override func setUp() async throws {
+        try await super.setUp()
+
+        tempDirectory = FileManager.default.temporaryDirectory
+            .appendingPathComponent(UUID().uuidString)
+        try FileManager.default.createDirectory(at: tempDirectory, withIntermediateDirectories: true)
+    }
+
+    override func tearDown() async throws {
+        try? FileManager.default.removeItem(at: tempDirectory)
+
+        try await super.tearDown()
+    }
+
+    /// An executable script standing in for a password manager CLI
+    private func stubCommand(_ body: String) throws -> URL {
+        let url = tempDirectory.appendingPathComponent("stub-pass")
+        try "#!/bin/sh\n\(body)\n".write(to: url, atomically: true, encoding: .utf8)
+        try FileManager.default.setAttributes([.posixPermissions: 0o755], ofItemAtPath: url.path)
+        return url
+    }
+
+    // MARK: - Running
+
+    func testStubCommandPasswordIsTrimmed() async throws {
+        let stub = try stubCommand(#"printf 'correct horse \n'; echo "arg: $1""#)
+
+        let password = try await PasswordCommandService.run("'\(stub.path)' email/work")
+
+        // Only the line ending goes, the first line is the password
+        XCTAssertEqual(password, "correct horse ")
+    }
+
+    func testShellSyntaxIsPassedLiterally() async throws {
+        let marker = tempDirectory.appendingPathComponent("injected")
+
+        let output = try await PasswordCommandService.run("/bin/echo secret; touch \(marker.path)")
+
+        XCTAssertEqual(output, "secret; touch \(marker.path)")
+        XCTAssertFalse(FileManager.default.fileExists(atPath: marker.path))
+    }
+
+    func testFailingCommand() async throws {
+        let stub = try stubCommand("exit 3")
+
+        do {
+            _ = try await PasswordCommandService.run(stub.path)
+            XCTFail("Expected the command to fail")
+        } catch let error as PasswordCommandError {
+            XCTAssertEqual(error, .failed(status: 3))
+        }
+    }
+
+    func testSlowCommandTimesOut() async throws {
+        let stub = try stubCommand("exec sleep 5")
+
+        do {
+            _ = try await PasswordCommandService.run(stub.path, timeout: 0.5)
+            XCTFail("Expected a timeout")
+        } catch let error as PasswordCommandError {
+            XCTAssertEqual(error, .timedOut(0.5))
+        }
+    }
+
+    func testEmptyOutputIsAnError() async throws {
+        let stub = try stubCommand("echo")
+
+        do {
+            _ = try await PasswordCommandService.run(stub.path)
+            XCTFail("Expected an error")
+        } catch let error as PasswordCommandError {
+            XCTAssertEqual(error, .emptyOutput)
+        }
+    }
+
+    func testAccountUsesPasswordCommand() async throws {
+        let stub = try stubCommand("echo from-command")
+        let account = EmailAccount(email: "me@example.com", imapServer: "imap.example.com", passwordCommand: stub.path)
+
+        let password = await account.getPassword()
+
+        XCTAssertEqual(password, "from-command")
+    }
+
+    func testHasPasswordDoesNotRunTheCommand() async throws {
+        let marker = tempDirectory.appendingPathComponent("ran")
+        let stub = try stubCommand("touch '\(marker.path)'; echo from-command")
+        let account = EmailAccount(email: "me@example.com", imapServer: "imap.example.com", passwordCommand: stub.path)
+
+        let hasPassword = await account.hasPassword()
+        let check = await DiagnosticsService.checkCredentials(for: account)
+
+        XCTAssertTrue(hasPassword)
+        XCTAssertEqual(check.status, .pass)
+        XCTAssertFalse(FileManager.default.fileExists(atPath: marker.path))
+    }
+
+    // MARK: - Argument Splitting
+
+    func testSplitArguments() throws {
+        XCTAssertEqual(try PasswordCommandService.splitArguments("pass show email/work"), ["pass", "show", "email/work"])
+        XCTAssertEqual(try PasswordCommandService.splitArguments(#"op read "op://Private/Mail Work/password""#),
+                       ["op", "read", "op://Private/Mail Work/password"])
+        XCTAssertEqual(try PasswordCommandService.splitArguments(#"cmd 'it''s' a\ b "q\"x" ''"#),
+                       ["cmd", "its", "a b", "q\"x", ""])
+        XCTAssertEqual(try PasswordCommandService.splitArguments("   "), [])
+    }
+
+    func testUnterminatedQuoteIsRejected() {
+        XCTAssertThrowsError(try PasswordCommandService.splitArguments("pass show 'email/work"))
+        XCTAssertNotNil(EmailAccount.passwordCommandProblem("pass show \"email"))
+        XCTAssertNil(EmailAccount.passwordCommandProblem("pass show email/work"))
+    }
+}
@@ -37,6 +37,17 @@ final class RateLimitServiceTests: XCTestCase {
         XCTAssertEqual(decoded.maxThrottleDelayMs, settings.maxThrottleDelayMs)
     }
 
+    func testFolderConnectionsStayWithinTheProviderLimit() {
+        var settings = RateLimitSettings()
+        settings.maxConcurrentRequests = 20
+        let gmail = IMAPServerInfo.parse(greeting: "* OK Gimap ready for requests from 192.0.2.1 a1mb12345")
+
+        XCTAssertEqual(settings.folderConnections(requested: 40, quirks: gmail.quirks), 15)
+        XCTAssertEqual(settings.folderConnections(requested: 40, quirks: nil), 20)
+        XCTAssertEqual(settings.folderConnections(requested: 4, quirks: gmail.quirks), 4)
+        XCTAssertEqual(settings.folderConnections(requested: 0, quirks: gmail.quirks), 1)
+    }
+
     // MARK: - RateLimitPreset Tests
 
     func testRateLimitPresetBalanced() {
@@ -123,6 +134,13 @@ final class RateLimitServiceTests: XCTestCase {
         XCTAssertFalse(RateLimitService.isThrottleError(normalError))
     }
 
+    func testIsBandwidthCapResponse() {
+        XCTAssertTrue(RateLimitService.isBandwidthCapResponse("A0012 NO [OVERQUOTA] Account exceeded command or bandwidth limits. (Failure)"))
+        XCTAssertTrue(RateLimitService.isBandwidthCapResponse("* BYE Daily download limit reached"))
+        XCTAssertFalse(RateLimitService.isBandwidthCapResponse("A0012 NO [OVERQUOTA] Mailbox is full"))
+        XCTAssertFalse(RateLimitService.isBandwidthCapResponse("A0012 OK FETCH completed"))
+    }
+
     // MARK: - ThrottleTracker Tests
 
     func testThrottleTrackerInitialState() async {
@@ -176,6 +194,47 @@ final class RateLimitServiceTests: XCTestCase {
         XCTAssertLessThan(elapsed, 0.5)
     }
 
+    func testSharedTrackerEnforcesAggregateRate() async {
+        var settings = RateLimitSettings()
+        settings.requestDelayMs = 50
+        let shared = ThrottleTracker(settings: settings)
+
+        // Three connections making two requests each through one tracker
+        let startTime = Date()
+        await withTaskGroup(of: Void.self) { group in
+            for _ in 0..<3 {
+                group.addTask {
+                    await shared.waitForRateLimit()
+                    await shared.waitForRateLimit()
+                }
+            }
+        }
+        let elapsed = Date().timeIntervalSince(startTime)
+
+        // Six requests, first is immediate: at least 5 * 50ms
+        XCTAssertGreaterThan(elapsed, 0.24)
+    }
+
+    func testSeparateTrackersDoNotInterfere() async {
+        var settings = RateLimitSettings()
+        settings.requestDelayMs = 50
+        let trackers = (0..<3).map { _ in ThrottleTracker(settings: settings) }
+
+        let startTime = Date()
+        await withTaskGroup(of: Void.self) { group in
+            for tracker in trackers {
+                group.addTask {
+                    await tracker.waitForRateLimit()
+                    await tracker.waitForRateLimit()
+                }
+            }
+        }
+        let elapsed = Date().timeIntervalSince(startTime)
+
+        // Each tracker only paces its own second request
+        XCTAssertLessThan(elapsed, 0.2)
+    }
+
     // MARK: - RateLimitService Tests
 
     @MainActor
@@ -193,4 +252,18 @@ final class RateLimitServiceTests: XCTestCase {
         XCTAssertNotNil(service.globalSettings)
         XCTAssertTrue(service.globalSettings.isEnabled || !service.globalSettings.isEnabled) // Just check it exists
     }
+
+    @MainActor
+    func testTrackerSharedPerServer() {
+        let service = RateLimitService.shared
+        let accountA = UUID()
+        let accountB = UUID()
+
+        let first = service.getTracker(forServer: "imap.shared-test.example", accountId: accountA)
+        let second = service.getTracker(forServer: "IMAP.Shared-Test.example", accountId: accountB)
+        let other = service.getTracker(forServer: "imap.other-test.example", accountId: accountA)
+
+        XCTAssertTrue(first === second)
+        XCTAssertFalse(first === other)
+    }
 }
@@ -0,0 +1,163 @@
+import XCTest
+@testable import IMAPBackup
+
+final class RestoreServiceTests: XCTestCase {
+
+    var tempDirectory: URL!
+    var mockService: MockIMAPService!
+
+    let smallEmail = """
+    From: sender@example.com\r
+    Subject: Small\r
+    Message-ID: <small@example.com>\r
+    \r
+    Short body\r
+
+    """
+
+    /// About 2 KB, almost all of it attachment
+    var largeEmail: String {
+        """
+        From: sender@example.com\r
+        Subject: Large\r
+        Message-ID: <large@example.com>\r
+        Content-Type: multipart/mixed; boundary="b1"\r
+        \r
+        --b1\r
+        Content-Type: text/plain\r
+        \r
+        See attached\r
+        --b1\r
+        Content-Type: application/pdf; name="report.pdf"\r
+        Content-Disposition: attachment; filename="report.pdf"\r
+        Content-Transfer-Encoding: base64\r
+        \r
+        \(String(repeating: "QUJD", count: 500))\r
+        --b1--\r
+
+        """
+    }
+
+    override func setUp() async throws {
+        try await super.setUp()
+
+        tempDirectory = FileManager.default.temporaryDirectory
+            .appendingPathComponent(UUID().uuidString)
+        try FileManager.default.createDirectory(at: tempDirectory, withIntermediateDirectories: true)
+        try Data(smallEmail.utf8).write(to: tempDirectory.appendingPathComponent("1_small.eml"))
+        try Data(largeEmail.utf8).write(to: tempDirectory.appendingPathComponent("2_large.eml"))
+
+        mockService = MockIMAPService()
+        await mockService.setAdvertisedCapabilities(["IMAP4REV1", "APPENDLIMIT=500"])
+        try await mockService.connect()
+        try await mockService.login(password: "secret")
+    }
+
+    override func tearDown() async throws {
+        try? FileManager.default.removeItem(at: tempDirectory)
+        mockService = nil
+
+        try await super.tearDown()
+    }
+
+    func testOversizedMessageIsSkipped() async throws {
+        let report = try await RestoreService.restore(folderURL: tempDirectory, to: "Drafts", using: mockService)
+
+        XCTAssertEqual(report.restored, 1)
+        XCTAssertEqual(report.skipped.map(\.file), ["2_large.eml"])
+        XCTAssertTrue(report.skipped[0].reason.contains("APPENDLIMIT of 500 bytes"))
+        XCTAssertTrue(report.failed.isEmpty)
+
+        let appended = await mockService.emails["Drafts"] ?? [:]
+        XCTAssertEqual(appended.count, 1)
+        XCTAssertEqual(appended.values.first, Data(smallEmail.utf8))
+    }
+
+    func testStripAttachmentsToFit() async throws {
+        let report = try await RestoreService.restore(
+            folderURL: tempDirectory,
+            to: "Drafts",
+            using: mockService,
+            options: RestoreOptions(stripAttachmentsToFit: true)
+        )
+
+        XCTAssertEqual(report.restored, 2)
+        XCTAssertEqual(report.trimmed.map(\.file), ["2_large.eml"])
+        XCTAssertTrue(report.skipped.isEmpty)
+
+        let appended = await mockService.emails["Drafts"] ?? [:]
+        let trimmed = try XCTUnwrap(appended.values.first { $0.count != smallEmail.utf8.count })
+        let content = String(decoding: trimmed, as: UTF8.self)
+        XCTAssertLessThanOrEqual(trimmed.count, 500)
+        XCTAssertTrue(content.contains("See attached"))
+        XCTAssertTrue(content.contains("report.pdf"))
+        XCTAssertFalse(content.contains("QUJD"))
+    }
+
+    func testNoLimitRestoresEverything() async throws {
+        await mockService.setAdvertisedCapabilities(["IMAP4REV1"])
+
+        let report = try await RestoreService.restore(folderURL: tempDirectory, to: "Drafts", using: mockService)
+
+        XCTAssertEqual(report.restored, 2)
+        XCTAssertEqual(report.summary, "Restored 2 emails")
+    }
+
+    // MARK: - Added Headers
+
+    func testAddedHeadersLeaveBodyAndExistingHeadersUnchanged() async throws {
+        await mockService.setAdvertisedCapabilities(["IMAP4REV1"])
+        let options = RestoreOptions(addedHeaders: ["X-Archived-From: {folder}", "Message-ID: <replaced@example.com>", "bad header"])
+
+        let report = try await RestoreService.restore(folderURL: tempDirectory, to: "Drafts", using: mockService, options: options)
+        XCTAssertEqual(report.restored, 2)
+
+        let appended = await mockService.emails["Drafts"] ?? [:]
+        let restored = try XCTUnwrap(appended.values.first { String(decoding: $0, as: UTF8.self).contains("Subject: Small") })
+        let folder = tempDirectory.lastPathComponent
+        let expected = """
+        From: sender@example.com\r
+        Subject: Small\r
+        Message-ID: <small@example.com>\r
+        X-Archived-From: \(folder)\r
+        \r
+        Short body\r
+
+        """
+        XCTAssertEqual(restored, Data(expected.utf8))
+
+        // Everything after the headers is byte-identical, and the Message-ID is kept for dedup
+        let original = Data(largeEmail.utf8)
+        let large = try XCTUnwrap(appended.values.first { $0.count > original.count })
+        let separator = Data("\r\n\r\n".utf8)
+        XCTAssertEqual(large[try XCTUnwrap(large.range(of: separator)).lowerBound...],
+                       original[try XCTUnwrap(original.range(of: separator)).lowerBound...])
+        XCTAssertEqual(EmailParser.messageId(from: large), "large@example.com")
+    }
+
+    func testAddedHeadersKeepLineEndings() {
+        let lf = Data("Subject: Hi\n\nBody\n".utf8)
+        XCTAssertEqual(RestoreService.addingHeaders(["X-Restored: yes"], to: lf), Data("Subject: Hi\nX-Restored: yes\n\nBody\n".utf8))
+
+        let headersOnly = Data("Subject: Hi".utf8)
+        XCTAssertEqual(RestoreService.addingHeaders(["X-Restored: yes"], to: headersOnly), Data("Subject: Hi\nX-Restored: yes\n".utf8))
+
+        XCTAssertEqual(RestoreService.addingHeaders([], to: lf), lf)
+    }
+
+    func testHeaderPlaceholders() {
+        let date = Date(timeIntervalSince1970: 0)
+        let headers = RestoreService.expandingPlaceholders(in: ["X-Folder: {folder}", "X-Restored-At: {date}"], folder: "INBOX", date: date)
+
+        XCTAssertEqual(headers[0], "X-Folder: INBOX")
+        XCTAssertTrue(headers[1].hasPrefix("X-Restored-At: "))
+        XCTAssertFalse(headers[1].contains("{date}"))
+    }
+
+    func testParseAppendLimit() {
+        XCTAssertEqual(IMAPService.appendLimit(in: ["IMAP4REV1", "APPENDLIMIT=35882577"]), 35882577)
+        XCTAssertNil(IMAPService.appendLimit(in: ["IMAP4REV1", "APPENDLIMIT"]))
+        XCTAssertEqual(IMAPService.statusAppendLimit("* STATUS \"INBOX\" (APPENDLIMIT 1048576)\r\nA0003 OK\r\n"), 1048576)
+        XCTAssertNil(IMAPService.statusAppendLimit("* STATUS \"INBOX\" (APPENDLIMIT NIL)\r\nA0003 OK\r\n"))
+    }
+}
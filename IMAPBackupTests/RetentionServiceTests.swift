@@ -142,12 +142,12 @@ final class RetentionServiceTests: XCTestCase {
     // MARK: - Preview Tests
 
     @MainActor
-    func testPreviewRetentionKeepAll() {
+    func testPreviewRetentionKeepAll() async {
         let service = RetentionService.shared
         var settings = RetentionSettings()
         settings.policy = .keepAll
 
-        let result = service.previewRetention(at: tempDirectory, settings: settings)
+        let result = await service.applyRetention(to: tempDirectory, settings: settings, mode: .dryRun)
 
         // Keep all should delete nothing
         XCTAssertEqual(result.filesDeleted, 0)
@@ -155,13 +155,13 @@ final class RetentionServiceTests: XCTestCase {
     }
 
     @MainActor
-    func testPreviewRetentionEmptyDirectory() {
+    func testPreviewRetentionEmptyDirectory() async {
         let service = RetentionService.shared
         var settings = RetentionSettings()
         settings.policy = .byCount
         settings.maxCount = 100
 
-        let result = service.previewRetention(at: tempDirectory, settings: settings)
+        let result = await service.applyRetention(to: tempDirectory, settings: settings, mode: .dryRun)
 
         // Empty directory should have nothing to delete
         XCTAssertEqual(result.filesDeleted, 0)
@@ -206,7 +206,7 @@ final class RetentionServiceTests: XCTestCase {
             )
         }
 
-        let result = await service.applyRetention(to: tempDirectory, settings: settings)
+        let result = await service.applyRetention(to: tempDirectory, settings: settings, mode: .confirmed)
 
         // Should delete 3 oldest files (5 - 2 = 3)
         XCTAssertEqual(result.filesDeleted, 3)
@@ -237,7 +237,7 @@ final class RetentionServiceTests: XCTestCase {
             ofItemAtPath: oldFile.path
         )
 
-        let result = await service.applyRetention(to: tempDirectory, settings: settings)
+        let result = await service.applyRetention(to: tempDirectory, settings: settings, mode: .confirmed)
 
         // Should delete the old file
         XCTAssertEqual(result.filesDeleted, 1)
@@ -245,6 +245,28 @@ final class RetentionServiceTests: XCTestCase {
         XCTAssertFalse(FileManager.default.fileExists(atPath: oldFile.path))
     }
 
+    @MainActor
+    func testApplyRetentionIsDryRunByDefault() async throws {
+        let service = RetentionService.shared
+        var settings = RetentionSettings()
+        settings.policy = .byAge
+        settings.maxAgeDays = 30
+
+        let oldFile = tempDirectory.appendingPathComponent("old.eml")
+        try "old content".write(to: oldFile, atomically: true, encoding: .utf8)
+        try FileManager.default.setAttributes(
+            [.modificationDate: Date().addingTimeInterval(-45 * 86400)],
+            ofItemAtPath: oldFile.path
+        )
+
+        let result = await service.applyRetention(to: tempDirectory, settings: settings)
+
+        // Counted like a real run, but nothing is deleted
+        XCTAssertEqual(result.filesDeleted, 1)
+        XCTAssertEqual(result.bytesFreed, Int64("old content".utf8.count))
+        XCTAssertTrue(FileManager.default.fileExists(atPath: oldFile.path))
+    }
+
     // MARK: - Integration Tests
 
     func testCreateTestFilesForRetention() throws {
@@ -199,6 +199,36 @@ final class SearchServiceTests: XCTestCase {
         XCTAssertEqual(results[0].matchType, .body)
     }
 
+    func testRoutingScopeSearchesReceivedAndDeliveredTo() async throws {
+        let folderDir = tempDirectory.appendingPathComponent("test@example.com/INBOX")
+        try FileManager.default.createDirectory(at: folderDir, withIntermediateDirectories: true)
+        let routed = """
+        Delivered-To: archive@example.com
+        Received: from mx.example.com by imap.example.com;
+         Mon, 15 Jan 2024 10:00:02 +0000
+        Received: from relay.example.net by mx.example.com;
+         Mon, 15 Jan 2024 10:00:01 +0000
+        From: John Doe <john@example.com>
+        Subject: Routed
+        Date: Mon, 15 Jan 2024 10:00:00 +0000
+
+        Sent through relay.example.net? Only the headers should count.
+        """
+        try routed.write(to: folderDir.appendingPathComponent("1_routed.eml"), atomically: true, encoding: .utf8)
+        _ = try createTestEmail(subject: "Mentions relay.example.net", body: "relay.example.net in the body")
+
+        var filter = SearchFilter.default
+        filter.scope = .routing
+
+        let byRelay = try await searchService.search(query: "relay.example.net", filter: filter)
+        XCTAssertEqual(byRelay.map(\.subject), ["Routed"])
+        XCTAssertEqual(byRelay.first?.matchType, .routing)
+        XCTAssertTrue(byRelay.first?.snippet.contains("Received: from relay.example.net") == true)
+
+        let byMailbox = try await searchService.search(query: "archive@example.com", filter: filter)
+        XCTAssertEqual(byMailbox.count, 1)
+    }
+
     // MARK: - Snippet Tests
 
     func testSnippetContainsSearchTerm() async throws {
@@ -0,0 +1,196 @@
+import XCTest
+@testable import IMAPBackup
+
+final class ServerCleanupServiceTests: XCTestCase {
+
+    // MARK: - ServerCleanupSettings Tests
+
+    func testServerCleanupSettingsDefaults() {
+        let settings = ServerCleanupSettings()
+
+        XCTAssertFalse(settings.isEnabled)
+        XCTAssertFalse(settings.isConfirmed)
+        XCTAssertFalse(settings.isActive)
+        XCTAssertEqual(settings.action, .moveToTrash)
+    }
+
+    func testServerCleanupRequiresConfirmation() {
+        var settings = ServerCleanupSettings()
+        settings.isEnabled = true
+
+        XCTAssertFalse(settings.isActive)
+
+        settings.isConfirmed = true
+        XCTAssertTrue(settings.isActive)
+    }
+
+    func testServerCleanupSettingsCodable() throws {
+        let settings = ServerCleanupSettings(isEnabled: true, action: .delete, isConfirmed: true)
+
+        let data = try JSONEncoder().encode(settings)
+        let decoded = try JSONDecoder().decode(ServerCleanupSettings.self, from: data)
+
+        XCTAssertEqual(decoded.isEnabled, true)
+        XCTAssertEqual(decoded.action, .delete)
+        XCTAssertEqual(decoded.isConfirmed, true)
+    }
+
+    // MARK: - Trash Folder Resolution Tests
+
+    func testTrashFolderPrefersSpecialUseFlag() {
+        let folders = [
+            IMAPFolder(name: "INBOX", delimiter: "/", flags: [], path: "INBOX"),
+            IMAPFolder(name: "Trash", delimiter: "/", flags: [], path: "Trash"),
+            IMAPFolder(name: "Bin", delimiter: "/", flags: ["\\HasNoChildren", "\\Trash"], path: "Bin")
+        ]
+
+        XCTAssertEqual(ServerCleanupService.trashFolder(in: folders)?.name, "Bin")
+    }
+
+    func testTrashFolderFallsBackToCommonName() {
+        let folders = [
+            IMAPFolder(name: "INBOX", delimiter: "/", flags: [], path: "INBOX"),
+            IMAPFolder(name: "Deleted Items", delimiter: "/", flags: [], path: "Deleted Items")
+        ]
+
+        XCTAssertEqual(ServerCleanupService.trashFolder(in: folders)?.name, "Deleted Items")
+    }
+
+    func testTrashFolderMissing() {
+        let folders = [
+            IMAPFolder(name: "INBOX", delimiter: "/", flags: [], path: "INBOX")
+        ]
+
+        XCTAssertNil(ServerCleanupService.trashFolder(in: folders))
+    }
+
+    // MARK: - Cleanup Tests
+
+    @MainActor
+    func testCleanupMovesOnlyVerifiedUIDsToTrash() async throws {
+        let mock = MockIMAPService()
+        await mock.addTestEmail(to: "INBOX", uid: 1, from: "a@example.com", subject: "One", body: "1")
+        await mock.addTestEmail(to: "INBOX", uid: 2, from: "b@example.com", subject: "Two", body: "2")
+        try await mock.connect()
+        try await mock.login(password: "test")
+
+        let service = ServerCleanupService.shared
+        let savedSettings = service.settings
+        defer { service.settings = savedSettings }
+        service.enable(action: .moveToTrash)
+
+        let folders = try await mock.listFolders()
+        let inbox = folders.first { $0.name == "INBOX" }!
+
+        let removed = try await service.cleanup(uids: [2], in: inbox, allFolders: folders, imapService: mock)
+        XCTAssertEqual(removed, 1)
+
+        _ = try await mock.selectFolder("INBOX")
+        let remaining = try await mock.searchAll()
+        XCTAssertEqual(remaining, [1])
+
+        let moveCalls = await mock.moveCalls
+        XCTAssertEqual(moveCalls, ["Trash"])
+    }
+
+    @MainActor
+    func testCleanupDoesNothingWhenNotConfirmed() async throws {
+        let mock = MockIMAPService()
+        await mock.addTestEmail(to: "INBOX", uid: 1, from: "a@example.com", subject: "One", body: "1")
+        try await mock.connect()
+        try await mock.login(password: "test")
+
+        let service = ServerCleanupService.shared
+        let savedSettings = service.settings
+        defer { service.settings = savedSettings }
+        service.settings = ServerCleanupSettings(isEnabled: true, action: .delete, isConfirmed: false)
+
+        let folders = try await mock.listFolders()
+        let removed = try await service.cleanup(uids: [1], in: folders[0], allFolders: folders, imapService: mock)
+
+        XCTAssertEqual(removed, 0)
+        let deleteCalls = await mock.deleteCalls
+        XCTAssertTrue(deleteCalls.isEmpty)
+    }
+
+    @MainActor
+    func testPermanentDeletionIsADryRunUnlessConfirmed() async throws {
+        let mock = MockIMAPService()
+        await mock.addTestEmail(to: "INBOX", uid: 1, from: "a@example.com", subject: "One", body: "1")
+        try await mock.connect()
+        try await mock.login(password: "test")
+
+        let service = ServerCleanupService.shared
+        let savedSettings = service.settings
+        defer { service.settings = savedSettings }
+        service.enable(action: .delete)
+
+        let folders = try await mock.listFolders()
+        let inbox = folders.first { $0.name == "INBOX" }!
+
+        let wouldRemove = try await service.cleanup(uids: [1], in: inbox, allFolders: folders, imapService: mock)
+        XCTAssertEqual(wouldRemove, 1)
+        var deleteCalls = await mock.deleteCalls
+        XCTAssertTrue(deleteCalls.isEmpty)
+
+        _ = try await service.cleanup(uids: [1], in: inbox, allFolders: folders, imapService: mock, mode: .confirmed)
+        deleteCalls = await mock.deleteCalls
+        XCTAssertEqual(deleteCalls, [[1]])
+    }
+
+    @MainActor
+    func testBackupCleanupIsADryRunWithoutConfirmation() async throws {
+        let mock = MockIMAPService()
+        await mock.addTestEmail(to: "INBOX", uid: 1, from: "a@example.com", subject: "One", body: "1")
+        try await mock.connect()
+        try await mock.login(password: "test")
+
+        let service = ServerCleanupService.shared
+        let savedSettings = service.settings
+        let savedDeletesAutomatically = service.deletesAutomatically
+        defer {
+            service.settings = savedSettings
+            service.deletesAutomatically = savedDeletesAutomatically
+        }
+        service.enable(action: .delete)
+        service.deletesAutomatically = false
+
+        // Enabling the delete action is not the confirmation to delete after every backup
+        let mode = service.takeAutomaticMode(launch: LaunchConfirmation(arguments: ["MailKeep"]))
+        XCTAssertEqual(mode, .dryRun)
+
+        let folders = try await mock.listFolders()
+        let inbox = folders.first { $0.name == "INBOX" }!
+        _ = try await service.cleanup(uids: [1], in: inbox, allFolders: folders, imapService: mock, mode: mode)
+
+        let deleteCalls = await mock.deleteCalls
+        XCTAssertTrue(deleteCalls.isEmpty)
+        _ = try await mock.selectFolder("INBOX")
+        let remaining = try await mock.searchAll()
+        XCTAssertEqual(remaining, [1])
+    }
+
+    @MainActor
+    func testBackupCleanupModeTakesTheLaunchConfirmationOnlyToDelete() {
+        let service = ServerCleanupService.shared
+        let savedSettings = service.settings
+        let savedDeletesAutomatically = service.deletesAutomatically
+        defer {
+            service.settings = savedSettings
+            service.deletesAutomatically = savedDeletesAutomatically
+        }
+        let launch = LaunchConfirmation(arguments: ["MailKeep", "--yes"])
+
+        // Moving to the trash can be undone, so it leaves --yes for a deletion
+        service.enable(action: .moveToTrash)
+        XCTAssertEqual(service.takeAutomaticMode(launch: launch), .dryRun)
+
+        service.enable(action: .delete)
+        service.deletesAutomatically = false
+        XCTAssertEqual(service.takeAutomaticMode(launch: launch), .confirmed)
+        XCTAssertEqual(service.takeAutomaticMode(launch: launch), .dryRun)
+
+        service.deletesAutomatically = true
+        XCTAssertEqual(service.takeAutomaticMode(launch: launch), .confirmed)
+    }
+}
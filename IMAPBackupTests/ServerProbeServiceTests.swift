@@ -0,0 +1,126 @@
+import XCTest
+@testable import IMAPBackup
+
+/// Scripted server: which host:port pairs accept connections and what they answer
+final class StubProbeServer {
+    struct Listener {
+        var implicitTLS: Bool
+        var greeting = "* OK IMAP4rev1 ready\r\n"
+        var capabilities = "* CAPABILITY IMAP4rev1 AUTH=PLAIN\r\n"
+    }
+
+    var listeners: [String: Listener] = [:]
+    private(set) var attempts: [String] = []
+
+    func listen(host: String, port: Int, _ listener: Listener) {
+        listeners["\(host):\(port)"] = listener
+    }
+
+    func connector() -> ProbeConnector {
+        return { host, port, implicitTLS in
+            let key = "\(host):\(port)"
+            self.attempts.append("\(key)\(implicitTLS ? " tls" : "")")
+            // A TLS handshake against a plain listener (or the reverse) fails like a refused connection
+            guard let listener = self.listeners[key], listener.implicitTLS == implicitTLS else {
+                throw IMAPError.connectionFailed("Connection refused")
+            }
+            return StubProbeConnection(listener: listener)
+        }
+    }
+}
+
+final class StubProbeConnection: ProbeConnection {
+    let listener: StubProbeServer.Listener
+
+    init(listener: StubProbeServer.Listener) {
+        self.listener = listener
+    }
+
+    func readGreeting() async throws -> String {
+        listener.greeting
+    }
+
+    func send(_ command: String, tag: String) async throws -> String {
+        if command.hasSuffix("CAPABILITY") {
+            return listener.capabilities + "\(tag) OK CAPABILITY completed\r\n"
+        }
+        return "* BYE\r\n\(tag) OK LOGOUT completed\r\n"
+    }
+
+    func close() async {}
+}
+
+final class ServerProbeServiceTests: XCTestCase {
+
+    func testCandidateHosts() {
+        XCTAssertEqual(ServerProbeService.candidateHosts(for: "me@Example.org"),
+                       ["imap.example.org", "mail.example.org", "example.org"])
+        XCTAssertEqual(ServerProbeService.candidateHosts(for: "not-an-address"), [])
+    }
+
+    func testPrefersImplicitTLSWhenBothPortsListen() async {
+        let server = StubProbeServer()
+        server.listen(host: "imap.example.org", port: 993, .init(implicitTLS: true))
+        server.listen(host: "imap.example.org", port: 143, .init(
+            implicitTLS: false,
+            capabilities: "* CAPABILITY IMAP4rev1 STARTTLS\r\n"
+        ))
+
+        let result = await ServerProbeService(connector: server.connector()).probe(host: "imap.example.org")
+
+        XCTAssertEqual(result?.port, 993)
+        XCTAssertEqual(result?.security, .implicitTLS)
+        XCTAssertEqual(result?.useSSL, true)
+        XCTAssertEqual(result?.startTLSRequired, false)
+        XCTAssertEqual(server.attempts, ["imap.example.org:993 tls"])
+    }
+
+    func testFallsBackToStartTLSPort() async {
+        let server = StubProbeServer()
+        server.listen(host: "imap.example.org", port: 143, .init(
+            implicitTLS: false,
+            capabilities: "* CAPABILITY IMAP4rev1 STARTTLS LOGINDISABLED\r\n"
+        ))
+
+        let result = await ServerProbeService(connector: server.connector()).probe(host: "imap.example.org")
+
+        XCTAssertEqual(result?.port, 143)
+        XCTAssertEqual(result?.security, .startTLS)
+        XCTAssertEqual(result?.startTLSRequired, true)
+        XCTAssertEqual(result?.useSSL, false)
+        XCTAssertEqual(result?.summary, "imap.example.org:143 uses STARTTLS and requires it before login")
+    }
+
+    func testPlainServerWithoutStartTLS() async {
+        let server = StubProbeServer()
+        server.listen(host: "imap.example.org", port: 143, .init(
+            implicitTLS: false,
+            greeting: "* OK [CAPABILITY IMAP4rev1 AUTH=PLAIN] ready\r\n",
+            capabilities: ""
+        ))
+
+        let result = await ServerProbeService(connector: server.connector()).probe(host: "imap.example.org")
+
+        XCTAssertEqual(result?.security, IMAPConnectionSecurity.none)
+        XCTAssertEqual(result?.startTLSRequired, false)
+        XCTAssertEqual(result?.capabilities.contains("AUTH=PLAIN"), true)
+    }
+
+    func testDetectTriesNextHostAndCustomPorts() async {
+        let server = StubProbeServer()
+        server.listen(host: "mail.example.org", port: 10993, .init(implicitTLS: true))
+        // Something that is not IMAP on the first candidate
+        server.listen(host: "imap.example.org", port: 10993, .init(implicitTLS: true, greeting: "220 smtp ready\r\n"))
+
+        let service = ServerProbeService(implicitTLSPort: 10993, startTLSPort: 10143, connector: server.connector())
+        let result = await service.detect(email: "me@example.org")
+
+        XCTAssertEqual(result?.host, "mail.example.org")
+        XCTAssertEqual(result?.port, 10993)
+    }
+
+    func testNothingFound() async {
+        let result = await ServerProbeService(connector: StubProbeServer().connector()).detect(email: "me@example.org")
+        XCTAssertNil(result)
+    }
+}
@@ -0,0 +1,127 @@
+import XCTest
+@testable import IMAPBackup
+
+final class ServerSearchServiceTests: XCTestCase {
+
+    var mockService: MockIMAPService!
+
+    let accountEmail = "test@example.com"
+
+    override func setUp() async throws {
+        try await super.setUp()
+
+        mockService = MockIMAPService()
+        await mockService.addTestEmail(to: "INBOX", uid: 1, from: "boss@example.com", subject: "Quarterly plan", body: "Numbers attached")
+        await mockService.addTestEmail(to: "INBOX", uid: 2, from: "friend@example.com", subject: "Lunch?", body: "Friday works")
+        await mockService.addTestEmail(to: "Sent", uid: 7, from: "test@example.com", subject: "Re: Quarterly plan", body: "Thanks boss")
+        try await mockService.connect()
+        try await mockService.login(password: "secret")
+    }
+
+    override func tearDown() async throws {
+        mockService = nil
+
+        try await super.tearDown()
+    }
+
+    private func search(_ criteria: IMAPSearchCriteria, folders: [String] = []) async throws -> ServerSearchResult {
+        try await ServerSearchService.searchAccount(
+            accountEmail: accountEmail,
+            criteria: criteria,
+            folderNames: folders,
+            service: mockService
+        )
+    }
+
+    // MARK: - Search Keys
+
+    func testSearchKeys() {
+        XCTAssertTrue(IMAPSearchCriteria(from: " ", subject: "").isEmpty)
+
+        var criteria = IMAPSearchCriteria(from: " boss ", subject: "", body: "say \"hi\"\nthere")
+        criteria.since = DateComponents(calendar: .current, year: 2026, month: 1, day: 5).date
+        XCTAssertEqual(criteria.searchKeys, "FROM \"boss\" BODY \"say \\\"hi\\\" there\" SINCE 5-Jan-2026")
+
+        XCTAssertEqual(IMAPSearchCriteria(subject: "Grüße").searchKeys, "CHARSET UTF-8 SUBJECT \"Grüße\"")
+    }
+
+    func testTextOutsideASCIIIsSentAsLiterals() {
+        let criteria = IMAPSearchCriteria(from: "anna", subject: "Grüße")
+
+        XCTAssertTrue(criteria.needsUTF8)
+        XCTAssertEqual(criteria.arguments, [
+            .text("CHARSET UTF-8"), .text("FROM"), .literal("anna"), .text("SUBJECT"), .literal("Grüße")
+        ])
+        XCTAssertEqual(IMAPSearchCriteria(from: "anna").arguments, [.text("FROM"), .text("\"anna\"")])
+    }
+
+    // MARK: - Searching
+
+    func testMatchesAreListedWithoutDownloadingBodies() async throws {
+        let result = try await search(IMAPSearchCriteria(subject: "quarterly"))
+
+        XCTAssertEqual(result.matches.map(\.id), ["INBOX/1", "Sent/7"])
+        XCTAssertEqual(result.matches.map(\.subject), ["Quarterly plan", "Re: Quarterly plan"])
+        XCTAssertEqual(result.report, "INBOX\t1\tQuarterly plan\nSent\t7\tRe: Quarterly plan")
+        XCTAssertTrue(result.errors.isEmpty)
+
+        let fetched = await mockService.fetchEmailCalls
+        let opened = await mockService.openFolderCommands
+        let commands = await mockService.searchCommands
+        XCTAssertTrue(fetched.isEmpty)
+        XCTAssertTrue(opened.allSatisfy { $0.hasPrefix("EXAMINE ") })
+        XCTAssertEqual(Set(commands), ["UID SEARCH SUBJECT \"quarterly\""])
+    }
+
+    func testCriteriaAreCombined() async throws {
+        var criteria = IMAPSearchCriteria(body: "boss")
+        criteria.since = DateComponents(calendar: .current, year: 2026, month: 1, day: 1).date
+        let sinceNewYear = try await search(criteria)
+        XCTAssertEqual(sinceNewYear.matches.map(\.id), ["Sent/7"])
+
+        criteria.before = criteria.since
+        let empty = try await search(criteria)
+        XCTAssertTrue(empty.matches.isEmpty)
+    }
+
+    func testOnlyNamedFoldersAreSearched() async throws {
+        let result = try await search(IMAPSearchCriteria(from: "example.com"), folders: ["inbox", "Archive"])
+
+        XCTAssertEqual(result.matches.map(\.id), ["INBOX/1", "INBOX/2"])
+        XCTAssertEqual(result.errors, ["Archive: no such folder"])
+    }
+
+    func testEmptyCriteriaAreRefused() async throws {
+        do {
+            _ = try await search(IMAPSearchCriteria(subject: " "))
+            XCTFail("Expected a search without criteria to be refused")
+        } catch ServerSearchError.noCriteria {
+            // Expected
+        }
+        let commands = await mockService.searchCommands
+        XCTAssertTrue(commands.isEmpty)
+    }
+
+    func testRefusedSearchIsReportedPerFolder() async throws {
+        await mockService.setRefusedSearchKeys(["BODY"])
+
+        let result = try await search(IMAPSearchCriteria(body: "boss"))
+
+        XCTAssertTrue(result.matches.isEmpty)
+        // Empty folders are not searched
+        XCTAssertEqual(result.errors.count, 2)
+        XCTAssertEqual(result.summary, "0 match(es) in 0 folder(s), 2 error(s)")
+    }
+
+    func testMatchIsDescribedFromEnvelope() {
+        let response = "* 3 FETCH (UID 42 FLAGS (\\Seen) ENVELOPE (\"Mon, 20 Jan 2026 10:00:00 +0000\" "
+            + "\"=?UTF-8?Q?Gr=C3=BC=C3=9Fe?=\" ((\"Anna\" NIL \"anna\" \"example.com\")) NIL NIL NIL NIL NIL NIL \"<a@example.com>\"))\r\n"
+
+        let match = ServerSearchMatch(folder: "INBOX", uid: 42, response: response)
+
+        XCTAssertEqual(match.subject, "Grüße")
+        XCTAssertEqual(match.from, "Anna <anna@example.com>")
+        XCTAssertEqual(match.date, "Mon, 20 Jan 2026 10:00:00 +0000")
+        XCTAssertEqual(ServerSearchMatch(folder: "INBOX", uid: 42, response: nil).subject, "(No Subject)")
+    }
+}
@@ -69,6 +69,194 @@ final class StorageServiceTests: XCTestCase {
         XCTAssertTrue(folderURL.path.contains("Alpha"))
     }
 
+    func testCollidingFolderNamesShareDirectoryWithoutRemap() async throws {
+        let first = try await storageService.createFolderDirectory(
+            accountEmail: "test@example.com",
+            folderPath: "Project A"
+        )
+        let second = try await storageService.createFolderDirectory(
+            accountEmail: "test@example.com",
+            folderPath: "Project_A"
+        )
+
+        XCTAssertEqual(first.standardized.path, second.standardized.path)
+    }
+
+    func testFolderRemapDisambiguatesCollidingNames() async throws {
+        await storageService.setFolderRemap(
+            ["Project_A": "Archive/Project Underscore"],
+            for: "test@example.com"
+        )
+
+        let first = try await storageService.createFolderDirectory(
+            accountEmail: "test@example.com",
+            folderPath: "Project A"
+        )
+        let second = try await storageService.createFolderDirectory(
+            accountEmail: "test@example.com",
+            folderPath: "Project_A"
+        )
+
+        XCTAssertNotEqual(first.standardized.path, second.standardized.path)
+        XCTAssertTrue(first.path.hasSuffix("Project_A"))
+        XCTAssertTrue(second.path.hasSuffix("Archive/Project_Underscore"))
+        XCTAssertTrue(FileManager.default.fileExists(atPath: second.path))
+    }
+
+    func testResolveFolderCollisionsSuffixesDeterministically() async throws {
+        let assignments = try await storageService.resolveFolderCollisions(
+            accountEmail: "test@example.com",
+            folderPaths: ["Project_A", "Project A", "INBOX"]
+        )
+
+        // "Project A" sorts first and keeps the base name
+        XCTAssertEqual(assignments, ["Project_A": "Project_A_2"])
+
+        let first = try await storageService.createFolderDirectory(accountEmail: "test@example.com", folderPath: "Project A")
+        let second = try await storageService.createFolderDirectory(accountEmail: "test@example.com", folderPath: "Project_A")
+        XCTAssertNotEqual(first.standardized.path, second.standardized.path)
+        XCTAssertTrue(second.path.hasSuffix("Project_A_2"))
+
+        // Mapping is recorded in the account directory and reused by a fresh service
+        let mapURL = tempDirectory
+            .appendingPathComponent("test@example.com".sanitizedForFilename())
+            .appendingPathComponent(".folder_map.json")
+        XCTAssertTrue(FileManager.default.fileExists(atPath: mapURL.path))
+
+        let reloaded = StorageService(baseURL: tempDirectory)
+        let reloadedPath = await reloaded.localFolderPath(accountEmail: "test@example.com", folderPath: "Project_A")
+        XCTAssertEqual(reloadedPath, "Project_A_2")
+    }
+
+    func testResolveFolderCollisionsWithoutCollisions() async throws {
+        let assignments = try await storageService.resolveFolderCollisions(
+            accountEmail: "test@example.com",
+            folderPaths: ["INBOX", "Sent", "Work/Projects"]
+        )
+
+        XCTAssertTrue(assignments.isEmpty)
+
+        // Unsuffixed folders are recorded too, claiming their directories for later runs
+        let mapURL = tempDirectory
+            .appendingPathComponent("test@example.com".sanitizedForFilename())
+            .appendingPathComponent(".folder_map.json")
+        let recorded = try JSONDecoder().decode([String: String].self, from: Data(contentsOf: mapURL))
+        XCTAssertEqual(recorded, ["INBOX": "INBOX", "Sent": "Sent", "Work/Projects": "Work/Projects"])
+    }
+
+    func testFolderAppearingLaterDoesNotTakeAnExistingDirectory() async throws {
+        try await storageService.resolveFolderCollisions(accountEmail: "test@example.com", folderPaths: ["Project_A"])
+        let existing = try await storageService.createFolderDirectory(accountEmail: "test@example.com", folderPath: "Project_A")
+
+        // "Project A" sorts first but was not there when "Project_A" got its directory
+        let assignments = try await storageService.resolveFolderCollisions(
+            accountEmail: "test@example.com",
+            folderPaths: ["Project_A", "Project A"]
+        )
+
+        XCTAssertEqual(assignments, ["Project A": "Project_A_2"])
+        let again = try await storageService.createFolderDirectory(accountEmail: "test@example.com", folderPath: "Project_A")
+        XCTAssertEqual(again.standardized.path, existing.standardized.path)
+    }
+
+    func testRemappedFolderIsAssignedAgain() async throws {
+        try await storageService.resolveFolderCollisions(accountEmail: "test@example.com", folderPaths: ["Old"])
+
+        await storageService.setFolderRemap(["Old": "Archive/2019"], for: "test@example.com")
+
+        let path = await storageService.localFolderPath(accountEmail: "test@example.com", folderPath: "Old")
+        XCTAssertEqual(path, "Archive/2019")
+        try await storageService.resolveFolderCollisions(accountEmail: "test@example.com", folderPaths: ["Old"])
+        let resolved = await storageService.localFolderPath(accountEmail: "test@example.com", folderPath: "Old")
+        XCTAssertEqual(resolved, "Archive/2019")
+    }
+
+    func testNestedFolderLayoutIsDefault() async throws {
+        let path = await storageService.localFolderPath(accountEmail: "test@example.com", folderPath: "Work/Projects")
+        XCTAssertEqual(path, "Work/Projects")
+
+        await storageService.setFlatFolderSeparator("_", for: "other@example.com")
+        let unaffected = await storageService.localFolderPath(accountEmail: "test@example.com", folderPath: "Work/Projects")
+        XCTAssertEqual(unaffected, "Work/Projects")
+    }
+
+    func testFlatFolderLayoutJoinsComponents() async throws {
+        await storageService.setFlatFolderSeparator("_", for: "test@example.com")
+
+        let folderURL = try await storageService.createFolderDirectory(
+            accountEmail: "test@example.com",
+            folderPath: "Work/Projects/Alpha Beta"
+        )
+        XCTAssertEqual(folderURL.lastPathComponent, "Work_Projects_Alpha_Beta")
+        XCTAssertEqual(folderURL.deletingLastPathComponent().lastPathComponent, "test@example.com".sanitizedForFilename())
+
+        // Remapped paths are flattened too, and an unsafe separator cannot nest
+        await storageService.setFolderRemap(["Old": "Archive/2019"], for: "test@example.com")
+        await storageService.setFlatFolderSeparator("/", for: "test@example.com")
+        let remapped = await storageService.localFolderPath(accountEmail: "test@example.com", folderPath: "Old")
+        XCTAssertEqual(remapped, "Archive_2019")
+
+        await storageService.setFlatFolderSeparator("--", for: "test@example.com")
+        let dashed = await storageService.localFolderPath(accountEmail: "test@example.com", folderPath: "Work/Projects")
+        XCTAssertEqual(dashed, "Work--Projects")
+    }
+
+    func testFlatFolderLayoutSuffixesCollisions() async throws {
+        await storageService.setFlatFolderSeparator("_", for: "test@example.com")
+
+        let assignments = try await storageService.resolveFolderCollisions(
+            accountEmail: "test@example.com",
+            folderPaths: ["Work_Projects", "Work/Projects", "Work"]
+        )
+
+        // "Work/Projects" sorts first and keeps the flattened name
+        XCTAssertEqual(assignments, ["Work_Projects": "Work_Projects_2"])
+
+        let nested = try await storageService.createFolderDirectory(accountEmail: "test@example.com", folderPath: "Work/Projects")
+        let flat = try await storageService.createFolderDirectory(accountEmail: "test@example.com", folderPath: "Work_Projects")
+        XCTAssertEqual(nested.lastPathComponent, "Work_Projects")
+        XCTAssertEqual(flat.lastPathComponent, "Work_Projects_2")
+    }
+
+    func testChangingFolderLayoutMovesBackedUpFolders() async throws {
+        let email = "test@example.com"
+        let folders = ["Work", "Work/Projects", "Work/Projects/Q1"]
+        try await storageService.resolveFolderCollisions(accountEmail: email, folderPaths: folders)
+        for (uid, folder) in zip(UInt32(1)..., folders) {
+            let message = Email(
+                messageId: "<\(uid)@example.com>",
+                uid: uid,
+                folder: folder,
+                subject: "Message \(uid)",
+                sender: "Sender",
+                senderEmail: "sender@example.com",
+                date: Date()
+            )
+            _ = try await storageService.saveEmail(Data("Body".utf8), email: message, accountEmail: email, folderPath: folder)
+        }
+
+        await storageService.setFlatFolderSeparator("_", for: email)
+        try await storageService.resolveFolderCollisions(accountEmail: email, folderPaths: folders)
+
+        let accountURL = tempDirectory.appendingPathComponent(email.sanitizedForFilename())
+        XCTAssertTrue(FileManager.default.fileExists(atPath: accountURL.appendingPathComponent("Work_Projects_Q1").path))
+        XCTAssertFalse(FileManager.default.fileExists(atPath: accountURL.appendingPathComponent("Work/Projects").path))
+        for (uid, folder) in zip(UInt32(1)..., folders) {
+            let existing = try await storageService.getExistingUIDs(accountEmail: email, folderPath: folder)
+            XCTAssertEqual(existing, [uid], folder)
+        }
+
+        // And back again when flattening is turned off
+        await storageService.setFlatFolderSeparator(nil, for: email)
+        try await storageService.resolveFolderCollisions(accountEmail: email, folderPaths: folders)
+
+        XCTAssertTrue(FileManager.default.fileExists(atPath: accountURL.appendingPathComponent("Work/Projects/Q1").path))
+        for (uid, folder) in zip(UInt32(1)..., folders) {
+            let existing = try await storageService.getExistingUIDs(accountEmail: email, folderPath: folder)
+            XCTAssertEqual(existing, [uid], folder)
+        }
+    }
+
     // MARK: - Email Storage Tests
 
     func testSaveEmail() async throws {
@@ -140,6 +328,405 @@ final class StorageServiceTests: XCTestCase {
         XCTAssertTrue(FileManager.default.fileExists(atPath: fileURL2.path))
     }
 
+    func testDatePartitionedLayoutSavesByMonth() async throws {
+        await storageService.setLayout(.datePartitioned)
+
+        let calendar = Calendar.current
+        let dates = [
+            calendar.date(from: DateComponents(year: 2025, month: 11, day: 15, hour: 12))!,
+            calendar.date(from: DateComponents(year: 2025, month: 12, day: 1, hour: 12))!,
+            calendar.date(from: DateComponents(year: 2026, month: 1, day: 20, hour: 12))!
+        ]
+
+        var savedURLs: [URL] = []
+        for (index, date) in dates.enumerated() {
+            let email = Email(
+                messageId: "<partition\(index)@example.com>",
+                uid: UInt32(index + 1),
+                folder: "INBOX",
+                subject: "Partition \(index)",
+                sender: "Sender",
+                senderEmail: "sender@example.com",
+                date: date
+            )
+            savedURLs.append(try await storageService.saveEmail(
+                "Email \(index)".data(using: .utf8)!,
+                email: email,
+                accountEmail: "test@example.com",
+                folderPath: "INBOX"
+            ))
+        }
+
+        let folderURL = try await storageService.createFolderDirectory(accountEmail: "test@example.com", folderPath: "INBOX")
+        XCTAssertEqual(savedURLs.map { $0.deletingLastPathComponent().path }, [
+            folderURL.appendingPathComponent("2025/11").path,
+            folderURL.appendingPathComponent("2025/12").path,
+            folderURL.appendingPathComponent("2026/01").path
+        ])
+
+        // UID cache stays at the folder level
+        var uids = try await storageService.getExistingUIDs(accountEmail: "test@example.com", folderPath: "INBOX")
+        XCTAssertEqual(uids, [1, 2, 3])
+
+        // Scanning without a cache finds partitioned files
+        try FileManager.default.removeItem(at: folderURL.appendingPathComponent(".uid_cache"))
+        uids = try await storageService.getExistingUIDs(accountEmail: "test@example.com", folderPath: "INBOX")
+        XCTAssertEqual(uids, [1, 2, 3])
+
+        let count = try await storageService.getEmailCount(for: "test@example.com")
+        XCTAssertEqual(count, 3)
+    }
+
+    func testMessageFilesSkipsSubfolders() async throws {
+        await storageService.setLayout(.datePartitioned)
+        let date = Calendar.current.date(from: DateComponents(year: 2024, month: 3, day: 5, hour: 12))!
+
+        for folder in ["INBOX", "INBOX/Sub"] {
+            let email = Email(
+                messageId: "<\(folder)@example.com>",
+                uid: 1,
+                folder: folder,
+                subject: "Test",
+                sender: "Sender",
+                senderEmail: "sender@example.com",
+                date: date
+            )
+            _ = try await storageService.saveEmail(Data("Email".utf8), email: email, accountEmail: "test@example.com", folderPath: folder)
+        }
+
+        let folderURL = try await storageService.createFolderDirectory(accountEmail: "test@example.com", folderPath: "INBOX")
+        let emails = try StorageService.messageFiles(in: folderURL).filter { $0.pathExtension == "eml" }
+
+        XCTAssertEqual(emails.count, 1)
+        XCTAssertTrue(StorageService.isDatePartition(emails[0].deletingLastPathComponent()))
+        XCTAssertEqual(StorageService.folderURL(containing: emails[0]).standardized.path, folderURL.standardized.path)
+    }
+
+    func testRecoverEmailsMissingFromUIDCache() async throws {
+        for uid: UInt32 in [1, 2, 3] {
+            let email = Email(
+                messageId: "<\(uid)@example.com>",
+                uid: uid,
+                folder: "INBOX",
+                subject: "Subject \(uid)",
+                sender: "Sender \(uid)",
+                senderEmail: "sender@example.com",
+                date: Date()
+            )
+            _ = try await storageService.saveEmail(Data("Email \(uid)".utf8), email: email, accountEmail: "test@example.com", folderPath: "INBOX")
+        }
+
+        // Lose the cache entry for UID 2 while its .eml stays
+        let folderURL = tempDirectory.appendingPathComponent("test@example.com".sanitizedForFilename()).appendingPathComponent("INBOX")
+        try "1\n3\n".write(to: folderURL.appendingPathComponent(".uid_cache"), atomically: true, encoding: .utf8)
+
+        let cached = try await storageService.getExistingUIDs(accountEmail: "test@example.com", folderPath: "INBOX")
+        XCTAssertEqual(cached, [1, 3])
+
+        // UID 2 is on disk, UID 4 really is new
+        let recovered = try await storageService.recoverUncachedUIDs([2, 4], accountEmail: "test@example.com", folderPath: "INBOX")
+        XCTAssertEqual(recovered, [2])
+
+        let repaired = try await storageService.getExistingUIDs(accountEmail: "test@example.com", folderPath: "INBOX")
+        XCTAssertEqual(repaired, [1, 2, 3])
+
+        // Nothing was written twice
+        let emlCount = try FileManager.default.contentsOfDirectory(atPath: folderURL.path).filter { $0.hasSuffix(".eml") }.count
+        XCTAssertEqual(emlCount, 3)
+    }
+
+    // MARK: - State Index Tests
+
+    private func saveTestEmail(uid: UInt32, to storage: StorageService) async throws {
+        let email = Email(
+            messageId: "<\(uid)@example.com>",
+            uid: uid,
+            folder: "INBOX",
+            subject: "Subject \(uid)",
+            sender: "Sender",
+            senderEmail: "sender@example.com",
+            date: Date()
+        )
+        _ = try await storage.saveEmail(Data("Email \(uid)".utf8), email: email, accountEmail: "test@example.com", folderPath: "INBOX")
+    }
+
+    func testSecondRunReadsStateIndexWithoutWalkingFolders() async throws {
+        // First run: nothing indexed yet, so the folder is read from disk and then tracked
+        await storageService.loadStateIndex(accountEmail: "test@example.com")
+        let firstLookup = await storageService.indexedUIDs(accountEmail: "test@example.com", folderPath: "INBOX", uidValidity: 7)
+        XCTAssertNil(firstLookup)
+        let existing = try await storageService.getExistingUIDs(accountEmail: "test@example.com", folderPath: "INBOX")
+        await storageService.updateStateIndex(existing, accountEmail: "test@example.com", folderPath: "INBOX", uidValidity: 7)
+        try await saveTestEmail(uid: 1, to: storageService)
+        try await saveTestEmail(uid: 2, to: storageService)
+        try await storageService.saveStateIndex(accountEmail: "test@example.com")
+
+        // Take the folder's files and cache away: only the index can still know the UIDs
+        let accountURL = tempDirectory.appendingPathComponent("test@example.com".sanitizedForFilename())
+        try FileManager.default.removeItem(at: accountURL.appendingPathComponent("INBOX"))
+        try FileManager.default.createDirectory(at: accountURL.appendingPathComponent("INBOX"), withIntermediateDirectories: true)
+
+        let secondRun = StorageService(baseURL: tempDirectory)
+        await secondRun.loadStateIndex(accountEmail: "test@example.com")
+        let indexed = await secondRun.indexedUIDs(accountEmail: "test@example.com", folderPath: "INBOX", uidValidity: 7)
+        XCTAssertEqual(indexed, [1, 2])
+        // Nothing was on disk before, so every UID was seen saved under this UIDVALIDITY
+        let verified = await secondRun.indexedUIDsAreVerified(accountEmail: "test@example.com", folderPath: "INBOX")
+        XCTAssertTrue(verified)
+
+        // A renumbered folder is not trusted
+        let renumbered = await secondRun.indexedUIDs(accountEmail: "test@example.com", folderPath: "INBOX", uidValidity: 8)
+        XCTAssertNil(renumbered)
+    }
+
+    func testStateIndexIsStaleAfterUnfinishedRun() async throws {
+        await storageService.loadStateIndex(accountEmail: "test@example.com")
+        await storageService.updateStateIndex([], accountEmail: "test@example.com", folderPath: "INBOX", uidValidity: 7)
+        try await saveTestEmail(uid: 1, to: storageService)
+        try await storageService.saveStateIndex(accountEmail: "test@example.com")
+
+        // A later run that was killed saved UID 2 without writing the index
+        let killedRun = StorageService(baseURL: tempDirectory)
+        try await saveTestEmail(uid: 2, to: killedRun)
+        let cacheURL = tempDirectory
+            .appendingPathComponent("test@example.com".sanitizedForFilename())
+            .appendingPathComponent("INBOX/.uid_cache")
+        try FileManager.default.setAttributes([.modificationDate: Date().addingTimeInterval(60)], ofItemAtPath: cacheURL.path)
+
+        let nextRun = StorageService(baseURL: tempDirectory)
+        await nextRun.loadStateIndex(accountEmail: "test@example.com")
+        let indexed = await nextRun.indexedUIDs(accountEmail: "test@example.com", folderPath: "INBOX", uidValidity: 7)
+        XCTAssertNil(indexed)
+        let onDisk = try await nextRun.getExistingUIDs(accountEmail: "test@example.com", folderPath: "INBOX")
+        XCTAssertEqual(onDisk, [1, 2])
+    }
+
+    // MARK: - Resume Checkpoint Tests
+
+    func testBandwidthCapWritesResumeCheckpoint() async throws {
+        let mock = MockIMAPService()
+        for uid in UInt32(1)...5 {
+            await mock.addTestEmail(to: "INBOX", uid: uid, from: "a@example.com", subject: "Mail \(uid)", body: "Body")
+        }
+        await mock.addTestEmail(to: "Sent", uid: 1, from: "a@example.com", subject: "Sent", body: "Body")
+        await mock.setBandwidthCapAfterFetches(2)
+        try await mock.connect()
+        try await mock.login(password: "test")
+
+        let pending: [(path: String, uids: [UInt32])] = [("INBOX", [1, 2, 3, 4, 5]), ("Sent", [1])]
+        _ = try await mock.selectFolder("INBOX")
+
+        var capMessage: String?
+        for uid in pending[0].uids {
+            do {
+                let data = try await mock.fetchEmail(uid: uid)
+                let email = Email(messageId: "<\(uid)@example.com>", uid: uid, folder: "INBOX", subject: "Mail \(uid)",
+                                  sender: "A", senderEmail: "a@example.com", date: Date())
+                _ = try await storageService.saveEmail(data, email: email, accountEmail: "test@example.com", folderPath: "INBOX")
+            } catch IMAPError.bandwidthLimitExceeded(let message) {
+                capMessage = message
+                break
+            }
+        }
+
+        let reason = try XCTUnwrap(capMessage)
+        let checkpoint = try await storageService.saveCheckpoint(accountEmail: "test@example.com", pending: pending, reason: reason)
+
+        XCTAssertEqual(checkpoint.folders, [
+            BackupCheckpoint.PendingFolder(path: "INBOX", uids: [3, 4, 5]),
+            BackupCheckpoint.PendingFolder(path: "Sent", uids: [1])
+        ])
+        XCTAssertEqual(checkpoint.remainingCount, 4)
+
+        let loaded = await storageService.loadCheckpoint(accountEmail: "test@example.com")
+        XCTAssertEqual(loaded?.folders, checkpoint.folders)
+        XCTAssertEqual(loaded?.reason, reason)
+
+        await storageService.clearCheckpoint(accountEmail: "test@example.com")
+        let cleared = await storageService.loadCheckpoint(accountEmail: "test@example.com")
+        XCTAssertNil(cleared)
+    }
+
+    // MARK: - Backup Report Tests
+
+    private func folderRecord(_ folder: String, runId: UUID, downloaded: Int) -> BackupReportRecord {
+        BackupReportRecord(kind: .folder, runId: runId, accountEmail: "test@example.com", folder: folder,
+                           startedAt: Date(), finishedAt: Date(), downloaded: downloaded, failed: 0,
+                           bytes: Int64(downloaded * 100), errors: [])
+    }
+
+    func testReportKeepsCompletedFoldersWhenRunIsKilled() async throws {
+        let runId = UUID()
+        try await storageService.appendReportRecord(folderRecord("INBOX", runId: runId, downloaded: 3))
+        try await storageService.appendReportRecord(folderRecord("Sent", runId: runId, downloaded: 1))
+
+        // Simulate the process dying halfway through writing the next line
+        let reportURL = await storageService.reportURL(accountEmail: "test@example.com")
+        let handle = try FileHandle(forWritingTo: reportURL)
+        try handle.seekToEnd()
+        try handle.write(contentsOf: Data(#"{"kind":"folder","runId":"#.utf8))
+        try handle.close()
+
+        let records = await storageService.loadReportRecords(accountEmail: "test@example.com")
+        XCTAssertEqual(records.map(\.folder), ["INBOX", "Sent"])
+        XCTAssertEqual(records.map(\.downloaded), [3, 1])
+        XCTAssertFalse(records.contains { $0.kind == .summary })
+    }
+
+    func testFolderRecordContainsTiming() async throws {
+        let startedAt = Date(timeIntervalSince1970: 1_760_000_000)
+        let record = BackupReportRecord(kind: .folder, runId: UUID(), accountEmail: "test@example.com", folder: "INBOX",
+                                        startedAt: startedAt, finishedAt: startedAt.addingTimeInterval(2.5),
+                                        downloaded: 10, failed: 0, bytes: 5_000_000, errors: []).withTiming()
+        try await storageService.appendReportRecord(record)
+
+        let reportURL = await storageService.reportURL(accountEmail: "test@example.com")
+        let line = try String(contentsOf: reportURL, encoding: .utf8)
+        XCTAssertTrue(line.contains(#""durationMs":2500"#))
+        XCTAssertTrue(line.contains(#""bytesPerSecond":2000000"#))
+        XCTAssertTrue(line.contains(#""downloaded":10"#))
+
+        let loaded = await storageService.loadReportRecords(accountEmail: "test@example.com")
+        XCTAssertEqual(loaded.first?.durationMs, 2500)
+        XCTAssertEqual(loaded.first?.bytesPerSecond, 2_000_000)
+    }
+
+    func testReportAppendsSummaryAsOneLinePerRecord() async throws {
+        let runId = UUID()
+        try await storageService.appendReportRecord(folderRecord("INBOX", runId: runId, downloaded: 2))
+        try await storageService.appendReportRecord(BackupReportRecord(
+            kind: .summary, runId: runId, accountEmail: "test@example.com", folder: nil,
+            startedAt: Date(), finishedAt: Date(), downloaded: 2, failed: 0, bytes: 200, errors: [],
+            status: .completed
+        ))
+
+        let reportURL = await storageService.reportURL(accountEmail: "test@example.com")
+        let lines = try String(contentsOf: reportURL, encoding: .utf8).split(separator: "\n")
+        XCTAssertEqual(lines.count, 2)
+
+        let records = await storageService.loadReportRecords(accountEmail: "test@example.com")
+        XCTAssertEqual(records.last?.kind, .summary)
+        XCTAssertEqual(records.last?.status, .completed)
+        XCTAssertTrue(records.allSatisfy { $0.runId == runId })
+    }
+
+    func testVerifySavedEmail() async throws {
+        let emailData = "Verified email content".data(using: .utf8)!
+        let email = Email(
+            messageId: "<verify@example.com>",
+            uid: 7,
+            folder: "INBOX",
+            subject: "Verify",
+            sender: "John Doe",
+            senderEmail: "john@example.com",
+            date: Date()
+        )
+
+        let fileURL = try await storageService.saveEmail(
+            emailData,
+            email: email,
+            accountEmail: "test@example.com",
+            folderPath: "INBOX"
+        )
+
+        let matches = await storageService.verifySavedEmail(at: fileURL, matches: emailData)
+        XCTAssertTrue(matches)
+
+        let sizeMatches = await storageService.verifySavedEmail(at: fileURL, expectedSize: emailData.count)
+        XCTAssertTrue(sizeMatches)
+
+        // Corrupt the file - verification must fail
+        try "Tampered".data(using: .utf8)!.write(to: fileURL)
+        let stillMatches = await storageService.verifySavedEmail(at: fileURL, matches: emailData)
+        XCTAssertFalse(stillMatches)
+    }
+
+    func testQuarantinedEmailIsNotBackedUp() async throws {
+        let email = Email(messageId: "<cut@example.com>", uid: 9, folder: "INBOX", subject: "Cut off",
+                          sender: "John Doe", senderEmail: "john@example.com", date: Date())
+
+        let url = try await storageService.quarantineEmail(
+            Data("Subject: Cut off\r\n\r\nThe first".utf8),
+            email: email,
+            accountEmail: "test@example.com",
+            folderPath: "INBOX"
+        )
+
+        XCTAssertTrue(FileManager.default.fileExists(atPath: url.path))
+        XCTAssertTrue(url.path.contains("/.quarantine/INBOX/"))
+
+        // Downloaded again next time
+        let existing = try await storageService.getExistingUIDs(accountEmail: "test@example.com", folderPath: "INBOX")
+        XCTAssertTrue(existing.isEmpty)
+        let count = try await storageService.getEmailCount(for: "test@example.com")
+        XCTAssertEqual(count, 0)
+    }
+
+    func testSameTruncatedDownloadIsQuarantinedOnce() async throws {
+        let email = Email(messageId: "<cut@example.com>", uid: 9, folder: "INBOX", subject: "Cut off",
+                          sender: "John Doe", senderEmail: "john@example.com", date: Date())
+        let cut = Data("Subject: Cut off\r\n\r\nThe first".utf8)
+
+        let first = try await storageService.quarantineEmail(cut, email: email, accountEmail: "test@example.com", folderPath: "INBOX")
+        let again = try await storageService.quarantineEmail(cut, email: email, accountEmail: "test@example.com", folderPath: "INBOX")
+        let different = try await storageService.quarantineEmail(
+            Data("Subject: Cut off\r\n\r\nThe first few".utf8),
+            email: email,
+            accountEmail: "test@example.com",
+            folderPath: "INBOX"
+        )
+
+        XCTAssertEqual(again, first)
+        XCTAssertNotEqual(different, first)
+        let files = try FileManager.default.contentsOfDirectory(atPath: first.deletingLastPathComponent().path)
+        XCTAssertEqual(files.count, 2)
+    }
+
+    // MARK: - Folder Summary Tests
+
+    func testFolderSummaryReflectsSavedMessages() async throws {
+        let oldest = Date(timeIntervalSince1970: 1_600_000_000)
+        let newest = Date(timeIntervalSince1970: 1_700_000_000)
+        let bodies = ["First", "Second email", "Third and longest email"]
+        for (index, date) in [newest, oldest, Date(timeIntervalSince1970: 1_650_000_000)].enumerated() {
+            let email = Email(messageId: "<summary\(index)@example.com>", uid: UInt32(index + 1), folder: "INBOX",
+                              subject: "Summary", sender: "John Doe", senderEmail: "john@example.com", date: date)
+            _ = try await storageService.saveEmail(Data(bodies[index].utf8), email: email,
+                                                   accountEmail: "test@example.com", folderPath: "INBOX")
+        }
+        let syncedAt = Date(timeIntervalSince1970: 1_750_000_000)
+
+        let written = try await storageService.writeFolderSummary(
+            accountEmail: "test@example.com",
+            folderPath: "INBOX",
+            uidValidity: 42,
+            syncedAt: syncedAt
+        )
+
+        let summary = try XCTUnwrap(written)
+        XCTAssertEqual(summary.folder, "INBOX")
+        XCTAssertEqual(summary.messageCount, 3)
+        XCTAssertEqual(summary.totalBytes, Int64(bodies.joined().utf8.count))
+        XCTAssertEqual(summary.oldestMessage, oldest)
+        XCTAssertEqual(summary.newestMessage, newest)
+        XCTAssertEqual(summary.uidValidity, 42)
+        XCTAssertEqual(summary.lastSync, syncedAt)
+
+        // Read back from _folder.json, which is not taken for an email
+        let stored = await storageService.folderSummary(accountEmail: "test@example.com", folderPath: "INBOX")
+        XCTAssertEqual(stored, summary)
+        let existing = try await storageService.getExistingUIDs(accountEmail: "test@example.com", folderPath: "INBOX")
+        XCTAssertEqual(existing, [1, 2, 3])
+    }
+
+    func testFolderSummaryNotWrittenForFolderNeverBackedUp() async throws {
+        let summary = try await storageService.writeFolderSummary(accountEmail: "test@example.com", folderPath: "Archive", uidValidity: nil)
+
+        XCTAssertNil(summary)
+        let stored = await storageService.folderSummary(accountEmail: "test@example.com", folderPath: "Archive")
+        XCTAssertNil(stored)
+    }
+
     // MARK: - Attachment Storage Tests
 
     func testSaveAttachment() async throws {
@@ -0,0 +1,267 @@
+import XCTest
+@testable import IMAPBackup
+
+final class TarStorageTests: XCTestCase {
+
+    var tempDirectory: URL!
+    var storage: TarStorage!
+
+    let accountEmail = "test@example.com"
+
+    override func setUp() async throws {
+        try await super.setUp()
+
+        tempDirectory = FileManager.default.temporaryDirectory
+            .appendingPathComponent(UUID().uuidString)
+        try FileManager.default.createDirectory(at: tempDirectory, withIntermediateDirectories: true)
+        storage = TarStorage(baseURL: tempDirectory)
+    }
+
+    override func tearDown() async throws {
+        try? FileManager.default.removeItem(at: tempDirectory)
+        storage = nil
+
+        try await super.tearDown()
+    }
+
+    private func email(uid: UInt32, sender: String = "Sender") -> Email {
+        Email(messageId: "m\(uid)@example.com", uid: uid, folder: "INBOX", subject: "Message \(uid)",
+              sender: sender, senderEmail: "sender@example.com", date: Date(timeIntervalSince1970: 1_760_000_000))
+    }
+
+    private func content(_ uid: UInt32) -> Data {
+        // Sizes that are not multiples of the block size, so padding is exercised
+        Data("Subject: Message \(uid)\r\n\r\n\(String(repeating: "x", count: Int(uid) * 300))\r\n".utf8)
+    }
+
+    @discardableResult
+    private func save(_ uids: [UInt32], folder: String = "INBOX") async throws -> URL? {
+        var url: URL?
+        for uid in uids {
+            url = try await storage.saveEmail(content(uid), email: email(uid: uid), accountEmail: accountEmail, folderPath: folder)
+        }
+        return url
+    }
+
+    private func fileSize(_ url: URL) throws -> Int64 {
+        try XCTUnwrap(FileManager.default.attributesOfItem(atPath: url.path)[.size] as? Int64)
+    }
+
+    // MARK: - Append and Lookup
+
+    func testAppendedEmailsAreFoundAndReadBack() async throws {
+        let archiveURL = try await save([1, 2, 3])
+
+        XCTAssertEqual(archiveURL?.lastPathComponent, TarStorage.archiveFilename)
+        let uids = try await storage.getExistingUIDs(accountEmail: accountEmail, folderPath: "INBOX")
+        XCTAssertEqual(uids, [1, 2, 3])
+        for uid in UInt32(1)...3 {
+            let data = try await storage.readEmail(uid: uid, accountEmail: accountEmail, folderPath: "INBOX")
+            XCTAssertEqual(data, content(uid))
+        }
+
+        // Entries are block aligned and the archive ends with two zero blocks
+        let entries = try await storage.entries(accountEmail: accountEmail, folderPath: "INBOX")
+        XCTAssertTrue(entries.allSatisfy { $0.offset % TarStorage.blockSize == 0 })
+        let last = try XCTUnwrap(entries.last)
+        XCTAssertEqual(try fileSize(XCTUnwrap(archiveURL)), Int64(last.offset + last.length + 2 * TarStorage.blockSize))
+    }
+
+    func testFoldersHaveTheirOwnArchive() async throws {
+        try await save([1], folder: "INBOX")
+        try await save([7], folder: "Work/Projects")
+
+        let inbox = try await storage.getExistingUIDs(accountEmail: accountEmail, folderPath: "INBOX")
+        let projects = try await storage.getExistingUIDs(accountEmail: accountEmail, folderPath: "Work/Projects")
+        let unknown = try await storage.getExistingUIDs(accountEmail: accountEmail, folderPath: "Archive")
+        XCTAssertEqual(inbox, [1])
+        XCTAssertEqual(projects, [7])
+        XCTAssertTrue(unknown.isEmpty)
+
+        let archiveURL = await storage.archiveURL(accountEmail: accountEmail, folderPath: "Work/Projects")
+        XCTAssertEqual(archiveURL.deletingLastPathComponent().lastPathComponent, "Projects")
+        let files = try FileManager.default.contentsOfDirectory(atPath: archiveURL.deletingLastPathComponent().path)
+        XCTAssertEqual(Set(files), [TarStorage.archiveFilename, TarStorage.indexFilename])
+    }
+
+    func testFoldersThatSanitizeAlikeGetTheirOwnArchive() async throws {
+        try await save([1], folder: "Project A")
+        try await save([2], folder: "Project_A")
+
+        let spaced = try await storage.getExistingUIDs(accountEmail: accountEmail, folderPath: "Project A")
+        let underscored = try await storage.getExistingUIDs(accountEmail: accountEmail, folderPath: "Project_A")
+        XCTAssertEqual(spaced, [1])
+        XCTAssertEqual(underscored, [2])
+
+        // The directories are recorded, so a new instance finds each folder where it was stored
+        let reopened = TarStorage(baseURL: tempDirectory)
+        let archiveURL = await reopened.archiveURL(accountEmail: accountEmail, folderPath: "Project_A")
+        XCTAssertEqual(archiveURL.deletingLastPathComponent().lastPathComponent, "Project_A_2")
+        let data = try await reopened.readEmail(uid: 2, accountEmail: accountEmail, folderPath: "Project_A")
+        XCTAssertEqual(data, content(2))
+    }
+
+    func testIndexIsReadBackByANewInstance() async throws {
+        try await save([1, 2])
+        try await storage.removeEmails([1], accountEmail: accountEmail, folderPath: "INBOX")
+
+        let reopened = TarStorage(baseURL: tempDirectory)
+        let uids = try await reopened.getExistingUIDs(accountEmail: accountEmail, folderPath: "INBOX")
+        XCTAssertEqual(uids, [2])
+
+        // Appending continues after the removed entry's bytes, which stay until compaction
+        try await reopened.saveEmail(content(3), email: email(uid: 3), accountEmail: accountEmail, folderPath: "INBOX")
+        let data = try await reopened.readEmail(uid: 2, accountEmail: accountEmail, folderPath: "INBOX")
+        XCTAssertEqual(data, content(2))
+        let third = try await reopened.readEmail(uid: 3, accountEmail: accountEmail, folderPath: "INBOX")
+        XCTAssertEqual(third, content(3))
+    }
+
+    func testMissingEmailThrows() async throws {
+        try await save([1])
+
+        do {
+            _ = try await storage.readEmail(uid: 9, accountEmail: accountEmail, folderPath: "INBOX")
+            XCTFail("Expected entryMissing")
+        } catch TarStorageError.entryMissing(let uid) {
+            XCTAssertEqual(uid, 9)
+        }
+    }
+
+    func testBackupEngineWritesThroughTheBackend() async throws {
+        let service = MockIMAPService()
+        for uid in UInt32(1)...3 {
+            await service.addTestEmail(to: "INBOX", uid: uid, from: "sender@example.com", subject: "Message \(uid)", body: "Body")
+        }
+        let account = EmailAccount(email: accountEmail, imapServer: "imap.example.com", username: "test")
+        let engine = BackupEngine(storage: storage, makeService: { _ in service })
+
+        let first = try await engine.backUp(account, password: "secret")
+        let second = try await engine.backUp(account, password: "secret")
+
+        XCTAssertEqual(first.downloadedEmails, 3)
+        XCTAssertEqual(second.downloadedEmails, 0)
+        let entries = try await storage.entries(accountEmail: accountEmail, folderPath: "INBOX")
+        XCTAssertEqual(entries.map(\.uid), [1, 2, 3])
+    }
+
+    // MARK: - Compaction
+
+    func testCompactionDropsRemovedEmails() async throws {
+        let saved = try await save([1, 2, 3, 4])
+        let archiveURL = try XCTUnwrap(saved)
+        let sizeBefore = try fileSize(archiveURL)
+
+        let removed = try await storage.removeEmails([2, 4, 99], accountEmail: accountEmail, folderPath: "INBOX")
+        XCTAssertEqual(removed, 2)
+        XCTAssertEqual(try fileSize(archiveURL), sizeBefore)
+
+        let freed = try await storage.compact(accountEmail: accountEmail, folderPath: "INBOX")
+
+        XCTAssertEqual(try fileSize(archiveURL), sizeBefore - freed)
+        XCTAssertGreaterThan(freed, 0)
+        let entries = try await storage.entries(accountEmail: accountEmail, folderPath: "INBOX")
+        XCTAssertEqual(entries.map(\.uid), [1, 3])
+        XCTAssertEqual(entries.first?.offset, 0)
+
+        // The compacted index is what a new instance reads
+        let reopened = TarStorage(baseURL: tempDirectory)
+        for uid: UInt32 in [1, 3] {
+            let data = try await reopened.readEmail(uid: uid, accountEmail: accountEmail, folderPath: "INBOX")
+            XCTAssertEqual(data, content(uid))
+        }
+        let uids = try await reopened.getExistingUIDs(accountEmail: accountEmail, folderPath: "INBOX")
+        XCTAssertEqual(uids, [1, 3])
+        let leftovers = try FileManager.default.contentsOfDirectory(atPath: archiveURL.deletingLastPathComponent().path)
+        XCTAssertEqual(Set(leftovers), [TarStorage.archiveFilename, TarStorage.indexFilename])
+    }
+
+    func testCompactingEverythingAwayLeavesAnEmptyArchive() async throws {
+        let saved = try await save([1, 2])
+        let archiveURL = try XCTUnwrap(saved)
+        try await storage.removeEmails([1, 2], accountEmail: accountEmail, folderPath: "INBOX")
+
+        try await storage.compact(accountEmail: accountEmail, folderPath: "INBOX")
+
+        XCTAssertEqual(try fileSize(archiveURL), Int64(2 * TarStorage.blockSize))
+        let reopened = TarStorage(baseURL: tempDirectory)
+        let uids = try await reopened.getExistingUIDs(accountEmail: accountEmail, folderPath: "INBOX")
+        XCTAssertTrue(uids.isEmpty)
+    }
+
+    // MARK: - Index Recovery
+
+    func testLostIndexIsRebuiltFromTheArchive() async throws {
+        let saved = try await save([1, 2, 3])
+        let archiveURL = try XCTUnwrap(saved)
+        try FileManager.default.removeItem(at: archiveURL.deletingLastPathComponent().appendingPathComponent(TarStorage.indexFilename))
+
+        let reopened = TarStorage(baseURL: tempDirectory)
+        let uids = try await reopened.getExistingUIDs(accountEmail: accountEmail, folderPath: "INBOX")
+        XCTAssertEqual(uids, [1, 2, 3])
+        let data = try await reopened.readEmail(uid: 2, accountEmail: accountEmail, folderPath: "INBOX")
+        XCTAssertEqual(data, content(2))
+    }
+
+    func testIndexOfAnotherArchiveIsRebuilt() async throws {
+        let saved = try await save([1, 2, 3])
+        let archiveURL = try XCTUnwrap(saved)
+        let indexURL = archiveURL.deletingLastPathComponent().appendingPathComponent(TarStorage.indexFilename)
+        let staleIndex = try Data(contentsOf: indexURL)
+
+        // As after a crash between moving the compacted archive and its index into place
+        try await storage.removeEmails([1], accountEmail: accountEmail, folderPath: "INBOX")
+        try await storage.compact(accountEmail: accountEmail, folderPath: "INBOX")
+        try staleIndex.write(to: indexURL)
+
+        let reopened = TarStorage(baseURL: tempDirectory)
+        let entries = try await reopened.entries(accountEmail: accountEmail, folderPath: "INBOX")
+        XCTAssertEqual(entries.map(\.uid), [2, 3])
+        let data = try await reopened.readEmail(uid: 3, accountEmail: accountEmail, folderPath: "INBOX")
+        XCTAssertEqual(data, content(3))
+    }
+
+    func testEntryWithoutIndexLineIsOverwritten() async throws {
+        let saved = try await save([1])
+        let archiveURL = try XCTUnwrap(saved)
+        let indexURL = archiveURL.deletingLastPathComponent().appendingPathComponent(TarStorage.indexFilename)
+        let indexBefore = try Data(contentsOf: indexURL)
+
+        // As after a crash between writing the archive and the index
+        try await save([2])
+        try indexBefore.write(to: indexURL)
+
+        let reopened = TarStorage(baseURL: tempDirectory)
+        try await reopened.saveEmail(content(3), email: email(uid: 3), accountEmail: accountEmail, folderPath: "INBOX")
+
+        let entries = try await reopened.entries(accountEmail: accountEmail, folderPath: "INBOX")
+        XCTAssertEqual(entries.map(\.uid), [1, 3])
+        let last = try XCTUnwrap(entries.last)
+        XCTAssertEqual(try fileSize(archiveURL), Int64(last.offset + last.length + 2 * TarStorage.blockSize))
+    }
+
+    // MARK: - Tar Format
+
+    func testHeaderRoundTrips() {
+        let header = TarStorage.header(name: "1_20251009_120000_Sender.eml", size: 1234, modified: Date(timeIntervalSince1970: 1_760_000_000))
+
+        XCTAssertEqual(header.count, 512)
+        XCTAssertEqual(String(decoding: header[257..<262], as: UTF8.self), "ustar")
+        let parsed = TarStorage.parseHeader(header)
+        XCTAssertEqual(parsed?.name, "1_20251009_120000_Sender.eml")
+        XCTAssertEqual(parsed?.size, 1234)
+
+        var damaged = header
+        damaged[0] ^= 1
+        XCTAssertNil(TarStorage.parseHeader(damaged))
+        XCTAssertNil(TarStorage.parseHeader(Data(count: 512)))
+    }
+
+    func testLongNamesAreShortenedToFit() {
+        let name = TarStorage.entryName(for: email(uid: 42, sender: String(repeating: "Ä", count: 80)))
+
+        XCTAssertLessThanOrEqual(name.utf8.count, 100)
+        XCTAssertTrue(name.hasSuffix(".eml"))
+        XCTAssertEqual(TarStorage.uid(fromEntryName: name), 42)
+    }
+}
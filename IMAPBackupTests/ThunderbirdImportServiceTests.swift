@@ -0,0 +1,148 @@
+import XCTest
+@testable import IMAPBackup
+
+final class ThunderbirdImportServiceTests: XCTestCase {
+
+    var tempDirectory: URL!
+
+    override func setUp() async throws {
+        try await super.setUp()
+
+        tempDirectory = FileManager.default.temporaryDirectory
+            .appendingPathComponent(UUID().uuidString)
+        try FileManager.default.createDirectory(at: tempDirectory, withIntermediateDirectories: true)
+    }
+
+    override func tearDown() async throws {
+        try? FileManager.default.removeItem(at: tempDirectory)
+        try await super.tearDown()
+    }
+
+    /// A Thunderbird directory with one relative profile holding `prefs`
+    private func writeFixture(prefs: String) throws {
+        try Data("""
+        [Install4F96D1932A9F858E]
+        Default=Profiles/k3x9.default-release
+        Locked=1
+
+        [Profile0]
+        Name=default-release
+        IsRelative=1
+        Path=Profiles/k3x9.default-release
+        Default=1
+
+        [General]
+        StartWithLastProfile=1
+        Version=2
+        """.utf8).write(to: tempDirectory.appendingPathComponent("profiles.ini"))
+
+        let profileURL = tempDirectory.appendingPathComponent("Profiles/k3x9.default-release")
+        try FileManager.default.createDirectory(at: profileURL, withIntermediateDirectories: true)
+        try Data(prefs.utf8).write(to: profileURL.appendingPathComponent("prefs.js"))
+    }
+
+    // MARK: - Discovery
+
+    func testFixtureProfileYieldsIMAPAccounts() throws {
+        try writeFixture(prefs: #"""
+        // Mozilla User Preferences
+        user_pref("mail.accountmanager.accounts", "account1,account2,account3,account4");
+        user_pref("mail.account.account1.identities", "id1");
+        user_pref("mail.account.account1.server", "server1");
+        user_pref("mail.account.account2.identities", "id2");
+        user_pref("mail.account.account2.server", "server2");
+        user_pref("mail.account.account3.server", "server3");
+        user_pref("mail.account.account4.server", "server4");
+        user_pref("mail.identity.id1.useremail", "jane@example.com");
+        user_pref("mail.identity.id2.useremail", "jane@gmail.com");
+        user_pref("mail.server.server1.hostname", "imap.example.com");
+        user_pref("mail.server.server1.name", "Work \"Jane\"");
+        user_pref("mail.server.server1.port", 993);
+        user_pref("mail.server.server1.socketType", 3);
+        user_pref("mail.server.server1.type", "imap");
+        user_pref("mail.server.server1.userName", "jdoe");
+        user_pref("mail.server.server2.authMethod", 10);
+        user_pref("mail.server.server2.hostname", "imap.gmail.com");
+        user_pref("mail.server.server2.port", 993);
+        user_pref("mail.server.server2.socketType", 3);
+        user_pref("mail.server.server2.type", "imap");
+        user_pref("mail.server.server2.userName", "jane@gmail.com");
+        user_pref("mail.server.server3.hostname", "mail.legacy.org");
+        user_pref("mail.server.server3.port", 143);
+        user_pref("mail.server.server3.socketType", 2);
+        user_pref("mail.server.server3.type", "imap");
+        user_pref("mail.server.server3.userName", "jane@legacy.org");
+        user_pref("mail.server.server4.hostname", "Local Folders");
+        user_pref("mail.server.server4.type", "none");
+        user_pref("mail.server.server4.userName", "nobody");
+        user_pref("mail.server.server9.hostname", "deleted.example.com");
+        user_pref("mail.server.server9.type", "imap");
+        user_pref("mail.server.server9.userName", "gone@example.com");
+        """#)
+
+        let discovered = ThunderbirdImportService.discoverAccounts(directory: tempDirectory)
+
+        XCTAssertEqual(discovered.map(\.username), ["jane@example.com", "jane@gmail.com", "jane@legacy.org"])
+        XCTAssertEqual(discovered[0].hostname, "imap.example.com")
+        XCTAssertEqual(discovered[0].port, 993)
+        XCTAssertTrue(discovered[0].useSSL)
+        XCTAssertEqual(discovered[0].accountDescription, "Work \"Jane\"")
+        XCTAssertFalse(discovered[0].isGoogle)
+        XCTAssertTrue(discovered[1].isGoogle)
+        // STARTTLS is taken over to TLS on the IMAPS port
+        XCTAssertEqual(discovered[2].port, 993)
+        XCTAssertTrue(discovered[2].useSSL)
+
+        let importable = MacAccountImportService.importableAccounts(from: discovered, existing: [])
+        XCTAssertEqual(importable.map(\.imapServer), ["imap.example.com", "imap.gmail.com", "mail.legacy.org"])
+        XCTAssertEqual(importable[1].authType, .oauth2)
+        XCTAssertFalse(importable.contains { $0.hasTemporaryPassword })
+    }
+
+    func testMissingThunderbirdDirectoryFindsNothing() {
+        let discovered = ThunderbirdImportService.discoverAccounts(directory: tempDirectory.appendingPathComponent("missing"))
+
+        XCTAssertTrue(discovered.isEmpty)
+    }
+
+    // MARK: - Parsing
+
+    func testProfilesIniResolvesRelativeAndAbsolutePaths() {
+        let ini = """
+        [Profile1]
+        Name=work
+        IsRelative=0
+        Path=/Volumes/Data/thunderbird-work
+
+        [Profile0]
+        Name=default
+        IsRelative=1
+        Path=Profiles/abcd.default
+
+        [Install123]
+        Default=Profiles/abcd.default
+        """
+
+        let directories = ThunderbirdImportService.profileDirectories(fromProfilesIni: ini, relativeTo: tempDirectory)
+
+        XCTAssertEqual(directories.map(\.path), [
+            "/Volumes/Data/thunderbird-work",
+            tempDirectory.appendingPathComponent("Profiles/abcd.default").standardizedFileURL.path
+        ])
+    }
+
+    func testPrefsParserHandlesEscapesAndNonStringValues() {
+        let prefs = ThunderbirdImportService.parsePrefs(#"""
+        user_pref("mail.server.server1.name", "Say \"hi\", C:\\Mail");
+        user_pref("mail.server.server1.port", 993);
+        user_pref("mail.server.server1.check_new_mail", true);
+        // user_pref("commented.out", "no");
+        not a pref line
+        """#)
+
+        XCTAssertEqual(prefs["mail.server.server1.name"], #"Say "hi", C:\Mail"#)
+        XCTAssertEqual(prefs["mail.server.server1.port"], "993")
+        XCTAssertEqual(prefs["mail.server.server1.check_new_mail"], "true")
+        XCTAssertNil(prefs["commented.out"])
+    }
+}
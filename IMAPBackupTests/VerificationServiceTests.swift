@@ -57,6 +57,24 @@ final class VerificationServiceTests: XCTestCase {
         XCTAssertEqual(result.synced.count, 3)
     }
 
+    func testFolderVerificationResultCorruptAttachments() {
+        let result = FolderVerificationResult(
+            folderName: "INBOX",
+            serverUIDs: Set([1, 2]),
+            localUIDs: Set([1, 2]),
+            corruptAttachments: [
+                AttachmentIntegrityIssue(fileURL: URL(fileURLWithPath: "/tmp/a.pdf"), kind: .checksumMismatch)
+            ]
+        )
+
+        XCTAssertFalse(result.isFullySynced)
+        XCTAssertTrue(result.summary.contains("1 corrupt attachments"))
+
+        let account = AccountVerificationResult(accountEmail: "test@example.com", folderResults: [result], verifiedAt: Date())
+        XCTAssertEqual(account.totalCorruptAttachments, 1)
+        XCTAssertTrue(account.summary.contains("1 corrupt attachments"))
+    }
+
     func testFolderVerificationResultEmptySets() {
         let result = FolderVerificationResult(
             folderName: "INBOX",
@@ -251,4 +269,83 @@ final class VerificationServiceTests: XCTestCase {
 
         XCTAssertTrue(service.lastResults.isEmpty)
     }
+
+    // MARK: - Incremental Attachment Verification
+
+    /// Two emails with one attachment each whose attachment files were then damaged;
+    /// the first one's metadata dates from before the last verification
+    private func makeDamagedFolder(in directory: URL, lastVerified: Date) async throws -> StorageService {
+        let storageService = StorageService(baseURL: directory)
+        let attachmentService = AttachmentService()
+
+        for uid: UInt32 in [1, 2] {
+            let email = Email(messageId: "m\(uid)@example.com", uid: uid, folder: "INBOX", subject: "Email \(uid)",
+                              sender: "Sender", senderEmail: "sender@example.com", date: Date())
+            let emailURL = try await storageService.saveEmail(Data("Subject: \(uid)".utf8), email: email,
+                                                              accountEmail: "test@example.com", folderPath: "INBOX")
+            try await attachmentService.saveAttachments(
+                [AttachmentService.Attachment(filename: "a\(uid).txt", contentType: "text/plain", data: Data("original".utf8))],
+                for: emailURL
+            )
+            try Data("damaged!".utf8).write(to: AttachmentMetadata.folderURL(for: emailURL).appendingPathComponent("a\(uid).txt"))
+
+            if uid == 1 {
+                try FileManager.default.setAttributes(
+                    [.modificationDate: lastVerified.addingTimeInterval(-86_400)],
+                    ofItemAtPath: AttachmentMetadata.sidecarURL(for: emailURL).path
+                )
+            }
+        }
+
+        try await storageService.recordVerification(at: lastVerified, accountEmail: "test@example.com", folderPath: "INBOX")
+        return storageService
+    }
+
+    func testIncrementalVerificationChecksOnlyNewFiles() async throws {
+        let directory = FileManager.default.temporaryDirectory.appendingPathComponent(UUID().uuidString)
+        defer { try? FileManager.default.removeItem(at: directory) }
+        let lastVerified = Date().addingTimeInterval(-3600)
+        let storageService = try await makeDamagedFolder(in: directory, lastVerified: lastVerified)
+
+        let since = await storageService.lastVerification(accountEmail: "test@example.com", folderPath: "INBOX")
+        XCTAssertEqual(since.map { Int($0.timeIntervalSince1970) }, Int(lastVerified.timeIntervalSince1970))
+
+        let issues = try await storageService.verifyAttachments(accountEmail: "test@example.com", folderPath: "INBOX", since: since)
+
+        XCTAssertEqual(issues.map { $0.fileURL.lastPathComponent }, ["a2.txt"])
+    }
+
+    func testAttachmentVerificationStopsWhenCancelled() async throws {
+        let directory = FileManager.default.temporaryDirectory.appendingPathComponent(UUID().uuidString)
+        defer { try? FileManager.default.removeItem(at: directory) }
+        let storageService = try await makeDamagedFolder(in: directory, lastVerified: Date().addingTimeInterval(-3600))
+
+        let result = await Task {
+            withUnsafeCurrentTask { $0?.cancel() }
+            return try await storageService.verifyAttachments(accountEmail: "test@example.com", folderPath: "INBOX", since: nil)
+        }.result
+
+        XCTAssertThrowsError(try result.get()) { error in
+            XCTAssertTrue(error is CancellationError)
+        }
+    }
+
+    func testFullVerificationChecksEverything() async throws {
+        let directory = FileManager.default.temporaryDirectory.appendingPathComponent(UUID().uuidString)
+        defer { try? FileManager.default.removeItem(at: directory) }
+        let storageService = try await makeDamagedFolder(in: directory, lastVerified: Date().addingTimeInterval(-3600))
+
+        let issues = try await storageService.verifyAttachments(accountEmail: "test@example.com", folderPath: "INBOX", since: nil)
+
+        XCTAssertEqual(Set(issues.map { $0.fileURL.lastPathComponent }), ["a1.txt", "a2.txt"])
+    }
+
+    func testFolderNeverVerifiedHasNoDate() async throws {
+        let directory = FileManager.default.temporaryDirectory.appendingPathComponent(UUID().uuidString)
+        defer { try? FileManager.default.removeItem(at: directory) }
+
+        let storageService = StorageService(baseURL: directory)
+        let date = await storageService.lastVerification(accountEmail: "test@example.com", folderPath: "INBOX")
+        XCTAssertNil(date)
+    }
 }